@@ -0,0 +1,269 @@
+//! Benchmarks for the messaging hot path, below the HTTP layer: sending into
+//! a group, fanning the message out to the members' Redis channels, and
+//! reading a page of history. They run against PostgreSQL and Redis from
+//! `make dev`, in a scratch database that is created, migrated and dropped
+//! by the run, so `DATABASE_URL` needs a role that can create databases.
+//!
+//!     cargo bench --bench messaging
+//!
+//! The k6 scenario in `loadtest/` measures the same paths end to end.
+
+use std::time::{Duration, Instant};
+
+use ansible_talk_backend::{
+    config::Config,
+    models::MessageType,
+    services::{
+        archives::ArchiveService, circuit_breaker::Breakers, limits::LimitsService,
+        messaging::MessagingService, outbox::OutboxService,
+    },
+    storage::{minio::MinioClient, redis::RedisClient},
+};
+use criterion::Criterion;
+use futures::StreamExt;
+use redis::aio::PubSub;
+use sqlx::{
+    postgres::{PgConnectOptions, PgPoolOptions},
+    Executor, PgPool,
+};
+use tokio::{runtime::Runtime, sync::Mutex};
+use uuid::Uuid;
+
+/// Members per group, as in the k6 scenario
+const GROUP_SIZE: usize = 10;
+/// Messages per history page
+const PAGE_SIZE: i32 = 50;
+/// Size of the ciphertext sent, about a short text message
+const CONTENT_SIZE: usize = 256;
+
+/// A group whose members all have the sender as a contact, in a database of
+/// its own with the spam policy off
+struct Fixture {
+    config: Config,
+    admin: PgPool,
+    database: String,
+    db: PgPool,
+    redis: RedisClient,
+    minio: MinioClient,
+    sender: Uuid,
+    members: Vec<Uuid>,
+    conversation_id: Uuid,
+}
+
+impl Fixture {
+    async fn setup() -> Self {
+        let config = Config::load();
+        let url = config.database_url();
+        let admin = PgPoolOptions::new()
+            .max_connections(1)
+            .connect(&url)
+            .await
+            .expect("PostgreSQL is not reachable; start it with `make dev`");
+        let database = format!("ansible_talk_bench_{}", std::process::id());
+        admin
+            .execute(format!("CREATE DATABASE {}", database).as_str())
+            .await
+            .unwrap();
+
+        let options = url.parse::<PgConnectOptions>().unwrap().database(&database);
+        let db = PgPoolOptions::new().connect_with(options).await.unwrap();
+        sqlx::migrate!("./migrations").run(&db).await.unwrap();
+        // The policy would throttle a benchmark's send rate
+        sqlx::query("UPDATE spam_settings SET enabled = false")
+            .execute(&db)
+            .await
+            .unwrap();
+
+        let redis = RedisClient::new(&config.redis_url(), None).await.unwrap();
+        let minio = MinioClient::new(&config.minio, Breakers::new(&config.breaker).minio)
+            .await
+            .unwrap();
+
+        let mut users = Vec::with_capacity(GROUP_SIZE);
+        for i in 0..GROUP_SIZE {
+            users.push(create_user(&db, &format!("bench_{}", i)).await);
+        }
+        let sender = users[0];
+        let members = users[1..].to_vec();
+
+        // Otherwise the group arrives as a message request
+        sqlx::query("INSERT INTO contacts (user_id, contact_id) SELECT unnest($1::uuid[]), $2")
+            .bind(&members)
+            .bind(sender)
+            .execute(&db)
+            .await
+            .unwrap();
+
+        let limits = LimitsService::new(db.clone(), config.limits.clone());
+        let conversation = MessagingService::new(db.clone(), redis.clone())
+            .create_group_conversation(sender, "Benchmark", members.clone(), None, &limits)
+            .await
+            .unwrap();
+
+        let fixture = Self {
+            config,
+            admin,
+            database,
+            db,
+            redis,
+            minio,
+            sender,
+            members,
+            conversation_id: conversation.conversation.id,
+        };
+
+        // A full page of history for `get_messages`, whichever benchmarks run
+        let messaging = fixture.messaging();
+        for _ in 0..PAGE_SIZE {
+            fixture.send(&messaging).await;
+        }
+
+        fixture
+    }
+
+    fn messaging(&self) -> MessagingService {
+        MessagingService::new(self.db.clone(), self.redis.clone())
+    }
+
+    async fn send(&self, messaging: &MessagingService) -> Uuid {
+        messaging
+            .send_message(
+                self.conversation_id,
+                self.sender,
+                MessageType::Text,
+                vec![0x5a; CONTENT_SIZE],
+                None,
+                None,
+                None,
+            )
+            .await
+            .unwrap()
+            .id
+    }
+
+    async fn teardown(self) {
+        self.db.close().await;
+        self.admin
+            .execute(format!("DROP DATABASE {} WITH (FORCE)", self.database).as_str())
+            .await
+            .unwrap();
+    }
+}
+
+async fn create_user(db: &PgPool, username: &str) -> Uuid {
+    sqlx::query_scalar(
+        r#"
+        INSERT INTO users (username, display_name, email)
+        VALUES ($1, $1, $1 || '@example.com')
+        RETURNING id
+        "#,
+    )
+    .bind(username)
+    .fetch_one(db)
+    .await
+    .unwrap()
+}
+
+/// Store a message and queue its events for the other members
+fn send_message(c: &mut Criterion, runtime: &Runtime, fixture: &Fixture) {
+    let messaging = fixture.messaging();
+
+    c.bench_function(&format!("send_message/group_of_{}", GROUP_SIZE), |b| {
+        b.to_async(runtime).iter(|| fixture.send(&messaging));
+    });
+}
+
+/// From a stored message to every other member's Redis subscription: one
+/// outbox dispatch, then a receive per member. Sending isn't timed.
+fn fan_out(c: &mut Criterion, runtime: &Runtime, fixture: &Fixture) {
+    let messaging = fixture.messaging();
+    let outbox = OutboxService::new(fixture.db.clone(), fixture.redis.clone());
+    let subscriptions = runtime.block_on(async {
+        // Events queued by earlier benchmarks would go out first
+        sqlx::query("UPDATE outbox_events SET delivered_at = NOW() WHERE delivered_at IS NULL")
+            .execute(&fixture.db)
+            .await
+            .unwrap();
+
+        let mut subscriptions = Vec::with_capacity(fixture.members.len());
+        for member in &fixture.members {
+            let subscription = fixture
+                .redis
+                .subscribe_messages(&member.to_string())
+                .await
+                .unwrap();
+            subscriptions.push(subscription);
+        }
+        Mutex::new(subscriptions)
+    });
+    let (messaging, outbox, subscriptions) = (&messaging, &outbox, &subscriptions);
+
+    c.bench_function(&format!("fan_out/group_of_{}", GROUP_SIZE), |b| {
+        b.to_async(runtime).iter_custom(|iters| async move {
+            let mut subscriptions = subscriptions.lock().await;
+            let mut elapsed = Duration::ZERO;
+            for _ in 0..iters {
+                let message_id = fixture.send(messaging).await.to_string();
+
+                let start = Instant::now();
+                outbox.dispatch_batch().await.unwrap();
+                for subscription in subscriptions.iter_mut() {
+                    receive(subscription, &message_id).await;
+                }
+                elapsed += start.elapsed();
+            }
+            elapsed
+        });
+    });
+}
+
+/// Wait for an event about `message_id` on `subscription`
+async fn receive(subscription: &mut PubSub, message_id: &str) {
+    let mut events = subscription.on_message();
+    while let Some(event) = events.next().await {
+        let payload: String = event.get_payload().unwrap();
+        if payload.contains(message_id) {
+            return;
+        }
+    }
+    panic!("Redis subscription closed");
+}
+
+/// The newest page of history, as the sender
+fn get_messages(c: &mut Criterion, runtime: &Runtime, fixture: &Fixture) {
+    let messaging = fixture.messaging();
+    let archives = ArchiveService::new(
+        fixture.db.clone(),
+        fixture.minio.clone(),
+        fixture.config.archive.clone(),
+    );
+
+    c.bench_function(&format!("get_messages/page_of_{}", PAGE_SIZE), |b| {
+        b.to_async(runtime).iter(|| async {
+            messaging
+                .get_messages(
+                    fixture.conversation_id,
+                    fixture.sender,
+                    PAGE_SIZE,
+                    0,
+                    None,
+                    &archives,
+                )
+                .await
+                .unwrap()
+        });
+    });
+}
+
+fn main() {
+    let runtime = Runtime::new().unwrap();
+    let fixture = runtime.block_on(Fixture::setup());
+    let mut criterion = Criterion::default().configure_from_args();
+
+    send_message(&mut criterion, &runtime, &fixture);
+    fan_out(&mut criterion, &runtime, &fixture);
+    get_messages(&mut criterion, &runtime, &fixture);
+
+    criterion.final_summary();
+    runtime.block_on(fixture.teardown());
+}
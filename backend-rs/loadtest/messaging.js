@@ -0,0 +1,143 @@
+// k6 load test for the messaging hot path: sending, WebSocket fan-out and
+// history reads. Thresholds are the performance budgets; k6 exits non-zero
+// when one is missed.
+//
+//   loadtest/run.sh                      # full load
+//   K6_PROFILE=smoke loadtest/run.sh     # quick CI check
+//
+// Seed users first with loadtest/seed.sh. run.sh turns the spam policy off
+// for the length of the run and restores it afterwards.
+
+import http from 'k6/http';
+import ws from 'k6/ws';
+import { check, sleep } from 'k6';
+import exec from 'k6/execution';
+import { SharedArray } from 'k6/data';
+import { Counter, Trend } from 'k6/metrics';
+
+const BASE_URL = __ENV.BASE_URL || 'http://localhost:8080/api/v1';
+const WS_URL = __ENV.WS_URL || BASE_URL.replace(/^http/, 'ws') + '/ws';
+const GROUP_SIZE = parseInt(__ENV.GROUP_SIZE || '10', 10);
+const SMOKE = __ENV.K6_PROFILE === 'smoke';
+
+const users = new SharedArray('users', () => JSON.parse(open(__ENV.TOKENS || './tokens.json')));
+
+const fanoutLatency = new Trend('ws_fanout_latency', true);
+const fanoutDelivered = new Counter('ws_fanout_delivered');
+
+// Budgets for the hot path, measured against the docker-compose stack
+export const BUDGETS = {
+  'http_req_duration{endpoint:send_message}': ['p(95)<150', 'p(99)<400'],
+  'http_req_duration{endpoint:get_messages}': ['p(95)<100', 'p(99)<250'],
+  ws_fanout_latency: ['p(95)<250', 'p(99)<750'],
+  http_req_failed: ['rate<0.01'],
+};
+
+const full = {
+  senders: { executor: 'constant-arrival-rate', rate: 200, timeUnit: '1s', duration: '5m', preAllocatedVUs: 50 },
+  readers: { executor: 'constant-vus', vus: 20, duration: '5m' },
+  receivers: { duration: '5m' },
+};
+
+const smoke = {
+  senders: { executor: 'constant-arrival-rate', rate: 10, timeUnit: '1s', duration: '30s', preAllocatedVUs: 5 },
+  readers: { executor: 'constant-vus', vus: 2, duration: '30s' },
+  receivers: { duration: '30s' },
+};
+
+const profile = SMOKE ? smoke : full;
+
+export const options = {
+  scenarios: {
+    send_message: { ...profile.senders, exec: 'sendMessage' },
+    get_messages: { ...profile.readers, exec: 'getMessages' },
+    ws_fanout: {
+      executor: 'per-vu-iterations',
+      vus: SMOKE ? Math.min(5, users.length) : users.length,
+      iterations: 1,
+      maxDuration: profile.receivers.duration,
+      exec: 'receive',
+    },
+  },
+  thresholds: BUDGETS,
+};
+
+function headers(user) {
+  return {
+    headers: {
+      'Content-Type': 'application/json',
+      Authorization: `Bearer ${user.access_token}`,
+    },
+  };
+}
+
+// One group per GROUP_SIZE users, created by its first member
+export function setup() {
+  if (users.length < GROUP_SIZE) {
+    throw new Error(`Need at least GROUP_SIZE (${GROUP_SIZE}) seeded users`);
+  }
+
+  const groups = [];
+  for (let i = 0; i + GROUP_SIZE <= users.length; i += GROUP_SIZE) {
+    const members = users.slice(i, i + GROUP_SIZE);
+    const res = http.post(
+      `${BASE_URL}/conversations/group`,
+      JSON.stringify({ name: `load test ${i / GROUP_SIZE}`, member_ids: members.slice(1).map((u) => u.user_id) }),
+      headers(members[0]),
+    );
+    check(res, { 'group created': (r) => r.status === 200 });
+    groups.push({ id: res.json('id'), members: members.map((_, j) => i + j) });
+  }
+
+  return { groups };
+}
+
+function pick(list) {
+  return list[Math.floor(Math.random() * list.length)];
+}
+
+export function sendMessage(data) {
+  const group = pick(data.groups);
+  const sender = users[pick(group.members)];
+
+  // Opaque to the server, like real ciphertext
+  const content = Array.from(`load test ${Date.now()}`, (c) => c.charCodeAt(0));
+  const res = http.post(
+    `${BASE_URL}/conversations/${group.id}/messages`,
+    JSON.stringify({ type: 'text', content }),
+    { ...headers(sender), tags: { endpoint: 'send_message' } },
+  );
+  check(res, { 'message sent': (r) => r.status === 200 });
+}
+
+export function getMessages(data) {
+  const group = pick(data.groups);
+  const reader = users[pick(group.members)];
+
+  const res = http.get(`${BASE_URL}/conversations/${group.id}/messages?limit=50`, {
+    ...headers(reader),
+    tags: { endpoint: 'get_messages' },
+  });
+  check(res, { 'history read': (r) => r.status === 200 });
+  sleep(1);
+}
+
+// Each receiver holds a socket for the whole run and measures how long
+// new messages take to arrive after the server stored them
+export function receive() {
+  const user = users[exec.scenario.iterationInTest];
+  const duration = SMOKE ? 30 : 300;
+
+  ws.connect(WS_URL, { headers: { Authorization: `Bearer ${user.access_token}` } }, (socket) => {
+    socket.on('message', (raw) => {
+      const msg = JSON.parse(raw);
+      if (msg.type !== 'new_message') return;
+
+      fanoutDelivered.add(1);
+      fanoutLatency.add(Date.now() - Date.parse(msg.payload.created_at));
+    });
+
+    socket.setInterval(() => socket.send(JSON.stringify({ type: 'ping', payload: {} })), 25000);
+    socket.setTimeout(() => socket.close(), duration * 1000);
+  });
+}
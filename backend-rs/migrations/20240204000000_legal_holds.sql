@@ -0,0 +1,37 @@
+-- Migration: legal_holds
+-- Description: Audit log and legal holds for compliance
+
+-- Audit log
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    action VARCHAR(100) NOT NULL,
+    target_type VARCHAR(50) NOT NULL,
+    target_id VARCHAR(255),
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_logs_actor ON audit_logs(actor_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_target ON audit_logs(target_type, target_id, created_at DESC);
+
+DO $$ BEGIN
+    CREATE TYPE legal_hold_target AS ENUM ('user', 'conversation');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+-- Legal holds
+CREATE TABLE IF NOT EXISTS legal_holds (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    target_type legal_hold_target NOT NULL,
+    target_id UUID NOT NULL,
+    reason TEXT NOT NULL,
+    placed_by UUID NOT NULL REFERENCES users(id),
+    placed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    released_by UUID REFERENCES users(id),
+    released_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Only one active hold per target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_legal_holds_active ON legal_holds(target_type, target_id) WHERE released_at IS NULL;
@@ -0,0 +1,14 @@
+-- Migration: backups
+-- Description: Client-encrypted account backups with versioned generations
+
+CREATE TABLE IF NOT EXISTS backups (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    object_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE(user_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_backups_user ON backups(user_id, version DESC);
@@ -0,0 +1,21 @@
+-- Migration: storage_usage
+-- Description: Per-user object storage accounting
+
+DO $$ BEGIN
+    CREATE TYPE storage_category AS ENUM ('avatar', 'attachment', 'backup');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS storage_objects (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    category storage_category NOT NULL,
+    bucket VARCHAR(100) NOT NULL,
+    object_key TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE(bucket, object_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_storage_objects_user ON storage_objects(user_id, category);
@@ -0,0 +1,23 @@
+-- Migration: attachment_dedup
+-- Description: Content-addressed attachments with reference counting
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    digest VARCHAR(64) NOT NULL UNIQUE,
+    object_key TEXT NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS attachment_refs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    attachment_id UUID NOT NULL REFERENCES attachments(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachment_refs_attachment ON attachment_refs(attachment_id);
+CREATE INDEX IF NOT EXISTS idx_attachment_refs_user ON attachment_refs(user_id);
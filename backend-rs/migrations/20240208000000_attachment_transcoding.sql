@@ -0,0 +1,17 @@
+-- Migration: attachment_transcoding
+-- Description: Transcoding state for video/audio attachments
+
+DO $$ BEGIN
+    CREATE TYPE transcode_status AS ENUM ('none', 'pending', 'processing', 'completed', 'failed');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcode_status transcode_status NOT NULL DEFAULT 'none';
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcoded_key TEXT;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcoded_content_type VARCHAR(100);
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcode_error TEXT;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcoded_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_attachments_transcode_pending ON attachments(created_at)
+    WHERE transcode_status = 'pending';
@@ -0,0 +1,23 @@
+-- Migration: spam_settings
+-- Description: Admin-tunable thresholds for the send-time spam policy
+
+CREATE TABLE IF NOT EXISTS spam_settings (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    max_sends_per_minute INTEGER NOT NULL DEFAULT 60,
+    new_account_age_hours INTEGER NOT NULL DEFAULT 24,
+    new_account_max_sends_per_minute INTEGER NOT NULL DEFAULT 10,
+    stranger_ratio_threshold DOUBLE PRECISION NOT NULL DEFAULT 0.8,
+    stranger_min_recipients INTEGER NOT NULL DEFAULT 5,
+    max_identical_fanout INTEGER NOT NULL DEFAULT 20,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO spam_settings (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
+
+DROP TRIGGER IF EXISTS update_spam_settings_updated_at ON spam_settings;
+CREATE TRIGGER update_spam_settings_updated_at BEFORE UPDATE ON spam_settings
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at();
+
+-- Shadow-limited messages stay visible to their sender only
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS shadow_limited BOOLEAN NOT NULL DEFAULT FALSE;
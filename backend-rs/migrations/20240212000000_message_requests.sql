@@ -0,0 +1,25 @@
+-- Migration: message_requests
+-- Description: First-message request inbox for conversations started by non-contacts
+
+DO $$ BEGIN
+    CREATE TYPE message_request_status AS ENUM ('pending', 'accepted', 'blocked');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+-- NULL means the conversation was never a request for this participant
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS request_status message_request_status;
+
+CREATE INDEX IF NOT EXISTS idx_participants_requests ON participants(user_id) WHERE request_status = 'pending';
+
+-- Reports filed from the request inbox
+CREATE TABLE IF NOT EXISTS user_reports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    reporter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reported_user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    conversation_id UUID REFERENCES conversations(id) ON DELETE SET NULL,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_reports_reported ON user_reports(reported_user_id, created_at DESC);
@@ -0,0 +1,4 @@
+-- Migration: slow_mode
+-- Description: Per-conversation slow mode (one message per member every N seconds)
+
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS slow_mode_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,15 @@
+-- Migration: user_limits
+-- Description: Per-user admin overrides of the global group, conversation and device limits
+
+CREATE TABLE IF NOT EXISTS user_limit_overrides (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    max_group_members INTEGER,
+    max_conversations INTEGER,
+    max_devices INTEGER,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+DROP TRIGGER IF EXISTS update_user_limit_overrides_updated_at ON user_limit_overrides;
+CREATE TRIGGER update_user_limit_overrides_updated_at BEFORE UPDATE ON user_limit_overrides
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at();
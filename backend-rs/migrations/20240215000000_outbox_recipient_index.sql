@@ -0,0 +1,4 @@
+-- Migration: outbox_recipient_index
+-- Description: Index the outbox by recipient so polling clients can drain their queue
+
+CREATE INDEX IF NOT EXISTS idx_outbox_events_recipient ON outbox_events(recipient_id, id);
@@ -0,0 +1,4 @@
+-- Migration: session_dpop_binding
+-- Description: Remember the device key thumbprint a session's tokens are bound to
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS dpop_jkt VARCHAR(64);
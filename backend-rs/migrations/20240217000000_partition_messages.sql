@@ -0,0 +1,94 @@
+-- Migration: partition_messages
+-- Description: Range-partition messages by created_at month
+
+-- Partitioned tables can't be the target of foreign keys on a column that
+-- isn't the whole partition key, so receipts and replies lose theirs. A
+-- trigger keeps the old ON DELETE behaviour.
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS receipts_message_id_fkey;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_reply_to_id_fkey;
+
+ALTER TABLE messages RENAME TO messages_unpartitioned;
+ALTER TABLE messages_unpartitioned RENAME CONSTRAINT messages_pkey TO messages_unpartitioned_pkey;
+
+UPDATE messages_unpartitioned SET created_at = NOW() WHERE created_at IS NULL;
+
+CREATE TABLE messages (
+    id UUID NOT NULL DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES users(id),
+    type message_type NOT NULL DEFAULT 'text',
+    content BYTEA NOT NULL,
+    sticker_id UUID REFERENCES stickers(id) ON DELETE SET NULL,
+    reply_to_id UUID,
+    status message_status DEFAULT 'sent',
+    edited_at TIMESTAMP WITH TIME ZONE,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    shadow_limited BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+-- Rows outside every monthly partition land here. It should stay empty: a
+-- month can't be attached while the default partition holds rows for it.
+CREATE TABLE IF NOT EXISTS messages_default PARTITION OF messages DEFAULT;
+
+-- Create the partition holding the given month (UTC). Idempotent; called by
+-- the server's partition maintenance task.
+CREATE OR REPLACE FUNCTION create_messages_partition(month DATE) RETURNS TEXT AS $$
+DECLARE
+    start_at TIMESTAMPTZ := date_trunc('month', month::TIMESTAMP) AT TIME ZONE 'UTC';
+    end_at TIMESTAMPTZ := (date_trunc('month', month::TIMESTAMP) + INTERVAL '1 month') AT TIME ZONE 'UTC';
+    partition_name TEXT := 'messages_' || to_char(month, 'YYYY_MM');
+BEGIN
+    EXECUTE format(
+        'CREATE TABLE IF NOT EXISTS %I PARTITION OF messages FOR VALUES FROM (%L) TO (%L)',
+        partition_name, start_at, end_at
+    );
+    RETURN partition_name;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Partitions for every month with existing messages, plus the next three
+DO $$
+DECLARE
+    month DATE;
+BEGIN
+    SELECT date_trunc('month', COALESCE(MIN(created_at), NOW()) AT TIME ZONE 'UTC')::DATE
+    INTO month
+    FROM messages_unpartitioned;
+
+    WHILE month <= (date_trunc('month', NOW() AT TIME ZONE 'UTC') + INTERVAL '3 months')::DATE LOOP
+        PERFORM create_messages_partition(month);
+        month := (month + INTERVAL '1 month')::DATE;
+    END LOOP;
+END;
+$$;
+
+INSERT INTO messages (
+    id, conversation_id, sender_id, type, content, sticker_id, reply_to_id,
+    status, edited_at, deleted_at, created_at, shadow_limited
+)
+SELECT
+    id, conversation_id, sender_id, type, content, sticker_id, reply_to_id,
+    status, edited_at, deleted_at, created_at, shadow_limited
+FROM messages_unpartitioned;
+
+DROP TABLE messages_unpartitioned;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id);
+CREATE INDEX IF NOT EXISTS idx_messages_sticker ON messages(sticker_id) WHERE sticker_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to ON messages(reply_to_id) WHERE reply_to_id IS NOT NULL;
+
+-- Stand-in for the dropped foreign keys
+CREATE OR REPLACE FUNCTION messages_on_delete() RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM receipts WHERE message_id = OLD.id;
+    UPDATE messages SET reply_to_id = NULL WHERE reply_to_id = OLD.id;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_on_delete
+    AFTER DELETE ON messages
+    FOR EACH ROW EXECUTE FUNCTION messages_on_delete();
@@ -0,0 +1,28 @@
+-- Migration: message_archives
+-- Description: Index of message batches moved to object storage
+
+CREATE TABLE IF NOT EXISTS message_archives (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    object_key VARCHAR(512) NOT NULL,
+    message_ids UUID[] NOT NULL,
+    message_count INTEGER NOT NULL,
+    first_created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_archives_conversation ON message_archives(conversation_id, last_created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_message_archives_message_ids ON message_archives USING GIN (message_ids);
+
+-- Archived messages are still there to reply to, so moving them out of
+-- Postgres must not clear reply_to_id on their replies
+CREATE OR REPLACE FUNCTION messages_on_delete() RETURNS TRIGGER AS $$
+BEGIN
+    DELETE FROM receipts WHERE message_id = OLD.id;
+    IF current_setting('app.archiving_messages', true) IS DISTINCT FROM 'on' THEN
+        UPDATE messages SET reply_to_id = NULL WHERE reply_to_id = OLD.id;
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
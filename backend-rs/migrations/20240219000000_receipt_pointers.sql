@@ -0,0 +1,40 @@
+-- Migration: receipt_pointers
+-- Description: Replace per-message receipts with per-participant delivered/read pointers
+
+-- created_at of the newest message the participant has received / read;
+-- every earlier message in the conversation counts as received / read too
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS delivered_up_to TIMESTAMP WITH TIME ZONE;
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS read_up_to TIMESTAMP WITH TIME ZONE;
+
+-- Compact existing receipts into the pointers. A read receipt implies delivery.
+UPDATE participants p
+SET delivered_up_to = acked.up_to
+FROM (
+    SELECT m.conversation_id, r.user_id, MAX(m.created_at) AS up_to
+    FROM receipts r
+    JOIN messages m ON m.id = r.message_id
+    GROUP BY m.conversation_id, r.user_id
+) acked
+WHERE p.conversation_id = acked.conversation_id AND p.user_id = acked.user_id;
+
+UPDATE participants p
+SET read_up_to = acked.up_to
+FROM (
+    SELECT m.conversation_id, r.user_id, MAX(m.created_at) AS up_to
+    FROM receipts r
+    JOIN messages m ON m.id = r.message_id
+    WHERE r.type = 'read'
+    GROUP BY m.conversation_id, r.user_id
+) acked
+WHERE p.conversation_id = acked.conversation_id AND p.user_id = acked.user_id;
+
+CREATE OR REPLACE FUNCTION messages_on_delete() RETURNS TRIGGER AS $$
+BEGIN
+    IF current_setting('app.archiving_messages', true) IS DISTINCT FROM 'on' THEN
+        UPDATE messages SET reply_to_id = NULL WHERE reply_to_id = OLD.id;
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TABLE IF EXISTS receipts;
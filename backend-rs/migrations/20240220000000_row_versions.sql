@@ -0,0 +1,8 @@
+-- Migration: row_versions
+-- Description: Version counters for optimistic concurrency on profiles, contacts and conversation settings
+
+-- Bumped on every user-editable change and exposed as the ETag; presence and
+-- last-message bookkeeping leave it alone
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,4 @@
+-- Migration: sticker_emoji_index
+-- Description: Index stickers by emoji for type-ahead suggestions
+
+CREATE INDEX IF NOT EXISTS idx_stickers_emoji ON stickers(emoji, pack_id);
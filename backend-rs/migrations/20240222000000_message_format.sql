@@ -0,0 +1,4 @@
+-- Migration: message_format
+-- Description: Record which formatting schema version a message's encrypted payload uses
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS format_version SMALLINT;
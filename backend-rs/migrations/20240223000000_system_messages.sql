@@ -0,0 +1,4 @@
+-- Migration: system_messages
+-- Description: Structured payloads for server-generated system messages
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS system_event JSONB;
@@ -0,0 +1,10 @@
+-- Migration: notification_routing
+-- Description: Per-user choice of which devices receive push notifications
+
+DO $$ BEGIN
+    CREATE TYPE notification_routing AS ENUM ('all', 'most_recent', 'none_while_desktop');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS notification_routing notification_routing NOT NULL DEFAULT 'all';
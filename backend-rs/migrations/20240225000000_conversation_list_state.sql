@@ -0,0 +1,5 @@
+-- Migration: conversation_list_state
+-- Description: Per-participant manual unread mark and flag
+
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS marked_unread BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS flagged_at TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,10 @@
+-- Migration: user_directory_search
+-- Description: Discoverability opt-out and trigram indexes for directory search
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS discoverable BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Substring search (LIKE '%q%') can only use trigram indexes
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING GIN (LOWER(username) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_users_display_name_trgm ON users USING GIN (LOWER(display_name) gin_trgm_ops);
@@ -0,0 +1,30 @@
+-- Migration: otp_delivery
+-- Description: Provider message ids and delivery status for OTP sends
+
+DO $$ BEGIN
+    CREATE TYPE otp_delivery_status AS ENUM ('queued', 'sent', 'delivered', 'failed');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS otp_deliveries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    -- The target and type the code was requested for
+    target VARCHAR(255) NOT NULL,
+    type otp_type NOT NULL,
+    -- Where it was actually sent; differs from the target on a fallback
+    channel otp_type NOT NULL,
+    recipient VARCHAR(255) NOT NULL,
+    provider VARCHAR(20) NOT NULL,
+    provider_message_id VARCHAR(255),
+    status otp_delivery_status NOT NULL DEFAULT 'queued',
+    error_code VARCHAR(64),
+    fallback_for UUID REFERENCES otp_deliveries(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_otp_deliveries_target ON otp_deliveries(target, created_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_otp_deliveries_provider_message
+    ON otp_deliveries(provider, provider_message_id)
+    WHERE provider_message_id IS NOT NULL;
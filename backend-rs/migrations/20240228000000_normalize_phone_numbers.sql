@@ -0,0 +1,30 @@
+-- Migration: normalize_phone_numbers
+-- Description: Rewrite stored phone numbers to E.164; new numbers are normalized on the way in
+
+-- Strip formatting and turn a "00" international prefix into "+"
+CREATE TEMP TABLE phone_normalization AS
+SELECT
+    id,
+    phone AS raw,
+    regexp_replace(regexp_replace(phone, '[[:space:]().-]', '', 'g'), '^00', '+') AS normalized
+FROM users
+WHERE phone IS NOT NULL;
+
+-- Without a country code the region is unknown; those rows are left as they are
+DELETE FROM phone_normalization
+WHERE normalized !~ '^\+[1-9][0-9]{6,14}$' OR normalized = raw;
+
+-- Numbers that collapse onto another account are left for support to merge
+DELETE FROM phone_normalization n
+WHERE EXISTS (SELECT 1 FROM users u WHERE u.phone = n.normalized AND u.id <> n.id)
+   OR (SELECT COUNT(*) FROM phone_normalization o WHERE o.normalized = n.normalized) > 1;
+
+UPDATE users u
+SET phone = n.normalized, version = u.version + 1, updated_at = NOW()
+FROM phone_normalization n
+WHERE u.id = n.id;
+
+DROP TABLE phone_normalization;
+
+-- Pending phone codes were keyed by the raw number and would no longer match
+DELETE FROM otps WHERE type = 'phone';
@@ -0,0 +1,33 @@
+-- Migration: email_domain_blocklist
+-- Description: Disposable email domains refused for OTPs and registration; admins maintain the list
+
+CREATE TABLE IF NOT EXISTS blocked_email_domains (
+    domain VARCHAR(255) PRIMARY KEY,
+    reason TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+INSERT INTO blocked_email_domains (domain, reason) VALUES
+    ('10minutemail.com', 'disposable'),
+    ('dispostable.com', 'disposable'),
+    ('emailondeck.com', 'disposable'),
+    ('fakeinbox.com', 'disposable'),
+    ('getairmail.com', 'disposable'),
+    ('getnada.com', 'disposable'),
+    ('guerrillamail.com', 'disposable'),
+    ('guerrillamail.net', 'disposable'),
+    ('mailinator.com', 'disposable'),
+    ('maildrop.cc', 'disposable'),
+    ('mailnesia.com', 'disposable'),
+    ('mintemail.com', 'disposable'),
+    ('mohmal.com', 'disposable'),
+    ('sharklasers.com', 'disposable'),
+    ('spamgourmet.com', 'disposable'),
+    ('tempail.com', 'disposable'),
+    ('temp-mail.org', 'disposable'),
+    ('tempmail.com', 'disposable'),
+    ('throwawaymail.com', 'disposable'),
+    ('trashmail.com', 'disposable'),
+    ('yopmail.com', 'disposable')
+ON CONFLICT (domain) DO NOTHING;
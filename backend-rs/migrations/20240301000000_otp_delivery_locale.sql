@@ -0,0 +1,4 @@
+-- Migration: otp_delivery_locale
+-- Description: Language each OTP was worded in, so a fallback send uses the same one
+
+ALTER TABLE otp_deliveries ADD COLUMN IF NOT EXISTS locale VARCHAR(16) NOT NULL DEFAULT 'en';
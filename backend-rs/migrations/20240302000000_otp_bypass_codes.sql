@@ -0,0 +1,10 @@
+-- Migration: otp_bypass_codes
+-- Description: Fixed OTP codes for seeded development users; ignored in production
+
+CREATE TABLE IF NOT EXISTS otp_bypass_codes (
+    target VARCHAR(255) NOT NULL,
+    type otp_type NOT NULL,
+    code VARCHAR(10) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (target, type)
+);
@@ -0,0 +1,24 @@
+-- Migration: impersonations
+-- Description: Read-only admin impersonation of a user, granted by that user
+
+DO $$ BEGIN
+    CREATE TYPE impersonation_status AS ENUM ('pending', 'approved', 'denied', 'revoked');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS impersonations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    admin_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reason TEXT NOT NULL,
+    status impersonation_status NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMP WITH TIME ZONE,
+    -- Set on approval; tokens stop working at this time
+    expires_at TIMESTAMP WITH TIME ZONE,
+    token_issued_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_impersonations_user ON impersonations(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_impersonations_admin ON impersonations(admin_id, created_at DESC);
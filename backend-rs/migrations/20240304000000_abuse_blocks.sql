@@ -0,0 +1,18 @@
+-- Migration: abuse_blocks
+-- Description: Admin-managed phone prefix, IP range and ASN blocks checked before OTPs are sent and accounts registered
+
+DO $$ BEGIN
+    CREATE TYPE abuse_block_kind AS ENUM ('phone_prefix', 'ip_cidr', 'asn');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS abuse_blocks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    kind abuse_block_kind NOT NULL,
+    value VARCHAR(64) NOT NULL,
+    reason TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (kind, value)
+);
@@ -0,0 +1,15 @@
+-- Migration: conversation_export_formats
+-- Description: Export formats and client-supplied plaintext for conversation exports
+
+DO $$ BEGIN
+    CREATE TYPE export_format AS ENUM ('json', 'whatsapp');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+ALTER TABLE conversation_exports
+    ADD COLUMN IF NOT EXISTS format export_format NOT NULL DEFAULT 'json',
+    ADD COLUMN IF NOT EXISTS utc_offset_minutes INTEGER NOT NULL DEFAULT 0,
+    -- Decrypted text by message id, supplied by the requesting client; cleared
+    -- once the export finishes
+    ADD COLUMN IF NOT EXISTS plaintext JSONB;
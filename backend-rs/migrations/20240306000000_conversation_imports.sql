@@ -0,0 +1,50 @@
+-- Migration: conversation_imports
+-- Description: Read-only conversations imported from WhatsApp and Telegram chat exports
+
+DO $$ BEGIN
+    CREATE TYPE import_source AS ENUM ('whatsapp', 'telegram');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+-- Set on imported conversations, which accept no new messages
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS imported_from import_source;
+
+CREATE TABLE IF NOT EXISTS conversation_imports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    source import_source,
+    status export_status NOT NULL DEFAULT 'pending',
+    progress INTEGER NOT NULL DEFAULT 0,
+    options JSONB NOT NULL DEFAULT '{}',
+    object_key TEXT,
+    conversation_id UUID REFERENCES conversations(id) ON DELETE SET NULL,
+    message_count INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_imports_user ON conversation_imports(user_id, created_at DESC);
+
+-- Senders named in an imported chat: matched to a user, or a placeholder
+-- known only by name
+CREATE TABLE IF NOT EXISTS import_participants (
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    PRIMARY KEY (conversation_id, name)
+);
+
+-- Imported history is plaintext from the source app's export and is only
+-- visible to the importing user
+CREATE TABLE IF NOT EXISTS imported_messages (
+    id BIGSERIAL PRIMARY KEY,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    sender_name TEXT,
+    text TEXT NOT NULL DEFAULT '',
+    media_name TEXT,
+    sent_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_imported_messages_conversation ON imported_messages(conversation_id, id);
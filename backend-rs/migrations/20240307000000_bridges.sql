@@ -0,0 +1,51 @@
+-- Migration: bridges
+-- Description: Service accounts for chat bridges (e.g. Matrix) and the tables
+-- mapping bridged rooms and events to local conversations and messages
+
+DO $$ BEGIN
+    CREATE TYPE bridge_direction AS ENUM ('inbound', 'outbound');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS bridges (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL UNIQUE,
+    -- The account relayed messages are sent as
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- SHA-256 of the service token, hex encoded
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- A bridged room; each conversation maps to at most one room per bridge
+CREATE TABLE IF NOT EXISTS bridge_conversations (
+    bridge_id UUID NOT NULL REFERENCES bridges(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    external_id VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (bridge_id, conversation_id),
+    UNIQUE (bridge_id, external_id)
+);
+
+-- A bridged event. No foreign key on message_id since messages is
+-- partitioned.
+CREATE TABLE IF NOT EXISTS bridge_messages (
+    bridge_id UUID NOT NULL REFERENCES bridges(id) ON DELETE CASCADE,
+    message_id UUID NOT NULL,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    external_id VARCHAR(255) NOT NULL,
+    -- inbound: relayed in by the bridge; outbound: mirrored out by it
+    direction bridge_direction NOT NULL,
+    -- The remote sender of inbound messages
+    external_sender VARCHAR(255),
+    sender_name VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (bridge_id, message_id),
+    UNIQUE (bridge_id, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bridge_messages_conversation ON bridge_messages(conversation_id);
@@ -0,0 +1,31 @@
+-- Migration: federation
+-- Description: Messages relayed to and from users on other servers
+
+DO $$ BEGIN
+    CREATE TYPE federation_direction AS ENUM ('inbound', 'outbound');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+DO $$ BEGIN
+    CREATE TYPE federation_status AS ENUM ('pending', 'delivered', 'failed');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS federated_messages (
+    -- Also the envelope id, so a replayed envelope is stored once
+    id UUID PRIMARY KEY,
+    direction federation_direction NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- The other party, as `username@domain`
+    remote_address VARCHAR(320) NOT NULL,
+    type message_type NOT NULL DEFAULT 'text',
+    content BYTEA NOT NULL,
+    status federation_status NOT NULL DEFAULT 'pending',
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_federated_messages_user ON federated_messages(user_id, created_at DESC);
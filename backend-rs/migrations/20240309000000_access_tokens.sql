@@ -0,0 +1,23 @@
+-- Migration: access_tokens
+-- Description: Personal access tokens for third-party API clients
+
+CREATE TABLE IF NOT EXISTS access_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL,
+    -- The device that created the token; removing the device removes it
+    device_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    -- SHA-256 of the token, hex encoded
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    -- JSON array of scope names
+    scopes JSONB NOT NULL,
+    -- Requests per minute
+    rate_limit INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (user_id, device_id) REFERENCES devices(user_id, device_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_access_tokens_user ON access_tokens(user_id, created_at DESC);
@@ -0,0 +1,14 @@
+-- Migration: list_watermarks
+-- Description: updated_at on participants and user sticker packs, so list
+-- responses can be validated with ETags built from updated_at watermarks
+
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE user_sticker_packs ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+DROP TRIGGER IF EXISTS update_participants_updated_at ON participants;
+CREATE TRIGGER update_participants_updated_at BEFORE UPDATE ON participants
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at();
+
+DROP TRIGGER IF EXISTS update_user_sticker_packs_updated_at ON user_sticker_packs;
+CREATE TRIGGER update_user_sticker_packs_updated_at BEFORE UPDATE ON user_sticker_packs
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at();
@@ -0,0 +1,28 @@
+-- Migration: account_purge
+-- Description: Purging of long-inactive accounts: the warnings sent ahead of
+-- a purge, accounts admins exempted, and tombstones for purged accounts
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS purged_at TIMESTAMP WITH TIME ZONE;
+
+-- A purged account keeps its row (messages and conversations still point at
+-- it) but loses its phone and email
+ALTER TABLE users DROP CONSTRAINT IF EXISTS phone_or_email;
+ALTER TABLE users ADD CONSTRAINT phone_or_email
+    CHECK (phone IS NOT NULL OR email IS NOT NULL OR purged_at IS NOT NULL);
+
+CREATE TABLE IF NOT EXISTS purge_exclusions (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    reason TEXT,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- One row per warning sent. The deadline is fixed by the first warning, so
+-- a purge never comes sooner than that warning promised.
+CREATE TABLE IF NOT EXISTS purge_warnings (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    days_before INTEGER NOT NULL,
+    deadline TIMESTAMP WITH TIME ZONE NOT NULL,
+    sent_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, days_before)
+);
@@ -0,0 +1,41 @@
+-- Migration: guest_sessions
+-- Description: Anonymous guest accounts for website chat widgets. A widget
+-- token belongs to a workspace and names the support group guests talk to;
+-- each guest gets a short-lived account and one conversation with it.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_guest BOOLEAN NOT NULL DEFAULT false;
+
+-- Guests sign up with neither a phone number nor an email
+ALTER TABLE users DROP CONSTRAINT IF EXISTS phone_or_email;
+ALTER TABLE users ADD CONSTRAINT phone_or_email
+    CHECK (phone IS NOT NULL OR email IS NOT NULL OR purged_at IS NOT NULL OR is_guest);
+
+CREATE TABLE IF NOT EXISTS widget_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    workspace_id UUID NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    -- The group conversation whose members answer guests
+    support_conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    -- SHA-256 of the token, hex encoded
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_widget_tokens_workspace ON widget_tokens(workspace_id, created_at DESC);
+
+-- One row per guest account. The row stays after the session ends so
+-- support staff can still tell whom a transcript was with.
+CREATE TABLE IF NOT EXISTS guest_sessions (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    widget_token_id UUID NOT NULL REFERENCES widget_tokens(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ended_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_guest_sessions_live ON guest_sessions(expires_at) WHERE ended_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_guest_sessions_widget ON guest_sessions(widget_token_id) WHERE ended_at IS NULL;
@@ -0,0 +1,27 @@
+-- Migration: share_links
+-- Description: Expiring read-only links to a snapshot of selected messages.
+-- Messages are end-to-end encrypted, so the sharer supplies the plaintext
+-- that goes into the snapshot.
+
+-- Group owners and admins can turn sharing off; direct conversations always
+-- allow it
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS share_links_enabled BOOLEAN NOT NULL DEFAULT true;
+
+CREATE TABLE IF NOT EXISTS share_links (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- SHA-256 of the link token, hex encoded
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    title VARCHAR(200),
+    -- JSON array of shared messages, rendered as of creation
+    snapshot JSONB NOT NULL,
+    message_count INTEGER NOT NULL,
+    view_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_viewed_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_conversation ON share_links(conversation_id, created_at DESC);
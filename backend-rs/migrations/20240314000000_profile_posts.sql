@@ -0,0 +1,24 @@
+-- Migration: profile_posts
+-- Description: Plaintext posts users publish on their profile, outside of
+-- any end-to-end encrypted conversation
+
+DO $$ BEGIN
+    CREATE TYPE post_visibility AS ENUM ('public', 'contacts');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS profile_posts (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    body TEXT NOT NULL,
+    visibility post_visibility NOT NULL DEFAULT 'public',
+    -- Set when the post republishes one of the author's own messages. No
+    -- foreign key (messages is partitioned); the post outlives the message.
+    source_message_id UUID,
+    pinned BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_profile_posts_user ON profile_posts(user_id, pinned DESC, created_at DESC);
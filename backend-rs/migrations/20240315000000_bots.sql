@@ -0,0 +1,47 @@
+-- Migration: bots
+-- Description: Bot accounts with webhooks, the slash commands they register,
+-- and the log of command invocations routed to them
+
+DO $$ BEGIN
+    CREATE TYPE bot_invocation_status AS ENUM ('pending', 'completed', 'failed');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS bots (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    name VARCHAR(100) NOT NULL UNIQUE,
+    -- The account the bot joins conversations and replies as
+    user_id UUID NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    webhook_url TEXT NOT NULL,
+    -- HMAC-SHA256 key for signing webhook requests; the bot holds a copy
+    signing_secret VARCHAR(64) NOT NULL,
+    created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE IF NOT EXISTS bot_commands (
+    bot_id UUID NOT NULL REFERENCES bots(id) ON DELETE CASCADE,
+    -- Without the leading slash
+    command VARCHAR(32) NOT NULL,
+    description VARCHAR(200) NOT NULL DEFAULT '',
+    PRIMARY KEY (bot_id, command)
+);
+
+CREATE TABLE IF NOT EXISTS bot_invocations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    bot_id UUID NOT NULL REFERENCES bots(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    command VARCHAR(32) NOT NULL,
+    args TEXT NOT NULL DEFAULT '',
+    status bot_invocation_status NOT NULL DEFAULT 'pending',
+    error TEXT,
+    -- The system message carrying the bot's reply
+    reply_message_id UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_bot_invocations_bot ON bot_invocations(bot_id, created_at DESC);
@@ -0,0 +1,26 @@
+-- Migration: message_seq
+-- Description: Per-conversation message sequence numbers, used as sync tokens
+
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS message_seq BIGINT NOT NULL DEFAULT 0;
+-- Highest sequence number moved to the archive tier; older tokens can't be
+-- synced from Postgres
+ALTER TABLE conversations ADD COLUMN IF NOT EXISTS archived_message_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT;
+
+-- Number the messages still in Postgres in the order they were sent.
+-- Messages archived before this migration have no number.
+UPDATE messages m SET seq = numbered.seq
+FROM (
+    SELECT id, created_at,
+           ROW_NUMBER() OVER (PARTITION BY conversation_id ORDER BY created_at, id) AS seq
+    FROM messages
+) numbered
+WHERE m.id = numbered.id AND m.created_at = numbered.created_at AND m.seq IS NULL;
+
+UPDATE conversations c SET message_seq = numbered.max_seq
+FROM (SELECT conversation_id, MAX(seq) AS max_seq FROM messages GROUP BY conversation_id) numbered
+WHERE c.id = numbered.conversation_id;
+
+ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_conversation_seq ON messages(conversation_id, seq);
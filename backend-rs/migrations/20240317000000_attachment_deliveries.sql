@@ -0,0 +1,18 @@
+-- Migration: attachment_deliveries
+-- Description: Per-device download tracking, so attachment objects can be
+-- deleted once every recipient device has them
+
+-- Set once the holder of a reference has said which conversation it was
+-- sent to; objects are only deleted when every reference has
+ALTER TABLE attachment_refs ADD COLUMN IF NOT EXISTS deliveries_declared_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS attachment_deliveries (
+    attachment_id UUID NOT NULL REFERENCES attachments(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    downloaded_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (attachment_id, user_id, device_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachment_deliveries_pending ON attachment_deliveries(created_at) WHERE downloaded_at IS NULL;
@@ -0,0 +1,8 @@
+-- Migration: message_delivered_at
+-- Description: When each message was first delivered, for delivery SLA
+-- tracking and stuck-message detection
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS delivered_at TIMESTAMP WITH TIME ZONE;
+
+-- Recent messages nobody has received yet
+CREATE INDEX IF NOT EXISTS idx_messages_undelivered ON messages(created_at) WHERE status = 'sent';
@@ -0,0 +1,8 @@
+-- Migration: read_receipt_privacy
+-- Description: Let users stop sharing read receipts, for their account or
+-- per conversation
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS read_receipts BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- NULL follows the account setting
+ALTER TABLE participants ADD COLUMN IF NOT EXISTS read_receipts BOOLEAN;
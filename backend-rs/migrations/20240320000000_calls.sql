@@ -0,0 +1,34 @@
+-- Migration: calls
+-- Description: Call history. Call signaling is end-to-end encrypted between
+-- clients, so the caller's client reports each call once it ends.
+
+DO $$ BEGIN
+    CREATE TYPE call_outcome AS ENUM ('completed', 'missed', 'declined', 'cancelled', 'failed');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS calls (
+    -- Chosen by the caller's client, so a retried report is recorded once
+    id UUID PRIMARY KEY,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    caller_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    video BOOLEAN NOT NULL DEFAULT FALSE,
+    outcome call_outcome NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    -- When the first callee picked up; NULL unless completed
+    answered_at TIMESTAMP WITH TIME ZONE,
+    ended_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_calls_conversation ON calls(conversation_id, started_at DESC);
+
+-- Who was on the call besides the caller
+CREATE TABLE IF NOT EXISTS call_participants (
+    call_id UUID NOT NULL REFERENCES calls(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (call_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_call_participants_user ON call_participants(user_id);
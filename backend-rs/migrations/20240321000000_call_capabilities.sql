@@ -0,0 +1,5 @@
+-- Migration: call_capabilities
+-- Description: What the caller's client offered on a call: video,
+-- screen sharing and codecs.
+
+ALTER TABLE calls ADD COLUMN IF NOT EXISTS capabilities JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,42 @@
+-- Migration: calendar_events
+-- Description: Events scheduled inside group conversations, with RSVPs.
+-- Titles and locations are stored in plaintext so the server can send
+-- reminders.
+
+DO $$ BEGIN
+    CREATE TYPE rsvp_status AS ENUM ('going', 'maybe', 'declined');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS calendar_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- The event_scheduled system message. No foreign key (messages is
+    -- partitioned).
+    message_id UUID,
+    title VARCHAR(200) NOT NULL,
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE,
+    -- Opaque to the server: an address, coordinates or a meeting link
+    location JSONB,
+    -- 0 = no reminder
+    remind_minutes_before INTEGER NOT NULL DEFAULT 15,
+    reminded_at TIMESTAMP WITH TIME ZONE,
+    cancelled_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_events_conversation ON calendar_events(conversation_id, starts_at);
+CREATE INDEX IF NOT EXISTS idx_calendar_events_due_reminders ON calendar_events(starts_at)
+    WHERE reminded_at IS NULL AND cancelled_at IS NULL AND remind_minutes_before > 0;
+
+CREATE TABLE IF NOT EXISTS calendar_event_rsvps (
+    event_id UUID NOT NULL REFERENCES calendar_events(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status rsvp_status NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (event_id, user_id)
+);
@@ -0,0 +1,33 @@
+-- Migration: payment_requests
+-- Description: Requests for money between members of a conversation. The
+-- server tracks their state; payments happen outside the app.
+
+DO $$ BEGIN
+    CREATE TYPE payment_status AS ENUM ('requested', 'paid', 'declined', 'cancelled');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE IF NOT EXISTS payment_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    requester_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    payer_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- In the currency's minor unit, e.g. cents
+    amount_minor BIGINT NOT NULL CHECK (amount_minor > 0),
+    -- ISO 4217 code
+    currency CHAR(3) NOT NULL,
+    note VARCHAR(200),
+    status payment_status NOT NULL DEFAULT 'requested',
+    -- The provider's transaction id, when the payer supplies one
+    provider_reference VARCHAR(200),
+    -- The payment_requested system message. No foreign key (messages is
+    -- partitioned).
+    message_id UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    settled_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_requests_conversation ON payment_requests(conversation_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_payment_requests_payer ON payment_requests(payer_id) WHERE status = 'requested';
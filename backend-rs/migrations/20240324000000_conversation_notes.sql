@@ -0,0 +1,12 @@
+-- Migration: conversation_notes
+-- Description: One shared note per conversation, encrypted by the clients.
+-- The version vector (user id -> edit count) lets the server spot edits
+-- made without having seen the latest one.
+
+CREATE TABLE IF NOT EXISTS conversation_notes (
+    conversation_id UUID PRIMARY KEY REFERENCES conversations(id) ON DELETE CASCADE,
+    content BYTEA NOT NULL,
+    version_vector JSONB NOT NULL DEFAULT '{}',
+    updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,20 @@
+-- Migration: conversation_tasks
+-- Description: Shared task lists inside conversations. Titles are stored in
+-- plaintext so changes can be posted as system messages.
+
+CREATE TABLE IF NOT EXISTS conversation_tasks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title VARCHAR(200) NOT NULL,
+    assignee_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    due_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    completed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_tasks_conversation ON conversation_tasks(conversation_id, created_at)
+    WHERE deleted_at IS NULL;
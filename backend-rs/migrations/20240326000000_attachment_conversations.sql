@@ -0,0 +1,12 @@
+-- Migration: attachment_conversations
+-- Description: Conversations each attachment was sent to, so only their
+-- participants can download it
+
+CREATE TABLE IF NOT EXISTS attachment_conversations (
+    attachment_id UUID NOT NULL REFERENCES attachments(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (attachment_id, conversation_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachment_conversations_conversation ON attachment_conversations(conversation_id);
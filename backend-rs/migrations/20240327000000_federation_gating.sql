@@ -0,0 +1,18 @@
+-- Migration: federation_gating
+-- Description: Message requests, blocks and shadow limits for messages relayed from other servers
+
+-- Pending until the recipient writes to or accepts the remote sender; NULL
+-- for outbound messages and senders the recipient already knows
+ALTER TABLE federated_messages ADD COLUMN IF NOT EXISTS request_status message_request_status;
+-- Stored but never delivered, like shadow-limited local messages
+ALTER TABLE federated_messages ADD COLUMN IF NOT EXISTS shadow_limited BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_federated_messages_remote ON federated_messages(user_id, remote_address);
+
+CREATE TABLE IF NOT EXISTS federation_blocks (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    -- The blocked sender, as `username@domain`
+    remote_address VARCHAR(320) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, remote_address)
+);
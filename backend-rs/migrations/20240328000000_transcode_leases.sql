@@ -0,0 +1,4 @@
+-- Migration: transcode_leases
+-- Description: Leases on attachments being transcoded, so only abandoned work is recovered
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS transcode_lease_until TIMESTAMP WITH TIME ZONE;
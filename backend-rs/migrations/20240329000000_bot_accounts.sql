@@ -0,0 +1,10 @@
+-- Migration: bot_accounts
+-- Description: Bots get an account of their own, created with the bot, rather
+-- than being bound to an existing user
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT false;
+
+-- Bot accounts never log in, so they have neither a phone number nor an email
+ALTER TABLE users DROP CONSTRAINT IF EXISTS phone_or_email;
+ALTER TABLE users ADD CONSTRAINT phone_or_email
+    CHECK (phone IS NOT NULL OR email IS NOT NULL OR purged_at IS NOT NULL OR is_guest OR is_bot);
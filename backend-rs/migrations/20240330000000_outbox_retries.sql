@@ -0,0 +1,12 @@
+-- Migration: outbox_retries
+-- Description: Back off between failed outbox publishes and give up after a maximum number of attempts
+
+ALTER TABLE outbox_events
+    ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    ADD COLUMN IF NOT EXISTS failed_at TIMESTAMP WITH TIME ZONE;
+
+-- Dead-lettered events are no longer pending
+DROP INDEX IF EXISTS idx_outbox_events_pending;
+CREATE INDEX IF NOT EXISTS idx_outbox_events_pending ON outbox_events(id)
+    WHERE delivered_at IS NULL AND failed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_outbox_events_failed ON outbox_events(failed_at) WHERE failed_at IS NOT NULL;
@@ -0,0 +1,12 @@
+-- Migration: jwt_secrets
+-- Description: HS256 signing secrets shared by every replica, so a rotated secret is accepted everywhere before anyone signs with it
+
+CREATE TABLE IF NOT EXISTS jwt_secrets (
+    kid VARCHAR(32) PRIMARY KEY,
+    secret TEXT NOT NULL,
+    -- The newest secret past its activation signs; every listed secret verifies
+    activates_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_jwt_secrets_activates_at ON jwt_secrets(activates_at);
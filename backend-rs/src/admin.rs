@@ -0,0 +1,239 @@
+//! `server admin <command>`: operational tasks that would otherwise take
+//! hand-written SQL. Each command goes through the same services as the API,
+//! is written to the audit log and exits.
+//!
+//! - `create-admin <username> [--phone <number>] [--email <address>] [--name <display name>]`
+//!   promotes an existing user, or creates one with the phone number or
+//!   email address to log in with
+//! - `revoke-sessions <user id or username>` logs the user out everywhere:
+//!   refreshing stops and access tokens issued before now are refused. Open
+//!   WebSockets stay connected until they drop.
+//! - `recount-pack-downloads` recomputes sticker pack download counts
+//! - `rebuild-search-indexes` rebuilds the user directory search indexes
+//! - `requeue-outbox [--redeliver <minutes>] [--user <user id or username>]`
+//!   retries stuck and dead-lettered real-time events; with `--redeliver`
+//!   it also republishes those delivered in the last `minutes`, e.g. after
+//!   Redis lost them
+
+use anyhow::Context;
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::Config,
+    models::{OtpType, UserStatus},
+    services::{
+        audit::AuditService, auth::AuthService, outbox::OutboxService, stickers::StickersService,
+    },
+    storage::{minio::MinioClient, redis::RedisClient},
+};
+
+/// Trigram indexes behind `GET /users/search`
+const SEARCH_INDEXES: &[&str] = &["idx_users_username_trgm", "idx_users_display_name_trgm"];
+const USAGE: &str = "usage: server admin <create-admin|revoke-sessions|recount-pack-downloads|rebuild-search-indexes|requeue-outbox> [args]";
+
+pub async fn run(
+    config: &Config,
+    db: &PgPool,
+    redis: &RedisClient,
+    minio: &MinioClient,
+    args: &[String],
+) -> anyhow::Result<()> {
+    let (command, args) = args.split_first().context(USAGE)?;
+    let admin = Admin {
+        db: db.clone(),
+        audit: AuditService::new(db.clone()),
+    };
+
+    match command.as_str() {
+        "create-admin" => {
+            let username = args.first().context("create-admin needs a username")?;
+            let auth = AuthService::new(db.clone(), redis.clone(), config.clone());
+            let phone = option(args, "--phone")?
+                .map(|p| auth.normalize_target(p, OtpType::Phone))
+                .transpose()?;
+            let email = option(args, "--email")?
+                .map(|e| auth.normalize_target(e, OtpType::Email))
+                .transpose()?;
+            let name = option(args, "--name")?.unwrap_or(username);
+            admin
+                .create_admin(username, name, phone.as_deref(), email.as_deref())
+                .await
+        }
+        "revoke-sessions" => {
+            let user = args.first().context("revoke-sessions needs a user")?;
+            let user_id = admin.find_user(user).await?;
+            AuthService::new(db.clone(), redis.clone(), config.clone())
+                .logout_all(user_id)
+                .await?;
+            admin
+                .record(
+                    "auth.sessions_revoked",
+                    "user",
+                    &user_id.to_string(),
+                    json!({}),
+                )
+                .await?;
+            tracing::info!("Revoked all sessions of {}", user);
+            Ok(())
+        }
+        "recount-pack-downloads" => {
+            let changed = StickersService::new(db.clone(), minio.clone())
+                .recount_downloads()
+                .await?;
+            admin
+                .record(
+                    "stickers.downloads_recounted",
+                    "sticker_pack",
+                    "*",
+                    json!({ "changed": changed }),
+                )
+                .await?;
+            tracing::info!("Recounted downloads; {} packs changed", changed);
+            Ok(())
+        }
+        "rebuild-search-indexes" => admin.rebuild_search_indexes().await,
+        "requeue-outbox" => {
+            let redeliver_minutes = option(args, "--redeliver")?
+                .map(|m| m.parse::<i32>())
+                .transpose()
+                .context("--redeliver must be a whole number of minutes")?;
+            let user_id = match option(args, "--user")? {
+                Some(user) => Some(admin.find_user(user).await?),
+                None => None,
+            };
+            let requeued = OutboxService::new(db.clone(), redis.clone())
+                .requeue(redeliver_minutes, user_id)
+                .await?;
+            admin
+                .record(
+                    "outbox.requeued",
+                    "user",
+                    &user_id.map_or("*".to_string(), |id| id.to_string()),
+                    json!({ "redeliver_minutes": redeliver_minutes, "events": requeued }),
+                )
+                .await?;
+            tracing::info!("Requeued {} outbox events", requeued);
+            Ok(())
+        }
+        _ => anyhow::bail!(USAGE),
+    }
+}
+
+/// The value following `flag`, if given
+fn option<'a>(args: &'a [String], flag: &str) -> anyhow::Result<Option<&'a str>> {
+    match args.iter().position(|a| a == flag) {
+        Some(i) => args
+            .get(i + 1)
+            .map(|v| Some(v.as_str()))
+            .with_context(|| format!("{} needs a value", flag)),
+        None => Ok(None),
+    }
+}
+
+struct Admin {
+    db: PgPool,
+    audit: AuditService,
+}
+
+impl Admin {
+    /// A user by id or username
+    async fn find_user(&self, user: &str) -> anyhow::Result<Uuid> {
+        let user_id: Option<Uuid> = match user.parse::<Uuid>() {
+            Ok(id) => {
+                sqlx::query_scalar("SELECT id FROM users WHERE id = $1")
+                    .bind(id)
+                    .fetch_optional(&self.db)
+                    .await?
+            }
+            Err(_) => {
+                sqlx::query_scalar("SELECT id FROM users WHERE LOWER(username) = LOWER($1)")
+                    .bind(user)
+                    .fetch_optional(&self.db)
+                    .await?
+            }
+        };
+
+        user_id.with_context(|| format!("No user {}", user))
+    }
+
+    /// Promote `username`, creating the user first if there is none
+    async fn create_admin(
+        &self,
+        username: &str,
+        display_name: &str,
+        phone: Option<&str>,
+        email: Option<&str>,
+    ) -> anyhow::Result<()> {
+        let user_id = match self.find_user(username).await {
+            Ok(user_id) => {
+                sqlx::query("UPDATE users SET is_admin = true WHERE id = $1")
+                    .bind(user_id)
+                    .execute(&self.db)
+                    .await?;
+                tracing::info!("Made {} an admin", username);
+                user_id
+            }
+            Err(_) => {
+                if phone.is_none() && email.is_none() {
+                    anyhow::bail!("A new admin needs --phone or --email to log in with");
+                }
+                let user_id: Uuid = sqlx::query_scalar(
+                    r#"
+                    INSERT INTO users (id, phone, email, username, display_name, status, is_admin)
+                    VALUES ($1, $2, $3, $4, $5, $6, true)
+                    RETURNING id
+                    "#,
+                )
+                .bind(Uuid::new_v4())
+                .bind(phone)
+                .bind(email)
+                .bind(username)
+                .bind(display_name)
+                .bind(UserStatus::Offline)
+                .fetch_one(&self.db)
+                .await
+                .context("Failed to create the user; is the phone number or email taken?")?;
+                tracing::info!("Created admin {}", username);
+                user_id
+            }
+        };
+
+        self.record("admin.granted", "user", &user_id.to_string(), json!({}))
+            .await
+    }
+
+    /// Rebuild the search indexes without blocking writes
+    async fn rebuild_search_indexes(&self) -> anyhow::Result<()> {
+        for index in SEARCH_INDEXES {
+            sqlx::query(&format!("REINDEX INDEX CONCURRENTLY {}", index))
+                .execute(&self.db)
+                .await
+                .with_context(|| format!("Failed to rebuild {}", index))?;
+            tracing::info!("Rebuilt {}", index);
+        }
+
+        self.record(
+            "search.indexes_rebuilt",
+            "index",
+            "*",
+            json!({ "indexes": SEARCH_INDEXES }),
+        )
+        .await
+    }
+
+    /// Audit entries from the CLI have no actor
+    async fn record(
+        &self,
+        action: &str,
+        target_type: &str,
+        target_id: &str,
+        metadata: serde_json::Value,
+    ) -> anyhow::Result<()> {
+        self.audit
+            .record(None, action, target_type, Some(target_id), metadata)
+            .await?;
+        Ok(())
+    }
+}
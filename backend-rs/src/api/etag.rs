@@ -0,0 +1,122 @@
+//! Optimistic concurrency for editable resources. Responses carry the row's
+//! version as a strong `ETag`; an update sent with `If-Match` only applies if
+//! the row is still at that version, and fails with 412 otherwise.
+//!
+//! List responses carry a weak `ETag` built from a `Watermark` of their rows
+//! instead. A poll sent with a matching `If-None-Match` gets 304 and no body.
+
+use axum::{
+    http::{
+        header::{CACHE_CONTROL, ETAG, IF_MATCH, IF_NONE_MATCH},
+        HeaderMap, HeaderValue, StatusCode,
+    },
+    response::{IntoResponse, Response},
+};
+use sha2::{Digest, Sha256};
+
+use crate::{
+    error::{AppError, AppResult},
+    models::Watermark,
+};
+
+use super::extract::Json;
+
+/// A JSON body sent with the `ETag` of its version
+pub struct Tagged<T>(pub i32, pub T);
+
+impl<T: serde::Serialize> IntoResponse for Tagged<T> {
+    fn into_response(self) -> Response {
+        let mut response = Json(self.1).into_response();
+        response.headers_mut().insert(ETAG, etag(self.0));
+        response
+    }
+}
+
+pub fn etag(version: i32) -> HeaderValue {
+    // A quoted integer is always a valid header value
+    HeaderValue::from_str(&format!("\"{}\"", version))
+        .unwrap_or_else(|_| HeaderValue::from_static("\"\""))
+}
+
+/// The version an update is conditional on. No header or `*` means the
+/// update applies to whatever is current.
+pub fn if_match(headers: &HeaderMap) -> AppResult<Option<i32>> {
+    let Some(value) = headers.get(IF_MATCH) else {
+        return Ok(None);
+    };
+
+    let invalid = || AppError::BadRequest("Invalid If-Match header".to_string());
+    let value = value.to_str().map_err(|_| invalid())?.trim();
+
+    if value == "*" {
+        return Ok(None);
+    }
+
+    value
+        .trim_start_matches("W/")
+        .trim_matches('"')
+        .parse()
+        .map(Some)
+        .map_err(|_| invalid())
+}
+
+/// A list response, or 304 if the client's copy is still current
+pub enum Snapshot<T> {
+    NotModified(HeaderValue),
+    Modified(HeaderValue, T),
+}
+
+impl<T: serde::Serialize> IntoResponse for Snapshot<T> {
+    fn into_response(self) -> Response {
+        let (mut response, etag) = match self {
+            Snapshot::NotModified(etag) => (StatusCode::NOT_MODIFIED.into_response(), etag),
+            Snapshot::Modified(etag, body) => (Json(body).into_response(), etag),
+        };
+
+        let headers = response.headers_mut();
+        headers.insert(ETAG, etag);
+        // Per user, and always revalidated
+        headers.insert(CACHE_CONTROL, HeaderValue::from_static("private, no-cache"));
+        response
+    }
+}
+
+/// A weak `ETag` for a list built from rows at `watermark`. `params` are the
+/// query parameters that shaped the list, so each page or filter gets its
+/// own tag.
+pub fn watermark_etag(watermark: &Watermark, params: &[&str]) -> HeaderValue {
+    let mut hasher = Sha256::new();
+    hasher.update(
+        watermark
+            .latest
+            .map_or(0, |t| t.timestamp_micros())
+            .to_be_bytes(),
+    );
+    hasher.update(watermark.count.to_be_bytes());
+    for param in params {
+        hasher.update(param.as_bytes());
+        hasher.update([0]);
+    }
+    let digest = format!("{:x}", hasher.finalize());
+
+    // Hex digits are always a valid header value
+    HeaderValue::from_str(&format!("W/\"{}\"", &digest[..32]))
+        .unwrap_or_else(|_| HeaderValue::from_static("W/\"\""))
+}
+
+/// Whether `If-None-Match` lists `etag` (or is `*`). Compared weakly, as
+/// `If-None-Match` always is.
+pub fn not_modified(headers: &HeaderMap, etag: &HeaderValue) -> bool {
+    let Some(value) = headers.get(IF_NONE_MATCH).and_then(|v| v.to_str().ok()) else {
+        return false;
+    };
+    let Ok(etag) = etag.to_str() else {
+        return false;
+    };
+
+    let opaque = |tag: &str| tag.trim().trim_start_matches("W/").to_string();
+    let wanted = opaque(etag);
+    value
+        .split(',')
+        .any(|tag| tag.trim() == "*" || opaque(tag) == wanted)
+}
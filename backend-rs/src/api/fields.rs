@@ -0,0 +1,69 @@
+//! Sparse fieldsets for heavy list endpoints. `?fields=id,name,last_message`
+//! keeps only those top-level fields of each item, so mobile clients can skip
+//! arrays they don't render. `id` is always kept; unknown names are ignored.
+
+use std::collections::HashSet;
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use crate::error::{AppError, AppResult};
+
+#[derive(Debug, Default, Deserialize)]
+pub struct FieldsQuery {
+    pub fields: Option<String>,
+}
+
+impl FieldsQuery {
+    /// The requested fields, normalized, for list ETags
+    pub fn shape(&self) -> String {
+        let Some(names) = self.names() else {
+            return "*".to_string();
+        };
+
+        let mut names: Vec<&str> = names.into_iter().collect();
+        names.sort_unstable();
+        names.join(",")
+    }
+
+    /// Trim each item down to the requested fields
+    pub fn select<T: Serialize>(&self, items: Vec<T>) -> AppResult<Selected<T>> {
+        let Some(names) = self.names() else {
+            return Ok(Selected::All(items));
+        };
+
+        let items = items
+            .into_iter()
+            .map(|item| {
+                let mut value = serde_json::to_value(item)
+                    .map_err(|e| AppError::Internal(anyhow::anyhow!(e)))?;
+                if let Value::Object(object) = &mut value {
+                    object.retain(|key, _| key == "id" || names.contains(key.as_str()));
+                }
+                Ok(value)
+            })
+            .collect::<AppResult<_>>()?;
+
+        Ok(Selected::Some(items))
+    }
+
+    /// `None` without a `fields` parameter, meaning every field
+    fn names(&self) -> Option<HashSet<&str>> {
+        let fields = self.fields.as_deref()?;
+        Some(
+            fields
+                .split(',')
+                .map(str::trim)
+                .filter(|name| !name.is_empty())
+                .collect(),
+        )
+    }
+}
+
+/// A list with every field, or only the selected ones
+#[derive(Debug, Serialize)]
+#[serde(untagged)]
+pub enum Selected<T> {
+    All(Vec<T>),
+    Some(Vec<Value>),
+}
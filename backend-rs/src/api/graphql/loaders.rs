@@ -0,0 +1,192 @@
+//! Batch loaders. Each one turns the lookups a query makes for every
+//! conversation or message in a list into a single `= ANY($1)` query.
+
+use std::{collections::HashMap, sync::Arc};
+
+use async_graphql::dataloader::Loader;
+use chrono::{DateTime, Utc};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::AppError,
+    models::{Message, Participant, Sticker, User},
+};
+
+pub struct UserLoader {
+    db: PgPool,
+}
+
+impl UserLoader {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+impl Loader<Uuid> for UserLoader {
+    type Value = User;
+    type Error = Arc<AppError>;
+
+    async fn load(&self, keys: &[Uuid]) -> Result<HashMap<Uuid, User>, Self::Error> {
+        let users: Vec<User> = sqlx::query_as("SELECT * FROM users WHERE id = ANY($1)")
+            .bind(keys)
+            .fetch_all(&self.db)
+            .await
+            .map_err(|e| Arc::new(AppError::from(e)))?;
+
+        Ok(users.into_iter().map(|u| (u.id, u)).collect())
+    }
+}
+
+/// Current participants, by conversation
+pub struct ParticipantsLoader {
+    db: PgPool,
+}
+
+impl ParticipantsLoader {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+impl Loader<Uuid> for ParticipantsLoader {
+    type Value = Vec<Participant>;
+    type Error = Arc<AppError>;
+
+    async fn load(&self, keys: &[Uuid]) -> Result<HashMap<Uuid, Vec<Participant>>, Self::Error> {
+        let participants: Vec<Participant> = sqlx::query_as(
+            r#"
+            SELECT * FROM participants
+            WHERE conversation_id = ANY($1) AND left_at IS NULL
+            ORDER BY joined_at ASC
+            "#,
+        )
+        .bind(keys)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|e| Arc::new(AppError::from(e)))?;
+
+        let mut by_conversation: HashMap<Uuid, Vec<Participant>> = HashMap::new();
+        for participant in participants {
+            by_conversation
+                .entry(participant.conversation_id)
+                .or_default()
+                .push(participant);
+        }
+
+        Ok(by_conversation)
+    }
+}
+
+/// Newest message the viewer can see, by conversation
+pub struct LastMessageLoader {
+    db: PgPool,
+    user_id: Uuid,
+}
+
+impl LastMessageLoader {
+    pub fn new(db: PgPool, user_id: Uuid) -> Self {
+        Self { db, user_id }
+    }
+}
+
+impl Loader<Uuid> for LastMessageLoader {
+    type Value = Message;
+    type Error = Arc<AppError>;
+
+    async fn load(&self, keys: &[Uuid]) -> Result<HashMap<Uuid, Message>, Self::Error> {
+        let messages: Vec<Message> = sqlx::query_as(
+            r#"
+            SELECT DISTINCT ON (conversation_id) * FROM messages
+            WHERE conversation_id = ANY($1) AND deleted_at IS NULL
+            AND (shadow_limited = FALSE OR sender_id = $2)
+            ORDER BY conversation_id, created_at DESC
+            "#,
+        )
+        .bind(keys)
+        .bind(self.user_id)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|e| Arc::new(AppError::from(e)))?;
+
+        Ok(messages
+            .into_iter()
+            .map(|m| (m.conversation_id, m))
+            .collect())
+    }
+}
+
+/// The viewer's own list state for a conversation
+#[derive(Debug, Clone, Default, sqlx::FromRow)]
+pub struct ViewerState {
+    pub conversation_id: Uuid,
+    pub unread_count: i64,
+    pub marked_unread: bool,
+    pub flagged_at: Option<DateTime<Utc>>,
+}
+
+/// Unread counts and list state of the viewer, by conversation. Counted the
+/// same way as `unread_count` in the REST conversation list.
+pub struct ViewerStateLoader {
+    db: PgPool,
+    user_id: Uuid,
+}
+
+impl ViewerStateLoader {
+    pub fn new(db: PgPool, user_id: Uuid) -> Self {
+        Self { db, user_id }
+    }
+}
+
+impl Loader<Uuid> for ViewerStateLoader {
+    type Value = ViewerState;
+    type Error = Arc<AppError>;
+
+    async fn load(&self, keys: &[Uuid]) -> Result<HashMap<Uuid, ViewerState>, Self::Error> {
+        let states: Vec<ViewerState> = sqlx::query_as(
+            r#"
+            SELECT p.conversation_id, p.marked_unread, p.flagged_at,
+                   COUNT(m.id) AS unread_count
+            FROM participants p
+            LEFT JOIN messages m ON m.conversation_id = p.conversation_id
+                AND m.sender_id != p.user_id AND m.deleted_at IS NULL
+                AND m.shadow_limited = FALSE
+                AND m.created_at > COALESCE(p.read_up_to, '-infinity')
+            WHERE p.conversation_id = ANY($1) AND p.user_id = $2
+            GROUP BY p.conversation_id, p.marked_unread, p.flagged_at
+            "#,
+        )
+        .bind(keys)
+        .bind(self.user_id)
+        .fetch_all(&self.db)
+        .await
+        .map_err(|e| Arc::new(AppError::from(e)))?;
+
+        Ok(states.into_iter().map(|s| (s.conversation_id, s)).collect())
+    }
+}
+
+pub struct StickerLoader {
+    db: PgPool,
+}
+
+impl StickerLoader {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+impl Loader<Uuid> for StickerLoader {
+    type Value = Sticker;
+    type Error = Arc<AppError>;
+
+    async fn load(&self, keys: &[Uuid]) -> Result<HashMap<Uuid, Sticker>, Self::Error> {
+        let stickers: Vec<Sticker> = sqlx::query_as("SELECT * FROM stickers WHERE id = ANY($1)")
+            .bind(keys)
+            .fetch_all(&self.db)
+            .await
+            .map_err(|e| Arc::new(AppError::from(e)))?;
+
+        Ok(stickers.into_iter().map(|s| (s.id, s)).collect())
+    }
+}
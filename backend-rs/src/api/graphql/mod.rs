@@ -0,0 +1,210 @@
+//! Read-only GraphQL gateway over the client API, so web clients can fetch
+//! a screen's worth of data (the conversation list with last messages and
+//! unread counts, say) in one round trip. Resolvers call the same services
+//! as the REST handlers; per-conversation and per-message lookups go through
+//! the batch loaders in `loaders`.
+
+mod loaders;
+mod types;
+
+use async_graphql::{
+    dataloader::DataLoader, Context, EmptyMutation, EmptySubscription, ErrorExtensions, Object,
+    Result, Schema,
+};
+use async_graphql_axum::{GraphQLRequest, GraphQLResponse};
+use axum::{extract::State, http::Method, Extension};
+use uuid::Uuid;
+
+use self::{
+    loaders::{
+        LastMessageLoader, ParticipantsLoader, StickerLoader, UserLoader, ViewerStateLoader,
+    },
+    types::{Contact, Conversation, StickerPack, User},
+};
+use super::middleware::{get_user_id, get_workspace_id};
+use crate::{
+    error::{AppError, AppResult},
+    services::{
+        auth::{Claims, Scope},
+        contacts::ContactsService,
+        messaging::MessagingService,
+        stickers::StickersService,
+    },
+    AppState,
+};
+
+pub type ApiSchema = Schema<QueryRoot, EmptyMutation, EmptySubscription>;
+
+const MAX_DEPTH: usize = 10;
+const MAX_COMPLEXITY: usize = 2000;
+const MAX_CONVERSATIONS: i32 = 100;
+
+pub fn build_schema() -> ApiSchema {
+    Schema::build(QueryRoot, EmptyMutation, EmptySubscription)
+        .limit_depth(MAX_DEPTH)
+        .limit_complexity(MAX_COMPLEXITY)
+        .finish()
+}
+
+/// The caller, resolved once per request
+struct Viewer {
+    user_id: Uuid,
+    workspace_id: Option<Uuid>,
+    claims: Claims,
+}
+
+fn viewer<'a>(ctx: &Context<'a>) -> &'a Viewer {
+    ctx.data_unchecked::<Viewer>()
+}
+
+/// Everything here is a read, so a `read` token may query any field; other
+/// downscoped tokens need the scope the matching REST routes ask for
+fn require_scope(ctx: &Context<'_>, required: Scope) -> Result<()> {
+    if !viewer(ctx).claims.allows(required, &Method::GET) {
+        return Err(gql_error(&AppError::InsufficientScope(required)));
+    }
+
+    Ok(())
+}
+
+/// An `AppError` as a GraphQL error with the REST error code in
+/// `extensions.code`. Server-side failures are logged, not echoed.
+fn gql_error(error: &AppError) -> async_graphql::Error {
+    let message = match error {
+        AppError::Database(_) | AppError::Redis(_) | AppError::Internal(_) => {
+            tracing::error!("GraphQL resolver error: {}", error);
+            "Internal server error".to_string()
+        }
+        _ => error.to_string(),
+    };
+    let code = error.code();
+
+    async_graphql::Error::new(message).extend_with(|_, ext| ext.set("code", code.as_str()))
+}
+
+pub struct QueryRoot;
+
+#[Object]
+impl QueryRoot {
+    /// The signed-in user
+    async fn me(&self, ctx: &Context<'_>) -> Result<Option<User>> {
+        require_scope(ctx, Scope::Account)?;
+
+        let user = ctx
+            .data_unchecked::<DataLoader<UserLoader>>()
+            .load_one(viewer(ctx).user_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(user.map(User))
+    }
+
+    /// The conversation list in the active workspace, most recently active
+    /// first, like `GET /conversations`
+    async fn conversations(
+        &self,
+        ctx: &Context<'_>,
+        #[graphql(default = 20)] limit: i32,
+        #[graphql(default = 0)] offset: i32,
+    ) -> Result<Vec<Conversation>> {
+        require_scope(ctx, Scope::Messaging)?;
+        let state = ctx.data_unchecked::<AppState>();
+        let viewer = viewer(ctx);
+
+        let conversations = MessagingService::new(state.db.clone(), state.redis.clone())
+            .list_conversations(
+                viewer.user_id,
+                viewer.workspace_id,
+                limit.clamp(1, MAX_CONVERSATIONS),
+                offset.max(0),
+            )
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(conversations.into_iter().map(Conversation).collect())
+    }
+
+    async fn conversation(&self, ctx: &Context<'_>, id: Uuid) -> Result<Conversation> {
+        require_scope(ctx, Scope::Messaging)?;
+        let state = ctx.data_unchecked::<AppState>();
+
+        let conversation = MessagingService::new(state.db.clone(), state.redis.clone())
+            .find_conversation(id, viewer(ctx).user_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(Conversation(conversation))
+    }
+
+    async fn contacts(
+        &self,
+        ctx: &Context<'_>,
+        #[graphql(default = false)] include_blocked: bool,
+    ) -> Result<Vec<Contact>> {
+        require_scope(ctx, Scope::Account)?;
+        let state = ctx.data_unchecked::<AppState>();
+
+        let contacts = ContactsService::new(state.db.clone())
+            .get_contacts(viewer(ctx).user_id, include_blocked)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(contacts.into_iter().map(Contact).collect())
+    }
+
+    /// The user's downloaded sticker packs, in their order
+    async fn sticker_packs(&self, ctx: &Context<'_>) -> Result<Vec<StickerPack>> {
+        require_scope(ctx, Scope::Account)?;
+        let state = ctx.data_unchecked::<AppState>();
+
+        let packs = StickersService::new(state.db.clone(), state.minio.clone())
+            .get_user_packs(viewer(ctx).user_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(packs.into_iter().map(StickerPack::from).collect())
+    }
+}
+
+/// `GET|POST /graphql`
+pub async fn graphql_handler(
+    State(state): State<AppState>,
+    Extension(schema): Extension<ApiSchema>,
+    Extension(claims): Extension<Claims>,
+    request: GraphQLRequest,
+) -> AppResult<GraphQLResponse> {
+    let user_id = get_user_id(&claims)?;
+    let workspace_id = get_workspace_id(&claims)?;
+
+    // Loaders live for one request, so batches never mix callers
+    let request = request
+        .into_inner()
+        .data(DataLoader::new(
+            UserLoader::new(state.db.clone()),
+            tokio::spawn,
+        ))
+        .data(DataLoader::new(
+            ParticipantsLoader::new(state.db.clone()),
+            tokio::spawn,
+        ))
+        .data(DataLoader::new(
+            LastMessageLoader::new(state.db.clone(), user_id),
+            tokio::spawn,
+        ))
+        .data(DataLoader::new(
+            ViewerStateLoader::new(state.db.clone(), user_id),
+            tokio::spawn,
+        ))
+        .data(DataLoader::new(
+            StickerLoader::new(state.db.clone()),
+            tokio::spawn,
+        ))
+        .data(Viewer {
+            user_id,
+            workspace_id,
+            claims,
+        })
+        .data(state);
+
+    Ok(schema.execute(request).await.into())
+}
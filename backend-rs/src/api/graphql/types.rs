@@ -0,0 +1,439 @@
+//! GraphQL views of the models. Enum fields carry the same lowercase
+//! strings as the REST API; binary content is base64.
+
+use async_graphql::{dataloader::DataLoader, Context, Object, Result, SimpleObject};
+use base64::{engine::general_purpose::STANDARD, Engine};
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use uuid::Uuid;
+
+use super::{
+    gql_error,
+    loaders::{
+        LastMessageLoader, ParticipantsLoader, StickerLoader, UserLoader, ViewerStateLoader,
+    },
+    viewer,
+};
+use crate::{
+    models::{self, MessageRequestStatus, UserStatus},
+    services::{archives::ArchiveService, messaging::MessagingService},
+    AppState,
+};
+
+const MAX_MESSAGES: i32 = 100;
+
+/// A serde enum's wire name, e.g. `MessageType::Text` -> `"text"`
+fn wire_name<T: Serialize>(value: &T) -> String {
+    serde_json::to_value(value)
+        .ok()
+        .and_then(|v| v.as_str().map(str::to_string))
+        .unwrap_or_default()
+}
+
+pub struct User(pub models::User);
+
+#[Object]
+impl User {
+    async fn id(&self) -> Uuid {
+        self.0.id
+    }
+
+    async fn username(&self) -> &str {
+        &self.0.username
+    }
+
+    async fn display_name(&self) -> &str {
+        &self.0.display_name
+    }
+
+    async fn phone(&self) -> Option<&str> {
+        self.0.phone.as_deref()
+    }
+
+    async fn email(&self) -> Option<&str> {
+        self.0.email.as_deref()
+    }
+
+    async fn avatar_url(&self) -> Option<&str> {
+        self.0.avatar_url.as_deref()
+    }
+
+    async fn bio(&self) -> Option<&str> {
+        self.0.bio.as_deref()
+    }
+
+    async fn status(&self) -> String {
+        wire_name(&self.0.status)
+    }
+
+    async fn last_seen_at(&self) -> Option<DateTime<Utc>> {
+        self.0.last_seen_at
+    }
+}
+
+pub struct Conversation(pub models::Conversation);
+
+#[Object]
+impl Conversation {
+    async fn id(&self) -> Uuid {
+        self.0.id
+    }
+
+    #[graphql(name = "type")]
+    async fn conversation_type(&self) -> String {
+        wire_name(&self.0.conversation_type)
+    }
+
+    async fn name(&self) -> Option<&str> {
+        self.0.name.as_deref()
+    }
+
+    async fn avatar_url(&self) -> Option<&str> {
+        self.0.avatar_url.as_deref()
+    }
+
+    async fn created_by(&self) -> Uuid {
+        self.0.created_by
+    }
+
+    async fn workspace_id(&self) -> Option<Uuid> {
+        self.0.workspace_id
+    }
+
+    async fn last_message_at(&self) -> Option<DateTime<Utc>> {
+        self.0.last_message_at
+    }
+
+    async fn slow_mode_seconds(&self) -> i32 {
+        self.0.slow_mode_seconds
+    }
+
+    async fn imported_from(&self) -> Option<String> {
+        self.0.imported_from.as_ref().map(wire_name)
+    }
+
+    async fn share_links_enabled(&self) -> bool {
+        self.0.share_links_enabled
+    }
+
+    async fn created_at(&self) -> DateTime<Utc> {
+        self.0.created_at
+    }
+
+    async fn updated_at(&self) -> DateTime<Utc> {
+        self.0.updated_at
+    }
+
+    async fn participants(&self, ctx: &Context<'_>) -> Result<Vec<Participant>> {
+        let participants = ctx
+            .data_unchecked::<DataLoader<ParticipantsLoader>>()
+            .load_one(self.0.id)
+            .await
+            .map_err(|e| gql_error(&e))?
+            .unwrap_or_default();
+
+        Ok(participants.into_iter().map(Participant).collect())
+    }
+
+    async fn last_message(&self, ctx: &Context<'_>) -> Result<Option<Message>> {
+        let message = ctx
+            .data_unchecked::<DataLoader<LastMessageLoader>>()
+            .load_one(self.0.id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(message.map(Message))
+    }
+
+    async fn unread_count(&self, ctx: &Context<'_>) -> Result<i64> {
+        Ok(self.viewer_state(ctx).await?.unread_count)
+    }
+
+    /// The viewer marked the conversation unread
+    async fn marked_unread(&self, ctx: &Context<'_>) -> Result<bool> {
+        Ok(self.viewer_state(ctx).await?.marked_unread)
+    }
+
+    /// When the viewer flagged the conversation, if they did
+    async fn flagged_at(&self, ctx: &Context<'_>) -> Result<Option<DateTime<Utc>>> {
+        Ok(self.viewer_state(ctx).await?.flagged_at)
+    }
+
+    /// Newest first, like `GET /conversations/:id/messages`
+    async fn messages(
+        &self,
+        ctx: &Context<'_>,
+        #[graphql(default = 50)] limit: i32,
+        before: Option<Uuid>,
+    ) -> Result<Vec<Message>> {
+        let state = ctx.data_unchecked::<AppState>();
+        let viewer = viewer(ctx);
+
+        let archives = ArchiveService::new(
+            state.db.clone(),
+            state.minio.clone(),
+            state.config.current().archive.clone(),
+        );
+        let messages = MessagingService::new(state.db.clone(), state.redis.clone())
+            .get_messages(
+                self.0.id,
+                viewer.user_id,
+                limit.clamp(1, MAX_MESSAGES),
+                0,
+                before,
+                &archives,
+            )
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(messages.into_iter().map(Message).collect())
+    }
+}
+
+impl Conversation {
+    async fn viewer_state(&self, ctx: &Context<'_>) -> Result<super::loaders::ViewerState> {
+        let state = ctx
+            .data_unchecked::<DataLoader<ViewerStateLoader>>()
+            .load_one(self.0.id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(state.unwrap_or_default())
+    }
+}
+
+pub struct Participant(pub models::Participant);
+
+#[Object]
+impl Participant {
+    async fn user_id(&self) -> Uuid {
+        self.0.user_id
+    }
+
+    async fn role(&self) -> String {
+        wire_name(&self.0.role)
+    }
+
+    async fn joined_at(&self) -> DateTime<Utc> {
+        self.0.joined_at
+    }
+
+    async fn muted_until(&self) -> Option<DateTime<Utc>> {
+        self.0.muted_until
+    }
+
+    async fn request_status(&self) -> Option<String> {
+        self.0.request_status.as_ref().map(wire_name)
+    }
+
+    async fn delivered_up_to(&self) -> Option<DateTime<Utc>> {
+        self.0.delivered_up_to
+    }
+
+    async fn read_up_to(&self, ctx: &Context<'_>) -> Result<Option<DateTime<Utc>>> {
+        if self.0.user_id == viewer(ctx).user_id {
+            return Ok(self.0.read_up_to);
+        }
+
+        let account_read_receipts = ctx
+            .data_unchecked::<DataLoader<UserLoader>>()
+            .load_one(self.0.user_id)
+            .await
+            .map_err(|e| gql_error(&e))?
+            .map_or(true, |user| user.read_receipts);
+        if !self.0.shares_read_receipts(account_read_receipts) {
+            return Ok(None);
+        }
+
+        Ok(self.0.read_up_to)
+    }
+
+    async fn user(&self, ctx: &Context<'_>) -> Result<Option<User>> {
+        let mut user = ctx
+            .data_unchecked::<DataLoader<UserLoader>>()
+            .load_one(self.0.user_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        // No presence leaks to the sender before a request is accepted
+        let pending = self.0.request_status == Some(MessageRequestStatus::Pending);
+        if pending && self.0.user_id != viewer(ctx).user_id {
+            if let Some(user) = user.as_mut() {
+                user.status = UserStatus::Offline;
+                user.last_seen_at = None;
+            }
+        }
+
+        Ok(user.map(User))
+    }
+}
+
+pub struct Message(pub models::Message);
+
+#[Object]
+impl Message {
+    async fn id(&self) -> Uuid {
+        self.0.id
+    }
+
+    async fn conversation_id(&self) -> Uuid {
+        self.0.conversation_id
+    }
+
+    async fn sender_id(&self) -> Uuid {
+        self.0.sender_id
+    }
+
+    #[graphql(name = "type")]
+    async fn message_type(&self) -> String {
+        wire_name(&self.0.message_type)
+    }
+
+    /// Encrypted payload, base64
+    async fn content(&self) -> String {
+        STANDARD.encode(&self.0.content)
+    }
+
+    async fn sticker_id(&self) -> Option<Uuid> {
+        self.0.sticker_id
+    }
+
+    async fn reply_to_id(&self) -> Option<Uuid> {
+        self.0.reply_to_id
+    }
+
+    async fn format_version(&self) -> Option<i16> {
+        self.0.format_version
+    }
+
+    /// What happened, for `system` messages
+    async fn system_event(&self) -> Option<async_graphql::Json<models::SystemEvent>> {
+        self.0
+            .system_event
+            .as_ref()
+            .map(|event| async_graphql::Json(event.0.clone()))
+    }
+
+    async fn status(&self) -> String {
+        wire_name(&self.0.status)
+    }
+
+    async fn edited_at(&self) -> Option<DateTime<Utc>> {
+        self.0.edited_at
+    }
+
+    async fn created_at(&self) -> DateTime<Utc> {
+        self.0.created_at
+    }
+
+    async fn sender(&self, ctx: &Context<'_>) -> Result<Option<User>> {
+        let user = ctx
+            .data_unchecked::<DataLoader<UserLoader>>()
+            .load_one(self.0.sender_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(user.map(User))
+    }
+
+    async fn sticker(&self, ctx: &Context<'_>) -> Result<Option<Sticker>> {
+        let Some(sticker_id) = self.0.sticker_id else {
+            return Ok(None);
+        };
+
+        let sticker = ctx
+            .data_unchecked::<DataLoader<StickerLoader>>()
+            .load_one(sticker_id)
+            .await
+            .map_err(|e| gql_error(&e))?;
+
+        Ok(sticker.map(Sticker::from))
+    }
+}
+
+pub struct Contact(pub models::ContactWithUser);
+
+#[Object]
+impl Contact {
+    async fn id(&self) -> Uuid {
+        self.0.contact.id
+    }
+
+    async fn contact_id(&self) -> Uuid {
+        self.0.contact.contact_id
+    }
+
+    async fn nickname(&self) -> Option<&str> {
+        self.0.contact.nickname.as_deref()
+    }
+
+    async fn is_blocked(&self) -> bool {
+        self.0.contact.is_blocked
+    }
+
+    async fn is_favorite(&self) -> bool {
+        self.0.contact.is_favorite
+    }
+
+    async fn created_at(&self) -> DateTime<Utc> {
+        self.0.contact.created_at
+    }
+
+    async fn updated_at(&self) -> DateTime<Utc> {
+        self.0.contact.updated_at
+    }
+
+    async fn user(&self) -> Option<User> {
+        self.0.user.clone().map(User)
+    }
+}
+
+#[derive(SimpleObject)]
+pub struct Sticker {
+    pub id: Uuid,
+    pub pack_id: Uuid,
+    pub emoji: String,
+    pub image_url: String,
+    pub position: i32,
+}
+
+impl From<models::Sticker> for Sticker {
+    fn from(sticker: models::Sticker) -> Self {
+        Self {
+            id: sticker.id,
+            pack_id: sticker.pack_id,
+            emoji: sticker.emoji,
+            image_url: sticker.image_url,
+            position: sticker.position,
+        }
+    }
+}
+
+#[derive(SimpleObject)]
+pub struct StickerPack {
+    pub id: Uuid,
+    pub name: String,
+    pub author: String,
+    pub description: Option<String>,
+    pub cover_url: Option<String>,
+    pub is_official: bool,
+    pub is_animated: bool,
+    pub workspace_id: Option<Uuid>,
+    pub stickers: Vec<Sticker>,
+}
+
+impl From<models::StickerPackWithStickers> for StickerPack {
+    fn from(pack: models::StickerPackWithStickers) -> Self {
+        Self {
+            id: pack.pack.id,
+            name: pack.pack.name,
+            author: pack.pack.author,
+            description: pack.pack.description,
+            cover_url: pack.pack.cover_url,
+            is_official: pack.pack.is_official,
+            is_animated: pack.pack.is_animated,
+            workspace_id: pack.pack.workspace_id,
+            stickers: pack.stickers.into_iter().map(Sticker::from).collect(),
+        }
+    }
+}
@@ -0,0 +1,58 @@
+use axum::{extract::State, Extension};
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{AbuseBlock, AddAbuseBlocksRequest, ListAbuseBlocksQuery},
+    services::{abuse::AbuseService, auth::Claims},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+pub async fn list_abuse_blocks(
+    State(state): State<AppState>,
+    Query(query): Query<ListAbuseBlocksQuery>,
+) -> AppResult<Json<Vec<AbuseBlock>>> {
+    let abuse_service = AbuseService::new(state.db, state.redis);
+    let blocks = abuse_service.list(query.kind).await?;
+
+    Ok(Json(blocks))
+}
+
+pub async fn add_abuse_blocks(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<AddAbuseBlocksRequest>,
+) -> AppResult<Json<Vec<AbuseBlock>>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let abuse_service = AbuseService::new(state.db, state.redis);
+    let added = abuse_service
+        .add(admin_id, req.kind, &req.values, req.reason.as_deref())
+        .await?;
+
+    Ok(Json(added))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn remove_abuse_block(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(block_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let abuse_service = AbuseService::new(state.db, state.redis);
+    abuse_service.remove(admin_id, block_id).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Block removed".to_string(),
+    }))
+}
@@ -0,0 +1,52 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{AccessToken, CreateAccessTokenRequest, CreatedAccessToken},
+    services::{access_tokens::AccessTokensService, auth::Claims},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+fn access_tokens_service(state: AppState) -> AccessTokensService {
+    let config = state.config.current();
+    AccessTokensService::new(state.db, state.redis, config.access_tokens.clone())
+}
+
+pub async fn list_access_tokens(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<Vec<AccessToken>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let tokens = access_tokens_service(state).list(user_id).await?;
+
+    Ok(Json(tokens))
+}
+
+pub async fn create_access_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<CreateAccessTokenRequest>,
+) -> AppResult<Json<CreatedAccessToken>> {
+    let token = access_tokens_service(state).create(&claims, req).await?;
+
+    Ok(Json(token))
+}
+
+pub async fn revoke_access_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(token_id): Path<Uuid>,
+) -> AppResult<Json<AccessToken>> {
+    let user_id = get_user_id(&claims)?;
+
+    let token = access_tokens_service(state)
+        .revoke(user_id, token_id)
+        .await?;
+
+    Ok(Json(token))
+}
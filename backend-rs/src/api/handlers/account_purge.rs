@@ -0,0 +1,69 @@
+use axum::{extract::State, Extension};
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{AddPurgeExclusionRequest, PurgeExclusion},
+    services::{account_purge::AccountPurgeService, auth::Claims},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+fn purge_service(state: AppState) -> AccountPurgeService {
+    let config = state.config.current();
+    AccountPurgeService::new(
+        state.db,
+        state.minio,
+        state.jobs,
+        config.account_purge.clone(),
+        config.storage.clone(),
+        config.archive.clone(),
+    )
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn list_purge_exclusions(
+    State(state): State<AppState>,
+) -> AppResult<Json<Vec<PurgeExclusion>>> {
+    let exclusions = purge_service(state).list_exclusions().await?;
+
+    Ok(Json(exclusions))
+}
+
+pub async fn add_purge_exclusion(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(user_id): Path<Uuid>,
+    Json(req): Json<AddPurgeExclusionRequest>,
+) -> AppResult<Json<PurgeExclusion>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let exclusion = purge_service(state)
+        .exclude(admin_id, user_id, req.reason.as_deref())
+        .await?;
+
+    Ok(Json(exclusion))
+}
+
+pub async fn remove_purge_exclusion(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(user_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let admin_id = get_user_id(&claims)?;
+
+    purge_service(state)
+        .remove_exclusion(admin_id, user_id)
+        .await?;
+
+    Ok(Json(MessageResponse {
+        message: "Purge exclusion removed".to_string(),
+    }))
+}
@@ -0,0 +1,60 @@
+use axum::{
+    extract::State,
+    http::{header::AUTHORIZATION, HeaderMap},
+};
+use serde::Deserialize;
+
+use crate::{
+    error::{AppError, AppResult},
+    services::{
+        analytics::{AnalyticsService, AnalyticsSummary},
+        delivery_sla::DeliverySlaService,
+        otp_delivery,
+        outbox::OutboxService,
+    },
+    AppState,
+};
+
+use super::super::extract::{Json, Query};
+
+#[derive(Debug, Deserialize)]
+pub struct StatsQuery {
+    #[serde(default = "default_days")]
+    pub days: i64,
+}
+
+fn default_days() -> i64 {
+    30
+}
+
+pub async fn get_stats(
+    State(state): State<AppState>,
+    Query(query): Query<StatsQuery>,
+) -> AppResult<Json<AnalyticsSummary>> {
+    let analytics_service = AnalyticsService::new(state.redis);
+    let summary = analytics_service.summary(query.days).await?;
+
+    Ok(Json(summary))
+}
+
+pub async fn get_metrics(State(state): State<AppState>, headers: HeaderMap) -> AppResult<String> {
+    let token = headers
+        .get(AUTHORIZATION)
+        .and_then(|h| h.to_str().ok())
+        .and_then(|h| h.strip_prefix("Bearer "));
+    let config = state.config.current();
+    match (config.server.metrics_token.as_deref(), token) {
+        (Some(expected), Some(token)) if otp_delivery::constant_time_eq(expected, token) => {}
+        _ => return Err(AppError::Unauthorized),
+    }
+
+    let analytics_service = AnalyticsService::new(state.redis.clone());
+    let outbox_service = OutboxService::new(state.db.clone(), state.redis);
+    let delivery_sla_service = DeliverySlaService::new(state.db);
+
+    let mut metrics = analytics_service.prometheus_metrics().await?;
+    metrics.push_str(&outbox_service.prometheus_metrics().await?);
+    metrics.push_str(&delivery_sla_service.prometheus_metrics().await?);
+
+    Ok(metrics)
+}
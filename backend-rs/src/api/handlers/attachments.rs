@@ -0,0 +1,185 @@
+use std::net::SocketAddr;
+
+use axum::{
+    body::Bytes,
+    extract::{ConnectInfo, State},
+    http::{header::CONTENT_TYPE, HeaderMap},
+    response::Redirect,
+    Extension,
+};
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{AttachmentDeliveryStatus, AttachmentUpload, DeclareDeliveriesRequest},
+    services::{
+        abuse::ClientOrigin,
+        attachments::AttachmentsService,
+        auth::Claims,
+        downloads::{Downloader, DownloadsService},
+    },
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::{get_device_id, get_user_id};
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn upload_attachment(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    headers: HeaderMap,
+    body: Bytes,
+) -> AppResult<Json<AttachmentUpload>> {
+    let user_id = get_user_id(&claims)?;
+
+    let content_type = headers
+        .get(CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("application/octet-stream");
+
+    let attachments_service = AttachmentsService::new(
+        state.db,
+        state.minio,
+        state.jobs,
+        state.config.current().storage.clone(),
+    );
+    let upload = attachments_service
+        .upload_attachment(user_id, body, content_type)
+        .await?;
+
+    Ok(Json(upload))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ClaimAttachmentRequest {
+    pub digest: String,
+}
+
+pub async fn claim_attachment(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
+    Json(req): Json<ClaimAttachmentRequest>,
+) -> AppResult<Json<AttachmentUpload>> {
+    let user_id = get_user_id(&claims)?;
+
+    let config = state.config.current();
+    let downloads = DownloadsService::new(state.db.clone(), state.redis, config.downloads.clone());
+    let downloader = Downloader {
+        user_id,
+        ip: ClientOrigin::from_request(&headers, peer, &config.abuse).ip,
+    };
+    downloads.check(&downloader).await?;
+
+    // The caller already holds the content it claims, so only probes for
+    // digests that aren't stored are counted
+    let attachments_service =
+        AttachmentsService::new(state.db, state.minio, state.jobs, config.storage.clone());
+    let result = attachments_service
+        .claim_attachment(user_id, &req.digest)
+        .await;
+    if let Err(AppError::AttachmentNotFound) = &result {
+        downloads.record_miss(&downloader).await?;
+    }
+
+    Ok(Json(result?))
+}
+
+pub async fn release_attachment(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(ref_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let attachments_service = AttachmentsService::new(
+        state.db,
+        state.minio,
+        state.jobs,
+        state.config.current().storage.clone(),
+    );
+    attachments_service.release_reference(user_id, ref_id).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Attachment released".to_string(),
+    }))
+}
+
+pub async fn declare_deliveries(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(ref_id): Path<Uuid>,
+    Json(req): Json<DeclareDeliveriesRequest>,
+) -> AppResult<Json<AttachmentDeliveryStatus>> {
+    let user_id = get_user_id(&claims)?;
+    let device_id = get_device_id(&claims)?;
+
+    let attachments_service = AttachmentsService::new(
+        state.db,
+        state.minio,
+        state.jobs,
+        state.config.current().storage.clone(),
+    );
+    let status = attachments_service
+        .declare_deliveries(user_id, device_id, ref_id, req.conversation_id)
+        .await?;
+
+    Ok(Json(status))
+}
+
+pub async fn confirm_download(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(attachment_id): Path<Uuid>,
+) -> AppResult<Json<AttachmentDeliveryStatus>> {
+    let user_id = get_user_id(&claims)?;
+    let device_id = get_device_id(&claims)?;
+
+    let attachments_service = AttachmentsService::new(
+        state.db,
+        state.minio,
+        state.jobs,
+        state.config.current().storage.clone(),
+    );
+    let status = attachments_service
+        .confirm_download(user_id, device_id, attachment_id)
+        .await?;
+
+    Ok(Json(status))
+}
+
+pub async fn redirect_file(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
+    Path(attachment_id): Path<Uuid>,
+) -> AppResult<Redirect> {
+    let user_id = get_user_id(&claims)?;
+
+    let config = state.config.current();
+    let downloads = DownloadsService::new(state.db.clone(), state.redis, config.downloads.clone());
+    let downloader = Downloader {
+        user_id,
+        ip: ClientOrigin::from_request(&headers, peer, &config.abuse).ip,
+    };
+    downloads.check(&downloader).await?;
+
+    let attachments_service =
+        AttachmentsService::new(state.db, state.minio, state.jobs, config.storage.clone());
+    let result = attachments_service.get_file_url(user_id, attachment_id).await;
+    let (url, _) = downloads
+        .settle(&downloader, result, |(_, size_bytes)| {
+            (attachment_id, *size_bytes)
+        })
+        .await?;
+
+    Ok(Redirect::temporary(&url))
+}
@@ -1,60 +1,160 @@
-use axum::{extract::State, Extension, Json};
+use std::net::SocketAddr;
+
+use axum::{
+    extract::{ConnectInfo, OriginalUri, State},
+    http::{header::ACCEPT_LANGUAGE, HeaderMap, Method, StatusCode},
+    Extension,
+};
 use serde::{Deserialize, Serialize};
+use ts_rs::TS;
+use uuid::Uuid;
 
 use crate::{
     error::{AppError, AppResult},
-    models::{OtpType, TokenPair, User},
-    services::auth::{AuthService, Claims},
+    models::{Otp, OtpType, ScopedToken, TokenPair, User},
+    services::{
+        abuse::{AbuseService, ClientOrigin},
+        analytics::{AnalyticsService, COUNTER_SIGNUPS},
+        auth::{AuthService, Claims, Scope},
+        dpop::DpopService,
+        email_validation::EmailValidationService,
+        lockout::{LockoutService, SignInAttempt},
+        otp_delivery::OtpDeliveryService,
+        otp_templates,
+    },
     AppState,
 };
 
+use super::super::extract::{Json, Query};
 use super::super::middleware::{get_device_id, get_user_id};
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct SendOtpRequest {
     pub target: String,
     #[serde(rename = "type")]
+    #[ts(as = "OtpType")]
     pub otp_type: String,
+    /// Language for the message, e.g. `zh-TW`; Accept-Language otherwise
+    #[ts(optional)]
+    pub locale: Option<String>,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Serialize, TS)]
 pub struct MessageResponse {
     pub message: String,
 }
 
 pub async fn send_otp(
     State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
     Json(req): Json<SendOtpRequest>,
-) -> AppResult<Json<MessageResponse>> {
+) -> AppResult<(StatusCode, Json<MessageResponse>)> {
     let otp_type = match req.otp_type.as_str() {
         "phone" => OtpType::Phone,
         "email" => OtpType::Email,
         _ => return Err(AppError::BadRequest("Invalid OTP type".to_string())),
     };
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
-    auth_service.send_otp(&req.target, otp_type).await?;
+    let config = state.config.current();
+    let abuse_service = AbuseService::new(state.db.clone(), state.redis.clone());
+    abuse_service
+        .check_origin(&ClientOrigin::from_request(&headers, peer, &config.abuse))
+        .await?;
+
+    let auth_service = AuthService::new(state.db.clone(), state.redis.clone(), (*config).clone());
+    let target = auth_service.normalize_target(&req.target, otp_type)?;
+    match otp_type {
+        OtpType::Phone => abuse_service.check_phone(&target).await?,
+        OtpType::Email => {
+            EmailValidationService::new(state.db.clone(), state.redis, config.email.clone())
+                .validate(&target)
+                .await?
+        }
+    }
+    auth_service.issue_otp(&target, otp_type).await?;
 
-    Ok(Json(MessageResponse {
-        message: "OTP sent successfully".to_string(),
-    }))
+    let delivery_service = OtpDeliveryService::new(
+        state.db,
+        state.http,
+        state.breakers,
+        config.otp_delivery.clone(),
+        config.server.environment.clone(),
+    );
+    let locale = otp_templates::negotiate(
+        req.locale.as_deref(),
+        headers
+            .get(ACCEPT_LANGUAGE)
+            .and_then(|v| v.to_str().ok()),
+    );
+    match delivery_service.deliver(&target, otp_type, locale).await {
+        Ok(()) => Ok((
+            StatusCode::OK,
+            Json(MessageResponse {
+                message: "OTP sent successfully".to_string(),
+            }),
+        )),
+        // Provider down: send it from a job worker once it's back
+        Err(AppError::DependencyUnavailable { .. }) => {
+            delivery_service
+                .queue(&state.jobs, &target, otp_type, locale)
+                .await?;
+
+            Ok((
+                StatusCode::ACCEPTED,
+                Json(MessageResponse {
+                    message: "OTP queued for delivery".to_string(),
+                }),
+            ))
+        }
+        Err(e) => Err(e),
+    }
 }
 
 #[derive(Debug, Deserialize)]
+pub struct LatestOtpQuery {
+    pub target: String,
+    #[serde(rename = "type")]
+    pub otp_type: String,
+}
+
+/// The last code issued for a target, so E2E tests and local clients can
+/// log in without reading server logs. Only routed outside production.
+pub async fn get_latest_otp(
+    State(state): State<AppState>,
+    Query(query): Query<LatestOtpQuery>,
+) -> AppResult<Json<Otp>> {
+    let otp_type = match query.otp_type.as_str() {
+        "phone" => OtpType::Phone,
+        "email" => OtpType::Email,
+        _ => return Err(AppError::BadRequest("Invalid OTP type".to_string())),
+    };
+
+    let auth_service = AuthService::new(state.db, state.redis, (*state.config.current()).clone());
+    let target = auth_service.normalize_target(&query.target, otp_type)?;
+    let otp = auth_service.latest_otp(&target, otp_type).await?;
+
+    Ok(Json(otp))
+}
+
+#[derive(Debug, Deserialize, TS)]
 pub struct VerifyOtpRequest {
     pub target: String,
     #[serde(rename = "type")]
+    #[ts(as = "OtpType")]
     pub otp_type: String,
     pub code: String,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Serialize, TS)]
 pub struct VerifyResponse {
     pub verified: bool,
 }
 
 pub async fn verify_otp(
     State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
     Json(req): Json<VerifyOtpRequest>,
 ) -> AppResult<Json<VerifyResponse>> {
     let otp_type = match req.otp_type.as_str() {
@@ -63,15 +163,28 @@ pub async fn verify_otp(
         _ => return Err(AppError::BadRequest("Invalid OTP type".to_string())),
     };
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
-    auth_service.verify_otp(&req.target, otp_type, &req.code).await?;
+    let config = state.config.current();
+    let auth_service = AuthService::new(state.db.clone(), state.redis.clone(), (*config).clone());
+    let target = auth_service.normalize_target(&req.target, otp_type)?;
+
+    let lockout = LockoutService::new(state.db, state.redis, config.lockout.clone());
+    let attempt = SignInAttempt {
+        action: "verify_otp",
+        target: Some(target.clone()),
+        ip: ClientOrigin::from_request(&headers, peer, &config.abuse).ip,
+    };
+    lockout.check(&attempt).await?;
+    let result = auth_service.verify_otp(&target, otp_type, &req.code).await;
+    lockout.settle(&attempt, result).await?;
 
     Ok(Json(VerifyResponse { verified: true }))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct RegisterRequest {
+    #[ts(optional)]
     pub phone: Option<String>,
+    #[ts(optional)]
     pub email: Option<String>,
     pub username: String,
     pub display_name: String,
@@ -79,39 +192,85 @@ pub struct RegisterRequest {
     pub platform: String,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Serialize, TS)]
 pub struct AuthResponse {
     pub user: User,
     pub tokens: TokenPair,
 }
 
+/// Thumbprint of the device key to bind new tokens to, from the request's
+/// DPoP proof
+async fn dpop_binding(
+    state: &AppState,
+    method: &Method,
+    uri: &OriginalUri,
+    headers: &HeaderMap,
+) -> AppResult<Option<String>> {
+    DpopService::new(state.redis.clone(), state.config.current().dpop.clone())
+        .binding_for(headers, method, uri.path())
+        .await
+}
+
 pub async fn register(
     State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    method: Method,
+    uri: OriginalUri,
+    headers: HeaderMap,
     Json(req): Json<RegisterRequest>,
 ) -> AppResult<Json<AuthResponse>> {
     if req.phone.is_none() && req.email.is_none() {
         return Err(AppError::BadRequest("Phone or email is required".to_string()));
     }
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
+    let dpop_jkt = dpop_binding(&state, &method, &uri, &headers).await?;
+
+    let config = state.config.current();
+    let abuse_service = AbuseService::new(state.db.clone(), state.redis.clone());
+    abuse_service
+        .check_origin(&ClientOrigin::from_request(&headers, peer, &config.abuse))
+        .await?;
+
+    let auth_service = AuthService::new(state.db.clone(), state.redis.clone(), (*config).clone());
+    let phone = req
+        .phone
+        .as_deref()
+        .map(|p| auth_service.normalize_phone(p))
+        .transpose()?;
+    if let Some(phone) = &phone {
+        abuse_service.check_phone(phone).await?;
+    }
+    let email = req.email.as_deref().map(str::trim);
+
+    let email_service =
+        EmailValidationService::new(state.db, state.redis.clone(), config.email.clone());
+    if let Some(email) = email {
+        email_service.validate(email).await?;
+    }
+    email_service.check_registration(phone.as_deref(), email)?;
+
     let (user, tokens) = auth_service
         .register(
-            req.phone.as_deref(),
-            req.email.as_deref(),
+            phone.as_deref(),
+            email,
             &req.username,
             &req.display_name,
             &req.device_name,
             &req.platform,
+            dpop_jkt.as_deref(),
         )
         .await?;
 
+    let _ = AnalyticsService::new(state.redis).incr(COUNTER_SIGNUPS).await;
+
     Ok(Json(AuthResponse { user, tokens }))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct LoginRequest {
     pub target: String,
     #[serde(rename = "type")]
+    #[ts(as = "OtpType")]
     pub otp_type: String,
     pub device_name: String,
     pub platform: String,
@@ -119,6 +278,10 @@ pub struct LoginRequest {
 
 pub async fn login(
     State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    method: Method,
+    uri: OriginalUri,
+    headers: HeaderMap,
     Json(req): Json<LoginRequest>,
 ) -> AppResult<Json<AuthResponse>> {
     let otp_type = match req.otp_type.as_str() {
@@ -127,34 +290,127 @@ pub async fn login(
         _ => return Err(AppError::BadRequest("Invalid OTP type".to_string())),
     };
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
-    let (user, tokens) = auth_service
-        .login(&req.target, otp_type, &req.device_name, &req.platform)
-        .await?;
+    let dpop_jkt = dpop_binding(&state, &method, &uri, &headers).await?;
+
+    let config = state.config.current();
+    let auth_service = AuthService::new(state.db.clone(), state.redis.clone(), (*config).clone());
+    let target = auth_service.normalize_target(&req.target, otp_type)?;
+
+    let lockout = LockoutService::new(state.db, state.redis, config.lockout.clone());
+    let attempt = SignInAttempt {
+        action: "login",
+        target: Some(target.clone()),
+        ip: ClientOrigin::from_request(&headers, peer, &config.abuse).ip,
+    };
+    lockout.check(&attempt).await?;
+    let result = auth_service
+        .login(
+            &target,
+            otp_type,
+            &req.device_name,
+            &req.platform,
+            dpop_jkt.as_deref(),
+        )
+        .await;
+    let (user, tokens) = lockout.settle(&attempt, result).await?;
 
     Ok(Json(AuthResponse { user, tokens }))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct RefreshRequest {
     pub refresh_token: String,
 }
 
-#[derive(Debug, Serialize)]
+#[derive(Debug, Serialize, TS)]
 pub struct TokenResponse {
     pub tokens: TokenPair,
 }
 
 pub async fn refresh_token(
     State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    method: Method,
+    uri: OriginalUri,
+    headers: HeaderMap,
     Json(req): Json<RefreshRequest>,
 ) -> AppResult<Json<TokenResponse>> {
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
-    let tokens = auth_service.refresh_token(&req.refresh_token).await?;
+    let dpop_jkt = dpop_binding(&state, &method, &uri, &headers).await?;
+
+    let config = state.config.current();
+    let auth_service = AuthService::new(state.db.clone(), state.redis.clone(), (*config).clone());
+
+    // Only a token with a valid signature names an account worth counting
+    // failures against; forged ones count against the IP alone
+    let lockout = LockoutService::new(state.db, state.redis, config.lockout.clone());
+    let attempt = SignInAttempt {
+        action: "refresh_token",
+        target: auth_service
+            .validate_token(&req.refresh_token)
+            .ok()
+            .map(|claims| claims.sub),
+        ip: ClientOrigin::from_request(&headers, peer, &config.abuse).ip,
+    };
+    lockout.check(&attempt).await?;
+    let result = auth_service
+        .refresh_token(&req.refresh_token, dpop_jkt.as_deref())
+        .await;
+    let tokens = lockout.settle(&attempt, result).await?;
 
     Ok(Json(TokenResponse { tokens }))
 }
 
+#[derive(Debug, Deserialize)]
+pub struct SwitchWorkspaceRequest {
+    pub workspace_id: Option<Uuid>,
+}
+
+pub async fn switch_workspace(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<SwitchWorkspaceRequest>,
+) -> AppResult<Json<TokenResponse>> {
+    let user_id = get_user_id(&claims)?;
+    let device_id = get_device_id(&claims)?;
+
+    // Issues a full token pair, so a downscoped token must not reach it
+    if !claims.scopes.is_empty() {
+        return Err(AppError::Forbidden);
+    }
+
+    let auth_service = AuthService::new(state.db, state.redis, (*state.config.current()).clone());
+    let tokens = auth_service
+        .switch_workspace(
+            user_id,
+            device_id,
+            req.workspace_id,
+            claims.cnf.as_ref().map(|cnf| cnf.jkt.as_str()),
+        )
+        .await?;
+
+    Ok(Json(TokenResponse { tokens }))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ScopedTokenRequest {
+    pub scopes: Vec<Scope>,
+    pub ttl_seconds: Option<u64>,
+}
+
+/// Mint a downscoped access token, e.g. for a web widget or bot
+pub async fn create_scoped_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<ScopedTokenRequest>,
+) -> AppResult<Json<ScopedToken>> {
+    let auth_service = AuthService::new(state.db, state.redis, (*state.config.current()).clone());
+    let token = auth_service
+        .mint_scoped_token(&claims, &req.scopes, req.ttl_seconds)
+        .await?;
+
+    Ok(Json(token))
+}
+
 pub async fn logout(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
@@ -162,7 +418,7 @@ pub async fn logout(
     let user_id = get_user_id(&claims)?;
     let device_id = get_device_id(&claims)?;
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
+    let auth_service = AuthService::new(state.db, state.redis, (*state.config.current()).clone());
     auth_service.logout(user_id, device_id).await?;
 
     Ok(Json(MessageResponse {
@@ -176,10 +432,16 @@ pub async fn logout_all(
 ) -> AppResult<Json<MessageResponse>> {
     let user_id = get_user_id(&claims)?;
 
-    let auth_service = AuthService::new(state.db, state.redis, (*state.config).clone());
+    let auth_service = AuthService::new(state.db, state.redis, (*state.config.current()).clone());
     auth_service.logout_all(user_id).await?;
 
     Ok(Json(MessageResponse {
         message: "Logged out from all devices".to_string(),
     }))
 }
+
+/// Public JWT verification keys (JWKS) so other services can verify tokens.
+/// Empty when tokens are signed with a shared HS256 secret.
+pub async fn get_jwks(State(state): State<AppState>) -> Json<serde_json::Value> {
+    Json(state.config.current().jwt.keys.jwks())
+}
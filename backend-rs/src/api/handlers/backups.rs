@@ -0,0 +1,81 @@
+use axum::{body::Bytes, extract::State, Extension};
+
+use crate::{
+    error::AppResult,
+    models::{Backup, BackupWithUrl},
+    services::{auth::Claims, backups::BackupsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+pub async fn upload_backup(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    body: Bytes,
+) -> AppResult<Json<Backup>> {
+    let user_id = get_user_id(&claims)?;
+
+    let backups_service = BackupsService::new(
+        state.db,
+        state.minio,
+        state.config.current().backup.clone(),
+        state.config.current().storage.clone(),
+    );
+    let backup = backups_service.upload_backup(user_id, body).await?;
+
+    Ok(Json(backup))
+}
+
+pub async fn get_backups(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<Vec<Backup>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let backups_service = BackupsService::new(
+        state.db,
+        state.minio,
+        state.config.current().backup.clone(),
+        state.config.current().storage.clone(),
+    );
+    let backups = backups_service.list_backups(user_id).await?;
+
+    Ok(Json(backups))
+}
+
+pub async fn get_latest_backup(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<BackupWithUrl>> {
+    let user_id = get_user_id(&claims)?;
+
+    let backups_service = BackupsService::new(
+        state.db,
+        state.minio,
+        state.config.current().backup.clone(),
+        state.config.current().storage.clone(),
+    );
+    let backup = backups_service.get_backup(user_id, None).await?;
+
+    Ok(Json(backup))
+}
+
+pub async fn get_backup(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(version): Path<i32>,
+) -> AppResult<Json<BackupWithUrl>> {
+    let user_id = get_user_id(&claims)?;
+
+    let backups_service = BackupsService::new(
+        state.db,
+        state.minio,
+        state.config.current().backup.clone(),
+        state.config.current().storage.clone(),
+    );
+    let backup = backups_service.get_backup(user_id, Some(version)).await?;
+
+    Ok(Json(backup))
+}
@@ -0,0 +1,129 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        AddBotRequest, Bot, BotCommand, BotInvocation, ConversationBot, CreateBotRequest,
+        CreatedBot, SetBotCommandsRequest, SubmitCommandRequest,
+    },
+    services::{auth::Claims, bots::BotsService, limits::LimitsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+fn bots_service(state: AppState) -> BotsService {
+    BotsService::new(state.db, state.http, state.jobs)
+}
+
+// Admin
+
+pub async fn list_bots(State(state): State<AppState>) -> AppResult<Json<Vec<Bot>>> {
+    let bots = bots_service(state).list().await?;
+
+    Ok(Json(bots))
+}
+
+pub async fn create_bot(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<CreateBotRequest>,
+) -> AppResult<Json<CreatedBot>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let bot = bots_service(state)
+        .create(admin_id, &req.name, &req.username, &req.webhook_url)
+        .await?;
+
+    Ok(Json(bot))
+}
+
+pub async fn revoke_bot(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(bot_id): Path<Uuid>,
+) -> AppResult<Json<Bot>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let bot = bots_service(state).revoke(admin_id, bot_id).await?;
+
+    Ok(Json(bot))
+}
+
+pub async fn set_bot_commands(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(bot_id): Path<Uuid>,
+    Json(req): Json<SetBotCommandsRequest>,
+) -> AppResult<Json<Vec<BotCommand>>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let commands = bots_service(state)
+        .set_commands(admin_id, bot_id, &req.commands)
+        .await?;
+
+    Ok(Json(commands))
+}
+
+// Conversations
+
+pub async fn list_conversation_bots(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<Vec<ConversationBot>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let bots = bots_service(state)
+        .list_for_conversation(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(bots))
+}
+
+pub async fn add_bot(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<AddBotRequest>,
+) -> AppResult<Json<Vec<ConversationBot>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let limits = LimitsService::new(state.db.clone(), state.config.current().limits.clone());
+    let bots = bots_service(state)
+        .add_to_conversation(conversation_id, user_id, req.bot_id, &limits)
+        .await?;
+
+    Ok(Json(bots))
+}
+
+pub async fn remove_bot(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, bot_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<Vec<ConversationBot>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let bots = bots_service(state)
+        .remove_from_conversation(conversation_id, user_id, bot_id)
+        .await?;
+
+    Ok(Json(bots))
+}
+
+pub async fn submit_command(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<SubmitCommandRequest>,
+) -> AppResult<Json<BotInvocation>> {
+    let user_id = get_user_id(&claims)?;
+
+    let invocation = bots_service(state)
+        .submit_command(conversation_id, user_id, &req.text)
+        .await?;
+
+    Ok(Json(invocation))
+}
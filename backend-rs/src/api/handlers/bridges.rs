@@ -0,0 +1,203 @@
+use axum::{extract::State, Extension};
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        Bridge, BridgeEventPage, BridgedConversation, BridgedMessage, CreateBridgeRequest,
+        CreatedBridge, LinkConversationRequest, MapMessageRequest, MessageType,
+        RelayMessageRequest, RelayedMessage,
+    },
+    services::{auth::Claims, bridges::BridgesService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+fn bridges_service(state: AppState) -> BridgesService {
+    BridgesService::new(state.db, state.redis)
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+// Admin
+
+pub async fn list_bridges(State(state): State<AppState>) -> AppResult<Json<Vec<Bridge>>> {
+    let bridges = bridges_service(state).list().await?;
+
+    Ok(Json(bridges))
+}
+
+pub async fn create_bridge(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<CreateBridgeRequest>,
+) -> AppResult<Json<CreatedBridge>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let bridge = bridges_service(state)
+        .create(admin_id, &req.name, req.user_id)
+        .await?;
+
+    Ok(Json(bridge))
+}
+
+pub async fn revoke_bridge(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(bridge_id): Path<Uuid>,
+) -> AppResult<Json<Bridge>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let bridge = bridges_service(state).revoke(admin_id, bridge_id).await?;
+
+    Ok(Json(bridge))
+}
+
+// Bridge service account
+
+#[derive(Debug, Deserialize)]
+pub struct BridgedConversationsQuery {
+    pub external_id: Option<String>,
+}
+
+pub async fn list_bridged_conversations(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Query(query): Query<BridgedConversationsQuery>,
+) -> AppResult<Json<Vec<BridgedConversation>>> {
+    let links = bridges_service(state)
+        .list_conversations(&bridge, query.external_id.as_deref())
+        .await?;
+
+    Ok(Json(links))
+}
+
+pub async fn link_conversation(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<LinkConversationRequest>,
+) -> AppResult<Json<BridgedConversation>> {
+    let link = bridges_service(state)
+        .link_conversation(&bridge, conversation_id, &req.external_id)
+        .await?;
+
+    Ok(Json(link))
+}
+
+pub async fn unlink_conversation(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    bridges_service(state)
+        .unlink_conversation(&bridge, conversation_id)
+        .await?;
+
+    Ok(Json(MessageResponse {
+        message: "Conversation unlinked".to_string(),
+    }))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BridgeEventsQuery {
+    #[serde(default)]
+    pub since: i64,
+    #[serde(default = "default_events_limit")]
+    pub limit: i64,
+}
+
+fn default_events_limit() -> i64 {
+    100
+}
+
+pub async fn get_bridge_events(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<BridgeEventsQuery>,
+) -> AppResult<Json<BridgeEventPage>> {
+    let page = bridges_service(state)
+        .list_events(
+            &bridge,
+            conversation_id,
+            query.since,
+            query.limit.clamp(1, 500),
+        )
+        .await?;
+
+    Ok(Json(page))
+}
+
+pub async fn relay_message(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<RelayMessageRequest>,
+) -> AppResult<Json<RelayedMessage>> {
+    // Remote stickers arrive as images; system messages are server-only
+    let message_type = match req.message_type.as_str() {
+        "image" | "sticker" => MessageType::Image,
+        "video" => MessageType::Video,
+        "audio" => MessageType::Audio,
+        "file" => MessageType::File,
+        _ => MessageType::Text,
+    };
+
+    let relayed = bridges_service(state)
+        .relay_message(&bridge, conversation_id, message_type, req)
+        .await?;
+
+    Ok(Json(relayed))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BridgedMessageQuery {
+    pub external_id: String,
+}
+
+pub async fn find_bridged_message(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Query(query): Query<BridgedMessageQuery>,
+) -> AppResult<Json<BridgedMessage>> {
+    let mapping = bridges_service(state)
+        .find_message(&bridge, &query.external_id)
+        .await?
+        .ok_or(AppError::MessageNotFound)?;
+
+    Ok(Json(mapping))
+}
+
+pub async fn map_message(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(message_id): Path<Uuid>,
+    Json(req): Json<MapMessageRequest>,
+) -> AppResult<Json<BridgedMessage>> {
+    let mapping = bridges_service(state)
+        .map_message(&bridge, message_id, &req.external_id)
+        .await?;
+
+    Ok(Json(mapping))
+}
+
+pub async fn delete_relayed_message(
+    State(state): State<AppState>,
+    Extension(bridge): Extension<Bridge>,
+    Path(message_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    bridges_service(state)
+        .delete_relayed(&bridge, message_id)
+        .await?;
+
+    Ok(Json(MessageResponse {
+        message: "Message deleted".to_string(),
+    }))
+}
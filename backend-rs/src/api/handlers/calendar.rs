@@ -0,0 +1,102 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        CalendarEvent, CalendarEventWithRsvps, CalendarEventsQuery, CreateCalendarEventRequest,
+        RsvpRequest,
+    },
+    services::{auth::Claims, calendar::CalendarService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+pub async fn list_events(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<CalendarEventsQuery>,
+) -> AppResult<Json<Vec<CalendarEvent>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let events = CalendarService::new(state.db)
+        .list(conversation_id, user_id, query.from, query.limit)
+        .await?;
+
+    Ok(Json(events))
+}
+
+pub async fn create_event(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<CreateCalendarEventRequest>,
+) -> AppResult<Json<CalendarEvent>> {
+    let user_id = get_user_id(&claims)?;
+
+    let event = CalendarService::new(state.db)
+        .create(conversation_id, user_id, &req)
+        .await?;
+
+    Ok(Json(event))
+}
+
+pub async fn get_event(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, event_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<CalendarEventWithRsvps>> {
+    let user_id = get_user_id(&claims)?;
+
+    let event = CalendarService::new(state.db)
+        .get(conversation_id, event_id, user_id)
+        .await?;
+
+    Ok(Json(event))
+}
+
+pub async fn cancel_event(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, event_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<CalendarEvent>> {
+    let user_id = get_user_id(&claims)?;
+
+    let event = CalendarService::new(state.db)
+        .cancel(conversation_id, event_id, user_id)
+        .await?;
+
+    Ok(Json(event))
+}
+
+pub async fn set_rsvp(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, event_id)): Path<(Uuid, Uuid)>,
+    Json(req): Json<RsvpRequest>,
+) -> AppResult<Json<CalendarEvent>> {
+    let user_id = get_user_id(&claims)?;
+
+    let event = CalendarService::new(state.db)
+        .rsvp(conversation_id, event_id, user_id, req.status)
+        .await?;
+
+    Ok(Json(event))
+}
+
+pub async fn clear_rsvp(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, event_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<CalendarEvent>> {
+    let user_id = get_user_id(&claims)?;
+
+    let event = CalendarService::new(state.db)
+        .clear_rsvp(conversation_id, event_id, user_id)
+        .await?;
+
+    Ok(Json(event))
+}
@@ -0,0 +1,56 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{Call, CallsQuery, ReportCallRequest},
+    services::{auth::Claims, calls::CallsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+pub async fn report_call(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<ReportCallRequest>,
+) -> AppResult<Json<Call>> {
+    let user_id = get_user_id(&claims)?;
+
+    let call = CallsService::new(state.db)
+        .report(conversation_id, user_id, &req)
+        .await?;
+
+    Ok(Json(call))
+}
+
+pub async fn list_conversation_calls(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<CallsQuery>,
+) -> AppResult<Json<Vec<Call>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let calls = CallsService::new(state.db)
+        .list_for_conversation(conversation_id, user_id, query.before, query.limit)
+        .await?;
+
+    Ok(Json(calls))
+}
+
+pub async fn list_my_calls(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<CallsQuery>,
+) -> AppResult<Json<Vec<Call>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let calls = CallsService::new(state.db)
+        .list_for_user(user_id, query.before, query.limit)
+        .await?;
+
+    Ok(Json(calls))
+}
@@ -0,0 +1,12 @@
+use axum::extract::State;
+
+use crate::{error::AppResult, services::circuit_breaker::BreakerStatus, AppState};
+
+use super::super::extract::Json;
+
+/// State of this process's breakers; each API node and worker keeps its own
+pub async fn get_circuit_breakers(
+    State(state): State<AppState>,
+) -> AppResult<Json<Vec<BreakerStatus>>> {
+    Ok(Json(state.breakers.statuses()))
+}
@@ -0,0 +1,100 @@
+use axum::{extract::State, Extension};
+use serde::Deserialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{AuditLog, LegalHold, LegalHoldTarget},
+    services::{audit::AuditService, auth::Claims, legal_holds::LegalHoldsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+#[derive(Debug, Deserialize)]
+pub struct ListHoldsQuery {
+    #[serde(default)]
+    pub active: bool,
+}
+
+pub async fn list_legal_holds(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<ListHoldsQuery>,
+) -> AppResult<Json<Vec<LegalHold>>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let legal_holds_service = LegalHoldsService::new(state.db);
+    let holds = legal_holds_service
+        .list_holds(admin_id, query.active)
+        .await?;
+
+    Ok(Json(holds))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct PlaceHoldRequest {
+    pub target_type: LegalHoldTarget,
+    pub target_id: Uuid,
+    pub reason: String,
+}
+
+pub async fn place_legal_hold(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<PlaceHoldRequest>,
+) -> AppResult<Json<LegalHold>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let legal_holds_service = LegalHoldsService::new(state.db);
+    let hold = legal_holds_service
+        .place_hold(admin_id, req.target_type, req.target_id, &req.reason)
+        .await?;
+
+    Ok(Json(hold))
+}
+
+pub async fn release_legal_hold(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(hold_id): Path<Uuid>,
+) -> AppResult<Json<LegalHold>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let legal_holds_service = LegalHoldsService::new(state.db);
+    let hold = legal_holds_service.release_hold(admin_id, hold_id).await?;
+
+    Ok(Json(hold))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AuditLogQuery {
+    pub target_type: Option<String>,
+    pub target_id: Option<String>,
+    #[serde(default = "default_limit")]
+    pub limit: i32,
+    #[serde(default)]
+    pub offset: i32,
+}
+
+fn default_limit() -> i32 {
+    50
+}
+
+pub async fn get_audit_logs(
+    State(state): State<AppState>,
+    Query(query): Query<AuditLogQuery>,
+) -> AppResult<Json<Vec<AuditLog>>> {
+    let audit_service = AuditService::new(state.db);
+    let logs = audit_service
+        .list(
+            query.target_type.as_deref(),
+            query.target_id.as_deref(),
+            query.limit,
+            query.offset,
+        )
+        .await?;
+
+    Ok(Json(logs))
+}
@@ -1,18 +1,19 @@
-use axum::{
-    extract::{Path, Query, State},
-    Extension, Json,
-};
+use axum::{extract::State, http::HeaderMap, Extension};
 use serde::{Deserialize, Serialize};
+use ts_rs::TS;
 use uuid::Uuid;
 
 use crate::{
     error::AppResult,
-    models::{ContactWithUser, User},
+    models::{ContactSyncResult, ContactWithUser, User},
     services::{auth::Claims, contacts::ContactsService},
     AppState,
 };
 
+use super::super::etag::{if_match, not_modified, watermark_etag, Snapshot, Tagged};
+use super::super::extract::{Json, Path, Query};
 use super::super::middleware::get_user_id;
+use super::super::pagination::{ListFormat, Listing};
 
 #[derive(Debug, Deserialize)]
 pub struct GetContactsQuery {
@@ -24,20 +25,38 @@ pub async fn get_contacts(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Query(query): Query<GetContactsQuery>,
-) -> AppResult<Json<Vec<ContactWithUser>>> {
+    headers: HeaderMap,
+) -> AppResult<Snapshot<Listing<Vec<ContactWithUser>>>> {
     let user_id = get_user_id(&claims)?;
+    let format = ListFormat::from_headers(&headers);
 
     let contacts_service = ContactsService::new(state.db);
+    let watermark = contacts_service
+        .contacts_watermark(user_id, query.include_blocked)
+        .await?;
+    let etag = watermark_etag(
+        &watermark,
+        &[&query.include_blocked.to_string(), format.shape()],
+    );
+    if not_modified(&headers, &etag) {
+        return Ok(Snapshot::NotModified(etag));
+    }
+
     let contacts = contacts_service
         .get_contacts(user_id, query.include_blocked)
         .await?;
 
-    Ok(Json(contacts))
+    // Not paged: every contact comes back at once
+    Ok(Snapshot::Modified(
+        etag,
+        format.list(contacts, None, Some(watermark.count)),
+    ))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct AddContactRequest {
     pub contact_id: Uuid,
+    #[ts(optional)]
     pub nickname: Option<String>,
 }
 
@@ -60,18 +79,20 @@ pub async fn get_contact(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Path(contact_id): Path<Uuid>,
-) -> AppResult<Json<ContactWithUser>> {
+) -> AppResult<Tagged<ContactWithUser>> {
     let user_id = get_user_id(&claims)?;
 
     let contacts_service = ContactsService::new(state.db);
     let contact = contacts_service.get_contact(user_id, contact_id).await?;
 
-    Ok(Json(contact))
+    Ok(Tagged(contact.contact.version, contact))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct UpdateContactRequest {
+    #[ts(optional)]
     pub nickname: Option<String>,
+    #[ts(optional)]
     pub is_favorite: Option<bool>,
 }
 
@@ -79,16 +100,23 @@ pub async fn update_contact(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Path(contact_id): Path<Uuid>,
+    headers: HeaderMap,
     Json(req): Json<UpdateContactRequest>,
-) -> AppResult<Json<ContactWithUser>> {
+) -> AppResult<Tagged<ContactWithUser>> {
     let user_id = get_user_id(&claims)?;
 
     let contacts_service = ContactsService::new(state.db);
     let contact = contacts_service
-        .update_contact(user_id, contact_id, req.nickname.as_deref(), req.is_favorite)
+        .update_contact(
+            user_id,
+            contact_id,
+            req.nickname.as_deref(),
+            req.is_favorite,
+            if_match(&headers)?,
+        )
         .await?;
 
-    Ok(Json(contact))
+    Ok(Tagged(contact.contact.version, contact))
 }
 
 #[derive(Debug, Serialize)]
@@ -158,6 +186,7 @@ pub struct SyncContactsRequest {
     pub identifiers: Vec<String>,
 }
 
+/// v1 returns only the matched users; v2 adds contact state and merge hints
 pub async fn sync_contacts(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
@@ -165,10 +194,47 @@ pub async fn sync_contacts(
 ) -> AppResult<Json<Vec<User>>> {
     let user_id = get_user_id(&claims)?;
 
+    let default_region = state.config.current().phone.default_region.clone();
+    let contacts_service = ContactsService::new(state.db);
+    let result = contacts_service
+        .sync_contacts(user_id, req.identifiers, default_region.as_deref())
+        .await?;
+
+    Ok(Json(result.matches.into_iter().map(|m| m.user).collect()))
+}
+
+pub async fn sync_contacts_with_hints(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<SyncContactsRequest>,
+) -> AppResult<Json<ContactSyncResult>> {
+    let user_id = get_user_id(&claims)?;
+
+    let default_region = state.config.current().phone.default_region.clone();
+    let contacts_service = ContactsService::new(state.db);
+    let result = contacts_service
+        .sync_contacts(user_id, req.identifiers, default_region.as_deref())
+        .await?;
+
+    Ok(Json(result))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BulkAddContactsRequest {
+    pub contact_ids: Vec<Uuid>,
+}
+
+pub async fn bulk_add_contacts(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<BulkAddContactsRequest>,
+) -> AppResult<Json<Vec<ContactWithUser>>> {
+    let user_id = get_user_id(&claims)?;
+
     let contacts_service = ContactsService::new(state.db);
-    let users = contacts_service
-        .sync_contacts(user_id, req.identifiers)
+    let contacts = contacts_service
+        .bulk_add_contacts(user_id, req.contact_ids)
         .await?;
 
-    Ok(Json(users))
+    Ok(Json(contacts))
 }
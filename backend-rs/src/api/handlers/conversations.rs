@@ -1,18 +1,36 @@
 use axum::{
-    extract::{Path, Query, State},
-    Extension, Json,
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    Extension,
 };
 use serde::{Deserialize, Serialize};
+use ts_rs::TS;
 use uuid::Uuid;
 
 use crate::{
     error::AppResult,
-    models::{ConversationWithDetails, Message, MessageType},
-    services::{auth::Claims, messaging::MessagingService},
+    models::{
+        ConversationEvent, ConversationExport, ConversationExportWithUrl, ConversationSearchResult,
+        ConversationWithDetails, ExportConversationRequest, Message, MessageType,
+    },
+    services::{
+        analytics::{AnalyticsService, COUNTER_MESSAGES_SENT, COUNTER_STICKERS_SENT},
+        archives::ArchiveService,
+        auth::Claims,
+        events::EventsService,
+        exports::ExportsService,
+        limits::LimitsService,
+        messaging::MessagingService,
+        suggestions::SuggestionsService,
+    },
     AppState,
 };
 
-use super::super::middleware::get_user_id;
+use super::super::etag::{if_match, not_modified, watermark_etag, Snapshot, Tagged};
+use super::super::extract::{Json, Path, Query};
+use super::super::fields::{FieldsQuery, Selected};
+use super::super::middleware::{get_user_id, get_workspace_id};
+use super::super::pagination::{decode_cursor, encode_cursor, ListFormat, Listing, OffsetCursor};
 
 #[derive(Debug, Deserialize)]
 pub struct PaginationQuery {
@@ -20,6 +38,8 @@ pub struct PaginationQuery {
     pub limit: i32,
     #[serde(default)]
     pub offset: i32,
+    /// Takes the place of `offset` when set
+    pub cursor: Option<String>,
 }
 
 fn default_limit() -> i32 {
@@ -30,18 +50,75 @@ pub async fn get_conversations(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Query(query): Query<PaginationQuery>,
-) -> AppResult<Json<Vec<ConversationWithDetails>>> {
+    Query(fields): Query<FieldsQuery>,
+    headers: HeaderMap,
+) -> AppResult<Snapshot<Listing<Selected<ConversationWithDetails>>>> {
     let user_id = get_user_id(&claims)?;
+    let workspace_id = get_workspace_id(&claims)?;
+    let format = ListFormat::from_headers(&headers);
+    let offset = OffsetCursor::resolve(query.cursor.as_deref(), query.offset)?;
 
     let messaging_service = MessagingService::new(state.db, state.redis);
-    let conversations = messaging_service
-        .get_user_conversations(user_id, query.limit, query.offset)
+    let watermark = messaging_service
+        .conversation_list_watermark(user_id, workspace_id)
         .await?;
+    let etag = watermark_etag(
+        &watermark,
+        &[
+            &query.limit.to_string(),
+            &offset.to_string(),
+            &workspace_id.map(|id| id.to_string()).unwrap_or_default(),
+            &fields.shape(),
+            format.shape(),
+        ],
+    );
+    if not_modified(&headers, &etag) {
+        return Ok(Snapshot::NotModified(etag));
+    }
 
-    Ok(Json(conversations))
+    let conversations = messaging_service
+        .get_user_conversations(user_id, workspace_id, query.limit, offset)
+        .await?;
+    let next_cursor = OffsetCursor::next(offset, query.limit, conversations.len());
+
+    Ok(Snapshot::Modified(
+        etag,
+        format.list(
+            fields.select(conversations)?,
+            next_cursor,
+            Some(watermark.count),
+        ),
+    ))
 }
 
 #[derive(Debug, Deserialize)]
+pub struct SearchQuery {
+    pub q: String,
+    #[serde(default = "default_limit")]
+    pub limit: i32,
+}
+
+pub async fn search_conversations(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<SearchQuery>,
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Vec<ConversationSearchResult>>>> {
+    let user_id = get_user_id(&claims)?;
+    let workspace_id = get_workspace_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let results = messaging_service
+        .search_conversations(user_id, workspace_id, &query.q, query.limit)
+        .await?;
+
+    // Only the best matches are returned, so there is no next page
+    Ok(Json(
+        ListFormat::from_headers(&headers).list(results, None, None),
+    ))
+}
+
+#[derive(Debug, Deserialize, TS)]
 pub struct CreateDirectRequest {
     pub user_id: Uuid,
 }
@@ -52,19 +129,22 @@ pub async fn create_direct_conversation(
     Json(req): Json<CreateDirectRequest>,
 ) -> AppResult<Json<ConversationWithDetails>> {
     let user_id = get_user_id(&claims)?;
+    let workspace_id = get_workspace_id(&claims)?;
 
+    let limits = LimitsService::new(state.db.clone(), state.config.current().limits.clone());
     let messaging_service = MessagingService::new(state.db, state.redis);
     let conversation = messaging_service
-        .create_direct_conversation(user_id, req.user_id)
+        .create_direct_conversation(user_id, req.user_id, workspace_id, &limits)
         .await?;
 
     Ok(Json(conversation))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct CreateGroupRequest {
     pub name: String,
-    pub member_ids: Vec<Uuid>,
+    /// Raw IDs so malformed entries can be reported individually
+    pub member_ids: Vec<String>,
 }
 
 pub async fn create_group_conversation(
@@ -73,30 +153,71 @@ pub async fn create_group_conversation(
     Json(req): Json<CreateGroupRequest>,
 ) -> AppResult<Json<ConversationWithDetails>> {
     let user_id = get_user_id(&claims)?;
+    let workspace_id = get_workspace_id(&claims)?;
 
+    let limits = LimitsService::new(state.db.clone(), state.config.current().limits.clone());
     let messaging_service = MessagingService::new(state.db, state.redis);
+    let member_ids = messaging_service
+        .resolve_group_members(user_id, &req.member_ids)
+        .await?;
     let conversation = messaging_service
-        .create_group_conversation(user_id, &req.name, req.member_ids)
+        .create_group_conversation(user_id, &req.name, member_ids, workspace_id, &limits)
         .await?;
 
     Ok(Json(conversation))
 }
 
-pub async fn get_conversation(
+#[derive(Debug, Deserialize, TS)]
+pub struct CloneGroupRequest {
+    /// Defaults to the source group's name
+    #[ts(optional)]
+    pub name: Option<String>,
+    /// The members to carry over, as confirmed by the owner; raw IDs so
+    /// malformed entries can be reported individually
+    pub member_ids: Vec<String>,
+}
+
+pub async fn clone_group_conversation(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Path(conversation_id): Path<Uuid>,
+    Json(req): Json<CloneGroupRequest>,
 ) -> AppResult<Json<ConversationWithDetails>> {
     let user_id = get_user_id(&claims)?;
 
+    let limits = LimitsService::new(state.db.clone(), state.config.current().limits.clone());
     let messaging_service = MessagingService::new(state.db, state.redis);
+    let member_ids = messaging_service
+        .resolve_group_members(user_id, &req.member_ids)
+        .await?;
     let conversation = messaging_service
-        .get_conversation(conversation_id, user_id)
+        .clone_group_conversation(
+            user_id,
+            conversation_id,
+            req.name.as_deref(),
+            member_ids,
+            &limits,
+        )
         .await?;
 
     Ok(Json(conversation))
 }
 
+pub async fn get_conversation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Tagged<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .get_conversation(conversation_id, user_id)
+        .await?;
+
+    Ok(Tagged(conversation.conversation.version, conversation))
+}
+
 #[derive(Debug, Deserialize)]
 pub struct MessagesQuery {
     #[serde(default = "default_message_limit")]
@@ -104,35 +225,93 @@ pub struct MessagesQuery {
     #[serde(default)]
     pub offset: i32,
     pub before: Option<Uuid>,
+    /// Takes the place of `before` and `offset` when set
+    pub cursor: Option<String>,
+    /// Catch up from a sync token instead: messages after this sequence
+    /// number, oldest first
+    pub since_seq: Option<i64>,
 }
 
 fn default_message_limit() -> i32 {
     50
 }
 
+/// Position in a conversation's history: the oldest message seen so far
+#[derive(Debug, Serialize, Deserialize)]
+struct MessageCursor {
+    before: Uuid,
+}
+
 pub async fn get_messages(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Path(conversation_id): Path<Uuid>,
     Query(query): Query<MessagesQuery>,
-) -> AppResult<Json<Vec<Message>>> {
+    Query(fields): Query<FieldsQuery>,
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Selected<Message>>>> {
     let user_id = get_user_id(&claims)?;
 
+    if let Some(since_seq) = query.since_seq {
+        let messaging_service = MessagingService::new(state.db, state.redis);
+        let messages = messaging_service
+            .sync_messages(conversation_id, user_id, since_seq, query.limit.clamp(1, 500))
+            .await?;
+
+        return Ok(Json(ListFormat::from_headers(&headers).list(
+            fields.select(messages)?,
+            None,
+            None,
+        )));
+    }
+
+    let (before, offset) = match query.cursor.as_deref() {
+        Some(cursor) => (Some(decode_cursor::<MessageCursor>(cursor)?.before), 0),
+        None => (query.before, query.offset),
+    };
+
+    let archives = ArchiveService::new(
+        state.db.clone(),
+        state.minio,
+        state.config.current().archive.clone(),
+    );
     let messaging_service = MessagingService::new(state.db, state.redis);
     let messages = messaging_service
-        .get_messages(conversation_id, user_id, query.limit, query.offset, query.before)
+        .get_messages(
+            conversation_id,
+            user_id,
+            query.limit,
+            offset,
+            before,
+            &archives,
+        )
         .await?;
 
-    Ok(Json(messages))
+    // Newest first, so the last message is the oldest on the page
+    let next_cursor = messages
+        .last()
+        .filter(|_| query.limit > 0 && messages.len() >= query.limit as usize)
+        .map(|m| encode_cursor(&MessageCursor { before: m.id }));
+
+    Ok(Json(ListFormat::from_headers(&headers).list(
+        fields.select(messages)?,
+        next_cursor,
+        None,
+    )))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct SendMessageRequest {
     #[serde(rename = "type")]
+    #[ts(as = "MessageType")]
     pub message_type: String,
     pub content: Vec<u8>,
+    #[ts(optional)]
     pub sticker_id: Option<Uuid>,
+    #[ts(optional)]
     pub reply_to_id: Option<Uuid>,
+    #[ts(optional)]
+    pub format_version: Option<i16>,
 }
 
 pub async fn send_message(
@@ -154,7 +333,7 @@ pub async fn send_message(
         _ => MessageType::Text,
     };
 
-    let messaging_service = MessagingService::new(state.db, state.redis);
+    let messaging_service = MessagingService::new(state.db, state.redis.clone());
     let message = messaging_service
         .send_message(
             conversation_id,
@@ -163,13 +342,24 @@ pub async fn send_message(
             req.content,
             req.sticker_id,
             req.reply_to_id,
+            req.format_version,
         )
         .await?;
 
+    if state.config.current().suggestions.enabled() && message_type != MessageType::System {
+        SuggestionsService::request(&state.jobs, message.id).await;
+    }
+
+    let analytics = AnalyticsService::new(state.redis);
+    let _ = analytics.incr(COUNTER_MESSAGES_SENT).await;
+    if message_type == MessageType::Sticker {
+        let _ = analytics.incr(COUNTER_STICKERS_SENT).await;
+    }
+
     Ok(Json(message))
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Deserialize, TS)]
 pub struct TypingRequest {
     pub is_typing: bool,
 }
@@ -196,3 +386,178 @@ pub async fn send_typing(
         message: "ok".to_string(),
     }))
 }
+
+#[derive(Debug, Deserialize)]
+pub struct SlowModeRequest {
+    pub seconds: i32,
+}
+
+pub async fn set_slow_mode(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    headers: HeaderMap,
+    Json(req): Json<SlowModeRequest>,
+) -> AppResult<Tagged<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .set_slow_mode(conversation_id, user_id, req.seconds, if_match(&headers)?)
+        .await?;
+
+    Ok(Tagged(conversation.conversation.version, conversation))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SharingRequest {
+    pub share_links_enabled: bool,
+}
+
+pub async fn set_sharing(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    headers: HeaderMap,
+    Json(req): Json<SharingRequest>,
+) -> AppResult<Tagged<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .set_share_links_enabled(
+            conversation_id,
+            user_id,
+            req.share_links_enabled,
+            if_match(&headers)?,
+        )
+        .await?;
+
+    Ok(Tagged(conversation.conversation.version, conversation))
+}
+
+/// `enabled: null` follows the account's `read_receipts` setting again
+#[derive(Debug, Deserialize)]
+pub struct ReadReceiptsRequest {
+    pub enabled: Option<bool>,
+}
+
+pub async fn set_read_receipts(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<ReadReceiptsRequest>,
+) -> AppResult<Json<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .set_read_receipts(conversation_id, user_id, req.enabled)
+        .await?;
+
+    Ok(Json(conversation))
+}
+
+pub async fn mark_unread(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .mark_unread(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(conversation))
+}
+
+pub async fn flag_conversation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .flag_conversation(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(conversation))
+}
+
+pub async fn unflag_conversation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let conversation = messaging_service
+        .unflag_conversation(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(conversation))
+}
+
+pub async fn export_conversation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<ExportConversationRequest>,
+) -> AppResult<(StatusCode, Json<ConversationExport>)> {
+    let user_id = get_user_id(&claims)?;
+
+    let exports_service = ExportsService::new(state.db, state.minio, state.jobs);
+    let export = exports_service
+        .request_export(conversation_id, user_id, &req)
+        .await?;
+
+    Ok((StatusCode::ACCEPTED, Json(export)))
+}
+
+pub async fn get_export(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, export_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<ConversationExportWithUrl>> {
+    let user_id = get_user_id(&claims)?;
+
+    let exports_service = ExportsService::new(state.db, state.minio, state.jobs);
+    let export = exports_service
+        .get_export(conversation_id, export_id, user_id)
+        .await?;
+
+    Ok(Json(export))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct EventsQuery {
+    #[serde(default)]
+    pub since: i64,
+    #[serde(default = "default_events_limit")]
+    pub limit: i64,
+}
+
+fn default_events_limit() -> i64 {
+    100
+}
+
+pub async fn get_events(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<EventsQuery>,
+) -> AppResult<Json<Vec<ConversationEvent>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let events_service = EventsService::new(state.db);
+    let events = events_service
+        .list_events(conversation_id, user_id, query.since, query.limit.clamp(1, 500))
+        .await?;
+
+    Ok(Json(events))
+}
@@ -1,37 +1,66 @@
-use axum::{
-    extract::{Path, State},
-    Extension, Json,
-};
-use serde::Serialize;
+use axum::{extract::State, http::HeaderMap, Extension};
+use serde::{Deserialize, Serialize};
 use uuid::Uuid;
 
 use crate::{
     error::AppResult,
-    models::Device,
-    services::auth::Claims,
+    models::{DeviceWithRouting, NotificationRouting},
+    services::{auth::Claims, notifications::NotificationsService},
     AppState,
 };
 
+use super::super::extract::{Json, Path};
 use super::super::middleware::get_user_id;
+use super::super::pagination::{ListFormat, Listing};
 
 pub async fn get_devices(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
-) -> AppResult<Json<Vec<Device>>> {
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Vec<DeviceWithRouting>>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let notifications_service = NotificationsService::new(state.db, state.redis);
+    let devices = notifications_service.list_devices(user_id).await?;
+    let total = devices.len() as i64;
+
+    Ok(Json(ListFormat::from_headers(&headers).list(
+        devices,
+        None,
+        Some(total),
+    )))
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct NotificationRoutingBody {
+    pub routing: NotificationRouting,
+}
+
+pub async fn get_notification_routing(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<NotificationRoutingBody>> {
     let user_id = get_user_id(&claims)?;
 
-    let devices: Vec<Device> = sqlx::query_as(
-        r#"
-        SELECT id, user_id, device_id, name, platform, push_token, last_active_at, created_at
-        FROM devices WHERE user_id = $1
-        ORDER BY last_active_at DESC
-        "#,
-    )
-    .bind(user_id)
-    .fetch_all(&state.db)
-    .await?;
-
-    Ok(Json(devices))
+    let notifications_service = NotificationsService::new(state.db, state.redis);
+    let routing = notifications_service.get_routing(user_id).await?;
+
+    Ok(Json(NotificationRoutingBody { routing }))
+}
+
+pub async fn set_notification_routing(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<NotificationRoutingBody>,
+) -> AppResult<Json<NotificationRoutingBody>> {
+    let user_id = get_user_id(&claims)?;
+
+    let notifications_service = NotificationsService::new(state.db, state.redis);
+    let routing = notifications_service
+        .set_routing(user_id, req.routing)
+        .await?;
+
+    Ok(Json(NotificationRoutingBody { routing }))
 }
 
 #[derive(Debug, Serialize)]
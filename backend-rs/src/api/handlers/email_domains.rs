@@ -0,0 +1,68 @@
+use axum::{extract::State, Extension};
+use serde::Serialize;
+
+use crate::{
+    error::AppResult,
+    models::{BlockEmailDomainsRequest, BlockedEmailDomain},
+    services::{auth::Claims, email_validation::EmailValidationService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+pub async fn list_blocked_domains(
+    State(state): State<AppState>,
+) -> AppResult<Json<Vec<BlockedEmailDomain>>> {
+    let email_service = EmailValidationService::new(
+        state.db,
+        state.redis,
+        state.config.current().email.clone(),
+    );
+    let domains = email_service.list_blocked_domains().await?;
+
+    Ok(Json(domains))
+}
+
+pub async fn block_domains(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<BlockEmailDomainsRequest>,
+) -> AppResult<Json<Vec<BlockedEmailDomain>>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let email_service = EmailValidationService::new(
+        state.db,
+        state.redis,
+        state.config.current().email.clone(),
+    );
+    let added = email_service
+        .block_domains(admin_id, &req.domains, req.reason.as_deref())
+        .await?;
+
+    Ok(Json(added))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn unblock_domain(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(domain): Path<String>,
+) -> AppResult<Json<MessageResponse>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let email_service = EmailValidationService::new(
+        state.db,
+        state.redis,
+        state.config.current().email.clone(),
+    );
+    email_service.unblock_domain(admin_id, &domain).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Domain unblocked".to_string(),
+    }))
+}
@@ -0,0 +1,114 @@
+use std::net::SocketAddr;
+
+use axum::{
+    extract::{ConnectInfo, State},
+    http::{HeaderMap, StatusCode},
+    Extension,
+};
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        FederatedMessage, FederatedMessagesQuery, FederationDocument, InboundEnvelope,
+        SendFederatedMessageRequest,
+    },
+    services::{abuse::ClientOrigin, auth::Claims, federation::FederationService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+fn federation_service(state: AppState) -> FederationService {
+    let config = state.config.current();
+    FederationService::new(state.db, state.redis, config.federation.clone(), state.jobs)
+}
+
+/// `/.well-known/ansible-talk/federation`
+pub async fn get_federation_document(State(state): State<AppState>) -> Json<FederationDocument> {
+    Json(federation_service(state).document())
+}
+
+#[derive(Debug, Serialize)]
+pub struct EnvelopeAccepted {
+    pub id: Uuid,
+}
+
+/// Inbound relay from other servers; authenticated by the envelope
+/// signature and rate-limited per client address
+pub async fn receive_envelope(
+    State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
+    Json(req): Json<InboundEnvelope>,
+) -> AppResult<(StatusCode, Json<EnvelopeAccepted>)> {
+    let config = state.config.current();
+    // Without the configured client address header, count the proxy's
+    let ip = ClientOrigin::from_request(&headers, peer, &config.abuse)
+        .ip
+        .unwrap_or_else(|| peer.ip());
+    let federation = federation_service(state);
+    federation.check_inbox_rate(ip).await?;
+
+    let id = federation.receive(&req.envelope).await?;
+
+    Ok((StatusCode::ACCEPTED, Json(EnvelopeAccepted { id })))
+}
+
+pub async fn send_federated_message(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<SendFederatedMessageRequest>,
+) -> AppResult<(StatusCode, Json<FederatedMessage>)> {
+    let user_id = get_user_id(&claims)?;
+
+    let message = federation_service(state).send(user_id, req).await?;
+
+    Ok((StatusCode::ACCEPTED, Json(message)))
+}
+
+pub async fn list_federated_messages(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<FederatedMessagesQuery>,
+) -> AppResult<Json<Vec<FederatedMessage>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messages = federation_service(state)
+        .list(user_id, query.with.as_deref(), query.before, query.limit)
+        .await?;
+
+    Ok(Json(messages))
+}
+
+/// Accept a message request from a user on another server
+pub async fn accept_federated_sender(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(address): Path<String>,
+) -> AppResult<StatusCode> {
+    let user_id = get_user_id(&claims)?;
+
+    federation_service(state)
+        .accept_sender(user_id, &address)
+        .await?;
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// Block a user on another server
+pub async fn block_federated_sender(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(address): Path<String>,
+) -> AppResult<StatusCode> {
+    let user_id = get_user_id(&claims)?;
+
+    federation_service(state)
+        .block_sender(user_id, &address)
+        .await?;
+
+    Ok(StatusCode::NO_CONTENT)
+}
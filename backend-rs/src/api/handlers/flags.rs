@@ -0,0 +1,87 @@
+use std::collections::HashMap;
+
+use axum::{extract::State, Extension};
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    error::AppResult,
+    models::FeatureFlag,
+    services::{auth::Claims, flags::FlagsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+#[derive(Debug, Serialize)]
+pub struct UserFlagsResponse {
+    pub flags: HashMap<String, bool>,
+}
+
+pub async fn get_my_flags(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<UserFlagsResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let flags_service = FlagsService::new(state.db, state.redis);
+    let flags = flags_service.evaluate_for_user(user_id).await?;
+
+    Ok(Json(UserFlagsResponse { flags }))
+}
+
+// Admin endpoints
+
+pub async fn list_flags(State(state): State<AppState>) -> AppResult<Json<Vec<FeatureFlag>>> {
+    let flags_service = FlagsService::new(state.db, state.redis);
+    let flags = flags_service.list_flags().await?;
+
+    Ok(Json(flags))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UpsertFlagRequest {
+    pub description: Option<String>,
+    pub enabled: bool,
+    #[serde(default = "default_rollout_percentage")]
+    pub rollout_percentage: i32,
+}
+
+fn default_rollout_percentage() -> i32 {
+    100
+}
+
+pub async fn upsert_flag(
+    State(state): State<AppState>,
+    Path(key): Path<String>,
+    Json(req): Json<UpsertFlagRequest>,
+) -> AppResult<Json<FeatureFlag>> {
+    let flags_service = FlagsService::new(state.db, state.redis);
+    let flag = flags_service
+        .upsert_flag(
+            &key,
+            req.description.as_deref(),
+            req.enabled,
+            req.rollout_percentage,
+        )
+        .await?;
+
+    Ok(Json(flag))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn delete_flag(
+    State(state): State<AppState>,
+    Path(key): Path<String>,
+) -> AppResult<Json<MessageResponse>> {
+    let flags_service = FlagsService::new(state.db, state.redis);
+    flags_service.delete_flag(&key).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Flag deleted".to_string(),
+    }))
+}
@@ -0,0 +1,111 @@
+use std::net::SocketAddr;
+
+use axum::{
+    extract::{ConnectInfo, State},
+    http::HeaderMap,
+    Extension,
+};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        CreateWidgetTokenRequest, CreatedWidgetToken, GuestSession, StartGuestSessionRequest,
+        StartedGuestSession, WidgetToken,
+    },
+    services::{abuse::ClientOrigin, auth::Claims, guests::GuestsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+fn guests_service(state: AppState) -> GuestsService {
+    let config = state.config.current();
+    GuestsService::new(state.db, state.redis, (*config).clone())
+}
+
+/// Public: the widget token in the body is the credential
+pub async fn start_guest_session(
+    State(state): State<AppState>,
+    ConnectInfo(peer): ConnectInfo<SocketAddr>,
+    headers: HeaderMap,
+    Json(req): Json<StartGuestSessionRequest>,
+) -> AppResult<Json<StartedGuestSession>> {
+    let origin = ClientOrigin::from_request(&headers, peer, &state.config.current().abuse);
+    let session = guests_service(state)
+        .start_session(&req.widget_token, req.display_name.as_deref(), &origin)
+        .await?;
+
+    Ok(Json(session))
+}
+
+pub async fn get_guest_session(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<GuestSession>> {
+    let user_id = get_user_id(&claims)?;
+
+    let session = guests_service(state).get_session(user_id).await?;
+
+    Ok(Json(session))
+}
+
+pub async fn end_guest_session(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<GuestSession>> {
+    let user_id = get_user_id(&claims)?;
+
+    let session = guests_service(state).end_session(user_id).await?;
+
+    Ok(Json(session))
+}
+
+pub async fn list_widget_tokens(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+) -> AppResult<Json<Vec<WidgetToken>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let tokens = guests_service(state)
+        .list_widget_tokens(workspace_id, user_id)
+        .await?;
+
+    Ok(Json(tokens))
+}
+
+pub async fn create_widget_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+    Json(req): Json<CreateWidgetTokenRequest>,
+) -> AppResult<Json<CreatedWidgetToken>> {
+    let user_id = get_user_id(&claims)?;
+
+    let token = guests_service(state)
+        .create_widget_token(
+            workspace_id,
+            user_id,
+            &req.name,
+            req.support_conversation_id,
+        )
+        .await?;
+
+    Ok(Json(token))
+}
+
+pub async fn revoke_widget_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((workspace_id, token_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<WidgetToken>> {
+    let user_id = get_user_id(&claims)?;
+
+    let token = guests_service(state)
+        .revoke_widget_token(workspace_id, user_id, token_id)
+        .await?;
+
+    Ok(Json(token))
+}
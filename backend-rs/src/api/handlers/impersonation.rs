@@ -0,0 +1,116 @@
+use axum::{extract::State, Extension};
+use serde::Deserialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{Impersonation, ImpersonationToken, RequestImpersonationRequest},
+    services::{auth::Claims, impersonation::ImpersonationService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+fn impersonation_service(state: AppState) -> ImpersonationService {
+    ImpersonationService::new(state.db, (*state.config.current()).clone())
+}
+
+// Admin
+
+pub async fn request_impersonation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<RequestImpersonationRequest>,
+) -> AppResult<Json<Impersonation>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let impersonation = impersonation_service(state)
+        .request(admin_id, req.user_id, &req.reason)
+        .await?;
+
+    Ok(Json(impersonation))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ListImpersonationsQuery {
+    pub user_id: Option<Uuid>,
+}
+
+pub async fn list_impersonations(
+    State(state): State<AppState>,
+    Query(query): Query<ListImpersonationsQuery>,
+) -> AppResult<Json<Vec<Impersonation>>> {
+    let impersonations = impersonation_service(state).list(query.user_id).await?;
+
+    Ok(Json(impersonations))
+}
+
+pub async fn issue_impersonation_token(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(impersonation_id): Path<Uuid>,
+) -> AppResult<Json<ImpersonationToken>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let token = impersonation_service(state)
+        .issue_token(admin_id, impersonation_id)
+        .await?;
+
+    Ok(Json(token))
+}
+
+// Impersonated user
+
+pub async fn get_my_impersonations(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<Vec<Impersonation>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let impersonations = impersonation_service(state).list_for_user(user_id).await?;
+
+    Ok(Json(impersonations))
+}
+
+pub async fn approve_impersonation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(impersonation_id): Path<Uuid>,
+) -> AppResult<Json<Impersonation>> {
+    let user_id = get_user_id(&claims)?;
+
+    let impersonation = impersonation_service(state)
+        .respond(user_id, impersonation_id, true)
+        .await?;
+
+    Ok(Json(impersonation))
+}
+
+pub async fn deny_impersonation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(impersonation_id): Path<Uuid>,
+) -> AppResult<Json<Impersonation>> {
+    let user_id = get_user_id(&claims)?;
+
+    let impersonation = impersonation_service(state)
+        .respond(user_id, impersonation_id, false)
+        .await?;
+
+    Ok(Json(impersonation))
+}
+
+pub async fn revoke_impersonation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(impersonation_id): Path<Uuid>,
+) -> AppResult<Json<Impersonation>> {
+    let user_id = get_user_id(&claims)?;
+
+    let impersonation = impersonation_service(state)
+        .revoke(user_id, impersonation_id)
+        .await?;
+
+    Ok(Json(impersonation))
+}
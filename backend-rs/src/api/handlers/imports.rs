@@ -0,0 +1,111 @@
+use axum::{
+    extract::{Multipart, State},
+    http::StatusCode,
+    Extension,
+};
+use serde::Deserialize;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{ConversationImport, ImportOptions, ImportedHistory},
+    services::{auth::Claims, imports::ImportsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+/// Upload a WhatsApp or Telegram chat export as multipart: the export in
+/// `archive` and, optionally, JSON `options`
+pub async fn import_conversation(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    mut multipart: Multipart,
+) -> AppResult<(StatusCode, Json<ConversationImport>)> {
+    let user_id = get_user_id(&claims)?;
+
+    let mut archive = None;
+    let mut options = ImportOptions::default();
+
+    while let Some(field) = multipart
+        .next_field()
+        .await
+        .map_err(|e| AppError::BadRequest(format!("Failed to read multipart field: {}", e)))?
+    {
+        match field.name().unwrap_or("") {
+            "archive" => {
+                archive =
+                    Some(field.bytes().await.map_err(|e| {
+                        AppError::BadRequest(format!("Failed to read archive: {}", e))
+                    })?);
+            }
+            "options" => {
+                let text = field
+                    .text()
+                    .await
+                    .map_err(|e| AppError::BadRequest(format!("Failed to read options: {}", e)))?;
+                options = serde_json::from_str(&text)
+                    .map_err(|e| AppError::Validation(format!("Invalid options: {}", e)))?;
+            }
+            _ => {}
+        }
+    }
+
+    let archive =
+        archive.ok_or_else(|| AppError::BadRequest("Archive file required".to_string()))?;
+
+    let imports_service = ImportsService::new(state.db, state.minio, state.jobs);
+    let import = imports_service
+        .request_import(user_id, archive, options)
+        .await?;
+
+    Ok((StatusCode::ACCEPTED, Json(import)))
+}
+
+pub async fn get_import(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(import_id): Path<Uuid>,
+) -> AppResult<Json<ConversationImport>> {
+    let user_id = get_user_id(&claims)?;
+
+    let imports_service = ImportsService::new(state.db, state.minio, state.jobs);
+    let import = imports_service.get_import(import_id, user_id).await?;
+
+    Ok(Json(import))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ImportedMessagesQuery {
+    /// Last message id already read
+    #[serde(default)]
+    pub after: i64,
+    #[serde(default = "default_limit")]
+    pub limit: i64,
+}
+
+fn default_limit() -> i64 {
+    100
+}
+
+pub async fn get_imported_messages(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<ImportedMessagesQuery>,
+) -> AppResult<Json<ImportedHistory>> {
+    let user_id = get_user_id(&claims)?;
+
+    let imports_service = ImportsService::new(state.db, state.minio, state.jobs);
+    let history = imports_service
+        .imported_history(
+            conversation_id,
+            user_id,
+            query.after,
+            query.limit.clamp(1, 500),
+        )
+        .await?;
+
+    Ok(Json(history))
+}
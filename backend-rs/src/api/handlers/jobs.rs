@@ -0,0 +1,45 @@
+use axum::extract::State;
+use serde::Deserialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    jobs::{Job, JobMetrics},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+
+pub async fn get_job_metrics(State(state): State<AppState>) -> AppResult<Json<JobMetrics>> {
+    let metrics = state.jobs.metrics().await?;
+
+    Ok(Json(metrics))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DeadJobsQuery {
+    #[serde(default = "default_limit")]
+    pub limit: isize,
+}
+
+fn default_limit() -> isize {
+    50
+}
+
+pub async fn get_dead_jobs(
+    State(state): State<AppState>,
+    Query(query): Query<DeadJobsQuery>,
+) -> AppResult<Json<Vec<Job>>> {
+    let jobs = state.jobs.dead_jobs(query.limit.clamp(1, 1000)).await?;
+
+    Ok(Json(jobs))
+}
+
+pub async fn retry_dead_job(
+    State(state): State<AppState>,
+    Path(job_id): Path<Uuid>,
+) -> AppResult<Json<Job>> {
+    let job = state.jobs.retry_dead_job(job_id).await?;
+
+    Ok(Json(job))
+}
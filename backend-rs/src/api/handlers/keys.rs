@@ -1,7 +1,4 @@
-use axum::{
-    extract::{Path, Query, State},
-    Extension, Json,
-};
+use axum::{extract::State, Extension};
 use serde::{Deserialize, Serialize};
 
 use crate::{
@@ -11,6 +8,7 @@ use crate::{
     AppState,
 };
 
+use super::super::extract::{Json, Path, Query};
 use super::super::middleware::{get_device_id, get_user_id};
 
 #[derive(Debug, Serialize)]
@@ -0,0 +1,56 @@
+use axum::extract::State;
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{EffectiveLimits, UpdateUserLimits, UserLimits},
+    services::limits::LimitsService,
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+
+pub async fn get_default_limits(State(state): State<AppState>) -> Json<EffectiveLimits> {
+    let limits_service = LimitsService::new(state.db, state.config.current().limits.clone());
+
+    Json(limits_service.defaults())
+}
+
+pub async fn get_user_limits(
+    State(state): State<AppState>,
+    Path(user_id): Path<Uuid>,
+) -> AppResult<Json<UserLimits>> {
+    let limits_service = LimitsService::new(state.db, state.config.current().limits.clone());
+    let limits = limits_service.get_user_limits(user_id).await?;
+
+    Ok(Json(limits))
+}
+
+pub async fn set_user_limits(
+    State(state): State<AppState>,
+    Path(user_id): Path<Uuid>,
+    Json(req): Json<UpdateUserLimits>,
+) -> AppResult<Json<UserLimits>> {
+    let limits_service = LimitsService::new(state.db, state.config.current().limits.clone());
+    let limits = limits_service.set_override(user_id, &req).await?;
+
+    Ok(Json(limits))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn clear_user_limits(
+    State(state): State<AppState>,
+    Path(user_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let limits_service = LimitsService::new(state.db, state.config.current().limits.clone());
+    limits_service.clear_override(user_id).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Limit override removed".to_string(),
+    }))
+}
@@ -0,0 +1,85 @@
+use axum::{extract::State, Extension};
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::ConversationWithDetails,
+    services::{auth::Claims, message_requests::MessageRequestsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+use super::conversations::PaginationQuery;
+
+pub async fn list_message_requests(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<PaginationQuery>,
+) -> AppResult<Json<Vec<ConversationWithDetails>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let requests_service = MessageRequestsService::new(state.db, state.redis);
+    let requests = requests_service
+        .list_requests(user_id, query.limit, query.offset)
+        .await?;
+
+    Ok(Json(requests))
+}
+
+pub async fn accept_message_request(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<ConversationWithDetails>> {
+    let user_id = get_user_id(&claims)?;
+
+    let requests_service = MessageRequestsService::new(state.db, state.redis);
+    let conversation = requests_service.accept(user_id, conversation_id).await?;
+
+    Ok(Json(conversation))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn block_message_request(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let requests_service = MessageRequestsService::new(state.db, state.redis);
+    requests_service.block(user_id, conversation_id).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Sender blocked".to_string(),
+    }))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ReportRequest {
+    pub reason: Option<String>,
+}
+
+pub async fn report_message_request(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<ReportRequest>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let requests_service = MessageRequestsService::new(state.db, state.redis);
+    requests_service
+        .report(user_id, conversation_id, req.reason.as_deref())
+        .await?;
+
+    Ok(Json(MessageResponse {
+        message: "Sender reported and blocked".to_string(),
+    }))
+}
@@ -1,16 +1,15 @@
-use axum::{
-    extract::{Path, State},
-    Extension, Json,
-};
-use serde::Serialize;
+use axum::{extract::State, Extension};
+use serde::{Deserialize, Serialize};
 use uuid::Uuid;
 
 use crate::{
     error::AppResult,
-    services::{auth::Claims, messaging::MessagingService},
+    models::{DeliveryReport, Receipt, ReceiptType},
+    services::{archives::ArchiveService, auth::Claims, messaging::MessagingService},
     AppState,
 };
 
+use super::super::extract::{Json, Path};
 use super::super::middleware::get_user_id;
 
 #[derive(Debug, Serialize)]
@@ -48,6 +47,69 @@ pub async fn mark_read(
     }))
 }
 
+#[derive(Debug, Deserialize)]
+pub struct ReceiptRequest {
+    #[serde(rename = "type")]
+    pub receipt_type: ReceiptType,
+}
+
+/// v2 replacement for the separate delivered/read endpoints
+pub async fn create_receipt(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(message_id): Path<Uuid>,
+    Json(req): Json<ReceiptRequest>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let message = match req.receipt_type {
+        ReceiptType::Delivered => {
+            messaging_service.mark_as_delivered(message_id, user_id).await?;
+            "Marked as delivered"
+        }
+        ReceiptType::Read => {
+            messaging_service.mark_as_read(message_id, user_id).await?;
+            "Marked as read"
+        }
+    };
+
+    Ok(Json(MessageResponse {
+        message: message.to_string(),
+    }))
+}
+
+/// Who has received or read the message. Receipts are per-participant
+/// pointers, so acknowledging a message also covers everything before it.
+pub async fn get_receipts(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(message_id): Path<Uuid>,
+) -> AppResult<Json<Vec<Receipt>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let receipts = messaging_service.get_receipts(message_id, user_id).await?;
+
+    Ok(Json(receipts))
+}
+
+/// Aggregate sent/delivered/read state, mainly for group messages
+pub async fn get_status(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(message_id): Path<Uuid>,
+) -> AppResult<Json<DeliveryReport>> {
+    let user_id = get_user_id(&claims)?;
+
+    let messaging_service = MessagingService::new(state.db, state.redis);
+    let report = messaging_service
+        .get_delivery_report(message_id, user_id)
+        .await?;
+
+    Ok(Json(report))
+}
+
 pub async fn delete_message(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
@@ -55,8 +117,15 @@ pub async fn delete_message(
 ) -> AppResult<Json<MessageResponse>> {
     let user_id = get_user_id(&claims)?;
 
+    let archives = ArchiveService::new(
+        state.db.clone(),
+        state.minio,
+        state.config.current().archive.clone(),
+    );
     let messaging_service = MessagingService::new(state.db, state.redis);
-    messaging_service.delete_message(message_id, user_id).await?;
+    messaging_service
+        .delete_message(message_id, user_id, Some(&archives))
+        .await?;
 
     Ok(Json(MessageResponse {
         message: "Message deleted".to_string(),
@@ -1,8 +1,45 @@
+pub mod access_tokens;
+pub mod account_purge;
+pub mod abuse;
+pub mod analytics;
+pub mod attachments;
 pub mod auth;
+pub mod backups;
+pub mod bots;
+pub mod bridges;
+pub mod calendar;
+pub mod calls;
+pub mod circuit_breakers;
+pub mod compliance;
 pub mod contacts;
 pub mod conversations;
 pub mod devices;
+pub mod email_domains;
+pub mod federation;
+pub mod flags;
+pub mod guests;
+pub mod impersonation;
+pub mod imports;
+pub mod jobs;
 pub mod keys;
+pub mod limits;
+pub mod message_requests;
 pub mod messages;
+pub mod notes;
+pub mod otp_delivery;
+pub mod payments;
+pub mod profiles;
+pub mod realtime;
+pub mod region;
+pub mod runtime_config;
+pub mod share_links;
+pub mod spam;
 pub mod stickers;
+pub mod storage;
+pub mod tasks;
+pub mod translation;
 pub mod users;
+pub mod workspaces;
+
+#[cfg(test)]
+mod tests;
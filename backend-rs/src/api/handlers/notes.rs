@@ -0,0 +1,41 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{ConversationNote, UpdateNoteRequest},
+    services::{auth::Claims, notes::NotesService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+pub async fn get_note(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<ConversationNote>> {
+    let user_id = get_user_id(&claims)?;
+
+    let note = NotesService::new(state.db)
+        .get(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(note))
+}
+
+pub async fn update_note(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<UpdateNoteRequest>,
+) -> AppResult<Json<ConversationNote>> {
+    let user_id = get_user_id(&claims)?;
+
+    let note = NotesService::new(state.db)
+        .update(conversation_id, user_id, &req)
+        .await?;
+
+    Ok(Json(note))
+}
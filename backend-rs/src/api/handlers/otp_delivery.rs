@@ -0,0 +1,82 @@
+use axum::{extract::State, http::StatusCode, Form};
+use serde::Deserialize;
+
+use crate::{
+    error::AppResult,
+    models::OtpDelivery,
+    services::otp_delivery::{OtpDeliveryService, SendgridEvent},
+    AppState,
+};
+
+use super::super::extract::{Json, Query};
+
+fn delivery_service(state: AppState) -> OtpDeliveryService {
+    let config = state.config.current();
+    OtpDeliveryService::new(
+        state.db,
+        state.http,
+        state.breakers,
+        config.otp_delivery.clone(),
+        config.server.environment.clone(),
+    )
+}
+
+#[derive(Debug, Deserialize)]
+pub struct WebhookQuery {
+    pub token: Option<String>,
+}
+
+/// Twilio's message status callback (form-encoded)
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+pub struct TwilioStatusCallback {
+    pub message_sid: String,
+    pub message_status: String,
+    pub error_code: Option<String>,
+}
+
+pub async fn twilio_status(
+    State(state): State<AppState>,
+    Query(query): Query<WebhookQuery>,
+    Form(callback): Form<TwilioStatusCallback>,
+) -> AppResult<StatusCode> {
+    let delivery_service = delivery_service(state);
+    delivery_service.verify_webhook_token(query.token.as_deref())?;
+    delivery_service
+        .handle_twilio_status(
+            &callback.message_sid,
+            &callback.message_status,
+            callback.error_code.as_deref(),
+        )
+        .await?;
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+pub async fn sendgrid_events(
+    State(state): State<AppState>,
+    Query(query): Query<WebhookQuery>,
+    Json(events): Json<Vec<SendgridEvent>>,
+) -> AppResult<StatusCode> {
+    let delivery_service = delivery_service(state);
+    delivery_service.verify_webhook_token(query.token.as_deref())?;
+    delivery_service.handle_sendgrid_events(&events).await?;
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DeliveriesQuery {
+    pub target: String,
+}
+
+pub async fn list_otp_deliveries(
+    State(state): State<AppState>,
+    Query(query): Query<DeliveriesQuery>,
+) -> AppResult<Json<Vec<OtpDelivery>>> {
+    let deliveries = delivery_service(state)
+        .list_for_target(&query.target)
+        .await?;
+
+    Ok(Json(deliveries))
+}
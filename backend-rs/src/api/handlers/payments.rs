@@ -0,0 +1,85 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        CreatePaymentRequestRequest, PaymentRequest, PaymentRequestsQuery,
+        UpdatePaymentRequestRequest,
+    },
+    services::{auth::Claims, payments::PaymentsService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+fn payments_service(state: AppState) -> PaymentsService {
+    let config = state.config.current().payments.clone();
+    PaymentsService::new(state.db, state.http, state.jobs, config)
+}
+
+pub async fn list_payment_requests(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<PaymentRequestsQuery>,
+) -> AppResult<Json<Vec<PaymentRequest>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let payment_requests = payments_service(state)
+        .list(
+            conversation_id,
+            user_id,
+            query.status,
+            query.before,
+            query.limit,
+        )
+        .await?;
+
+    Ok(Json(payment_requests))
+}
+
+pub async fn create_payment_request(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<CreatePaymentRequestRequest>,
+) -> AppResult<Json<PaymentRequest>> {
+    let user_id = get_user_id(&claims)?;
+
+    let payment_request = payments_service(state)
+        .create(conversation_id, user_id, &req)
+        .await?;
+
+    Ok(Json(payment_request))
+}
+
+pub async fn get_payment_request(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, payment_request_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<PaymentRequest>> {
+    let user_id = get_user_id(&claims)?;
+
+    let payment_request = payments_service(state)
+        .get(conversation_id, payment_request_id, user_id)
+        .await?;
+
+    Ok(Json(payment_request))
+}
+
+pub async fn update_payment_request_status(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, payment_request_id)): Path<(Uuid, Uuid)>,
+    Json(req): Json<UpdatePaymentRequestRequest>,
+) -> AppResult<Json<PaymentRequest>> {
+    let user_id = get_user_id(&claims)?;
+
+    let payment_request = payments_service(state)
+        .update_status(conversation_id, payment_request_id, user_id, &req)
+        .await?;
+
+    Ok(Json(payment_request))
+}
@@ -0,0 +1,87 @@
+use axum::{extract::State, Extension};
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{CreateProfilePostRequest, ProfilePost, UpdateProfilePostRequest, UserProfile},
+    services::{auth::Claims, profiles::ProfilesService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn get_profile(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(profile_user_id): Path<Uuid>,
+) -> AppResult<Json<UserProfile>> {
+    let user_id = get_user_id(&claims)?;
+
+    let profiles_service = ProfilesService::new(state.db);
+    let profile = profiles_service
+        .get_profile(profile_user_id, user_id)
+        .await?;
+
+    Ok(Json(profile))
+}
+
+pub async fn list_my_posts(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<Vec<ProfilePost>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let profiles_service = ProfilesService::new(state.db);
+    let posts = profiles_service.list_posts(user_id).await?;
+
+    Ok(Json(posts))
+}
+
+pub async fn create_post(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<CreateProfilePostRequest>,
+) -> AppResult<Json<ProfilePost>> {
+    let user_id = get_user_id(&claims)?;
+
+    let profiles_service = ProfilesService::new(state.db);
+    let post = profiles_service.create_post(user_id, &req).await?;
+
+    Ok(Json(post))
+}
+
+pub async fn update_post(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(post_id): Path<Uuid>,
+    Json(req): Json<UpdateProfilePostRequest>,
+) -> AppResult<Json<ProfilePost>> {
+    let user_id = get_user_id(&claims)?;
+
+    let profiles_service = ProfilesService::new(state.db);
+    let post = profiles_service.update_post(user_id, post_id, &req).await?;
+
+    Ok(Json(post))
+}
+
+pub async fn delete_post(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(post_id): Path<Uuid>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let profiles_service = ProfilesService::new(state.db);
+    profiles_service.delete_post(user_id, post_id).await?;
+
+    Ok(Json(MessageResponse {
+        message: "Post deleted".to_string(),
+    }))
+}
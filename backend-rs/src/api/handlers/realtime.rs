@@ -0,0 +1,234 @@
+use std::{collections::VecDeque, convert::Infallible, time::Duration};
+
+use axum::{
+    extract::State,
+    http::HeaderMap,
+    response::sse::{Event, KeepAlive, Sse},
+    Extension,
+};
+use futures_util::{stream, Stream};
+use serde::Deserialize;
+
+use crate::{
+    error::AppResult,
+    models::{
+        DeliverySla, DeliverySlaQuery, PollResponse, QueuedEvent, RealtimeQueueQuery,
+        RealtimeQueueStats, StuckMessage, StuckMessagesQuery,
+    },
+    services::{
+        auth::Claims,
+        delivery_sla::{DeliverySlaService, DEFAULT_SLA_WINDOW_MINUTES},
+        messaging::WsMessage,
+        outbox::OutboxService,
+    },
+    AppState,
+};
+
+use super::super::extract::{Json, Query};
+use super::super::middleware::get_user_id;
+
+const DEFAULT_POLL_TIMEOUT_SECS: u64 = 25;
+const MAX_POLL_TIMEOUT_SECS: u64 = 30;
+const SSE_WAIT: Duration = Duration::from_secs(30);
+const DEFAULT_BACKLOG_LIMIT: i64 = 20;
+const MAX_BACKLOG_LIMIT: i64 = 200;
+const MAX_SLA_WINDOW_MINUTES: i32 = 24 * 60;
+const DEFAULT_STUCK_AGE_MINUTES: i32 = 5;
+const DEFAULT_STUCK_LIMIT: i64 = 50;
+const MAX_STUCK_LIMIT: i64 = 500;
+
+#[derive(Debug, Deserialize)]
+pub struct PollQuery {
+    /// Last event id the client has seen; omit to start from now
+    pub cursor: Option<i64>,
+    pub timeout: Option<u64>,
+}
+
+/// Long-polling fallback for clients that can't hold a WebSocket open.
+/// Returns queued events after `cursor`, waiting up to `timeout` seconds.
+pub async fn poll_events(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<PollQuery>,
+) -> AppResult<Json<PollResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let outbox_service = OutboxService::new(state.db, state.redis);
+
+    // A fresh session starts at the head of the queue; history comes from
+    // the REST endpoints
+    let Some(cursor) = query.cursor else {
+        let cursor = outbox_service.latest_event_id(user_id).await?;
+        return Ok(Json(PollResponse {
+            events: Vec::new(),
+            cursor,
+        }));
+    };
+
+    let timeout = query
+        .timeout
+        .unwrap_or(DEFAULT_POLL_TIMEOUT_SECS)
+        .min(MAX_POLL_TIMEOUT_SECS);
+
+    let max_subscriptions = state.config.current().realtime.max_subscriptions_per_user;
+    let _subscription = state
+        .ws_hub
+        .subscribe(&user_id.to_string(), max_subscriptions)?;
+
+    let mut wakeup = state.event_listener.subscribe(user_id);
+    let events = outbox_service
+        .wait_for_events(&mut wakeup, user_id, cursor, Duration::from_secs(timeout))
+        .await?;
+    let cursor = events.last().map_or(cursor, |e| e.id);
+
+    Ok(Json(PollResponse { events, cursor }))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct EventStreamQuery {
+    /// Resume point for clients that can't set `Last-Event-ID`
+    pub last_event_id: Option<i64>,
+}
+
+/// Server-Sent Events stream of the same payloads the WebSocket delivers,
+/// for receive-only clients. Each event's `id` is its position in the
+/// durable queue, so reconnecting with `Last-Event-ID` replays what was
+/// missed (within the queue's retention window).
+pub async fn stream_events(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    headers: HeaderMap,
+    Query(query): Query<EventStreamQuery>,
+) -> AppResult<Sse<impl Stream<Item = Result<Event, Infallible>>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let outbox_service = OutboxService::new(state.db, state.redis);
+
+    let last_event_id = headers
+        .get("last-event-id")
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.trim().parse().ok())
+        .or(query.last_event_id);
+
+    let cursor = match last_event_id {
+        Some(id) => id,
+        None => outbox_service.latest_event_id(user_id).await?,
+    };
+
+    // Held by the stream, so released when the client disconnects
+    let max_subscriptions = state.config.current().realtime.max_subscriptions_per_user;
+    let subscription = state
+        .ws_hub
+        .subscribe(&user_id.to_string(), max_subscriptions)?;
+
+    // Subscribed once for the whole stream, so nothing published while an
+    // event is being sent is missed
+    let wakeup = state.event_listener.subscribe(user_id);
+
+    let events = stream::unfold(
+        (
+            outbox_service,
+            cursor,
+            VecDeque::new(),
+            subscription,
+            wakeup,
+        ),
+        move |(outbox_service, mut cursor, mut pending, subscription, mut wakeup)| async move {
+            loop {
+                if let Some(event) = pending.pop_front() {
+                    let sse_event = to_sse_event(event);
+                    return Some((
+                        Ok(sse_event),
+                        (outbox_service, cursor, pending, subscription, wakeup),
+                    ));
+                }
+
+                let waited = outbox_service
+                    .wait_for_events(&mut wakeup, user_id, cursor, SSE_WAIT)
+                    .await;
+                match waited {
+                    Ok(events) => {
+                        if let Some(last) = events.last() {
+                            cursor = last.id;
+                        }
+                        pending.extend(events);
+                    }
+                    Err(e) => {
+                        // End the stream; the client reconnects with Last-Event-ID
+                        tracing::warn!("Event stream for user {} failed: {}", user_id, e);
+                        return None;
+                    }
+                }
+            }
+        },
+    );
+
+    Ok(Sse::new(events).keep_alive(KeepAlive::default()))
+}
+
+fn to_sse_event(event: QueuedEvent) -> Event {
+    let ws_message = WsMessage {
+        msg_type: event.event_type,
+        payload: event.payload,
+    };
+
+    Event::default()
+        .id(event.id.to_string())
+        .event(ws_message.msg_type.clone())
+        .json_data(&ws_message)
+        .unwrap_or_else(|_| Event::default().comment("unserializable event"))
+}
+
+/// Realtime queue depth, delivery lag and per-user backlogs (admin)
+pub async fn get_queue_stats(
+    State(state): State<AppState>,
+    Query(query): Query<RealtimeQueueQuery>,
+) -> AppResult<Json<RealtimeQueueStats>> {
+    let outbox_service = OutboxService::new(state.db, state.redis);
+    let limit = query
+        .limit
+        .unwrap_or(DEFAULT_BACKLOG_LIMIT)
+        .clamp(1, MAX_BACKLOG_LIMIT);
+
+    let stats = outbox_service.queue_stats(query.user_id, limit).await?;
+
+    Ok(Json(stats))
+}
+
+/// Send-to-delivered percentiles over recent messages (admin)
+pub async fn get_delivery_sla(
+    State(state): State<AppState>,
+    Query(query): Query<DeliverySlaQuery>,
+) -> AppResult<Json<DeliverySla>> {
+    let delivery_sla_service = DeliverySlaService::new(state.db);
+    let window_minutes = query
+        .window_minutes
+        .unwrap_or(DEFAULT_SLA_WINDOW_MINUTES)
+        .clamp(1, MAX_SLA_WINDOW_MINUTES);
+
+    let sla = delivery_sla_service.sla(window_minutes).await?;
+
+    Ok(Json(sla))
+}
+
+/// Recent messages with no delivered receipt at all (admin)
+pub async fn get_stuck_messages(
+    State(state): State<AppState>,
+    Query(query): Query<StuckMessagesQuery>,
+) -> AppResult<Json<Vec<StuckMessage>>> {
+    let delivery_sla_service = DeliverySlaService::new(state.db);
+    let older_than_minutes = query
+        .older_than_minutes
+        .unwrap_or(DEFAULT_STUCK_AGE_MINUTES)
+        .max(1);
+    let limit = query
+        .limit
+        .unwrap_or(DEFAULT_STUCK_LIMIT)
+        .clamp(1, MAX_STUCK_LIMIT);
+
+    let messages = delivery_sla_service
+        .stuck_messages(older_than_minutes, limit)
+        .await?;
+
+    Ok(Json(messages))
+}
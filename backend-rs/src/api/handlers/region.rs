@@ -0,0 +1,24 @@
+use axum::{extract::State, http::StatusCode};
+
+use crate::{error::AppResult, models::RegionHealth, services::region::RegionService, AppState};
+
+use super::super::extract::Json;
+
+/// This region's role and replication state; 503 when unhealthy, so a load
+/// balancer can route around it
+pub async fn get_region_health(
+    State(state): State<AppState>,
+) -> AppResult<(StatusCode, Json<RegionHealth>)> {
+    let config = state.config.current();
+    let health = RegionService::new(state.db, config.region.clone())
+        .health()
+        .await?;
+
+    let status = if health.healthy {
+        StatusCode::OK
+    } else {
+        StatusCode::SERVICE_UNAVAILABLE
+    };
+
+    Ok((status, Json(health)))
+}
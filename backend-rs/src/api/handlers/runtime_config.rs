@@ -0,0 +1,31 @@
+use axum::{extract::State, Extension};
+
+use crate::{
+    error::AppResult,
+    models::{ConfigReloadResult, RuntimeConfig},
+    services::{auth::Claims, runtime_config::RuntimeConfigService},
+    AppState,
+};
+
+use super::super::extract::Json;
+use super::super::middleware::get_user_id;
+
+pub async fn get_runtime_config(State(state): State<AppState>) -> AppResult<Json<RuntimeConfig>> {
+    let config_service =
+        RuntimeConfigService::new(state.db, state.redis, state.config, state.log_filter);
+
+    Ok(Json(config_service.get()))
+}
+
+pub async fn reload_config(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<ConfigReloadResult>> {
+    let admin_id = get_user_id(&claims)?;
+
+    let config_service =
+        RuntimeConfigService::new(state.db, state.redis, state.config, state.log_filter);
+    let result = config_service.reload(Some(admin_id), "admin_api").await?;
+
+    Ok(Json(result))
+}
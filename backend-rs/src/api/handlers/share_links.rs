@@ -0,0 +1,71 @@
+use axum::{extract::State, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{CreateShareLinkRequest, CreatedShareLink, ShareLink, SharedSnapshot},
+    services::{auth::Claims, share_links::ShareLinksService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+pub async fn list_share_links(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+) -> AppResult<Json<Vec<ShareLink>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let links = ShareLinksService::new(state.db)
+        .list(conversation_id, user_id)
+        .await?;
+
+    Ok(Json(links))
+}
+
+pub async fn create_share_link(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<CreateShareLinkRequest>,
+) -> AppResult<Json<CreatedShareLink>> {
+    let user_id = get_user_id(&claims)?;
+
+    let link = ShareLinksService::new(state.db)
+        .create(
+            conversation_id,
+            user_id,
+            &req.messages,
+            req.title.as_deref(),
+            req.expires_in,
+        )
+        .await?;
+
+    Ok(Json(link))
+}
+
+pub async fn revoke_share_link(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, link_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<ShareLink>> {
+    let user_id = get_user_id(&claims)?;
+
+    let link = ShareLinksService::new(state.db)
+        .revoke(conversation_id, user_id, link_id)
+        .await?;
+
+    Ok(Json(link))
+}
+
+/// Public: the token in the path is the credential
+pub async fn view_shared(
+    State(state): State<AppState>,
+    Path(token): Path<String>,
+) -> AppResult<Json<SharedSnapshot>> {
+    let snapshot = ShareLinksService::new(state.db).view(&token).await?;
+
+    Ok(Json(snapshot))
+}
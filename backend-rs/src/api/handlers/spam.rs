@@ -0,0 +1,27 @@
+use axum::extract::State;
+
+use crate::{
+    error::AppResult,
+    models::{SpamSettings, UpdateSpamSettings},
+    services::spam::SpamService,
+    AppState,
+};
+
+use super::super::extract::Json;
+
+pub async fn get_spam_settings(State(state): State<AppState>) -> AppResult<Json<SpamSettings>> {
+    let spam_service = SpamService::new(state.db, state.redis);
+    let settings = spam_service.get_settings().await?;
+
+    Ok(Json(settings))
+}
+
+pub async fn update_spam_settings(
+    State(state): State<AppState>,
+    Json(req): Json<UpdateSpamSettings>,
+) -> AppResult<Json<SpamSettings>> {
+    let spam_service = SpamService::new(state.db, state.redis);
+    let settings = spam_service.update_settings(&req).await?;
+
+    Ok(Json(settings))
+}
@@ -1,6 +1,7 @@
 use axum::{
-    extract::{Multipart, Path, Query, State},
-    Extension, Json,
+    extract::{Multipart, State},
+    http::HeaderMap,
+    Extension,
 };
 use serde::{Deserialize, Serialize};
 use uuid::Uuid;
@@ -12,7 +13,11 @@ use crate::{
     AppState,
 };
 
+use super::super::etag::{not_modified, watermark_etag, Snapshot};
+use super::super::extract::{Json, Path, Query};
+use super::super::fields::{FieldsQuery, Selected};
 use super::super::middleware::get_user_id;
+use super::super::pagination::{ListFormat, Listing, OffsetCursor};
 
 #[derive(Debug, Deserialize)]
 pub struct CatalogQuery {
@@ -20,6 +25,8 @@ pub struct CatalogQuery {
     pub limit: i32,
     #[serde(default)]
     pub offset: i32,
+    /// Takes the place of `offset` when set
+    pub cursor: Option<String>,
     pub official: Option<bool>,
 }
 
@@ -30,13 +37,22 @@ fn default_limit() -> i32 {
 pub async fn get_catalog(
     State(state): State<AppState>,
     Query(query): Query<CatalogQuery>,
-) -> AppResult<Json<Vec<StickerPack>>> {
+    Query(fields): Query<FieldsQuery>,
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Selected<StickerPack>>>> {
+    let offset = OffsetCursor::resolve(query.cursor.as_deref(), query.offset)?;
+
     let stickers_service = StickersService::new(state.db, state.minio);
     let packs = stickers_service
-        .get_catalog(query.limit, query.offset, query.official)
+        .get_catalog(query.limit, offset, query.official)
         .await?;
+    let next_cursor = OffsetCursor::next(offset, query.limit, packs.len());
 
-    Ok(Json(packs))
+    Ok(Json(ListFormat::from_headers(&headers).list(
+        fields.select(packs)?,
+        next_cursor,
+        None,
+    )))
 }
 
 #[derive(Debug, Deserialize)]
@@ -49,7 +65,8 @@ pub struct SearchQuery {
 pub async fn search_stickers(
     State(state): State<AppState>,
     Query(query): Query<SearchQuery>,
-) -> AppResult<Json<Vec<StickerPack>>> {
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Vec<StickerPack>>>> {
     if query.q.is_empty() {
         return Err(AppError::BadRequest("Search query required".to_string()));
     }
@@ -57,7 +74,9 @@ pub async fn search_stickers(
     let stickers_service = StickersService::new(state.db, state.minio);
     let packs = stickers_service.search_packs(&query.q, query.limit).await?;
 
-    Ok(Json(packs))
+    Ok(Json(
+        ListFormat::from_headers(&headers).list(packs, None, None),
+    ))
 }
 
 pub async fn get_sticker_pack(
@@ -67,9 +86,44 @@ pub async fn get_sticker_pack(
     let stickers_service = StickersService::new(state.db, state.minio);
     let pack = stickers_service.get_pack(pack_id).await?;
 
+    // Workspace packs are not part of the public catalog
+    if pack.pack.workspace_id.is_some() {
+        return Err(AppError::StickerPackNotFound);
+    }
+
     Ok(Json(pack))
 }
 
+#[derive(Debug, Deserialize)]
+pub struct SuggestQuery {
+    pub emoji: String,
+    /// Also suggest stickers from popular packs the user hasn't added
+    #[serde(default)]
+    pub trending: bool,
+    #[serde(default = "default_limit")]
+    pub limit: i32,
+}
+
+pub async fn suggest_stickers(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<SuggestQuery>,
+) -> AppResult<Json<Vec<Sticker>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let emoji = query.emoji.trim();
+    if emoji.is_empty() {
+        return Err(AppError::BadRequest("Emoji required".to_string()));
+    }
+
+    let stickers_service = StickersService::new(state.db, state.minio);
+    let stickers = stickers_service
+        .suggest(user_id, emoji, query.trending, query.limit.clamp(1, 50))
+        .await?;
+
+    Ok(Json(stickers))
+}
+
 #[derive(Debug, Serialize)]
 pub struct MessageResponse {
     pub message: String,
@@ -79,15 +133,13 @@ pub async fn download_sticker_pack(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
     Path(pack_id): Path<Uuid>,
-) -> AppResult<Json<MessageResponse>> {
+) -> AppResult<Json<StickerPackWithStickers>> {
     let user_id = get_user_id(&claims)?;
 
     let stickers_service = StickersService::new(state.db, state.minio);
-    stickers_service.download_pack(user_id, pack_id).await?;
+    let pack = stickers_service.download_pack(user_id, pack_id).await?;
 
-    Ok(Json(MessageResponse {
-        message: "Pack downloaded".to_string(),
-    }))
+    Ok(Json(pack))
 }
 
 pub async fn remove_sticker_pack(
@@ -108,13 +160,20 @@ pub async fn remove_sticker_pack(
 pub async fn get_user_sticker_packs(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
-) -> AppResult<Json<Vec<StickerPackWithStickers>>> {
+    headers: HeaderMap,
+) -> AppResult<Snapshot<Vec<StickerPackWithStickers>>> {
     let user_id = get_user_id(&claims)?;
 
     let stickers_service = StickersService::new(state.db, state.minio);
+    let watermark = stickers_service.user_packs_watermark(user_id).await?;
+    let etag = watermark_etag(&watermark, &[]);
+    if not_modified(&headers, &etag) {
+        return Ok(Snapshot::NotModified(etag));
+    }
+
     let packs = stickers_service.get_user_packs(user_id).await?;
 
-    Ok(Json(packs))
+    Ok(Snapshot::Modified(etag, packs))
 }
 
 #[derive(Debug, Deserialize)]
@@ -162,6 +221,7 @@ pub async fn create_sticker_pack(
             req.description.as_deref(),
             req.is_official,
             req.is_animated,
+            None,
         )
         .await?;
 
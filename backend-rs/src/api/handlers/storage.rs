@@ -0,0 +1,15 @@
+use axum::extract::State;
+
+use crate::{error::AppResult, models::BucketLifecycle, AppState};
+
+use super::super::extract::Json;
+
+/// Lifecycle rules on each bucket as the object store has them, which can
+/// differ from the configured ones if the store refused some
+pub async fn get_lifecycle_policies(
+    State(state): State<AppState>,
+) -> AppResult<Json<Vec<BucketLifecycle>>> {
+    let policies = state.minio.lifecycle_policies().await?;
+
+    Ok(Json(policies))
+}
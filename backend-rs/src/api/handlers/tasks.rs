@@ -0,0 +1,99 @@
+use axum::{extract::State, http::StatusCode, Extension};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{AssignTaskRequest, CreateTaskRequest, Task, TasksQuery},
+    services::{auth::Claims, tasks::TasksService},
+    AppState,
+};
+
+use super::super::extract::{Json, Path, Query};
+use super::super::middleware::get_user_id;
+
+pub async fn list_tasks(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Query(query): Query<TasksQuery>,
+) -> AppResult<Json<Vec<Task>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let tasks = TasksService::new(state.db)
+        .list(conversation_id, user_id, query.completed)
+        .await?;
+
+    Ok(Json(tasks))
+}
+
+pub async fn create_task(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(conversation_id): Path<Uuid>,
+    Json(req): Json<CreateTaskRequest>,
+) -> AppResult<Json<Task>> {
+    let user_id = get_user_id(&claims)?;
+
+    let task = TasksService::new(state.db)
+        .create(conversation_id, user_id, &req)
+        .await?;
+
+    Ok(Json(task))
+}
+
+pub async fn delete_task(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, task_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<StatusCode> {
+    let user_id = get_user_id(&claims)?;
+
+    TasksService::new(state.db)
+        .delete(conversation_id, task_id, user_id)
+        .await?;
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+pub async fn assign_task(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, task_id)): Path<(Uuid, Uuid)>,
+    Json(req): Json<AssignTaskRequest>,
+) -> AppResult<Json<Task>> {
+    let user_id = get_user_id(&claims)?;
+
+    let task = TasksService::new(state.db)
+        .assign(conversation_id, task_id, user_id, req.assignee_id)
+        .await?;
+
+    Ok(Json(task))
+}
+
+pub async fn complete_task(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, task_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<Task>> {
+    let user_id = get_user_id(&claims)?;
+
+    let task = TasksService::new(state.db)
+        .set_completed(conversation_id, task_id, user_id, true)
+        .await?;
+
+    Ok(Json(task))
+}
+
+pub async fn reopen_task(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((conversation_id, task_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<Task>> {
+    let user_id = get_user_id(&claims)?;
+
+    let task = TasksService::new(state.db)
+        .set_completed(conversation_id, task_id, user_id, false)
+        .await?;
+
+    Ok(Json(task))
+}
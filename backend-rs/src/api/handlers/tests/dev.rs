@@ -0,0 +1,18 @@
+//! Development-only routes exist only with `ENVIRONMENT=development`
+
+use axum::http::StatusCode;
+use sqlx::PgPool;
+
+use super::{get, test_app_with, test_config};
+
+#[sqlx::test(migrations = "./migrations")]
+async fn latest_otp_route_is_only_mounted_in_development(db: PgPool) {
+    for environment in ["production", "staging", "prod", "preprod"] {
+        let mut config = test_config();
+        config.server.environment = environment.to_string();
+        let app = test_app_with(db.clone(), config).await;
+
+        let response = get(&app, "/api/v1/dev/otp?target=alice&type=phone", None, false).await;
+        assert_eq!(response.status(), StatusCode::NOT_FOUND, "{}", environment);
+    }
+}
@@ -0,0 +1,328 @@
+//! List endpoints answer an empty list with `[]`, never `null`, both as a
+//! bare array and inside the `Accept-Version: 2` envelope.
+
+use std::{collections::BTreeSet, fs, path::Path};
+
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use super::{create_user, get_json, sign_token, test_app, test_app_with, test_config};
+use crate::{services::bridges::BridgesService, storage::redis::RedisClient};
+
+/// Every list endpoint with the envelope besides messages (below), for a
+/// user with nothing to list
+const LIST_PATHS: [&str; 7] = [
+    "/api/v1/contacts",
+    "/api/v1/conversations",
+    "/api/v1/conversations/search?q=nothing",
+    "/api/v1/devices",
+    "/api/v1/stickers/catalog",
+    "/api/v1/stickers/search?q=nothing",
+    "/api/v1/users/search?q=nothing",
+];
+
+#[sqlx::test(migrations = "./migrations")]
+async fn empty_lists_are_arrays(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let token = sign_token(&config, create_user(&db, "alice").await);
+
+    for path in LIST_PATHS {
+        let body = get_json(&app, path, &token, false).await;
+        assert_eq!(body, json!([]), "GET {}", path);
+    }
+}
+
+#[sqlx::test(migrations = "./migrations")]
+async fn empty_pages_have_item_arrays(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let token = sign_token(&config, create_user(&db, "alice").await);
+
+    for path in LIST_PATHS {
+        let body = get_json(&app, path, &token, true).await;
+        assert_eq!(body["items"], json!([]), "GET {}", path);
+    }
+}
+
+#[sqlx::test(migrations = "./migrations")]
+async fn empty_conversation_has_no_messages(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let user_id = create_user(&db, "alice").await;
+    let token = sign_token(&config, user_id);
+
+    let conversation_id: Uuid = sqlx::query_scalar(
+        "INSERT INTO conversations (type, created_by) VALUES ('direct', $1) RETURNING id",
+    )
+    .bind(user_id)
+    .fetch_one(&db)
+    .await
+    .unwrap();
+    sqlx::query(
+        "INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, 'owner')",
+    )
+    .bind(conversation_id)
+    .bind(user_id)
+    .execute(&db)
+    .await
+    .unwrap();
+
+    let path = format!("/api/v1/conversations/{}/messages", conversation_id);
+    let bare = get_json(&app, &path, &token, false).await;
+    assert_eq!(bare, json!([]));
+    let page = get_json(&app, &path, &token, true).await;
+    assert_eq!(page["items"], json!([]));
+}
+
+#[sqlx::test(migrations = "./migrations")]
+async fn empty_user_search_page_has_user_array(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let token = sign_token(&config, create_user(&db, "alice").await);
+
+    let body = get_json(&app, "/api/v2/users/search?q=nothing", &token, false).await;
+    assert_eq!(body["users"], json!([]));
+}
+
+/// Every list endpoint in both API versions, by handler, relative to the
+/// version prefix. `{conversation}`, `{message}` and `{workspace}` are ones
+/// the user in `list_routes_return_arrays` belongs to.
+const LIST_ROUTES: [(&str, &str); 43] = [
+    ("abuse::list_abuse_blocks", "/admin/abuse-blocks"),
+    ("access_tokens::list_access_tokens", "/users/me/tokens"),
+    (
+        "account_purge::list_purge_exclusions",
+        "/admin/purge-exclusions",
+    ),
+    ("backups::get_backups", "/backups"),
+    ("bots::list_bots", "/admin/bots"),
+    (
+        "bridges::list_bridged_conversations",
+        "/bridge/conversations",
+    ),
+    ("bridges::list_bridges", "/admin/bridges"),
+    (
+        "bots::list_conversation_bots",
+        "/conversations/{conversation}/bots",
+    ),
+    (
+        "calendar::list_events",
+        "/conversations/{conversation}/calendar",
+    ),
+    (
+        "calls::list_conversation_calls",
+        "/conversations/{conversation}/calls",
+    ),
+    ("calls::list_my_calls", "/users/me/calls"),
+    (
+        "circuit_breakers::get_circuit_breakers",
+        "/admin/circuit-breakers",
+    ),
+    ("compliance::get_audit_logs", "/admin/audit-logs"),
+    ("compliance::list_legal_holds", "/admin/legal-holds"),
+    ("contacts::get_blocked_contacts", "/contacts/blocked"),
+    ("contacts::get_contacts", "/contacts"),
+    ("conversations::get_conversations", "/conversations"),
+    (
+        "conversations::get_events",
+        "/conversations/{conversation}/events",
+    ),
+    (
+        "conversations::get_messages",
+        "/conversations/{conversation}/messages",
+    ),
+    (
+        "conversations::search_conversations",
+        "/conversations/search?q=nothing",
+    ),
+    ("devices::get_devices", "/devices"),
+    (
+        "email_domains::list_blocked_domains",
+        "/admin/email-domains",
+    ),
+    (
+        "federation::list_federated_messages",
+        "/federation/messages",
+    ),
+    ("flags::list_flags", "/admin/flags"),
+    (
+        "guests::list_widget_tokens",
+        "/workspaces/{workspace}/widget-tokens",
+    ),
+    (
+        "impersonation::get_my_impersonations",
+        "/users/me/impersonations",
+    ),
+    (
+        "impersonation::list_impersonations",
+        "/admin/impersonations",
+    ),
+    ("jobs::get_dead_jobs", "/admin/jobs/dead"),
+    (
+        "message_requests::list_message_requests",
+        "/conversations/requests",
+    ),
+    (
+        "otp_delivery::list_otp_deliveries",
+        "/admin/otp-deliveries?target=alice%40example.com",
+    ),
+    (
+        "payments::list_payment_requests",
+        "/conversations/{conversation}/payment-requests",
+    ),
+    ("profiles::list_my_posts", "/users/me/posts"),
+    (
+        "realtime::get_stuck_messages",
+        "/admin/realtime/stuck-messages",
+    ),
+    (
+        "share_links::list_share_links",
+        "/conversations/{conversation}/share-links",
+    ),
+    ("stickers::get_catalog", "/stickers/catalog"),
+    ("stickers::get_user_sticker_packs", "/stickers/my-packs"),
+    ("stickers::search_stickers", "/stickers/search?q=nothing"),
+    ("stickers::suggest_stickers", "/stickers/suggest?emoji=cat"),
+    (
+        "storage::get_lifecycle_policies",
+        "/admin/storage/lifecycle",
+    ),
+    ("tasks::list_tasks", "/conversations/{conversation}/tasks"),
+    ("workspaces::get_members", "/workspaces/{workspace}/members"),
+    (
+        "workspaces::get_sticker_packs",
+        "/workspaces/{workspace}/sticker-packs",
+    ),
+    ("workspaces::get_workspaces", "/workspaces"),
+];
+
+/// List endpoints only one API version registers
+const VERSIONED_LIST_ROUTES: [(&str, &str); 2] = [
+    ("users::search_users", "/api/v1/users/search?q=nothing"),
+    (
+        "messages::get_receipts",
+        "/api/v2/messages/{message}/receipts",
+    ),
+];
+
+/// Routes authenticated with a bridge token rather than a user's
+const BRIDGE_PREFIX: &str = "/bridge/";
+
+/// `module::function` of every handler the router serves GETs with whose
+/// response is a list, read from the router and handler sources
+fn routed_list_handlers() -> BTreeSet<String> {
+    let api = Path::new(env!("CARGO_MANIFEST_DIR")).join("src/api");
+    let router = fs::read_to_string(api.join("router.rs")).unwrap();
+
+    router
+        .split("get(handlers::")
+        .skip(1)
+        .filter_map(|rest| {
+            let handler = &rest[..rest.find(')')?];
+            let (module, function) = handler.split_once("::")?;
+            let source =
+                fs::read_to_string(api.join("handlers").join(format!("{}.rs", module))).unwrap();
+            let signature = &source[source.find(&format!("pub async fn {}(", function))?..];
+            let returns = &signature[signature.find("->")?..signature.find('{')?];
+            (returns.contains("Vec<") || returns.contains("Listing<")).then(|| handler.to_string())
+        })
+        .collect()
+}
+
+#[test]
+fn every_list_route_is_covered() {
+    let covered: BTreeSet<String> = LIST_ROUTES
+        .iter()
+        .chain(VERSIONED_LIST_ROUTES.iter())
+        .map(|(handler, _)| handler.to_string())
+        .collect();
+
+    let missing: Vec<_> = routed_list_handlers()
+        .difference(&covered)
+        .cloned()
+        .collect();
+    assert!(
+        missing.is_empty(),
+        "list routes missing from LIST_ROUTES: {:?}",
+        missing
+    );
+}
+
+#[sqlx::test(migrations = "./migrations")]
+async fn list_routes_return_arrays(db: PgPool) {
+    let mut config = test_config();
+    config.federation.enabled = true;
+    let app = test_app_with(db.clone(), config.clone()).await;
+
+    let user_id = create_user(&db, "alice").await;
+    sqlx::query("UPDATE users SET is_admin = TRUE WHERE id = $1")
+        .bind(user_id)
+        .execute(&db)
+        .await
+        .unwrap();
+    let token = sign_token(&config, user_id);
+
+    let conversation_id: Uuid = sqlx::query_scalar(
+        "INSERT INTO conversations (type, name, created_by) VALUES ('group', 'Team', $1) RETURNING id",
+    )
+    .bind(user_id)
+    .fetch_one(&db)
+    .await
+    .unwrap();
+    sqlx::query(
+        "INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, 'owner')",
+    )
+    .bind(conversation_id)
+    .bind(user_id)
+    .execute(&db)
+    .await
+    .unwrap();
+    let message_id: Uuid = sqlx::query_scalar(
+        "INSERT INTO messages (conversation_id, sender_id, content) VALUES ($1, $2, 'hi') RETURNING id",
+    )
+    .bind(conversation_id)
+    .bind(user_id)
+    .fetch_one(&db)
+    .await
+    .unwrap();
+    let workspace_id: Uuid = sqlx::query_scalar(
+        "INSERT INTO workspaces (name, slug, created_by) VALUES ('Acme', 'acme', $1) RETURNING id",
+    )
+    .bind(user_id)
+    .fetch_one(&db)
+    .await
+    .unwrap();
+    sqlx::query(
+        "INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, 'owner')",
+    )
+    .bind(workspace_id)
+    .bind(user_id)
+    .execute(&db)
+    .await
+    .unwrap();
+
+    let redis = RedisClient::new(&config.redis_url(), None).await.unwrap();
+    let bridge_token = BridgesService::new(db.clone(), redis)
+        .create(user_id, "relay", user_id)
+        .await
+        .unwrap()
+        .token;
+
+    let shared = ["/api/v1", "/api/v2"]
+        .into_iter()
+        .flat_map(|version| LIST_ROUTES.map(|(_, path)| format!("{}{}", version, path)));
+    let versioned = VERSIONED_LIST_ROUTES.map(|(_, path)| path.to_string());
+
+    for path in shared.chain(versioned) {
+        let path = path
+            .replace("{conversation}", &conversation_id.to_string())
+            .replace("{message}", &message_id.to_string())
+            .replace("{workspace}", &workspace_id.to_string());
+        let token = if path.contains(BRIDGE_PREFIX) {
+            &bridge_token
+        } else {
+            &token
+        };
+
+        let body = get_json(&app, &path, token, false).await;
+        assert!(body.is_array(), "GET {} returned {}", path, body);
+    }
+}
@@ -0,0 +1,142 @@
+//! Handler tests. These run the real router against PostgreSQL
+//! (`DATABASE_URL`; each test gets a fresh, migrated database) and Redis
+//! (`REDIS_URL`), e.g. from `make dev`.
+
+use std::sync::Arc;
+
+use axum::{
+    body::{to_bytes, Body},
+    http::{header::AUTHORIZATION, Request, StatusCode},
+    response::Response,
+    Router,
+};
+use chrono::Utc;
+use serde_json::Value;
+use sqlx::PgPool;
+use tower::ServiceExt;
+use tracing_subscriber::{reload, EnvFilter, Registry};
+use uuid::Uuid;
+
+use crate::{
+    api::{
+        pagination::ACCEPT_VERSION_HEADER,
+        router::{create_v1_router, create_v2_router},
+        websocket::WsHub,
+    },
+    config::{Config, SharedConfig},
+    jobs::JobQueue,
+    services::{auth::Claims, circuit_breaker::Breakers, event_listener::EventListener},
+    storage::{minio::MinioClient, redis::RedisClient},
+    AppState,
+};
+
+mod dev;
+mod lists;
+mod sessions;
+mod stickers;
+mod workspaces;
+
+/// Config from the environment, with its JWT keys loaded
+fn test_config() -> Config {
+    let mut config = Config::load();
+    config.jwt.load_keys().unwrap();
+    config
+}
+
+/// Both API versions over `db`, with the rest of the config from the
+/// environment
+async fn test_app(db: PgPool) -> (Router, Config) {
+    let config = test_config();
+    (test_app_with(db, config.clone()).await, config)
+}
+
+async fn test_app_with(db: PgPool, config: Config) -> Router {
+    let redis = RedisClient::new(&config.redis_url(), None).await.unwrap();
+    let breakers = Breakers::new(&config.breaker);
+    let minio = MinioClient::new(&config.minio, breakers.minio.clone())
+        .await
+        .unwrap();
+    let (_, log_filter) = reload::Layer::<EnvFilter, Registry>::new(EnvFilter::new("info"));
+
+    let state = AppState {
+        db,
+        redis: redis.clone(),
+        minio,
+        config: Arc::new(SharedConfig::new(config.clone())),
+        log_filter,
+        ws_hub: Arc::new(WsHub::new(redis.clone())),
+        event_listener: Arc::new(EventListener::new(redis.clone())),
+        jobs: JobQueue::new(redis, config.jobs.max_attempts),
+        http: reqwest::Client::new(),
+        breakers,
+    };
+
+    Router::new()
+        .nest("/api/v1", create_v1_router(state.clone()))
+        .nest("/api/v2", create_v2_router(state.clone()))
+        .with_state(state)
+}
+
+async fn create_user(db: &PgPool, username: &str) -> Uuid {
+    sqlx::query_scalar(
+        r#"
+        INSERT INTO users (username, display_name, email)
+        VALUES ($1, $1, $1 || '@example.com')
+        RETURNING id
+        "#,
+    )
+    .bind(username)
+    .fetch_one(db)
+    .await
+    .unwrap()
+}
+
+/// A full session token for the user's first device
+fn sign_token(config: &Config, user_id: Uuid) -> String {
+    sign_workspace_token(config, user_id, None)
+}
+
+/// A full session token for the user's first device, with `workspace_id`
+/// as the active workspace
+fn sign_workspace_token(config: &Config, user_id: Uuid, workspace_id: Option<Uuid>) -> String {
+    let now = Utc::now().timestamp();
+    let claims = Claims {
+        sub: user_id.to_string(),
+        device_id: "1".to_string(),
+        iss: config.jwt.issuer.clone(),
+        exp: now + config.jwt.access_token_ttl.as_secs() as i64,
+        iat: now,
+        workspace_id: workspace_id.map(|id| id.to_string()),
+        scopes: Vec::new(),
+        cnf: None,
+        act: None,
+        guest: false,
+    };
+
+    config.jwt.keys.sign(&claims).unwrap()
+}
+
+/// GET `path`, with `token` if given
+async fn get(app: &Router, path: &str, token: Option<&str>, envelope: bool) -> Response {
+    let mut request = Request::get(path);
+    if let Some(token) = token {
+        request = request.header(AUTHORIZATION, format!("Bearer {}", token));
+    }
+    if envelope {
+        request = request.header(ACCEPT_VERSION_HEADER, "2");
+    }
+
+    app.clone()
+        .oneshot(request.body(Body::empty()).unwrap())
+        .await
+        .unwrap()
+}
+
+/// GET `path` as the token's user and expect a 200 with a JSON body
+async fn get_json(app: &Router, path: &str, token: &str, envelope: bool) -> Value {
+    let response = get(app, path, Some(token), envelope).await;
+    assert_eq!(response.status(), StatusCode::OK, "GET {}", path);
+
+    let body = to_bytes(response.into_body(), usize::MAX).await.unwrap();
+    serde_json::from_slice(&body).unwrap()
+}
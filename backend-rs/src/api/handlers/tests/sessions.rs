@@ -0,0 +1,34 @@
+//! Revoking a user's sessions reaches access tokens already handed out
+
+use std::time::Duration;
+
+use axum::http::StatusCode;
+use sqlx::PgPool;
+
+use super::{create_user, get, sign_token, test_app};
+use crate::{services::auth::AuthService, storage::redis::RedisClient};
+
+#[sqlx::test(migrations = "./migrations")]
+async fn logout_all_refuses_outstanding_access_tokens(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let user_id = create_user(&db, "alice").await;
+    let token = sign_token(&config, user_id);
+
+    let response = get(&app, "/api/v1/conversations", Some(&token), false).await;
+    assert_eq!(response.status(), StatusCode::OK);
+
+    // Tokens issued in the same second as the revocation still pass
+    tokio::time::sleep(Duration::from_secs(1)).await;
+    let redis = RedisClient::new(&config.redis_url(), None).await.unwrap();
+    AuthService::new(db, redis, config.clone())
+        .logout_all(user_id)
+        .await
+        .unwrap();
+
+    let response = get(&app, "/api/v1/conversations", Some(&token), false).await;
+    assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+
+    let fresh = sign_token(&config, user_id);
+    let response = get(&app, "/api/v1/conversations", Some(&fresh), false).await;
+    assert_eq!(response.status(), StatusCode::OK);
+}
@@ -0,0 +1,43 @@
+//! Sticker pack administration is for admins only
+
+use axum::{
+    body::Body,
+    http::{
+        header::{AUTHORIZATION, CONTENT_TYPE},
+        Request, StatusCode,
+    },
+    Router,
+};
+use serde_json::json;
+use sqlx::PgPool;
+use tower::ServiceExt;
+
+use super::{create_user, sign_token, test_app};
+
+async fn create_pack(app: &Router, token: &str) -> StatusCode {
+    let body = json!({ "name": "Cats", "author": "alice" });
+    let request = Request::post("/api/v1/admin/stickers/packs")
+        .header(AUTHORIZATION, format!("Bearer {}", token))
+        .header(CONTENT_TYPE, "application/json")
+        .body(Body::from(body.to_string()))
+        .unwrap();
+
+    app.clone().oneshot(request).await.unwrap().status()
+}
+
+#[sqlx::test(migrations = "./migrations")]
+async fn only_admins_create_sticker_packs(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let user_id = create_user(&db, "alice").await;
+    let token = sign_token(&config, user_id);
+
+    assert_eq!(create_pack(&app, &token).await, StatusCode::FORBIDDEN);
+
+    sqlx::query("UPDATE users SET is_admin = TRUE WHERE id = $1")
+        .bind(user_id)
+        .execute(&db)
+        .await
+        .unwrap();
+
+    assert_eq!(create_pack(&app, &token).await, StatusCode::OK);
+}
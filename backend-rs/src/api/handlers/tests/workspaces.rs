@@ -0,0 +1,40 @@
+//! Tokens that carry an active workspace
+
+use axum::http::StatusCode;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use super::{create_user, get, sign_workspace_token, test_app};
+
+#[sqlx::test(migrations = "./migrations")]
+async fn removed_member_loses_workspace_access_before_token_expires(db: PgPool) {
+    let (app, config) = test_app(db.clone()).await;
+    let user_id = create_user(&db, "alice").await;
+    let workspace_id: Uuid = sqlx::query_scalar(
+        "INSERT INTO workspaces (name, slug, created_by) VALUES ('Acme', 'acme', $1) RETURNING id",
+    )
+    .bind(user_id)
+    .fetch_one(&db)
+    .await
+    .unwrap();
+    sqlx::query("INSERT INTO workspace_members (workspace_id, user_id) VALUES ($1, $2)")
+        .bind(workspace_id)
+        .bind(user_id)
+        .execute(&db)
+        .await
+        .unwrap();
+    let token = sign_workspace_token(&config, user_id, Some(workspace_id));
+
+    let response = get(&app, "/api/v1/conversations", Some(&token), false).await;
+    assert_eq!(response.status(), StatusCode::OK);
+
+    sqlx::query("DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2")
+        .bind(workspace_id)
+        .bind(user_id)
+        .execute(&db)
+        .await
+        .unwrap();
+
+    let response = get(&app, "/api/v1/conversations", Some(&token), false).await;
+    assert_eq!(response.status(), StatusCode::FORBIDDEN);
+}
@@ -0,0 +1,28 @@
+use axum::{extract::State, Extension};
+
+use crate::{
+    error::AppResult,
+    models::{TranslateRequest, TranslateResponse},
+    services::{auth::Claims, translation::TranslationService},
+    AppState,
+};
+
+use super::super::extract::Json;
+use super::super::middleware::get_user_id;
+
+pub async fn translate(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<TranslateRequest>,
+) -> AppResult<Json<TranslateResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let translation_service = TranslationService::new(
+        state.http,
+        state.redis,
+        state.config.current().translation.clone(),
+    );
+    let translation = translation_service.translate(user_id, &req).await?;
+
+    Ok(Json(translation))
+}
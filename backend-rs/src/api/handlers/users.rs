@@ -1,27 +1,34 @@
 use axum::{
-    extract::{Multipart, Query, State},
-    Extension, Json,
+    extract::{Multipart, State},
+    http::HeaderMap,
+    Extension,
 };
 use serde::{Deserialize, Serialize};
+use uuid::Uuid;
 
 use crate::{
     error::{AppError, AppResult},
-    models::User,
-    services::{auth::Claims, contacts::ContactsService},
+    models::{AccountUsage, StorageCategory, StorageUsage, User, UserSearchPage},
+    services::{
+        auth::Claims, contacts::ContactsService, storage::StorageService, usage::UsageService,
+    },
     AppState,
 };
 
+use super::super::etag::{if_match, Tagged};
+use super::super::extract::{Json, Query};
 use super::super::middleware::get_user_id;
+use super::super::pagination::{ListFormat, Listing};
 
 pub async fn get_current_user(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
-) -> AppResult<Json<User>> {
+) -> AppResult<Tagged<User>> {
     let user_id = get_user_id(&claims)?;
 
     let user: Option<User> = sqlx::query_as(
         r#"
-        SELECT id, phone, email, username, display_name, avatar_url, bio, status, last_seen_at, created_at, updated_at
+        SELECT id, phone, email, username, display_name, avatar_url, bio, status, last_seen_at, created_at, updated_at, version, discoverable, read_receipts
         FROM users WHERE id = $1
         "#,
     )
@@ -30,7 +37,7 @@ pub async fn get_current_user(
     .await?;
 
     let user = user.ok_or(AppError::UserNotFound)?;
-    Ok(Json(user))
+    Ok(Tagged(user.version, user))
 }
 
 #[derive(Debug, Deserialize)]
@@ -38,27 +45,41 @@ pub struct UpdateUserRequest {
     pub display_name: Option<String>,
     pub username: Option<String>,
     pub bio: Option<String>,
+    pub discoverable: Option<bool>,
+    pub read_receipts: Option<bool>,
 }
 
+/// Honors `If-Match` so concurrent edits from several devices don't
+/// silently overwrite each other
 pub async fn update_current_user(
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
+    headers: HeaderMap,
     Json(req): Json<UpdateUserRequest>,
-) -> AppResult<Json<User>> {
+) -> AppResult<Tagged<User>> {
     let user_id = get_user_id(&claims)?;
+    let expected_version = if_match(&headers)?;
 
-    if req.display_name.is_none() && req.username.is_none() && req.bio.is_none() {
+    if req.display_name.is_none()
+        && req.username.is_none()
+        && req.bio.is_none()
+        && req.discoverable.is_none()
+        && req.read_receipts.is_none()
+    {
         return Err(AppError::BadRequest("No fields to update".to_string()));
     }
 
-    let user: User = sqlx::query_as(
+    let user: Option<User> = sqlx::query_as(
         r#"
         UPDATE users
         SET display_name = COALESCE($1, display_name),
             username = COALESCE($2, username),
             bio = COALESCE($3, bio),
+            discoverable = COALESCE($6, discoverable),
+            read_receipts = COALESCE($7, read_receipts),
+            version = version + 1,
             updated_at = NOW()
-        WHERE id = $4
+        WHERE id = $4 AND ($5::INTEGER IS NULL OR version = $5)
         RETURNING *
         "#,
     )
@@ -66,10 +87,26 @@ pub async fn update_current_user(
     .bind(&req.username)
     .bind(&req.bio)
     .bind(user_id)
-    .fetch_one(&state.db)
+    .bind(expected_version)
+    .bind(req.discoverable)
+    .bind(req.read_receipts)
+    .fetch_optional(&state.db)
     .await?;
 
-    Ok(Json(user))
+    let Some(user) = user else {
+        let current_version: Option<i32> =
+            sqlx::query_scalar("SELECT version FROM users WHERE id = $1")
+                .bind(user_id)
+                .fetch_optional(&state.db)
+                .await?;
+
+        return Err(match current_version {
+            Some(current_version) => AppError::PreconditionFailed { current_version },
+            None => AppError::UserNotFound,
+        });
+    };
+
+    Ok(Tagged(user.version, user))
 }
 
 #[derive(Debug, Serialize)]
@@ -109,52 +146,147 @@ pub async fn upload_avatar(
             _ => "bin",
         };
 
-        let key = format!("avatars/{}/avatar.{}", user_id, extension);
+        // A new key per upload, since avatars are served as immutable
+        let key = format!("avatars/{}/{}.{}", user_id, Uuid::new_v4(), extension);
+        let size = data.len() as i64;
+
+        let storage_service =
+            StorageService::new(state.db.clone(), state.config.current().storage.clone());
+        storage_service
+            .ensure_quota(user_id, state.minio.avatars_bucket(), &key, size)
+            .await?;
+
         let avatar_url = state
             .minio
             .upload_file(state.minio.avatars_bucket(), &key, data, &content_type)
             .await?;
 
+        storage_service
+            .record(
+                user_id,
+                StorageCategory::Avatar,
+                state.minio.avatars_bucket(),
+                &key,
+                size,
+            )
+            .await?;
+
         // Update user
-        sqlx::query("UPDATE users SET avatar_url = $1, updated_at = NOW() WHERE id = $2")
+        sqlx::query(
+            "UPDATE users SET avatar_url = $1, version = version + 1, updated_at = NOW() WHERE id = $2",
+        )
             .bind(&avatar_url)
             .bind(user_id)
             .execute(&state.db)
             .await?;
 
+        let previous: Vec<String> = sqlx::query_scalar(
+            "SELECT object_key FROM storage_objects WHERE user_id = $1 AND category = $2 AND object_key != $3",
+        )
+        .bind(user_id)
+        .bind(StorageCategory::Avatar)
+        .bind(&key)
+        .fetch_all(&state.db)
+        .await?;
+        for old_key in previous {
+            state
+                .minio
+                .delete_file(state.minio.avatars_bucket(), &old_key)
+                .await?;
+            storage_service
+                .release(state.minio.avatars_bucket(), &old_key)
+                .await?;
+        }
+
         return Ok(Json(AvatarResponse { avatar_url }));
     }
 
     Err(AppError::BadRequest("Avatar file required".to_string()))
 }
 
+pub async fn get_storage_usage(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<StorageUsage>> {
+    let user_id = get_user_id(&claims)?;
+
+    let storage_service = StorageService::new(state.db, state.config.current().storage.clone());
+    let usage = storage_service.get_usage(user_id).await?;
+
+    Ok(Json(usage))
+}
+
+pub async fn get_usage(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<AccountUsage>> {
+    let user_id = get_user_id(&claims)?;
+
+    let config = state.config.current();
+    let usage_service = UsageService::new(
+        state.db,
+        state.redis,
+        config.storage.clone(),
+        config.limits.clone(),
+        config.translation.clone(),
+    );
+    let usage = usage_service.get_usage(user_id).await?;
+
+    Ok(Json(usage))
+}
+
 #[derive(Debug, Deserialize)]
 pub struct SearchQuery {
     pub q: String,
     #[serde(default = "default_limit")]
     pub limit: i32,
+    pub cursor: Option<String>,
 }
 
 fn default_limit() -> i32 {
     20
 }
 
-pub async fn search_users(
-    State(state): State<AppState>,
-    Extension(claims): Extension<Claims>,
-    Query(query): Query<SearchQuery>,
-) -> AppResult<Json<Vec<User>>> {
-    let user_id = get_user_id(&claims)?;
+async fn search_page(
+    state: AppState,
+    claims: &Claims,
+    query: &SearchQuery,
+) -> AppResult<UserSearchPage> {
+    let user_id = get_user_id(claims)?;
 
     if query.q.is_empty() {
         return Err(AppError::BadRequest("Search query required".to_string()));
     }
 
-    let contacts_service = ContactsService::new(state.db.clone());
-    let mut users = contacts_service.search_users(&query.q, query.limit).await?;
+    let contacts_service = ContactsService::new(state.db);
+    contacts_service
+        .search_users(user_id, &query.q, query.limit, query.cursor.as_deref())
+        .await
+}
+
+/// v1 returns a bare list unless the client asks for the list envelope;
+/// follow-up pages need a cursor from either
+pub async fn search_users(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<SearchQuery>,
+    headers: HeaderMap,
+) -> AppResult<Json<Listing<Vec<User>>>> {
+    let page = search_page(state, &claims, &query).await?;
+
+    Ok(Json(ListFormat::from_headers(&headers).list(
+        page.users,
+        page.next_cursor,
+        None,
+    )))
+}
 
-    // Filter out current user
-    users.retain(|u| u.id != user_id);
+pub async fn search_users_page(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Query(query): Query<SearchQuery>,
+) -> AppResult<Json<UserSearchPage>> {
+    let page = search_page(state, &claims, &query).await?;
 
-    Ok(Json(users))
+    Ok(Json(page))
 }
@@ -0,0 +1,185 @@
+use axum::{extract::State, Extension};
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{
+        StickerPack, Workspace, WorkspaceMember, WorkspaceMemberWithUser, WorkspaceRole,
+        WorkspaceWithRole,
+    },
+    services::{
+        auth::{AuthService, Claims},
+        stickers::StickersService,
+        workspaces::WorkspacesService,
+    },
+    AppState,
+};
+
+use super::super::extract::{Json, Path};
+use super::super::middleware::get_user_id;
+
+#[derive(Debug, Deserialize)]
+pub struct CreateWorkspaceRequest {
+    pub name: String,
+    pub slug: String,
+}
+
+pub async fn create_workspace(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Json(req): Json<CreateWorkspaceRequest>,
+) -> AppResult<Json<Workspace>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db);
+    let workspace = workspaces_service
+        .create_workspace(user_id, &req.name, &req.slug)
+        .await?;
+
+    Ok(Json(workspace))
+}
+
+pub async fn get_workspaces(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+) -> AppResult<Json<Vec<WorkspaceWithRole>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db);
+    let workspaces = workspaces_service.get_user_workspaces(user_id).await?;
+
+    Ok(Json(workspaces))
+}
+
+pub async fn get_workspace(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+) -> AppResult<Json<WorkspaceWithRole>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db);
+    let workspace = workspaces_service
+        .get_workspace(workspace_id, user_id)
+        .await?;
+
+    Ok(Json(workspace))
+}
+
+pub async fn get_members(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+) -> AppResult<Json<Vec<WorkspaceMemberWithUser>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db);
+    let members = workspaces_service.get_members(workspace_id, user_id).await?;
+
+    Ok(Json(members))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SetMemberRequest {
+    pub role: WorkspaceRole,
+}
+
+pub async fn set_member(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((workspace_id, member_id)): Path<(Uuid, Uuid)>,
+    Json(req): Json<SetMemberRequest>,
+) -> AppResult<Json<WorkspaceMember>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db);
+    let member = workspaces_service
+        .set_member(workspace_id, user_id, member_id, req.role)
+        .await?;
+
+    Ok(Json(member))
+}
+
+#[derive(Debug, Serialize)]
+pub struct MessageResponse {
+    pub message: String,
+}
+
+pub async fn remove_member(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path((workspace_id, member_id)): Path<(Uuid, Uuid)>,
+) -> AppResult<Json<MessageResponse>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db.clone());
+    workspaces_service
+        .remove_member(workspace_id, user_id, member_id)
+        .await?;
+
+    // Tokens carry the active workspace; make a removed member sign in again
+    if member_id != user_id {
+        let config = state.config.current();
+        AuthService::new(state.db, state.redis, (*config).clone())
+            .logout_all(member_id)
+            .await?;
+    }
+
+    Ok(Json(MessageResponse {
+        message: "Member removed".to_string(),
+    }))
+}
+
+pub async fn get_sticker_packs(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+) -> AppResult<Json<Vec<StickerPack>>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db.clone());
+    workspaces_service
+        .require_member(workspace_id, user_id)
+        .await?;
+
+    let stickers_service = StickersService::new(state.db, state.minio);
+    let packs = stickers_service.get_workspace_packs(workspace_id).await?;
+
+    Ok(Json(packs))
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateWorkspacePackRequest {
+    pub name: String,
+    pub author: String,
+    pub description: Option<String>,
+    #[serde(default)]
+    pub is_animated: bool,
+}
+
+pub async fn create_sticker_pack(
+    State(state): State<AppState>,
+    Extension(claims): Extension<Claims>,
+    Path(workspace_id): Path<Uuid>,
+    Json(req): Json<CreateWorkspacePackRequest>,
+) -> AppResult<Json<StickerPack>> {
+    let user_id = get_user_id(&claims)?;
+
+    let workspaces_service = WorkspacesService::new(state.db.clone());
+    workspaces_service.require_admin(workspace_id, user_id).await?;
+
+    let stickers_service = StickersService::new(state.db, state.minio);
+    let pack = stickers_service
+        .create_pack(
+            &req.name,
+            &req.author,
+            req.description.as_deref(),
+            false,
+            req.is_animated,
+            Some(workspace_id),
+        )
+        .await?;
+
+    Ok(Json(pack))
+}
@@ -1,14 +1,32 @@
+use std::net::SocketAddr;
+
 use axum::{
-    extract::{Request, State},
-    http::header::AUTHORIZATION,
+    body::{to_bytes, Body},
+    extract::{ConnectInfo, OriginalUri, Request, State},
+    http::{
+        header::{AUTHORIZATION, CONTENT_LENGTH, CONTENT_TYPE, USER_AGENT},
+        HeaderValue, Method,
+    },
     middleware::Next,
     response::Response,
 };
+use serde_json::json;
 use uuid::Uuid;
 
 use crate::{
-    error::{AppError, AppResult},
-    services::auth::Claims,
+    error::{AppError, AppResult, ErrorCode},
+    services::{
+        abuse::ClientOrigin,
+        access_tokens::{self, AccessTokensService},
+        analytics::AnalyticsService,
+        auth::{Claims, Scope},
+        bridges::BridgesService,
+        dpop::DpopService,
+        guests::GuestsService,
+        impersonation::{self, ImpersonationService},
+        session_anomaly::SessionAnomalyService,
+        workspaces::WorkspacesService,
+    },
     AppState,
 };
 
@@ -18,24 +36,231 @@ pub async fn auth_middleware(
     mut request: Request,
     next: Next,
 ) -> Result<Response, AppError> {
+    // DPoP-bound tokens may use either scheme
     let token = request
         .headers()
         .get(AUTHORIZATION)
         .and_then(|h| h.to_str().ok())
-        .and_then(|h| h.strip_prefix("Bearer "))
+        .and_then(|h| h.strip_prefix("Bearer ").or_else(|| h.strip_prefix("DPoP ")))
         .ok_or(AppError::Unauthorized)?;
 
+    let config = state.config.current();
     let auth_service = crate::services::auth::AuthService::new(
         state.db.clone(),
         state.redis.clone(),
-        (*state.config).clone(),
+        (*config).clone(),
     );
 
-    let claims = auth_service.validate_token(token)?;
+    // Personal access tokens are looked up rather than verified
+    let is_access_token = token.starts_with(access_tokens::TOKEN_PREFIX);
+    let claims = if is_access_token {
+        let access_token = AccessTokensService::new(
+            state.db.clone(),
+            state.redis.clone(),
+            config.access_tokens.clone(),
+        )
+        .authenticate(token, config.region.read_only)
+        .await?;
+        access_tokens::token_claims(&access_token, &config.jwt.issuer)
+    } else {
+        let claims = auth_service.validate_token(token)?;
+        auth_service.check_revocation(&claims).await?;
+        claims
+    };
+
+    // Nested routers strip their prefix from the URI; proofs sign the full path
+    let path = request
+        .extensions()
+        .get::<OriginalUri>()
+        .map(|uri| uri.path())
+        .unwrap_or_else(|| request.uri().path());
+    DpopService::new(state.redis.clone(), config.dpop.clone())
+        .check_request(&claims, token, request.headers(), request.method(), path)
+        .await?;
+
+    let impersonated = claims.act.is_some();
+    if let Some(actor) = &claims.act {
+        ImpersonationService::new(state.db.clone(), (*config).clone())
+            .authorize_request(&claims, actor, request.method(), path)
+            .await?;
+    }
+
+    if claims.guest {
+        GuestsService::new(state.db.clone(), state.redis.clone(), (*config).clone())
+            .authorize_request(&claims, path)
+            .await?;
+    }
+
+    // The active workspace is only as current as the token, so a member
+    // removed from it must not keep acting in it until the token expires
+    if let Some(workspace_id) = get_workspace_id(&claims)? {
+        WorkspacesService::new(state.db.clone())
+            .require_member(workspace_id, get_user_id(&claims)?)
+            .await?;
+    }
+
+    // Only full session tokens are tied to one device's whereabouts; access
+    // tokens, scoped tokens and guests are meant to be used from elsewhere
+    let session_token =
+        !is_access_token && !impersonated && !claims.guest && claims.scopes.is_empty();
+    let peer = request
+        .extensions()
+        .get::<ConnectInfo<SocketAddr>>()
+        .copied();
+    if let Some(ConnectInfo(peer)) = peer.filter(|_| session_token) {
+        let origin = ClientOrigin::from_request(request.headers(), peer, &config.abuse);
+        let user_agent = request
+            .headers()
+            .get(USER_AGENT)
+            .and_then(|v| v.to_str().ok());
+        SessionAnomalyService::new(state.db.clone(), state.redis.clone(), (*config).clone())
+            .check_request(
+                get_user_id(&claims)?,
+                get_device_id(&claims)?,
+                claims.iat,
+                &origin,
+                user_agent,
+            )
+            .await?;
+    }
+
+    // Aggregate DAU/MAU tracking; failures must not block the request. An
+    // admin impersonating the user doesn't make them active, and widget
+    // guests aren't counted.
+    match get_user_id(&claims) {
+        Ok(user_id) if !impersonated && !claims.guest => {
+            let _ = AnalyticsService::new(state.redis.clone())
+                .record_active(user_id)
+                .await;
+        }
+        _ => {}
+    }
 
     // Insert claims into request extensions
     request.extensions_mut().insert(claims);
 
+    let response = next.run(request).await;
+    if impersonated {
+        return redact_response(response).await;
+    }
+
+    Ok(response)
+}
+
+/// Strip message content from a JSON response to an impersonation token
+async fn redact_response(response: Response) -> Result<Response, AppError> {
+    let is_json = response
+        .headers()
+        .get(CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|v| v.starts_with("application/json"));
+    if !is_json {
+        return Ok(response);
+    }
+
+    let (mut parts, body) = response.into_parts();
+    let bytes = to_bytes(body, usize::MAX)
+        .await
+        .map_err(|e| anyhow::anyhow!("Failed to read response body: {}", e))?;
+    let mut value: serde_json::Value = match serde_json::from_slice(&bytes) {
+        Ok(value) => value,
+        Err(_) => return Ok(Response::from_parts(parts, Body::from(bytes))),
+    };
+
+    impersonation::redact_content(&mut value);
+    let redacted = serde_json::to_vec(&value)
+        .map_err(|e| anyhow::anyhow!("Failed to serialize response: {}", e))?;
+    parts.headers.remove(CONTENT_LENGTH);
+
+    Ok(Response::from_parts(parts, Body::from(redacted)))
+}
+
+/// Bridge service-account authentication. Bridges send their own token
+/// rather than a user JWT; the `Bridge` goes into request extensions.
+pub async fn bridge_middleware(
+    State(state): State<AppState>,
+    mut request: Request,
+    next: Next,
+) -> Result<Response, AppError> {
+    let token = request
+        .headers()
+        .get(AUTHORIZATION)
+        .and_then(|h| h.to_str().ok())
+        .and_then(|h| h.strip_prefix("Bearer "))
+        .ok_or(AppError::Unauthorized)?;
+
+    let read_only = state.config.current().region.read_only;
+    let bridge = BridgesService::new(state.db.clone(), state.redis.clone())
+        .authenticate(token, read_only)
+        .await?;
+    request.extensions_mut().insert(bridge);
+
+    Ok(next.run(request).await)
+}
+
+/// Admin authorization middleware (must run after auth_middleware)
+pub async fn admin_middleware(
+    State(state): State<AppState>,
+    request: Request,
+    next: Next,
+) -> Result<Response, AppError> {
+    let claims = request
+        .extensions()
+        .get::<Claims>()
+        .ok_or(AppError::Unauthorized)?;
+    let user_id = get_user_id(claims)?;
+
+    let is_admin: Option<bool> = sqlx::query_scalar("SELECT is_admin FROM users WHERE id = $1")
+        .bind(user_id)
+        .fetch_optional(&state.db)
+        .await?;
+
+    if !is_admin.unwrap_or(false) {
+        return Err(AppError::Forbidden);
+    }
+
+    Ok(next.run(request).await)
+}
+
+/// Refuse anything but GET, HEAD and OPTIONS while the region is read-only,
+/// pointing the client at the leader. WebSocket upgrades are GETs and still
+/// connect.
+pub async fn read_only_gate(
+    State(state): State<AppState>,
+    request: Request,
+    next: Next,
+) -> Result<Response, AppError> {
+    let config = state.config.current();
+    let is_read = matches!(
+        *request.method(),
+        Method::GET | Method::HEAD | Method::OPTIONS
+    );
+    if config.region.read_only && !is_read {
+        return Err(AppError::RegionReadOnly {
+            leader_url: config.region.leader_url.clone(),
+        });
+    }
+
+    Ok(next.run(request).await)
+}
+
+/// Scope check for a route group (must run after auth_middleware). Full
+/// login tokens pass; downscoped tokens need the group's scope, or `read`
+/// for GET/HEAD outside admin routes.
+pub async fn require_scope(
+    State(required): State<Scope>,
+    request: Request,
+    next: Next,
+) -> Result<Response, AppError> {
+    let claims = request
+        .extensions()
+        .get::<Claims>()
+        .ok_or(AppError::Unauthorized)?;
+
+    if !claims.allows(required, request.method()) {
+        return Err(AppError::InsufficientScope(required));
+    }
+
     Ok(next.run(request).await)
 }
 
@@ -51,3 +276,42 @@ pub fn get_device_id(claims: &Claims) -> AppResult<i32> {
         .parse()
         .map_err(|_| AppError::InvalidToken)
 }
+
+/// Extract the active workspace from request extensions
+pub fn get_workspace_id(claims: &Claims) -> AppResult<Option<Uuid>> {
+    claims
+        .workspace_id
+        .as_deref()
+        .map(|id| Uuid::parse_str(id).map_err(|_| AppError::InvalidToken))
+        .transpose()
+}
+
+/// Give error responses that didn't come from an `AppError` (axum's 405s,
+/// body limit and multipart rejections) the standard envelope, so every
+/// error carries a `code`. Their plain-text bodies are dropped rather than
+/// passed on, since they echo parser internals.
+pub async fn envelope_errors(response: Response) -> Response {
+    let status = response.status();
+    let is_json = response
+        .headers()
+        .get(CONTENT_TYPE)
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|v| v.starts_with("application/json"));
+    if is_json || !(status.is_client_error() || status.is_server_error()) {
+        return response;
+    }
+
+    let body = json!({
+        "code": ErrorCode::for_status(status),
+        "message": status.canonical_reason().unwrap_or("Error"),
+        "details": null
+    });
+
+    let (mut parts, _) = response.into_parts();
+    parts.headers.remove(CONTENT_LENGTH);
+    parts
+        .headers
+        .insert(CONTENT_TYPE, HeaderValue::from_static("application/json"));
+
+    Response::from_parts(parts, Body::from(body.to_string()))
+}
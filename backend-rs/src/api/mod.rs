@@ -1,4 +1,10 @@
+pub mod etag;
+pub mod extract;
+pub mod fields;
+pub mod graphql;
 pub mod handlers;
 pub mod middleware;
+pub mod pagination;
 pub mod router;
+pub mod versioning;
 pub mod websocket;
@@ -0,0 +1,119 @@
+//! The list envelope. List endpoints return a bare array by default; clients
+//! that send `Accept-Version: 2` get `{items, next_cursor, total_estimate}`
+//! instead. Pass `next_cursor` back as `cursor` for the next page; it is
+//! `null` on the last one. Cursors are opaque to clients.
+
+use axum::http::HeaderMap;
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+
+use crate::error::{AppError, AppResult};
+
+/// Header opting into the list envelope, e.g. `Accept-Version: 2`
+pub const ACCEPT_VERSION_HEADER: &str = "accept-version";
+const ENVELOPE_VERSION: u64 = 2;
+
+/// How the client wants lists shaped, from `Accept-Version`
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ListFormat {
+    Bare,
+    Envelope,
+}
+
+impl ListFormat {
+    pub fn from_headers(headers: &HeaderMap) -> Self {
+        let major: Option<u64> = headers
+            .get(ACCEPT_VERSION_HEADER)
+            .and_then(|v| v.to_str().ok())
+            .and_then(|v| {
+                v.trim()
+                    .trim_start_matches('v')
+                    .split('.')
+                    .next()?
+                    .parse()
+                    .ok()
+            });
+
+        match major {
+            Some(major) if major >= ENVELOPE_VERSION => ListFormat::Envelope,
+            _ => ListFormat::Bare,
+        }
+    }
+
+    pub fn list<T>(
+        self,
+        items: T,
+        next_cursor: Option<String>,
+        total_estimate: Option<i64>,
+    ) -> Listing<T> {
+        match self {
+            ListFormat::Bare => Listing::Bare(items),
+            ListFormat::Envelope => Listing::Page(Page {
+                items,
+                next_cursor,
+                total_estimate,
+            }),
+        }
+    }
+
+    /// Part of a list's shape, for ETags
+    pub fn shape(self) -> &'static str {
+        match self {
+            ListFormat::Bare => "bare",
+            ListFormat::Envelope => "envelope",
+        }
+    }
+}
+
+#[derive(Debug, Serialize)]
+pub struct Page<T> {
+    pub items: T,
+    pub next_cursor: Option<String>,
+    /// Total across all pages where it is cheap to count, `null` otherwise
+    pub total_estimate: Option<i64>,
+}
+
+#[derive(Debug, Serialize)]
+#[serde(untagged)]
+pub enum Listing<T> {
+    Bare(T),
+    Page(Page<T>),
+}
+
+/// Position in a list paged by offset
+#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+pub struct OffsetCursor {
+    pub offset: i32,
+}
+
+impl OffsetCursor {
+    /// The offset to read from: the cursor's if there is one, else `offset`
+    pub fn resolve(cursor: Option<&str>, offset: i32) -> AppResult<i32> {
+        match cursor {
+            Some(cursor) => Ok(decode_cursor::<Self>(cursor)?.offset.max(0)),
+            None => Ok(offset),
+        }
+    }
+
+    /// The cursor after a page read at `offset`, unless it came back short
+    pub fn next(offset: i32, limit: i32, returned: usize) -> Option<String> {
+        (limit > 0 && returned >= limit as usize).then(|| {
+            encode_cursor(&OffsetCursor {
+                offset: offset + limit,
+            })
+        })
+    }
+}
+
+pub fn encode_cursor<T: Serialize>(cursor: &T) -> String {
+    let json = serde_json::to_vec(cursor).unwrap_or_default();
+    URL_SAFE_NO_PAD.encode(json)
+}
+
+pub fn decode_cursor<T: DeserializeOwned>(cursor: &str) -> AppResult<T> {
+    URL_SAFE_NO_PAD
+        .decode(cursor)
+        .ok()
+        .and_then(|json| serde_json::from_slice(&json).ok())
+        .ok_or_else(|| AppError::InvalidQuery("Invalid cursor".to_string()))
+}
@@ -1,13 +1,82 @@
 use axum::{
+    extract::DefaultBodyLimit,
     middleware,
     routing::{delete, get, post, put},
-    Router,
+    Extension, Router,
 };
 
-use super::{handlers, middleware::auth_middleware, websocket::handle_websocket};
-use crate::AppState;
+use super::{
+    graphql, handlers,
+    middleware::{admin_middleware, auth_middleware, bridge_middleware, require_scope},
+    versioning::v1_deprecation_headers,
+    websocket::handle_websocket,
+};
+use crate::{
+    services::{auth::Scope, exports::EXPORT_MAX_REQUEST_SIZE, imports::IMPORT_MAX_REQUEST_SIZE},
+    AppState,
+};
+
+/// `/api/v1`: the original API. Routes replaced in v2 carry deprecation
+/// headers.
+pub fn create_v1_router(state: AppState) -> Router<AppState> {
+    let message_routes = Router::new()
+        .route("/:id/delivered", post(handlers::messages::mark_delivered))
+        .route("/:id/read", post(handlers::messages::mark_read))
+        .route("/:id/status", get(handlers::messages::get_status))
+        .route("/:id", delete(handlers::messages::delete_message))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    let user_search_routes = Router::new()
+        .route("/search", get(handlers::users::search_users))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    let contact_sync_routes = Router::new()
+        .route("/sync", post(handlers::contacts::sync_contacts))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    common_routes(&state)
+        .nest("/messages", message_routes)
+        .nest("/users", user_search_routes)
+        .nest("/contacts", contact_sync_routes)
+        .layer(middleware::from_fn_with_state(state.clone(), v1_deprecation_headers))
+        .with_state(state)
+}
 
-pub fn create_router(state: AppState) -> Router<AppState> {
+/// `/api/v2`: shares every unchanged route with v1 and registers only the
+/// endpoints whose contract changed
+pub fn create_v2_router(state: AppState) -> Router<AppState> {
+    let message_routes = Router::new()
+        .route(
+            "/:id/receipts",
+            get(handlers::messages::get_receipts).post(handlers::messages::create_receipt),
+        )
+        .route("/:id/status", get(handlers::messages::get_status))
+        .route("/:id", delete(handlers::messages::delete_message))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    let user_search_routes = Router::new()
+        .route("/search", get(handlers::users::search_users_page))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    let contact_sync_routes = Router::new()
+        .route("/sync", post(handlers::contacts::sync_contacts_with_hints))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    common_routes(&state)
+        .nest("/messages", message_routes)
+        .nest("/users", user_search_routes)
+        .nest("/contacts", contact_sync_routes)
+        .with_state(state)
+}
+
+/// Routes that are identical in every API version
+fn common_routes(state: &AppState) -> Router<AppState> {
     // Public auth routes
     let auth_routes = Router::new()
         .route("/otp/send", post(handlers::auth::send_otp))
@@ -16,10 +85,25 @@ pub fn create_router(state: AppState) -> Router<AppState> {
         .route("/login", post(handlers::auth::login))
         .route("/refresh", post(handlers::auth::refresh_token));
 
+    // Provider delivery callbacks (public, checked against OTP_WEBHOOK_TOKEN)
+    let webhook_routes = Router::new()
+        .route("/twilio", post(handlers::otp_delivery::twilio_status))
+        .route("/sendgrid", post(handlers::otp_delivery::sendgrid_events));
+
+    // Development tooling; never routed in production
+    let dev_routes = Router::new().route("/otp", get(handlers::auth::get_latest_otp));
+
     // Protected auth routes
     let auth_protected = Router::new()
         .route("/logout", post(handlers::auth::logout))
         .route("/logout-all", post(handlers::auth::logout_all))
+        .route("/workspace", post(handlers::auth::switch_workspace))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Minting only ever narrows the caller's scopes (protected, any scope)
+    let scoped_token_routes = Router::new()
+        .route("/tokens/scoped", post(handlers::auth::create_scoped_token))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // User routes (protected)
@@ -27,13 +111,51 @@ pub fn create_router(state: AppState) -> Router<AppState> {
         .route("/me", get(handlers::users::get_current_user))
         .route("/me", put(handlers::users::update_current_user))
         .route("/me/avatar", post(handlers::users::upload_avatar))
-        .route("/search", get(handlers::users::search_users))
+        .route("/me/flags", get(handlers::flags::get_my_flags))
+        .route("/me/storage", get(handlers::users::get_storage_usage))
+        .route("/me/usage", get(handlers::users::get_usage))
+        .route("/me/impersonations", get(handlers::impersonation::get_my_impersonations))
+        .route(
+            "/me/impersonations/:id/approve",
+            post(handlers::impersonation::approve_impersonation),
+        )
+        .route(
+            "/me/impersonations/:id/deny",
+            post(handlers::impersonation::deny_impersonation),
+        )
+        .route(
+            "/me/impersonations/:id/revoke",
+            post(handlers::impersonation::revoke_impersonation),
+        )
+        .route(
+            "/me/tokens",
+            get(handlers::access_tokens::list_access_tokens)
+                .post(handlers::access_tokens::create_access_token),
+        )
+        .route("/me/tokens/:id", delete(handlers::access_tokens::revoke_access_token))
+        .route("/me/calls", get(handlers::calls::list_my_calls))
+        .route(
+            "/me/posts",
+            get(handlers::profiles::list_my_posts).post(handlers::profiles::create_post),
+        )
+        .route(
+            "/me/posts/:id",
+            put(handlers::profiles::update_post).delete(handlers::profiles::delete_post),
+        )
+        .route("/:id/profile", get(handlers::profiles::get_profile))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Device routes (protected)
     let device_routes = Router::new()
         .route("/", get(handlers::devices::get_devices))
+        .route(
+            "/notification-routing",
+            get(handlers::devices::get_notification_routing)
+                .put(handlers::devices::set_notification_routing),
+        )
         .route("/:id", delete(handlers::devices::remove_device))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Key routes (protected)
@@ -43,6 +165,58 @@ pub fn create_router(state: AppState) -> Router<AppState> {
         .route("/count", get(handlers::keys::get_pre_key_count))
         .route("/prekeys", post(handlers::keys::refresh_pre_keys))
         .route("/signed-prekey", put(handlers::keys::update_signed_pre_key))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Workspace routes (protected)
+    let workspace_routes = Router::new()
+        .route("/", get(handlers::workspaces::get_workspaces))
+        .route("/", post(handlers::workspaces::create_workspace))
+        .route("/:id", get(handlers::workspaces::get_workspace))
+        .route("/:id/members", get(handlers::workspaces::get_members))
+        .route("/:id/members/:user_id", put(handlers::workspaces::set_member))
+        .route("/:id/members/:user_id", delete(handlers::workspaces::remove_member))
+        .route("/:id/sticker-packs", get(handlers::workspaces::get_sticker_packs))
+        .route("/:id/sticker-packs", post(handlers::workspaces::create_sticker_pack))
+        .route(
+            "/:id/widget-tokens",
+            get(handlers::guests::list_widget_tokens).post(handlers::guests::create_widget_token),
+        )
+        .route("/:id/widget-tokens/:token_id", delete(handlers::guests::revoke_widget_token))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Backup routes (protected). Uploads may exceed the default body limit.
+    let backup_routes = Router::new()
+        .route("/", get(handlers::backups::get_backups))
+        .route(
+            "/",
+            post(handlers::backups::upload_backup)
+                .layer(DefaultBodyLimit::max(state.config.current().backup.max_size)),
+        )
+        .route("/latest", get(handlers::backups::get_latest_backup))
+        .route("/:version", get(handlers::backups::get_backup))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Attachment routes (protected)
+    let attachment_routes = Router::new()
+        .route(
+            "/",
+            post(handlers::attachments::upload_attachment)
+                .layer(DefaultBodyLimit::max(state.config.current().storage.max_attachment_size)),
+        )
+        .route("/claim", post(handlers::attachments::claim_attachment))
+        .route("/refs/:ref_id", delete(handlers::attachments::release_attachment))
+        .route("/refs/:ref_id/deliveries", post(handlers::attachments::declare_deliveries))
+        .route("/:id/downloaded", post(handlers::attachments::confirm_download))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // File redirect routes (protected)
+    let file_routes = Router::new()
+        .route("/:id", get(handlers::attachments::redirect_file))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Contact routes (protected)
@@ -55,25 +229,95 @@ pub fn create_router(state: AppState) -> Router<AppState> {
         .route("/:id/block", post(handlers::contacts::block_contact))
         .route("/:id/unblock", post(handlers::contacts::unblock_contact))
         .route("/blocked", get(handlers::contacts::get_blocked_contacts))
-        .route("/sync", post(handlers::contacts::sync_contacts))
+        .route("/bulk", post(handlers::contacts::bulk_add_contacts))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Conversation routes (protected)
     let conversation_routes = Router::new()
         .route("/", get(handlers::conversations::get_conversations))
+        .route("/search", get(handlers::conversations::search_conversations))
+        .route("/requests", get(handlers::message_requests::list_message_requests))
+        .route("/requests/:id/accept", post(handlers::message_requests::accept_message_request))
+        .route("/requests/:id/block", post(handlers::message_requests::block_message_request))
+        .route("/requests/:id/report", post(handlers::message_requests::report_message_request))
         .route("/direct", post(handlers::conversations::create_direct_conversation))
         .route("/group", post(handlers::conversations::create_group_conversation))
         .route("/:id", get(handlers::conversations::get_conversation))
         .route("/:id/messages", get(handlers::conversations::get_messages))
         .route("/:id/messages", post(handlers::conversations::send_message))
         .route("/:id/typing", post(handlers::conversations::send_typing))
-        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
-
-    // Message routes (protected)
-    let message_routes = Router::new()
-        .route("/:id/delivered", post(handlers::messages::mark_delivered))
-        .route("/:id/read", post(handlers::messages::mark_read))
-        .route("/:id", delete(handlers::messages::delete_message))
+        .route("/:id/slow-mode", put(handlers::conversations::set_slow_mode))
+        .route("/:id/clone", post(handlers::conversations::clone_group_conversation))
+        .route("/:id/sharing", put(handlers::conversations::set_sharing))
+        .route(
+            "/:id/share-links",
+            get(handlers::share_links::list_share_links)
+                .post(handlers::share_links::create_share_link),
+        )
+        .route("/:id/share-links/:link_id", delete(handlers::share_links::revoke_share_link))
+        .route(
+            "/:id/bots",
+            get(handlers::bots::list_conversation_bots).post(handlers::bots::add_bot),
+        )
+        .route("/:id/bots/:bot_id", delete(handlers::bots::remove_bot))
+        .route("/:id/commands", post(handlers::bots::submit_command))
+        .route("/:id/read-receipts", put(handlers::conversations::set_read_receipts))
+        .route("/:id/unread", post(handlers::conversations::mark_unread))
+        .route(
+            "/:id/flag",
+            post(handlers::conversations::flag_conversation)
+                .delete(handlers::conversations::unflag_conversation),
+        )
+        .route("/:id/events", get(handlers::conversations::get_events))
+        .route(
+            "/:id/calls",
+            get(handlers::calls::list_conversation_calls).post(handlers::calls::report_call),
+        )
+        .route(
+            "/:id/calendar",
+            get(handlers::calendar::list_events).post(handlers::calendar::create_event),
+        )
+        .route(
+            "/:id/calendar/:event_id",
+            get(handlers::calendar::get_event).delete(handlers::calendar::cancel_event),
+        )
+        .route(
+            "/:id/calendar/:event_id/rsvp",
+            put(handlers::calendar::set_rsvp).delete(handlers::calendar::clear_rsvp),
+        )
+        .route("/:id/note", get(handlers::notes::get_note).put(handlers::notes::update_note))
+        .route(
+            "/:id/payment-requests",
+            get(handlers::payments::list_payment_requests)
+                .post(handlers::payments::create_payment_request),
+        )
+        .route("/:id/payment-requests/:request_id", get(handlers::payments::get_payment_request))
+        .route(
+            "/:id/payment-requests/:request_id/status",
+            put(handlers::payments::update_payment_request_status),
+        )
+        .route("/:id/tasks", get(handlers::tasks::list_tasks).post(handlers::tasks::create_task))
+        .route("/:id/tasks/:task_id", delete(handlers::tasks::delete_task))
+        .route("/:id/tasks/:task_id/assignee", put(handlers::tasks::assign_task))
+        .route(
+            "/:id/tasks/:task_id/complete",
+            post(handlers::tasks::complete_task).delete(handlers::tasks::reopen_task),
+        )
+        .route(
+            "/import",
+            post(handlers::imports::import_conversation)
+                .layer(DefaultBodyLimit::max(IMPORT_MAX_REQUEST_SIZE)),
+        )
+        .route("/imports/:import_id", get(handlers::imports::get_import))
+        .route("/:id/imported-messages", get(handlers::imports::get_imported_messages))
+        .route(
+            "/:id/export",
+            post(handlers::conversations::export_conversation)
+                .layer(DefaultBodyLimit::max(EXPORT_MAX_REQUEST_SIZE)),
+        )
+        .route("/:id/exports/:export_id", get(handlers::conversations::get_export))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Sticker routes (public catalog, protected for user actions)
@@ -83,35 +327,196 @@ pub fn create_router(state: AppState) -> Router<AppState> {
         .route("/packs/:id", get(handlers::stickers::get_sticker_pack));
 
     let sticker_protected_routes = Router::new()
+        .route("/suggest", get(handlers::stickers::suggest_stickers))
         .route("/packs/:id/download", post(handlers::stickers::download_sticker_pack))
         .route("/packs/:id", delete(handlers::stickers::remove_sticker_pack))
         .route("/my-packs", get(handlers::stickers::get_user_sticker_packs))
         .route("/my-packs/reorder", put(handlers::stickers::reorder_sticker_packs))
+        .layer(middleware::from_fn_with_state(Scope::Account, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
-    // Admin sticker routes (protected - would need admin check in production)
+    // Admin sticker routes
     let admin_sticker_routes = Router::new()
         .route("/packs", post(handlers::stickers::create_sticker_pack))
         .route("/packs/:id/cover", post(handlers::stickers::upload_pack_cover))
         .route("/packs/:id/stickers", post(handlers::stickers::add_sticker))
+        .layer(middleware::from_fn_with_state(Scope::Admin, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), admin_middleware))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Admin feature flag routes
+    let admin_flag_routes = Router::new()
+        .route("/", get(handlers::flags::list_flags))
+        .route("/:key", put(handlers::flags::upsert_flag))
+        .route("/:key", delete(handlers::flags::delete_flag))
+        .layer(middleware::from_fn_with_state(Scope::Admin, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), admin_middleware))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Admin compliance and operations routes
+    let admin_routes = Router::new()
+        .route("/legal-holds", get(handlers::compliance::list_legal_holds))
+        .route("/legal-holds", post(handlers::compliance::place_legal_hold))
+        .route("/legal-holds/:id", delete(handlers::compliance::release_legal_hold))
+        .route("/audit-logs", get(handlers::compliance::get_audit_logs))
+        .route("/stats", get(handlers::analytics::get_stats))
+        .route("/jobs", get(handlers::jobs::get_job_metrics))
+        .route("/jobs/dead", get(handlers::jobs::get_dead_jobs))
+        .route("/jobs/dead/:id/retry", post(handlers::jobs::retry_dead_job))
+        .route("/realtime/queue", get(handlers::realtime::get_queue_stats))
+        .route("/realtime/delivery-sla", get(handlers::realtime::get_delivery_sla))
+        .route("/realtime/stuck-messages", get(handlers::realtime::get_stuck_messages))
+        .route("/circuit-breakers", get(handlers::circuit_breakers::get_circuit_breakers))
+        .route("/storage/lifecycle", get(handlers::storage::get_lifecycle_policies))
+        .route("/limits", get(handlers::limits::get_default_limits))
+        .route("/limits/users/:id", get(handlers::limits::get_user_limits))
+        .route("/limits/users/:id", put(handlers::limits::set_user_limits))
+        .route("/limits/users/:id", delete(handlers::limits::clear_user_limits))
+        .route("/spam/settings", get(handlers::spam::get_spam_settings))
+        .route("/spam/settings", put(handlers::spam::update_spam_settings))
+        .route("/config", get(handlers::runtime_config::get_runtime_config))
+        .route("/config/reload", post(handlers::runtime_config::reload_config))
+        .route("/otp-deliveries", get(handlers::otp_delivery::list_otp_deliveries))
+        .route("/email-domains", get(handlers::email_domains::list_blocked_domains))
+        .route("/email-domains", post(handlers::email_domains::block_domains))
+        .route("/email-domains/:domain", delete(handlers::email_domains::unblock_domain))
+        .route("/abuse-blocks", get(handlers::abuse::list_abuse_blocks))
+        .route("/abuse-blocks", post(handlers::abuse::add_abuse_blocks))
+        .route("/abuse-blocks/:id", delete(handlers::abuse::remove_abuse_block))
+        .route("/impersonations", get(handlers::impersonation::list_impersonations))
+        .route("/impersonations", post(handlers::impersonation::request_impersonation))
+        .route(
+            "/impersonations/:id/token",
+            post(handlers::impersonation::issue_impersonation_token),
+        )
+        .route("/bridges", get(handlers::bridges::list_bridges))
+        .route("/bridges", post(handlers::bridges::create_bridge))
+        .route("/bridges/:id", delete(handlers::bridges::revoke_bridge))
+        .route("/bots", get(handlers::bots::list_bots))
+        .route("/bots", post(handlers::bots::create_bot))
+        .route("/bots/:id", delete(handlers::bots::revoke_bot))
+        .route("/bots/:id/commands", put(handlers::bots::set_bot_commands))
+        .route("/purge-exclusions", get(handlers::account_purge::list_purge_exclusions))
+        .route("/purge-exclusions/:user_id", put(handlers::account_purge::add_purge_exclusion))
+        .route("/purge-exclusions/:user_id", delete(handlers::account_purge::remove_purge_exclusion))
+        .layer(middleware::from_fn_with_state(Scope::Admin, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), admin_middleware))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Translation relay (protected, opt-in per deployment)
+    let translate_route = Router::new()
+        .route("/translate", post(handlers::translation::translate))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // WebSocket route (protected)
     let ws_route = Router::new()
         .route("/ws", get(handle_websocket))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Fallback transport for networks that block WebSockets (protected)
+    let realtime_routes = Router::new()
+        .route("/poll", get(handlers::realtime::poll_events))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // GraphQL gateway (protected; resolvers check scopes per field)
+    let graphql_route = Router::new()
+        .route("/graphql", get(graphql::graphql_handler).post(graphql::graphql_handler))
+        .layer(Extension(graphql::build_schema()))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Server-Sent Events for receive-only clients (protected)
+    let event_stream_route = Router::new()
+        .route("/events", get(handlers::realtime::stream_events))
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Chat bridge relay (bridge service tokens, not user JWTs)
+    let bridge_routes = Router::new()
+        .route("/conversations", get(handlers::bridges::list_bridged_conversations))
+        .route(
+            "/conversations/:id/link",
+            put(handlers::bridges::link_conversation)
+                .delete(handlers::bridges::unlink_conversation),
+        )
+        .route("/conversations/:id/events", get(handlers::bridges::get_bridge_events))
+        .route("/conversations/:id/messages", post(handlers::bridges::relay_message))
+        .route("/messages", get(handlers::bridges::find_bridged_message))
+        .route("/messages/:id", delete(handlers::bridges::delete_relayed_message))
+        .route("/messages/:id/external-id", put(handlers::bridges::map_message))
+        .layer(middleware::from_fn_with_state(state.clone(), bridge_middleware));
+
+    // Website chat widget guests. Starting a session is public; the widget
+    // token in the body is checked instead.
+    let guest_public_routes =
+        Router::new().route("/sessions", post(handlers::guests::start_guest_session));
+    let guest_routes = Router::new()
+        .route(
+            "/session",
+            get(handlers::guests::get_guest_session).delete(handlers::guests::end_guest_session),
+        )
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
+        .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
+
+    // Read-only message snapshots. Public; the token in the path is checked
+    // instead.
+    let shared_routes =
+        Router::new().route("/:token", get(handlers::share_links::view_shared));
+
+    // Server-to-server relay (opt-in per deployment). The inbox is public;
+    // envelopes carry the sending server's signature.
+    let federation_inbox =
+        Router::new().route("/inbox", post(handlers::federation::receive_envelope));
+    let federation_routes = Router::new()
+        .route(
+            "/messages",
+            get(handlers::federation::list_federated_messages)
+                .post(handlers::federation::send_federated_message),
+        )
+        .route(
+            "/senders/:address/accept",
+            post(handlers::federation::accept_federated_sender),
+        )
+        .route(
+            "/senders/:address/block",
+            post(handlers::federation::block_federated_sender),
+        )
+        .layer(middleware::from_fn_with_state(Scope::Messaging, require_scope))
         .layer(middleware::from_fn_with_state(state.clone(), auth_middleware));
 
     // Combine all routes
-    Router::new()
-        .nest("/auth", auth_routes.merge(auth_protected))
+    let mut router = Router::new();
+    if state.config.current().server.environment == "development" {
+        router = router.nest("/dev", dev_routes);
+    }
+    if state.config.current().federation.enabled {
+        router = router.nest("/federation", federation_inbox.merge(federation_routes));
+    }
+
+    router
+        .nest("/auth", auth_routes.merge(auth_protected).merge(scoped_token_routes))
+        .nest("/webhooks", webhook_routes)
         .nest("/users", user_routes)
         .nest("/devices", device_routes)
         .nest("/keys", key_routes)
+        .nest("/workspaces", workspace_routes)
+        .nest("/backups", backup_routes)
+        .nest("/attachments", attachment_routes)
+        .nest("/files", file_routes)
         .nest("/contacts", contact_routes)
         .nest("/conversations", conversation_routes)
-        .nest("/messages", message_routes)
         .nest("/stickers", sticker_public_routes.merge(sticker_protected_routes))
         .nest("/admin/stickers", admin_sticker_routes)
+        .nest("/admin/flags", admin_flag_routes)
+        .nest("/admin", admin_routes)
+        .nest("/realtime", realtime_routes)
+        .nest("/bridge", bridge_routes)
+        .nest("/guest", guest_public_routes.merge(guest_routes))
+        .nest("/shared", shared_routes)
+        .merge(event_stream_route)
+        .merge(translate_route)
+        .merge(graphql_route)
         .merge(ws_route)
-        .with_state(state)
 }
@@ -0,0 +1,145 @@
+//! API versioning. Versions are negotiated by URL prefix (`/api/v1`,
+//! `/api/v2`); each version registers its own router and shares unchanged
+//! routes. v1 routes replaced in v2 advertise `Deprecation`, `Sunset` and a
+//! successor `Link`, and clients below `MIN_CLIENT_VERSION` are asked to
+//! upgrade.
+
+use axum::{
+    extract::{Request, State},
+    http::{header::LINK, HeaderName, HeaderValue, Method},
+    middleware::Next,
+    response::Response,
+};
+
+use crate::{error::AppError, AppState};
+
+/// Header carrying the app version, e.g. `X-Client-Version: 1.4.2`
+pub const CLIENT_VERSION_HEADER: &str = "x-client-version";
+
+const DEPRECATION: HeaderName = HeaderName::from_static("deprecation");
+const SUNSET: HeaderName = HeaderName::from_static("sunset");
+
+/// A v1 route slated for removal and the v2 route that replaces it
+struct Deprecation {
+    method: Method,
+    path: &'static str,
+    successor: &'static str,
+}
+
+const V1_DEPRECATIONS: &[Deprecation] = &[
+    Deprecation {
+        method: Method::POST,
+        path: "/messages/:id/delivered",
+        successor: "/api/v2/messages/:id/receipts",
+    },
+    Deprecation {
+        method: Method::POST,
+        path: "/messages/:id/read",
+        successor: "/api/v2/messages/:id/receipts",
+    },
+    Deprecation {
+        method: Method::GET,
+        path: "/users/search",
+        successor: "/api/v2/users/search",
+    },
+    Deprecation {
+        method: Method::POST,
+        path: "/contacts/sync",
+        successor: "/api/v2/contacts/sync",
+    },
+];
+
+/// Add deprecation headers to v1 responses for routes replaced in v2
+pub async fn v1_deprecation_headers(
+    State(state): State<AppState>,
+    request: Request,
+    next: Next,
+) -> Response {
+    let deprecation = V1_DEPRECATIONS.iter().find(|d| {
+        d.method == request.method() && path_matches(d.path, request.uri().path())
+    });
+
+    let mut response = next.run(request).await;
+
+    if let Some(deprecation) = deprecation {
+        let headers = response.headers_mut();
+        headers.insert(DEPRECATION, HeaderValue::from_static("true"));
+
+        if let Some(sunset) = state
+            .config
+            .current()
+            .server
+            .v1_sunset
+            .as_deref()
+            .and_then(|s| HeaderValue::from_str(s).ok())
+        {
+            headers.insert(SUNSET, sunset);
+        }
+
+        let link = format!("<{}>; rel=\"successor-version\"", deprecation.successor);
+        if let Ok(link) = HeaderValue::from_str(&link) {
+            headers.insert(LINK, link);
+        }
+    }
+
+    response
+}
+
+/// Reject clients older than MIN_CLIENT_VERSION. Requests without the
+/// header (scripts, the web console) are let through.
+pub async fn client_version_gate(
+    State(state): State<AppState>,
+    request: Request,
+    next: Next,
+) -> Result<Response, AppError> {
+    let config = state.config.current();
+    if let Some(min_version) = &config.server.min_client_version {
+        let client_version = request
+            .headers()
+            .get(CLIENT_VERSION_HEADER)
+            .and_then(|v| v.to_str().ok());
+
+        if let Some(client_version) = client_version {
+            if parse_version(client_version) < parse_version(min_version) {
+                return Err(AppError::UpgradeRequired {
+                    min_version: min_version.clone(),
+                    client_version: client_version.to_string(),
+                });
+            }
+        }
+    }
+
+    Ok(next.run(request).await)
+}
+
+/// Parse `major.minor.patch`, ignoring pre-release and build suffixes.
+/// Unparseable parts count as 0.
+fn parse_version(version: &str) -> (u64, u64, u64) {
+    let core = version
+        .trim()
+        .trim_start_matches('v')
+        .split(['-', '+'])
+        .next()
+        .unwrap_or_default();
+
+    let mut parts = core.split('.').map(|p| p.parse().unwrap_or(0));
+    (
+        parts.next().unwrap_or(0),
+        parts.next().unwrap_or(0),
+        parts.next().unwrap_or(0),
+    )
+}
+
+/// Match a request path against a route pattern with `:param` segments
+fn path_matches(pattern: &str, path: &str) -> bool {
+    let mut pattern_segments = pattern.trim_matches('/').split('/');
+    let mut path_segments = path.trim_matches('/').split('/');
+
+    loop {
+        match (pattern_segments.next(), path_segments.next()) {
+            (None, None) => return true,
+            (Some(p), Some(s)) if p.starts_with(':') || p == s => continue,
+            _ => return false,
+        }
+    }
+}
@@ -1,23 +1,31 @@
 use std::{
-    collections::HashMap,
-    sync::Arc,
-    time::Duration,
+    collections::{hash_map::DefaultHasher, HashMap},
+    hash::{Hash, Hasher},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
 };
 
 use axum::{
     extract::{
-        ws::{Message, WebSocket, WebSocketUpgrade},
+        ws::{CloseFrame, Message, WebSocket, WebSocketUpgrade},
         State,
     },
-    response::Response,
+    response::{IntoResponse, Response},
     Extension,
 };
 use futures_util::{SinkExt, StreamExt};
 use serde::{Deserialize, Serialize};
 use tokio::sync::{mpsc, RwLock};
+use uuid::Uuid;
 
 use crate::{
-    services::auth::Claims,
+    config::RealtimeConfig,
+    error::{AppError, ErrorCode},
+    models::{
+        EventFilter, PresenceUpdate, TypingUpdate, WS_ACK, WS_FILTER, WS_PING, WS_PONG,
+        WS_PRESENCE, WS_TYPING,
+    },
+    services::{auth::Claims, notifications::NotificationsService, publisher},
     storage::redis::RedisClient,
     AppState,
 };
@@ -38,19 +46,94 @@ pub struct WsOutgoingMessage {
     pub payload: serde_json::Value,
 }
 
+/// Registry shards; a user's connections always live in the same shard
+const SHARD_COUNT: usize = 16;
+
+/// Close code sent to a WebSocket over one of the connection limits, with a
+/// JSON reason naming the limit
+pub const CLOSE_TOO_MANY_CONNECTIONS: u16 = 4429;
+
+/// Bounds on a connection's event filter
+const MAX_FILTER_TYPES: usize = 32;
+const MAX_FILTER_CONVERSATIONS: usize = 1000;
+
+/// A connection's event filter, shared between the hub and the socket's
+/// Redis subscription so both apply the same one
+pub type ConnectionFilter = Arc<Mutex<EventFilter>>;
+
+struct Connection {
+    device_id: String,
+    sender: mpsc::Sender<WsOutgoingMessage>,
+    filter: ConnectionFilter,
+}
+
+#[derive(Default)]
+struct Shard {
+    /// Open connections by user id
+    connections: RwLock<HashMap<String, Vec<Connection>>>,
+    /// Redis subscriptions held by WebSockets, SSE streams and long polls,
+    /// by user id. A std mutex so `Subscription` can release on drop.
+    subscriptions: Mutex<HashMap<String, usize>>,
+}
+
+/// A connection refused by one of the `RealtimeConfig` limits
+#[derive(Debug, Clone, Copy)]
+pub struct ConnectionLimit {
+    pub limit: &'static str,
+    pub max: usize,
+}
+
+impl From<ConnectionLimit> for AppError {
+    fn from(e: ConnectionLimit) -> Self {
+        AppError::TooManyConnections {
+            limit: e.limit,
+            max: e.max,
+        }
+    }
+}
+
+/// A counted Redis subscription; released when dropped
+pub struct Subscription {
+    hub: Arc<WsHub>,
+    user_id: String,
+}
+
+impl Drop for Subscription {
+    fn drop(&mut self) {
+        let mut subscriptions = self.hub.shard(&self.user_id).subscriptions.lock().unwrap();
+        if let Some(count) = subscriptions.get_mut(&self.user_id) {
+            *count -= 1;
+            if *count == 0 {
+                subscriptions.remove(&self.user_id);
+            }
+        }
+    }
+}
+
+/// Connections held by this server. The registry is sharded by user so
+/// connects, disconnects and fan-out for different users rarely contend on
+/// a lock, and indexed by user so sending costs O(devices), not O(clients).
+/// Limits are per server; behind a load balancer a user's total is bounded
+/// by the limit times the number of instances.
 pub struct WsHub {
-    clients: RwLock<HashMap<String, mpsc::Sender<WsOutgoingMessage>>>,
+    shards: Vec<Shard>,
     redis: RedisClient,
 }
 
 impl WsHub {
     pub fn new(redis: RedisClient) -> Self {
         Self {
-            clients: RwLock::new(HashMap::new()),
+            shards: (0..SHARD_COUNT).map(|_| Shard::default()).collect(),
             redis,
         }
     }
 
+    fn shard(&self, user_id: &str) -> &Shard {
+        let mut hasher = DefaultHasher::new();
+        user_id.hash(&mut hasher);
+        &self.shards[hasher.finish() as usize % SHARD_COUNT]
+    }
+
     pub async fn run(&self) {
         // This is a placeholder for any hub-level background tasks
         // In production, you might want to implement heartbeat checking here
@@ -59,64 +142,200 @@ impl WsHub {
         }
     }
 
-    pub async fn register(&self, client_id: &str, sender: mpsc::Sender<WsOutgoingMessage>) {
-        let mut clients = self.clients.write().await;
-        clients.insert(client_id.to_string(), sender);
-        tracing::info!("Client registered: {}", client_id);
+    /// Add a connection and claim its Redis subscription, unless the user
+    /// or device is already at its limit
+    pub async fn register(
+        self: &Arc<Self>,
+        user_id: &str,
+        device_id: &str,
+        sender: mpsc::Sender<WsOutgoingMessage>,
+        filter: ConnectionFilter,
+        limits: &RealtimeConfig,
+    ) -> Result<Subscription, ConnectionLimit> {
+        let mut users = self.shard(user_id).connections.write().await;
+        let connections = users.get(user_id).map(Vec::as_slice).unwrap_or_default();
+
+        if connections.len() >= limits.max_connections_per_user {
+            return Err(ConnectionLimit {
+                limit: "connections_per_user",
+                max: limits.max_connections_per_user,
+            });
+        }
+        let on_device = connections
+            .iter()
+            .filter(|c| c.device_id == device_id)
+            .count();
+        if on_device >= limits.max_connections_per_device {
+            return Err(ConnectionLimit {
+                limit: "connections_per_device",
+                max: limits.max_connections_per_device,
+            });
+        }
+
+        let subscription = self.subscribe(user_id, limits.max_subscriptions_per_user)?;
+
+        users
+            .entry(user_id.to_string())
+            .or_default()
+            .push(Connection {
+                device_id: device_id.to_string(),
+                sender,
+                filter,
+            });
+        tracing::info!("Client registered: {}:{}", user_id, device_id);
+
+        Ok(subscription)
     }
 
-    pub async fn unregister(&self, client_id: &str) {
-        let mut clients = self.clients.write().await;
-        clients.remove(client_id);
-        tracing::info!("Client unregistered: {}", client_id);
+    /// Remove the connection that sends through `sender`
+    pub async fn unregister(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        sender: &mpsc::Sender<WsOutgoingMessage>,
+    ) {
+        let mut users = self.shard(user_id).connections.write().await;
+        if let Some(connections) = users.get_mut(user_id) {
+            connections.retain(|c| !c.sender.same_channel(sender));
+            if connections.is_empty() {
+                users.remove(user_id);
+            }
+        }
+        tracing::info!("Client unregistered: {}:{}", user_id, device_id);
     }
 
-    pub async fn send_to_user(&self, user_id: &str, message: WsOutgoingMessage) {
-        let clients = self.clients.read().await;
+    /// Claim one of the user's Redis subscriptions for an SSE stream or long
+    /// poll; hold the returned guard for as long as the subscription is open
+    pub fn subscribe(
+        self: &Arc<Self>,
+        user_id: &str,
+        max: usize,
+    ) -> Result<Subscription, ConnectionLimit> {
+        let mut subscriptions = self.shard(user_id).subscriptions.lock().unwrap();
+        let count = subscriptions.entry(user_id.to_string()).or_default();
 
-        // Find all clients for this user (could be multiple devices)
-        for (client_id, sender) in clients.iter() {
-            if client_id.starts_with(&format!("{}:", user_id)) {
-                let _ = sender.send(message.clone()).await;
-            }
+        if *count >= max {
+            return Err(ConnectionLimit {
+                limit: "subscriptions_per_user",
+                max,
+            });
+        }
+        *count += 1;
+
+        Ok(Subscription {
+            hub: self.clone(),
+            user_id: user_id.to_string(),
+        })
+    }
+
+    /// The user's connections on this server whose filter lets `message`
+    /// through, optionally only one device's, copied out so no lock is held
+    /// while sending
+    async fn senders(
+        &self,
+        user_id: &str,
+        device_id: Option<&str>,
+        message: &WsOutgoingMessage,
+    ) -> Vec<mpsc::Sender<WsOutgoingMessage>> {
+        let users = self.shard(user_id).connections.read().await;
+        users
+            .get(user_id)
+            .map(|connections| {
+                connections
+                    .iter()
+                    .filter(|c| device_id.map_or(true, |d| c.device_id == d))
+                    .filter(|c| allows(&c.filter, message))
+                    .map(|c| c.sender.clone())
+                    .collect()
+            })
+            .unwrap_or_default()
+    }
+
+    pub async fn send_to_user(&self, user_id: &str, message: WsOutgoingMessage) {
+        // All of the user's devices connected here
+        for sender in self.senders(user_id, None, &message).await {
+            let _ = sender.send(message.clone()).await;
         }
 
         // Also publish to Redis for other server instances
         if let Ok(msg_str) = serde_json::to_string(&message) {
-            let _ = self.redis.publish_message(user_id, &msg_str).await;
+            publisher::publish(&self.redis, user_id, &msg_str).await;
         }
     }
 
     pub async fn send_to_device(&self, user_id: &str, device_id: &str, message: WsOutgoingMessage) {
-        let clients = self.clients.read().await;
-        let client_id = format!("{}:{}", user_id, device_id);
-
-        if let Some(sender) = clients.get(&client_id) {
-            let _ = sender.send(message).await;
+        for sender in self.senders(user_id, Some(device_id), &message).await {
+            let _ = sender.send(message.clone()).await;
         }
     }
 }
 
+fn allows(filter: &ConnectionFilter, message: &WsOutgoingMessage) -> bool {
+    filter
+        .lock()
+        .unwrap()
+        .allows(&message.msg_type, &message.payload)
+}
+
 pub async fn handle_websocket(
     ws: WebSocketUpgrade,
     State(state): State<AppState>,
     Extension(claims): Extension<Claims>,
 ) -> Response {
-    let user_id = get_user_id(&claims).unwrap_or_default();
+    let user_id = match get_user_id(&claims) {
+        Ok(user_id) => user_id,
+        Err(e) => return e.into_response(),
+    };
     let device_id = get_device_id(&claims).unwrap_or(1);
 
-    ws.on_upgrade(move |socket| handle_socket(socket, state, user_id.to_string(), device_id))
+    ws.on_upgrade(move |socket| handle_socket(socket, state, user_id, device_id))
 }
 
-async fn handle_socket(socket: WebSocket, state: AppState, user_id: String, device_id: i32) {
-    let client_id = format!("{}:{}", user_id, device_id);
-    let (mut ws_sender, mut ws_receiver) = socket.split();
+/// How often an open socket refreshes its device's activity for
+/// notification routing
+const ACTIVITY_REFRESH_INTERVAL: Duration = Duration::from_secs(60);
+
+async fn handle_socket(mut socket: WebSocket, state: AppState, user_uuid: Uuid, device_id: i32) {
+    let user_id = user_uuid.to_string();
+    let device_key = device_id.to_string();
 
     // Create channel for sending messages to this client
     let (tx, mut rx) = mpsc::channel::<WsOutgoingMessage>(256);
+    // Everything until the client sends a `filter`
+    let filter = ConnectionFilter::default();
+
+    // Register client; the subscription is released when this returns
+    let limits = state.config.current().realtime.clone();
+    let _subscription = match state
+        .ws_hub
+        .register(&user_id, &device_key, tx.clone(), filter.clone(), &limits)
+        .await
+    {
+        Ok(subscription) => subscription,
+        Err(limit) => {
+            tracing::warn!(
+                "Rejected WebSocket for {}:{}: {} limit of {}",
+                user_id,
+                device_key,
+                limit.limit,
+                limit.max
+            );
+            let reason = serde_json::json!({
+                "code": ErrorCode::TooManyConnections,
+                "limit": limit.limit,
+                "max": limit.max,
+            });
+            let _ = socket
+                .send(Message::Close(Some(CloseFrame {
+                    code: CLOSE_TOO_MANY_CONNECTIONS,
+                    reason: reason.to_string().into(),
+                })))
+                .await;
+            return;
+        }
+    };
 
-    // Register client
-    state.ws_hub.register(&client_id, tx.clone()).await;
+    let (mut ws_sender, mut ws_receiver) = socket.split();
 
     // Set user presence to online
     let _ = state
@@ -124,17 +343,29 @@ async fn handle_socket(socket: WebSocket, state: AppState, user_id: String, devi
         .set_user_presence(&user_id, "online", Duration::from_secs(300))
         .await;
 
+    let notifications = Arc::new(NotificationsService::new(
+        state.db.clone(),
+        state.redis.clone(),
+    ));
+    let read_only = state.config.current().region.read_only;
+    let _ = notifications
+        .record_ws_activity(user_uuid, device_id, read_only)
+        .await;
+
     // Subscribe to Redis for this user
     let redis_client = state.redis.clone();
     let user_id_clone = user_id.clone();
     let tx_clone = tx.clone();
+    let filter_clone = filter.clone();
 
     let redis_task = tokio::spawn(async move {
         if let Ok(mut pubsub) = redis_client.subscribe_messages(&user_id_clone).await {
             while let Some(msg) = pubsub.on_message().next().await {
                 if let Ok(payload) = msg.get_payload::<String>() {
                     if let Ok(ws_msg) = serde_json::from_str::<WsOutgoingMessage>(&payload) {
-                        let _ = tx_clone.send(ws_msg).await;
+                        if allows(&filter_clone, &ws_msg) {
+                            let _ = tx_clone.send(ws_msg).await;
+                        }
                     }
                 }
             }
@@ -156,14 +387,34 @@ async fn handle_socket(socket: WebSocket, state: AppState, user_id: String, devi
     let hub = state.ws_hub.clone();
     let redis = state.redis.clone();
     let user_id_for_recv = user_id.clone();
+    let notifications_for_recv = notifications.clone();
+    let config_for_recv = state.config.clone();
+    let tx_for_recv = tx.clone();
 
     let recv_task = tokio::spawn(async move {
+        let mut last_activity = Instant::now();
         while let Some(result) = ws_receiver.next().await {
+            if last_activity.elapsed() >= ACTIVITY_REFRESH_INTERVAL {
+                let read_only = config_for_recv.current().region.read_only;
+                let _ = notifications_for_recv
+                    .record_ws_activity(user_uuid, device_id, read_only)
+                    .await;
+                last_activity = Instant::now();
+            }
+
             match result {
                 Ok(Message::Text(text)) => {
                     if let Ok(msg) = serde_json::from_str::<WsIncomingMessage>(&text) {
-                        handle_incoming_message(&hub, &redis, &user_id_for_recv, device_id, msg)
-                            .await;
+                        handle_incoming_message(
+                            &hub,
+                            &redis,
+                            &user_id_for_recv,
+                            device_id,
+                            &tx_for_recv,
+                            &filter,
+                            msg,
+                        )
+                        .await;
                     }
                 }
                 Ok(Message::Ping(data)) => {
@@ -185,7 +436,8 @@ async fn handle_socket(socket: WebSocket, state: AppState, user_id: String, devi
     }
 
     // Cleanup
-    state.ws_hub.unregister(&client_id).await;
+    state.ws_hub.unregister(&user_id, &device_key, &tx).await;
+    let _ = notifications.clear_ws_activity(user_uuid, device_id).await;
 
     // Set user presence to offline
     let _ = state
@@ -199,37 +451,59 @@ async fn handle_incoming_message(
     redis: &RedisClient,
     user_id: &str,
     _device_id: i32,
+    tx: &mpsc::Sender<WsOutgoingMessage>,
+    filter: &ConnectionFilter,
     msg: WsIncomingMessage,
 ) {
     match msg.msg_type.as_str() {
-        "ping" => {
+        WS_PING => {
             // Respond with pong
             let pong = WsOutgoingMessage {
-                msg_type: "pong".to_string(),
+                msg_type: WS_PONG.to_string(),
                 payload: serde_json::json!({}),
             };
             hub.send_to_user(user_id, pong).await;
         }
-        "typing" => {
+        WS_TYPING => {
             // Forward typing indicator to conversation participants
-            // This would need conversation_id from payload
-            if let Some(conversation_id) = msg.payload.get("conversation_id") {
+            if let Ok(update) = serde_json::from_value::<TypingUpdate>(msg.payload) {
                 tracing::debug!(
                     "User {} typing in conversation {}",
                     user_id,
-                    conversation_id
+                    update.conversation_id
                 );
             }
         }
-        "presence" => {
+        WS_PRESENCE => {
             // Update user presence
-            if let Some(status) = msg.payload.get("status").and_then(|s| s.as_str()) {
+            if let Ok(update) = serde_json::from_value::<PresenceUpdate>(msg.payload) {
                 let _ = redis
-                    .set_user_presence(user_id, status, Duration::from_secs(300))
+                    .set_user_presence(user_id, &update.status, Duration::from_secs(300))
                     .await;
             }
         }
-        "ack" => {
+        WS_FILTER => {
+            // Replace this connection's filter; a malformed or oversized one
+            // is ignored, and either way the client is told what applies
+            match serde_json::from_value::<EventFilter>(msg.payload) {
+                Ok(update)
+                    if update.types.as_ref().map_or(0, Vec::len) <= MAX_FILTER_TYPES
+                        && update.conversation_ids.as_ref().map_or(0, Vec::len)
+                            <= MAX_FILTER_CONVERSATIONS =>
+                {
+                    *filter.lock().unwrap() = update;
+                }
+                _ => tracing::warn!("User {} sent an invalid event filter", user_id),
+            }
+
+            let current = filter.lock().unwrap().clone();
+            let reply = WsOutgoingMessage {
+                msg_type: WS_FILTER.to_string(),
+                payload: serde_json::to_value(current).unwrap_or_default(),
+            };
+            let _ = tx.send(reply).await;
+        }
+        WS_ACK => {
             // Handle message acknowledgment
             tracing::debug!("User {} ack: {:?}", user_id, msg.payload);
         }
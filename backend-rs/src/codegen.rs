@@ -0,0 +1,221 @@
+//! `server codegen`: write the TypeScript types of the client API into the
+//! SDK (`sdk/typescript/src/generated`, or the directory given after
+//! `codegen`). Types come straight from the request and response structs,
+//! so the web client can't drift from them. Realtime events are written as
+//! `ServerEvent` and `ClientEvent` unions keyed by their `type`.
+
+use std::{fs, path::Path};
+
+use anyhow::Context;
+use ts_rs::TS;
+
+use crate::{
+    api::handlers::{auth, contacts, conversations},
+    error::ErrorCode,
+    models::{
+        AttachmentProcessedEvent, ContactWithUser, ConversationNote, ConversationState,
+        ConversationWithDetails, DeviceWithRouting, EventFilter, EventReminderEvent,
+        FederatedMessage, Impersonation, Message, MessageRequestAcceptedEvent, PresenceUpdate,
+        SessionAnomalyEvent, SuggestionsEvent, Task, TypingEvent, TypingUpdate, User, WS_ACK,
+        WS_ATTACHMENT_PROCESSED, WS_CONVERSATION_STATE, WS_EVENT_REMINDER, WS_FEDERATED_MESSAGE,
+        WS_FILTER, WS_IMPERSONATION_REQUESTED, WS_IMPERSONATION_STARTED,
+        WS_MESSAGE_REQUEST_ACCEPTED, WS_NEW_MESSAGE, WS_NOTE_UPDATED, WS_PING, WS_PONG,
+        WS_PRESENCE, WS_SESSION_ANOMALY, WS_SUGGESTIONS, WS_TASK_UPDATED, WS_TYPING,
+    },
+};
+
+const DEFAULT_OUT_DIR: &str = "../sdk/typescript/src/generated";
+const HEADER: &str = "// Generated by `server codegen`. Do not edit.\n";
+
+/// An event's payload, as written into the union
+enum Payload {
+    Type(String),
+    /// `{}`
+    Empty,
+    /// Whatever the client sends; the server only logs it
+    Unknown,
+}
+
+impl Payload {
+    fn of<T: TS>() -> Self {
+        Payload::Type(T::name())
+    }
+
+    fn ts(&self) -> &str {
+        match self {
+            Payload::Type(name) => name,
+            Payload::Empty => "Record<string, never>",
+            Payload::Unknown => "unknown",
+        }
+    }
+}
+
+fn server_events() -> Vec<(&'static str, Payload)> {
+    vec![
+        (WS_NEW_MESSAGE, Payload::of::<Message>()),
+        (WS_TYPING, Payload::of::<TypingEvent>()),
+        (WS_CONVERSATION_STATE, Payload::of::<ConversationState>()),
+        (
+            WS_MESSAGE_REQUEST_ACCEPTED,
+            Payload::of::<MessageRequestAcceptedEvent>(),
+        ),
+        (
+            WS_ATTACHMENT_PROCESSED,
+            Payload::of::<AttachmentProcessedEvent>(),
+        ),
+        (WS_FEDERATED_MESSAGE, Payload::of::<FederatedMessage>()),
+        (WS_IMPERSONATION_REQUESTED, Payload::of::<Impersonation>()),
+        (WS_IMPERSONATION_STARTED, Payload::of::<Impersonation>()),
+        (WS_SUGGESTIONS, Payload::of::<SuggestionsEvent>()),
+        (WS_SESSION_ANOMALY, Payload::of::<SessionAnomalyEvent>()),
+        (WS_EVENT_REMINDER, Payload::of::<EventReminderEvent>()),
+        (WS_NOTE_UPDATED, Payload::of::<ConversationNote>()),
+        (WS_TASK_UPDATED, Payload::of::<Task>()),
+        (WS_PONG, Payload::Empty),
+        (WS_FILTER, Payload::of::<EventFilter>()),
+    ]
+}
+
+fn client_events() -> Vec<(&'static str, Payload)> {
+    vec![
+        (WS_PING, Payload::Empty),
+        (WS_TYPING, Payload::of::<TypingUpdate>()),
+        (WS_PRESENCE, Payload::of::<PresenceUpdate>()),
+        (WS_ACK, Payload::Unknown),
+        (WS_FILTER, Payload::of::<EventFilter>()),
+    ]
+}
+
+pub fn run(dir: Option<&str>) -> anyhow::Result<()> {
+    let out_dir = Path::new(dir.unwrap_or(DEFAULT_OUT_DIR));
+    fs::create_dir_all(out_dir)
+        .with_context(|| format!("Failed to create {}", out_dir.display()))?;
+
+    // Types that were renamed or dropped must not linger
+    for entry in fs::read_dir(out_dir)? {
+        let path = entry?.path();
+        if path.extension().is_some_and(|ext| ext == "ts") {
+            fs::remove_file(&path)?;
+        }
+    }
+
+    // Auth
+    export::<auth::SendOtpRequest>(out_dir)?;
+    export::<auth::VerifyOtpRequest>(out_dir)?;
+    export::<auth::VerifyResponse>(out_dir)?;
+    export::<auth::RegisterRequest>(out_dir)?;
+    export::<auth::LoginRequest>(out_dir)?;
+    export::<auth::RefreshRequest>(out_dir)?;
+    export::<auth::AuthResponse>(out_dir)?;
+    export::<auth::TokenResponse>(out_dir)?;
+    export::<auth::MessageResponse>(out_dir)?;
+
+    // Errors
+    export::<ErrorCode>(out_dir)?;
+
+    // Users, contacts and devices
+    export::<User>(out_dir)?;
+    export::<ContactWithUser>(out_dir)?;
+    export::<contacts::AddContactRequest>(out_dir)?;
+    export::<contacts::UpdateContactRequest>(out_dir)?;
+    export::<DeviceWithRouting>(out_dir)?;
+
+    // Conversations and messages
+    export::<ConversationWithDetails>(out_dir)?;
+    export::<conversations::CreateDirectRequest>(out_dir)?;
+    export::<conversations::CreateGroupRequest>(out_dir)?;
+    export::<conversations::CloneGroupRequest>(out_dir)?;
+    export::<conversations::SendMessageRequest>(out_dir)?;
+    export::<conversations::TypingRequest>(out_dir)?;
+    export::<Message>(out_dir)?;
+
+    // Realtime payloads
+    export::<TypingEvent>(out_dir)?;
+    export::<ConversationState>(out_dir)?;
+    export::<MessageRequestAcceptedEvent>(out_dir)?;
+    export::<AttachmentProcessedEvent>(out_dir)?;
+    export::<FederatedMessage>(out_dir)?;
+    export::<Impersonation>(out_dir)?;
+    export::<SuggestionsEvent>(out_dir)?;
+    export::<SessionAnomalyEvent>(out_dir)?;
+    export::<EventReminderEvent>(out_dir)?;
+    export::<ConversationNote>(out_dir)?;
+    export::<Task>(out_dir)?;
+    export::<TypingUpdate>(out_dir)?;
+    export::<PresenceUpdate>(out_dir)?;
+    export::<EventFilter>(out_dir)?;
+
+    fs::write(out_dir.join("events.ts"), events_module())?;
+    fs::write(out_dir.join("index.ts"), index_module(out_dir)?)?;
+
+    println!("Wrote TypeScript types to {}", out_dir.display());
+    Ok(())
+}
+
+fn export<T: TS + 'static>(out_dir: &Path) -> anyhow::Result<()> {
+    T::export_all_to(out_dir).with_context(|| format!("Failed to export {}", T::name()))
+}
+
+fn events_module() -> String {
+    let server = server_events();
+    let client = client_events();
+
+    let mut imports: Vec<&str> = server
+        .iter()
+        .chain(client.iter())
+        .filter_map(|(_, payload)| match payload {
+            Payload::Type(name) => Some(name.as_str()),
+            _ => None,
+        })
+        .collect();
+    imports.sort_unstable();
+    imports.dedup();
+
+    let mut out = String::from(HEADER);
+    for name in imports {
+        out.push_str(&format!(
+            "import type {{ {} }} from \"./{}\";\n",
+            name, name
+        ));
+    }
+
+    for (union, events) in [("ServerEvent", &server), ("ClientEvent", &client)] {
+        let variants: Vec<String> = events
+            .iter()
+            .map(|(event_type, payload)| {
+                format!(
+                    "  | {{ type: \"{}\"; payload: {} }}",
+                    event_type,
+                    payload.ts()
+                )
+            })
+            .collect();
+        out.push_str(&format!(
+            "\nexport type {} =\n{};\n",
+            union,
+            variants.join("\n")
+        ));
+    }
+
+    out
+}
+
+/// Re-exports every generated file, dependencies included. Type-only, so
+/// nothing of it is left in the compiled JavaScript.
+fn index_module(out_dir: &Path) -> anyhow::Result<String> {
+    let mut modules: Vec<String> = fs::read_dir(out_dir)?
+        .filter_map(|entry| {
+            let name = entry.ok()?.file_name().into_string().ok()?;
+            let module = name.strip_suffix(".ts")?;
+            (module != "index").then(|| module.to_string())
+        })
+        .collect();
+    modules.sort_unstable();
+
+    let mut out = String::from(HEADER);
+    for module in modules {
+        out.push_str(&format!("export type * from \"./{}\";\n", module));
+    }
+
+    Ok(out)
+}
@@ -1,14 +1,56 @@
+use std::collections::HashMap;
 use std::env;
+use std::str::FromStr;
+use std::sync::{Arc, RwLock};
 use std::time::Duration;
 
+use jsonwebtoken::Algorithm;
+
+use crate::models::AnomalySignal;
+use crate::services::jwt_keys::JwtKeySet;
+use crate::services::jwt_secrets::SharedJwtSecret;
+
+const DEFAULT_LOG_FILTER: &str = "ansible_talk_backend=debug,tower_http=debug";
+
+/// JWT secret used when none is configured; refused in production
+pub const DEV_JWT_SECRET: &str = "super-secret-jwt-key-change-in-production";
+
 #[derive(Debug, Clone)]
 pub struct Config {
     pub server: ServerConfig,
+    pub tls: TlsConfig,
     pub database: DatabaseConfig,
     pub redis: RedisConfig,
     pub minio: MinioConfig,
     pub jwt: JwtConfig,
+    pub dpop: DpopConfig,
+    pub session_anomaly: SessionAnomalyConfig,
     pub otp: OtpConfig,
+    pub otp_delivery: OtpDeliveryConfig,
+    pub phone: PhoneConfig,
+    pub email: EmailConfig,
+    pub abuse: AbuseConfig,
+    pub lockout: LockoutConfig,
+    pub backup: BackupConfig,
+    pub storage: StorageConfig,
+    pub downloads: DownloadsConfig,
+    pub transcode: TranscodeConfig,
+    pub jobs: JobsConfig,
+    pub breaker: BreakerConfig,
+    pub startup: StartupConfig,
+    pub region: RegionConfig,
+    pub archive: ArchiveConfig,
+    pub account_purge: AccountPurgeConfig,
+    pub guest: GuestConfig,
+    pub calendar: CalendarConfig,
+    pub payments: PaymentsConfig,
+    pub translation: TranslationConfig,
+    pub suggestions: SuggestionsConfig,
+    pub limits: LimitsConfig,
+    pub realtime: RealtimeConfig,
+    pub access_tokens: AccessTokenConfig,
+    pub federation: FederationConfig,
+    pub secrets: SecretsConfig,
 }
 
 #[derive(Debug, Clone)]
@@ -16,6 +58,33 @@ pub struct ServerConfig {
     pub host: String,
     pub port: u16,
     pub environment: String,
+    pub log_level: String,
+    pub metrics_enabled: bool,
+    /// Bearer token scrapers send to `/metrics`; required with
+    /// `metrics_enabled`
+    pub metrics_token: Option<String>,
+    pub min_client_version: Option<String>,
+    pub v1_sunset: Option<String>,
+}
+
+/// Native TLS for deployments without a reverse proxy. Static certificates
+/// take TLS_CERT_PATH/TLS_KEY_PATH; TLS_ACME_DOMAINS obtains and renews
+/// certificates from Let's Encrypt instead.
+#[derive(Debug, Clone)]
+pub struct TlsConfig {
+    pub cert_path: Option<String>,
+    pub key_path: Option<String>,
+    pub acme_domains: Vec<String>,
+    pub acme_contact: Option<String>,
+    pub acme_cache_dir: String,
+    pub acme_staging: bool,
+    pub redirect_port: Option<u16>,
+}
+
+impl TlsConfig {
+    pub fn enabled(&self) -> bool {
+        !self.acme_domains.is_empty() || (self.cert_path.is_some() && self.key_path.is_some())
+    }
 }
 
 #[derive(Debug, Clone)]
@@ -27,6 +96,8 @@ pub struct DatabaseConfig {
     pub database: String,
     pub ssl_mode: String,
     pub max_connections: u32,
+    /// Monthly partitions of the messages table to keep created ahead of time
+    pub message_partitions_ahead: u32,
 }
 
 #[derive(Debug, Clone)]
@@ -47,17 +118,141 @@ pub struct MinioConfig {
     pub stickers_bucket: String,
     pub avatars_bucket: String,
     pub attachments_bucket: String,
+    pub exports_bucket: String,
+    pub backups_bucket: String,
+    pub archives_bucket: String,
     pub public_url: Option<String>,
+    pub presigned_url_ttl: Duration,
+    pub url_mode: FileUrlMode,
+    pub cdn_url: Option<String>,
+    pub cdn_signing_key: Option<String>,
+    pub cache_control: String,
+    /// Lifecycle rules `ensure_buckets` sets, in days; 0 leaves a rule out
+    pub abort_multipart_days: i32,
+    pub imports_expire_days: i32,
+    pub attachment_transition_days: i32,
+    /// Storage class old attachments move to, where the backend has it
+    pub attachment_storage_class: String,
+}
+
+/// How file URLs handed to clients are built
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FileUrlMode {
+    /// Unsigned URLs on MINIO_PUBLIC_URL (or the MinIO endpoint)
+    Public,
+    /// S3 presigned URLs straight from MinIO
+    Presigned,
+    /// HMAC-signed URLs on CDN_URL, verified at the CDN edge
+    SignedCdn,
+}
+
+impl FileUrlMode {
+    fn parse(value: &str) -> Option<Self> {
+        match value.to_lowercase().as_str() {
+            "public" => Some(Self::Public),
+            "presigned" => Some(Self::Presigned),
+            "signed_cdn" | "cdn" => Some(Self::SignedCdn),
+            _ => None,
+        }
+    }
 }
 
 #[derive(Debug, Clone)]
 pub struct JwtConfig {
     pub secret: String,
+    /// HS256 secrets shared between replicas, oldest first; filled in by
+    /// `JwtSecretsService::sync`
+    pub shared_secrets: Vec<SharedJwtSecret>,
+    /// HS256 (shared secret), RS256 or EdDSA
+    pub algorithm: Algorithm,
+    /// Key that signs new tokens (RS256/EdDSA)
+    pub signing_kid: Option<String>,
+    /// Directory of `<kid>.pem` / `<kid>.pub.pem` key files (RS256/EdDSA)
+    pub keys_dir: Option<String>,
+    /// Loaded keys; filled in by `load_keys`
+    pub keys: Arc<JwtKeySet>,
     pub access_token_ttl: Duration,
     pub refresh_token_ttl: Duration,
     pub issuer: String,
 }
 
+/// How strictly tokens must be bound to a device key with DPoP proofs
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DpopEnforcement {
+    /// Proofs are ignored and no tokens are bound
+    Off,
+    /// Tokens are bound when the client sends a proof at login; bound
+    /// tokens then need a proof on every request
+    Optional,
+    /// Login requires a proof and unbound tokens are rejected
+    Required,
+}
+
+impl DpopEnforcement {
+    fn parse(value: &str) -> Option<Self> {
+        match value.to_lowercase().as_str() {
+            "off" => Some(Self::Off),
+            "optional" => Some(Self::Optional),
+            "required" => Some(Self::Required),
+            _ => None,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Off => "off",
+            Self::Optional => "optional",
+            Self::Required => "required",
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct DpopConfig {
+    pub enforcement: DpopEnforcement,
+    /// How far a proof's `iat` may be from the server clock
+    pub max_proof_age: Duration,
+}
+
+/// What happens when a session token is used from an unusual network,
+/// country or client
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum SessionAnomalyAction {
+    /// Token use isn't checked
+    Off,
+    /// The user is told and the request goes through
+    Notify,
+    /// The user is told and the session ends; the device has to log in
+    /// again with an OTP
+    StepUp,
+}
+
+impl SessionAnomalyAction {
+    fn parse(value: &str) -> Option<Self> {
+        match value.to_lowercase().as_str() {
+            "off" => Some(Self::Off),
+            "notify" => Some(Self::Notify),
+            "step_up" => Some(Self::StepUp),
+            _ => None,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Off => "off",
+            Self::Notify => "notify",
+            Self::StepUp => "step_up",
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct SessionAnomalyConfig {
+    pub action: SessionAnomalyAction,
+    /// What token use is compared on against the session's history
+    pub signals: Vec<AnomalySignal>,
+}
+
 #[derive(Debug, Clone)]
 pub struct OtpConfig {
     pub length: usize,
@@ -65,6 +260,387 @@ pub struct OtpConfig {
     pub max_attempts: u32,
 }
 
+/// SMS (Twilio) and email (SendGrid) providers for OTP codes. Without
+/// credentials for a channel, codes on it are only logged (development).
+#[derive(Debug, Clone)]
+pub struct OtpDeliveryConfig {
+    /// Product name filled into OTP message templates
+    pub app_name: String,
+    pub twilio_account_sid: Option<String>,
+    pub twilio_auth_token: Option<String>,
+    pub twilio_from_number: Option<String>,
+    pub sendgrid_api_key: Option<String>,
+    pub sendgrid_from_email: Option<String>,
+    /// Public base URL providers call back on, e.g. `https://chat.example.com`
+    pub webhook_base_url: Option<String>,
+    /// Shared secret providers must pass as `?token=` on callbacks
+    pub webhook_token: Option<String>,
+    /// Plain, unauthenticated SMTP server for email OTPs when SendGrid isn't
+    /// configured, e.g. MailHog. Ignored in production.
+    pub smtp_host: Option<String>,
+    pub smtp_port: u16,
+}
+
+impl OtpDeliveryConfig {
+    pub fn sms_enabled(&self) -> bool {
+        self.twilio_account_sid.is_some()
+            && self.twilio_auth_token.is_some()
+            && self.twilio_from_number.is_some()
+    }
+
+    pub fn email_enabled(&self) -> bool {
+        self.sendgrid_api_key.is_some() && self.sendgrid_from_email.is_some()
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct PhoneConfig {
+    /// ISO 3166 region (e.g. `US`) for numbers entered without a `+`
+    /// country code
+    pub default_region: Option<String>,
+}
+
+#[derive(Debug, Clone)]
+pub struct EmailConfig {
+    /// Refuse domains that can't receive mail
+    pub mx_check: bool,
+    /// When set, registering without a phone number needs an email in one of
+    /// these domains (or their subdomains)
+    pub registration_domains: Vec<String>,
+}
+
+#[derive(Debug, Clone)]
+pub struct AbuseConfig {
+    /// Header the reverse proxy puts the client address in (e.g.
+    /// `X-Forwarded-For`, first entry wins); the peer address otherwise
+    pub client_ip_header: Option<String>,
+    /// Header the proxy or CDN puts the client's ASN in, for ASN blocks
+    pub client_asn_header: Option<String>,
+    /// Header the proxy or CDN puts the client's country in (e.g.
+    /// `CF-IPCountry`), for session anomaly checks
+    pub client_country_header: Option<String>,
+}
+
+/// Brute-force protection for login, OTP verification and token refresh.
+/// Failures are counted per target (phone number, email or account) and
+/// per client IP over `window`.
+#[derive(Debug, Clone)]
+pub struct LockoutConfig {
+    /// Failures allowed before each further attempt has to wait, starting
+    /// at a second and doubling up to `max_delay`
+    pub free_attempts: u32,
+    pub max_delay: Duration,
+    /// Failures that lock a target, or an IP, out for `duration`
+    pub target_threshold: u32,
+    pub ip_threshold: u32,
+    pub window: Duration,
+    pub duration: Duration,
+}
+
+#[derive(Debug, Clone)]
+pub struct BackupConfig {
+    pub max_size: usize,
+    pub max_generations: i64,
+}
+
+/// Download quotas and scraping detection for attachment URLs, counted per
+/// user and per client IP over `window`
+#[derive(Debug, Clone)]
+pub struct DownloadsConfig {
+    /// Attachment bytes a user, or an IP, can fetch per window; 0 for no limit
+    pub user_bytes: i64,
+    pub ip_bytes: i64,
+    /// Distinct attachments, or lookups of attachments that don't exist,
+    /// per window that block a user or IP for `block_duration`
+    pub max_objects: i64,
+    pub max_misses: i64,
+    pub window: Duration,
+    pub block_duration: Duration,
+}
+
+#[derive(Debug, Clone)]
+pub struct StorageConfig {
+    pub user_quota: i64,
+    pub max_attachment_size: usize,
+    /// Delete attachment objects once every recipient device has downloaded
+    /// them
+    pub delete_after_download: bool,
+    /// With `delete_after_download`, days to wait for devices that never
+    /// download before deleting anyway; 0 waits forever
+    pub undelivered_retention_days: u32,
+}
+
+#[derive(Debug, Clone)]
+pub struct TranscodeConfig {
+    /// Transcodes run at once per process; 0 leaves attachments pending
+    pub workers: usize,
+    pub ffmpeg_path: String,
+}
+
+#[derive(Debug, Clone)]
+pub struct JobsConfig {
+    pub workers: usize,
+    pub max_attempts: u32,
+    pub retry_base_delay: Duration,
+    pub poll_interval: Duration,
+}
+
+/// Circuit breakers around SMS, email and object storage
+#[derive(Debug, Clone)]
+pub struct BreakerConfig {
+    /// Consecutive failures that open a breaker
+    pub failure_threshold: u32,
+    /// How long an open breaker fails fast before letting a trial call through
+    pub open_timeout: Duration,
+}
+
+/// Waiting for dependencies at boot
+#[derive(Debug, Clone)]
+pub struct StartupConfig {
+    /// Tries to reach PostgreSQL, Redis and MinIO before giving up, waiting
+    /// a second, then doubling up to `retry_max_delay`, between tries
+    pub retry_attempts: u32,
+    pub retry_max_delay: Duration,
+    /// Start without media features, rather than exiting, when MinIO still
+    /// can't be reached
+    pub degraded_media: bool,
+}
+
+/// Active-passive deployment across regions. The standby region runs
+/// read-only against a PostgreSQL replica until a failover promotes it.
+#[derive(Debug, Clone)]
+pub struct RegionConfig {
+    /// Namespaces Redis pub/sub channels, so regions sharing a Redis don't
+    /// receive each other's events
+    pub name: Option<String>,
+    /// Refuse writes with 503 `region_read_only`
+    pub read_only: bool,
+    /// Public URL of the region taking writes, handed to refused clients
+    pub leader_url: Option<String>,
+    /// Replication lag past which a standby reports itself unhealthy
+    pub max_replication_lag: Duration,
+}
+
+/// Cold-storage tier for old messages
+#[derive(Debug, Clone)]
+pub struct ArchiveConfig {
+    /// Messages older than this many days move to object storage; 0 keeps
+    /// everything in Postgres
+    pub after_days: u32,
+    /// Messages per archive object
+    pub batch_size: i64,
+    pub interval: Duration,
+}
+
+/// Purging of accounts nobody has signed in to for a long time
+#[derive(Debug, Clone)]
+pub struct AccountPurgeConfig {
+    /// Accounts inactive for this many months are purged; 0 disables the
+    /// purge
+    pub inactive_months: u32,
+    /// Days before the purge on which a warning email goes out
+    pub warning_days: Vec<u32>,
+    pub interval: Duration,
+    /// Accounts looked at per pass
+    pub batch_size: i64,
+}
+
+/// Anonymous guest sessions started from website chat widgets
+#[derive(Debug, Clone)]
+pub struct GuestConfig {
+    /// How long a guest session lasts; its token can't be refreshed
+    pub session_ttl: Duration,
+    /// Live sessions one widget token may have at a time
+    pub max_active_per_widget: i64,
+    /// Sessions one client IP address may start per hour
+    pub max_sessions_per_ip: i64,
+    /// How often expired sessions are closed
+    pub cleanup_interval: Duration,
+}
+
+/// Group calendar events
+#[derive(Debug, Clone)]
+pub struct CalendarConfig {
+    /// How often due event reminders are sent
+    pub reminder_interval: Duration,
+}
+
+/// Payment requests in conversations. The server only tracks their state;
+/// a payment provider can follow along through the webhook.
+#[derive(Debug, Clone)]
+pub struct PaymentsConfig {
+    /// Receives every new payment request and status change; unset sends
+    /// nothing
+    pub webhook_url: Option<String>,
+    /// Signs webhook bodies (`X-Payment-Signature`)
+    pub webhook_secret: Option<String>,
+}
+
+impl PaymentsConfig {
+    pub fn webhook_enabled(&self) -> bool {
+        self.webhook_url.is_some()
+    }
+}
+
+/// Opt-in relay to a translation provider, using the client's own key
+#[derive(Debug, Clone)]
+pub struct TranslationConfig {
+    pub enabled: bool,
+    /// Requests per user per minute
+    pub rate_limit: i64,
+    /// Longest text accepted, in characters
+    pub max_length: usize,
+}
+
+/// Optional smart-reply sidecar. It is sent message metadata, never
+/// content, and answers with quick actions for the recipients.
+#[derive(Debug, Clone)]
+pub struct SuggestionsConfig {
+    /// Sidecar endpoint; unset disables suggestions
+    pub url: Option<String>,
+    /// How long to wait for the sidecar before dropping the suggestions
+    pub timeout: Duration,
+}
+
+impl SuggestionsConfig {
+    pub fn enabled(&self) -> bool {
+        self.url.is_some()
+    }
+}
+
+/// Where credentials come from. With a secrets manager, the secret holds a
+/// JSON object keyed by env var name (`JWT_SECRET`, `DB_PASSWORD`, ...);
+/// keys it provides replace the env values.
+#[derive(Debug, Clone)]
+pub struct SecretsConfig {
+    pub backend: SecretsBackend,
+    pub refresh_interval: Duration,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SecretsBackend {
+    /// Plain environment variables
+    Env,
+    /// HashiCorp Vault KV (v1 or v2) read with a token
+    Vault {
+        addr: String,
+        token: String,
+        path: String,
+    },
+    /// AWS Secrets Manager, using the default AWS credential chain
+    Aws { secret_id: String },
+}
+
+impl SecretsBackend {
+    fn from_env() -> Self {
+        match env::var("SECRETS_BACKEND").unwrap_or_default().to_lowercase().as_str() {
+            "vault" => Self::Vault {
+                addr: env::var("VAULT_ADDR")
+                    .unwrap_or_else(|_| "http://localhost:8200".to_string()),
+                token: env::var("VAULT_TOKEN").unwrap_or_default(),
+                path: env::var("VAULT_SECRET_PATH")
+                    .unwrap_or_else(|_| "secret/data/ansible-talk".to_string()),
+            },
+            "aws" => Self::Aws {
+                secret_id: env::var("AWS_SECRET_ID").unwrap_or_else(|_| "ansible-talk".to_string()),
+            },
+            _ => Self::Env,
+        }
+    }
+}
+
+/// Global defaults; admins can override them per user
+#[derive(Debug, Clone)]
+pub struct LimitsConfig {
+    pub max_group_members: i64,
+    pub max_conversations: i64,
+    pub max_devices: i64,
+}
+
+/// Per-user caps on realtime connections held by one server, so a single
+/// account can't multiply Redis pub/sub traffic
+#[derive(Debug, Clone)]
+pub struct RealtimeConfig {
+    pub max_connections_per_user: usize,
+    pub max_connections_per_device: usize,
+    /// Redis subscriptions across WebSockets, SSE streams and long polls
+    pub max_subscriptions_per_user: usize,
+}
+
+/// Personal access tokens for third-party clients
+#[derive(Debug, Clone)]
+pub struct AccessTokenConfig {
+    pub max_per_user: i64,
+    /// Requests per minute for tokens created without a limit
+    pub default_rate_limit: i64,
+    /// Highest per-token limit a user may ask for
+    pub max_rate_limit: i64,
+}
+
+/// Experimental server-to-server relay of messages addressed to
+/// `username@otherdomain`
+#[derive(Debug, Clone)]
+pub struct FederationConfig {
+    pub enabled: bool,
+    /// This server's domain; local users are addressed as `username@domain`
+    pub domain: String,
+    /// Directory of Ed25519 `<kid>.pem` / `<kid>.pub.pem` envelope keys
+    pub keys_dir: Option<String>,
+    /// Key that signs outgoing envelopes
+    pub signing_kid: Option<String>,
+    /// Loaded keys; filled in by `load_keys`
+    pub keys: Arc<JwtKeySet>,
+    /// When non-empty, the only domains to federate with
+    pub allowed_domains: Vec<String>,
+    /// Domains never to federate with; wins over `allowed_domains`
+    pub denied_domains: Vec<String>,
+    /// How long a signed envelope stays valid
+    pub envelope_ttl: Duration,
+    /// Inbox requests allowed per minute from one address
+    pub inbox_rate_limit: i64,
+}
+
+impl FederationConfig {
+    /// Whether `domain` may send to or receive from this server
+    pub fn allows(&self, domain: &str) -> bool {
+        let domain = domain.to_lowercase();
+        !self.denied_domains.contains(&domain)
+            && (self.allowed_domains.is_empty() || self.allowed_domains.contains(&domain))
+    }
+
+    /// Load envelope keys when federation is on
+    pub fn load_keys(&mut self) -> anyhow::Result<()> {
+        if !self.enabled {
+            return Ok(());
+        }
+        if self.domain.is_empty() {
+            anyhow::bail!("FEDERATION_DOMAIN is required when federation is enabled");
+        }
+
+        let dir = self
+            .keys_dir
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("FEDERATION_KEYS_DIR is required"))?;
+        let kid = self
+            .signing_kid
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("FEDERATION_SIGNING_KID is required"))?;
+        self.keys = Arc::new(JwtKeySet::load_dir(Algorithm::EdDSA, dir, kid)?);
+        Ok(())
+    }
+}
+
+fn domain_list(var: &str) -> Vec<String> {
+    env::var(var)
+        .map(|s| {
+            s.split(',')
+                .map(|d| d.trim().to_lowercase())
+                .filter(|d| !d.is_empty())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
 impl Config {
     pub fn load() -> Self {
         dotenvy::dotenv().ok();
@@ -76,7 +652,37 @@ impl Config {
                     .ok()
                     .and_then(|p| p.parse().ok())
                     .unwrap_or(8080),
-                environment: env::var("ENVIRONMENT").unwrap_or_else(|_| "development".to_string()),
+                environment: env::var("ENVIRONMENT").unwrap_or_else(|_| "production".to_string()),
+                log_level: env::var("RUST_LOG").unwrap_or_else(|_| DEFAULT_LOG_FILTER.to_string()),
+                metrics_enabled: env::var("METRICS_ENABLED")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                metrics_token: env::var("METRICS_TOKEN").ok().filter(|s| !s.is_empty()),
+                min_client_version: env::var("MIN_CLIENT_VERSION").ok(),
+                v1_sunset: env::var("API_V1_SUNSET").ok(),
+            },
+            tls: TlsConfig {
+                cert_path: env::var("TLS_CERT_PATH").ok().filter(|s| !s.is_empty()),
+                key_path: env::var("TLS_KEY_PATH").ok().filter(|s| !s.is_empty()),
+                acme_domains: env::var("TLS_ACME_DOMAINS")
+                    .map(|s| {
+                        s.split(',')
+                            .map(|d| d.trim().to_string())
+                            .filter(|d| !d.is_empty())
+                            .collect()
+                    })
+                    .unwrap_or_default(),
+                acme_contact: env::var("TLS_ACME_CONTACT").ok().filter(|s| !s.is_empty()),
+                acme_cache_dir: env::var("TLS_ACME_CACHE_DIR")
+                    .unwrap_or_else(|_| "./acme-cache".to_string()),
+                acme_staging: env::var("TLS_ACME_STAGING")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                redirect_port: env::var("TLS_REDIRECT_PORT")
+                    .ok()
+                    .and_then(|p| p.parse().ok()),
             },
             database: DatabaseConfig {
                 host: env::var("DB_HOST").unwrap_or_else(|_| "localhost".to_string()),
@@ -92,6 +698,10 @@ impl Config {
                     .ok()
                     .and_then(|p| p.parse().ok())
                     .unwrap_or(25),
+                message_partitions_ahead: env::var("MESSAGE_PARTITIONS_AHEAD")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(3),
             },
             redis: RedisConfig {
                 host: env::var("REDIS_HOST").unwrap_or_else(|_| "localhost".to_string()),
@@ -120,11 +730,49 @@ impl Config {
                 stickers_bucket: "stickers".to_string(),
                 avatars_bucket: "avatars".to_string(),
                 attachments_bucket: "attachments".to_string(),
+                exports_bucket: "exports".to_string(),
+                backups_bucket: "backups".to_string(),
+                archives_bucket: "message-archives".to_string(),
                 public_url: env::var("MINIO_PUBLIC_URL").ok(),
+                presigned_url_ttl: Duration::from_secs(
+                    env::var("MINIO_PRESIGNED_URL_TTL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60 * 60), // 1 hour
+                ),
+                url_mode: env::var("FILE_URL_MODE")
+                    .ok()
+                    .and_then(|m| FileUrlMode::parse(&m))
+                    .unwrap_or(FileUrlMode::Public),
+                cdn_url: env::var("CDN_URL").ok(),
+                cdn_signing_key: env::var("CDN_SIGNING_KEY").ok(),
+                cache_control: env::var("MINIO_CACHE_CONTROL")
+                    .unwrap_or_else(|_| "public, max-age=31536000, immutable".to_string()),
+                abort_multipart_days: env::var("STORAGE_ABORT_MULTIPART_DAYS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(1),
+                imports_expire_days: env::var("STORAGE_IMPORTS_EXPIRE_DAYS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(7),
+                attachment_transition_days: env::var("ATTACHMENT_TRANSITION_DAYS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(0),
+                attachment_storage_class: env::var("ATTACHMENT_STORAGE_CLASS")
+                    .unwrap_or_else(|_| "STANDARD_IA".to_string()),
             },
             jwt: JwtConfig {
-                secret: env::var("JWT_SECRET")
-                    .unwrap_or_else(|_| "super-secret-jwt-key-change-in-production".to_string()),
+                secret: env::var("JWT_SECRET").unwrap_or_else(|_| DEV_JWT_SECRET.to_string()),
+                shared_secrets: Vec::new(),
+                algorithm: env::var("JWT_ALGORITHM")
+                    .ok()
+                    .and_then(|a| Algorithm::from_str(&a).ok())
+                    .unwrap_or(Algorithm::HS256),
+                signing_kid: env::var("JWT_SIGNING_KID").ok().filter(|s| !s.is_empty()),
+                keys_dir: env::var("JWT_KEYS_DIR").ok().filter(|s| !s.is_empty()),
+                keys: Arc::default(),
                 access_token_ttl: Duration::from_secs(
                     env::var("JWT_ACCESS_TOKEN_TTL")
                         .ok()
@@ -139,6 +787,33 @@ impl Config {
                 ),
                 issuer: env::var("JWT_ISSUER").unwrap_or_else(|_| "ansible-talk".to_string()),
             },
+            dpop: DpopConfig {
+                enforcement: env::var("DPOP_ENFORCEMENT")
+                    .ok()
+                    .and_then(|e| DpopEnforcement::parse(&e))
+                    .unwrap_or(DpopEnforcement::Optional),
+                max_proof_age: Duration::from_secs(
+                    env::var("DPOP_PROOF_MAX_AGE")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60),
+                ),
+            },
+            session_anomaly: SessionAnomalyConfig {
+                action: env::var("SESSION_ANOMALY_ACTION")
+                    .ok()
+                    .and_then(|a| SessionAnomalyAction::parse(&a))
+                    .unwrap_or(SessionAnomalyAction::Off),
+                signals: env::var("SESSION_ANOMALY_SIGNALS")
+                    .map(|s| s.split(',').filter_map(AnomalySignal::parse).collect())
+                    .unwrap_or_else(|_| {
+                        vec![
+                            AnomalySignal::Network,
+                            AnomalySignal::Country,
+                            AnomalySignal::UserAgent,
+                        ]
+                    }),
+            },
             otp: OtpConfig {
                 length: env::var("OTP_LENGTH")
                     .ok()
@@ -155,9 +830,564 @@ impl Config {
                     .and_then(|p| p.parse().ok())
                     .unwrap_or(3),
             },
+            otp_delivery: OtpDeliveryConfig {
+                app_name: env::var("APP_NAME").unwrap_or_else(|_| "Ansible Talk".to_string()),
+                twilio_account_sid: env::var("TWILIO_ACCOUNT_SID").ok().filter(|s| !s.is_empty()),
+                twilio_auth_token: env::var("TWILIO_AUTH_TOKEN").ok().filter(|s| !s.is_empty()),
+                twilio_from_number: env::var("TWILIO_FROM_NUMBER").ok().filter(|s| !s.is_empty()),
+                sendgrid_api_key: env::var("SENDGRID_API_KEY").ok().filter(|s| !s.is_empty()),
+                sendgrid_from_email: env::var("SENDGRID_FROM_EMAIL")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+                webhook_base_url: env::var("OTP_WEBHOOK_BASE_URL")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+                webhook_token: env::var("OTP_WEBHOOK_TOKEN").ok().filter(|s| !s.is_empty()),
+                smtp_host: env::var("SMTP_HOST").ok().filter(|s| !s.is_empty()),
+                smtp_port: env::var("SMTP_PORT")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(1025),
+            },
+            phone: PhoneConfig {
+                default_region: env::var("PHONE_DEFAULT_REGION")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+            },
+            email: EmailConfig {
+                mx_check: env::var("EMAIL_MX_CHECK")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(true),
+                registration_domains: env::var("REGISTRATION_EMAIL_DOMAINS")
+                    .map(|s| {
+                        s.split(',')
+                            .map(|d| d.trim().to_lowercase())
+                            .filter(|d| !d.is_empty())
+                            .collect()
+                    })
+                    .unwrap_or_default(),
+            },
+            abuse: AbuseConfig {
+                client_ip_header: env::var("CLIENT_IP_HEADER")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+                client_asn_header: env::var("CLIENT_ASN_HEADER")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+                client_country_header: env::var("CLIENT_COUNTRY_HEADER")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+            },
+            lockout: LockoutConfig {
+                free_attempts: env::var("LOGIN_FREE_ATTEMPTS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(3),
+                max_delay: Duration::from_secs(
+                    env::var("LOGIN_MAX_DELAY")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60),
+                ),
+                target_threshold: env::var("LOGIN_LOCKOUT_THRESHOLD")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(10),
+                ip_threshold: env::var("LOGIN_IP_LOCKOUT_THRESHOLD")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(50),
+                window: Duration::from_secs(
+                    env::var("LOGIN_FAILURE_WINDOW")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(15 * 60), // 15 minutes
+                ),
+                duration: Duration::from_secs(
+                    env::var("LOGIN_LOCKOUT_DURATION")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(15 * 60), // 15 minutes
+                ),
+            },
+            backup: BackupConfig {
+                max_size: env::var("BACKUP_MAX_SIZE")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(50 * 1024 * 1024), // 50 MB
+                max_generations: env::var("BACKUP_MAX_GENERATIONS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(3),
+            },
+            storage: StorageConfig {
+                user_quota: env::var("STORAGE_USER_QUOTA")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(1024 * 1024 * 1024), // 1 GB
+                max_attachment_size: env::var("ATTACHMENT_MAX_SIZE")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(100 * 1024 * 1024), // 100 MB
+                delete_after_download: env::var("ATTACHMENT_DELETE_AFTER_DOWNLOAD")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                undelivered_retention_days: env::var("ATTACHMENT_UNDELIVERED_RETENTION_DAYS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(30),
+            },
+            downloads: DownloadsConfig {
+                user_bytes: env::var("DOWNLOAD_USER_BYTES")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(2 * 1024 * 1024 * 1024), // 2 GB
+                ip_bytes: env::var("DOWNLOAD_IP_BYTES")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(10 * 1024 * 1024 * 1024), // 10 GB
+                max_objects: env::var("DOWNLOAD_MAX_OBJECTS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(2000),
+                max_misses: env::var("DOWNLOAD_MAX_MISSES")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(50),
+                window: Duration::from_secs(
+                    env::var("DOWNLOAD_WINDOW")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60 * 60), // 1 hour
+                ),
+                block_duration: Duration::from_secs(
+                    env::var("DOWNLOAD_BLOCK_DURATION")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60 * 60), // 1 hour
+                ),
+            },
+            transcode: TranscodeConfig {
+                workers: env::var("TRANSCODE_WORKERS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(2),
+                ffmpeg_path: env::var("FFMPEG_PATH").unwrap_or_else(|_| "ffmpeg".to_string()),
+            },
+            jobs: JobsConfig {
+                workers: env::var("JOB_WORKERS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(2),
+                max_attempts: env::var("JOB_MAX_ATTEMPTS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(5),
+                retry_base_delay: Duration::from_secs(
+                    env::var("JOB_RETRY_BASE_DELAY")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(10),
+                ),
+                poll_interval: Duration::from_millis(
+                    env::var("JOB_POLL_INTERVAL_MS")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(1000),
+                ),
+            },
+            breaker: BreakerConfig {
+                failure_threshold: env::var("CIRCUIT_BREAKER_FAILURES")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .filter(|&n| n > 0)
+                    .unwrap_or(5),
+                open_timeout: Duration::from_secs(
+                    env::var("CIRCUIT_BREAKER_OPEN_TIMEOUT")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(30),
+                ),
+            },
+            startup: StartupConfig {
+                retry_attempts: env::var("STARTUP_RETRY_ATTEMPTS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .filter(|&n| n > 0)
+                    .unwrap_or(8),
+                retry_max_delay: Duration::from_secs(
+                    env::var("STARTUP_RETRY_MAX_DELAY")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(30),
+                ),
+                degraded_media: env::var("STARTUP_DEGRADED_MEDIA")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(true),
+            },
+            region: RegionConfig {
+                name: env::var("REGION_NAME").ok().filter(|s| !s.is_empty()),
+                read_only: env::var("REGION_READ_ONLY")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                leader_url: env::var("REGION_LEADER_URL").ok().filter(|s| !s.is_empty()),
+                max_replication_lag: Duration::from_secs(
+                    env::var("REGION_MAX_REPLICATION_LAG")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(30),
+                ),
+            },
+            archive: ArchiveConfig {
+                after_days: env::var("ARCHIVE_AFTER_DAYS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(0),
+                batch_size: env::var("ARCHIVE_BATCH_SIZE")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(1000),
+                interval: Duration::from_secs(
+                    env::var("ARCHIVE_INTERVAL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60 * 60), // 1 hour
+                ),
+            },
+            account_purge: AccountPurgeConfig {
+                inactive_months: env::var("ACCOUNT_PURGE_INACTIVE_MONTHS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(0),
+                warning_days: env::var("ACCOUNT_PURGE_WARNING_DAYS")
+                    .map(|s| {
+                        s.split(',')
+                            .filter_map(|d| d.trim().parse().ok())
+                            .collect()
+                    })
+                    .unwrap_or_else(|_| vec![30, 7, 1]),
+                interval: Duration::from_secs(
+                    env::var("ACCOUNT_PURGE_INTERVAL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60 * 60), // 1 hour
+                ),
+                batch_size: env::var("ACCOUNT_PURGE_BATCH_SIZE")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(100),
+            },
+            guest: GuestConfig {
+                session_ttl: Duration::from_secs(
+                    env::var("GUEST_SESSION_TTL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(4 * 60 * 60), // 4 hours
+                ),
+                max_active_per_widget: env::var("GUEST_MAX_ACTIVE_PER_WIDGET")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(200),
+                max_sessions_per_ip: env::var("GUEST_MAX_SESSIONS_PER_IP")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(10),
+                cleanup_interval: Duration::from_secs(
+                    env::var("GUEST_CLEANUP_INTERVAL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(5 * 60), // 5 minutes
+                ),
+            },
+            calendar: CalendarConfig {
+                reminder_interval: Duration::from_secs(
+                    env::var("EVENT_REMINDER_INTERVAL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(60),
+                ),
+            },
+            payments: PaymentsConfig {
+                webhook_url: env::var("PAYMENT_WEBHOOK_URL").ok().filter(|s| !s.is_empty()),
+                webhook_secret: env::var("PAYMENT_WEBHOOK_SECRET")
+                    .ok()
+                    .filter(|s| !s.is_empty()),
+            },
+            translation: TranslationConfig {
+                enabled: env::var("TRANSLATION_ENABLED")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                rate_limit: env::var("TRANSLATION_RATE_LIMIT")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(30),
+                max_length: env::var("TRANSLATION_MAX_LENGTH")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(5000),
+            },
+            suggestions: SuggestionsConfig {
+                url: env::var("SUGGESTIONS_URL").ok().filter(|s| !s.is_empty()),
+                timeout: Duration::from_millis(
+                    env::var("SUGGESTIONS_TIMEOUT_MS")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(2000),
+                ),
+            },
+            limits: LimitsConfig {
+                max_group_members: env::var("GROUP_MAX_MEMBERS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(1000),
+                max_conversations: env::var("USER_MAX_CONVERSATIONS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(10000),
+                max_devices: env::var("USER_MAX_DEVICES")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(5),
+            },
+            realtime: RealtimeConfig {
+                max_connections_per_user: env::var("WS_MAX_CONNECTIONS_PER_USER")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(10),
+                max_connections_per_device: env::var("WS_MAX_CONNECTIONS_PER_DEVICE")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(2),
+                max_subscriptions_per_user: env::var("REALTIME_MAX_SUBSCRIPTIONS_PER_USER")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(16),
+            },
+            access_tokens: AccessTokenConfig {
+                max_per_user: env::var("USER_MAX_ACCESS_TOKENS")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(20),
+                default_rate_limit: env::var("ACCESS_TOKEN_RATE_LIMIT")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(60),
+                max_rate_limit: env::var("ACCESS_TOKEN_MAX_RATE_LIMIT")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(600),
+            },
+            federation: FederationConfig {
+                enabled: env::var("FEDERATION_ENABLED")
+                    .ok()
+                    .and_then(|s| s.parse().ok())
+                    .unwrap_or(false),
+                domain: env::var("FEDERATION_DOMAIN")
+                    .unwrap_or_default()
+                    .trim()
+                    .to_lowercase(),
+                keys_dir: env::var("FEDERATION_KEYS_DIR").ok().filter(|s| !s.is_empty()),
+                signing_kid: env::var("FEDERATION_SIGNING_KID").ok().filter(|s| !s.is_empty()),
+                keys: Arc::default(),
+                allowed_domains: domain_list("FEDERATION_ALLOWED_DOMAINS"),
+                denied_domains: domain_list("FEDERATION_DENIED_DOMAINS"),
+                envelope_ttl: Duration::from_secs(
+                    env::var("FEDERATION_ENVELOPE_TTL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(5 * 60), // 5 minutes
+                ),
+                inbox_rate_limit: env::var("FEDERATION_INBOX_RATE_LIMIT")
+                    .ok()
+                    .and_then(|p| p.parse().ok())
+                    .unwrap_or(120),
+            },
+            secrets: SecretsConfig {
+                backend: SecretsBackend::from_env(),
+                refresh_interval: Duration::from_secs(
+                    env::var("SECRETS_REFRESH_INTERVAL")
+                        .ok()
+                        .and_then(|p| p.parse().ok())
+                        .unwrap_or(5 * 60), // 5 minutes
+                ),
+            },
         }
     }
 
+    /// Overlay credentials fetched from a secrets manager
+    pub fn apply_secrets(&mut self, secrets: &HashMap<String, String>) {
+        if let Some(secret) = secrets.get("JWT_SECRET") {
+            self.jwt.secret = secret.clone();
+        }
+        if let Some(password) = secrets.get("DB_PASSWORD") {
+            self.database.password = password.clone();
+        }
+        if let Some(password) = secrets.get("REDIS_PASSWORD") {
+            self.redis.password = Some(password.clone());
+        }
+        if let Some(key) = secrets.get("MINIO_SECRET_KEY") {
+            self.minio.secret_key = key.clone();
+        }
+        if let Some(key) = secrets.get("CDN_SIGNING_KEY") {
+            self.minio.cdn_signing_key = Some(key.clone());
+        }
+        if let Some(token) = secrets.get("TWILIO_AUTH_TOKEN") {
+            self.otp_delivery.twilio_auth_token = Some(token.clone());
+        }
+        if let Some(key) = secrets.get("SENDGRID_API_KEY") {
+            self.otp_delivery.sendgrid_api_key = Some(key.clone());
+        }
+        if let Some(token) = secrets.get("OTP_WEBHOOK_TOKEN") {
+            self.otp_delivery.webhook_token = Some(token.clone());
+        }
+        if let Some(secret) = secrets.get("PAYMENT_WEBHOOK_SECRET") {
+            self.payments.webhook_secret = Some(secret.clone());
+        }
+    }
+
+    /// Refuse to start production with development credentials
+    pub fn ensure_production_ready(&self) -> Result<(), String> {
+        if self.server.environment != "production" || self.jwt.algorithm != Algorithm::HS256 {
+            return Ok(());
+        }
+
+        if self.jwt.secret == DEV_JWT_SECRET || self.jwt.secret.len() < 32 {
+            return Err(
+                "JWT_SECRET is unset, the development default, or shorter than 32 bytes \
+                 (set ENVIRONMENT=development for local use)"
+                    .to_string(),
+            );
+        }
+
+        Ok(())
+    }
+
+    /// Re-read configuration, letting values in `.env` replace the ones
+    /// loaded at startup
+    pub fn reload() -> Self {
+        dotenvy::dotenv_override().ok();
+        Self::load()
+    }
+
+    /// This config with the hot-reloadable settings taken from `other`.
+    /// Everything else (listeners, database, secrets) needs a restart.
+    pub fn with_reloadable(&self, other: &Config) -> Config {
+        let mut config = self.clone();
+        config.server.log_level = other.server.log_level.clone();
+        config.server.min_client_version = other.server.min_client_version.clone();
+        config.otp = other.otp.clone();
+        config.limits = other.limits.clone();
+        config.realtime = other.realtime.clone();
+        config.jwt.signing_kid = other.jwt.signing_kid.clone();
+        config.dpop = other.dpop.clone();
+        config.session_anomaly = other.session_anomaly.clone();
+        config.access_tokens = other.access_tokens.clone();
+        config.federation.allowed_domains = other.federation.allowed_domains.clone();
+        config.federation.denied_domains = other.federation.denied_domains.clone();
+        config.region.read_only = other.region.read_only;
+        config.region.leader_url = other.region.leader_url.clone();
+        config
+    }
+
+    /// Current values of the hot-reloadable settings, by env var name
+    pub fn reloadable_values(&self) -> Vec<(&'static str, String)> {
+        vec![
+            ("RUST_LOG", self.server.log_level.clone()),
+            (
+                "MIN_CLIENT_VERSION",
+                self.server.min_client_version.clone().unwrap_or_default(),
+            ),
+            ("OTP_LENGTH", self.otp.length.to_string()),
+            ("OTP_TTL", self.otp.ttl.as_secs().to_string()),
+            ("OTP_MAX_ATTEMPTS", self.otp.max_attempts.to_string()),
+            ("GROUP_MAX_MEMBERS", self.limits.max_group_members.to_string()),
+            ("USER_MAX_CONVERSATIONS", self.limits.max_conversations.to_string()),
+            ("USER_MAX_DEVICES", self.limits.max_devices.to_string()),
+            (
+                "WS_MAX_CONNECTIONS_PER_USER",
+                self.realtime.max_connections_per_user.to_string(),
+            ),
+            (
+                "WS_MAX_CONNECTIONS_PER_DEVICE",
+                self.realtime.max_connections_per_device.to_string(),
+            ),
+            (
+                "REALTIME_MAX_SUBSCRIPTIONS_PER_USER",
+                self.realtime.max_subscriptions_per_user.to_string(),
+            ),
+            ("JWT_SIGNING_KID", self.jwt.signing_kid.clone().unwrap_or_default()),
+            ("DPOP_ENFORCEMENT", self.dpop.enforcement.as_str().to_string()),
+            ("DPOP_PROOF_MAX_AGE", self.dpop.max_proof_age.as_secs().to_string()),
+            ("SESSION_ANOMALY_ACTION", self.session_anomaly.action.as_str().to_string()),
+            (
+                "SESSION_ANOMALY_SIGNALS",
+                self.session_anomaly
+                    .signals
+                    .iter()
+                    .map(|s| s.as_str())
+                    .collect::<Vec<_>>()
+                    .join(","),
+            ),
+            ("USER_MAX_ACCESS_TOKENS", self.access_tokens.max_per_user.to_string()),
+            ("ACCESS_TOKEN_RATE_LIMIT", self.access_tokens.default_rate_limit.to_string()),
+            ("ACCESS_TOKEN_MAX_RATE_LIMIT", self.access_tokens.max_rate_limit.to_string()),
+            ("FEDERATION_ALLOWED_DOMAINS", self.federation.allowed_domains.join(",")),
+            ("FEDERATION_DENIED_DOMAINS", self.federation.denied_domains.join(",")),
+            ("REGION_READ_ONLY", self.region.read_only.to_string()),
+            ("REGION_LEADER_URL", self.region.leader_url.clone().unwrap_or_default()),
+        ]
+    }
+
+    /// Sanity-check the hot-reloadable settings before applying them
+    pub fn validate_reloadable(&self) -> Result<(), String> {
+        if !(4..=10).contains(&self.otp.length) {
+            return Err("OTP_LENGTH must be between 4 and 10".to_string());
+        }
+        if self.otp.ttl.is_zero() {
+            return Err("OTP_TTL must be positive".to_string());
+        }
+        if self.otp.max_attempts == 0 {
+            return Err("OTP_MAX_ATTEMPTS must be at least 1".to_string());
+        }
+        if self.dpop.max_proof_age.is_zero() {
+            return Err("DPOP_PROOF_MAX_AGE must be positive".to_string());
+        }
+
+        let limits = [
+            self.limits.max_group_members,
+            self.limits.max_conversations,
+            self.limits.max_devices,
+            self.access_tokens.max_per_user,
+            self.access_tokens.default_rate_limit,
+            self.access_tokens.max_rate_limit,
+        ];
+        if limits.iter().any(|v| *v < 1) {
+            return Err("Limits must be at least 1".to_string());
+        }
+
+        let realtime = [
+            self.realtime.max_connections_per_user,
+            self.realtime.max_connections_per_device,
+            self.realtime.max_subscriptions_per_user,
+        ];
+        if realtime.contains(&0) {
+            return Err("Realtime connection limits must be at least 1".to_string());
+        }
+
+        if self.access_tokens.default_rate_limit > self.access_tokens.max_rate_limit {
+            return Err(
+                "ACCESS_TOKEN_RATE_LIMIT must not exceed ACCESS_TOKEN_MAX_RATE_LIMIT".to_string(),
+            );
+        }
+
+        Ok(())
+    }
+
     pub fn database_url(&self) -> String {
         format!(
             "postgres://{}:{}@{}:{}/{}?sslmode={}",
@@ -183,3 +1413,38 @@ impl Config {
         }
     }
 }
+
+/// Configuration shared by all requests. Handlers take a snapshot with
+/// `current()`; a reload swaps in a new one without touching in-flight
+/// requests.
+#[derive(Debug)]
+pub struct SharedConfig {
+    current: RwLock<Arc<Config>>,
+}
+
+impl SharedConfig {
+    pub fn new(config: Config) -> Self {
+        Self {
+            current: RwLock::new(Arc::new(config)),
+        }
+    }
+
+    pub fn current(&self) -> Arc<Config> {
+        self.current
+            .read()
+            .unwrap_or_else(|e| e.into_inner())
+            .clone()
+    }
+
+    pub fn replace(&self, config: Config) {
+        *self.current.write().unwrap_or_else(|e| e.into_inner()) = Arc::new(config);
+    }
+}
+
+impl JwtConfig {
+    /// (Re)load signing and verification keys from the current settings
+    pub fn load_keys(&mut self) -> anyhow::Result<()> {
+        self.keys = Arc::new(JwtKeySet::load(self)?);
+        Ok(())
+    }
+}
@@ -1,10 +1,17 @@
 use axum::{
-    http::StatusCode,
+    http::{header::RETRY_AFTER, HeaderValue, StatusCode},
     response::{IntoResponse, Response},
     Json,
 };
+use serde::Serialize;
 use serde_json::json;
 use thiserror::Error;
+use ts_rs::TS;
+
+use crate::{
+    models::{EmailRejection, InvalidMember, VersionVector},
+    services::auth::Scope,
+};
 
 #[derive(Debug, Error)]
 pub enum AppError {
@@ -17,6 +24,16 @@ pub enum AppError {
     TokenExpired,
     #[error("Unauthorized")]
     Unauthorized,
+    #[error("Forbidden")]
+    Forbidden,
+    #[error("Token lacks the {} scope", .0.as_str())]
+    InsufficientScope(Scope),
+    #[error("Invalid DPoP proof")]
+    InvalidDpopProof(String),
+    #[error("DPoP proof required")]
+    DpopProofRequired,
+    #[error("Session used from an unusual location; log in again")]
+    ReauthRequired,
 
     // User errors
     #[error("User not found")]
@@ -29,10 +46,34 @@ pub enum AppError {
     InvalidOtp,
     #[error("OTP expired")]
     OtpExpired,
+    #[error("No OTP issued for this target")]
+    OtpNotFound,
     #[error("Too many attempts")]
     TooManyAttempts,
+    #[error("Rate limited, retry after {0} seconds")]
+    RateLimited(u64),
+    #[error("Too many failed attempts, retry after {retry_after} seconds")]
+    LoginLocked {
+        scope: &'static str,
+        locked: bool,
+        retry_after: u64,
+    },
+    #[error("Too many downloads, retry after {retry_after} seconds")]
+    DownloadLimited {
+        scope: &'static str,
+        blocked: bool,
+        retry_after: u64,
+    },
     #[error("OTP not verified")]
     OtpNotVerified,
+    #[error("Email address not accepted")]
+    InvalidEmail(EmailRejection),
+    #[error("Email domain not found")]
+    EmailDomainNotFound,
+    #[error("Request blocked")]
+    RequestBlocked,
+    #[error("Abuse block not found")]
+    AbuseBlockNotFound,
 
     // Contact errors
     #[error("Contact not found")]
@@ -47,10 +88,102 @@ pub enum AppError {
     ConversationNotFound,
     #[error("Not a participant")]
     NotParticipant,
+    #[error("Imported conversations are read-only")]
+    ConversationReadOnly,
+    #[error("Message request not found")]
+    MessageRequestNotFound,
+    #[error("Invalid group members")]
+    InvalidMembers(Vec<InvalidMember>),
 
     // Message errors
     #[error("Message not found")]
     MessageNotFound,
+    #[error("Messages after this sequence number have been archived; reload the history")]
+    SyncTokenExpired,
+
+    // Export errors
+    #[error("Export not found")]
+    ExportNotFound,
+    #[error("Import not found")]
+    ImportNotFound,
+
+    // Bridge errors
+    #[error("Bridge not found")]
+    BridgeNotFound,
+    #[error("External id conflicts with an existing {0} mapping")]
+    ExternalIdConflict(&'static str),
+
+    // Access token errors
+    #[error("Access token not found")]
+    AccessTokenNotFound,
+
+    // Guest errors
+    #[error("Widget token not found")]
+    WidgetTokenNotFound,
+    #[error("Not available to guests")]
+    GuestRestricted,
+
+    // Share link errors
+    #[error("Share link not found")]
+    ShareLinkNotFound,
+    #[error("Share links are turned off for this conversation")]
+    ShareLinksDisabled,
+
+    // Profile errors
+    #[error("Post not found")]
+    ProfilePostNotFound,
+
+    // Calendar errors
+    #[error("Event not found")]
+    CalendarEventNotFound,
+
+    // Note errors
+    #[error("The note was changed by an edit you haven't seen")]
+    NoteConflict(VersionVector),
+
+    // Task errors
+    #[error("Task not found")]
+    TaskNotFound,
+
+    // Payment request errors
+    #[error("Payment request not found")]
+    PaymentRequestNotFound,
+    #[error("Payment request is already {0}")]
+    PaymentRequestSettled(&'static str),
+
+    // Bot errors
+    #[error("Bot not found")]
+    BotNotFound,
+    #[error("No bot in this conversation handles /{0}")]
+    BotCommandNotFound(String),
+
+    // Account purge errors
+    #[error("User is not excluded from the purge")]
+    PurgeExclusionNotFound,
+
+    // Federation errors
+    #[error("Federation with {0} is not allowed")]
+    FederationDomainBlocked(String),
+    #[error("Invalid federation envelope")]
+    InvalidFederationEnvelope(String),
+
+    // Backup errors
+    #[error("Backup not found")]
+    BackupNotFound,
+    #[error("Backup exceeds the maximum size of {0} bytes")]
+    BackupTooLarge(usize),
+
+    // Storage errors
+    #[error("Storage quota exceeded")]
+    StorageQuotaExceeded,
+    #[error("Attachment not found")]
+    AttachmentNotFound,
+    #[error("Attachment exceeds the maximum size of {0} bytes")]
+    AttachmentTooLarge(usize),
+
+    // Job errors
+    #[error("Job not found")]
+    JobNotFound,
 
     // Signal key errors
     #[error("Identity key not found")]
@@ -61,16 +194,78 @@ pub enum AppError {
     // Sticker errors
     #[error("Sticker pack not found")]
     StickerPackNotFound,
-    #[error("Sticker pack already owned")]
-    StickerPackAlreadyOwned,
     #[error("Sticker pack not owned")]
     StickerPackNotOwned,
 
+    // Workspace errors
+    #[error("Workspace not found")]
+    WorkspaceNotFound,
+    #[error("Not a workspace member")]
+    NotWorkspaceMember,
+    #[error("Workspace slug already taken")]
+    WorkspaceSlugTaken,
+
+    // Compliance errors
+    #[error("Legal hold not found")]
+    LegalHoldNotFound,
+    #[error("Target is already under legal hold")]
+    LegalHoldAlreadyActive,
+    #[error("Impersonation not found")]
+    ImpersonationNotFound,
+    #[error("Impersonation is not {0}")]
+    ImpersonationNotInState(&'static str),
+    #[error("Not available while impersonating")]
+    ImpersonationRestricted,
+
+    // Feature flag errors
+    #[error("Feature flag not found")]
+    FeatureFlagNotFound,
+    #[error("Feature not enabled: {0}")]
+    FeatureDisabled(String),
+
+    // Translation errors
+    #[error("Translation provider request failed")]
+    TranslationFailed(Option<u16>),
+
+    // OTP delivery errors
+    #[error("OTP could not be delivered")]
+    OtpDeliveryFailed,
+
+    // External dependency errors
+    #[error("{dependency} is temporarily unavailable")]
+    DependencyUnavailable {
+        dependency: &'static str,
+        retry_after: u64,
+    },
+    #[error("This region is read-only; send writes to the leader")]
+    RegionReadOnly { leader_url: Option<String> },
+
+    // Limit errors
+    #[error("Limit exceeded: {0}")]
+    LimitExceeded(String),
+    #[error("Too many open connections ({limit})")]
+    TooManyConnections { limit: &'static str, max: usize },
+
     // Validation errors
     #[error("Validation error: {0}")]
     Validation(String),
     #[error("Bad request: {0}")]
     BadRequest(String),
+    #[error("Invalid path parameter")]
+    InvalidPathParams(String),
+    #[error("Invalid query parameter")]
+    InvalidQuery(String),
+    #[error("Invalid request body")]
+    InvalidBody(String),
+    #[error("Route not found")]
+    RouteNotFound,
+    #[error("Resource was modified since it was read")]
+    PreconditionFailed { current_version: i32 },
+    #[error("Client version {client_version} is no longer supported; please upgrade")]
+    UpgradeRequired {
+        min_version: String,
+        client_version: String,
+    },
 
     // Database errors
     #[error("Database error: {0}")]
@@ -89,6 +284,221 @@ pub enum AppError {
     Internal(#[from] anyhow::Error),
 }
 
+/// Stable machine-readable error codes, sent as `code` in every error
+/// response. Clients localize by code; `message` is an English fallback and
+/// may change.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, TS)]
+#[serde(rename_all = "snake_case")]
+pub enum ErrorCode {
+    InvalidCredentials,
+    InvalidToken,
+    TokenExpired,
+    Unauthorized,
+    Forbidden,
+    InsufficientScope,
+    InvalidDpopProof,
+    DpopProofRequired,
+    ReauthRequired,
+    UserNotFound,
+    UserAlreadyExists,
+    InvalidOtp,
+    OtpExpired,
+    OtpNotFound,
+    InvalidEmail,
+    EmailDomainNotFound,
+    RequestBlocked,
+    AbuseBlockNotFound,
+    TooManyAttempts,
+    RateLimited,
+    LoginLocked,
+    DownloadLimited,
+    OtpNotVerified,
+    ContactNotFound,
+    ContactAlreadyExists,
+    CannotAddSelf,
+    ConversationNotFound,
+    NotParticipant,
+    ConversationReadOnly,
+    MessageRequestNotFound,
+    InvalidMembers,
+    MessageNotFound,
+    SyncTokenExpired,
+    ExportNotFound,
+    ImportNotFound,
+    BridgeNotFound,
+    ExternalIdConflict,
+    AccessTokenNotFound,
+    WidgetTokenNotFound,
+    GuestRestricted,
+    ShareLinkNotFound,
+    ShareLinksDisabled,
+    ProfilePostNotFound,
+    CalendarEventNotFound,
+    NoteConflict,
+    TaskNotFound,
+    PaymentRequestNotFound,
+    PaymentRequestSettled,
+    BotNotFound,
+    BotCommandNotFound,
+    PurgeExclusionNotFound,
+    FederationDomainBlocked,
+    InvalidFederationEnvelope,
+    BackupNotFound,
+    BackupTooLarge,
+    StorageQuotaExceeded,
+    AttachmentNotFound,
+    AttachmentTooLarge,
+    JobNotFound,
+    IdentityKeyNotFound,
+    PreKeyNotFound,
+    StickerPackNotFound,
+    StickerPackNotOwned,
+    WorkspaceNotFound,
+    NotWorkspaceMember,
+    WorkspaceSlugTaken,
+    LegalHoldNotFound,
+    LegalHoldAlreadyActive,
+    ImpersonationNotFound,
+    ImpersonationStateConflict,
+    ImpersonationRestricted,
+    FeatureFlagNotFound,
+    FeatureDisabled,
+    TranslationFailed,
+    OtpDeliveryFailed,
+    DependencyUnavailable,
+    RegionReadOnly,
+    LimitExceeded,
+    TooManyConnections,
+    ValidationFailed,
+    BadRequest,
+    InvalidPathParams,
+    InvalidQuery,
+    InvalidBody,
+    RouteNotFound,
+    PreconditionFailed,
+    UpgradeRequired,
+    InternalError,
+
+    // Responses produced by the framework rather than an `AppError`
+    MethodNotAllowed,
+    PayloadTooLarge,
+    UnsupportedMediaType,
+}
+
+impl ErrorCode {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ErrorCode::InvalidCredentials => "invalid_credentials",
+            ErrorCode::InvalidToken => "invalid_token",
+            ErrorCode::TokenExpired => "token_expired",
+            ErrorCode::Unauthorized => "unauthorized",
+            ErrorCode::Forbidden => "forbidden",
+            ErrorCode::InsufficientScope => "insufficient_scope",
+            ErrorCode::InvalidDpopProof => "invalid_dpop_proof",
+            ErrorCode::DpopProofRequired => "dpop_proof_required",
+            ErrorCode::ReauthRequired => "reauth_required",
+            ErrorCode::UserNotFound => "user_not_found",
+            ErrorCode::UserAlreadyExists => "user_already_exists",
+            ErrorCode::InvalidOtp => "invalid_otp",
+            ErrorCode::OtpExpired => "otp_expired",
+            ErrorCode::OtpNotFound => "otp_not_found",
+            ErrorCode::InvalidEmail => "invalid_email",
+            ErrorCode::EmailDomainNotFound => "email_domain_not_found",
+            ErrorCode::RequestBlocked => "request_blocked",
+            ErrorCode::AbuseBlockNotFound => "abuse_block_not_found",
+            ErrorCode::TooManyAttempts => "too_many_attempts",
+            ErrorCode::RateLimited => "rate_limited",
+            ErrorCode::LoginLocked => "login_locked",
+            ErrorCode::DownloadLimited => "download_limited",
+            ErrorCode::OtpNotVerified => "otp_not_verified",
+            ErrorCode::ContactNotFound => "contact_not_found",
+            ErrorCode::ContactAlreadyExists => "contact_already_exists",
+            ErrorCode::CannotAddSelf => "cannot_add_self",
+            ErrorCode::ConversationNotFound => "conversation_not_found",
+            ErrorCode::NotParticipant => "not_participant",
+            ErrorCode::ConversationReadOnly => "conversation_read_only",
+            ErrorCode::MessageRequestNotFound => "message_request_not_found",
+            ErrorCode::InvalidMembers => "invalid_members",
+            ErrorCode::MessageNotFound => "message_not_found",
+            ErrorCode::SyncTokenExpired => "sync_token_expired",
+            ErrorCode::ExportNotFound => "export_not_found",
+            ErrorCode::ImportNotFound => "import_not_found",
+            ErrorCode::BridgeNotFound => "bridge_not_found",
+            ErrorCode::ExternalIdConflict => "external_id_conflict",
+            ErrorCode::AccessTokenNotFound => "access_token_not_found",
+            ErrorCode::WidgetTokenNotFound => "widget_token_not_found",
+            ErrorCode::GuestRestricted => "guest_restricted",
+            ErrorCode::ShareLinkNotFound => "share_link_not_found",
+            ErrorCode::ShareLinksDisabled => "share_links_disabled",
+            ErrorCode::ProfilePostNotFound => "profile_post_not_found",
+            ErrorCode::CalendarEventNotFound => "calendar_event_not_found",
+            ErrorCode::NoteConflict => "note_conflict",
+            ErrorCode::TaskNotFound => "task_not_found",
+            ErrorCode::PaymentRequestNotFound => "payment_request_not_found",
+            ErrorCode::PaymentRequestSettled => "payment_request_settled",
+            ErrorCode::BotNotFound => "bot_not_found",
+            ErrorCode::BotCommandNotFound => "bot_command_not_found",
+            ErrorCode::PurgeExclusionNotFound => "purge_exclusion_not_found",
+            ErrorCode::FederationDomainBlocked => "federation_domain_blocked",
+            ErrorCode::InvalidFederationEnvelope => "invalid_federation_envelope",
+            ErrorCode::BackupNotFound => "backup_not_found",
+            ErrorCode::BackupTooLarge => "backup_too_large",
+            ErrorCode::StorageQuotaExceeded => "storage_quota_exceeded",
+            ErrorCode::AttachmentNotFound => "attachment_not_found",
+            ErrorCode::AttachmentTooLarge => "attachment_too_large",
+            ErrorCode::JobNotFound => "job_not_found",
+            ErrorCode::IdentityKeyNotFound => "identity_key_not_found",
+            ErrorCode::PreKeyNotFound => "pre_key_not_found",
+            ErrorCode::StickerPackNotFound => "sticker_pack_not_found",
+            ErrorCode::StickerPackNotOwned => "sticker_pack_not_owned",
+            ErrorCode::WorkspaceNotFound => "workspace_not_found",
+            ErrorCode::NotWorkspaceMember => "not_workspace_member",
+            ErrorCode::WorkspaceSlugTaken => "workspace_slug_taken",
+            ErrorCode::LegalHoldNotFound => "legal_hold_not_found",
+            ErrorCode::LegalHoldAlreadyActive => "legal_hold_already_active",
+            ErrorCode::ImpersonationNotFound => "impersonation_not_found",
+            ErrorCode::ImpersonationStateConflict => "impersonation_state_conflict",
+            ErrorCode::ImpersonationRestricted => "impersonation_restricted",
+            ErrorCode::FeatureFlagNotFound => "feature_flag_not_found",
+            ErrorCode::FeatureDisabled => "feature_disabled",
+            ErrorCode::TranslationFailed => "translation_failed",
+            ErrorCode::OtpDeliveryFailed => "otp_delivery_failed",
+            ErrorCode::DependencyUnavailable => "dependency_unavailable",
+            ErrorCode::RegionReadOnly => "region_read_only",
+            ErrorCode::LimitExceeded => "limit_exceeded",
+            ErrorCode::TooManyConnections => "too_many_connections",
+            ErrorCode::ValidationFailed => "validation_failed",
+            ErrorCode::BadRequest => "bad_request",
+            ErrorCode::InvalidPathParams => "invalid_path_params",
+            ErrorCode::InvalidQuery => "invalid_query",
+            ErrorCode::InvalidBody => "invalid_body",
+            ErrorCode::RouteNotFound => "route_not_found",
+            ErrorCode::PreconditionFailed => "precondition_failed",
+            ErrorCode::UpgradeRequired => "upgrade_required",
+            ErrorCode::InternalError => "internal_error",
+            ErrorCode::MethodNotAllowed => "method_not_allowed",
+            ErrorCode::PayloadTooLarge => "payload_too_large",
+            ErrorCode::UnsupportedMediaType => "unsupported_media_type",
+        }
+    }
+
+    /// The code for an error response that didn't come from an `AppError`
+    pub fn for_status(status: StatusCode) -> Self {
+        match status {
+            StatusCode::UNAUTHORIZED => ErrorCode::Unauthorized,
+            StatusCode::FORBIDDEN => ErrorCode::Forbidden,
+            StatusCode::NOT_FOUND => ErrorCode::RouteNotFound,
+            StatusCode::METHOD_NOT_ALLOWED => ErrorCode::MethodNotAllowed,
+            StatusCode::PAYLOAD_TOO_LARGE => ErrorCode::PayloadTooLarge,
+            StatusCode::UNSUPPORTED_MEDIA_TYPE => ErrorCode::UnsupportedMediaType,
+            StatusCode::UNPROCESSABLE_ENTITY => ErrorCode::InvalidBody,
+            StatusCode::TOO_MANY_REQUESTS => ErrorCode::RateLimited,
+            status if status.is_server_error() => ErrorCode::InternalError,
+            _ => ErrorCode::BadRequest,
+        }
+    }
+}
+
 impl IntoResponse for AppError {
     fn into_response(self) -> Response {
         let (status, message) = match &self {
@@ -97,36 +507,120 @@ impl IntoResponse for AppError {
             AppError::BadRequest(msg) => (StatusCode::BAD_REQUEST, msg.clone()),
             AppError::InvalidOtp => (StatusCode::BAD_REQUEST, self.to_string()),
             AppError::OtpExpired => (StatusCode::BAD_REQUEST, self.to_string()),
+            AppError::InvalidEmail(_) => (StatusCode::BAD_REQUEST, self.to_string()),
             AppError::CannotAddSelf => (StatusCode::BAD_REQUEST, self.to_string()),
+            AppError::InvalidPathParams(_) => (StatusCode::BAD_REQUEST, self.to_string()),
+            AppError::InvalidQuery(_) => (StatusCode::BAD_REQUEST, self.to_string()),
 
             // 401 Unauthorized
             AppError::InvalidCredentials => (StatusCode::UNAUTHORIZED, self.to_string()),
             AppError::InvalidToken => (StatusCode::UNAUTHORIZED, self.to_string()),
             AppError::TokenExpired => (StatusCode::UNAUTHORIZED, self.to_string()),
             AppError::Unauthorized => (StatusCode::UNAUTHORIZED, self.to_string()),
+            AppError::InvalidDpopProof(_) => (StatusCode::UNAUTHORIZED, self.to_string()),
+            AppError::DpopProofRequired => (StatusCode::UNAUTHORIZED, self.to_string()),
+            AppError::ReauthRequired => (StatusCode::UNAUTHORIZED, self.to_string()),
+            AppError::InvalidFederationEnvelope(_) => (StatusCode::UNAUTHORIZED, self.to_string()),
             AppError::Jwt(_) => (StatusCode::UNAUTHORIZED, "Invalid token".to_string()),
 
             // 403 Forbidden
             AppError::NotParticipant => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::ConversationReadOnly => (StatusCode::FORBIDDEN, self.to_string()),
             AppError::OtpNotVerified => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::Forbidden => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::ImpersonationRestricted => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::GuestRestricted => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::ShareLinksDisabled => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::RequestBlocked => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::FederationDomainBlocked(_) => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::InsufficientScope(_) => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::NotWorkspaceMember => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::FeatureDisabled(_) => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::LimitExceeded(_) => (StatusCode::FORBIDDEN, self.to_string()),
+            AppError::TooManyConnections { .. } => {
+                (StatusCode::TOO_MANY_REQUESTS, self.to_string())
+            }
 
             // 404 Not Found
             AppError::UserNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::EmailDomainNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::AbuseBlockNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::OtpNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::ContactNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::ConversationNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::MessageRequestNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::MessageNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::ExportNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::ImportNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::BridgeNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::AccessTokenNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::WidgetTokenNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::ShareLinkNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::ProfilePostNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::CalendarEventNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::PaymentRequestNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::TaskNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::BotNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::BotCommandNotFound(_) => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::PurgeExclusionNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::BackupNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::AttachmentNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::JobNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::IdentityKeyNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::PreKeyNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::StickerPackNotFound => (StatusCode::NOT_FOUND, self.to_string()),
             AppError::StickerPackNotOwned => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::FeatureFlagNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::WorkspaceNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::LegalHoldNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::ImpersonationNotFound => (StatusCode::NOT_FOUND, self.to_string()),
+            AppError::RouteNotFound => (StatusCode::NOT_FOUND, self.to_string()),
 
             // 409 Conflict
             AppError::UserAlreadyExists => (StatusCode::CONFLICT, self.to_string()),
             AppError::ContactAlreadyExists => (StatusCode::CONFLICT, self.to_string()),
-            AppError::StickerPackAlreadyOwned => (StatusCode::CONFLICT, self.to_string()),
+            AppError::WorkspaceSlugTaken => (StatusCode::CONFLICT, self.to_string()),
+            AppError::LegalHoldAlreadyActive => (StatusCode::CONFLICT, self.to_string()),
+            AppError::ImpersonationNotInState(_) => (StatusCode::CONFLICT, self.to_string()),
+            AppError::ExternalIdConflict(_) => (StatusCode::CONFLICT, self.to_string()),
+            AppError::PaymentRequestSettled(_) => (StatusCode::CONFLICT, self.to_string()),
+            AppError::NoteConflict(_) => (StatusCode::CONFLICT, self.to_string()),
+
+            // 410 Gone
+            AppError::SyncTokenExpired => (StatusCode::GONE, self.to_string()),
+
+            // 412 Precondition Failed
+            AppError::PreconditionFailed { .. } => {
+                (StatusCode::PRECONDITION_FAILED, self.to_string())
+            }
+
+            // 413 Payload Too Large
+            AppError::BackupTooLarge(_) => (StatusCode::PAYLOAD_TOO_LARGE, self.to_string()),
+            AppError::AttachmentTooLarge(_) => (StatusCode::PAYLOAD_TOO_LARGE, self.to_string()),
+            AppError::StorageQuotaExceeded => (StatusCode::PAYLOAD_TOO_LARGE, self.to_string()),
+
+            // 422 Unprocessable Entity
+            AppError::InvalidMembers(_) => (StatusCode::UNPROCESSABLE_ENTITY, self.to_string()),
+            AppError::InvalidBody(_) => (StatusCode::UNPROCESSABLE_ENTITY, self.to_string()),
+
+            // 426 Upgrade Required
+            AppError::UpgradeRequired { .. } => (StatusCode::UPGRADE_REQUIRED, self.to_string()),
 
             // 429 Too Many Requests
             AppError::TooManyAttempts => (StatusCode::TOO_MANY_REQUESTS, self.to_string()),
+            AppError::RateLimited(_) => (StatusCode::TOO_MANY_REQUESTS, self.to_string()),
+            AppError::LoginLocked { .. } => (StatusCode::TOO_MANY_REQUESTS, self.to_string()),
+            AppError::DownloadLimited { .. } => (StatusCode::TOO_MANY_REQUESTS, self.to_string()),
+
+            // 502 Bad Gateway
+            AppError::TranslationFailed(_) => (StatusCode::BAD_GATEWAY, self.to_string()),
+            AppError::OtpDeliveryFailed => (StatusCode::BAD_GATEWAY, self.to_string()),
+
+            // 503 Service Unavailable
+            AppError::DependencyUnavailable { .. } => {
+                (StatusCode::SERVICE_UNAVAILABLE, self.to_string())
+            }
+            AppError::RegionReadOnly { .. } => (StatusCode::SERVICE_UNAVAILABLE, self.to_string()),
 
             // 500 Internal Server Error
             AppError::Database(e) => {
@@ -150,10 +644,169 @@ impl IntoResponse for AppError {
         };
 
         let body = Json(json!({
-            "error": message
+            "code": self.code(),
+            "message": message,
+            "details": self.details()
         }));
 
-        (status, body).into_response()
+        let mut response = (status, body).into_response();
+
+        if let AppError::RateLimited(retry_after)
+        | AppError::LoginLocked { retry_after, .. }
+        | AppError::DownloadLimited { retry_after, .. }
+        | AppError::DependencyUnavailable { retry_after, .. } = &self
+        {
+            response
+                .headers_mut()
+                .insert(RETRY_AFTER, HeaderValue::from(*retry_after));
+        }
+
+        response
+    }
+}
+
+impl AppError {
+    /// Stable machine-readable error code for the response envelope
+    pub fn code(&self) -> ErrorCode {
+        match self {
+            AppError::InvalidCredentials => ErrorCode::InvalidCredentials,
+            AppError::InvalidToken | AppError::Jwt(_) => ErrorCode::InvalidToken,
+            AppError::TokenExpired => ErrorCode::TokenExpired,
+            AppError::Unauthorized => ErrorCode::Unauthorized,
+            AppError::Forbidden => ErrorCode::Forbidden,
+            AppError::InsufficientScope(_) => ErrorCode::InsufficientScope,
+            AppError::InvalidDpopProof(_) => ErrorCode::InvalidDpopProof,
+            AppError::DpopProofRequired => ErrorCode::DpopProofRequired,
+            AppError::ReauthRequired => ErrorCode::ReauthRequired,
+            AppError::UserNotFound => ErrorCode::UserNotFound,
+            AppError::UserAlreadyExists => ErrorCode::UserAlreadyExists,
+            AppError::InvalidOtp => ErrorCode::InvalidOtp,
+            AppError::OtpExpired => ErrorCode::OtpExpired,
+            AppError::OtpNotFound => ErrorCode::OtpNotFound,
+            AppError::InvalidEmail(_) => ErrorCode::InvalidEmail,
+            AppError::EmailDomainNotFound => ErrorCode::EmailDomainNotFound,
+            AppError::RequestBlocked => ErrorCode::RequestBlocked,
+            AppError::AbuseBlockNotFound => ErrorCode::AbuseBlockNotFound,
+            AppError::TooManyAttempts => ErrorCode::TooManyAttempts,
+            AppError::RateLimited(_) => ErrorCode::RateLimited,
+            AppError::LoginLocked { .. } => ErrorCode::LoginLocked,
+            AppError::DownloadLimited { .. } => ErrorCode::DownloadLimited,
+            AppError::OtpNotVerified => ErrorCode::OtpNotVerified,
+            AppError::ContactNotFound => ErrorCode::ContactNotFound,
+            AppError::ContactAlreadyExists => ErrorCode::ContactAlreadyExists,
+            AppError::CannotAddSelf => ErrorCode::CannotAddSelf,
+            AppError::ConversationNotFound => ErrorCode::ConversationNotFound,
+            AppError::NotParticipant => ErrorCode::NotParticipant,
+            AppError::ConversationReadOnly => ErrorCode::ConversationReadOnly,
+            AppError::MessageRequestNotFound => ErrorCode::MessageRequestNotFound,
+            AppError::InvalidMembers(_) => ErrorCode::InvalidMembers,
+            AppError::MessageNotFound => ErrorCode::MessageNotFound,
+            AppError::SyncTokenExpired => ErrorCode::SyncTokenExpired,
+            AppError::ExportNotFound => ErrorCode::ExportNotFound,
+            AppError::ImportNotFound => ErrorCode::ImportNotFound,
+            AppError::BridgeNotFound => ErrorCode::BridgeNotFound,
+            AppError::ExternalIdConflict(_) => ErrorCode::ExternalIdConflict,
+            AppError::AccessTokenNotFound => ErrorCode::AccessTokenNotFound,
+            AppError::WidgetTokenNotFound => ErrorCode::WidgetTokenNotFound,
+            AppError::GuestRestricted => ErrorCode::GuestRestricted,
+            AppError::ShareLinkNotFound => ErrorCode::ShareLinkNotFound,
+            AppError::ShareLinksDisabled => ErrorCode::ShareLinksDisabled,
+            AppError::ProfilePostNotFound => ErrorCode::ProfilePostNotFound,
+            AppError::CalendarEventNotFound => ErrorCode::CalendarEventNotFound,
+            AppError::NoteConflict(_) => ErrorCode::NoteConflict,
+            AppError::TaskNotFound => ErrorCode::TaskNotFound,
+            AppError::PaymentRequestNotFound => ErrorCode::PaymentRequestNotFound,
+            AppError::PaymentRequestSettled(_) => ErrorCode::PaymentRequestSettled,
+            AppError::BotNotFound => ErrorCode::BotNotFound,
+            AppError::BotCommandNotFound(_) => ErrorCode::BotCommandNotFound,
+            AppError::PurgeExclusionNotFound => ErrorCode::PurgeExclusionNotFound,
+            AppError::FederationDomainBlocked(_) => ErrorCode::FederationDomainBlocked,
+            AppError::InvalidFederationEnvelope(_) => ErrorCode::InvalidFederationEnvelope,
+            AppError::BackupNotFound => ErrorCode::BackupNotFound,
+            AppError::BackupTooLarge(_) => ErrorCode::BackupTooLarge,
+            AppError::StorageQuotaExceeded => ErrorCode::StorageQuotaExceeded,
+            AppError::AttachmentNotFound => ErrorCode::AttachmentNotFound,
+            AppError::AttachmentTooLarge(_) => ErrorCode::AttachmentTooLarge,
+            AppError::JobNotFound => ErrorCode::JobNotFound,
+            AppError::IdentityKeyNotFound => ErrorCode::IdentityKeyNotFound,
+            AppError::PreKeyNotFound => ErrorCode::PreKeyNotFound,
+            AppError::StickerPackNotFound => ErrorCode::StickerPackNotFound,
+            AppError::StickerPackNotOwned => ErrorCode::StickerPackNotOwned,
+            AppError::WorkspaceNotFound => ErrorCode::WorkspaceNotFound,
+            AppError::NotWorkspaceMember => ErrorCode::NotWorkspaceMember,
+            AppError::WorkspaceSlugTaken => ErrorCode::WorkspaceSlugTaken,
+            AppError::LegalHoldNotFound => ErrorCode::LegalHoldNotFound,
+            AppError::LegalHoldAlreadyActive => ErrorCode::LegalHoldAlreadyActive,
+            AppError::ImpersonationNotFound => ErrorCode::ImpersonationNotFound,
+            AppError::ImpersonationNotInState(_) => ErrorCode::ImpersonationStateConflict,
+            AppError::ImpersonationRestricted => ErrorCode::ImpersonationRestricted,
+            AppError::FeatureFlagNotFound => ErrorCode::FeatureFlagNotFound,
+            AppError::FeatureDisabled(_) => ErrorCode::FeatureDisabled,
+            AppError::TranslationFailed(_) => ErrorCode::TranslationFailed,
+            AppError::OtpDeliveryFailed => ErrorCode::OtpDeliveryFailed,
+            AppError::DependencyUnavailable { .. } => ErrorCode::DependencyUnavailable,
+            AppError::RegionReadOnly { .. } => ErrorCode::RegionReadOnly,
+            AppError::LimitExceeded(_) => ErrorCode::LimitExceeded,
+            AppError::TooManyConnections { .. } => ErrorCode::TooManyConnections,
+            AppError::Validation(_) => ErrorCode::ValidationFailed,
+            AppError::BadRequest(_) => ErrorCode::BadRequest,
+            AppError::InvalidPathParams(_) => ErrorCode::InvalidPathParams,
+            AppError::InvalidQuery(_) => ErrorCode::InvalidQuery,
+            AppError::InvalidBody(_) => ErrorCode::InvalidBody,
+            AppError::RouteNotFound => ErrorCode::RouteNotFound,
+            AppError::PreconditionFailed { .. } => ErrorCode::PreconditionFailed,
+            AppError::UpgradeRequired { .. } => ErrorCode::UpgradeRequired,
+            AppError::Database(_) | AppError::Redis(_) | AppError::Internal(_) => {
+                ErrorCode::InternalError
+            }
+        }
+    }
+
+    /// Structured context for errors that carry more than a message
+    fn details(&self) -> serde_json::Value {
+        match self {
+            AppError::RateLimited(retry_after) => json!({ "retry_after": retry_after }),
+            AppError::LoginLocked {
+                scope,
+                locked,
+                retry_after,
+            } => json!({ "scope": scope, "locked": locked, "retry_after": retry_after }),
+            AppError::DownloadLimited {
+                scope,
+                blocked,
+                retry_after,
+            } => json!({ "scope": scope, "blocked": blocked, "retry_after": retry_after }),
+            AppError::InvalidMembers(members) => json!({ "invalid_members": members }),
+            AppError::BackupTooLarge(max_size) | AppError::AttachmentTooLarge(max_size) => {
+                json!({ "max_size": max_size })
+            }
+            AppError::FeatureDisabled(feature) => json!({ "feature": feature }),
+            AppError::TranslationFailed(status) => json!({ "provider_status": status }),
+            AppError::PreconditionFailed { current_version } => {
+                json!({ "current_version": current_version })
+            }
+            AppError::InsufficientScope(scope) => json!({ "required_scope": scope }),
+            AppError::DependencyUnavailable {
+                dependency,
+                retry_after,
+            } => json!({ "dependency": dependency, "retry_after": retry_after }),
+            AppError::RegionReadOnly { leader_url } => json!({ "leader_url": leader_url }),
+            AppError::InvalidEmail(reason) => json!({ "reason": reason }),
+            AppError::FederationDomainBlocked(domain) => json!({ "domain": domain }),
+            AppError::BotCommandNotFound(command) => json!({ "command": command }),
+            AppError::NoteConflict(version_vector) => json!({ "version_vector": version_vector }),
+            AppError::TooManyConnections { limit, max } => json!({ "limit": limit, "max": max }),
+            AppError::UpgradeRequired {
+                min_version,
+                client_version,
+            } => json!({ "min_version": min_version, "client_version": client_version }),
+            AppError::InvalidPathParams(reason)
+            | AppError::InvalidQuery(reason)
+            | AppError::InvalidBody(reason)
+            | AppError::InvalidDpopProof(reason)
+            | AppError::InvalidFederationEnvelope(reason) => json!({ "reason": reason }),
+            _ => serde_json::Value::Null,
+        }
     }
 }
 
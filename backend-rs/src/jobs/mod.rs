@@ -0,0 +1,5 @@
+pub mod queue;
+pub mod runner;
+
+pub use queue::{Job, JobMetrics, JobQueue};
+pub use runner::{JobHandler, JobRunner};
@@ -0,0 +1,129 @@
+use std::collections::HashMap;
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    storage::redis::RedisClient,
+};
+
+/// Dead-lettered jobs kept for inspection; older entries are trimmed
+pub const DEAD_LETTER_MAX_LEN: isize = 1000;
+
+/// A unit of background work, stored in Redis as JSON
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Job {
+    pub id: Uuid,
+    pub kind: String,
+    pub payload: serde_json::Value,
+    pub attempts: u32,
+    pub max_attempts: u32,
+    pub last_error: Option<String>,
+    pub enqueued_at: DateTime<Utc>,
+}
+
+impl Job {
+    /// Whether a failure of the current attempt sends the job to the dead-letter list
+    pub fn is_final_attempt(&self) -> bool {
+        self.attempts + 1 >= self.max_attempts
+    }
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct JobMetrics {
+    pub queued: i64,
+    pub scheduled: i64,
+    pub processing: i64,
+    pub dead: i64,
+    /// Per-kind counters such as `export.succeeded` or `export.retried`
+    pub counters: HashMap<String, i64>,
+}
+
+/// Producer side of the Redis-backed job queue
+#[derive(Clone)]
+pub struct JobQueue {
+    redis: RedisClient,
+    max_attempts: u32,
+}
+
+impl JobQueue {
+    pub fn new(redis: RedisClient, max_attempts: u32) -> Self {
+        Self {
+            redis,
+            max_attempts,
+        }
+    }
+
+    /// Enqueue a job for the worker registered under `kind`
+    pub async fn enqueue(&self, kind: &str, payload: serde_json::Value) -> AppResult<Uuid> {
+        let job = Job {
+            id: Uuid::new_v4(),
+            kind: kind.to_string(),
+            payload,
+            attempts: 0,
+            max_attempts: self.max_attempts,
+            last_error: None,
+            enqueued_at: Utc::now(),
+        };
+
+        let job_json = serde_json::to_string(&job)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize job: {}", e))?;
+        self.redis.push_job(&job_json).await?;
+        self.redis.incr_job_metric(&format!("{}.enqueued", kind)).await?;
+
+        Ok(job.id)
+    }
+
+    /// Queue lengths and per-kind counters
+    pub async fn metrics(&self) -> AppResult<JobMetrics> {
+        let (queued, scheduled, processing, dead) = self.redis.get_job_queue_lengths().await?;
+        let counters = self.redis.get_job_metrics().await?;
+
+        Ok(JobMetrics {
+            queued,
+            scheduled,
+            processing,
+            dead,
+            counters,
+        })
+    }
+
+    /// Most recent dead-lettered jobs
+    pub async fn dead_jobs(&self, limit: isize) -> AppResult<Vec<Job>> {
+        let values = self.redis.get_dead_jobs(limit).await?;
+
+        Ok(values
+            .iter()
+            .filter_map(|v| serde_json::from_str::<Job>(v).ok())
+            .collect())
+    }
+
+    /// Move a dead-lettered job back onto the queue with a fresh attempt budget
+    pub async fn retry_dead_job(&self, job_id: Uuid) -> AppResult<Job> {
+        let values = self.redis.get_dead_jobs(DEAD_LETTER_MAX_LEN).await?;
+
+        for value in values {
+            let Ok(mut job) = serde_json::from_str::<Job>(&value) else {
+                continue;
+            };
+            if job.id != job_id {
+                continue;
+            }
+
+            if !self.redis.remove_dead_job(&value).await? {
+                break;
+            }
+
+            job.attempts = 0;
+            let job_json = serde_json::to_string(&job)
+                .map_err(|e| anyhow::anyhow!("Failed to serialize job: {}", e))?;
+            self.redis.push_job(&job_json).await?;
+
+            return Ok(job);
+        }
+
+        Err(AppError::JobNotFound)
+    }
+}
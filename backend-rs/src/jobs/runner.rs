@@ -0,0 +1,218 @@
+use std::{collections::HashMap, sync::Arc, time::Duration};
+
+use async_trait::async_trait;
+use chrono::Utc;
+use uuid::Uuid;
+
+use crate::{
+    config::JobsConfig,
+    error::{AppError, AppResult},
+    storage::redis::RedisClient,
+};
+
+use super::queue::{Job, DEAD_LETTER_MAX_LEN};
+
+/// How often a runner renews its registration and looks for jobs held by
+/// runners that stopped renewing theirs
+const HEARTBEAT_INTERVAL: Duration = Duration::from_secs(10);
+/// A runner missing this many seconds of heartbeats is presumed dead
+const HEARTBEAT_TTL: Duration = Duration::from_secs(30);
+
+/// Handler for one kind of job. Jobs are delivered at least once, so
+/// handlers must be idempotent.
+#[async_trait]
+pub trait JobHandler: Send + Sync {
+    fn kind(&self) -> &'static str;
+
+    async fn handle(&self, job: &Job) -> AppResult<()>;
+}
+
+/// Consumer side of the job queue: runs registered handlers with retries
+/// and exponential backoff, dead-lettering jobs that exhaust their attempts.
+/// Each runner keeps the jobs it has claimed on its own processing list and
+/// a heartbeat in Redis. Only the lists of runners whose heartbeat has
+/// lapsed are requeued, so a replica starting up doesn't rerun jobs other
+/// replicas are still working on.
+pub struct JobRunner {
+    redis: RedisClient,
+    config: JobsConfig,
+    runner_id: String,
+    handlers: HashMap<&'static str, Arc<dyn JobHandler>>,
+}
+
+impl JobRunner {
+    pub fn new(redis: RedisClient, config: JobsConfig) -> Self {
+        Self {
+            redis,
+            config,
+            runner_id: Uuid::new_v4().to_string(),
+            handlers: HashMap::new(),
+        }
+    }
+
+    pub fn register(&mut self, handler: Arc<dyn JobHandler>) {
+        self.handlers.insert(handler.kind(), handler);
+    }
+
+    /// Register this runner, recover orphaned jobs and spawn the worker,
+    /// scheduler and heartbeat tasks
+    pub async fn start(self) -> AppResult<()> {
+        self.redis
+            .heartbeat_job_runner(&self.runner_id, HEARTBEAT_TTL)
+            .await?;
+        self.requeue_orphaned().await?;
+
+        let runner = Arc::new(self);
+
+        for worker_id in 0..runner.config.workers {
+            let worker = runner.clone();
+            tokio::spawn(async move {
+                worker.run_worker(worker_id).await;
+            });
+        }
+
+        let scheduler = runner.clone();
+        tokio::spawn(async move {
+            scheduler.run_scheduler().await;
+        });
+
+        let heartbeat = runner.clone();
+        tokio::spawn(async move {
+            heartbeat.run_heartbeat().await;
+        });
+
+        tracing::info!(
+            "Job runner started with {} workers ({} handlers)",
+            runner.config.workers,
+            runner.handlers.len()
+        );
+
+        Ok(())
+    }
+
+    async fn run_worker(&self, worker_id: usize) {
+        loop {
+            match self.redis.claim_job(&self.runner_id).await {
+                Ok(Some(job_json)) => self.process(&job_json).await,
+                Ok(None) => tokio::time::sleep(self.config.poll_interval).await,
+                Err(e) => {
+                    tracing::error!("Job worker {} failed to claim job: {}", worker_id, e);
+                    tokio::time::sleep(self.config.poll_interval).await;
+                }
+            }
+        }
+    }
+
+    /// Periodically move due retries back onto the queue
+    async fn run_scheduler(&self) {
+        loop {
+            if let Err(e) = self.redis.promote_due_jobs(Utc::now().timestamp()).await {
+                tracing::error!("Job scheduler failed: {}", e);
+            }
+            tokio::time::sleep(self.config.poll_interval).await;
+        }
+    }
+
+    /// Keep this runner registered and requeue the jobs of runners that
+    /// stopped heartbeating
+    async fn run_heartbeat(&self) {
+        loop {
+            tokio::time::sleep(HEARTBEAT_INTERVAL).await;
+
+            if let Err(e) = self
+                .redis
+                .heartbeat_job_runner(&self.runner_id, HEARTBEAT_TTL)
+                .await
+            {
+                tracing::error!("Job runner heartbeat failed: {}", e);
+                continue;
+            }
+            if let Err(e) = self.requeue_orphaned().await {
+                tracing::error!("Failed to requeue orphaned jobs: {}", e);
+            }
+        }
+    }
+
+    async fn requeue_orphaned(&self) -> AppResult<()> {
+        let requeued = self.redis.requeue_orphaned_jobs().await?;
+        if requeued > 0 {
+            tracing::info!("Requeued {} jobs from stopped runners", requeued);
+        }
+        Ok(())
+    }
+
+    async fn process(&self, job_json: &str) {
+        if let Err(e) = self.try_process(job_json).await {
+            tracing::error!("Failed to process job: {}", e);
+        }
+    }
+
+    async fn try_process(&self, job_json: &str) -> AppResult<()> {
+        let mut job: Job = match serde_json::from_str(job_json) {
+            Ok(job) => job,
+            Err(e) => {
+                tracing::error!("Dropping malformed job: {}", e);
+                self.redis.push_dead_job(job_json, DEAD_LETTER_MAX_LEN).await?;
+                return self.redis.ack_job(&self.runner_id, job_json).await;
+            }
+        };
+
+        let result = match self.handlers.get(job.kind.as_str()) {
+            Some(handler) => handler.handle(&job).await,
+            None => Err(AppError::Internal(anyhow::anyhow!(
+                "No handler registered for job kind {}",
+                job.kind
+            ))),
+        };
+
+        match result {
+            Ok(()) => {
+                self.redis.ack_job(&self.runner_id, job_json).await?;
+                self.redis
+                    .incr_job_metric(&format!("{}.succeeded", job.kind))
+                    .await?;
+            }
+            Err(e) => {
+                job.attempts += 1;
+                job.last_error = Some(e.to_string());
+
+                let updated = serde_json::to_string(&job)
+                    .map_err(|e| anyhow::anyhow!("Failed to serialize job: {}", e))?;
+
+                if job.attempts >= job.max_attempts {
+                    tracing::error!("Job {} ({}) dead-lettered: {}", job.id, job.kind, e);
+                    self.redis.push_dead_job(&updated, DEAD_LETTER_MAX_LEN).await?;
+                    self.redis
+                        .incr_job_metric(&format!("{}.dead", job.kind))
+                        .await?;
+                } else {
+                    let delay = self.retry_delay(job.attempts);
+                    tracing::warn!(
+                        "Job {} ({}) failed, retrying in {}s: {}",
+                        job.id,
+                        job.kind,
+                        delay,
+                        e
+                    );
+                    self.redis
+                        .schedule_job(&updated, Utc::now().timestamp() + delay)
+                        .await?;
+                    self.redis
+                        .incr_job_metric(&format!("{}.retried", job.kind))
+                        .await?;
+                }
+
+                self.redis.ack_job(&self.runner_id, job_json).await?;
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Exponential backoff: base * 2^(attempts - 1), capped at one hour
+    fn retry_delay(&self, attempts: u32) -> i64 {
+        let base = self.config.retry_base_delay.as_secs() as i64;
+        let factor = 1i64 << attempts.saturating_sub(1).min(16);
+        (base * factor).min(60 * 60)
+    }
+}
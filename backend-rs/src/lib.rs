@@ -0,0 +1,38 @@
+//! The server as a library: the `server` binary (`main.rs`) wires it up,
+//! and the benchmarks in `benches/` drive its services directly.
+
+use std::sync::Arc;
+
+pub mod admin;
+pub mod api;
+pub mod codegen;
+pub mod config;
+pub mod error;
+pub mod jobs;
+pub mod models;
+pub mod secrets;
+pub mod seed;
+pub mod server;
+pub mod services;
+pub mod storage;
+
+use config::SharedConfig;
+use jobs::JobQueue;
+use services::{
+    circuit_breaker::Breakers, event_listener::EventListener, runtime_config::LogFilterHandle,
+};
+use storage::{minio::MinioClient, redis::RedisClient};
+
+#[derive(Clone)]
+pub struct AppState {
+    pub db: sqlx::PgPool,
+    pub redis: RedisClient,
+    pub minio: MinioClient,
+    pub config: Arc<SharedConfig>,
+    pub log_filter: LogFilterHandle,
+    pub ws_hub: Arc<api::websocket::WsHub>,
+    pub event_listener: Arc<EventListener>,
+    pub jobs: JobQueue,
+    pub http: reqwest::Client,
+    pub breakers: Breakers,
+}
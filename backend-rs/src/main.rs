@@ -1,66 +1,180 @@
-use std::sync::Arc;
+use std::{fmt::Display, future::Future, sync::Arc, time::Duration};
 
-use axum::{routing::get, Router};
+use axum::{middleware, routing::get, Router};
+use jsonwebtoken::Algorithm;
 use sqlx::postgres::PgPoolOptions;
 use tower_http::{
+    compression::CompressionLayer,
     cors::{Any, CorsLayer},
     trace::TraceLayer,
 };
 use tracing_subscriber::{layer::SubscriberExt, util::SubscriberInitExt};
 
-mod api;
-mod config;
-mod error;
-mod models;
-mod services;
-mod storage;
-
-use config::Config;
+use ansible_talk_backend::{
+    admin, api, codegen, config, error, jobs, secrets, seed, server, services, storage, AppState,
+};
+use config::{Config, SharedConfig, StartupConfig};
+use error::AppError;
+use jobs::{JobQueue, JobRunner};
+use secrets::SecretsManager;
+use services::{
+    account_purge::{AccountPurgeJob, AccountPurgeService, PurgeWarningJob},
+    archives::ArchiveService,
+    attachments::{AttachmentsService, DeleteObjectsJob},
+    bots::{BotCommandJob, BotsService},
+    calendar::CalendarService,
+    circuit_breaker::Breakers,
+    event_listener::EventListener,
+    exports::{ExportJob, ExportsService},
+    federation::{FederationJob, FederationService, WELL_KNOWN_PATH},
+    guests::GuestsService,
+    imports::{ImportJob, ImportsService},
+    jwt_secrets::JwtSecretsService,
+    limits::LimitsService,
+    otp_delivery::{OtpDeliveryJob, OtpDeliveryService},
+    outbox::OutboxService,
+    partitions::PartitionService,
+    payments::{PaymentWebhookJob, PaymentsService},
+    runtime_config::RuntimeConfigService,
+    storage::StorageService,
+    suggestions::{SuggestionsJob, SuggestionsService},
+    transcoding::{TranscodeJob, TranscodingService},
+};
 use storage::{minio::MinioClient, redis::RedisClient};
 
-#[derive(Clone)]
-pub struct AppState {
-    pub db: sqlx::PgPool,
-    pub redis: RedisClient,
-    pub minio: MinioClient,
-    pub config: Arc<Config>,
-    pub ws_hub: Arc<api::websocket::WsHub>,
-}
-
 #[tokio::main]
 async fn main() -> anyhow::Result<()> {
-    // Initialize tracing
+    // `server codegen [dir]` writes the TypeScript client types and exits;
+    // it needs no config or services
+    if std::env::args().nth(1).as_deref() == Some("codegen") {
+        let dir = std::env::args().nth(2);
+        return codegen::run(dir.as_deref());
+    }
+
+    // Load configuration
+    let mut config = Config::load();
+
+    // Initialize tracing; the filter can be swapped on config reload
+    let (log_filter, log_filter_handle) = tracing_subscriber::reload::Layer::new(
+        tracing_subscriber::EnvFilter::try_new(&config.server.log_level)
+            .unwrap_or_else(|_| tracing_subscriber::EnvFilter::new("info")),
+    );
     tracing_subscriber::registry()
-        .with(
-            tracing_subscriber::EnvFilter::try_from_default_env()
-                .unwrap_or_else(|_| "ansible_talk_backend=debug,tower_http=debug".into()),
-        )
+        .with(log_filter)
         .with(tracing_subscriber::fmt::layer())
         .init();
 
-    // Load configuration
-    let config = Config::load();
     tracing::info!("Starting server in {} mode", config.server.environment);
 
+    // Overlay credentials from the secrets manager, if one is configured
+    let secrets = SecretsManager::from_config(&config.secrets).await.map(Arc::new);
+    if let Some(secrets) = &secrets {
+        config.apply_secrets(&secrets.get_all().await?);
+        tracing::info!("Loaded credentials from secrets manager");
+    }
+    config
+        .ensure_production_ready()
+        .map_err(|e| anyhow::anyhow!("Refusing to start: {}", e))?;
+    config.jwt.load_keys()?;
+    config.federation.load_keys()?;
+
     // Initialize database pool
-    let db = PgPoolOptions::new()
-        .max_connections(config.database.max_connections)
-        .connect(&config.database_url())
-        .await?;
+    let database_url = config.database_url();
+    let db = with_retry("PostgreSQL", &config.startup, || {
+        PgPoolOptions::new()
+            .max_connections(config.database.max_connections)
+            .connect(&database_url)
+    })
+    .await?;
     tracing::info!("Connected to PostgreSQL");
 
-    // Run migrations
-    sqlx::migrate!("./migrations").run(&db).await?;
-    tracing::info!("Database migrations completed");
+    // Run migrations. A standby's database is a replica, which gets them
+    // from the primary.
+    if config.region.read_only {
+        tracing::info!("Read-only region: skipping database migrations");
+    } else {
+        sqlx::migrate!("./migrations").run(&db).await?;
+        tracing::info!("Database migrations completed");
+    }
+
+    // HS256 secrets are shared through the database, so every replica
+    // accepts a rotated secret before any of them signs with it
+    if config.jwt.algorithm == Algorithm::HS256 {
+        JwtSecretsService::new(db.clone())
+            .sync(
+                &mut config.jwt,
+                config.region.read_only,
+                config.secrets.refresh_interval,
+            )
+            .await?;
+    }
 
     // Initialize Redis
-    let redis = RedisClient::new(&config.redis_url()).await?;
+    let redis_url = config.redis_url();
+    let redis = with_retry("Redis", &config.startup, || {
+        RedisClient::new(&redis_url, config.region.name.as_deref())
+    })
+    .await?;
     tracing::info!("Connected to Redis");
 
-    // Initialize MinIO
-    let minio = MinioClient::new(&config.minio).await?;
-    minio.ensure_buckets().await?;
-    tracing::info!("Connected to MinIO");
+    // Circuit breakers around SMS, email, MinIO and the suggestions sidecar,
+    // shared process-wide
+    let breakers = Breakers::new(&config.breaker);
+
+    // Initialize MinIO. Without it only media features are lost, so by
+    // default the server comes up without them and keeps trying.
+    let minio = MinioClient::new(&config.minio, breakers.minio.clone()).await?;
+    match with_retry("MinIO", &config.startup, || minio.ensure_buckets()).await {
+        Ok(()) => tracing::info!("Connected to MinIO"),
+        Err(e) if config.startup.degraded_media => {
+            tracing::error!("MinIO unavailable, starting without media features: {}", e);
+            let interval = config.startup.retry_max_delay;
+            minio.set_degraded(interval);
+            let recovery = minio.clone();
+            tokio::spawn(async move {
+                recovery.run_recovery(interval).await;
+            });
+        }
+        Err(e) => return Err(e.into()),
+    }
+
+    // Initialize job queue
+    let jobs = JobQueue::new(redis.clone(), config.jobs.max_attempts);
+
+    // `server seed [dir]` loads development fixtures and exits
+    if std::env::args().nth(1).as_deref() == Some("seed") {
+        let dir = std::env::args().nth(2);
+        return seed::run(&config, &db, &redis, &minio, dir.as_deref()).await;
+    }
+
+    // `server admin <command>` runs one operational task and exits
+    if std::env::args().nth(1).as_deref() == Some("admin") {
+        let args: Vec<String> = std::env::args().skip(2).collect();
+        return admin::run(&config, &db, &redis, &minio, &args).await;
+    }
+
+    // Shared client for outbound HTTP calls (OTP providers, translation relay)
+    let http = reqwest::Client::builder()
+        .timeout(std::time::Duration::from_secs(10))
+        .build()?;
+
+    // Spawn background workers (job runner, outbox dispatcher, transcoding).
+    // They all write, so a standby only starts them once it is promoted and
+    // restarted.
+    if config.region.read_only {
+        tracing::info!("Read-only region: not starting background workers");
+    } else {
+        spawn_background_workers(&config, &db, &redis, &minio, &jobs, &http, &breakers).await?;
+    }
+
+    // `server worker` only runs background workers; API nodes can then set
+    // JOB_WORKERS=0 and TRANSCODE_WORKERS=0
+    if std::env::args().nth(1).as_deref() == Some("worker") {
+        tracing::info!("Running in worker mode");
+        tokio::signal::ctrl_c().await?;
+        tracing::info!("Worker shutting down");
+        return Ok(());
+    }
 
     // Initialize WebSocket hub
     let ws_hub = Arc::new(api::websocket::WsHub::new(redis.clone()));
@@ -71,38 +185,338 @@ async fn main() -> anyhow::Result<()> {
         hub_clone.run().await;
     });
 
+    // One Redis subscription wakes every long poll and SSE stream
+    let event_listener = Arc::new(EventListener::new(redis.clone()));
+    let listener_clone = event_listener.clone();
+    tokio::spawn(async move {
+        listener_clone.run().await;
+    });
+
     // Create app state
     let state = AppState {
         db,
         redis,
         minio,
-        config: Arc::new(config.clone()),
+        config: Arc::new(SharedConfig::new(config.clone())),
+        log_filter: log_filter_handle,
         ws_hub,
+        event_listener,
+        jobs,
+        http,
+        breakers,
     };
 
+    spawn_reload_on_sighup(&state);
+
+    secrets::spawn_rotation(secrets, state.config.clone(), state.db.clone());
+
     // Build router
-    let app = Router::new()
+    let mut app = Router::new()
         .route("/health", get(health_check))
-        .nest("/api/v1", api::router::create_router(state.clone()))
+        .route(
+            "/health/region",
+            get(api::handlers::region::get_region_health),
+        )
+        .route("/.well-known/jwks.json", get(api::handlers::auth::get_jwks));
+
+    if config.federation.enabled {
+        app = app.route(
+            WELL_KNOWN_PATH,
+            get(api::handlers::federation::get_federation_document),
+        );
+    }
+
+    // Aggregate analytics in Prometheus format (no per-user data), for
+    // scrapers holding METRICS_TOKEN
+    if config.server.metrics_enabled {
+        if config.server.metrics_token.is_none() {
+            anyhow::bail!("METRICS_TOKEN is required when METRICS_ENABLED is set");
+        }
+        app = app.route("/metrics", get(api::handlers::analytics::get_metrics));
+    }
+
+    let app = app
+        .nest("/api/v1", api::router::create_v1_router(state.clone()))
+        .nest("/api/v2", api::router::create_v2_router(state.clone()))
+        .fallback(|| async { AppError::RouteNotFound })
+        .layer(middleware::map_response(api::middleware::envelope_errors))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            api::versioning::client_version_gate,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            api::middleware::read_only_gate,
+        ))
         .layer(
             CorsLayer::new()
                 .allow_origin(Any)
                 .allow_methods(Any)
                 .allow_headers(Any),
         )
+        // gzip or br, per Accept-Encoding; skips small bodies, images and SSE
+        .layer(CompressionLayer::new())
         .layer(TraceLayer::new_for_http())
         .with_state(state);
 
     // Start server
-    let addr = format!("{}:{}", config.server.host, config.server.port);
-    let listener = tokio::net::TcpListener::bind(&addr).await?;
-    tracing::info!("Server listening on {}", addr);
+    server::serve(app, &config).await
+}
+
+/// Reload the hot-reloadable config on SIGHUP
+fn spawn_reload_on_sighup(state: &AppState) {
+    #[cfg(unix)]
+    {
+        use tokio::signal::unix::{signal, SignalKind};
+
+        let mut hangup = match signal(SignalKind::hangup()) {
+            Ok(hangup) => hangup,
+            Err(e) => {
+                tracing::warn!("Failed to install SIGHUP handler: {}", e);
+                return;
+            }
+        };
+
+        let config_service = RuntimeConfigService::new(
+            state.db.clone(),
+            state.redis.clone(),
+            state.config.clone(),
+            state.log_filter.clone(),
+        );
+
+        tokio::spawn(async move {
+            while hangup.recv().await.is_some() {
+                if let Err(e) = config_service.reload(None, "sighup").await {
+                    tracing::error!("Config reload failed: {}", e);
+                }
+            }
+        });
+    }
+
+    #[cfg(not(unix))]
+    let _ = state;
+}
+
+async fn spawn_background_workers(
+    config: &Config,
+    db: &sqlx::PgPool,
+    redis: &RedisClient,
+    minio: &MinioClient,
+    jobs: &JobQueue,
+    http: &reqwest::Client,
+    breakers: &Breakers,
+) -> anyhow::Result<()> {
+    if config.jobs.workers > 0 {
+        let mut runner = JobRunner::new(redis.clone(), config.jobs.clone());
+        runner.register(Arc::new(ExportJob::new(
+            ExportsService::new(db.clone(), minio.clone(), jobs.clone()),
+            ArchiveService::new(db.clone(), minio.clone(), config.archive.clone()),
+            AttachmentsService::new(
+                db.clone(),
+                minio.clone(),
+                jobs.clone(),
+                config.storage.clone(),
+            ),
+        )));
+        runner.register(Arc::new(ImportJob::new(
+            ImportsService::new(db.clone(), minio.clone(), jobs.clone()),
+            LimitsService::new(db.clone(), config.limits.clone()),
+        )));
+        if config.federation.enabled {
+            runner.register(Arc::new(FederationJob::new(FederationService::new(
+                db.clone(),
+                redis.clone(),
+                config.federation.clone(),
+                jobs.clone(),
+            ))));
+        }
+        runner.register(Arc::new(BotCommandJob::new(BotsService::new(
+            db.clone(),
+            http.clone(),
+            jobs.clone(),
+        ))));
+        if config.payments.webhook_enabled() {
+            runner.register(Arc::new(PaymentWebhookJob::new(PaymentsService::new(
+                db.clone(),
+                http.clone(),
+                jobs.clone(),
+                config.payments.clone(),
+            ))));
+        }
+        if config.suggestions.enabled() {
+            runner.register(Arc::new(SuggestionsJob::new(SuggestionsService::new(
+                db.clone(),
+                http.clone(),
+                breakers.suggestions.clone(),
+                config.suggestions.clone(),
+            ))));
+        }
+        runner.register(Arc::new(OtpDeliveryJob::new(OtpDeliveryService::new(
+            db.clone(),
+            http.clone(),
+            breakers.clone(),
+            config.otp_delivery.clone(),
+            config.server.environment.clone(),
+        ))));
+        runner.register(Arc::new(PurgeWarningJob::new(
+            AccountPurgeService::new(
+                db.clone(),
+                minio.clone(),
+                jobs.clone(),
+                config.account_purge.clone(),
+                config.storage.clone(),
+                config.archive.clone(),
+            ),
+            OtpDeliveryService::new(
+                db.clone(),
+                http.clone(),
+                breakers.clone(),
+                config.otp_delivery.clone(),
+                config.server.environment.clone(),
+            ),
+            config.otp_delivery.app_name.clone(),
+        )));
+        runner.register(Arc::new(AccountPurgeJob::new(AccountPurgeService::new(
+            db.clone(),
+            minio.clone(),
+            jobs.clone(),
+            config.account_purge.clone(),
+            config.storage.clone(),
+            config.archive.clone(),
+        ))));
+        runner.register(Arc::new(DeleteObjectsJob::new(AttachmentsService::new(
+            db.clone(),
+            minio.clone(),
+            jobs.clone(),
+            config.storage.clone(),
+        ))));
+        runner.register(Arc::new(TranscodeJob::new(
+            TranscodingService::new(
+                db.clone(),
+                minio.clone(),
+                StorageService::new(db.clone(), config.storage.clone()),
+                config.transcode.clone(),
+            ),
+            config.transcode.workers,
+        )));
+        runner.start().await?;
+
+        // Attachments whose job was never queued, or whose transcoder went
+        // away, are picked up again; live leases are left alone
+        if config.transcode.workers > 0 {
+            TranscodingService::new(
+                db.clone(),
+                minio.clone(),
+                StorageService::new(db.clone(), config.storage.clone()),
+                config.transcode.clone(),
+            )
+            .queue_stalled(jobs)
+            .await?;
+        }
+    }
+
+    // The outbox dispatcher is safe to run in every process (rows are claimed
+    // with SKIP LOCKED)
+    let outbox = OutboxService::new(db.clone(), redis.clone());
+    tokio::spawn(async move {
+        outbox.run_dispatcher().await;
+    });
+
+    if config.archive.after_days > 0 {
+        let archiver = ArchiveService::new(db.clone(), minio.clone(), config.archive.clone());
+        tokio::spawn(async move {
+            archiver.run_archiver().await;
+        });
+    }
 
-    axum::serve(listener, app).await?;
+    // Deleting an attachment twice finds nothing the second time
+    if config.storage.delete_after_download && config.storage.undelivered_retention_days > 0 {
+        let sweeper = AttachmentsService::new(
+            db.clone(),
+            minio.clone(),
+            jobs.clone(),
+            config.storage.clone(),
+        );
+        tokio::spawn(async move {
+            sweeper.run_sweeper().await;
+        });
+    }
+
+    // Warnings are recorded before they are queued, so a second process only
+    // queues duplicate purges, which find nothing left to do
+    if config.account_purge.inactive_months > 0 {
+        let purge = AccountPurgeService::new(
+            db.clone(),
+            minio.clone(),
+            jobs.clone(),
+            config.account_purge.clone(),
+            config.storage.clone(),
+            config.archive.clone(),
+        );
+        tokio::spawn(async move {
+            purge.run_scheduler().await;
+        });
+    }
+
+    // Each session is closed by whichever process claims it first
+    let guests = GuestsService::new(db.clone(), redis.clone(), config.clone());
+    tokio::spawn(async move {
+        guests.run_cleanup().await;
+    });
+
+    // Reminders are claimed with SKIP LOCKED, so each goes out once
+    let calendar = CalendarService::new(db.clone());
+    let reminder_interval = config.calendar.reminder_interval;
+    tokio::spawn(async move {
+        calendar.run_reminders(reminder_interval).await;
+    });
+
+    // Partition creation is idempotent and serialized by an advisory lock
+    let partitions = PartitionService::new(db.clone(), config.database.message_partitions_ahead);
+    tokio::spawn(async move {
+        partitions.run_maintenance().await;
+    });
 
     Ok(())
 }
 
+/// Run a startup step against a dependency, retrying with a delay that
+/// starts at a second and doubles up to `retry_max_delay`, so a dependency
+/// that is briefly down at boot doesn't crash-loop the process
+async fn with_retry<T, E, F, Fut>(
+    dependency: &str,
+    config: &StartupConfig,
+    mut step: F,
+) -> Result<T, E>
+where
+    E: Display,
+    F: FnMut() -> Fut,
+    Fut: Future<Output = Result<T, E>>,
+{
+    let mut delay = Duration::from_secs(1);
+    let mut attempt = 1;
+
+    loop {
+        match step().await {
+            Ok(value) => return Ok(value),
+            Err(e) if attempt < config.retry_attempts => {
+                tracing::warn!(
+                    "{} unavailable (attempt {} of {}), retrying in {}s: {}",
+                    dependency,
+                    attempt,
+                    config.retry_attempts,
+                    delay.as_secs(),
+                    e
+                );
+                tokio::time::sleep(delay).await;
+                delay = (delay * 2).min(config.retry_max_delay);
+                attempt += 1;
+            }
+            Err(e) => return Err(e),
+        }
+    }
+}
+
 async fn health_check() -> &'static str {
     "OK"
 }
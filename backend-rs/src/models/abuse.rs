@@ -0,0 +1,48 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+/// A phone number prefix, IP range or network OTPs and registrations are
+/// refused for, typically after SMS pumping or a bot signup wave
+#[derive(Debug, Clone, Serialize, FromRow)]
+pub struct AbuseBlock {
+    pub id: Uuid,
+    pub kind: AbuseBlockKind,
+    /// E.164 prefix (`+882`), CIDR (`203.0.113.0/24`) or ASN (`64496`)
+    pub value: String,
+    pub reason: Option<String>,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "abuse_block_kind", rename_all = "snake_case")]
+#[serde(rename_all = "snake_case")]
+pub enum AbuseBlockKind {
+    PhonePrefix,
+    IpCidr,
+    Asn,
+}
+
+impl AbuseBlockKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            AbuseBlockKind::PhonePrefix => "phone_prefix",
+            AbuseBlockKind::IpCidr => "ip_cidr",
+            AbuseBlockKind::Asn => "asn",
+        }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AddAbuseBlocksRequest {
+    pub kind: AbuseBlockKind,
+    pub values: Vec<String>,
+    pub reason: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct ListAbuseBlocksQuery {
+    pub kind: Option<AbuseBlockKind>,
+}
@@ -0,0 +1,43 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::{types::Json, FromRow};
+use uuid::Uuid;
+
+use crate::services::auth::Scope;
+
+/// A personal access token a user issues to a third-party client. It acts
+/// as the user within its scopes until it expires or is revoked.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct AccessToken {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub device_id: i32,
+    pub name: String,
+    #[serde(skip_serializing)]
+    pub token_hash: String,
+    pub scopes: Json<Vec<Scope>>,
+    /// Requests per minute
+    pub rate_limit: i32,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: Option<DateTime<Utc>>,
+    pub last_used_at: Option<DateTime<Utc>>,
+    pub revoked_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateAccessTokenRequest {
+    pub name: String,
+    pub scopes: Vec<Scope>,
+    /// Requests per minute; defaults to `ACCESS_TOKEN_RATE_LIMIT`
+    pub rate_limit: Option<i32>,
+    /// Never expires when absent
+    pub expires_at: Option<DateTime<Utc>>,
+}
+
+/// A new access token and its secret, which is only ever shown here
+#[derive(Debug, Serialize)]
+pub struct CreatedAccessToken {
+    #[serde(flatten)]
+    pub access_token: AccessToken,
+    pub token: String,
+}
@@ -0,0 +1,19 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+/// An account the inactivity purge leaves alone, e.g. a shared mailbox or
+/// an account under investigation
+#[derive(Debug, Clone, Serialize, FromRow)]
+pub struct PurgeExclusion {
+    pub user_id: Uuid,
+    pub reason: Option<String>,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AddPurgeExclusionRequest {
+    pub reason: Option<String>,
+}
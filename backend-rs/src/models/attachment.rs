@@ -0,0 +1,83 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+/// A content-addressed attachment blob, keyed by the SHA-256 digest of its
+/// encrypted content
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Attachment {
+    pub id: Uuid,
+    pub digest: String,
+    #[serde(skip_serializing)]
+    pub object_key: String,
+    pub content_type: String,
+    pub size_bytes: i64,
+    pub ref_count: i32,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub transcode_status: TranscodeStatus,
+    #[serde(skip_serializing)]
+    pub transcoded_key: Option<String>,
+    pub transcoded_content_type: Option<String>,
+    pub transcode_error: Option<String>,
+    pub transcoded_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "transcode_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum TranscodeStatus {
+    None,
+    Pending,
+    Processing,
+    Completed,
+    Failed,
+}
+
+impl TranscodeStatus {
+    /// Plaintext video/audio uploads are normalized for streaming. Encrypted
+    /// blobs (application/octet-stream) are opaque to the server and skipped.
+    pub fn for_content_type(content_type: &str) -> Self {
+        if content_type.starts_with("video/") || content_type.starts_with("audio/") {
+            Self::Pending
+        } else {
+            Self::None
+        }
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct AttachmentRef {
+    pub id: Uuid,
+    pub attachment_id: Uuid,
+    pub user_id: Uuid,
+    pub created_at: DateTime<Utc>,
+    pub deliveries_declared_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AttachmentUpload {
+    pub ref_id: Uuid,
+    #[serde(flatten)]
+    pub attachment: Attachment,
+    pub url: String,
+    /// True when the content was already stored and no bytes were written
+    pub deduplicated: bool,
+}
+
+/// The conversation an attachment was sent to. Its participants may then
+/// download it and, with delete-after-download, their devices must before
+/// it can be deleted.
+#[derive(Debug, Deserialize)]
+pub struct DeclareDeliveriesRequest {
+    pub conversation_id: Uuid,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct AttachmentDeliveryStatus {
+    pub attachment_id: Uuid,
+    /// Recipient devices that haven't confirmed the download yet
+    pub pending_devices: i64,
+}
@@ -0,0 +1,22 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Backup {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub version: i32,
+    pub size_bytes: i64,
+    #[serde(skip_serializing)]
+    pub object_key: String,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct BackupWithUrl {
+    #[serde(flatten)]
+    pub backup: Backup,
+    pub download_url: String,
+}
@@ -0,0 +1,131 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+/// A bot: an account that can be added to conversations and answers slash
+/// commands through its webhook
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Bot {
+    pub id: Uuid,
+    pub name: String,
+    pub user_id: Uuid,
+    pub webhook_url: String,
+    #[serde(skip_serializing)]
+    pub signing_secret: String,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub revoked_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateBotRequest {
+    pub name: String,
+    /// Username of the account created for the bot
+    pub username: String,
+    pub webhook_url: String,
+}
+
+/// A new bot and the secret its webhook requests are signed with, which is
+/// only ever shown here
+#[derive(Debug, Serialize)]
+pub struct CreatedBot {
+    #[serde(flatten)]
+    pub bot: Bot,
+    pub signing_secret: String,
+}
+
+/// A slash command a bot handles, without the leading `/`
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct BotCommand {
+    pub bot_id: Uuid,
+    pub command: String,
+    pub description: String,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SetBotCommandsRequest {
+    pub commands: Vec<BotCommandInput>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BotCommandInput {
+    pub command: String,
+    pub description: Option<String>,
+}
+
+/// A bot in a conversation and the commands it offers there
+#[derive(Debug, Serialize)]
+pub struct ConversationBot {
+    pub bot_id: Uuid,
+    pub name: String,
+    pub user_id: Uuid,
+    pub username: String,
+    pub commands: Vec<BotCommand>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AddBotRequest {
+    pub bot_id: Uuid,
+}
+
+/// `text` is the command line: `/command args` or `/command@username args`
+#[derive(Debug, Deserialize)]
+pub struct SubmitCommandRequest {
+    pub text: String,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "bot_invocation_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum BotInvocationStatus {
+    Pending,
+    Completed,
+    Failed,
+}
+
+/// One command sent to a bot. The reply arrives later as a `bot_reply`
+/// system message.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct BotInvocation {
+    pub id: Uuid,
+    pub bot_id: Uuid,
+    pub conversation_id: Uuid,
+    pub user_id: Uuid,
+    pub command: String,
+    pub args: String,
+    pub status: BotInvocationStatus,
+    pub error: Option<String>,
+    pub reply_message_id: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub completed_at: Option<DateTime<Utc>>,
+}
+
+/// What the bot's webhook is sent
+#[derive(Debug, Serialize)]
+pub struct BotWebhookRequest {
+    pub invocation_id: Uuid,
+    pub command: String,
+    pub args: String,
+    pub conversation_id: Uuid,
+    pub user_id: Uuid,
+    pub user_display_name: String,
+    pub sent_at: DateTime<Utc>,
+}
+
+/// What the bot's webhook answers with; an empty body posts nothing
+#[derive(Debug, Deserialize)]
+pub struct BotReply {
+    pub text: String,
+    #[serde(default)]
+    pub actions: Vec<BotAction>,
+}
+
+/// A button under a bot reply that submits another command
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, TS)]
+pub struct BotAction {
+    pub label: String,
+    /// Command line to submit when pressed, e.g. `/weather tomorrow`
+    pub command: String,
+}
@@ -0,0 +1,115 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+use super::{ConversationEvent, Message};
+
+/// A service account for a bridge to another chat network. The bridge
+/// authenticates with its own token and relays messages as `user_id`.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Bridge {
+    pub id: Uuid,
+    pub name: String,
+    pub user_id: Uuid,
+    #[serde(skip_serializing)]
+    pub token_hash: String,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub last_used_at: Option<DateTime<Utc>>,
+    pub revoked_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateBridgeRequest {
+    pub name: String,
+    pub user_id: Uuid,
+}
+
+/// A new bridge and its service token, which is only ever shown here
+#[derive(Debug, Serialize)]
+pub struct CreatedBridge {
+    #[serde(flatten)]
+    pub bridge: Bridge,
+    pub token: String,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "bridge_direction", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum BridgeDirection {
+    /// Relayed in from the other network
+    Inbound,
+    /// Mirrored out to the other network
+    Outbound,
+}
+
+/// A conversation mirrored to a room on the other network
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct BridgedConversation {
+    pub bridge_id: Uuid,
+    pub conversation_id: Uuid,
+    pub external_id: String,
+    pub created_at: DateTime<Utc>,
+}
+
+/// A message mirrored to or from an event on the other network
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct BridgedMessage {
+    pub bridge_id: Uuid,
+    pub message_id: Uuid,
+    pub conversation_id: Uuid,
+    pub external_id: String,
+    pub direction: BridgeDirection,
+    pub external_sender: Option<String>,
+    pub sender_name: Option<String>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct LinkConversationRequest {
+    pub external_id: String,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct MapMessageRequest {
+    pub external_id: String,
+}
+
+/// A message relayed in from the other network. `external_id` doubles as
+/// an idempotency key: relaying the same event again returns the message
+/// created the first time.
+#[derive(Debug, Deserialize)]
+pub struct RelayMessageRequest {
+    pub external_id: String,
+    pub external_sender: String,
+    pub sender_name: Option<String>,
+    #[serde(rename = "type")]
+    pub message_type: String,
+    pub content: Vec<u8>,
+    pub reply_to_id: Option<Uuid>,
+    pub format_version: Option<i16>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RelayedMessage {
+    pub message: Message,
+    pub mapping: BridgedMessage,
+}
+
+/// A conversation event as the bridge sees it, with the remote id of the
+/// message it concerns when one is mapped
+#[derive(Debug, Serialize, FromRow)]
+pub struct BridgeEvent {
+    #[serde(flatten)]
+    #[sqlx(flatten)]
+    pub event: ConversationEvent,
+    pub external_id: Option<String>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct BridgeEventPage {
+    pub events: Vec<BridgeEvent>,
+    /// Pass back as `since`; it moves past suppressed echoes too
+    pub cursor: i64,
+}
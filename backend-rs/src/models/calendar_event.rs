@@ -0,0 +1,76 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "rsvp_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum RsvpStatus {
+    Going,
+    Maybe,
+    Declined,
+}
+
+/// An event scheduled in a group, with its RSVP counts
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct CalendarEvent {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub created_by: Uuid,
+    /// The `event_scheduled` system message that shows the event in the chat
+    pub message_id: Option<Uuid>,
+    pub title: String,
+    pub starts_at: DateTime<Utc>,
+    pub ends_at: Option<DateTime<Utc>>,
+    /// Whatever the client put there: an address, coordinates, a link
+    pub location: Option<serde_json::Value>,
+    /// 0 = no reminder
+    pub remind_minutes_before: i32,
+    pub reminded_at: Option<DateTime<Utc>>,
+    pub cancelled_at: Option<DateTime<Utc>>,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+    pub going: i64,
+    pub maybe: i64,
+    pub declined: i64,
+    /// The caller's own answer
+    pub my_rsvp: Option<RsvpStatus>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct EventRsvp {
+    pub user_id: Uuid,
+    pub status: RsvpStatus,
+    pub updated_at: DateTime<Utc>,
+}
+
+/// An event and everyone's answers
+#[derive(Debug, Serialize)]
+pub struct CalendarEventWithRsvps {
+    #[serde(flatten)]
+    pub event: CalendarEvent,
+    pub rsvps: Vec<EventRsvp>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateCalendarEventRequest {
+    pub title: String,
+    pub starts_at: DateTime<Utc>,
+    pub ends_at: Option<DateTime<Utc>>,
+    pub location: Option<serde_json::Value>,
+    /// Defaults to 15; 0 turns the reminder off
+    pub remind_minutes_before: Option<i32>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct RsvpRequest {
+    pub status: RsvpStatus,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CalendarEventsQuery {
+    /// Events starting at or after this time; defaults to now
+    pub from: Option<DateTime<Utc>>,
+    pub limit: Option<i64>,
+}
@@ -0,0 +1,73 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::{types::Json, FromRow};
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "call_outcome", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum CallOutcome {
+    /// Someone picked up
+    Completed,
+    /// Rang out unanswered
+    Missed,
+    Declined,
+    /// The caller hung up before anyone answered
+    Cancelled,
+    Failed,
+}
+
+/// What the caller's client offered. A call with neither video nor screen
+/// sharing is audio-only.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CallCapabilities {
+    #[serde(default)]
+    pub video: bool,
+    #[serde(default)]
+    pub screenshare: bool,
+    /// Codec names in the caller's order of preference, e.g. `opus`, `vp8`
+    #[serde(default)]
+    pub codecs: Vec<String>,
+}
+
+/// A finished call, as reported by the caller's client
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Call {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub caller_id: Uuid,
+    pub video: bool,
+    pub outcome: CallOutcome,
+    pub started_at: DateTime<Utc>,
+    pub answered_at: Option<DateTime<Utc>>,
+    pub ended_at: DateTime<Utc>,
+    /// From answer to hang-up; 0 for calls nobody answered
+    pub duration_seconds: i64,
+    /// Who was on the call besides the caller
+    pub participant_ids: Vec<Uuid>,
+    pub capabilities: Json<CallCapabilities>,
+    pub created_at: DateTime<Utc>,
+}
+
+/// `id` is chosen by the client so a retried report is recorded once
+#[derive(Debug, Deserialize)]
+pub struct ReportCallRequest {
+    pub id: Uuid,
+    #[serde(default)]
+    pub video: bool,
+    pub outcome: CallOutcome,
+    pub started_at: DateTime<Utc>,
+    pub answered_at: Option<DateTime<Utc>>,
+    pub ended_at: DateTime<Utc>,
+    /// Who joined, not counting the caller
+    #[serde(default)]
+    pub participant_ids: Vec<Uuid>,
+    #[serde(default)]
+    pub capabilities: CallCapabilities,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CallsQuery {
+    pub before: Option<DateTime<Utc>>,
+    pub limit: Option<i64>,
+}
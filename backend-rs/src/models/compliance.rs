@@ -0,0 +1,44 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct AuditLog {
+    pub id: Uuid,
+    pub actor_id: Option<Uuid>,
+    pub action: String,
+    pub target_type: String,
+    pub target_id: Option<String>,
+    pub metadata: serde_json::Value,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct LegalHold {
+    pub id: Uuid,
+    pub target_type: LegalHoldTarget,
+    pub target_id: Uuid,
+    pub reason: String,
+    pub placed_by: Uuid,
+    pub placed_at: DateTime<Utc>,
+    pub released_by: Option<Uuid>,
+    pub released_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "legal_hold_target", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum LegalHoldTarget {
+    User,
+    Conversation,
+}
+
+impl LegalHoldTarget {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::User => "user",
+            Self::Conversation => "conversation",
+        }
+    }
+}
@@ -1,11 +1,12 @@
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::FromRow;
+use ts_rs::TS;
 use uuid::Uuid;
 
 use super::User;
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct Contact {
     pub id: Uuid,
     pub user_id: Uuid,
@@ -15,11 +16,36 @@ pub struct Contact {
     pub is_favorite: bool,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
+    /// Bumped whenever the contact changes; see `If-Match` on updates
+    pub version: i32,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
 pub struct ContactWithUser {
     #[serde(flatten)]
     pub contact: Contact,
     pub user: Option<User>,
 }
+
+/// Address book sync results, one entry per matched user
+#[derive(Debug, Clone, Serialize)]
+pub struct ContactSyncResult {
+    pub matches: Vec<ContactMatch>,
+    /// Matched users the client likely holds as several address book
+    /// entries, e.g. one for their phone and one for their email
+    pub merge_hints: Vec<MergeHint>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct ContactMatch {
+    pub user: User,
+    /// The submitted identifiers that matched this user
+    pub identifiers: Vec<String>,
+    pub is_contact: bool,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct MergeHint {
+    pub user_id: Uuid,
+    pub identifiers: Vec<String>,
+}
@@ -1,9 +1,12 @@
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::FromRow;
+use ts_rs::TS;
 use uuid::Uuid;
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+use super::ImportSource;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct Conversation {
     pub id: Uuid,
     #[serde(rename = "type")]
@@ -11,12 +14,20 @@ pub struct Conversation {
     pub name: Option<String>,
     pub avatar_url: Option<String>,
     pub created_by: Uuid,
+    pub workspace_id: Option<Uuid>,
     pub last_message_at: Option<DateTime<Utc>>,
+    pub slow_mode_seconds: i32,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
+    /// Settings version; new messages don't change it
+    pub version: i32,
+    /// Set on read-only conversations imported from another app
+    pub imported_from: Option<ImportSource>,
+    /// Whether participants may create share links
+    pub share_links_enabled: bool,
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "conversation_type", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum ConversationType {
@@ -24,7 +35,7 @@ pub enum ConversationType {
     Group,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct Participant {
     pub id: Uuid,
     pub conversation_id: Uuid,
@@ -33,9 +44,37 @@ pub struct Participant {
     pub joined_at: DateTime<Utc>,
     pub left_at: Option<DateTime<Utc>>,
     pub muted_until: Option<DateTime<Utc>>,
+    pub request_status: Option<MessageRequestStatus>,
+    /// Messages created up to this time have been delivered to the participant
+    pub delivered_up_to: Option<DateTime<Utc>>,
+    /// Messages created up to this time have been read by the participant.
+    /// Hidden from others when the participant doesn't share read receipts.
+    pub read_up_to: Option<DateTime<Utc>>,
+    /// Overrides the user's account-wide `read_receipts` in this
+    /// conversation; `None` follows it
+    pub read_receipts: Option<bool>,
+}
+
+impl Participant {
+    /// Whether other participants may see this participant's reads, given
+    /// the user's account-wide setting
+    pub fn shares_read_receipts(&self, account_read_receipts: bool) -> bool {
+        self.read_receipts.unwrap_or(account_read_receipts)
+    }
+}
+
+/// State of a conversation started by someone the participant hasn't added
+/// as a contact
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "message_request_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum MessageRequestStatus {
+    Pending,
+    Accepted,
+    Blocked,
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "participant_role", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum ParticipantRole {
@@ -44,18 +83,80 @@ pub enum ParticipantRole {
     Member,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// A rejected entry in a group member list
+#[derive(Debug, Clone, Serialize)]
+pub struct InvalidMember {
+    pub id: String,
+    pub reason: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
 pub struct ConversationWithDetails {
     #[serde(flatten)]
     pub conversation: Conversation,
     pub participants: Vec<ParticipantWithUser>,
+    #[ts(type = "number")]
     pub unread_count: i64,
     pub last_message: Option<super::Message>,
+    /// The viewer marked the conversation unread; cleared once they read it
+    pub marked_unread: bool,
+    /// When the viewer flagged the conversation, if they did
+    pub flagged_at: Option<DateTime<Utc>>,
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// The viewer's own list state for a conversation, synced to their other
+/// devices as a `conversation_state` event
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct ConversationState {
+    pub conversation_id: Uuid,
+    pub marked_unread: bool,
+    pub flagged_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
 pub struct ParticipantWithUser {
     #[serde(flatten)]
     pub participant: Participant,
     pub user: Option<super::User>,
 }
+
+/// A conversation found by search, with what matched so clients can
+/// highlight it
+#[derive(Debug, Clone, Serialize)]
+pub struct ConversationSearchResult {
+    #[serde(flatten)]
+    pub conversation: ConversationWithDetails,
+    pub matches: Vec<SearchMatch>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct SearchMatch {
+    /// `name`, `display_name` or `username`
+    pub field: &'static str,
+    /// The participant whose name matched; `None` for the group name
+    pub user_id: Option<Uuid>,
+    /// Offset and length of the match in the field, in characters
+    pub start: usize,
+    pub length: usize,
+}
+
+impl SearchMatch {
+    /// Case-insensitive match of `query` in `value`, if any
+    pub fn find(
+        field: &'static str,
+        user_id: Option<Uuid>,
+        value: &str,
+        query: &str,
+    ) -> Option<Self> {
+        let value = value.to_lowercase();
+        let query = query.to_lowercase();
+        let byte_start = value.find(&query)?;
+
+        Some(Self {
+            field,
+            user_id,
+            start: value[..byte_start].chars().count(),
+            length: query.chars().count(),
+        })
+    }
+}
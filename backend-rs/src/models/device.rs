@@ -1,9 +1,10 @@
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::FromRow;
+use ts_rs::TS;
 use uuid::Uuid;
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct Device {
     pub id: Uuid,
     pub user_id: Uuid,
@@ -14,3 +15,30 @@ pub struct Device {
     pub last_active_at: DateTime<Utc>,
     pub created_at: DateTime<Utc>,
 }
+
+/// Which of a user's devices get push notifications
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "notification_routing", rename_all = "snake_case")]
+#[serde(rename_all = "snake_case")]
+pub enum NotificationRouting {
+    /// Every device with a push token
+    All,
+    /// Only the device that was active most recently
+    MostRecent,
+    /// No pushes while a desktop client holds a WebSocket open
+    NoneWhileDesktop,
+}
+
+impl Default for NotificationRouting {
+    fn default() -> Self {
+        Self::All
+    }
+}
+
+#[derive(Debug, Clone, Serialize, TS)]
+pub struct DeviceWithRouting {
+    #[serde(flatten)]
+    pub device: Device,
+    /// Whether the push dispatcher would notify this device right now
+    pub receives_push: bool,
+}
@@ -0,0 +1,35 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+/// A domain email OTPs and registrations are refused for, typically a
+/// disposable mail provider
+#[derive(Debug, Clone, Serialize, FromRow)]
+pub struct BlockedEmailDomain {
+    pub domain: String,
+    pub reason: Option<String>,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct BlockEmailDomainsRequest {
+    pub domains: Vec<String>,
+    pub reason: Option<String>,
+}
+
+/// Why an email address was refused; sent as `details.reason`
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EmailRejection {
+    /// Not a syntactically valid address
+    Syntax,
+    /// The domain has no mail server (no MX, null MX, or no address at all)
+    NoMailServer,
+    /// The domain is on the disposable-domain blocklist
+    DisposableDomain,
+    /// Registration requires a phone number or an address in one of
+    /// `REGISTRATION_EMAIL_DOMAINS`
+    DomainNotAllowed,
+}
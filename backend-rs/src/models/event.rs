@@ -0,0 +1,135 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+// Conversation event types
+pub const EVENT_CONVERSATION_CREATED: &str = "conversation.created";
+pub const EVENT_CONVERSATION_UPDATED: &str = "conversation.updated";
+pub const EVENT_MESSAGE_CREATED: &str = "message.created";
+pub const EVENT_MESSAGE_DELETED: &str = "message.deleted";
+pub const EVENT_MEMBER_JOINED: &str = "member.joined";
+pub const EVENT_MEMBER_LEFT: &str = "member.left";
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ConversationEvent {
+    pub conversation_id: Uuid,
+    pub seq: i64,
+    pub event_type: String,
+    pub actor_id: Option<Uuid>,
+    pub payload: serde_json::Value,
+    pub created_at: DateTime<Utc>,
+}
+
+/// An event in a user's realtime queue, as served to polling clients. `id`
+/// is the resume cursor.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct QueuedEvent {
+    pub id: i64,
+    #[serde(rename = "type")]
+    pub event_type: String,
+    pub payload: serde_json::Value,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct PollResponse {
+    pub events: Vec<QueuedEvent>,
+    /// Pass back as `cursor` on the next poll
+    pub cursor: i64,
+}
+
+/// Health of the realtime queue, for spotting late delivery
+#[derive(Debug, Serialize)]
+pub struct RealtimeQueueStats {
+    /// Events not yet published to Redis
+    pub pending: i64,
+    /// Events given up on after repeated failed publishes
+    pub failed: i64,
+    /// The oldest of them, if any
+    pub oldest_pending: Option<PendingEvent>,
+    /// How long events took from being queued to being published, over
+    /// the last `window_seconds`
+    pub delivery_lag: DeliveryLag,
+    /// Typing and presence publishes this process gave up on
+    pub dropped_publishes: u64,
+    /// Users with the most pending events, or just the requested user
+    pub recipients: Vec<RecipientBacklog>,
+}
+
+#[derive(Debug, Serialize, FromRow)]
+pub struct PendingEvent {
+    pub id: i64,
+    pub recipient_id: Uuid,
+    pub event_type: String,
+    pub attempts: i32,
+    pub created_at: DateTime<Utc>,
+    pub age_seconds: f64,
+}
+
+#[derive(Debug, Serialize, FromRow)]
+pub struct DeliveryLag {
+    pub window_seconds: i32,
+    pub sample_size: i64,
+    pub avg_seconds: Option<f64>,
+    pub p95_seconds: Option<f64>,
+    pub max_seconds: Option<f64>,
+}
+
+#[derive(Debug, Serialize, FromRow)]
+pub struct RecipientBacklog {
+    pub user_id: Uuid,
+    pub pending: i64,
+    pub oldest_pending_at: DateTime<Utc>,
+    /// Failed publish attempts of the most-retried pending event
+    pub max_attempts: i32,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct RealtimeQueueQuery {
+    pub user_id: Option<Uuid>,
+    pub limit: Option<i64>,
+}
+
+/// Time from send to first delivered receipt, for messages sent in the last
+/// `window_seconds`
+#[derive(Debug, Serialize, FromRow)]
+pub struct DeliverySla {
+    pub window_seconds: i32,
+    /// Messages delivered to at least one recipient
+    pub delivered: i64,
+    /// Messages no recipient has received yet
+    pub undelivered: i64,
+    pub p50_seconds: Option<f64>,
+    pub p95_seconds: Option<f64>,
+    pub p99_seconds: Option<f64>,
+    pub max_seconds: Option<f64>,
+}
+
+/// A message no recipient has received. Only metadata: never the content.
+#[derive(Debug, Serialize, FromRow)]
+pub struct StuckMessage {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub sender_id: Uuid,
+    pub created_at: DateTime<Utc>,
+    pub age_seconds: f64,
+    /// Participants who should have received it
+    pub recipients: i64,
+    /// Of those, how many had a device active since it was sent. Stuck
+    /// messages with active recipients point at a failed fan-out rather than
+    /// recipients being offline.
+    pub active_recipients: i64,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DeliverySlaQuery {
+    pub window_minutes: Option<i32>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct StuckMessagesQuery {
+    /// Minimum age; younger messages may just be in flight
+    pub older_than_minutes: Option<i32>,
+    pub limit: Option<i64>,
+}
@@ -0,0 +1,71 @@
+use std::collections::HashMap;
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ConversationExport {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub requested_by: Uuid,
+    pub status: ExportStatus,
+    pub format: ExportFormat,
+    /// Offset of the requester's local time from UTC, for timestamps in
+    /// text transcripts
+    pub utc_offset_minutes: i32,
+    pub progress: i32,
+    #[serde(skip_serializing)]
+    pub object_key: Option<String>,
+    pub error: Option<String>,
+    pub created_at: DateTime<Utc>,
+    pub completed_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "export_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum ExportStatus {
+    Pending,
+    Processing,
+    Completed,
+    Failed,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "export_format", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum ExportFormat {
+    /// A zip of conversation metadata and every message, with the content
+    /// of the attachments the requester can download
+    Json,
+    /// The plain-text layout of WhatsApp's "Export chat", for importing
+    /// into other apps
+    Whatsapp,
+}
+
+impl Default for ExportFormat {
+    fn default() -> Self {
+        Self::Json
+    }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct ExportConversationRequest {
+    #[serde(default)]
+    pub format: ExportFormat,
+    #[serde(default)]
+    pub utc_offset_minutes: i32,
+    /// Message text the client has decrypted, by message id. Messages it
+    /// leaves out are exported without their text.
+    #[serde(default)]
+    pub plaintext: HashMap<Uuid, String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ConversationExportWithUrl {
+    #[serde(flatten)]
+    pub export: ConversationExport,
+    pub download_url: Option<String>,
+}
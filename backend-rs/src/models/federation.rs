@@ -0,0 +1,98 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+use super::{MessageRequestStatus, MessageType};
+
+/// A message exchanged with a user on another server
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct FederatedMessage {
+    pub id: Uuid,
+    pub direction: FederationDirection,
+    pub user_id: Uuid,
+    pub remote_address: String,
+    #[serde(rename = "type")]
+    pub message_type: MessageType,
+    pub content: Vec<u8>,
+    pub status: FederationStatus,
+    pub error: Option<String>,
+    /// `pending` while an inbound sender is still a message request
+    pub request_status: Option<MessageRequestStatus>,
+    pub created_at: DateTime<Utc>,
+    pub delivered_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "federation_direction", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum FederationDirection {
+    Inbound,
+    Outbound,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "federation_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum FederationStatus {
+    Pending,
+    Delivered,
+    Failed,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct SendFederatedMessageRequest {
+    /// Recipient as `username@domain`
+    pub to: String,
+    #[serde(rename = "type", default)]
+    pub message_type: MessageType,
+    pub content: Vec<u8>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct FederatedMessagesQuery {
+    /// Only messages with this remote address
+    pub with: Option<String>,
+    pub before: Option<DateTime<Utc>>,
+    pub limit: Option<i64>,
+}
+
+/// Claims of a signed server-to-server envelope (an EdDSA JWS signed with
+/// the origin server's federation key)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FederationEnvelope {
+    /// Origin domain
+    pub iss: String,
+    /// Destination domain
+    pub aud: String,
+    pub iat: i64,
+    pub exp: i64,
+    /// Envelope id; receivers store each one once
+    pub jti: Uuid,
+    /// Sender as `username@origin`
+    pub from: String,
+    /// Recipient as `username@destination`
+    pub to: String,
+    #[serde(rename = "type")]
+    pub message_type: MessageType,
+    /// Base64 ciphertext, passed through untouched
+    pub content: String,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct InboundEnvelope {
+    /// The compact JWS
+    pub envelope: String,
+}
+
+/// Served at `/.well-known/ansible-talk/federation`: who this server is and
+/// the public keys its envelopes are signed with
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct FederationDocument {
+    pub domain: String,
+    /// Path of the inbound relay endpoint on this host
+    pub inbox: String,
+    /// Ed25519 JWKs
+    pub keys: Vec<serde_json::Value>,
+}
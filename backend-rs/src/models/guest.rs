@@ -0,0 +1,64 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+use super::{ConversationWithDetails, User};
+
+/// Lets a website chat widget start guest sessions in a workspace. Guests
+/// talk to the members of `support_conversation_id`.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct WidgetToken {
+    pub id: Uuid,
+    pub workspace_id: Uuid,
+    pub name: String,
+    pub support_conversation_id: Uuid,
+    #[serde(skip_serializing)]
+    pub token_hash: String,
+    pub created_by: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub last_used_at: Option<DateTime<Utc>>,
+    pub revoked_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateWidgetTokenRequest {
+    pub name: String,
+    pub support_conversation_id: Uuid,
+}
+
+/// A new widget token, which is only ever shown here
+#[derive(Debug, Serialize)]
+pub struct CreatedWidgetToken {
+    #[serde(flatten)]
+    pub widget_token: WidgetToken,
+    pub token: String,
+}
+
+/// A guest account and the one conversation it may use
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct GuestSession {
+    pub user_id: Uuid,
+    pub widget_token_id: Uuid,
+    pub conversation_id: Uuid,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    pub ended_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct StartGuestSessionRequest {
+    pub widget_token: String,
+    /// Shown to support staff; defaults to `Guest`
+    pub display_name: Option<String>,
+}
+
+/// A started guest session. The access token can't be refreshed and stops
+/// working when the session expires or ends.
+#[derive(Debug, Serialize)]
+pub struct StartedGuestSession {
+    pub access_token: String,
+    pub expires_at: DateTime<Utc>,
+    pub user: User,
+    pub conversation: ConversationWithDetails,
+}
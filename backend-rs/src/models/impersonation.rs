@@ -0,0 +1,44 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+/// An admin's request to view a user's account read-only. The user approves
+/// or denies it; an approved impersonation can be used until `expires_at`
+/// or until the user revokes it.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct Impersonation {
+    pub id: Uuid,
+    pub admin_id: Uuid,
+    pub user_id: Uuid,
+    pub reason: String,
+    pub status: ImpersonationStatus,
+    pub created_at: DateTime<Utc>,
+    pub responded_at: Option<DateTime<Utc>>,
+    pub expires_at: Option<DateTime<Utc>>,
+    pub token_issued_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "impersonation_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum ImpersonationStatus {
+    Pending,
+    Approved,
+    Denied,
+    Revoked,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct RequestImpersonationRequest {
+    pub user_id: Uuid,
+    pub reason: String,
+}
+
+/// A read-only access token acting as the impersonated user
+#[derive(Debug, Clone, Serialize)]
+pub struct ImpersonationToken {
+    pub access_token: String,
+    pub expires_at: DateTime<Utc>,
+}
@@ -0,0 +1,88 @@
+use std::collections::HashMap;
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+use super::ExportStatus;
+
+/// An import of another app's chat export, processed in the background
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ConversationImport {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    /// Detected from the archive once processing starts
+    pub source: Option<ImportSource>,
+    pub status: ExportStatus,
+    pub progress: i32,
+    /// The read-only conversation, once completed
+    pub conversation_id: Option<Uuid>,
+    pub message_count: i32,
+    #[serde(skip_serializing)]
+    pub object_key: Option<String>,
+    pub error: Option<String>,
+    pub created_at: DateTime<Utc>,
+    pub completed_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "import_source", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum ImportSource {
+    Whatsapp,
+    Telegram,
+}
+
+/// Field order of numeric dates in a WhatsApp export, which follows the
+/// exporting phone's locale
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DateOrder {
+    Dmy,
+    Mdy,
+}
+
+/// The `options` part of an import upload
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ImportOptions {
+    /// Name of the imported conversation; defaults to the chat's name in
+    /// the export
+    pub name: Option<String>,
+    /// How the importing user appears in the export
+    pub self_name: Option<String>,
+    /// Offset from UTC of the exporting device, for exports with local
+    /// timestamps
+    #[serde(default)]
+    pub utc_offset_minutes: i32,
+    /// Detected from the dates when omitted
+    pub date_order: Option<DateOrder>,
+    /// Sender names mapped to users explicitly
+    #[serde(default)]
+    pub participants: HashMap<String, Uuid>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ImportParticipant {
+    pub name: String,
+    /// `None` for a placeholder that matched no user
+    pub user_id: Option<Uuid>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ImportedMessage {
+    pub id: i64,
+    /// `None` for notices from the source app
+    pub sender_name: Option<String>,
+    pub text: String,
+    /// File name of an attachment, which is not imported
+    pub media_name: Option<String>,
+    pub sent_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ImportedHistory {
+    pub participants: Vec<ImportParticipant>,
+    pub messages: Vec<ImportedMessage>,
+}
@@ -0,0 +1,38 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct UserLimitOverride {
+    pub user_id: Uuid,
+    pub max_group_members: Option<i32>,
+    pub max_conversations: Option<i32>,
+    pub max_devices: Option<i32>,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+}
+
+/// Limits in force for a user after applying any override
+#[derive(Debug, Clone, Serialize)]
+pub struct EffectiveLimits {
+    pub max_group_members: i64,
+    pub max_conversations: i64,
+    pub max_devices: i64,
+}
+
+#[derive(Debug, Serialize)]
+pub struct UserLimits {
+    pub user_id: Uuid,
+    pub limits: EffectiveLimits,
+    #[serde(rename = "override")]
+    pub limit_override: Option<UserLimitOverride>,
+}
+
+/// Override values; omitted fields fall back to the global default
+#[derive(Debug, Deserialize)]
+pub struct UpdateUserLimits {
+    pub max_group_members: Option<i32>,
+    pub max_conversations: Option<i32>,
+    pub max_devices: Option<i32>,
+}
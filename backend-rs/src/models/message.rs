@@ -1,9 +1,12 @@
-use chrono::{DateTime, Utc};
+use chrono::{DateTime, Duration, Utc};
 use serde::{Deserialize, Serialize};
-use sqlx::FromRow;
-use uuid::Uuid;
+use sqlx::{types::Json, FromRow};
+use ts_rs::TS;
+use uuid::{Uuid, Version};
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+use super::{BotAction, PaymentStatus};
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct Message {
     pub id: Uuid,
     pub conversation_id: Uuid,
@@ -13,13 +16,74 @@ pub struct Message {
     pub content: Vec<u8>,
     pub sticker_id: Option<Uuid>,
     pub reply_to_id: Option<Uuid>,
+    /// Version of the formatting schema the encrypted payload uses for its
+    /// ranges (bold, italic, spoiler, code, mentions); `None` for plain text
+    pub format_version: Option<i16>,
+    /// What happened, for `system` messages; these are generated by the
+    /// server and carry no encrypted content
+    #[ts(as = "Option<SystemEvent>")]
+    pub system_event: Option<Json<SystemEvent>>,
     pub status: MessageStatus,
     pub edited_at: Option<DateTime<Utc>>,
     pub deleted_at: Option<DateTime<Utc>>,
     pub created_at: DateTime<Utc>,
+    /// Position in the conversation, for `?since_seq=`; missing on messages
+    /// archived before sequence numbers existed
+    #[serde(default)]
+    #[ts(type = "number | null")]
+    pub seq: Option<i64>,
+    /// Metadata of the message replied to, filled in by the service while it
+    /// is still visible
+    #[sqlx(skip)]
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    #[ts(optional)]
+    pub reply_to: Option<QuotedMessage>,
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+/// The minimum a client needs to render a quote before it has decrypted (or
+/// if it can no longer find) the original
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct QuotedMessage {
+    pub id: Uuid,
+    pub sender_id: Uuid,
+    #[serde(rename = "type")]
+    pub message_type: MessageType,
+    pub created_at: DateTime<Utc>,
+}
+
+/// Newest formatting schema version the server accepts. The ranges live
+/// inside the encrypted payload, so only the version is checked here.
+pub const MAX_FORMAT_VERSION: i16 = 1;
+
+impl Message {
+    /// New messages get UUIDv7 ids, stamped with the same millisecond that
+    /// goes into `created_at` (the partition key of the messages table)
+    pub fn new_id() -> (Uuid, DateTime<Utc>) {
+        let id = Uuid::now_v7();
+        let (created_at, _) = Self::created_at_range(id);
+        (id, created_at)
+    }
+
+    /// The half-open `created_at` range a message with this id falls in, so
+    /// lookups by id only touch one partition. Ids from before partitioning
+    /// are random, so those messages could be anywhere in the past.
+    pub fn created_at_range(id: Uuid) -> (DateTime<Utc>, DateTime<Utc>) {
+        let created_at = match id.get_version() {
+            Some(Version::SortRand) => id.get_timestamp().and_then(|ts| {
+                let (secs, nanos) = ts.to_unix();
+                DateTime::from_timestamp(secs as i64, nanos)
+            }),
+            _ => None,
+        };
+
+        match created_at {
+            Some(created_at) => (created_at, created_at + Duration::milliseconds(1)),
+            None => (DateTime::UNIX_EPOCH, Utc::now() + Duration::days(1)),
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "message_type", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum MessageType {
@@ -38,7 +102,62 @@ impl Default for MessageType {
     }
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+/// The catalog of system messages. Payloads are structured rather than
+/// rendered text so clients can localize them; the acting user is the
+/// message's `sender_id`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, TS)]
+#[serde(tag = "kind", rename_all = "snake_case")]
+pub enum SystemEvent {
+    MemberAdded { user_ids: Vec<Uuid> },
+    MemberLeft { user_id: Uuid },
+    NameChanged { name: String },
+    CallMissed { caller_id: Uuid, video: bool },
+    /// A calendar event was created; clients render it inline from the
+    /// event's id
+    EventScheduled {
+        event_id: Uuid,
+        title: String,
+        starts_at: DateTime<Utc>,
+    },
+    EventCancelled { event_id: Uuid, title: String },
+    /// `payer_id` was asked for money; the request's state lives at
+    /// `/conversations/:id/payment-requests/:payment_request_id`
+    PaymentRequested {
+        payment_request_id: Uuid,
+        payer_id: Uuid,
+        #[ts(type = "number")]
+        amount_minor: i64,
+        currency: String,
+    },
+    PaymentStatusChanged {
+        payment_request_id: Uuid,
+        status: PaymentStatus,
+    },
+    TaskCreated {
+        task_id: Uuid,
+        title: String,
+        assignee_id: Option<Uuid>,
+    },
+    /// `assignee_id` is `None` when the task was unassigned
+    TaskAssigned {
+        task_id: Uuid,
+        title: String,
+        assignee_id: Option<Uuid>,
+    },
+    TaskCompleted { task_id: Uuid, title: String },
+    TaskReopened { task_id: Uuid, title: String },
+    DisappearingTimerChanged { seconds: i32 },
+    /// A bot's answer to a slash command; sent by the bot's account
+    BotReply {
+        invocation_id: Uuid,
+        invoked_by: Uuid,
+        command: String,
+        text: String,
+        actions: Vec<BotAction>,
+    },
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "message_status", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum MessageStatus {
@@ -55,14 +174,13 @@ impl Default for MessageStatus {
     }
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+/// How far one recipient has got with a message, derived from their
+/// delivered/read pointers
+#[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Receipt {
-    pub id: Uuid,
-    pub message_id: Uuid,
     pub user_id: Uuid,
     #[serde(rename = "type")]
     pub receipt_type: ReceiptType,
-    pub created_at: DateTime<Utc>,
 }
 
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
@@ -73,6 +191,20 @@ pub enum ReceiptType {
     Read,
 }
 
+/// Aggregate delivery state of a message across its recipients
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DeliveryReport {
+    pub message_id: Uuid,
+    /// `read` once every recipient has read it, `delivered` once every
+    /// recipient has received it, otherwise `sent`
+    pub status: MessageStatus,
+    pub recipients: i64,
+    pub delivered: i64,
+    pub read: i64,
+    /// Per-recipient breakdown; only the sender gets it
+    pub receipts: Option<Vec<Receipt>>,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct MessageWithSender {
     #[serde(flatten)]
@@ -5,6 +5,39 @@ pub mod conversation;
 pub mod message;
 pub mod sticker;
 pub mod signal_keys;
+pub mod flag;
+pub mod workspace;
+pub mod export;
+pub mod import;
+pub mod compliance;
+pub mod backup;
+pub mod storage;
+pub mod attachment;
+pub mod event;
+pub mod spam;
+pub mod limits;
+pub mod runtime_config;
+pub mod translation;
+pub mod email;
+pub mod impersonation;
+pub mod abuse;
+pub mod bridge;
+pub mod federation;
+pub mod access_token;
+pub mod watermark;
+pub mod account_purge;
+pub mod usage;
+pub mod realtime;
+pub mod guest;
+pub mod share_link;
+pub mod profile_post;
+pub mod bot;
+pub mod call;
+pub mod calendar_event;
+pub mod payment;
+pub mod note;
+pub mod task;
+pub mod region;
 
 pub use user::*;
 pub use device::*;
@@ -13,3 +46,36 @@ pub use conversation::*;
 pub use message::*;
 pub use sticker::*;
 pub use signal_keys::*;
+pub use flag::*;
+pub use workspace::*;
+pub use export::*;
+pub use import::*;
+pub use compliance::*;
+pub use backup::*;
+pub use storage::*;
+pub use attachment::*;
+pub use event::*;
+pub use spam::*;
+pub use limits::*;
+pub use runtime_config::*;
+pub use translation::*;
+pub use email::*;
+pub use impersonation::*;
+pub use abuse::*;
+pub use bridge::*;
+pub use federation::*;
+pub use access_token::*;
+pub use watermark::*;
+pub use account_purge::*;
+pub use usage::*;
+pub use realtime::*;
+pub use guest::*;
+pub use share_link::*;
+pub use profile_post::*;
+pub use bot::*;
+pub use call::*;
+pub use calendar_event::*;
+pub use payment::*;
+pub use note::*;
+pub use task::*;
+pub use region::*;
@@ -0,0 +1,31 @@
+use std::collections::BTreeMap;
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::{types::Json, FromRow};
+use ts_rs::TS;
+use uuid::Uuid;
+
+/// Edits per user, as a version vector
+pub type VersionVector = BTreeMap<Uuid, i64>;
+
+/// The conversation's shared note, e.g. group rules or a shopping list.
+/// `content` is encrypted by the clients; a conversation nobody has written
+/// a note for has empty content and an empty vector.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct ConversationNote {
+    pub conversation_id: Uuid,
+    pub content: Vec<u8>,
+    #[ts(type = "Record<string, number>")]
+    pub version_vector: Json<VersionVector>,
+    pub updated_by: Option<Uuid>,
+    pub updated_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UpdateNoteRequest {
+    pub content: Vec<u8>,
+    /// The vector of the note this edit was made on, merged with any others
+    /// the client has folded in
+    pub version_vector: VersionVector,
+}
@@ -0,0 +1,81 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
+#[sqlx(type_name = "payment_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum PaymentStatus {
+    Requested,
+    Paid,
+    Declined,
+    Cancelled,
+}
+
+impl PaymentStatus {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Requested => "requested",
+            Self::Paid => "paid",
+            Self::Declined => "declined",
+            Self::Cancelled => "cancelled",
+        }
+    }
+}
+
+/// A request for money from one member of a conversation to another. No
+/// money moves through the server; it only records what the members say
+/// happened.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct PaymentRequest {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub requester_id: Uuid,
+    pub payer_id: Uuid,
+    /// In the currency's minor unit, e.g. cents
+    pub amount_minor: i64,
+    /// ISO 4217 code
+    pub currency: String,
+    pub note: Option<String>,
+    pub status: PaymentStatus,
+    pub provider_reference: Option<String>,
+    /// The `payment_requested` system message
+    pub message_id: Option<Uuid>,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+    pub settled_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreatePaymentRequestRequest {
+    pub payer_id: Uuid,
+    pub amount_minor: i64,
+    pub currency: String,
+    pub note: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UpdatePaymentRequestRequest {
+    /// `paid`, `declined` or `cancelled`
+    pub status: PaymentStatus,
+    /// The provider's transaction id, with `paid`
+    pub provider_reference: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct PaymentRequestsQuery {
+    pub status: Option<PaymentStatus>,
+    pub before: Option<DateTime<Utc>>,
+    pub limit: Option<i64>,
+}
+
+/// What the payment webhook receives: the request as it is after `status`
+/// was reached
+#[derive(Debug, Serialize)]
+pub struct PaymentWebhookEvent {
+    pub status: PaymentStatus,
+    pub payment_request: PaymentRequest,
+    pub sent_at: DateTime<Utc>,
+}
@@ -0,0 +1,68 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+/// Who can see a profile post
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "post_visibility", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum PostVisibility {
+    /// Anyone signed in who hasn't been blocked by the author
+    Public,
+    /// Only the author's (unblocked) contacts
+    Contacts,
+}
+
+impl Default for PostVisibility {
+    fn default() -> Self {
+        Self::Public
+    }
+}
+
+/// A plaintext post on a user's profile. Unlike messages it is stored and
+/// served unencrypted.
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ProfilePost {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub body: String,
+    pub visibility: PostVisibility,
+    /// The author's message this post republishes, if any
+    pub source_message_id: Option<Uuid>,
+    pub pinned: bool,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateProfilePostRequest {
+    pub body: String,
+    #[serde(default)]
+    pub visibility: PostVisibility,
+    /// Pin one of your own messages: `body` is its plaintext
+    pub message_id: Option<Uuid>,
+    #[serde(default)]
+    pub pinned: bool,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct UpdateProfilePostRequest {
+    pub body: Option<String>,
+    pub visibility: Option<PostVisibility>,
+    pub pinned: Option<bool>,
+}
+
+/// Another user's profile as the caller may see it. Phone and email are
+/// never included.
+#[derive(Debug, Serialize)]
+pub struct UserProfile {
+    pub id: Uuid,
+    pub username: String,
+    pub display_name: String,
+    pub avatar_url: Option<String>,
+    pub bio: Option<String>,
+    pub created_at: DateTime<Utc>,
+    /// Posts visible to the caller, pinned first, then newest first
+    pub posts: Vec<ProfilePost>,
+}
@@ -0,0 +1,180 @@
+//! Realtime events, as sent over the WebSocket, SSE and long-poll
+//! transports in a `{type, payload}` envelope. The names here are what the
+//! outbox and publishers send; `server codegen` turns them and the payload
+//! types into the TypeScript client's `ServerEvent` and `ClientEvent` unions.
+
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use ts_rs::TS;
+use uuid::Uuid;
+
+use super::TranscodeStatus;
+
+// Server to client
+pub const WS_NEW_MESSAGE: &str = "new_message";
+pub const WS_TYPING: &str = "typing";
+pub const WS_CONVERSATION_STATE: &str = "conversation_state";
+pub const WS_MESSAGE_REQUEST_ACCEPTED: &str = "message_request_accepted";
+pub const WS_ATTACHMENT_PROCESSED: &str = "attachment_processed";
+pub const WS_FEDERATED_MESSAGE: &str = "federated_message";
+pub const WS_IMPERSONATION_REQUESTED: &str = "impersonation_requested";
+pub const WS_IMPERSONATION_STARTED: &str = "impersonation_started";
+pub const WS_SUGGESTIONS: &str = "suggestions";
+pub const WS_SESSION_ANOMALY: &str = "session_anomaly";
+pub const WS_EVENT_REMINDER: &str = "event_reminder";
+pub const WS_NOTE_UPDATED: &str = "note_updated";
+pub const WS_TASK_UPDATED: &str = "task_updated";
+pub const WS_PONG: &str = "pong";
+/// Both ways: the client sets its connection's filter, and the server
+/// answers with the filter now in effect
+pub const WS_FILTER: &str = "filter";
+
+// Client to server
+pub const WS_PING: &str = "ping";
+pub const WS_PRESENCE: &str = "presence";
+pub const WS_ACK: &str = "ack";
+
+/// `typing`, from the server: someone started or stopped typing
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct TypingEvent {
+    pub conversation_id: Uuid,
+    pub user_id: Uuid,
+    pub is_typing: bool,
+    pub timestamp: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct MessageRequestAcceptedEvent {
+    pub conversation_id: Uuid,
+    /// Who accepted
+    pub user_id: Uuid,
+}
+
+/// Sent to the uploader once a video or audio attachment is transcoded
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct AttachmentProcessedEvent {
+    pub attachment_id: Uuid,
+    pub status: TranscodeStatus,
+    pub error: Option<String>,
+}
+
+/// Quick actions for a message just received, from the suggestions sidecar
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct SuggestionsEvent {
+    pub conversation_id: Uuid,
+    pub message_id: Uuid,
+    pub suggestions: Vec<Suggestion>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct Suggestion {
+    /// Machine-readable action, e.g. `share_location`
+    pub action: String,
+    /// Text for the button
+    pub label: String,
+}
+
+/// What a session token's use is compared on against where the session
+/// has been used before
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, TS)]
+#[serde(rename_all = "snake_case")]
+pub enum AnomalySignal {
+    /// The client IP's network (/16 for IPv4, /32 for IPv6)
+    Network,
+    /// The client's country, from `CLIENT_COUNTRY_HEADER`
+    Country,
+    /// The User-Agent with version numbers left out
+    UserAgent,
+}
+
+impl AnomalySignal {
+    pub fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "network" => Some(Self::Network),
+            "country" => Some(Self::Country),
+            "user_agent" => Some(Self::UserAgent),
+            _ => None,
+        }
+    }
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Self::Network => "network",
+            Self::Country => "country",
+            Self::UserAgent => "user_agent",
+        }
+    }
+}
+
+/// Sent to a user when one of their sessions is used from somewhere
+/// unusual. With `reauth_required`, the device was signed out.
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct SessionAnomalyEvent {
+    pub device_id: i32,
+    pub signals: Vec<AnomalySignal>,
+    pub ip: Option<String>,
+    pub country: Option<String>,
+    pub user_agent: Option<String>,
+    pub reauth_required: bool,
+    pub detected_at: DateTime<Utc>,
+}
+
+/// Sent to the members of a group, except those who declined, when one of
+/// its calendar events is about to start
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct EventReminderEvent {
+    pub event_id: Uuid,
+    pub conversation_id: Uuid,
+    pub title: String,
+    pub starts_at: DateTime<Utc>,
+    pub location: Option<serde_json::Value>,
+}
+
+/// `typing`, from the client
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct TypingUpdate {
+    pub conversation_id: Uuid,
+}
+
+/// `presence`, from the client
+#[derive(Debug, Clone, Serialize, Deserialize, TS)]
+pub struct PresenceUpdate {
+    pub status: String,
+}
+
+/// `filter`: which events this WebSocket connection receives. Omitted (or
+/// null) fields don't filter; events without a `conversation_id` pass the
+/// conversation filter. `pong` and `filter` are always sent.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize, TS)]
+pub struct EventFilter {
+    /// Event types to receive, e.g. `["new_message"]`
+    #[serde(default)]
+    pub types: Option<Vec<String>>,
+    /// Conversations whose events to receive
+    #[serde(default)]
+    pub conversation_ids: Option<Vec<Uuid>>,
+}
+
+impl EventFilter {
+    pub fn allows(&self, event_type: &str, payload: &serde_json::Value) -> bool {
+        if event_type == WS_PONG || event_type == WS_FILTER {
+            return true;
+        }
+        if let Some(types) = &self.types {
+            if !types.iter().any(|t| t == event_type) {
+                return false;
+            }
+        }
+        if let Some(conversation_ids) = &self.conversation_ids {
+            let conversation_id = payload
+                .get("conversation_id")
+                .and_then(|v| v.as_str())
+                .and_then(|v| Uuid::parse_str(v).ok());
+            if let Some(conversation_id) = conversation_id {
+                return conversation_ids.contains(&conversation_id);
+            }
+        }
+
+        true
+    }
+}
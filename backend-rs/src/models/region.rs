@@ -0,0 +1,35 @@
+use serde::Serialize;
+use sqlx::FromRow;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum RegionRole {
+    Primary,
+    Standby,
+}
+
+/// This region's role and how far its database is behind, for load
+/// balancers and the failover runbook
+#[derive(Debug, Serialize)]
+pub struct RegionHealth {
+    pub region: Option<String>,
+    pub role: RegionRole,
+    pub read_only: bool,
+    pub leader_url: Option<String>,
+    /// Whether the database is a replica
+    pub in_recovery: bool,
+    /// Seconds of primary writes not yet replayed, on a replica
+    pub replication_lag_seconds: Option<f64>,
+    /// Replicas streaming from this database, on the primary
+    pub replicas: Vec<ReplicaStatus>,
+    pub healthy: bool,
+    /// Why the region is unhealthy
+    pub problems: Vec<String>,
+}
+
+#[derive(Debug, Serialize, FromRow)]
+pub struct ReplicaStatus {
+    pub application_name: String,
+    pub state: Option<String>,
+    pub replay_lag_seconds: Option<f64>,
+}
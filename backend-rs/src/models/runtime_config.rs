@@ -0,0 +1,22 @@
+use std::collections::BTreeMap;
+
+use serde::Serialize;
+
+/// A hot-reloadable setting that changed, keyed by its env var name
+#[derive(Debug, Clone, Serialize)]
+pub struct ConfigChange {
+    pub key: String,
+    pub old_value: String,
+    pub new_value: String,
+}
+
+#[derive(Debug, Serialize)]
+pub struct RuntimeConfig {
+    pub settings: BTreeMap<String, String>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ConfigReloadResult {
+    pub changes: Vec<ConfigChange>,
+    pub settings: BTreeMap<String, String>,
+}
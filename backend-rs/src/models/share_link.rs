@@ -0,0 +1,70 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+use super::MessageType;
+
+/// An expiring link to a read-only snapshot of selected messages
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct ShareLink {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub created_by: Uuid,
+    #[serde(skip_serializing)]
+    pub token_hash: String,
+    pub title: Option<String>,
+    pub message_count: i32,
+    pub view_count: i32,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    pub last_viewed_at: Option<DateTime<Utc>>,
+    pub revoked_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateShareLinkRequest {
+    /// In the order they should appear
+    pub messages: Vec<ShareMessageInput>,
+    pub title: Option<String>,
+    /// Seconds until the link stops working; defaults to a week
+    pub expires_in: Option<u64>,
+}
+
+/// A message to share and its plaintext, which only the client has
+#[derive(Debug, Deserialize)]
+pub struct ShareMessageInput {
+    pub message_id: Uuid,
+    pub text: String,
+}
+
+/// A new share link and its token, which is only ever shown here. The
+/// snapshot is public at `GET /api/v1/shared/:token`.
+#[derive(Debug, Serialize)]
+pub struct CreatedShareLink {
+    #[serde(flatten)]
+    pub share_link: ShareLink,
+    pub token: String,
+}
+
+/// One message as it appears in a snapshot. Senders are shown by name only.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SharedMessage {
+    pub sender_name: String,
+    #[serde(rename = "type")]
+    pub message_type: MessageType,
+    pub text: String,
+    pub sent_at: DateTime<Utc>,
+}
+
+/// What anyone with the link sees
+#[derive(Debug, Serialize)]
+pub struct SharedSnapshot {
+    pub title: Option<String>,
+    /// The group's name; `None` for direct conversations
+    pub conversation_name: Option<String>,
+    pub shared_by: String,
+    pub created_at: DateTime<Utc>,
+    pub expires_at: DateTime<Utc>,
+    pub messages: Vec<SharedMessage>,
+}
@@ -0,0 +1,27 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct SpamSettings {
+    pub enabled: bool,
+    pub max_sends_per_minute: i32,
+    pub new_account_age_hours: i32,
+    pub new_account_max_sends_per_minute: i32,
+    pub stranger_ratio_threshold: f64,
+    pub stranger_min_recipients: i32,
+    pub max_identical_fanout: i32,
+    pub updated_at: DateTime<Utc>,
+}
+
+/// Partial update of the spam settings; omitted fields keep their value
+#[derive(Debug, Deserialize)]
+pub struct UpdateSpamSettings {
+    pub enabled: Option<bool>,
+    pub max_sends_per_minute: Option<i32>,
+    pub new_account_age_hours: Option<i32>,
+    pub new_account_max_sends_per_minute: Option<i32>,
+    pub stranger_ratio_threshold: Option<f64>,
+    pub stranger_min_recipients: Option<i32>,
+    pub max_identical_fanout: Option<i32>,
+}
@@ -14,6 +14,7 @@ pub struct StickerPack {
     pub is_animated: bool,
     pub price: i32,
     pub downloads: i64,
+    pub workspace_id: Option<Uuid>,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
 }
@@ -0,0 +1,57 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct StorageObject {
+    pub id: Uuid,
+    pub user_id: Uuid,
+    pub category: StorageCategory,
+    pub bucket: String,
+    pub object_key: String,
+    pub size_bytes: i64,
+    pub created_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "storage_category", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum StorageCategory {
+    Avatar,
+    Attachment,
+    Backup,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct CategoryUsage {
+    pub category: StorageCategory,
+    pub objects: i64,
+    pub bytes: i64,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct StorageUsage {
+    pub used_bytes: i64,
+    pub quota_bytes: i64,
+    pub categories: Vec<CategoryUsage>,
+}
+
+/// A bucket's lifecycle rules, as the object store reports them
+#[derive(Debug, Clone, Serialize)]
+pub struct BucketLifecycle {
+    pub bucket: String,
+    pub rules: Vec<LifecycleRuleStatus>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct LifecycleRuleStatus {
+    pub id: Option<String>,
+    pub enabled: bool,
+    /// Key prefix the rule applies to; empty for the whole bucket
+    pub prefix: Option<String>,
+    pub expiration_days: Option<i32>,
+    pub abort_multipart_days: Option<i32>,
+    pub transition_days: Option<i32>,
+    pub storage_class: Option<String>,
+}
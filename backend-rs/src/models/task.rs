@@ -0,0 +1,41 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use ts_rs::TS;
+use uuid::Uuid;
+
+/// An item on a conversation's shared task list
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
+pub struct Task {
+    pub id: Uuid,
+    pub conversation_id: Uuid,
+    pub created_by: Uuid,
+    pub title: String,
+    pub assignee_id: Option<Uuid>,
+    pub due_at: Option<DateTime<Utc>>,
+    pub completed_at: Option<DateTime<Utc>>,
+    pub completed_by: Option<Uuid>,
+    /// Only set in the `task_updated` event for a deleted task
+    pub deleted_at: Option<DateTime<Utc>>,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct CreateTaskRequest {
+    pub title: String,
+    pub assignee_id: Option<Uuid>,
+    pub due_at: Option<DateTime<Utc>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct AssignTaskRequest {
+    /// `null` unassigns the task
+    pub assignee_id: Option<Uuid>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct TasksQuery {
+    /// Only open (`false`) or only completed (`true`) tasks
+    pub completed: Option<bool>,
+}
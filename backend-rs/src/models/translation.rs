@@ -0,0 +1,35 @@
+use serde::{Deserialize, Serialize};
+
+#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TranslationProvider {
+    Deepl,
+    Google,
+}
+
+impl TranslationProvider {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            TranslationProvider::Deepl => "deepl",
+            TranslationProvider::Google => "google",
+        }
+    }
+}
+
+/// Text the client has already decrypted, to be translated with the client's
+/// own provider key. Deliberately not `Debug`, so neither the text nor the
+/// key can end up in a log line.
+#[derive(Deserialize)]
+pub struct TranslateRequest {
+    pub text: String,
+    pub target_lang: String,
+    pub source_lang: Option<String>,
+    pub provider: TranslationProvider,
+    pub provider_token: String,
+}
+
+#[derive(Serialize)]
+pub struct TranslateResponse {
+    pub text: String,
+    pub detected_source_lang: Option<String>,
+}
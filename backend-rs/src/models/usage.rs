@@ -0,0 +1,40 @@
+use serde::Serialize;
+use uuid::Uuid;
+
+use super::StorageUsage;
+
+/// Everything the account health screen shows, from `GET /users/me/usage`
+#[derive(Debug, Serialize)]
+pub struct AccountUsage {
+    pub rate_limits: Vec<RateLimitUsage>,
+    pub storage: StorageUsage,
+    pub devices: DeviceUsage,
+    /// Signed-in sessions that have not expired
+    pub active_sessions: i64,
+    /// Personal access tokens that are neither revoked nor expired
+    pub active_access_tokens: i64,
+}
+
+/// One rate-limited resource in its current window
+#[derive(Debug, Serialize)]
+pub struct RateLimitUsage {
+    /// `messages`, `translation` or `access_token`
+    pub resource: &'static str,
+    /// The access token, for `access_token` limits
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub token_id: Option<Uuid>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub token_name: Option<String>,
+    pub used: i64,
+    /// `null` where the limit is adaptive rather than fixed
+    pub limit: Option<i64>,
+    pub window_seconds: u64,
+    /// Seconds until the window resets; `null` when nothing was used
+    pub resets_in: Option<u64>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct DeviceUsage {
+    pub count: i64,
+    pub limit: i64,
+}
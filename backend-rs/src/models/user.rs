@@ -1,9 +1,13 @@
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
 use sqlx::FromRow;
+use ts_rs::TS;
 use uuid::Uuid;
 
-#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+use crate::services::auth::Scope;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow, TS)]
 pub struct User {
     pub id: Uuid,
     pub phone: Option<String>,
@@ -16,9 +20,44 @@ pub struct User {
     pub last_seen_at: Option<DateTime<Utc>>,
     pub created_at: DateTime<Utc>,
     pub updated_at: DateTime<Utc>,
+    /// Profile version, bumped on edits (not presence) and sent as the ETag
+    pub version: i32,
+    /// Whether the user shows up in directory search for non-contacts
+    pub discoverable: bool,
+    /// Whether other participants see when the user has read their
+    /// messages, unless overridden per conversation
+    pub read_receipts: bool,
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+/// One page of directory search. Pass `next_cursor` back as `cursor` for the
+/// next page; it is `None` on the last one.
+#[derive(Debug, Serialize)]
+pub struct UserSearchPage {
+    pub users: Vec<User>,
+    pub next_cursor: Option<String>,
+}
+
+/// Position in directory search results, which are ordered contacts first,
+/// then by username. Opaque to clients.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct UserSearchCursor {
+    pub is_contact: bool,
+    pub username: String,
+}
+
+impl UserSearchCursor {
+    pub fn encode(&self) -> String {
+        let json = serde_json::to_vec(self).unwrap_or_default();
+        URL_SAFE_NO_PAD.encode(json)
+    }
+
+    pub fn decode(cursor: &str) -> Option<Self> {
+        let json = URL_SAFE_NO_PAD.decode(cursor).ok()?;
+        serde_json::from_slice(&json).ok()
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "user_status", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum UserStatus {
@@ -33,13 +72,21 @@ impl Default for UserStatus {
     }
 }
 
-#[derive(Debug, Serialize, Deserialize)]
+#[derive(Debug, Serialize, Deserialize, TS)]
 pub struct TokenPair {
     pub access_token: String,
     pub refresh_token: String,
     pub expires_at: DateTime<Utc>,
 }
 
+/// An access-only token restricted to a set of scopes; it cannot be refreshed
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScopedToken {
+    pub access_token: String,
+    pub scopes: Vec<Scope>,
+    pub expires_at: DateTime<Utc>,
+}
+
 #[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
 pub struct Session {
     pub id: Uuid,
@@ -47,6 +94,8 @@ pub struct Session {
     pub device_id: i32,
     pub token_hash: String,
     pub refresh_token_hash: String,
+    /// Thumbprint of the DPoP key the session's tokens are bound to
+    pub dpop_jkt: Option<String>,
     pub expires_at: DateTime<Utc>,
     pub last_used_at: DateTime<Utc>,
     pub created_at: DateTime<Utc>,
@@ -65,10 +114,57 @@ pub struct Otp {
     pub created_at: DateTime<Utc>,
 }
 
-#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type, TS)]
 #[sqlx(type_name = "otp_type", rename_all = "lowercase")]
 #[serde(rename_all = "lowercase")]
 pub enum OtpType {
     Phone,
     Email,
 }
+
+impl OtpType {
+    /// The other channel, used when delivery on this one fails
+    pub fn other(self) -> Self {
+        match self {
+            OtpType::Phone => OtpType::Email,
+            OtpType::Email => OtpType::Phone,
+        }
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "otp_delivery_status", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum OtpDeliveryStatus {
+    Queued,
+    Sent,
+    Delivered,
+    Failed,
+}
+
+impl OtpDeliveryStatus {
+    /// Delivered and failed are final; late callbacks don't move them
+    pub fn is_final(self) -> bool {
+        matches!(self, OtpDeliveryStatus::Delivered | OtpDeliveryStatus::Failed)
+    }
+}
+
+/// One attempt to deliver an OTP code through a provider
+#[derive(Debug, Clone, Serialize, FromRow)]
+pub struct OtpDelivery {
+    pub id: Uuid,
+    pub target: String,
+    #[sqlx(rename = "type")]
+    #[serde(rename = "type")]
+    pub otp_type: OtpType,
+    pub channel: OtpType,
+    pub recipient: String,
+    pub provider: String,
+    pub provider_message_id: Option<String>,
+    pub status: OtpDeliveryStatus,
+    pub error_code: Option<String>,
+    pub fallback_for: Option<Uuid>,
+    pub locale: String,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+}
@@ -0,0 +1,10 @@
+use chrono::{DateTime, Utc};
+use sqlx::FromRow;
+
+/// The newest change among the rows behind a list response, and how many
+/// rows there are. A list can only have changed if one of the two did.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, FromRow)]
+pub struct Watermark {
+    pub latest: Option<DateTime<Utc>>,
+    pub count: i64,
+}
@@ -0,0 +1,54 @@
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::FromRow;
+use uuid::Uuid;
+
+use super::User;
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct Workspace {
+    pub id: Uuid,
+    pub name: String,
+    pub slug: String,
+    pub created_by: Uuid,
+    pub created_at: DateTime<Utc>,
+    pub updated_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, FromRow)]
+pub struct WorkspaceMember {
+    pub id: Uuid,
+    pub workspace_id: Uuid,
+    pub user_id: Uuid,
+    pub role: WorkspaceRole,
+    pub joined_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, sqlx::Type)]
+#[sqlx(type_name = "workspace_role", rename_all = "lowercase")]
+#[serde(rename_all = "lowercase")]
+pub enum WorkspaceRole {
+    Owner,
+    Admin,
+    Member,
+}
+
+impl WorkspaceRole {
+    pub fn is_admin(&self) -> bool {
+        matches!(self, Self::Owner | Self::Admin)
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct WorkspaceWithRole {
+    #[serde(flatten)]
+    pub workspace: Workspace,
+    pub role: WorkspaceRole,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct WorkspaceMemberWithUser {
+    #[serde(flatten)]
+    pub member: WorkspaceMember,
+    pub user: Option<User>,
+}
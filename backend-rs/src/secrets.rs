@@ -0,0 +1,244 @@
+//! Credentials from a secrets manager (Vault or AWS Secrets Manager) instead
+//! of plain env vars. Secrets are cached and re-fetched periodically; a
+//! rotated JWT secret or database password takes effect without a restart.
+//! HS256 secrets are then shared with the other replicas through the
+//! database, see `JwtSecretsService`.
+
+use std::{
+    collections::HashMap,
+    str::FromStr,
+    sync::Arc,
+    time::{Duration, Instant},
+};
+
+use async_trait::async_trait;
+use jsonwebtoken::Algorithm;
+use sqlx::{postgres::PgConnectOptions, PgPool};
+use tokio::sync::RwLock;
+
+use crate::{
+    config::{SecretsBackend, SecretsConfig, SharedConfig},
+    services::jwt_secrets::JwtSecretsService,
+};
+
+/// A source of secrets, keyed by env var name
+#[async_trait]
+pub trait SecretsProvider: Send + Sync {
+    fn name(&self) -> &'static str;
+    async fn fetch(&self) -> anyhow::Result<HashMap<String, String>>;
+}
+
+/// HashiCorp Vault KV secret, read over the HTTP API
+pub struct VaultProvider {
+    http: reqwest::Client,
+    addr: String,
+    token: String,
+    path: String,
+}
+
+#[async_trait]
+impl SecretsProvider for VaultProvider {
+    fn name(&self) -> &'static str {
+        "vault"
+    }
+
+    async fn fetch(&self) -> anyhow::Result<HashMap<String, String>> {
+        let url = format!("{}/v1/{}", self.addr.trim_end_matches('/'), self.path);
+        let body: serde_json::Value = self
+            .http
+            .get(&url)
+            .header("X-Vault-Token", &self.token)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await?;
+
+        // KV v2 nests the values one level deeper than v1
+        let data = body
+            .pointer("/data/data")
+            .or_else(|| body.get("data"))
+            .cloned()
+            .ok_or_else(|| anyhow::anyhow!("Vault response for {} has no data", self.path))?;
+
+        parse_secret_map(data)
+    }
+}
+
+/// AWS Secrets Manager secret holding a JSON object
+pub struct AwsSecretsProvider {
+    client: aws_sdk_secretsmanager::Client,
+    secret_id: String,
+}
+
+#[async_trait]
+impl SecretsProvider for AwsSecretsProvider {
+    fn name(&self) -> &'static str {
+        "aws"
+    }
+
+    async fn fetch(&self) -> anyhow::Result<HashMap<String, String>> {
+        let output = self
+            .client
+            .get_secret_value()
+            .secret_id(&self.secret_id)
+            .send()
+            .await?;
+
+        let secret = output
+            .secret_string()
+            .ok_or_else(|| anyhow::anyhow!("Secret {} has no string value", self.secret_id))?;
+
+        parse_secret_map(serde_json::from_str(secret)?)
+    }
+}
+
+fn parse_secret_map(value: serde_json::Value) -> anyhow::Result<HashMap<String, String>> {
+    let serde_json::Value::Object(map) = value else {
+        anyhow::bail!("Secret is not a JSON object");
+    };
+
+    Ok(map
+        .into_iter()
+        .filter_map(|(key, value)| match value {
+            serde_json::Value::String(s) => Some((key, s)),
+            serde_json::Value::Null => None,
+            other => Some((key, other.to_string())),
+        })
+        .collect())
+}
+
+/// Caching wrapper around a provider
+pub struct SecretsManager {
+    provider: Box<dyn SecretsProvider>,
+    ttl: Duration,
+    cache: RwLock<Option<(Instant, HashMap<String, String>)>>,
+}
+
+impl SecretsManager {
+    /// Build the manager for the configured backend; `None` means secrets
+    /// come from env vars
+    pub async fn from_config(config: &SecretsConfig) -> Option<Self> {
+        let provider: Box<dyn SecretsProvider> = match &config.backend {
+            SecretsBackend::Env => return None,
+            SecretsBackend::Vault { addr, token, path } => Box::new(VaultProvider {
+                http: reqwest::Client::new(),
+                addr: addr.clone(),
+                token: token.clone(),
+                path: path.clone(),
+            }),
+            SecretsBackend::Aws { secret_id } => {
+                let aws_config = aws_config::load_from_env().await;
+                Box::new(AwsSecretsProvider {
+                    client: aws_sdk_secretsmanager::Client::new(&aws_config),
+                    secret_id: secret_id.clone(),
+                })
+            }
+        };
+
+        Some(Self {
+            provider,
+            ttl: config.refresh_interval,
+            cache: RwLock::new(None),
+        })
+    }
+
+    /// All secrets, from cache while fresh. If a refresh fails, the last
+    /// known values are served so a secrets manager outage doesn't take the
+    /// server down.
+    pub async fn get_all(&self) -> anyhow::Result<HashMap<String, String>> {
+        if let Some((fetched_at, secrets)) = self.cache.read().await.as_ref() {
+            if fetched_at.elapsed() < self.ttl {
+                return Ok(secrets.clone());
+            }
+        }
+
+        self.refresh().await
+    }
+
+    /// Fetch from the provider, bypassing the cache
+    pub async fn refresh(&self) -> anyhow::Result<HashMap<String, String>> {
+        let mut cache = self.cache.write().await;
+
+        match self.provider.fetch().await {
+            Ok(secrets) => {
+                *cache = Some((Instant::now(), secrets.clone()));
+                Ok(secrets)
+            }
+            Err(e) => match cache.as_ref() {
+                Some((_, stale)) => {
+                    tracing::warn!(
+                        "Failed to refresh secrets from {}: {}",
+                        self.provider.name(),
+                        e
+                    );
+                    Ok(stale.clone())
+                }
+                None => Err(e.context(format!("loading secrets from {}", self.provider.name()))),
+            },
+        }
+    }
+}
+
+/// Periodically re-fetch secrets, if a secrets manager is configured, and
+/// re-sync the shared HS256 key set. A new JWT secret is registered with the
+/// other replicas and signs once they have all loaded it; a new database
+/// password is used for new pool connections. Other credentials need a
+/// restart.
+pub fn spawn_rotation(secrets: Option<Arc<SecretsManager>>, config: Arc<SharedConfig>, db: PgPool) {
+    tokio::spawn(async move {
+        loop {
+            let interval = config.current().secrets.refresh_interval;
+            tokio::time::sleep(interval).await;
+
+            let current = config.current();
+            let mut next = (*current).clone();
+            if let Some(secrets) = &secrets {
+                match secrets.refresh().await {
+                    Ok(fetched) => next.apply_secrets(&fetched),
+                    Err(e) => tracing::error!("Secret rotation check failed: {}", e),
+                }
+            }
+
+            let jwt_rotated = next.jwt.secret != current.jwt.secret;
+            let db_rotated = next.database.password != current.database.password;
+            if jwt_rotated || db_rotated {
+                if let Err(e) = next.ensure_production_ready() {
+                    tracing::error!("Ignoring rotated secrets: {}", e);
+                    continue;
+                }
+            }
+
+            if next.jwt.algorithm == Algorithm::HS256 {
+                let synced = JwtSecretsService::new(db.clone())
+                    .sync(&mut next.jwt, next.region.read_only, interval)
+                    .await;
+                if let Err(e) = synced {
+                    tracing::error!("Failed to sync JWT secrets: {}", e);
+                    continue;
+                }
+            }
+
+            let keys_changed = next.jwt.shared_secrets != current.jwt.shared_secrets;
+            if !jwt_rotated && !db_rotated && !keys_changed {
+                continue;
+            }
+
+            if jwt_rotated {
+                tracing::info!("JWT secret rotated");
+            }
+
+            if db_rotated {
+                match PgConnectOptions::from_str(&next.database_url()) {
+                    Ok(options) => {
+                        db.set_connect_options(options);
+                        tracing::info!("Database password rotated");
+                    }
+                    Err(e) => tracing::error!("Invalid database options after rotation: {}", e),
+                }
+            }
+
+            config.replace(next);
+        }
+    });
+}
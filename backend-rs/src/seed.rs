@@ -0,0 +1,396 @@
+//! `server seed`: load development fixtures so a fresh stack has users to log
+//! in as, sticker packs and conversations with history. Fixtures are read from
+//! `fixtures/<ENVIRONMENT>/seed.json` (or the directory given after `seed`);
+//! image paths are relative to that directory. Anything already seeded is
+//! skipped, so the command can be re-run after fixtures change. Seeded users
+//! log in with fixed codes, so it only runs with `ENVIRONMENT=development`.
+
+use std::{
+    collections::HashMap,
+    path::{Path, PathBuf},
+};
+
+use anyhow::Context;
+use bytes::Bytes;
+use serde::Deserialize;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::Config,
+    error::AppError,
+    models::{ConversationType, MessageType, OtpType, UserStatus},
+    services::{
+        contacts::ContactsService, limits::LimitsService, messaging::MessagingService, phone,
+        stickers::StickersService,
+    },
+    storage::{minio::MinioClient, redis::RedisClient},
+};
+
+#[derive(Debug, Deserialize)]
+struct Fixtures {
+    #[serde(default)]
+    users: Vec<UserFixture>,
+    /// Pairs of usernames who have each other as contacts
+    #[serde(default)]
+    contacts: Vec<(String, String)>,
+    #[serde(default)]
+    sticker_packs: Vec<StickerPackFixture>,
+    #[serde(default)]
+    conversations: Vec<ConversationFixture>,
+}
+
+#[derive(Debug, Deserialize)]
+struct UserFixture {
+    username: String,
+    display_name: String,
+    phone: Option<String>,
+    email: Option<String>,
+    /// Code that always verifies for the user's phone and email
+    otp_code: Option<String>,
+    #[serde(default)]
+    is_admin: bool,
+}
+
+#[derive(Debug, Deserialize)]
+struct StickerPackFixture {
+    name: String,
+    author: String,
+    description: Option<String>,
+    cover: Option<String>,
+    #[serde(default)]
+    stickers: Vec<StickerFixture>,
+}
+
+#[derive(Debug, Deserialize)]
+struct StickerFixture {
+    emoji: String,
+    image: String,
+}
+
+/// A group when named (created by the first member), otherwise a direct
+/// conversation between exactly two members
+#[derive(Debug, Deserialize)]
+struct ConversationFixture {
+    name: Option<String>,
+    members: Vec<String>,
+    #[serde(default)]
+    messages: Vec<MessageFixture>,
+}
+
+#[derive(Debug, Deserialize)]
+struct MessageFixture {
+    from: String,
+    text: String,
+}
+
+pub async fn run(
+    config: &Config,
+    db: &PgPool,
+    redis: &RedisClient,
+    minio: &MinioClient,
+    dir: Option<&str>,
+) -> anyhow::Result<()> {
+    if config.server.environment != "development" {
+        anyhow::bail!(
+            "Refusing to seed fixtures outside development (ENVIRONMENT={})",
+            config.server.environment
+        );
+    }
+
+    let dir = dir
+        .map(PathBuf::from)
+        .unwrap_or_else(|| Path::new("fixtures").join(&config.server.environment));
+    let path = dir.join("seed.json");
+    let source = std::fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read {}", path.display()))?;
+    let fixtures: Fixtures = serde_json::from_str(&source)
+        .with_context(|| format!("Invalid fixtures in {}", path.display()))?;
+
+    let seeder = Seeder {
+        db: db.clone(),
+        dir,
+        contacts: ContactsService::new(db.clone()),
+        stickers: StickersService::new(db.clone(), minio.clone()),
+        messaging: MessagingService::new(db.clone(), redis.clone()),
+        limits: LimitsService::new(db.clone(), config.limits.clone()),
+    };
+
+    let users = seeder.seed_users(&fixtures.users).await?;
+    seeder.seed_contacts(&users, &fixtures.contacts).await?;
+    seeder.seed_sticker_packs(&fixtures.sticker_packs).await?;
+    seeder.seed_conversations(&users, &fixtures.conversations).await?;
+
+    tracing::info!("Seeded fixtures from {}", path.display());
+    Ok(())
+}
+
+struct Seeder {
+    db: PgPool,
+    dir: PathBuf,
+    contacts: ContactsService,
+    stickers: StickersService,
+    messaging: MessagingService,
+    limits: LimitsService,
+}
+
+impl Seeder {
+    /// Create missing users and (re)set their bypass codes. Returns every
+    /// fixture user's id by username.
+    async fn seed_users(&self, fixtures: &[UserFixture]) -> anyhow::Result<HashMap<String, Uuid>> {
+        let mut users = HashMap::with_capacity(fixtures.len());
+
+        for fixture in fixtures {
+            let phone = fixture
+                .phone
+                .as_deref()
+                .map(|p| phone::normalize(p, None))
+                .transpose()?;
+            let email = fixture.email.as_deref().map(str::trim);
+
+            let existing: Option<Uuid> =
+                sqlx::query_scalar("SELECT id FROM users WHERE username = $1")
+                    .bind(&fixture.username)
+                    .fetch_optional(&self.db)
+                    .await?;
+
+            let user_id = match existing {
+                Some(id) => id,
+                None => {
+                    let id: Uuid = sqlx::query_scalar(
+                        r#"
+                        INSERT INTO users (id, phone, email, username, display_name, status, is_admin)
+                        VALUES ($1, $2, $3, $4, $5, $6, $7)
+                        RETURNING id
+                        "#,
+                    )
+                    .bind(Uuid::new_v4())
+                    .bind(&phone)
+                    .bind(email)
+                    .bind(&fixture.username)
+                    .bind(&fixture.display_name)
+                    .bind(UserStatus::Offline)
+                    .bind(fixture.is_admin)
+                    .fetch_one(&self.db)
+                    .await?;
+
+                    tracing::info!("Created user {}", fixture.username);
+                    id
+                }
+            };
+
+            if let Some(code) = &fixture.otp_code {
+                let targets = phone
+                    .as_deref()
+                    .map(|p| (p, OtpType::Phone))
+                    .into_iter()
+                    .chain(email.map(|e| (e, OtpType::Email)));
+
+                for (target, otp_type) in targets {
+                    sqlx::query(
+                        r#"
+                        INSERT INTO otp_bypass_codes (target, type, code)
+                        VALUES ($1, $2, $3)
+                        ON CONFLICT (target, type) DO UPDATE SET code = $3
+                        "#,
+                    )
+                    .bind(target)
+                    .bind(otp_type)
+                    .bind(code)
+                    .execute(&self.db)
+                    .await?;
+                }
+            }
+
+            users.insert(fixture.username.clone(), user_id);
+        }
+
+        Ok(users)
+    }
+
+    async fn seed_contacts(
+        &self,
+        users: &HashMap<String, Uuid>,
+        pairs: &[(String, String)],
+    ) -> anyhow::Result<()> {
+        for (a, b) in pairs {
+            let (a, b) = (user_id(users, a)?, user_id(users, b)?);
+
+            for (user, contact) in [(a, b), (b, a)] {
+                match self.contacts.add_contact(user, contact, None).await {
+                    Ok(_) | Err(AppError::ContactAlreadyExists) => {}
+                    Err(e) => return Err(e.into()),
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Create missing global packs and push their images to MinIO
+    async fn seed_sticker_packs(&self, fixtures: &[StickerPackFixture]) -> anyhow::Result<()> {
+        for fixture in fixtures {
+            let existing: Option<Uuid> = sqlx::query_scalar(
+                "SELECT id FROM sticker_packs WHERE name = $1 AND workspace_id IS NULL",
+            )
+            .bind(&fixture.name)
+            .fetch_optional(&self.db)
+            .await?;
+
+            if existing.is_some() {
+                continue;
+            }
+
+            let pack = self
+                .stickers
+                .create_pack(
+                    &fixture.name,
+                    &fixture.author,
+                    fixture.description.as_deref(),
+                    true,
+                    false,
+                    None,
+                )
+                .await?;
+
+            if let Some(cover) = &fixture.cover {
+                let (data, content_type) = self.read_image(cover)?;
+                self.stickers
+                    .upload_pack_cover(pack.id, data, content_type)
+                    .await?;
+            }
+
+            for (position, sticker) in fixture.stickers.iter().enumerate() {
+                let (data, content_type) = self.read_image(&sticker.image)?;
+                self.stickers
+                    .add_sticker(pack.id, &sticker.emoji, position as i32, data, content_type)
+                    .await?;
+            }
+
+            tracing::info!(
+                "Created sticker pack {} with {} stickers",
+                fixture.name,
+                fixture.stickers.len()
+            );
+        }
+
+        Ok(())
+    }
+
+    /// Create the conversations and post their messages, unless the
+    /// conversation already has messages
+    async fn seed_conversations(
+        &self,
+        users: &HashMap<String, Uuid>,
+        fixtures: &[ConversationFixture],
+    ) -> anyhow::Result<()> {
+        for fixture in fixtures {
+            let members = fixture
+                .members
+                .iter()
+                .map(|m| user_id(users, m))
+                .collect::<anyhow::Result<Vec<Uuid>>>()?;
+            let (creator, others) = members
+                .split_first()
+                .context("Conversation fixture has no members")?;
+
+            let conversation_id = match &fixture.name {
+                Some(name) => {
+                    let existing: Option<Uuid> = sqlx::query_scalar(
+                        r#"
+                        SELECT id FROM conversations
+                        WHERE type = $1 AND name = $2 AND created_by = $3 AND workspace_id IS NULL
+                        "#,
+                    )
+                    .bind(ConversationType::Group)
+                    .bind(name)
+                    .bind(creator)
+                    .fetch_optional(&self.db)
+                    .await?;
+
+                    match existing {
+                        Some(id) => id,
+                        None => {
+                            self.messaging
+                                .create_group_conversation(
+                                    *creator,
+                                    name,
+                                    others.to_vec(),
+                                    None,
+                                    &self.limits,
+                                )
+                                .await?
+                                .conversation
+                                .id
+                        }
+                    }
+                }
+                None => {
+                    let [other] = others else {
+                        anyhow::bail!("A direct conversation needs exactly two members");
+                    };
+                    self.messaging
+                        .create_direct_conversation(*creator, *other, None, &self.limits)
+                        .await?
+                        .conversation
+                        .id
+                }
+            };
+
+            let has_messages: bool = sqlx::query_scalar(
+                "SELECT EXISTS(SELECT 1 FROM messages WHERE conversation_id = $1)",
+            )
+            .bind(conversation_id)
+            .fetch_one(&self.db)
+            .await?;
+
+            if has_messages {
+                continue;
+            }
+
+            // Demo messages are plain UTF-8, not Signal ciphertext
+            for message in &fixture.messages {
+                self.messaging
+                    .send_message(
+                        conversation_id,
+                        user_id(users, &message.from)?,
+                        MessageType::Text,
+                        message.text.as_bytes().to_vec(),
+                        None,
+                        None,
+                        None,
+                    )
+                    .await?;
+            }
+
+            tracing::info!(
+                "Seeded conversation {} with {} messages",
+                fixture.name.as_deref().unwrap_or(&fixture.members.join(" & ")),
+                fixture.messages.len()
+            );
+        }
+
+        Ok(())
+    }
+
+    fn read_image(&self, relative: &str) -> anyhow::Result<(Bytes, &'static str)> {
+        let path = self.dir.join(relative);
+        let content_type = match path.extension().and_then(|e| e.to_str()) {
+            Some("png") => "image/png",
+            Some("jpg" | "jpeg") => "image/jpeg",
+            Some("webp") => "image/webp",
+            Some("gif") => "image/gif",
+            _ => anyhow::bail!("Unsupported sticker image {}", path.display()),
+        };
+        let data = std::fs::read(&path).with_context(|| format!("Failed to read {}", path.display()))?;
+
+        Ok((Bytes::from(data), content_type))
+    }
+}
+
+fn user_id(users: &HashMap<String, Uuid>, username: &str) -> anyhow::Result<Uuid> {
+    users
+        .get(username)
+        .copied()
+        .with_context(|| format!("Fixture refers to unknown user {}", username))
+}
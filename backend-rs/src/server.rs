@@ -0,0 +1,143 @@
+//! Listener setup. Serves plain HTTP (behind a proxy) or terminates TLS
+//! natively with static certificates or Let's Encrypt, negotiating HTTP/2
+//! via ALPN. With TLS on, an optional plain listener redirects to HTTPS.
+//! Handlers can read the peer address through `ConnectInfo<SocketAddr>`.
+
+use std::{net::SocketAddr, sync::Arc};
+
+use axum::{
+    http::{header::HOST, HeaderMap, StatusCode, Uri},
+    response::Redirect,
+    Router,
+};
+use axum_server::tls_rustls::RustlsConfig;
+use futures_util::StreamExt;
+use rustls_acme::{caches::DirCache, futures_rustls::rustls::ServerConfig, AcmeConfig};
+
+use crate::config::{Config, TlsConfig};
+
+const ALPN_PROTOCOLS: [&[u8]; 2] = [b"h2", b"http/1.1"];
+const ACME_TLS_ALPN: &[u8] = b"acme-tls/1";
+
+/// Serve the app until the process exits
+pub async fn serve(app: Router, config: &Config) -> anyhow::Result<()> {
+    let addr: SocketAddr = format!("{}:{}", config.server.host, config.server.port).parse()?;
+    let tls = &config.tls;
+
+    if !tls.enabled() {
+        let listener = tokio::net::TcpListener::bind(addr).await?;
+        tracing::info!("Server listening on http://{}", addr);
+        axum::serve(
+            listener,
+            app.into_make_service_with_connect_info::<SocketAddr>(),
+        )
+        .await?;
+        return Ok(());
+    }
+
+    if let Some(redirect_port) = tls.redirect_port {
+        let redirect_addr = SocketAddr::new(addr.ip(), redirect_port);
+        tokio::spawn(redirect_http_to_https(redirect_addr, config.server.port));
+    }
+
+    if !tls.acme_domains.is_empty() {
+        return serve_acme(app, addr, tls).await;
+    }
+
+    let (Some(cert_path), Some(key_path)) = (&tls.cert_path, &tls.key_path) else {
+        unreachable!("TLS enabled without certificate or ACME domains");
+    };
+
+    // from_pem_file advertises h2 and http/1.1 over ALPN
+    let rustls_config = RustlsConfig::from_pem_file(cert_path, key_path).await?;
+    tracing::info!("Server listening on https://{}", addr);
+
+    axum_server::bind_rustls(addr, rustls_config)
+        .serve(app.into_make_service_with_connect_info::<SocketAddr>())
+        .await?;
+
+    Ok(())
+}
+
+/// Serve with certificates issued and renewed by Let's Encrypt using the
+/// TLS-ALPN-01 challenge, so no port 80 listener is required
+async fn serve_acme(app: Router, addr: SocketAddr, tls: &TlsConfig) -> anyhow::Result<()> {
+    let mut state = AcmeConfig::new(tls.acme_domains.clone())
+        .contact(tls.acme_contact.iter().map(|c| format!("mailto:{}", c)))
+        .cache(DirCache::new(tls.acme_cache_dir.clone()))
+        .directory_lets_encrypt(!tls.acme_staging)
+        .state();
+
+    let mut rustls_config = ServerConfig::builder()
+        .with_no_client_auth()
+        .with_cert_resolver(state.resolver());
+    rustls_config.alpn_protocols = ALPN_PROTOCOLS
+        .iter()
+        .chain([&ACME_TLS_ALPN])
+        .map(|p| p.to_vec())
+        .collect();
+
+    let acceptor = state.axum_acceptor(Arc::new(rustls_config));
+
+    // Drives issuance and renewal; must keep being polled
+    tokio::spawn(async move {
+        while let Some(event) = state.next().await {
+            match event {
+                Ok(ok) => tracing::info!("ACME event: {:?}", ok),
+                Err(e) => tracing::error!("ACME error: {:?}", e),
+            }
+        }
+    });
+
+    tracing::info!(
+        "Server listening on https://{} (ACME for {})",
+        addr,
+        tls.acme_domains.join(", ")
+    );
+
+    axum_server::bind(addr)
+        .acceptor(acceptor)
+        .serve(app.into_make_service_with_connect_info::<SocketAddr>())
+        .await?;
+
+    Ok(())
+}
+
+/// Answer every plain HTTP request with a permanent redirect to HTTPS
+async fn redirect_http_to_https(addr: SocketAddr, https_port: u16) {
+    let app = Router::new().fallback(move |headers: HeaderMap, uri: Uri| async move {
+        https_url(&headers, &uri, https_port)
+            .map(|url| Redirect::permanent(&url))
+            .ok_or(StatusCode::BAD_REQUEST)
+    });
+
+    let listener = match tokio::net::TcpListener::bind(addr).await {
+        Ok(listener) => listener,
+        Err(e) => {
+            tracing::error!("Failed to bind HTTPS redirect listener on {}: {}", addr, e);
+            return;
+        }
+    };
+    tracing::info!("Redirecting http://{} to HTTPS", addr);
+
+    if let Err(e) = axum::serve(listener, app).await {
+        tracing::error!("HTTPS redirect listener failed: {}", e);
+    }
+}
+
+fn https_url(headers: &HeaderMap, uri: &Uri, https_port: u16) -> Option<String> {
+    let host = headers.get(HOST)?.to_str().ok()?;
+    // Drop any port, keeping bracketed IPv6 literals intact
+    let host = match host.rsplit_once(':') {
+        Some((name, port)) if !port.contains(']') => name,
+        _ => host,
+    };
+
+    let path = uri.path_and_query().map(|p| p.as_str()).unwrap_or("/");
+
+    Some(if https_port == 443 {
+        format!("https://{}{}", host, path)
+    } else {
+        format!("https://{}:{}{}", host, https_port, path)
+    })
+}
@@ -0,0 +1,305 @@
+use std::{
+    net::{IpAddr, SocketAddr},
+    time::Duration,
+};
+
+use axum::http::HeaderMap;
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::AbuseConfig,
+    error::{AppError, AppResult},
+    models::{AbuseBlock, AbuseBlockKind},
+    services::{
+        analytics::{
+            AnalyticsService, COUNTER_BLOCKED_ASN, COUNTER_BLOCKED_IP, COUNTER_BLOCKED_PHONE_PREFIX,
+        },
+        audit::AuditService,
+    },
+    storage::redis::RedisClient,
+};
+
+const BLOCKLIST_CACHE_TTL: Duration = Duration::from_secs(60);
+
+/// Where a request came from, as far as the abuse blocklists and session
+/// anomaly checks care
+#[derive(Debug, Clone, Default)]
+pub struct ClientOrigin {
+    pub ip: Option<IpAddr>,
+    pub asn: Option<u32>,
+    /// ISO 3166 country code
+    pub country: Option<String>,
+}
+
+impl ClientOrigin {
+    /// Read the client address from `CLIENT_IP_HEADER` when configured
+    /// (first entry of a comma-separated list), else use the peer address.
+    /// The ASN and country are only known when `CLIENT_ASN_HEADER` and
+    /// `CLIENT_COUNTRY_HEADER` are configured.
+    pub fn from_request(headers: &HeaderMap, peer: SocketAddr, config: &AbuseConfig) -> Self {
+        let header = |name: &Option<String>| {
+            name.as_deref()
+                .and_then(|name| headers.get(name))
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| v.split(',').next())
+                .map(str::trim)
+        };
+
+        let ip = match &config.client_ip_header {
+            Some(_) => header(&config.client_ip_header).and_then(|v| v.parse().ok()),
+            None => Some(peer.ip()),
+        };
+        let asn = header(&config.client_asn_header)
+            .map(|v| v.trim_start_matches("AS").trim_start_matches("as"))
+            .and_then(|v| v.parse().ok());
+        // `XX` is Cloudflare's "unknown"
+        let country = header(&config.client_country_header)
+            .filter(|v| v.len() == 2 && !v.eq_ignore_ascii_case("XX"))
+            .map(str::to_uppercase);
+
+        Self { ip, asn, country }
+    }
+}
+
+/// Admin-managed blocklists against SMS pumping and bot signups. Phone
+/// prefixes are checked before a code is texted; client IP ranges and ASNs
+/// before any code is sent or account registered. Lists are cached in Redis
+/// and every refusal is counted in the daily analytics counters.
+pub struct AbuseService {
+    db: PgPool,
+    redis: RedisClient,
+    audit: AuditService,
+}
+
+impl AbuseService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self { db, redis, audit }
+    }
+
+    /// Refuse an E.164 number starting with a blocked prefix
+    pub async fn check_phone(&self, phone: &str) -> AppResult<()> {
+        let prefixes = self.cached_values(AbuseBlockKind::PhonePrefix).await?;
+        if let Some(prefix) = prefixes.iter().find(|p| phone.starts_with(p.as_str())) {
+            tracing::info!("Blocked phone {} by prefix {}", phone, prefix);
+            return self.blocked(COUNTER_BLOCKED_PHONE_PREFIX).await;
+        }
+
+        Ok(())
+    }
+
+    /// Refuse a client in a blocked IP range or network
+    pub async fn check_origin(&self, origin: &ClientOrigin) -> AppResult<()> {
+        if let Some(ip) = origin.ip {
+            let ranges = self.cached_values(AbuseBlockKind::IpCidr).await?;
+            let blocked = ranges
+                .iter()
+                .filter_map(|r| parse_cidr(r))
+                .find(|&(network, prefix_len)| cidr_contains(network, prefix_len, ip));
+            if let Some((network, prefix_len)) = blocked {
+                tracing::info!("Blocked client {} by range {}/{}", ip, network, prefix_len);
+                return self.blocked(COUNTER_BLOCKED_IP).await;
+            }
+        }
+
+        if let Some(asn) = origin.asn {
+            let asns = self.cached_values(AbuseBlockKind::Asn).await?;
+            if asns.iter().any(|a| a.parse() == Ok(asn)) {
+                tracing::info!("Blocked client from AS{}", asn);
+                return self.blocked(COUNTER_BLOCKED_ASN).await;
+            }
+        }
+
+        Ok(())
+    }
+
+    pub async fn list(&self, kind: Option<AbuseBlockKind>) -> AppResult<Vec<AbuseBlock>> {
+        let blocks: Vec<AbuseBlock> = sqlx::query_as(
+            r#"
+            SELECT * FROM abuse_blocks
+            WHERE $1::abuse_block_kind IS NULL OR kind = $1
+            ORDER BY kind, value
+            "#,
+        )
+        .bind(kind)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(blocks)
+    }
+
+    /// Add entries to a blocklist; ones already on it are left unchanged.
+    /// Returns the entries newly added.
+    pub async fn add(
+        &self,
+        admin_id: Uuid,
+        kind: AbuseBlockKind,
+        values: &[String],
+        reason: Option<&str>,
+    ) -> AppResult<Vec<AbuseBlock>> {
+        let normalized = values
+            .iter()
+            .map(|v| {
+                normalize_value(kind, v).ok_or_else(|| {
+                    AppError::Validation(format!("Invalid {}: {}", kind.as_str(), v))
+                })
+            })
+            .collect::<AppResult<Vec<String>>>()?;
+
+        let added: Vec<AbuseBlock> = sqlx::query_as(
+            r#"
+            INSERT INTO abuse_blocks (kind, value, reason, created_by)
+            SELECT $1, v, $3, $4 FROM UNNEST($2::text[]) AS v
+            ON CONFLICT (kind, value) DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(kind)
+        .bind(&normalized)
+        .bind(reason)
+        .bind(admin_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        self.redis
+            .invalidate_cached_blocklist(kind.as_str())
+            .await?;
+
+        let added_values: Vec<&str> = added.iter().map(|b| b.value.as_str()).collect();
+        self.audit
+            .record(
+                Some(admin_id),
+                "abuse_block.added",
+                "abuse_block",
+                None,
+                json!({ "kind": kind, "values": added_values, "reason": reason }),
+            )
+            .await?;
+
+        Ok(added)
+    }
+
+    pub async fn remove(&self, admin_id: Uuid, block_id: Uuid) -> AppResult<()> {
+        let removed: Option<AbuseBlock> =
+            sqlx::query_as("DELETE FROM abuse_blocks WHERE id = $1 RETURNING *")
+                .bind(block_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        let removed = removed.ok_or(AppError::AbuseBlockNotFound)?;
+
+        self.redis
+            .invalidate_cached_blocklist(removed.kind.as_str())
+            .await?;
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "abuse_block.removed",
+                "abuse_block",
+                Some(&removed.id.to_string()),
+                json!({ "kind": removed.kind, "value": removed.value }),
+            )
+            .await?;
+
+        Ok(())
+    }
+
+    /// Values on one list, from Redis when cached
+    async fn cached_values(&self, kind: AbuseBlockKind) -> AppResult<Vec<String>> {
+        if let Some(cached) = self.redis.get_cached_blocklist(kind.as_str()).await? {
+            if let Ok(values) = serde_json::from_str::<Vec<String>>(&cached) {
+                return Ok(values);
+            }
+        }
+
+        let values: Vec<String> =
+            sqlx::query_scalar("SELECT value FROM abuse_blocks WHERE kind = $1")
+                .bind(kind)
+                .fetch_all(&self.db)
+                .await?;
+
+        if let Ok(json) = serde_json::to_string(&values) {
+            self.redis
+                .set_cached_blocklist(kind.as_str(), &json, BLOCKLIST_CACHE_TTL)
+                .await?;
+        }
+
+        Ok(values)
+    }
+
+    async fn blocked(&self, counter: &str) -> AppResult<()> {
+        let _ = AnalyticsService::new(self.redis.clone())
+            .incr(counter)
+            .await;
+        Err(AppError::RequestBlocked)
+    }
+}
+
+/// Canonical form of a blocklist entry, or `None` if it isn't valid for
+/// the list: `+` and digits for prefixes, a network address with its host
+/// bits cleared for ranges, a bare number for ASNs
+fn normalize_value(kind: AbuseBlockKind, value: &str) -> Option<String> {
+    let value = value.trim();
+    match kind {
+        AbuseBlockKind::PhonePrefix => {
+            let digits = value.strip_prefix('+')?;
+            (!digits.is_empty() && digits.len() <= 15 && digits.chars().all(|c| c.is_ascii_digit()))
+                .then(|| value.to_string())
+        }
+        AbuseBlockKind::IpCidr => {
+            let (network, prefix_len) = parse_cidr(value)?;
+            Some(format!("{}/{}", mask(network, prefix_len), prefix_len))
+        }
+        AbuseBlockKind::Asn => {
+            let asn: u32 = value
+                .trim_start_matches("AS")
+                .trim_start_matches("as")
+                .parse()
+                .ok()?;
+            Some(asn.to_string())
+        }
+    }
+}
+
+/// `203.0.113.0/24`, `2001:db8::/32`, or a single address
+fn parse_cidr(value: &str) -> Option<(IpAddr, u8)> {
+    let (addr, prefix_len) = match value.split_once('/') {
+        Some((addr, len)) => (addr.parse::<IpAddr>().ok()?, Some(len.parse::<u8>().ok()?)),
+        None => (value.parse::<IpAddr>().ok()?, None),
+    };
+    let max_len = if addr.is_ipv4() { 32 } else { 128 };
+    let prefix_len = prefix_len.unwrap_or(max_len);
+
+    (prefix_len <= max_len).then_some((addr, prefix_len))
+}
+
+fn cidr_contains(network: IpAddr, prefix_len: u8, ip: IpAddr) -> bool {
+    // IPv4 clients reaching a dual-stack listener show up as ::ffff:a.b.c.d
+    let ip = match ip {
+        IpAddr::V6(v6) => v6.to_ipv4_mapped().map(IpAddr::V4).unwrap_or(ip),
+        IpAddr::V4(_) => ip,
+    };
+    network.is_ipv4() == ip.is_ipv4() && mask(network, prefix_len) == mask(ip, prefix_len)
+}
+
+fn mask(ip: IpAddr, prefix_len: u8) -> IpAddr {
+    match ip {
+        IpAddr::V4(v4) => {
+            let bits = u32::from(v4)
+                & u32::MAX
+                    .checked_shl(32 - u32::from(prefix_len))
+                    .unwrap_or(0);
+            IpAddr::V4(bits.into())
+        }
+        IpAddr::V6(v6) => {
+            let bits = u128::from(v6)
+                & u128::MAX
+                    .checked_shl(128 - u32::from(prefix_len))
+                    .unwrap_or(0);
+            IpAddr::V6(bits.into())
+        }
+    }
+}
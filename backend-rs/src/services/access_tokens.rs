@@ -0,0 +1,268 @@
+use std::time::Duration;
+
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use chrono::Utc;
+use rand::RngCore;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::{types::Json, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    config::AccessTokenConfig,
+    error::{AppError, AppResult},
+    models::{AccessToken, CreateAccessTokenRequest, CreatedAccessToken},
+    services::{
+        audit::AuditService,
+        auth::{Claims, Scope},
+    },
+    storage::redis::RedisClient,
+};
+
+/// Prefix of personal access tokens, so they are easy to tell apart from JWTs
+pub const TOKEN_PREFIX: &str = "atp_";
+pub const RATE_WINDOW: Duration = Duration::from_secs(60);
+/// How stale `last_used_at` may get before a request refreshes it
+const LAST_USED_RESOLUTION_SECS: i64 = 60;
+
+/// Long-lived tokens a user hands to third-party clients in place of the
+/// OTP login. A token acts as the user and the device that created it,
+/// limited to its scopes, and carries its own request rate limit.
+pub struct AccessTokensService {
+    db: PgPool,
+    redis: RedisClient,
+    config: AccessTokenConfig,
+    audit: AuditService,
+}
+
+impl AccessTokensService {
+    pub fn new(db: PgPool, redis: RedisClient, config: AccessTokenConfig) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            redis,
+            config,
+            audit,
+        }
+    }
+
+    /// Issue a token for the caller's device. Scopes can only narrow the
+    /// caller's own. The token is returned once; only its hash is stored.
+    pub async fn create(
+        &self,
+        claims: &Claims,
+        req: CreateAccessTokenRequest,
+    ) -> AppResult<CreatedAccessToken> {
+        let user_id = Uuid::parse_str(&claims.sub).map_err(|_| AppError::InvalidToken)?;
+        let device_id: i32 = claims
+            .device_id
+            .parse()
+            .map_err(|_| AppError::InvalidToken)?;
+
+        let name = req.name.trim();
+        if name.is_empty() || name.chars().count() > 100 {
+            return Err(AppError::Validation(
+                "Name must be between 1 and 100 characters".to_string(),
+            ));
+        }
+
+        let mut scopes = req.scopes;
+        scopes.sort_by_key(|s| s.as_str());
+        scopes.dedup();
+        if scopes.is_empty() {
+            return Err(AppError::Validation(
+                "At least one scope is required".to_string(),
+            ));
+        }
+        if let Some(missing) = scopes
+            .iter()
+            .find(|s| !claims.scopes.is_empty() && !claims.scopes.contains(s))
+        {
+            return Err(AppError::InsufficientScope(*missing));
+        }
+        if scopes.contains(&Scope::Admin) {
+            let is_admin: Option<bool> =
+                sqlx::query_scalar("SELECT is_admin FROM users WHERE id = $1")
+                    .bind(user_id)
+                    .fetch_optional(&self.db)
+                    .await?;
+            if !is_admin.unwrap_or(false) {
+                return Err(AppError::Forbidden);
+            }
+        }
+
+        let rate_limit = req
+            .rate_limit
+            .map(i64::from)
+            .unwrap_or(self.config.default_rate_limit);
+        if rate_limit < 1 || rate_limit > self.config.max_rate_limit {
+            return Err(AppError::Validation(format!(
+                "Rate limit must be between 1 and {} requests per minute",
+                self.config.max_rate_limit
+            )));
+        }
+
+        if req.expires_at.is_some_and(|at| at <= Utc::now()) {
+            return Err(AppError::Validation(
+                "Expiry must be in the future".to_string(),
+            ));
+        }
+
+        let (active,): (i64,) = sqlx::query_as(
+            r#"
+            SELECT COUNT(*) FROM access_tokens
+            WHERE user_id = $1 AND revoked_at IS NULL
+              AND (expires_at IS NULL OR expires_at > NOW())
+            "#,
+        )
+        .bind(user_id)
+        .fetch_one(&self.db)
+        .await?;
+        if active >= self.config.max_per_user {
+            return Err(AppError::LimitExceeded(format!(
+                "accounts are limited to {} access tokens",
+                self.config.max_per_user
+            )));
+        }
+
+        let mut secret = [0u8; 32];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let token = format!("{}{}", TOKEN_PREFIX, URL_SAFE_NO_PAD.encode(secret));
+
+        let access_token: AccessToken = sqlx::query_as(
+            r#"
+            INSERT INTO access_tokens (id, user_id, device_id, name, token_hash, scopes, rate_limit, expires_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(device_id)
+        .bind(name)
+        .bind(hash_token(&token))
+        .bind(Json(&scopes))
+        .bind(rate_limit as i32)
+        .bind(req.expires_at)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.record(user_id, "access_token.created", &access_token)
+            .await?;
+
+        Ok(CreatedAccessToken {
+            access_token,
+            token,
+        })
+    }
+
+    /// The user's tokens, newest first, including revoked and expired ones
+    pub async fn list(&self, user_id: Uuid) -> AppResult<Vec<AccessToken>> {
+        let tokens: Vec<AccessToken> = sqlx::query_as(
+            "SELECT * FROM access_tokens WHERE user_id = $1 ORDER BY created_at DESC",
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(tokens)
+    }
+
+    /// Stop accepting a token. Revoking twice is a no-op.
+    pub async fn revoke(&self, user_id: Uuid, token_id: Uuid) -> AppResult<AccessToken> {
+        let access_token: Option<AccessToken> = sqlx::query_as(
+            r#"
+            UPDATE access_tokens SET revoked_at = COALESCE(revoked_at, NOW())
+            WHERE id = $1 AND user_id = $2
+            RETURNING *
+            "#,
+        )
+        .bind(token_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let access_token = access_token.ok_or(AppError::AccessTokenNotFound)?;
+        self.record(user_id, "access_token.revoked", &access_token)
+            .await?;
+
+        Ok(access_token)
+    }
+
+    /// Look up a live token and count the request against its rate limit.
+    /// A read-only region doesn't record the use.
+    pub async fn authenticate(&self, token: &str, read_only: bool) -> AppResult<AccessToken> {
+        if !token.starts_with(TOKEN_PREFIX) {
+            return Err(AppError::InvalidToken);
+        }
+
+        let access_token: Option<AccessToken> = sqlx::query_as(
+            r#"
+            SELECT * FROM access_tokens
+            WHERE token_hash = $1 AND revoked_at IS NULL
+              AND (expires_at IS NULL OR expires_at > NOW())
+            "#,
+        )
+        .bind(hash_token(token))
+        .fetch_optional(&self.db)
+        .await?;
+        let access_token = access_token.ok_or(AppError::InvalidToken)?;
+
+        if let Some(retry_after) = self
+            .redis
+            .claim_access_token_quota(
+                &access_token.id.to_string(),
+                access_token.rate_limit as i64,
+                RATE_WINDOW,
+            )
+            .await?
+        {
+            return Err(AppError::RateLimited(retry_after));
+        }
+
+        // Coarse on purpose, so busy tokens don't write on every request
+        let stale = access_token.last_used_at.map_or(true, |at| {
+            (Utc::now() - at).num_seconds() >= LAST_USED_RESOLUTION_SECS
+        });
+        if stale && !read_only {
+            sqlx::query("UPDATE access_tokens SET last_used_at = NOW() WHERE id = $1")
+                .bind(access_token.id)
+                .execute(&self.db)
+                .await?;
+        }
+
+        Ok(access_token)
+    }
+
+    async fn record(&self, actor_id: Uuid, action: &str, token: &AccessToken) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "access_token",
+                Some(&token.id.to_string()),
+                json!({ "name": token.name, "scopes": token.scopes }),
+            )
+            .await
+    }
+}
+
+/// Request claims for a token, as if it were a downscoped JWT
+pub fn token_claims(token: &AccessToken, issuer: &str) -> Claims {
+    Claims {
+        sub: token.user_id.to_string(),
+        device_id: token.device_id.to_string(),
+        iss: issuer.to_string(),
+        exp: token.expires_at.map_or(i64::MAX, |at| at.timestamp()),
+        iat: token.created_at.timestamp(),
+        workspace_id: None,
+        scopes: token.scopes.0.clone(),
+        cnf: None,
+        act: None,
+        guest: false,
+    }
+}
+
+fn hash_token(token: &str) -> String {
+    format!("{:x}", Sha256::digest(token.as_bytes()))
+}
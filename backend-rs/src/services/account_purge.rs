@@ -0,0 +1,589 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Duration, Months, Utc};
+use serde::Deserialize;
+use serde_json::json;
+use sqlx::{FromRow, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    config::{AccountPurgeConfig, ArchiveConfig, StorageConfig},
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::PurgeExclusion,
+    services::{
+        archives::ArchiveService, attachments::AttachmentsService, audit::AuditService,
+        otp_delivery::OtpDeliveryService, storage::StorageService,
+    },
+    storage::minio::MinioClient,
+};
+
+pub const PURGE_WARNING_JOB_KIND: &str = "account.purge_warning";
+pub const PURGE_JOB_KIND: &str = "account.purge";
+
+/// An account past the point where warnings start
+#[derive(Debug, FromRow)]
+struct Candidate {
+    id: Uuid,
+    /// Latest of sign-up, last presence, device activity and session use
+    last_active: DateTime<Utc>,
+}
+
+/// Flags accounts nobody has used for `inactive_months`, warns them by email
+/// ahead of the purge and then purges them through the job queue. Purging
+/// wipes the account's messages (archived ones too), keys, devices,
+/// contacts and media and leaves a tombstone row, since conversations still
+/// refer to it.
+///
+/// Admins, bridge service accounts, widget guests (closed by
+/// `GuestsService` instead), accounts under a legal hold and accounts on the
+/// exclusion list are never purged. Messages in
+/// conversations under a legal hold are kept.
+pub struct AccountPurgeService {
+    db: PgPool,
+    minio: MinioClient,
+    jobs: JobQueue,
+    config: AccountPurgeConfig,
+    storage_config: StorageConfig,
+    archive_config: ArchiveConfig,
+    audit: AuditService,
+}
+
+impl AccountPurgeService {
+    pub fn new(
+        db: PgPool,
+        minio: MinioClient,
+        jobs: JobQueue,
+        config: AccountPurgeConfig,
+        storage_config: StorageConfig,
+        archive_config: ArchiveConfig,
+    ) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            minio,
+            jobs,
+            config,
+            storage_config,
+            archive_config,
+            audit,
+        }
+    }
+
+    pub async fn run_scheduler(&self) {
+        tracing::info!(
+            "Account purge started (after {} months inactive)",
+            self.config.inactive_months
+        );
+
+        loop {
+            match self.schedule_pass().await {
+                Ok((0, 0)) => {}
+                Ok((warned, purged)) => tracing::info!(
+                    "Queued {} purge warnings and {} account purges",
+                    warned,
+                    purged
+                ),
+                Err(e) => tracing::error!("Account purge pass failed: {}", e),
+            }
+
+            tokio::time::sleep(self.config.interval).await;
+        }
+    }
+
+    /// Queue the warnings and purges that are due. Returns how many of each
+    /// were queued.
+    async fn schedule_pass(&self) -> AppResult<(usize, usize)> {
+        let now = Utc::now();
+        let (mut warned, mut purged) = (0, 0);
+        let mut after = Uuid::nil();
+
+        loop {
+            let candidates = self.candidates(now, None, after).await?;
+            let Some(last) = candidates.last() else {
+                break;
+            };
+            after = last.id;
+
+            for candidate in &candidates {
+                let deadline = self.deadline(candidate, now).await?;
+
+                if let Some(days_before) = self
+                    .record_due_warnings(candidate.id, deadline, now)
+                    .await?
+                {
+                    self.jobs
+                        .enqueue(
+                            PURGE_WARNING_JOB_KIND,
+                            json!({ "user_id": candidate.id, "days_before": days_before }),
+                        )
+                        .await?;
+                    warned += 1;
+                }
+
+                if now >= deadline {
+                    self.jobs
+                        .enqueue(PURGE_JOB_KIND, json!({ "user_id": candidate.id }))
+                        .await?;
+                    purged += 1;
+                }
+            }
+        }
+
+        Ok((warned, purged))
+    }
+
+    /// Accounts close enough to their purge that the first warning is due,
+    /// by id after `after`. With `user_id`, only that account.
+    async fn candidates(
+        &self,
+        now: DateTime<Utc>,
+        user_id: Option<Uuid>,
+        after: Uuid,
+    ) -> AppResult<Vec<Candidate>> {
+        let cutoff = (now + Duration::days(self.max_warning_days()))
+            .checked_sub_months(Months::new(self.config.inactive_months))
+            .unwrap_or(DateTime::<Utc>::MIN_UTC);
+
+        let candidates: Vec<Candidate> = sqlx::query_as(
+            r#"
+            WITH activity AS (
+                SELECT u.id,
+                       GREATEST(u.created_at, u.last_seen_at, d.last_active_at, s.last_used_at)
+                           AS last_active
+                FROM users u
+                LEFT JOIN LATERAL (
+                    SELECT MAX(last_active_at) AS last_active_at FROM devices WHERE user_id = u.id
+                ) d ON true
+                LEFT JOIN LATERAL (
+                    SELECT MAX(last_used_at) AS last_used_at FROM sessions WHERE user_id = u.id
+                ) s ON true
+                WHERE u.purged_at IS NULL AND u.is_admin = false AND u.is_guest = false
+                AND u.is_bot = false
+                AND ($2::UUID IS NULL OR u.id = $2)
+                AND NOT EXISTS (SELECT 1 FROM purge_exclusions e WHERE e.user_id = u.id)
+                AND NOT EXISTS (
+                    SELECT 1 FROM bridges b WHERE b.user_id = u.id AND b.revoked_at IS NULL
+                )
+                AND NOT EXISTS (
+                    SELECT 1 FROM legal_holds h
+                    WHERE h.target_type = 'user' AND h.target_id = u.id AND h.released_at IS NULL
+                )
+            )
+            SELECT id, last_active FROM activity
+            WHERE last_active < $1 AND id > $3
+            ORDER BY id
+            LIMIT $4
+            "#,
+        )
+        .bind(cutoff)
+        .bind(user_id)
+        .bind(after)
+        .bind(self.config.batch_size)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(candidates)
+    }
+
+    /// When the account will be purged. The first warning fixes the date;
+    /// activity since then pushes it back and starts the warnings over.
+    async fn deadline(
+        &self,
+        candidate: &Candidate,
+        now: DateTime<Utc>,
+    ) -> AppResult<DateTime<Utc>> {
+        let policy = candidate
+            .last_active
+            .checked_add_months(Months::new(self.config.inactive_months))
+            .unwrap_or(DateTime::<Utc>::MAX_UTC);
+
+        let recorded: Option<DateTime<Utc>> =
+            sqlx::query_scalar("SELECT MIN(deadline) FROM purge_warnings WHERE user_id = $1")
+                .bind(candidate.id)
+                .fetch_one(&self.db)
+                .await?;
+
+        match recorded {
+            Some(deadline) if deadline >= policy => Ok(deadline),
+            Some(_) => {
+                sqlx::query("DELETE FROM purge_warnings WHERE user_id = $1")
+                    .bind(candidate.id)
+                    .execute(&self.db)
+                    .await?;
+                Ok(policy.max(now + Duration::days(self.max_warning_days())))
+            }
+            // Never less notice than the earliest warning promises
+            None => Ok(policy.max(now + Duration::days(self.max_warning_days()))),
+        }
+    }
+
+    /// Record the warnings due by now. Returns the one to send, if any; when
+    /// several came due at once (the scheduler was down), only the most
+    /// urgent goes out.
+    async fn record_due_warnings(
+        &self,
+        user_id: Uuid,
+        deadline: DateTime<Utc>,
+        now: DateTime<Utc>,
+    ) -> AppResult<Option<u32>> {
+        let mut to_send = None;
+
+        for &days_before in &self.config.warning_days {
+            if now < deadline - Duration::days(days_before as i64) {
+                continue;
+            }
+
+            let inserted = sqlx::query(
+                r#"
+                INSERT INTO purge_warnings (user_id, days_before, deadline)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (user_id, days_before) DO NOTHING
+                "#,
+            )
+            .bind(user_id)
+            .bind(days_before as i32)
+            .bind(deadline)
+            .execute(&self.db)
+            .await?
+            .rows_affected()
+                > 0;
+
+            if inserted && to_send.map_or(true, |d| days_before < d) {
+                to_send = Some(days_before);
+            }
+        }
+
+        Ok(to_send)
+    }
+
+    /// Send a recorded warning, unless the account was used or excluded
+    /// since it was recorded. Accounts without an email get no warning.
+    pub async fn send_warning(
+        &self,
+        delivery: &OtpDeliveryService,
+        app_name: &str,
+        user_id: Uuid,
+        days_before: u32,
+    ) -> AppResult<()> {
+        let warning: Option<(Option<String>, DateTime<Utc>)> = sqlx::query_as(
+            r#"
+            SELECT u.email, w.deadline FROM purge_warnings w
+            JOIN users u ON u.id = w.user_id
+            WHERE w.user_id = $1 AND w.days_before = $2 AND u.purged_at IS NULL
+            "#,
+        )
+        .bind(user_id)
+        .bind(days_before as i32)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let Some((Some(email), deadline)) = warning else {
+            return Ok(());
+        };
+
+        let subject = format!(
+            "Your {} account will be deleted in {} day{}",
+            app_name,
+            days_before,
+            if days_before == 1 { "" } else { "s" }
+        );
+        let text = format!(
+            "Nobody has signed in to your {} account for a long time. Sign in before {} to keep it.\n\n\
+             Otherwise, on that date your messages, keys and media will be deleted. This can't be undone.",
+            app_name,
+            deadline.format("%B %-d, %Y"),
+        );
+
+        delivery.send_notice(&email, &subject, &text).await
+    }
+
+    /// Purge the account if it is still due. Safe to run more than once.
+    pub async fn purge(&self, user_id: Uuid) -> AppResult<()> {
+        let now = Utc::now();
+        let Some(candidate) = self
+            .candidates(now, Some(user_id), Uuid::nil())
+            .await?
+            .into_iter()
+            .next()
+        else {
+            return Ok(());
+        };
+        if now < self.deadline(&candidate, now).await? {
+            return Ok(());
+        }
+
+        self.purge_media(user_id).await?;
+        ArchiveService::new(
+            self.db.clone(),
+            self.minio.clone(),
+            self.archive_config.clone(),
+        )
+        .wipe_sender(user_id)
+        .await?;
+
+        let mut tx = self.db.begin().await?;
+
+        // Wiped like a sender-deleted message; conversation lists change too
+        sqlx::query(
+            r#"
+            WITH wiped AS (
+                UPDATE messages SET deleted_at = NOW(), content = ''::BYTEA
+                WHERE sender_id = $1 AND deleted_at IS NULL
+                AND NOT EXISTS (
+                    SELECT 1 FROM legal_holds h
+                    WHERE h.target_type = 'conversation' AND h.target_id = messages.conversation_id
+                    AND h.released_at IS NULL
+                )
+                RETURNING conversation_id
+            )
+            UPDATE conversations SET updated_at = NOW()
+            WHERE id IN (SELECT DISTINCT conversation_id FROM wiped)
+            "#,
+        )
+        .bind(user_id)
+        .execute(&mut *tx)
+        .await?;
+
+        for query in [
+            "DELETE FROM signal_prekeys WHERE user_id = $1",
+            "DELETE FROM signal_signed_prekeys WHERE user_id = $1",
+            "DELETE FROM signal_identity_keys WHERE user_id = $1",
+            "DELETE FROM sessions WHERE user_id = $1",
+            // Also revokes the devices' access tokens
+            "DELETE FROM devices WHERE user_id = $1",
+            "DELETE FROM contacts WHERE user_id = $1 OR contact_id = $1",
+            "DELETE FROM user_sticker_packs WHERE user_id = $1",
+            "DELETE FROM workspace_members WHERE user_id = $1",
+            "DELETE FROM backups WHERE user_id = $1",
+            "DELETE FROM purge_warnings WHERE user_id = $1",
+            "UPDATE participants SET left_at = NOW() WHERE user_id = $1 AND left_at IS NULL",
+        ] {
+            sqlx::query(query).bind(user_id).execute(&mut *tx).await?;
+        }
+
+        sqlx::query(
+            r#"
+            UPDATE users
+            SET phone = NULL, email = NULL, username = 'deleted-' || id::TEXT,
+                display_name = 'Deleted account', avatar_url = NULL, bio = NULL,
+                status = 'offline', last_seen_at = NULL, discoverable = false,
+                purged_at = NOW()
+            WHERE id = $1
+            "#,
+        )
+        .bind(user_id)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.audit
+            .record(
+                None,
+                "account.purged",
+                "user",
+                Some(&user_id.to_string()),
+                json!({ "last_active": candidate.last_active }),
+            )
+            .await?;
+
+        tracing::info!("Purged inactive account {}", user_id);
+        Ok(())
+    }
+
+    /// Drop the account's attachment references (blobs nobody else refers
+    /// to go with them) and delete its avatars and backups
+    async fn purge_media(&self, user_id: Uuid) -> AppResult<()> {
+        let attachments = AttachmentsService::new(
+            self.db.clone(),
+            self.minio.clone(),
+            self.jobs.clone(),
+            self.storage_config.clone(),
+        );
+        let ref_ids: Vec<Uuid> =
+            sqlx::query_scalar("SELECT id FROM attachment_refs WHERE user_id = $1")
+                .bind(user_id)
+                .fetch_all(&self.db)
+                .await?;
+        for ref_id in ref_ids {
+            match attachments.release_reference(user_id, ref_id).await {
+                // Released by a previous, interrupted run
+                Err(AppError::AttachmentNotFound) => {}
+                result => result?,
+            }
+        }
+
+        let storage = StorageService::new(self.db.clone(), self.storage_config.clone());
+        let objects: Vec<(String, String)> = sqlx::query_as(
+            r#"
+            SELECT bucket, object_key FROM storage_objects
+            WHERE user_id = $1 AND category IN ('avatar', 'backup')
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+        for (bucket, key) in objects {
+            self.minio.delete_file(&bucket, &key).await?;
+            storage.release(&bucket, &key).await?;
+        }
+
+        Ok(())
+    }
+
+    pub async fn list_exclusions(&self) -> AppResult<Vec<PurgeExclusion>> {
+        let exclusions: Vec<PurgeExclusion> =
+            sqlx::query_as("SELECT * FROM purge_exclusions ORDER BY created_at DESC")
+                .fetch_all(&self.db)
+                .await?;
+
+        Ok(exclusions)
+    }
+
+    /// Exempt an account from the purge. Warnings already sent are dropped,
+    /// so a later removal starts the account over.
+    pub async fn exclude(
+        &self,
+        admin_id: Uuid,
+        user_id: Uuid,
+        reason: Option<&str>,
+    ) -> AppResult<PurgeExclusion> {
+        let exists: Option<Uuid> =
+            sqlx::query_scalar("SELECT id FROM users WHERE id = $1 AND purged_at IS NULL")
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+        if exists.is_none() {
+            return Err(AppError::UserNotFound);
+        }
+
+        let reason = reason.map(str::trim).filter(|r| !r.is_empty());
+        let exclusion: PurgeExclusion = sqlx::query_as(
+            r#"
+            INSERT INTO purge_exclusions (user_id, reason, created_by)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (user_id) DO UPDATE SET reason = EXCLUDED.reason
+            RETURNING *
+            "#,
+        )
+        .bind(user_id)
+        .bind(reason)
+        .bind(admin_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        sqlx::query("DELETE FROM purge_warnings WHERE user_id = $1")
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "purge_exclusion.added",
+                "user",
+                Some(&user_id.to_string()),
+                json!({ "reason": reason }),
+            )
+            .await?;
+
+        Ok(exclusion)
+    }
+
+    pub async fn remove_exclusion(&self, admin_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        let result = sqlx::query("DELETE FROM purge_exclusions WHERE user_id = $1")
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+        if result.rows_affected() == 0 {
+            return Err(AppError::PurgeExclusionNotFound);
+        }
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "purge_exclusion.removed",
+                "user",
+                Some(&user_id.to_string()),
+                json!({}),
+            )
+            .await
+    }
+
+    fn max_warning_days(&self) -> i64 {
+        self.config.warning_days.iter().copied().max().unwrap_or(0) as i64
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct PurgeWarningPayload {
+    user_id: Uuid,
+    days_before: u32,
+}
+
+/// Sends one recorded purge warning by email
+pub struct PurgeWarningJob {
+    purge: AccountPurgeService,
+    delivery: OtpDeliveryService,
+    app_name: String,
+}
+
+impl PurgeWarningJob {
+    pub fn new(purge: AccountPurgeService, delivery: OtpDeliveryService, app_name: String) -> Self {
+        Self {
+            purge,
+            delivery,
+            app_name,
+        }
+    }
+}
+
+#[async_trait]
+impl JobHandler for PurgeWarningJob {
+    fn kind(&self) -> &'static str {
+        PURGE_WARNING_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let payload: PurgeWarningPayload = serde_json::from_value(job.payload.clone())
+            .map_err(|e| anyhow::anyhow!("Invalid purge warning job: {}", e))?;
+
+        self.purge
+            .send_warning(
+                &self.delivery,
+                &self.app_name,
+                payload.user_id,
+                payload.days_before,
+            )
+            .await
+    }
+}
+
+/// Purges one account once it is due
+pub struct AccountPurgeJob {
+    purge: AccountPurgeService,
+}
+
+impl AccountPurgeJob {
+    pub fn new(purge: AccountPurgeService) -> Self {
+        Self { purge }
+    }
+}
+
+#[async_trait]
+impl JobHandler for AccountPurgeJob {
+    fn kind(&self) -> &'static str {
+        PURGE_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let user_id = job
+            .payload
+            .get("user_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Account purge job is missing user_id"))?;
+
+        self.purge.purge(user_id).await
+    }
+}
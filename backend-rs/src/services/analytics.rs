@@ -0,0 +1,128 @@
+use std::collections::HashMap;
+use std::time::Duration;
+
+use chrono::{Duration as ChronoDuration, Utc};
+use serde::Serialize;
+use uuid::Uuid;
+
+use crate::{error::AppResult, services::publisher, storage::redis::RedisClient};
+
+const ACTIVE_USERS_TTL: Duration = Duration::from_secs(35 * 24 * 60 * 60);
+const COUNTERS_TTL: Duration = Duration::from_secs(400 * 24 * 60 * 60);
+
+// Counter names
+pub const COUNTER_MESSAGES_SENT: &str = "messages_sent";
+pub const COUNTER_STICKERS_SENT: &str = "stickers_sent";
+pub const COUNTER_SIGNUPS: &str = "signups";
+pub const COUNTER_BLOCKED_PHONE_PREFIX: &str = "blocked_phone_prefix";
+pub const COUNTER_BLOCKED_EMAIL_DOMAIN: &str = "blocked_email_domain";
+pub const COUNTER_BLOCKED_IP: &str = "blocked_ip";
+pub const COUNTER_BLOCKED_ASN: &str = "blocked_asn";
+
+#[derive(Debug, Clone, Serialize)]
+pub struct DailyStats {
+    pub date: String,
+    pub active_users: i64,
+    pub counters: HashMap<String, i64>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct AnalyticsSummary {
+    pub dau: i64,
+    pub mau: i64,
+    pub days: Vec<DailyStats>,
+}
+
+/// Privacy-safe aggregate analytics. Only user ids (for distinct counts) and
+/// counters are stored; nothing about message content or recipients.
+pub struct AnalyticsService {
+    redis: RedisClient,
+}
+
+impl AnalyticsService {
+    pub fn new(redis: RedisClient) -> Self {
+        Self { redis }
+    }
+
+    /// Mark a user as active today
+    pub async fn record_active(&self, user_id: Uuid) -> AppResult<()> {
+        self.redis
+            .track_active_user(&today(), &user_id.to_string(), ACTIVE_USERS_TTL)
+            .await
+    }
+
+    /// Increment today's value of a counter
+    pub async fn incr(&self, counter: &str) -> AppResult<()> {
+        self.redis
+            .incr_daily_counter(&today(), counter, COUNTERS_TTL)
+            .await
+    }
+
+    /// DAU, rolling 30-day MAU and per-day stats for the last `days` days
+    pub async fn summary(&self, days: i64) -> AppResult<AnalyticsSummary> {
+        let month = last_dates(30);
+        let dau = self.redis.count_active_users(&month[..1]).await?;
+        let mau = self.redis.count_active_users(&month).await?;
+
+        let mut daily = Vec::new();
+        for date in last_dates(days.clamp(1, 90)) {
+            let active_users = self
+                .redis
+                .count_active_users(std::slice::from_ref(&date))
+                .await?;
+            let counters = self.redis.get_daily_counters(&date).await?;
+            daily.push(DailyStats {
+                date,
+                active_users,
+                counters,
+            });
+        }
+
+        Ok(AnalyticsSummary {
+            dau,
+            mau,
+            days: daily,
+        })
+    }
+
+    /// Render today's aggregates in the Prometheus text format
+    pub async fn prometheus_metrics(&self) -> AppResult<String> {
+        let summary = self.summary(1).await?;
+        let mut out = String::new();
+
+        out.push_str("# TYPE ansible_talk_daily_active_users gauge\n");
+        out.push_str(&format!("ansible_talk_daily_active_users {}\n", summary.dau));
+        out.push_str("# TYPE ansible_talk_monthly_active_users gauge\n");
+        out.push_str(&format!("ansible_talk_monthly_active_users {}\n", summary.mau));
+
+        if let Some(today) = summary.days.first() {
+            let mut counters: Vec<_> = today.counters.iter().collect();
+            counters.sort();
+            for (name, value) in counters {
+                out.push_str(&format!("# TYPE ansible_talk_{}_today gauge\n", name));
+                out.push_str(&format!("ansible_talk_{}_today {}\n", name, value));
+            }
+        }
+
+        // Process-local: Redis is usually what failed
+        out.push_str("# TYPE ansible_talk_dropped_publishes_total counter\n");
+        out.push_str(&format!(
+            "ansible_talk_dropped_publishes_total {}\n",
+            publisher::dropped_publishes()
+        ));
+
+        Ok(out)
+    }
+}
+
+fn today() -> String {
+    Utc::now().format("%Y-%m-%d").to_string()
+}
+
+/// The last `days` dates (UTC), today first
+fn last_dates(days: i64) -> Vec<String> {
+    let now = Utc::now();
+    (0..days)
+        .map(|i| (now - ChronoDuration::days(i)).format("%Y-%m-%d").to_string())
+        .collect()
+}
@@ -0,0 +1,452 @@
+use std::io::{Read, Write};
+
+use bytes::Bytes;
+use chrono::{DateTime, Duration, Utc};
+use flate2::{read::GzDecoder, write::GzEncoder, Compression};
+use serde::{Deserialize, Serialize};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::ArchiveConfig,
+    error::AppResult,
+    models::Message,
+    services::legal_holds::LegalHoldsService,
+    storage::minio::MinioClient,
+};
+
+/// Conversations archived per pass before checking again
+const CONVERSATIONS_PER_PASS: i64 = 50;
+
+/// A message as stored in an archive object. The shadow-limit flag is kept so
+/// archived history is filtered the same way as the live table.
+#[derive(Debug, Serialize, Deserialize, sqlx::FromRow)]
+struct ArchivedMessage {
+    #[serde(flatten)]
+    #[sqlx(flatten)]
+    message: Message,
+    shadow_limited: bool,
+}
+
+#[derive(Debug, sqlx::FromRow)]
+struct ArchiveObject {
+    object_key: String,
+}
+
+#[derive(Debug, sqlx::FromRow)]
+struct LockedArchive {
+    conversation_id: Uuid,
+    object_key: String,
+}
+
+/// Cold-storage tier: old messages are moved out of Postgres into
+/// gzip-compressed JSON objects, indexed by `message_archives`. Deletes
+/// rewrite the object, so a deleted message is wiped there as it would be
+/// in Postgres.
+pub struct ArchiveService {
+    db: PgPool,
+    minio: MinioClient,
+    config: ArchiveConfig,
+}
+
+impl ArchiveService {
+    pub fn new(db: PgPool, minio: MinioClient, config: ArchiveConfig) -> Self {
+        Self { db, minio, config }
+    }
+
+    /// Archiver loop: move messages past the threshold out of Postgres
+    pub async fn run_archiver(&self) {
+        tracing::info!(
+            "Message archiver started (after {} days)",
+            self.config.after_days
+        );
+
+        loop {
+            loop {
+                match self.archive_pass().await {
+                    Ok(0) => break,
+                    Ok(count) => tracing::info!("Archived {} messages", count),
+                    Err(e) => {
+                        tracing::error!("Message archiving failed: {}", e);
+                        break;
+                    }
+                }
+            }
+
+            tokio::time::sleep(self.config.interval).await;
+        }
+    }
+
+    /// Archive one batch from each of a few conversations with old messages.
+    /// Returns how many messages were moved.
+    async fn archive_pass(&self) -> AppResult<usize> {
+        let cutoff = Utc::now() - Duration::days(self.config.after_days as i64);
+
+        let conversation_ids: Vec<Uuid> = sqlx::query_scalar(
+            "SELECT DISTINCT conversation_id FROM messages WHERE created_at < $1 LIMIT $2",
+        )
+        .bind(cutoff)
+        .bind(CONVERSATIONS_PER_PASS)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut archived = 0;
+        for conversation_id in conversation_ids {
+            archived += self.archive_batch(conversation_id, cutoff).await?;
+        }
+
+        Ok(archived)
+    }
+
+    /// Move the oldest batch of a conversation's messages before `cutoff` to
+    /// object storage. The object is written before the rows are deleted, so
+    /// a failure leaves at worst an unreferenced object behind.
+    async fn archive_batch(
+        &self,
+        conversation_id: Uuid,
+        cutoff: DateTime<Utc>,
+    ) -> AppResult<usize> {
+        let mut tx = self.db.begin().await?;
+
+        // Rows are locked with SKIP LOCKED so several servers can archive
+        // side by side
+        let batch: Vec<ArchivedMessage> = sqlx::query_as(
+            r#"
+            SELECT * FROM messages
+            WHERE conversation_id = $1 AND created_at < $2
+            ORDER BY created_at ASC
+            LIMIT $3
+            FOR UPDATE SKIP LOCKED
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(cutoff)
+        .bind(self.config.batch_size)
+        .fetch_all(&mut *tx)
+        .await?;
+
+        let (Some(first), Some(last)) = (batch.first(), batch.last()) else {
+            return Ok(0);
+        };
+        let first_created_at = first.message.created_at;
+        let last_created_at = last.message.created_at;
+
+        let archive_id = Uuid::new_v4();
+        let key = format!(
+            "conversations/{}/{}-{}.json.gz",
+            conversation_id,
+            first_created_at.format("%Y%m%dT%H%M%S"),
+            archive_id
+        );
+        self.store(&key, &batch).await?;
+
+        let message_ids: Vec<Uuid> = batch.iter().map(|m| m.message.id).collect();
+
+        sqlx::query(
+            r#"
+            INSERT INTO message_archives (id, conversation_id, object_key, message_ids, message_count, first_created_at, last_created_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            "#,
+        )
+        .bind(archive_id)
+        .bind(conversation_id)
+        .bind(&key)
+        .bind(&message_ids)
+        .bind(message_ids.len() as i32)
+        .bind(first_created_at)
+        .bind(last_created_at)
+        .execute(&mut *tx)
+        .await?;
+
+        // Replies to archived messages keep their reply_to_id
+        sqlx::query("SET LOCAL app.archiving_messages = 'on'")
+            .execute(&mut *tx)
+            .await?;
+
+        sqlx::query(
+            "DELETE FROM messages WHERE id = ANY($1) AND created_at >= $2 AND created_at <= $3",
+        )
+        .bind(&message_ids)
+        .bind(first_created_at)
+        .bind(last_created_at)
+        .execute(&mut *tx)
+        .await?;
+
+        // Sync tokens this batch covered can't be resumed from Postgres
+        if let Some(archived_seq) = batch.iter().filter_map(|m| m.message.seq).max() {
+            sqlx::query(
+                "UPDATE conversations SET archived_message_seq = GREATEST(archived_message_seq, $2) WHERE id = $1",
+            )
+            .bind(conversation_id)
+            .bind(archived_seq)
+            .execute(&mut *tx)
+            .await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(message_ids.len())
+    }
+
+    /// Archived messages the viewer can see, newest first, created before
+    /// `before` (or the newest archived ones)
+    pub async fn list(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        limit: usize,
+        before: Option<DateTime<Utc>>,
+    ) -> AppResult<Vec<Message>> {
+        let archives: Vec<ArchiveObject> = sqlx::query_as(
+            r#"
+            SELECT object_key FROM message_archives
+            WHERE conversation_id = $1 AND ($2::TIMESTAMPTZ IS NULL OR first_created_at < $2)
+            ORDER BY last_created_at DESC
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(before)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut messages = Vec::with_capacity(limit);
+        for archive in archives {
+            let mut batch: Vec<Message> = self
+                .load(&archive.object_key)
+                .await?
+                .into_iter()
+                .filter(|m| !m.shadow_limited || m.message.sender_id == viewer_id)
+                .map(|m| m.message)
+                .filter(|m| m.deleted_at.is_none())
+                .filter(|m| before.map_or(true, |before| m.created_at < before))
+                .collect();
+
+            batch.sort_by(|a, b| b.created_at.cmp(&a.created_at));
+            messages.extend(batch.into_iter().take(limit - messages.len()));
+
+            if messages.len() >= limit {
+                break;
+            }
+        }
+
+        Ok(messages)
+    }
+
+    /// Keys and message counts of the archive objects holding a
+    /// conversation's messages from `since` on, oldest first
+    pub async fn objects_since(
+        &self,
+        conversation_id: Uuid,
+        since: DateTime<Utc>,
+    ) -> AppResult<Vec<(String, i32)>> {
+        let objects: Vec<(String, i32)> = sqlx::query_as(
+            r#"
+            SELECT object_key, message_count FROM message_archives
+            WHERE conversation_id = $1 AND last_created_at >= $2
+            ORDER BY first_created_at ASC
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(since)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(objects)
+    }
+
+    /// Undeleted messages in one archive object that the viewer can see,
+    /// created at or after `since`, oldest first
+    pub async fn load_since(
+        &self,
+        object_key: &str,
+        viewer_id: Uuid,
+        since: DateTime<Utc>,
+    ) -> AppResult<Vec<Message>> {
+        let messages = self
+            .load(object_key)
+            .await?
+            .into_iter()
+            .filter(|m| !m.shadow_limited || m.message.sender_id == viewer_id)
+            .map(|m| m.message)
+            .filter(|m| m.deleted_at.is_none() && m.created_at >= since)
+            .collect();
+
+        Ok(messages)
+    }
+
+    /// When an archived message was created, for resolving a paging cursor
+    pub async fn created_at(
+        &self,
+        conversation_id: Uuid,
+        message_id: Uuid,
+    ) -> AppResult<Option<DateTime<Utc>>> {
+        let archive: Option<ArchiveObject> = sqlx::query_as(
+            "SELECT object_key FROM message_archives WHERE conversation_id = $1 AND message_ids @> ARRAY[$2]",
+        )
+        .bind(conversation_id)
+        .bind(message_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let Some(archive) = archive else {
+            return Ok(None);
+        };
+
+        Ok(self
+            .load(&archive.object_key)
+            .await?
+            .into_iter()
+            .find(|m| m.message.id == message_id)
+            .map(|m| m.message.created_at))
+    }
+
+    /// Delete an archived message for everyone, like
+    /// `MessagingService::delete_message` does for live ones. Returns its
+    /// conversation, or None if the sender has no such undeleted message.
+    pub async fn delete_message(
+        &self,
+        message_id: Uuid,
+        sender_id: Uuid,
+    ) -> AppResult<Option<Uuid>> {
+        let mut tx = self.db.begin().await?;
+
+        // The row lock keeps two rewrites of one object from racing
+        let archive: Option<LockedArchive> = sqlx::query_as(
+            "SELECT conversation_id, object_key FROM message_archives WHERE message_ids @> ARRAY[$1] FOR UPDATE",
+        )
+        .bind(message_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let Some(archive) = archive else {
+            return Ok(None);
+        };
+
+        let held = LegalHoldsService::new(self.db.clone())
+            .is_held(archive.conversation_id, sender_id)
+            .await?;
+
+        let mut batch = self.load(&archive.object_key).await?;
+        let Some(archived) = batch.iter_mut().find(|m| {
+            m.message.id == message_id
+                && m.message.sender_id == sender_id
+                && m.message.deleted_at.is_none()
+        }) else {
+            return Ok(None);
+        };
+        archived.message.deleted_at = Some(Utc::now());
+        if !held {
+            archived.message.content.clear();
+        }
+
+        self.store(&archive.object_key, &batch).await?;
+        tx.commit().await?;
+
+        Ok(Some(archive.conversation_id))
+    }
+
+    /// Wipe everything `sender_id` sent from the archive when the account is
+    /// purged, except in conversations under a legal hold. Returns how many
+    /// messages were wiped.
+    pub async fn wipe_sender(&self, sender_id: Uuid) -> AppResult<usize> {
+        let archive_ids: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT a.id FROM message_archives a
+            WHERE a.conversation_id IN (SELECT conversation_id FROM participants WHERE user_id = $1)
+            AND NOT EXISTS (
+                SELECT 1 FROM legal_holds h
+                WHERE h.target_type = 'conversation' AND h.target_id = a.conversation_id
+                AND h.released_at IS NULL
+            )
+            "#,
+        )
+        .bind(sender_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut wiped = 0;
+        for archive_id in archive_ids {
+            let mut tx = self.db.begin().await?;
+
+            let object_key: Option<String> = sqlx::query_scalar(
+                "SELECT object_key FROM message_archives WHERE id = $1 FOR UPDATE",
+            )
+            .bind(archive_id)
+            .fetch_optional(&mut *tx)
+            .await?;
+            let Some(object_key) = object_key else {
+                continue;
+            };
+
+            let mut batch = self.load(&object_key).await?;
+            let now = Utc::now();
+            let mut changed = 0;
+            for archived in batch
+                .iter_mut()
+                .filter(|m| m.message.sender_id == sender_id && m.message.deleted_at.is_none())
+            {
+                archived.message.deleted_at = Some(now);
+                archived.message.content.clear();
+                changed += 1;
+            }
+
+            if changed > 0 {
+                self.store(&object_key, &batch).await?;
+                wiped += changed;
+            }
+            tx.commit().await?;
+        }
+
+        Ok(wiped)
+    }
+
+    /// Overwrite an archive object in place
+    async fn store(&self, key: &str, batch: &[ArchivedMessage]) -> AppResult<()> {
+        self.minio
+            .upload_private_file(
+                self.minio.archives_bucket(),
+                key,
+                Bytes::from(compress(batch)?),
+                "application/gzip",
+            )
+            .await?;
+
+        Ok(())
+    }
+
+    async fn load(&self, key: &str) -> AppResult<Vec<ArchivedMessage>> {
+        let data = self
+            .minio
+            .download_file(self.minio.archives_bucket(), key)
+            .await?;
+
+        decompress(&data)
+    }
+}
+
+fn compress(messages: &[ArchivedMessage]) -> AppResult<Vec<u8>> {
+    let json = serde_json::to_vec(messages)
+        .map_err(|e| anyhow::anyhow!("Failed to serialize archive: {}", e))?;
+
+    let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+    encoder
+        .write_all(&json)
+        .map_err(|e| anyhow::anyhow!("Failed to compress archive: {}", e))?;
+
+    let data = encoder
+        .finish()
+        .map_err(|e| anyhow::anyhow!("Failed to compress archive: {}", e))?;
+
+    Ok(data)
+}
+
+fn decompress(data: &[u8]) -> AppResult<Vec<ArchivedMessage>> {
+    let mut json = Vec::new();
+    GzDecoder::new(data)
+        .read_to_end(&mut json)
+        .map_err(|e| anyhow::anyhow!("Failed to decompress archive: {}", e))?;
+
+    let messages = serde_json::from_slice(&json)
+        .map_err(|e| anyhow::anyhow!("Failed to parse archive: {}", e))?;
+
+    Ok(messages)
+}
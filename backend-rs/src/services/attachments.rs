@@ -0,0 +1,615 @@
+use std::time::Duration;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::{PgConnection, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    config::StorageConfig,
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        Attachment, AttachmentDeliveryStatus, AttachmentUpload, StorageCategory, TranscodeStatus,
+    },
+    services::{storage::StorageService, transcoding::TranscodingService},
+    storage::minio::MinioClient,
+};
+
+pub const DELETE_OBJECTS_JOB_KIND: &str = "attachment.delete_objects";
+const SWEEP_INTERVAL: Duration = Duration::from_secs(60 * 60);
+
+pub struct AttachmentsService {
+    db: PgPool,
+    minio: MinioClient,
+    storage: StorageService,
+    jobs: JobQueue,
+    config: StorageConfig,
+}
+
+impl AttachmentsService {
+    pub fn new(db: PgPool, minio: MinioClient, jobs: JobQueue, config: StorageConfig) -> Self {
+        Self {
+            storage: StorageService::new(db.clone(), config.clone()),
+            db,
+            minio,
+            jobs,
+            config,
+        }
+    }
+
+    /// Upload an encrypted message attachment. Content that is already stored
+    /// is not written again; the caller just gains a new reference to it.
+    pub async fn upload_attachment(
+        &self,
+        user_id: Uuid,
+        data: Bytes,
+        content_type: &str,
+    ) -> AppResult<AttachmentUpload> {
+        if data.is_empty() {
+            return Err(AppError::BadRequest("Attachment data required".to_string()));
+        }
+
+        if data.len() > self.config.max_attachment_size {
+            return Err(AppError::AttachmentTooLarge(self.config.max_attachment_size));
+        }
+
+        let digest = format!("{:x}", Sha256::digest(&data));
+
+        if let Some(attachment) = self.find_by_digest(&digest).await? {
+            match self.add_reference(attachment.id, user_id, true).await {
+                // Released in the meantime; store it again
+                Err(AppError::AttachmentNotFound) => {}
+                result => return result,
+            }
+        }
+
+        let bucket = self.minio.attachments_bucket();
+        let key = format!("attachments/{}", digest);
+        let size = data.len() as i64;
+
+        self.storage.ensure_quota(user_id, bucket, &key, size).await?;
+
+        // Held until the row exists, so a queued deletion of the previous
+        // copy can't remove the object just written
+        let mut tx = self.db.begin().await?;
+        lock_digest(&mut tx, &digest).await?;
+
+        self.minio.upload_file(bucket, &key, data, content_type).await?;
+
+        let inserted: Option<Attachment> = sqlx::query_as(
+            r#"
+            INSERT INTO attachments
+                (id, digest, object_key, content_type, size_bytes, created_by, transcode_status)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            ON CONFLICT (digest) DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(&digest)
+        .bind(&key)
+        .bind(content_type)
+        .bind(size)
+        .bind(user_id)
+        .bind(TranscodeStatus::for_content_type(content_type))
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        match inserted {
+            Some(attachment) => {
+                self.storage
+                    .record(user_id, StorageCategory::Attachment, bucket, &key, size)
+                    .await?;
+                if attachment.transcode_status == TranscodeStatus::Pending {
+                    TranscodingService::request(&self.jobs, attachment.id).await;
+                }
+                self.add_reference(attachment.id, user_id, false).await
+            }
+            // A concurrent upload stored the same content first
+            None => {
+                let attachment = self
+                    .find_by_digest(&digest)
+                    .await?
+                    .ok_or(AppError::AttachmentNotFound)?;
+                self.add_reference(attachment.id, user_id, true).await
+            }
+        }
+    }
+
+    /// Reference already-stored content by digest without re-uploading it
+    pub async fn claim_attachment(
+        &self,
+        user_id: Uuid,
+        digest: &str,
+    ) -> AppResult<AttachmentUpload> {
+        let attachment = self
+            .find_by_digest(&digest.to_lowercase())
+            .await?
+            .ok_or(AppError::AttachmentNotFound)?;
+
+        self.add_reference(attachment.id, user_id, true).await
+    }
+
+    /// Drop a reference; the blob is purged once no references remain
+    pub async fn release_reference(&self, user_id: Uuid, ref_id: Uuid) -> AppResult<()> {
+        let mut tx = self.db.begin().await?;
+
+        let attachment_id: Option<Uuid> = sqlx::query_scalar(
+            "SELECT attachment_id FROM attachment_refs WHERE id = $1 AND user_id = $2",
+        )
+        .bind(ref_id)
+        .bind(user_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let attachment_id = attachment_id.ok_or(AppError::AttachmentNotFound)?;
+
+        // Locked before the reference goes, in the same order as
+        // add_reference, so the count and the row can't change under us
+        let attachment: Option<Attachment> =
+            sqlx::query_as("SELECT * FROM attachments WHERE id = $1 FOR UPDATE")
+                .bind(attachment_id)
+                .fetch_optional(&mut *tx)
+                .await?;
+        let attachment = attachment.ok_or(AppError::AttachmentNotFound)?;
+
+        let released = sqlx::query("DELETE FROM attachment_refs WHERE id = $1")
+            .bind(ref_id)
+            .execute(&mut *tx)
+            .await?;
+        if released.rows_affected() == 0 {
+            return Err(AppError::AttachmentNotFound);
+        }
+
+        if attachment.ref_count > 1 {
+            sqlx::query("UPDATE attachments SET ref_count = ref_count - 1 WHERE id = $1")
+                .bind(attachment.id)
+                .execute(&mut *tx)
+                .await?;
+            tx.commit().await?;
+            return Ok(());
+        }
+
+        sqlx::query("DELETE FROM attachments WHERE id = $1")
+            .bind(attachment.id)
+            .execute(&mut *tx)
+            .await?;
+
+        tx.commit().await?;
+
+        self.queue_object_deletion(&attachment).await
+    }
+
+    /// Record which conversation a reference was sent to, letting its
+    /// participants download the content. With delete-after-download, every
+    /// other device of its current participants then has to confirm the
+    /// download before the content is deleted.
+    pub async fn declare_deliveries(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        ref_id: Uuid,
+        conversation_id: Uuid,
+    ) -> AppResult<AttachmentDeliveryStatus> {
+        let mut tx = self.db.begin().await?;
+
+        let attachment_id: Option<Uuid> = sqlx::query_scalar(
+            r#"
+            UPDATE attachment_refs SET deliveries_declared_at = NOW()
+            WHERE id = $1 AND user_id = $2
+            RETURNING attachment_id
+            "#,
+        )
+        .bind(ref_id)
+        .bind(user_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let attachment_id = attachment_id.ok_or(AppError::AttachmentNotFound)?;
+
+        let is_participant: bool = sqlx::query_scalar(
+            r#"
+            SELECT EXISTS(
+                SELECT 1 FROM participants
+                WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL
+            )
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_one(&mut *tx)
+        .await?;
+        if !is_participant {
+            return Err(AppError::NotParticipant);
+        }
+
+        sqlx::query(
+            "INSERT INTO attachment_conversations (attachment_id, conversation_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+        )
+        .bind(attachment_id)
+        .bind(conversation_id)
+        .execute(&mut *tx)
+        .await?;
+
+        if !self.config.delete_after_download {
+            tx.commit().await?;
+            return self.delivery_status(attachment_id).await;
+        }
+
+        sqlx::query(
+            r#"
+            INSERT INTO attachment_deliveries (attachment_id, user_id, device_id)
+            SELECT $1, d.user_id, d.device_id
+            FROM participants p
+            JOIN devices d ON d.user_id = p.user_id
+            WHERE p.conversation_id = $2 AND p.left_at IS NULL
+            AND NOT (d.user_id = $3 AND d.device_id = $4)
+            ON CONFLICT DO NOTHING
+            "#,
+        )
+        .bind(attachment_id)
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(device_id)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.delivery_status(attachment_id).await
+    }
+
+    /// Confirm this device has downloaded an attachment, deleting the content
+    /// if it was the last one waiting
+    pub async fn confirm_download(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        attachment_id: Uuid,
+    ) -> AppResult<AttachmentDeliveryStatus> {
+        self.ensure_delete_after_download()?;
+
+        let exists: bool =
+            sqlx::query_scalar("SELECT EXISTS(SELECT 1 FROM attachments WHERE id = $1)")
+                .bind(attachment_id)
+                .fetch_one(&self.db)
+                .await?;
+        if !exists {
+            return Err(AppError::AttachmentNotFound);
+        }
+
+        sqlx::query(
+            r#"
+            UPDATE attachment_deliveries SET downloaded_at = NOW()
+            WHERE attachment_id = $1 AND user_id = $2 AND device_id = $3
+            AND downloaded_at IS NULL
+            "#,
+        )
+        .bind(attachment_id)
+        .bind(user_id)
+        .bind(device_id)
+        .execute(&self.db)
+        .await?;
+
+        self.purge(attachment_id, false).await?;
+
+        self.delivery_status(attachment_id).await
+    }
+
+    pub async fn run_sweeper(&self) {
+        tracing::info!(
+            "Undelivered attachment sweeper started (after {} days)",
+            self.config.undelivered_retention_days
+        );
+
+        loop {
+            match self.sweep_pass().await {
+                Ok(0) => {}
+                Ok(count) => tracing::info!("Deleted {} undelivered attachments", count),
+                Err(e) => tracing::error!("Undelivered attachment sweep failed: {}", e),
+            }
+
+            tokio::time::sleep(SWEEP_INTERVAL).await;
+        }
+    }
+
+    /// Delete attachments some device has still not downloaded after the
+    /// retention period, except those under legal hold. Returns how many
+    /// were deleted.
+    async fn sweep_pass(&self) -> AppResult<usize> {
+        let expired: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT DISTINCT attachment_id FROM attachment_deliveries
+            WHERE downloaded_at IS NULL AND created_at <= NOW() - make_interval(days => $1)
+            "#,
+        )
+        .bind(self.config.undelivered_retention_days as i32)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut deleted = 0;
+        for attachment_id in expired {
+            if self.purge(attachment_id, true).await? {
+                deleted += 1;
+            }
+        }
+
+        Ok(deleted)
+    }
+
+    /// Delete an attachment once every reference has declared its deliveries
+    /// and, unless `force`, every recipient device has downloaded it.
+    /// Attachments declared to a conversation under legal hold, or held by
+    /// a user under one, are kept. Returns whether it was deleted.
+    async fn purge(&self, attachment_id: Uuid, force: bool) -> AppResult<bool> {
+        let attachment: Option<Attachment> = sqlx::query_as(
+            r#"
+            DELETE FROM attachments a
+            WHERE a.id = $1
+            AND NOT EXISTS(
+                SELECT 1 FROM attachment_refs r
+                WHERE r.attachment_id = a.id AND r.deliveries_declared_at IS NULL
+            )
+            AND ($2 OR NOT EXISTS(
+                SELECT 1 FROM attachment_deliveries d
+                WHERE d.attachment_id = a.id AND d.downloaded_at IS NULL
+            ))
+            AND NOT EXISTS(
+                SELECT 1 FROM legal_holds h
+                WHERE h.released_at IS NULL AND (
+                    (h.target_type = 'conversation' AND h.target_id IN (
+                        SELECT c.conversation_id FROM attachment_conversations c
+                        WHERE c.attachment_id = a.id
+                    ))
+                    OR (h.target_type = 'user' AND (
+                        h.target_id = a.created_by
+                        OR h.target_id IN (
+                            SELECT r.user_id FROM attachment_refs r WHERE r.attachment_id = a.id
+                        )
+                    ))
+                )
+            )
+            RETURNING a.*
+            "#,
+        )
+        .bind(attachment_id)
+        .bind(force)
+        .fetch_optional(&self.db)
+        .await?;
+
+        match attachment {
+            Some(attachment) => {
+                self.queue_object_deletion(&attachment).await?;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    async fn delivery_status(&self, attachment_id: Uuid) -> AppResult<AttachmentDeliveryStatus> {
+        let pending_devices: i64 = sqlx::query_scalar(
+            r#"
+            SELECT COUNT(*) FROM attachment_deliveries
+            WHERE attachment_id = $1 AND downloaded_at IS NULL
+            "#,
+        )
+        .bind(attachment_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(AttachmentDeliveryStatus {
+            attachment_id,
+            pending_devices,
+        })
+    }
+
+    fn ensure_delete_after_download(&self) -> AppResult<()> {
+        if !self.config.delete_after_download {
+            return Err(AppError::FeatureDisabled(
+                "attachment_delete_after_download".to_string(),
+            ));
+        }
+
+        Ok(())
+    }
+
+    /// Objects are deleted by a job rather than straight away, since the
+    /// same content may be uploaded again under the same keys before then
+    async fn queue_object_deletion(&self, attachment: &Attachment) -> AppResult<()> {
+        let keys: Vec<&String> = std::iter::once(&attachment.object_key)
+            .chain(&attachment.transcoded_key)
+            .collect();
+        self.jobs
+            .enqueue(
+                DELETE_OBJECTS_JOB_KIND,
+                json!({ "digest": attachment.digest, "keys": keys }),
+            )
+            .await?;
+
+        Ok(())
+    }
+
+    /// Delete the objects of content that is no longer stored, unless it
+    /// has been uploaded again since
+    pub async fn delete_objects(&self, digest: &str, keys: &[String]) -> AppResult<()> {
+        let mut tx = self.db.begin().await?;
+        lock_digest(&mut tx, digest).await?;
+
+        let stored: bool =
+            sqlx::query_scalar("SELECT EXISTS(SELECT 1 FROM attachments WHERE digest = $1)")
+                .bind(digest)
+                .fetch_one(&mut *tx)
+                .await?;
+        if stored {
+            return Ok(());
+        }
+
+        let bucket = self.minio.attachments_bucket();
+        for key in keys {
+            self.minio.delete_file(bucket, key).await?;
+            self.storage.release(bucket, key).await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    /// Resolve an attachment to a short-lived client URL. Also returns the
+    /// attachment's size, for download quotas.
+    pub async fn get_file_url(
+        &self,
+        user_id: Uuid,
+        attachment_id: Uuid,
+    ) -> AppResult<(String, i64)> {
+        let (object_key, size_bytes) = self.accessible_object(user_id, attachment_id).await?;
+
+        let url = self
+            .minio
+            .file_url(self.minio.attachments_bucket(), &object_key)
+            .await?;
+
+        Ok((url, size_bytes))
+    }
+
+    /// The object key and size of an attachment the user may download,
+    /// preferring the streaming-friendly variant once transcoding completed.
+    /// Only someone holding a reference, a recipient device, or a participant
+    /// of a conversation it was declared to may; anyone else is told it
+    /// doesn't exist.
+    pub async fn accessible_object(
+        &self,
+        user_id: Uuid,
+        attachment_id: Uuid,
+    ) -> AppResult<(String, i64)> {
+        let file: Option<(String, i64)> = sqlx::query_as(
+            r#"
+            SELECT COALESCE(a.transcoded_key, a.object_key), a.size_bytes FROM attachments a
+            WHERE a.id = $1 AND (
+                EXISTS(
+                    SELECT 1 FROM attachment_refs r
+                    WHERE r.attachment_id = a.id AND r.user_id = $2
+                )
+                OR EXISTS(
+                    SELECT 1 FROM attachment_deliveries d
+                    WHERE d.attachment_id = a.id AND d.user_id = $2
+                )
+                OR EXISTS(
+                    SELECT 1 FROM attachment_conversations c
+                    JOIN participants p ON p.conversation_id = c.conversation_id
+                    WHERE c.attachment_id = a.id AND p.user_id = $2 AND p.left_at IS NULL
+                )
+            )
+            "#,
+        )
+        .bind(attachment_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        file.ok_or(AppError::AttachmentNotFound)
+    }
+
+    async fn find_by_digest(&self, digest: &str) -> AppResult<Option<Attachment>> {
+        let attachment: Option<Attachment> =
+            sqlx::query_as("SELECT * FROM attachments WHERE digest = $1")
+                .bind(digest)
+                .fetch_optional(&self.db)
+                .await?;
+
+        Ok(attachment)
+    }
+
+    async fn add_reference(
+        &self,
+        attachment_id: Uuid,
+        user_id: Uuid,
+        deduplicated: bool,
+    ) -> AppResult<AttachmentUpload> {
+        let mut tx = self.db.begin().await?;
+
+        // A concurrent release either finishes first, and the row is gone,
+        // or waits for this reference and keeps the content
+        let attachment: Option<Attachment> =
+            sqlx::query_as("SELECT * FROM attachments WHERE id = $1 FOR UPDATE")
+                .bind(attachment_id)
+                .fetch_optional(&mut *tx)
+                .await?;
+        let attachment = attachment.ok_or(AppError::AttachmentNotFound)?;
+
+        let ref_id = Uuid::new_v4();
+        sqlx::query("INSERT INTO attachment_refs (id, attachment_id, user_id) VALUES ($1, $2, $3)")
+            .bind(ref_id)
+            .bind(attachment.id)
+            .bind(user_id)
+            .execute(&mut *tx)
+            .await?;
+
+        let attachment: Attachment = sqlx::query_as(
+            "UPDATE attachments SET ref_count = ref_count + 1 WHERE id = $1 RETURNING *",
+        )
+        .bind(attachment.id)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        let url = self
+            .minio
+            .file_url(self.minio.attachments_bucket(), &attachment.object_key)
+            .await?;
+
+        Ok(AttachmentUpload {
+            ref_id,
+            attachment,
+            url,
+            deduplicated,
+        })
+    }
+}
+
+/// Serialize uploads and object deletions of the same content
+async fn lock_digest(conn: &mut PgConnection, digest: &str) -> AppResult<()> {
+    sqlx::query("SELECT pg_advisory_xact_lock(hashtext($1))")
+        .bind(format!("attachment:{}", digest))
+        .execute(&mut *conn)
+        .await?;
+
+    Ok(())
+}
+
+/// Job handler that deletes the objects of released attachments
+pub struct DeleteObjectsJob {
+    attachments: AttachmentsService,
+}
+
+impl DeleteObjectsJob {
+    pub fn new(attachments: AttachmentsService) -> Self {
+        Self { attachments }
+    }
+}
+
+#[async_trait]
+impl JobHandler for DeleteObjectsJob {
+    fn kind(&self) -> &'static str {
+        DELETE_OBJECTS_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let digest = job
+            .payload
+            .get("digest")
+            .and_then(|v| v.as_str())
+            .ok_or_else(|| anyhow::anyhow!("Object deletion job is missing digest"))?;
+        let keys: Vec<String> = job
+            .payload
+            .get("keys")
+            .and_then(|v| serde_json::from_value(v.clone()).ok())
+            .ok_or_else(|| anyhow::anyhow!("Object deletion job is missing keys"))?;
+
+        self.attachments.delete_objects(digest, &keys).await
+    }
+}
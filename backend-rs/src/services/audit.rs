@@ -0,0 +1,68 @@
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{error::AppResult, models::AuditLog};
+
+pub struct AuditService {
+    db: PgPool,
+}
+
+impl AuditService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Record an audit log entry
+    pub async fn record(
+        &self,
+        actor_id: Option<Uuid>,
+        action: &str,
+        target_type: &str,
+        target_id: Option<&str>,
+        metadata: serde_json::Value,
+    ) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            INSERT INTO audit_logs (id, actor_id, action, target_type, target_id, metadata)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(actor_id)
+        .bind(action)
+        .bind(target_type)
+        .bind(target_id)
+        .bind(metadata)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// List audit log entries, newest first
+    pub async fn list(
+        &self,
+        target_type: Option<&str>,
+        target_id: Option<&str>,
+        limit: i32,
+        offset: i32,
+    ) -> AppResult<Vec<AuditLog>> {
+        let logs: Vec<AuditLog> = sqlx::query_as(
+            r#"
+            SELECT * FROM audit_logs
+            WHERE ($1::VARCHAR IS NULL OR target_type = $1)
+            AND ($2::VARCHAR IS NULL OR target_id = $2)
+            ORDER BY created_at DESC
+            LIMIT $3 OFFSET $4
+            "#,
+        )
+        .bind(target_type)
+        .bind(target_id)
+        .bind(limit)
+        .bind(offset)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(logs)
+    }
+}
@@ -1,15 +1,16 @@
+use axum::http::Method;
 use bcrypt::{hash, verify, DEFAULT_COST};
-use chrono::{Duration, Utc};
-use jsonwebtoken::{decode, encode, DecodingKey, EncodingKey, Header, Validation};
+use chrono::{DateTime, Duration, Utc};
 use rand::Rng;
 use serde::{Deserialize, Serialize};
 use sqlx::PgPool;
 use uuid::Uuid;
 
 use crate::{
-    config::Config,
+    config::{Config, DpopEnforcement},
     error::{AppError, AppResult},
-    models::{Device, Otp, OtpType, Session, TokenPair, User, UserStatus},
+    models::{Device, Otp, OtpType, ScopedToken, Session, TokenPair, User, UserStatus},
+    services::{limits::LimitsService, phone, session_anomaly::SessionAnomalyService},
     storage::redis::RedisClient,
 };
 
@@ -20,6 +21,68 @@ pub struct Claims {
     pub iss: String,       // issuer
     pub exp: i64,          // expiry
     pub iat: i64,          // issued at
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub workspace_id: Option<String>, // active workspace
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub scopes: Vec<Scope>, // empty = full access
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cnf: Option<Confirmation>, // DPoP key binding
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub act: Option<Actor>, // impersonating admin
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub guest: bool, // widget guest, limited to its conversation
+}
+
+/// The admin acting as `sub` on an impersonation token (RFC 8693 `act`)
+#[derive(Debug, Serialize, Deserialize, Clone, PartialEq, Eq)]
+pub struct Actor {
+    pub sub: String, // admin user_id
+    pub sid: String, // impersonation id
+}
+
+/// Proof-of-possession confirmation (RFC 9449): the thumbprint of the
+/// device key every request with this token must be signed by
+#[derive(Debug, Serialize, Deserialize, Clone, PartialEq, Eq)]
+pub struct Confirmation {
+    pub jkt: String,
+}
+
+impl Claims {
+    /// Whether the token may call a route group requiring `required`
+    pub fn allows(&self, required: Scope, method: &Method) -> bool {
+        if self.scopes.is_empty() || self.scopes.contains(&required) {
+            return true;
+        }
+
+        let is_read = *method == Method::GET || *method == Method::HEAD;
+        is_read && required != Scope::Admin && self.scopes.contains(&Scope::Read)
+    }
+}
+
+/// Route groups a downscoped token can reach. Tokens from login carry no
+/// scopes and can reach everything the user can.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Scope {
+    /// GET/HEAD on any non-admin route
+    Read,
+    /// Conversations, messages, attachments and realtime delivery
+    Messaging,
+    /// Profile, contacts, devices, keys, backups, workspaces and stickers
+    Account,
+    /// Admin routes; the user must also be an admin
+    Admin,
+}
+
+impl Scope {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Scope::Read => "read",
+            Scope::Messaging => "messaging",
+            Scope::Account => "account",
+            Scope::Admin => "admin",
+        }
+    }
 }
 
 pub struct AuthService {
@@ -33,8 +96,28 @@ impl AuthService {
         Self { db, redis, config }
     }
 
+    /// The canonical form of an OTP target: E.164 for phone numbers
+    pub fn normalize_target(&self, target: &str, otp_type: OtpType) -> AppResult<String> {
+        match otp_type {
+            OtpType::Phone => self.normalize_phone(target),
+            OtpType::Email => Ok(target.trim().to_string()),
+        }
+    }
+
+    pub fn normalize_phone(&self, phone: &str) -> AppResult<String> {
+        let region = self
+            .config
+            .phone
+            .default_region
+            .as_deref()
+            .and_then(phone::parse_region);
+
+        phone::normalize(phone, region)
+    }
+
     // OTP Management
-    pub async fn send_otp(&self, target: &str, otp_type: OtpType) -> AppResult<()> {
+    /// Store a fresh code for the target; `OtpDeliveryService` sends it
+    pub async fn issue_otp(&self, target: &str, otp_type: OtpType) -> AppResult<()> {
         let code = self.generate_otp();
 
         // Store OTP in database
@@ -59,16 +142,31 @@ impl AuthService {
             .set_otp(target, &code, self.config.otp.ttl)
             .await?;
 
-        // Send OTP via SMS or Email
-        match otp_type {
-            OtpType::Phone => self.send_sms(target, &code).await?,
-            OtpType::Email => self.send_email(target, &code).await?,
-        }
-
         Ok(())
     }
 
     pub async fn verify_otp(&self, target: &str, otp_type: OtpType, code: &str) -> AppResult<()> {
+        if self.is_bypass_code(target, otp_type, code).await? {
+            // Leave a verified row behind for register and login to find
+            sqlx::query(
+                r#"
+                INSERT INTO otps (id, target, type, code, expires_at, attempts, verified)
+                VALUES ($1, $2, $3, $4, $5, 0, true)
+                ON CONFLICT (target, type)
+                DO UPDATE SET code = $4, expires_at = $5, attempts = 0, verified = true
+                "#,
+            )
+            .bind(Uuid::new_v4())
+            .bind(target)
+            .bind(otp_type)
+            .bind(code)
+            .bind(Utc::now() + Duration::seconds(self.config.otp.ttl.as_secs() as i64))
+            .execute(&self.db)
+            .await?;
+
+            return Ok(());
+        }
+
         // Try Redis first
         if let Some(cached_code) = self.redis.get_otp(target).await? {
             if cached_code == code {
@@ -121,6 +219,41 @@ impl AuthService {
         Ok(())
     }
 
+    /// The target's most recent code, verified or not, for E2E tests and
+    /// local clients. Only available in development.
+    pub async fn latest_otp(&self, target: &str, otp_type: OtpType) -> AppResult<Otp> {
+        if self.config.server.environment != "development" {
+            return Err(AppError::RouteNotFound);
+        }
+
+        let otp: Option<Otp> = sqlx::query_as("SELECT * FROM otps WHERE target = $1 AND type = $2")
+            .bind(target)
+            .bind(otp_type)
+            .fetch_optional(&self.db)
+            .await?;
+
+        otp.ok_or(AppError::OtpNotFound)
+    }
+
+    /// Seeded development users accept a fixed code (see `server seed`).
+    /// Only honored in development, even if the table has rows.
+    async fn is_bypass_code(&self, target: &str, otp_type: OtpType, code: &str) -> AppResult<bool> {
+        if self.config.server.environment != "development" {
+            return Ok(false);
+        }
+
+        let matches: bool = sqlx::query_scalar(
+            "SELECT EXISTS(SELECT 1 FROM otp_bypass_codes WHERE target = $1 AND type = $2 AND code = $3)",
+        )
+        .bind(target)
+        .bind(otp_type)
+        .bind(code)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(matches)
+    }
+
     // User Registration
     pub async fn register(
         &self,
@@ -130,6 +263,7 @@ impl AuthService {
         display_name: &str,
         device_name: &str,
         platform: &str,
+        dpop_jkt: Option<&str>,
     ) -> AppResult<(User, TokenPair)> {
         // Check if OTP was verified
         let target = phone.or(email).ok_or(AppError::BadRequest(
@@ -203,7 +337,12 @@ impl AuthService {
         .await?;
 
         // Generate tokens
-        let tokens = self.generate_token_pair(&user_id.to_string(), &device_id.to_string())?;
+        let tokens = self.generate_token_pair(
+            &user_id.to_string(),
+            &device_id.to_string(),
+            None,
+            dpop_jkt,
+        )?;
 
         // Store session
         let token_hash = hash(&tokens.access_token, DEFAULT_COST)
@@ -213,8 +352,8 @@ impl AuthService {
 
         sqlx::query(
             r#"
-            INSERT INTO sessions (id, user_id, device_id, token_hash, refresh_token_hash, expires_at, last_used_at)
-            VALUES ($1, $2, $3, $4, $5, $6, NOW())
+            INSERT INTO sessions (id, user_id, device_id, token_hash, refresh_token_hash, expires_at, last_used_at, dpop_jkt)
+            VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7)
             "#,
         )
         .bind(Uuid::new_v4())
@@ -223,6 +362,7 @@ impl AuthService {
         .bind(token_hash)
         .bind(refresh_hash)
         .bind(tokens.expires_at)
+        .bind(dpop_jkt)
         .execute(&mut *tx)
         .await?;
 
@@ -235,6 +375,10 @@ impl AuthService {
 
         tx.commit().await?;
 
+        SessionAnomalyService::new(self.db.clone(), self.redis.clone(), self.config.clone())
+            .reset(user_id, device_id)
+            .await?;
+
         Ok((user, tokens))
     }
 
@@ -245,6 +389,7 @@ impl AuthService {
         otp_type: OtpType,
         device_name: &str,
         platform: &str,
+        dpop_jkt: Option<&str>,
     ) -> AppResult<(User, TokenPair)> {
         // Check if OTP was verified
         let otp: Option<Otp> = sqlx::query_as(
@@ -299,6 +444,10 @@ impl AuthService {
         });
 
         let device_id = if device.device_id == 0 {
+            LimitsService::new(self.db.clone(), self.config.limits.clone())
+                .ensure_device_capacity(user.id)
+                .await?;
+
             // Get next device_id
             let max_device_id: Option<i32> = sqlx::query_scalar(
                 "SELECT MAX(device_id) FROM devices WHERE user_id = $1",
@@ -334,7 +483,12 @@ impl AuthService {
         };
 
         // Generate tokens
-        let tokens = self.generate_token_pair(&user.id.to_string(), &device_id.to_string())?;
+        let tokens = self.generate_token_pair(
+            &user.id.to_string(),
+            &device_id.to_string(),
+            None,
+            dpop_jkt,
+        )?;
 
         // Store session
         let token_hash = hash(&tokens.access_token, DEFAULT_COST)
@@ -344,10 +498,10 @@ impl AuthService {
 
         sqlx::query(
             r#"
-            INSERT INTO sessions (id, user_id, device_id, token_hash, refresh_token_hash, expires_at, last_used_at)
-            VALUES ($1, $2, $3, $4, $5, $6, NOW())
+            INSERT INTO sessions (id, user_id, device_id, token_hash, refresh_token_hash, expires_at, last_used_at, dpop_jkt)
+            VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7)
             ON CONFLICT (user_id, device_id)
-            DO UPDATE SET token_hash = $4, refresh_token_hash = $5, expires_at = $6, last_used_at = NOW()
+            DO UPDATE SET token_hash = $4, refresh_token_hash = $5, expires_at = $6, last_used_at = NOW(), dpop_jkt = $7
             "#,
         )
         .bind(Uuid::new_v4())
@@ -356,9 +510,15 @@ impl AuthService {
         .bind(token_hash)
         .bind(refresh_hash)
         .bind(tokens.expires_at)
+        .bind(dpop_jkt)
         .execute(&self.db)
         .await?;
 
+        // A fresh login is where the session's history starts over
+        SessionAnomalyService::new(self.db.clone(), self.redis.clone(), self.config.clone())
+            .reset(user.id, device_id)
+            .await?;
+
         // Delete OTP
         sqlx::query("DELETE FROM otps WHERE target = $1 AND type = $2")
             .bind(target)
@@ -378,15 +538,25 @@ impl AuthService {
 
     // Token validation
     pub fn validate_token(&self, token: &str) -> AppResult<Claims> {
-        let key = DecodingKey::from_secret(self.config.jwt.secret.as_bytes());
-        let validation = Validation::default();
+        self.config.jwt.keys.verify(token)
+    }
 
-        let token_data = decode::<Claims>(token, &key, &validation)?;
-        Ok(token_data.claims)
+    /// Refuse a token issued before its user was last logged out of all
+    /// devices
+    pub async fn check_revocation(&self, claims: &Claims) -> AppResult<()> {
+        let revoked = self.redis.get_tokens_revoked(&claims.sub).await?;
+        if revoked.is_some_and(|since| claims.iat < since) {
+            return Err(AppError::InvalidToken);
+        }
+        Ok(())
     }
 
     // Refresh token
-    pub async fn refresh_token(&self, refresh_token: &str) -> AppResult<TokenPair> {
+    pub async fn refresh_token(
+        &self,
+        refresh_token: &str,
+        dpop_jkt: Option<&str>,
+    ) -> AppResult<TokenPair> {
         let claims = self.validate_token(refresh_token)?;
 
         // Check session exists
@@ -407,8 +577,41 @@ impl AuthService {
             return Err(AppError::InvalidToken);
         }
 
+        // A bound session can only be refreshed with a proof from its key.
+        // An unbound session becomes bound if the client sends a proof.
+        if let Some(bound_jkt) = session.dpop_jkt.as_deref() {
+            if self.config.dpop.enforcement != DpopEnforcement::Off {
+                match dpop_jkt {
+                    None => return Err(AppError::DpopProofRequired),
+                    Some(jkt) if jkt != bound_jkt => {
+                        return Err(AppError::InvalidDpopProof(
+                            "key does not match the session binding".to_string(),
+                        ))
+                    }
+                    Some(_) => {}
+                }
+            }
+        }
+        let dpop_jkt = dpop_jkt.or(session.dpop_jkt.as_deref());
+
+        // Keep the active workspace only while the user is still a member
+        let workspace_id = match claims.workspace_id.as_deref() {
+            Some(workspace_id) => {
+                let is_member: Option<(i64,)> = sqlx::query_as(
+                    "SELECT 1::BIGINT FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+                )
+                .bind(Uuid::parse_str(workspace_id).map_err(|_| AppError::InvalidToken)?)
+                .bind(session.user_id)
+                .fetch_optional(&self.db)
+                .await?;
+                is_member.map(|_| workspace_id)
+            }
+            None => None,
+        };
+
         // Generate new tokens
-        let tokens = self.generate_token_pair(&claims.sub, &claims.device_id)?;
+        let tokens =
+            self.generate_token_pair(&claims.sub, &claims.device_id, workspace_id, dpop_jkt)?;
 
         // Update session
         let token_hash = hash(&tokens.access_token, DEFAULT_COST)
@@ -417,11 +620,12 @@ impl AuthService {
             .map_err(|e| anyhow::anyhow!("Hash error: {}", e))?;
 
         sqlx::query(
-            "UPDATE sessions SET token_hash = $1, refresh_token_hash = $2, expires_at = $3, last_used_at = NOW() WHERE id = $4",
+            "UPDATE sessions SET token_hash = $1, refresh_token_hash = $2, expires_at = $3, last_used_at = NOW(), dpop_jkt = $4 WHERE id = $5",
         )
         .bind(token_hash)
         .bind(refresh_hash)
         .bind(tokens.expires_at)
+        .bind(dpop_jkt)
         .bind(session.id)
         .execute(&self.db)
         .await?;
@@ -429,6 +633,59 @@ impl AuthService {
         Ok(tokens)
     }
 
+    // Switch the active workspace carried in the token claims
+    pub async fn switch_workspace(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        workspace_id: Option<Uuid>,
+        dpop_jkt: Option<&str>,
+    ) -> AppResult<TokenPair> {
+        if let Some(workspace_id) = workspace_id {
+            let is_member: Option<(i64,)> = sqlx::query_as(
+                "SELECT 1::BIGINT FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+            )
+            .bind(workspace_id)
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?;
+
+            if is_member.is_none() {
+                return Err(AppError::NotWorkspaceMember);
+            }
+        }
+
+        let workspace_id = workspace_id.map(|id| id.to_string());
+        let tokens = self.generate_token_pair(
+            &user_id.to_string(),
+            &device_id.to_string(),
+            workspace_id.as_deref(),
+            dpop_jkt,
+        )?;
+
+        let token_hash = hash(&tokens.access_token, DEFAULT_COST)
+            .map_err(|e| anyhow::anyhow!("Hash error: {}", e))?;
+        let refresh_hash = hash(&tokens.refresh_token, DEFAULT_COST)
+            .map_err(|e| anyhow::anyhow!("Hash error: {}", e))?;
+
+        let result = sqlx::query(
+            "UPDATE sessions SET token_hash = $1, refresh_token_hash = $2, expires_at = $3, last_used_at = NOW() WHERE user_id = $4 AND device_id = $5",
+        )
+        .bind(token_hash)
+        .bind(refresh_hash)
+        .bind(tokens.expires_at)
+        .bind(user_id)
+        .bind(device_id)
+        .execute(&self.db)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::InvalidToken);
+        }
+
+        Ok(tokens)
+    }
+
     // Logout
     pub async fn logout(&self, user_id: Uuid, device_id: i32) -> AppResult<()> {
         sqlx::query("DELETE FROM sessions WHERE user_id = $1 AND device_id = $2")
@@ -456,6 +713,16 @@ impl AuthService {
 
         self.redis.delete_all_user_sessions(&user_id.to_string()).await?;
 
+        // Deleting the sessions stops refreshes; this catches access tokens
+        // still in their lifetime
+        self.redis
+            .set_tokens_revoked(
+                &user_id.to_string(),
+                Utc::now().timestamp(),
+                self.config.jwt.access_token_ttl,
+            )
+            .await?;
+
         // Update user status
         sqlx::query("UPDATE users SET status = $1, last_seen_at = NOW() WHERE id = $2")
             .bind(UserStatus::Offline)
@@ -474,18 +741,101 @@ impl AuthService {
         format!("{:0>width$}", code, width = self.config.otp.length)
     }
 
-    fn generate_token_pair(&self, user_id: &str, device_id: &str) -> AppResult<TokenPair> {
+    /// Mint an access-only token limited to `scopes` for a widget or bot.
+    /// A scoped caller can only narrow its own scopes, and the new token
+    /// can't outlive it. Scoped tokens can't be revoked, so they live no
+    /// longer than an access token.
+    pub async fn mint_scoped_token(
+        &self,
+        claims: &Claims,
+        scopes: &[Scope],
+        ttl_seconds: Option<u64>,
+    ) -> AppResult<ScopedToken> {
+        let mut scopes = scopes.to_vec();
+        scopes.sort_by_key(|s| s.as_str());
+        scopes.dedup();
+
+        if scopes.is_empty() {
+            return Err(AppError::Validation("At least one scope is required".to_string()));
+        }
+
+        if let Some(missing) = scopes
+            .iter()
+            .find(|s| !claims.scopes.is_empty() && !claims.scopes.contains(s))
+        {
+            return Err(AppError::InsufficientScope(*missing));
+        }
+
+        if scopes.contains(&Scope::Admin) {
+            let user_id = Uuid::parse_str(&claims.sub).map_err(|_| AppError::InvalidToken)?;
+            let is_admin: Option<bool> =
+                sqlx::query_scalar("SELECT is_admin FROM users WHERE id = $1")
+                    .bind(user_id)
+                    .fetch_optional(&self.db)
+                    .await?;
+
+            if !is_admin.unwrap_or(false) {
+                return Err(AppError::Forbidden);
+            }
+        }
+
+        let max_ttl = self.config.jwt.access_token_ttl.as_secs();
+        let ttl = ttl_seconds.unwrap_or(max_ttl).clamp(1, max_ttl);
+
+        let now = Utc::now();
+        let exp = (now + Duration::seconds(ttl as i64))
+            .timestamp()
+            .min(claims.exp);
+
+        let scoped_claims = Claims {
+            sub: claims.sub.clone(),
+            device_id: claims.device_id.clone(),
+            iss: self.config.jwt.issuer.clone(),
+            exp,
+            iat: now.timestamp(),
+            workspace_id: claims.workspace_id.clone(),
+            scopes: scopes.clone(),
+            cnf: claims.cnf.clone(),
+            act: claims.act.clone(),
+            guest: claims.guest,
+        };
+
+        let access_token = self.config.jwt.keys.sign(&scoped_claims)?;
+
+        Ok(ScopedToken {
+            access_token,
+            scopes,
+            expires_at: DateTime::from_timestamp(exp, 0).unwrap_or(now),
+        })
+    }
+
+    fn generate_token_pair(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        workspace_id: Option<&str>,
+        dpop_jkt: Option<&str>,
+    ) -> AppResult<TokenPair> {
         let now = Utc::now();
         let access_exp = now + Duration::seconds(self.config.jwt.access_token_ttl.as_secs() as i64);
         let refresh_exp =
             now + Duration::seconds(self.config.jwt.refresh_token_ttl.as_secs() as i64);
 
+        let cnf = dpop_jkt.map(|jkt| Confirmation {
+            jkt: jkt.to_string(),
+        });
+
         let access_claims = Claims {
             sub: user_id.to_string(),
             device_id: device_id.to_string(),
             iss: self.config.jwt.issuer.clone(),
             exp: access_exp.timestamp(),
             iat: now.timestamp(),
+            workspace_id: workspace_id.map(str::to_string),
+            scopes: Vec::new(),
+            cnf: cnf.clone(),
+            act: None,
+            guest: false,
         };
 
         let refresh_claims = Claims {
@@ -494,12 +844,15 @@ impl AuthService {
             iss: self.config.jwt.issuer.clone(),
             exp: refresh_exp.timestamp(),
             iat: now.timestamp(),
+            workspace_id: workspace_id.map(str::to_string),
+            scopes: Vec::new(),
+            cnf,
+            act: None,
+            guest: false,
         };
 
-        let key = EncodingKey::from_secret(self.config.jwt.secret.as_bytes());
-
-        let access_token = encode(&Header::default(), &access_claims, &key)?;
-        let refresh_token = encode(&Header::default(), &refresh_claims, &key)?;
+        let access_token = self.config.jwt.keys.sign(&access_claims)?;
+        let refresh_token = self.config.jwt.keys.sign(&refresh_claims)?;
 
         Ok(TokenPair {
             access_token,
@@ -507,28 +860,4 @@ impl AuthService {
             expires_at: access_exp,
         })
     }
-
-    async fn send_sms(&self, phone: &str, code: &str) -> AppResult<()> {
-        // In development, just log the code
-        if self.config.server.environment == "development" {
-            tracing::info!("SMS OTP to {}: {}", phone, code);
-            return Ok(());
-        }
-
-        // TODO: Implement actual SMS sending (Twilio, etc.)
-        tracing::warn!("SMS sending not implemented for production");
-        Ok(())
-    }
-
-    async fn send_email(&self, email: &str, code: &str) -> AppResult<()> {
-        // In development, just log the code
-        if self.config.server.environment == "development" {
-            tracing::info!("Email OTP to {}: {}", email, code);
-            return Ok(());
-        }
-
-        // TODO: Implement actual email sending (SendGrid, etc.)
-        tracing::warn!("Email sending not implemented for production");
-        Ok(())
-    }
 }
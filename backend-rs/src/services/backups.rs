@@ -0,0 +1,192 @@
+use bytes::Bytes;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::{BackupConfig, StorageConfig},
+    error::{AppError, AppResult},
+    models::{Backup, BackupWithUrl, StorageCategory},
+    services::storage::StorageService,
+    storage::minio::MinioClient,
+};
+
+pub struct BackupsService {
+    db: PgPool,
+    minio: MinioClient,
+    storage: StorageService,
+    config: BackupConfig,
+}
+
+impl BackupsService {
+    pub fn new(
+        db: PgPool,
+        minio: MinioClient,
+        config: BackupConfig,
+        storage_config: StorageConfig,
+    ) -> Self {
+        Self {
+            storage: StorageService::new(db.clone(), storage_config),
+            db,
+            minio,
+            config,
+        }
+    }
+
+    /// Store a new backup generation. The blob is encrypted on the client and
+    /// stored as-is; generations beyond the configured limit are pruned.
+    pub async fn upload_backup(&self, user_id: Uuid, data: Bytes) -> AppResult<Backup> {
+        if data.is_empty() {
+            return Err(AppError::BadRequest("Backup data required".to_string()));
+        }
+
+        if data.len() > self.config.max_size {
+            return Err(AppError::BackupTooLarge(self.config.max_size));
+        }
+
+        let backup_id = Uuid::new_v4();
+        let key = format!("users/{}/{}.bin", user_id, backup_id);
+        let size = data.len() as i64;
+
+        self.storage
+            .ensure_quota(user_id, self.minio.backups_bucket(), &key, size)
+            .await?;
+
+        self.minio
+            .upload_private_file(
+                self.minio.backups_bucket(),
+                &key,
+                data,
+                "application/octet-stream",
+            )
+            .await?;
+
+        let backup: Backup = match sqlx::query_as(
+            r#"
+            INSERT INTO backups (id, user_id, version, size_bytes, object_key)
+            VALUES (
+                $1, $2,
+                (SELECT COALESCE(MAX(version), 0) + 1 FROM backups WHERE user_id = $2),
+                $3, $4
+            )
+            RETURNING *
+            "#,
+        )
+        .bind(backup_id)
+        .bind(user_id)
+        .bind(size)
+        .bind(&key)
+        .fetch_one(&self.db)
+        .await
+        {
+            Ok(backup) => backup,
+            Err(e) => {
+                let _ = self
+                    .minio
+                    .delete_file(self.minio.backups_bucket(), &key)
+                    .await;
+                return Err(e.into());
+            }
+        };
+
+        self.storage
+            .record(
+                user_id,
+                StorageCategory::Backup,
+                self.minio.backups_bucket(),
+                &key,
+                size,
+            )
+            .await?;
+
+        self.prune_generations(user_id).await?;
+
+        Ok(backup)
+    }
+
+    /// List the user's backup generations, newest first
+    pub async fn list_backups(&self, user_id: Uuid) -> AppResult<Vec<Backup>> {
+        let backups: Vec<Backup> =
+            sqlx::query_as("SELECT * FROM backups WHERE user_id = $1 ORDER BY version DESC")
+                .bind(user_id)
+                .fetch_all(&self.db)
+                .await?;
+
+        Ok(backups)
+    }
+
+    /// Get a backup generation for restore, with a presigned download URL.
+    /// When no version is given the latest generation is returned.
+    pub async fn get_backup(
+        &self,
+        user_id: Uuid,
+        version: Option<i32>,
+    ) -> AppResult<BackupWithUrl> {
+        let backup: Option<Backup> = match version {
+            Some(version) => {
+                sqlx::query_as("SELECT * FROM backups WHERE user_id = $1 AND version = $2")
+                    .bind(user_id)
+                    .bind(version)
+                    .fetch_optional(&self.db)
+                    .await?
+            }
+            None => {
+                sqlx::query_as(
+                    "SELECT * FROM backups WHERE user_id = $1 ORDER BY version DESC LIMIT 1",
+                )
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?
+            }
+        };
+
+        let backup = backup.ok_or(AppError::BackupNotFound)?;
+
+        let download_url = self
+            .minio
+            .presigned_url(self.minio.backups_bucket(), &backup.object_key)
+            .await?;
+
+        Ok(BackupWithUrl {
+            backup,
+            download_url,
+        })
+    }
+
+    /// Delete generations older than the newest `max_generations`
+    async fn prune_generations(&self, user_id: Uuid) -> AppResult<()> {
+        let stale: Vec<Backup> = sqlx::query_as(
+            r#"
+            SELECT * FROM backups
+            WHERE user_id = $1
+            ORDER BY version DESC
+            OFFSET $2
+            "#,
+        )
+        .bind(user_id)
+        .bind(self.config.max_generations.max(1))
+        .fetch_all(&self.db)
+        .await?;
+
+        for backup in stale {
+            if let Err(e) = self
+                .minio
+                .delete_file(self.minio.backups_bucket(), &backup.object_key)
+                .await
+            {
+                tracing::warn!("Failed to delete backup object {}: {}", backup.object_key, e);
+                continue;
+            }
+
+            sqlx::query("DELETE FROM backups WHERE id = $1")
+                .bind(backup.id)
+                .execute(&self.db)
+                .await?;
+
+            self.storage
+                .release(self.minio.backups_bucket(), &backup.object_key)
+                .await?;
+        }
+
+        Ok(())
+    }
+}
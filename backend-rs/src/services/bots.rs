@@ -0,0 +1,807 @@
+use std::time::Duration;
+
+use async_trait::async_trait;
+use chrono::Utc;
+use hmac::{Hmac, Mac};
+use rand::RngCore;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        Bot, BotCommand, BotCommandInput, BotInvocation, BotInvocationStatus, BotReply,
+        BotWebhookRequest, ConversationBot, ConversationType, CreatedBot, ParticipantRole,
+        SystemEvent, UserStatus, EVENT_MEMBER_JOINED, EVENT_MEMBER_LEFT,
+    },
+    services::{
+        audit::AuditService, events::EventsService, limits::LimitsService,
+        messaging::MessagingService,
+    },
+};
+
+pub const BOT_COMMAND_JOB_KIND: &str = "bot_command";
+const WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+const MAX_COMMANDS_PER_BOT: usize = 50;
+const MAX_COMMAND_LENGTH: usize = 32;
+const MAX_DESCRIPTION_LENGTH: usize = 200;
+const MAX_ARGS_LENGTH: usize = 4000;
+const MAX_REPLY_LENGTH: usize = 4000;
+const MAX_REPLY_ACTIONS: usize = 5;
+const MAX_ACTION_LABEL_LENGTH: usize = 64;
+
+/// Bots and their slash commands. A bot is an account of its own, flagged
+/// `is_bot` and created with it, plus a webhook; once a group owner or
+/// admin adds it to a conversation, members can submit `/command args`
+/// lines. Messages are end-to-end encrypted, so commands
+/// are submitted separately in plaintext rather than parsed out of
+/// messages. Each command is logged as an invocation and sent to the bot's
+/// webhook by a background job, signed with the bot's secret; the bot's
+/// answer is posted to the conversation as a `bot_reply` system message.
+pub struct BotsService {
+    db: PgPool,
+    http: reqwest::Client,
+    jobs: JobQueue,
+    audit: AuditService,
+}
+
+impl BotsService {
+    pub fn new(db: PgPool, http: reqwest::Client, jobs: JobQueue) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            http,
+            jobs,
+            audit,
+        }
+    }
+
+    /// Register a bot (admin), creating the account it joins conversations
+    /// and replies as. The signing secret is returned once.
+    pub async fn create(
+        &self,
+        admin_id: Uuid,
+        name: &str,
+        username: &str,
+        webhook_url: &str,
+    ) -> AppResult<CreatedBot> {
+        let name = name.trim();
+        if name.is_empty() || name.chars().count() > 100 {
+            return Err(AppError::Validation(
+                "Name must be between 1 and 100 characters".to_string(),
+            ));
+        }
+        validate_username(username)?;
+        validate_webhook_url(webhook_url)?;
+
+        let mut secret = [0u8; 32];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let signing_secret = format!("{:x}", Sha256::digest(secret));
+
+        let mut tx = self.db.begin().await?;
+
+        let user_id: Option<Uuid> = sqlx::query_scalar(
+            r#"
+            INSERT INTO users (id, username, display_name, status, discoverable, is_bot)
+            VALUES ($1, $2, $3, $4, false, true)
+            ON CONFLICT DO NOTHING
+            RETURNING id
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(username)
+        .bind(name)
+        .bind(UserStatus::Offline)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let user_id =
+            user_id.ok_or_else(|| AppError::Validation("Username is taken".to_string()))?;
+
+        let bot: Option<Bot> = sqlx::query_as(
+            r#"
+            INSERT INTO bots (id, name, user_id, webhook_url, signing_secret, created_by)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(name)
+        .bind(user_id)
+        .bind(webhook_url)
+        .bind(&signing_secret)
+        .bind(admin_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        let bot = bot.ok_or_else(|| {
+            AppError::Validation("A bot with this name already exists".to_string())
+        })?;
+
+        tx.commit().await?;
+
+        self.record(admin_id, "bot.created", &bot).await?;
+
+        Ok(CreatedBot {
+            bot,
+            signing_secret,
+        })
+    }
+
+    /// Every bot, newest first (admin)
+    pub async fn list(&self) -> AppResult<Vec<Bot>> {
+        let bots: Vec<Bot> = sqlx::query_as("SELECT * FROM bots ORDER BY created_at DESC")
+            .fetch_all(&self.db)
+            .await?;
+
+        Ok(bots)
+    }
+
+    /// Stop routing commands to the bot (admin). It stays in its
+    /// conversations, and pending invocations fail.
+    pub async fn revoke(&self, admin_id: Uuid, bot_id: Uuid) -> AppResult<Bot> {
+        let bot: Option<Bot> = sqlx::query_as(
+            r#"
+            UPDATE bots SET revoked_at = COALESCE(revoked_at, NOW())
+            WHERE id = $1
+            RETURNING *
+            "#,
+        )
+        .bind(bot_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let bot = bot.ok_or(AppError::BotNotFound)?;
+        self.record(admin_id, "bot.revoked", &bot).await?;
+
+        Ok(bot)
+    }
+
+    /// Replace the bot's commands (admin)
+    pub async fn set_commands(
+        &self,
+        admin_id: Uuid,
+        bot_id: Uuid,
+        commands: &[BotCommandInput],
+    ) -> AppResult<Vec<BotCommand>> {
+        if commands.len() > MAX_COMMANDS_PER_BOT {
+            return Err(AppError::Validation(format!(
+                "A bot can register at most {} commands",
+                MAX_COMMANDS_PER_BOT
+            )));
+        }
+
+        let mut names = Vec::with_capacity(commands.len());
+        let mut descriptions = Vec::with_capacity(commands.len());
+        for input in commands {
+            let name = input.command.trim().trim_start_matches('/').to_lowercase();
+            if !is_valid_command(&name) {
+                return Err(AppError::Validation(format!(
+                    "Commands must be 1 to {} lowercase letters, digits or underscores",
+                    MAX_COMMAND_LENGTH
+                )));
+            }
+            if names.contains(&name) {
+                return Err(AppError::Validation(format!("/{} is listed twice", name)));
+            }
+
+            let description = input.description.as_deref().unwrap_or("").trim();
+            if description.chars().count() > MAX_DESCRIPTION_LENGTH {
+                return Err(AppError::Validation(format!(
+                    "Descriptions must be at most {} characters",
+                    MAX_DESCRIPTION_LENGTH
+                )));
+            }
+
+            names.push(name);
+            descriptions.push(description.to_string());
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let bot: Option<Bot> = sqlx::query_as("SELECT * FROM bots WHERE id = $1 FOR UPDATE")
+            .bind(bot_id)
+            .fetch_optional(&mut *tx)
+            .await?;
+        let bot = bot.ok_or(AppError::BotNotFound)?;
+
+        sqlx::query("DELETE FROM bot_commands WHERE bot_id = $1")
+            .bind(bot_id)
+            .execute(&mut *tx)
+            .await?;
+        let registered: Vec<BotCommand> = sqlx::query_as(
+            r#"
+            INSERT INTO bot_commands (bot_id, command, description)
+            SELECT $1, command, description FROM UNNEST($2::TEXT[], $3::TEXT[]) AS c(command, description)
+            RETURNING *
+            "#,
+        )
+        .bind(bot_id)
+        .bind(&names)
+        .bind(&descriptions)
+        .fetch_all(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.record(admin_id, "bot.commands_updated", &bot).await?;
+
+        Ok(registered)
+    }
+
+    /// Bots in the conversation that still take commands, with their
+    /// commands
+    pub async fn list_for_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<Vec<ConversationBot>> {
+        self.membership(conversation_id, user_id).await?;
+
+        let bots: Vec<(Uuid, String, Uuid, String)> = sqlx::query_as(
+            r#"
+            SELECT b.id, b.name, b.user_id, u.username FROM bots b
+            JOIN participants p ON p.user_id = b.user_id
+            JOIN users u ON u.id = b.user_id
+            WHERE p.conversation_id = $1 AND p.left_at IS NULL AND b.revoked_at IS NULL
+            ORDER BY b.name
+            "#,
+        )
+        .bind(conversation_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let bot_ids: Vec<Uuid> = bots.iter().map(|(id, ..)| *id).collect();
+        let commands: Vec<BotCommand> =
+            sqlx::query_as("SELECT * FROM bot_commands WHERE bot_id = ANY($1) ORDER BY command")
+                .bind(&bot_ids)
+                .fetch_all(&self.db)
+                .await?;
+
+        Ok(bots
+            .into_iter()
+            .map(|(bot_id, name, user_id, username)| ConversationBot {
+                bot_id,
+                name,
+                user_id,
+                username,
+                commands: commands
+                    .iter()
+                    .filter(|c| c.bot_id == bot_id)
+                    .cloned()
+                    .collect(),
+            })
+            .collect())
+    }
+
+    /// Add a bot to a group (owners and admins)
+    pub async fn add_to_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        bot_id: Uuid,
+        limits: &LimitsService,
+    ) -> AppResult<Vec<ConversationBot>> {
+        self.require_moderator(conversation_id, user_id).await?;
+
+        let bot: Option<Bot> =
+            sqlx::query_as("SELECT * FROM bots WHERE id = $1 AND revoked_at IS NULL")
+                .bind(bot_id)
+                .fetch_optional(&self.db)
+                .await?;
+        let bot = bot.ok_or(AppError::BotNotFound)?;
+
+        let already_joined: bool = sqlx::query_scalar(
+            "SELECT EXISTS(SELECT 1 FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL)",
+        )
+        .bind(conversation_id)
+        .bind(bot.user_id)
+        .fetch_one(&self.db)
+        .await?;
+        if !already_joined {
+            limits.ensure_group_capacity(conversation_id).await?;
+            limits.ensure_conversation_capacity(&[bot.user_id]).await?;
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        // Rejoins if the bot was removed before
+        let joined = sqlx::query(
+            r#"
+            INSERT INTO participants (id, conversation_id, user_id, role, joined_at)
+            VALUES ($1, $2, $3, $4, NOW())
+            ON CONFLICT (conversation_id, user_id)
+            DO UPDATE SET left_at = NULL, joined_at = NOW(), role = EXCLUDED.role
+            WHERE participants.left_at IS NOT NULL
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(conversation_id)
+        .bind(bot.user_id)
+        .bind(ParticipantRole::Member)
+        .execute(&mut *tx)
+        .await?;
+
+        if joined.rows_affected() > 0 {
+            EventsService::append(
+                &mut tx,
+                conversation_id,
+                Some(user_id),
+                EVENT_MEMBER_JOINED,
+                json!({ "user_id": bot.user_id, "bot_id": bot.id }),
+            )
+            .await?;
+            MessagingService::post_system_message(
+                &mut tx,
+                conversation_id,
+                user_id,
+                SystemEvent::MemberAdded {
+                    user_ids: vec![bot.user_id],
+                },
+            )
+            .await?;
+        }
+
+        tx.commit().await?;
+
+        self.list_for_conversation(conversation_id, user_id).await
+    }
+
+    /// Remove a bot from a group (owners and admins)
+    pub async fn remove_from_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        bot_id: Uuid,
+    ) -> AppResult<Vec<ConversationBot>> {
+        self.require_moderator(conversation_id, user_id).await?;
+
+        let mut tx = self.db.begin().await?;
+
+        let bot_user_id: Option<(Uuid,)> = sqlx::query_as(
+            r#"
+            UPDATE participants p SET left_at = NOW()
+            FROM bots b
+            WHERE b.id = $2 AND p.user_id = b.user_id
+            AND p.conversation_id = $1 AND p.left_at IS NULL
+            RETURNING p.user_id
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(bot_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let (bot_user_id,) = bot_user_id.ok_or(AppError::BotNotFound)?;
+
+        EventsService::append(
+            &mut tx,
+            conversation_id,
+            Some(user_id),
+            EVENT_MEMBER_LEFT,
+            json!({ "user_id": bot_user_id, "bot_id": bot_id }),
+        )
+        .await?;
+        MessagingService::post_system_message(
+            &mut tx,
+            conversation_id,
+            user_id,
+            SystemEvent::MemberLeft {
+                user_id: bot_user_id,
+            },
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        self.list_for_conversation(conversation_id, user_id).await
+    }
+
+    /// Route a command line to the bot in the conversation that handles it.
+    /// `/command@username` picks one bot when several handle the command.
+    pub async fn submit_command(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        text: &str,
+    ) -> AppResult<BotInvocation> {
+        self.membership(conversation_id, user_id).await?;
+
+        let (command, username, args) = parse_command(text)?;
+
+        let bots: Vec<(Uuid, String)> = sqlx::query_as(
+            r#"
+            SELECT b.id, u.username FROM bots b
+            JOIN bot_commands c ON c.bot_id = b.id
+            JOIN participants p ON p.user_id = b.user_id
+            JOIN users u ON u.id = b.user_id
+            WHERE c.command = $2 AND p.conversation_id = $1 AND p.left_at IS NULL
+            AND b.revoked_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(&command)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut handlers = bots
+            .into_iter()
+            .filter(|(_, name)| username.map_or(true, |u| name.eq_ignore_ascii_case(u)));
+        let bot_id = match (handlers.next(), handlers.next()) {
+            (Some((bot_id, _)), None) => bot_id,
+            (None, _) => return Err(AppError::BotCommandNotFound(command)),
+            (Some(_), Some(_)) => {
+                return Err(AppError::Validation(format!(
+                    "Several bots handle /{0}; use /{0}@username",
+                    command
+                )))
+            }
+        };
+
+        let invocation: BotInvocation = sqlx::query_as(
+            r#"
+            INSERT INTO bot_invocations (id, bot_id, conversation_id, user_id, command, args)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(bot_id)
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(&command)
+        .bind(args)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.jobs
+            .enqueue(
+                BOT_COMMAND_JOB_KIND,
+                json!({ "invocation_id": invocation.id }),
+            )
+            .await?;
+
+        Ok(invocation)
+    }
+
+    /// Send an invocation to the bot's webhook and post its reply. Failures
+    /// are retried by the job queue; the last attempt marks the invocation
+    /// failed.
+    pub async fn deliver(&self, invocation_id: Uuid, final_attempt: bool) -> AppResult<()> {
+        let invocation: Option<BotInvocation> =
+            sqlx::query_as("SELECT * FROM bot_invocations WHERE id = $1 AND status = 'pending'")
+                .bind(invocation_id)
+                .fetch_optional(&self.db)
+                .await?;
+        let Some(invocation) = invocation else {
+            return Ok(());
+        };
+
+        // The bot may have been revoked or removed since
+        let bot: Option<Bot> = sqlx::query_as(
+            r#"
+            SELECT b.* FROM bots b
+            JOIN participants p ON p.user_id = b.user_id
+            WHERE b.id = $1 AND b.revoked_at IS NULL
+            AND p.conversation_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(invocation.bot_id)
+        .bind(invocation.conversation_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let Some(bot) = bot else {
+            return self.fail(invocation.id, "Bot is no longer available").await;
+        };
+
+        let (user_display_name,): (String,) =
+            sqlx::query_as("SELECT display_name FROM users WHERE id = $1")
+                .bind(invocation.user_id)
+                .fetch_one(&self.db)
+                .await?;
+
+        let request = BotWebhookRequest {
+            invocation_id: invocation.id,
+            command: invocation.command.clone(),
+            args: invocation.args.clone(),
+            conversation_id: invocation.conversation_id,
+            user_id: invocation.user_id,
+            user_display_name,
+            sent_at: invocation.created_at,
+        };
+
+        let reply = match self.call_webhook(&bot, &request).await {
+            Ok(reply) => reply,
+            Err(e) if final_attempt => return self.fail(invocation.id, &e.to_string()).await,
+            Err(e) => return Err(e.into()),
+        };
+        let Some(reply) = reply else {
+            return self.complete(&invocation, &bot, None).await;
+        };
+
+        if let Err(reason) = validate_reply(&reply) {
+            return self.fail(invocation.id, &reason).await;
+        }
+
+        self.complete(&invocation, &bot, Some(reply)).await
+    }
+
+    async fn call_webhook(
+        &self,
+        bot: &Bot,
+        request: &BotWebhookRequest,
+    ) -> anyhow::Result<Option<BotReply>> {
+        let body = serde_json::to_vec(request)?;
+        let timestamp = Utc::now().timestamp().to_string();
+
+        let mut mac = Hmac::<Sha256>::new_from_slice(bot.signing_secret.as_bytes())
+            .map_err(|e| anyhow::anyhow!("Invalid signing secret: {}", e))?;
+        mac.update(timestamp.as_bytes());
+        mac.update(b".");
+        mac.update(&body);
+        let signature = format!("{:x}", mac.finalize().into_bytes());
+
+        let response = self
+            .http
+            .post(&bot.webhook_url)
+            .timeout(WEBHOOK_TIMEOUT)
+            .header("Content-Type", "application/json")
+            .header("X-Bot-Timestamp", &timestamp)
+            .header("X-Bot-Signature", format!("sha256={}", signature))
+            .body(body)
+            .send()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to reach the bot: {}", e))?;
+
+        if !response.status().is_success() {
+            anyhow::bail!("Bot answered with status {}", response.status());
+        }
+
+        let bytes = response.bytes().await?;
+        if bytes.iter().all(u8::is_ascii_whitespace) {
+            return Ok(None);
+        }
+
+        serde_json::from_slice(&bytes)
+            .map(Some)
+            .map_err(|e| anyhow::anyhow!("Bot reply is not valid: {}", e))
+    }
+
+    async fn complete(
+        &self,
+        invocation: &BotInvocation,
+        bot: &Bot,
+        reply: Option<BotReply>,
+    ) -> AppResult<()> {
+        let mut tx = self.db.begin().await?;
+
+        let reply_message_id = match reply {
+            Some(reply) => {
+                let message = MessagingService::post_system_message(
+                    &mut tx,
+                    invocation.conversation_id,
+                    bot.user_id,
+                    SystemEvent::BotReply {
+                        invocation_id: invocation.id,
+                        invoked_by: invocation.user_id,
+                        command: invocation.command.clone(),
+                        text: reply.text,
+                        actions: reply.actions,
+                    },
+                )
+                .await?;
+                Some(message.id)
+            }
+            None => None,
+        };
+
+        sqlx::query(
+            r#"
+            UPDATE bot_invocations
+            SET status = $2, reply_message_id = $3, completed_at = NOW()
+            WHERE id = $1
+            "#,
+        )
+        .bind(invocation.id)
+        .bind(BotInvocationStatus::Completed)
+        .bind(reply_message_id)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    async fn fail(&self, invocation_id: Uuid, error: &str) -> AppResult<()> {
+        tracing::warn!("Bot invocation {} failed: {}", invocation_id, error);
+
+        sqlx::query(
+            r#"
+            UPDATE bot_invocations SET status = $2, error = $3, completed_at = NOW()
+            WHERE id = $1
+            "#,
+        )
+        .bind(invocation_id)
+        .bind(BotInvocationStatus::Failed)
+        .bind(error)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// The conversation's type and the caller's role, for active
+    /// participants of writable conversations
+    async fn membership(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<(ConversationType, ParticipantRole)> {
+        let member: Option<(ConversationType, ParticipantRole, bool)> = sqlx::query_as(
+            r#"
+            SELECT c.type, p.role, c.imported_from IS NOT NULL FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        match member {
+            Some((_, _, true)) => Err(AppError::ConversationReadOnly),
+            Some((conversation_type, role, false)) => Ok((conversation_type, role)),
+            None => Err(AppError::NotParticipant),
+        }
+    }
+
+    async fn require_moderator(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        let (conversation_type, role) = self.membership(conversation_id, user_id).await?;
+        if conversation_type != ConversationType::Group {
+            return Err(AppError::Validation(
+                "Bots can only be added to groups".to_string(),
+            ));
+        }
+        if role == ParticipantRole::Member {
+            return Err(AppError::Forbidden);
+        }
+
+        Ok(())
+    }
+
+    async fn record(&self, actor_id: Uuid, action: &str, bot: &Bot) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "bot",
+                Some(&bot.id.to_string()),
+                json!({ "name": bot.name, "user_id": bot.user_id }),
+            )
+            .await
+    }
+}
+
+/// Split `/command[@username] args` into its parts; the command is
+/// lowercased
+fn parse_command(text: &str) -> AppResult<(String, Option<&str>, &str)> {
+    let invalid = || AppError::Validation("Commands look like /command args".to_string());
+
+    let text = text.trim().strip_prefix('/').ok_or_else(invalid)?;
+    let (head, args) = match text.split_once(char::is_whitespace) {
+        Some((head, args)) => (head, args.trim()),
+        None => (text, ""),
+    };
+    let (command, username) = match head.split_once('@') {
+        Some((command, username)) => (command, Some(username)),
+        None => (head, None),
+    };
+
+    let command = command.to_lowercase();
+    if !is_valid_command(&command) || username.is_some_and(str::is_empty) {
+        return Err(invalid());
+    }
+    if args.chars().count() > MAX_ARGS_LENGTH {
+        return Err(AppError::Validation(format!(
+            "Command arguments must be at most {} characters",
+            MAX_ARGS_LENGTH
+        )));
+    }
+
+    Ok((command, username, args))
+}
+
+fn is_valid_command(command: &str) -> bool {
+    !command.is_empty()
+        && command.len() <= MAX_COMMAND_LENGTH
+        && command
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '_')
+}
+
+/// Bot usernames follow `/command@username`, so they stick to letters,
+/// digits and underscores
+fn validate_username(username: &str) -> AppResult<()> {
+    let valid_chars = username
+        .chars()
+        .all(|c| c.is_ascii_alphanumeric() || c == '_');
+    if !valid_chars || !(3..=50).contains(&username.len()) {
+        return Err(AppError::Validation(
+            "Username must be 3 to 50 letters, digits or underscores".to_string(),
+        ));
+    }
+
+    Ok(())
+}
+
+fn validate_webhook_url(url: &str) -> AppResult<()> {
+    let parsed = reqwest::Url::parse(url)
+        .map_err(|_| AppError::Validation("Webhook URL is not valid".to_string()))?;
+    if !matches!(parsed.scheme(), "https" | "http") || parsed.host_str().is_none() {
+        return Err(AppError::Validation(
+            "Webhook URL must be an http(s) URL".to_string(),
+        ));
+    }
+
+    Ok(())
+}
+
+fn validate_reply(reply: &BotReply) -> Result<(), String> {
+    if reply.text.trim().is_empty() || reply.text.chars().count() > MAX_REPLY_LENGTH {
+        return Err(format!(
+            "Reply text must be between 1 and {} characters",
+            MAX_REPLY_LENGTH
+        ));
+    }
+    if reply.actions.len() > MAX_REPLY_ACTIONS {
+        return Err(format!(
+            "Replies can have at most {} actions",
+            MAX_REPLY_ACTIONS
+        ));
+    }
+    for action in &reply.actions {
+        if action.label.trim().is_empty()
+            || action.label.chars().count() > MAX_ACTION_LABEL_LENGTH
+            || parse_command(&action.command).is_err()
+        {
+            return Err("Each action needs a short label and a /command".to_string());
+        }
+    }
+
+    Ok(())
+}
+
+/// Job handler that sends queued commands to bot webhooks
+pub struct BotCommandJob {
+    bots: BotsService,
+}
+
+impl BotCommandJob {
+    pub fn new(bots: BotsService) -> Self {
+        Self { bots }
+    }
+}
+
+#[async_trait]
+impl JobHandler for BotCommandJob {
+    fn kind(&self) -> &'static str {
+        BOT_COMMAND_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let invocation_id = job
+            .payload
+            .get("invocation_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Bot command job is missing invocation_id"))?;
+
+        self.bots
+            .deliver(invocation_id, job.is_final_attempt())
+            .await
+    }
+}
@@ -0,0 +1,492 @@
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use rand::RngCore;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        Bridge, BridgeDirection, BridgeEvent, BridgeEventPage, BridgedConversation, BridgedMessage,
+        CreatedBridge, Message, MessageType, RelayMessageRequest, RelayedMessage,
+    },
+    services::{audit::AuditService, messaging::MessagingService},
+    storage::redis::RedisClient,
+};
+
+/// Prefix of bridge service tokens, so they are easy to tell apart from JWTs
+const TOKEN_PREFIX: &str = "atb_";
+const MAX_EXTERNAL_ID_LENGTH: usize = 255;
+const MAX_SENDER_NAME_LENGTH: usize = 100;
+
+/// Integration point for bridges to other chat networks, built around how a
+/// Matrix application service mirrors rooms. A bridge is a service account:
+/// it authenticates with its own token, relays remote messages in as its
+/// account, and reads each linked conversation's event log to mirror local
+/// messages out. Mapping tables tie rooms and events to conversations and
+/// messages so edits, replies and deletions can be carried across.
+pub struct BridgesService {
+    db: PgPool,
+    redis: RedisClient,
+    audit: AuditService,
+}
+
+impl BridgesService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self { db, redis, audit }
+    }
+
+    /// Register a bridge relaying as `user_id` (admin). The token is
+    /// returned once; only its hash is stored.
+    pub async fn create(
+        &self,
+        admin_id: Uuid,
+        name: &str,
+        user_id: Uuid,
+    ) -> AppResult<CreatedBridge> {
+        let name = name.trim();
+        if name.is_empty() || name.chars().count() > 100 {
+            return Err(AppError::Validation(
+                "Name must be between 1 and 100 characters".to_string(),
+            ));
+        }
+
+        let exists: Option<(Uuid,)> = sqlx::query_as("SELECT id FROM users WHERE id = $1")
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?;
+        if exists.is_none() {
+            return Err(AppError::UserNotFound);
+        }
+
+        let mut secret = [0u8; 32];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let token = format!("{}{}", TOKEN_PREFIX, URL_SAFE_NO_PAD.encode(secret));
+
+        let bridge: Option<Bridge> = sqlx::query_as(
+            r#"
+            INSERT INTO bridges (id, name, user_id, token_hash, created_by)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (name) DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(name)
+        .bind(user_id)
+        .bind(hash_token(&token))
+        .bind(admin_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let bridge = bridge.ok_or_else(|| {
+            AppError::Validation(format!("A bridge named {} already exists", name))
+        })?;
+
+        self.record(admin_id, "bridge.created", &bridge).await?;
+
+        Ok(CreatedBridge { bridge, token })
+    }
+
+    /// Every bridge, newest first (admin)
+    pub async fn list(&self) -> AppResult<Vec<Bridge>> {
+        let bridges: Vec<Bridge> = sqlx::query_as("SELECT * FROM bridges ORDER BY created_at DESC")
+            .fetch_all(&self.db)
+            .await?;
+
+        Ok(bridges)
+    }
+
+    /// Stop accepting the bridge's token (admin). Its mappings are kept so
+    /// a replacement bridge can be pointed at the same account later.
+    pub async fn revoke(&self, admin_id: Uuid, bridge_id: Uuid) -> AppResult<Bridge> {
+        let bridge: Option<Bridge> = sqlx::query_as(
+            r#"
+            UPDATE bridges SET revoked_at = COALESCE(revoked_at, NOW())
+            WHERE id = $1
+            RETURNING *
+            "#,
+        )
+        .bind(bridge_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let bridge = bridge.ok_or(AppError::BridgeNotFound)?;
+        self.record(admin_id, "bridge.revoked", &bridge).await?;
+
+        Ok(bridge)
+    }
+
+    /// Look up the bridge a service token belongs to. A read-only region
+    /// doesn't record the use.
+    pub async fn authenticate(&self, token: &str, read_only: bool) -> AppResult<Bridge> {
+        if !token.starts_with(TOKEN_PREFIX) {
+            return Err(AppError::InvalidToken);
+        }
+
+        let query = if read_only {
+            "SELECT * FROM bridges WHERE token_hash = $1 AND revoked_at IS NULL"
+        } else {
+            r#"
+            UPDATE bridges SET last_used_at = NOW()
+            WHERE token_hash = $1 AND revoked_at IS NULL
+            RETURNING *
+            "#
+        };
+        let bridge: Option<Bridge> = sqlx::query_as(query)
+            .bind(hash_token(token))
+            .fetch_optional(&self.db)
+            .await?;
+
+        bridge.ok_or(AppError::InvalidToken)
+    }
+
+    /// The bridge's linked conversations, or just the one linked to
+    /// `external_id`
+    pub async fn list_conversations(
+        &self,
+        bridge: &Bridge,
+        external_id: Option<&str>,
+    ) -> AppResult<Vec<BridgedConversation>> {
+        let links: Vec<BridgedConversation> = sqlx::query_as(
+            r#"
+            SELECT * FROM bridge_conversations
+            WHERE bridge_id = $1 AND ($2::text IS NULL OR external_id = $2)
+            ORDER BY created_at ASC
+            "#,
+        )
+        .bind(bridge.id)
+        .bind(external_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(links)
+    }
+
+    /// Mirror a conversation the bridge's account takes part in to a remote
+    /// room. Relinking to the same room is a no-op.
+    pub async fn link_conversation(
+        &self,
+        bridge: &Bridge,
+        conversation_id: Uuid,
+        external_id: &str,
+    ) -> AppResult<BridgedConversation> {
+        validate_external_id(external_id)?;
+        self.ensure_participant(bridge, conversation_id).await?;
+
+        let linked: Option<BridgedConversation> = sqlx::query_as(
+            r#"
+            INSERT INTO bridge_conversations (bridge_id, conversation_id, external_id)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (bridge_id, conversation_id) DO UPDATE SET external_id = bridge_conversations.external_id
+            RETURNING *
+            "#,
+        )
+        .bind(bridge.id)
+        .bind(conversation_id)
+        .bind(external_id)
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|e| conflict_on_unique(e, "conversation"))?;
+
+        match linked {
+            Some(link) if link.external_id == external_id => Ok(link),
+            // Already linked to a different room
+            _ => Err(AppError::ExternalIdConflict("conversation")),
+        }
+    }
+
+    pub async fn unlink_conversation(
+        &self,
+        bridge: &Bridge,
+        conversation_id: Uuid,
+    ) -> AppResult<()> {
+        let result = sqlx::query(
+            "DELETE FROM bridge_conversations WHERE bridge_id = $1 AND conversation_id = $2",
+        )
+        .bind(bridge.id)
+        .bind(conversation_id)
+        .execute(&self.db)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::ConversationNotFound);
+        }
+
+        Ok(())
+    }
+
+    /// A linked conversation's event log after `since`, oldest first. Events
+    /// caused by the bridge's own account are echoes of what it relayed in
+    /// and are left out, but the cursor still moves past them.
+    pub async fn list_events(
+        &self,
+        bridge: &Bridge,
+        conversation_id: Uuid,
+        since: i64,
+        limit: i64,
+    ) -> AppResult<BridgeEventPage> {
+        self.get_link(bridge, conversation_id).await?;
+
+        let events: Vec<BridgeEvent> = sqlx::query_as(
+            r#"
+            SELECT e.*, m.external_id
+            FROM conversation_events e
+            LEFT JOIN bridge_messages m
+              ON m.bridge_id = $2
+             AND e.event_type LIKE 'message.%'
+             AND m.message_id = COALESCE(e.payload->>'message_id', e.payload->>'id')::uuid
+            WHERE e.conversation_id = $1 AND e.seq > $3
+            ORDER BY e.seq ASC
+            LIMIT $4
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(bridge.id)
+        .bind(since)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        let cursor = events.last().map_or(since, |e| e.event.seq);
+        let events = events
+            .into_iter()
+            .filter(|e| e.event.actor_id != Some(bridge.user_id))
+            .collect();
+
+        Ok(BridgeEventPage { events, cursor })
+    }
+
+    /// Post a remote message into a linked conversation as the bridge's
+    /// account. Relaying an `external_id` again returns the original message
+    /// rather than posting a duplicate.
+    pub async fn relay_message(
+        &self,
+        bridge: &Bridge,
+        conversation_id: Uuid,
+        message_type: MessageType,
+        req: RelayMessageRequest,
+    ) -> AppResult<RelayedMessage> {
+        validate_external_id(&req.external_id)?;
+        validate_external_id(&req.external_sender)?;
+        if req
+            .sender_name
+            .as_deref()
+            .is_some_and(|name| name.chars().count() > MAX_SENDER_NAME_LENGTH)
+        {
+            return Err(AppError::Validation(format!(
+                "Sender name must be at most {} characters",
+                MAX_SENDER_NAME_LENGTH
+            )));
+        }
+        self.get_link(bridge, conversation_id).await?;
+
+        if let Some(mapping) = self.find_message(bridge, &req.external_id).await? {
+            if mapping.conversation_id != conversation_id
+                || mapping.direction != BridgeDirection::Inbound
+            {
+                return Err(AppError::ExternalIdConflict("message"));
+            }
+            let message = self.get_message(mapping.message_id).await?;
+            return Ok(RelayedMessage { message, mapping });
+        }
+
+        let message = MessagingService::new(self.db.clone(), self.redis.clone())
+            .send_message(
+                conversation_id,
+                bridge.user_id,
+                message_type,
+                req.content,
+                None,
+                req.reply_to_id,
+                req.format_version,
+            )
+            .await?;
+
+        let mapping: Option<BridgedMessage> = sqlx::query_as(
+            r#"
+            INSERT INTO bridge_messages (bridge_id, message_id, conversation_id, external_id, direction, external_sender, sender_name)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            ON CONFLICT DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(bridge.id)
+        .bind(message.id)
+        .bind(conversation_id)
+        .bind(&req.external_id)
+        .bind(BridgeDirection::Inbound)
+        .bind(&req.external_sender)
+        .bind(req.sender_name.as_deref().map(str::trim))
+        .fetch_optional(&self.db)
+        .await?;
+
+        match mapping {
+            Some(mapping) => Ok(RelayedMessage { message, mapping }),
+            None => {
+                // A concurrent relay of the same event won; drop this copy
+                MessagingService::new(self.db.clone(), self.redis.clone())
+                    .delete_message(message.id, bridge.user_id, None)
+                    .await?;
+                let mapping = self
+                    .find_message(bridge, &req.external_id)
+                    .await?
+                    .ok_or(AppError::MessageNotFound)?;
+                let message = self.get_message(mapping.message_id).await?;
+                Ok(RelayedMessage { message, mapping })
+            }
+        }
+    }
+
+    /// Record the remote id of a local message the bridge mirrored out
+    pub async fn map_message(
+        &self,
+        bridge: &Bridge,
+        message_id: Uuid,
+        external_id: &str,
+    ) -> AppResult<BridgedMessage> {
+        validate_external_id(external_id)?;
+        let message = self.get_message(message_id).await?;
+        self.get_link(bridge, message.conversation_id).await?;
+
+        let mapping: Option<BridgedMessage> = sqlx::query_as(
+            r#"
+            INSERT INTO bridge_messages (bridge_id, message_id, conversation_id, external_id, direction)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (bridge_id, message_id) DO UPDATE SET external_id = bridge_messages.external_id
+            RETURNING *
+            "#,
+        )
+        .bind(bridge.id)
+        .bind(message.id)
+        .bind(message.conversation_id)
+        .bind(external_id)
+        .bind(BridgeDirection::Outbound)
+        .fetch_optional(&self.db)
+        .await
+        .map_err(|e| conflict_on_unique(e, "message"))?;
+
+        match mapping {
+            Some(mapping) if mapping.external_id == external_id => Ok(mapping),
+            _ => Err(AppError::ExternalIdConflict("message")),
+        }
+    }
+
+    /// The mapping for a remote event id, if any
+    pub async fn find_message(
+        &self,
+        bridge: &Bridge,
+        external_id: &str,
+    ) -> AppResult<Option<BridgedMessage>> {
+        let mapping: Option<BridgedMessage> = sqlx::query_as(
+            "SELECT * FROM bridge_messages WHERE bridge_id = $1 AND external_id = $2",
+        )
+        .bind(bridge.id)
+        .bind(external_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(mapping)
+    }
+
+    /// Delete a message the bridge relayed in, e.g. after a remote redaction
+    pub async fn delete_relayed(&self, bridge: &Bridge, message_id: Uuid) -> AppResult<()> {
+        let relayed: Option<(Uuid,)> = sqlx::query_as(
+            "SELECT message_id FROM bridge_messages WHERE bridge_id = $1 AND message_id = $2 AND direction = 'inbound'",
+        )
+        .bind(bridge.id)
+        .bind(message_id)
+        .fetch_optional(&self.db)
+        .await?;
+        if relayed.is_none() {
+            return Err(AppError::MessageNotFound);
+        }
+
+        MessagingService::new(self.db.clone(), self.redis.clone())
+            .delete_message(message_id, bridge.user_id, None)
+            .await
+    }
+
+    async fn get_link(
+        &self,
+        bridge: &Bridge,
+        conversation_id: Uuid,
+    ) -> AppResult<BridgedConversation> {
+        let link: Option<BridgedConversation> = sqlx::query_as(
+            "SELECT * FROM bridge_conversations WHERE bridge_id = $1 AND conversation_id = $2",
+        )
+        .bind(bridge.id)
+        .bind(conversation_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        link.ok_or(AppError::ConversationNotFound)
+    }
+
+    async fn ensure_participant(&self, bridge: &Bridge, conversation_id: Uuid) -> AppResult<()> {
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(bridge.user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        Ok(())
+    }
+
+    async fn get_message(&self, message_id: Uuid) -> AppResult<Message> {
+        let (from, to) = Message::created_at_range(message_id);
+        let message: Option<Message> = sqlx::query_as(
+            "SELECT * FROM messages WHERE id = $1 AND created_at >= $2 AND created_at < $3",
+        )
+        .bind(message_id)
+        .bind(from)
+        .bind(to)
+        .fetch_optional(&self.db)
+        .await?;
+
+        message.ok_or(AppError::MessageNotFound)
+    }
+
+    async fn record(&self, actor_id: Uuid, action: &str, bridge: &Bridge) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "bridge",
+                Some(&bridge.id.to_string()),
+                json!({ "name": bridge.name, "user_id": bridge.user_id }),
+            )
+            .await
+    }
+}
+
+fn hash_token(token: &str) -> String {
+    format!("{:x}", Sha256::digest(token.as_bytes()))
+}
+
+fn validate_external_id(external_id: &str) -> AppResult<()> {
+    if external_id.is_empty() || external_id.len() > MAX_EXTERNAL_ID_LENGTH {
+        return Err(AppError::Validation(format!(
+            "External ids must be between 1 and {} bytes",
+            MAX_EXTERNAL_ID_LENGTH
+        )));
+    }
+
+    Ok(())
+}
+
+/// The external id is already mapped to a different local `kind`
+fn conflict_on_unique(error: sqlx::Error, kind: &'static str) -> AppError {
+    match &error {
+        sqlx::Error::Database(db) if db.is_unique_violation() => AppError::ExternalIdConflict(kind),
+        _ => error.into(),
+    }
+}
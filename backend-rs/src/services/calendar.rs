@@ -0,0 +1,420 @@
+use std::time::Duration;
+
+use chrono::{DateTime, Utc};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        CalendarEvent, CalendarEventWithRsvps, ConversationType, CreateCalendarEventRequest,
+        EventReminderEvent, EventRsvp, ParticipantRole, RsvpStatus, SystemEvent, WS_EVENT_REMINDER,
+    },
+    services::{messaging::MessagingService, outbox::OutboxService},
+};
+
+const DEFAULT_LIST_LIMIT: i64 = 50;
+const MAX_LIST_LIMIT: i64 = 200;
+const MAX_TITLE_LENGTH: usize = 200;
+/// Serialized size of the client's location object
+const MAX_LOCATION_BYTES: usize = 2048;
+const DEFAULT_REMINDER_MINUTES: i32 = 15;
+const MAX_REMINDER_MINUTES: i32 = 7 * 24 * 60;
+/// Reminders claimed per transaction
+const REMINDER_BATCH_SIZE: i64 = 100;
+
+/// Events scheduled inside group conversations. Creating one posts an
+/// `event_scheduled` system message so the event shows up in the chat, and
+/// members answer with an RSVP. Ahead of the start, members who haven't
+/// declined get an `event_reminder` through the outbox. Unlike messages,
+/// titles and locations are stored in plaintext, since the server has to
+/// send the reminders.
+pub struct CalendarService {
+    db: PgPool,
+}
+
+impl CalendarService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Schedule an event in a group. Any member can.
+    pub async fn create(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        req: &CreateCalendarEventRequest,
+    ) -> AppResult<CalendarEvent> {
+        let (conversation_type, _) = self.membership(conversation_id, user_id).await?;
+        if conversation_type != ConversationType::Group {
+            return Err(AppError::Validation(
+                "Events can only be scheduled in groups".to_string(),
+            ));
+        }
+
+        let title = req.title.trim();
+        if title.is_empty() || title.chars().count() > MAX_TITLE_LENGTH {
+            return Err(AppError::Validation(format!(
+                "Title must be between 1 and {} characters",
+                MAX_TITLE_LENGTH
+            )));
+        }
+        if req.starts_at <= Utc::now() {
+            return Err(AppError::Validation(
+                "starts_at must be in the future".to_string(),
+            ));
+        }
+        if req.ends_at.is_some_and(|ends_at| ends_at < req.starts_at) {
+            return Err(AppError::Validation(
+                "ends_at must not be before starts_at".to_string(),
+            ));
+        }
+        if let Some(location) = &req.location {
+            if location.to_string().len() > MAX_LOCATION_BYTES {
+                return Err(AppError::Validation(format!(
+                    "location must be at most {} bytes",
+                    MAX_LOCATION_BYTES
+                )));
+            }
+        }
+        let remind_minutes_before = req
+            .remind_minutes_before
+            .unwrap_or(DEFAULT_REMINDER_MINUTES);
+        if !(0..=MAX_REMINDER_MINUTES).contains(&remind_minutes_before) {
+            return Err(AppError::Validation(format!(
+                "remind_minutes_before must be between 0 and {}",
+                MAX_REMINDER_MINUTES
+            )));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let event_id: Uuid = sqlx::query_scalar(
+            r#"
+            INSERT INTO calendar_events (conversation_id, created_by, title, starts_at, ends_at, location, remind_minutes_before)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            RETURNING id
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(title)
+        .bind(req.starts_at)
+        .bind(req.ends_at)
+        .bind(&req.location)
+        .bind(remind_minutes_before)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let message = MessagingService::post_system_message(
+            &mut tx,
+            conversation_id,
+            user_id,
+            SystemEvent::EventScheduled {
+                event_id,
+                title: title.to_string(),
+                starts_at: req.starts_at,
+            },
+        )
+        .await?;
+
+        sqlx::query("UPDATE calendar_events SET message_id = $1 WHERE id = $2")
+            .bind(message.id)
+            .bind(event_id)
+            .execute(&mut *tx)
+            .await?;
+
+        tx.commit().await?;
+
+        self.find(conversation_id, event_id, user_id).await
+    }
+
+    /// Events that haven't been cancelled, starting at or after `from`
+    /// (default now), soonest first
+    pub async fn list(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        from: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<CalendarEvent>> {
+        self.membership(conversation_id, user_id).await?;
+        let limit = limit.unwrap_or(DEFAULT_LIST_LIMIT).clamp(1, MAX_LIST_LIMIT);
+
+        let events: Vec<CalendarEvent> = sqlx::query_as(
+            r#"
+            SELECT e.*,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'going') AS going,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'maybe') AS maybe,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'declined') AS declined,
+                   (SELECT r.status FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.user_id = $2) AS my_rsvp
+            FROM calendar_events e
+            WHERE e.conversation_id = $1 AND e.cancelled_at IS NULL AND e.starts_at >= $3
+            ORDER BY e.starts_at
+            LIMIT $4
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(from.unwrap_or_else(Utc::now))
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(events)
+    }
+
+    /// An event, cancelled or not, with every member's answer
+    pub async fn get(
+        &self,
+        conversation_id: Uuid,
+        event_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<CalendarEventWithRsvps> {
+        self.membership(conversation_id, user_id).await?;
+        let event = self.find(conversation_id, event_id, user_id).await?;
+
+        let rsvps: Vec<EventRsvp> = sqlx::query_as(
+            r#"
+            SELECT user_id, status, updated_at FROM calendar_event_rsvps
+            WHERE event_id = $1
+            ORDER BY updated_at
+            "#,
+        )
+        .bind(event_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(CalendarEventWithRsvps { event, rsvps })
+    }
+
+    /// Cancel an event and post an `event_cancelled` system message. Its
+    /// creator and group owners/admins can. Cancelling twice is a no-op.
+    pub async fn cancel(
+        &self,
+        conversation_id: Uuid,
+        event_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<CalendarEvent> {
+        let (_, role) = self.membership(conversation_id, user_id).await?;
+        let event = self.find(conversation_id, event_id, user_id).await?;
+        if event.created_by != user_id && role == ParticipantRole::Member {
+            return Err(AppError::Forbidden);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let result = sqlx::query(
+            "UPDATE calendar_events SET cancelled_at = NOW(), updated_at = NOW() WHERE id = $1 AND cancelled_at IS NULL",
+        )
+        .bind(event_id)
+        .execute(&mut *tx)
+        .await?;
+
+        if result.rows_affected() > 0 {
+            MessagingService::post_system_message(
+                &mut tx,
+                conversation_id,
+                user_id,
+                SystemEvent::EventCancelled {
+                    event_id,
+                    title: event.title,
+                },
+            )
+            .await?;
+        }
+
+        tx.commit().await?;
+
+        self.find(conversation_id, event_id, user_id).await
+    }
+
+    /// Answer an event, replacing any earlier answer
+    pub async fn rsvp(
+        &self,
+        conversation_id: Uuid,
+        event_id: Uuid,
+        user_id: Uuid,
+        status: RsvpStatus,
+    ) -> AppResult<CalendarEvent> {
+        self.membership(conversation_id, user_id).await?;
+        let event = self.find(conversation_id, event_id, user_id).await?;
+        if event.cancelled_at.is_some() {
+            return Err(AppError::Validation("The event was cancelled".to_string()));
+        }
+
+        sqlx::query(
+            r#"
+            INSERT INTO calendar_event_rsvps (event_id, user_id, status)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (event_id, user_id) DO UPDATE SET status = $3, updated_at = NOW()
+            "#,
+        )
+        .bind(event_id)
+        .bind(user_id)
+        .bind(status)
+        .execute(&self.db)
+        .await?;
+
+        self.find(conversation_id, event_id, user_id).await
+    }
+
+    /// Withdraw the caller's answer
+    pub async fn clear_rsvp(
+        &self,
+        conversation_id: Uuid,
+        event_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<CalendarEvent> {
+        self.membership(conversation_id, user_id).await?;
+        self.find(conversation_id, event_id, user_id).await?;
+
+        sqlx::query("DELETE FROM calendar_event_rsvps WHERE event_id = $1 AND user_id = $2")
+            .bind(event_id)
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+
+        self.find(conversation_id, event_id, user_id).await
+    }
+
+    pub async fn run_reminders(&self, interval: Duration) {
+        tracing::info!("Event reminders started");
+
+        loop {
+            match self.reminder_pass().await {
+                Ok(0) => {}
+                Ok(count) => tracing::info!("Sent reminders for {} events", count),
+                Err(e) => tracing::error!("Event reminder pass failed: {}", e),
+            }
+
+            tokio::time::sleep(interval).await;
+        }
+    }
+
+    /// Send every reminder that is due. Events are claimed with SKIP LOCKED
+    /// and marked in the same transaction as their outbox rows, so each
+    /// reminder goes out once however many processes run this. Events that
+    /// started while no process was running get no reminder. Returns how
+    /// many events were reminded.
+    async fn reminder_pass(&self) -> AppResult<usize> {
+        let mut reminded = 0;
+
+        loop {
+            let mut tx = self.db.begin().await?;
+
+            let due: Vec<(Uuid, Uuid, String, DateTime<Utc>, Option<serde_json::Value>)> =
+                sqlx::query_as(
+                    r#"
+                    UPDATE calendar_events SET reminded_at = NOW()
+                    WHERE id IN (
+                        SELECT id FROM calendar_events
+                        WHERE reminded_at IS NULL AND cancelled_at IS NULL AND remind_minutes_before > 0
+                        AND starts_at > NOW()
+                        AND starts_at <= NOW() + make_interval(mins => remind_minutes_before)
+                        ORDER BY starts_at
+                        LIMIT $1
+                        FOR UPDATE SKIP LOCKED
+                    )
+                    RETURNING id, conversation_id, title, starts_at, location
+                    "#,
+                )
+                .bind(REMINDER_BATCH_SIZE)
+                .fetch_all(&mut *tx)
+                .await?;
+
+            for (event_id, conversation_id, title, starts_at, location) in &due {
+                let recipients: Vec<Uuid> = sqlx::query_scalar(
+                    r#"
+                    SELECT p.user_id FROM participants p
+                    WHERE p.conversation_id = $1 AND p.left_at IS NULL
+                    AND p.request_status IS DISTINCT FROM 'pending'
+                    AND NOT EXISTS(
+                        SELECT 1 FROM calendar_event_rsvps r
+                        WHERE r.event_id = $2 AND r.user_id = p.user_id AND r.status = 'declined'
+                    )
+                    "#,
+                )
+                .bind(conversation_id)
+                .bind(event_id)
+                .fetch_all(&mut *tx)
+                .await?;
+
+                let payload = serde_json::to_value(EventReminderEvent {
+                    event_id: *event_id,
+                    conversation_id: *conversation_id,
+                    title: title.clone(),
+                    starts_at: *starts_at,
+                    location: location.clone(),
+                })
+                .map_err(|e| anyhow::anyhow!("Failed to serialize event reminder: {}", e))?;
+
+                for recipient_id in recipients {
+                    OutboxService::enqueue(&mut tx, recipient_id, WS_EVENT_REMINDER, &payload)
+                        .await?;
+                }
+            }
+
+            tx.commit().await?;
+
+            reminded += due.len();
+            if (due.len() as i64) < REMINDER_BATCH_SIZE {
+                break;
+            }
+        }
+
+        Ok(reminded)
+    }
+
+    async fn find(
+        &self,
+        conversation_id: Uuid,
+        event_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<CalendarEvent> {
+        let event: Option<CalendarEvent> = sqlx::query_as(
+            r#"
+            SELECT e.*,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'going') AS going,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'maybe') AS maybe,
+                   (SELECT COUNT(*) FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.status = 'declined') AS declined,
+                   (SELECT r.status FROM calendar_event_rsvps r WHERE r.event_id = e.id AND r.user_id = $3) AS my_rsvp
+            FROM calendar_events e
+            WHERE e.id = $1 AND e.conversation_id = $2
+            "#,
+        )
+        .bind(event_id)
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        event.ok_or(AppError::CalendarEventNotFound)
+    }
+
+    /// The conversation's type and the caller's role, for active
+    /// participants of writable conversations
+    async fn membership(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<(ConversationType, ParticipantRole)> {
+        let member: Option<(ConversationType, ParticipantRole, bool)> = sqlx::query_as(
+            r#"
+            SELECT c.type, p.role, c.imported_from IS NOT NULL FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        match member {
+            Some((_, _, true)) => Err(AppError::ConversationReadOnly),
+            Some((conversation_type, role, false)) => Ok((conversation_type, role)),
+            None => Err(AppError::NotParticipant),
+        }
+    }
+}
@@ -0,0 +1,278 @@
+use chrono::{DateTime, Duration, Utc};
+use sqlx::{types::Json, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{Call, CallOutcome, ReportCallRequest, SystemEvent},
+    services::messaging::MessagingService,
+};
+
+const DEFAULT_LIST_LIMIT: i64 = 50;
+const MAX_LIST_LIMIT: i64 = 200;
+/// Calls reported later than this after they started are refused
+const MAX_REPORT_AGE_DAYS: i64 = 7;
+/// Allowance for the client's clock running ahead of the server's
+const MAX_CLOCK_SKEW_SECONDS: i64 = 60;
+const MAX_CODECS: usize = 16;
+const MAX_CODEC_NAME_LENGTH: usize = 32;
+
+/// Call history. Call signaling is end-to-end encrypted between clients, so
+/// the server only learns about a call when the caller's client reports it
+/// after hang-up. A missed call posts a `call_missed` system message, which
+/// reaches the other participants as a `new_message` event.
+pub struct CallsService {
+    db: PgPool,
+}
+
+impl CallsService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Record a finished call placed by `caller_id`. Reporting the same call
+    /// id again returns the call as first recorded.
+    pub async fn report(
+        &self,
+        conversation_id: Uuid,
+        caller_id: Uuid,
+        req: &ReportCallRequest,
+    ) -> AppResult<Call> {
+        validate(req)?;
+
+        let mut tx = self.db.begin().await?;
+
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(caller_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        let mut participant_ids = req.participant_ids.clone();
+        participant_ids.sort_unstable();
+        participant_ids.dedup();
+        // Only people in the conversation when the call started could join
+        let members: i64 = sqlx::query_scalar(
+            r#"
+            SELECT COUNT(*) FROM participants
+            WHERE conversation_id = $1 AND user_id = ANY($2) AND user_id != $3
+            AND joined_at <= $4 AND (left_at IS NULL OR left_at >= $4)
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(&participant_ids)
+        .bind(caller_id)
+        .bind(req.started_at)
+        .fetch_one(&mut *tx)
+        .await?;
+        if members != participant_ids.len() as i64 {
+            return Err(AppError::Validation(
+                "participant_ids must be other members of the conversation".to_string(),
+            ));
+        }
+
+        let result = sqlx::query(
+            r#"
+            INSERT INTO calls (id, conversation_id, caller_id, video, outcome, started_at, answered_at, ended_at, capabilities)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+            ON CONFLICT (id) DO NOTHING
+            "#,
+        )
+        .bind(req.id)
+        .bind(conversation_id)
+        .bind(caller_id)
+        .bind(req.video)
+        .bind(req.outcome)
+        .bind(req.started_at)
+        .bind(req.answered_at)
+        .bind(req.ended_at)
+        .bind(Json(&req.capabilities))
+        .execute(&mut *tx)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            drop(tx);
+            let call = self.get(req.id).await?;
+            if call.conversation_id != conversation_id || call.caller_id != caller_id {
+                return Err(AppError::Validation("Call id is already taken".to_string()));
+            }
+            return Ok(call);
+        }
+
+        sqlx::query(
+            "INSERT INTO call_participants (call_id, user_id) SELECT $1, UNNEST($2::uuid[])",
+        )
+        .bind(req.id)
+        .bind(&participant_ids)
+        .execute(&mut *tx)
+        .await?;
+
+        if req.outcome == CallOutcome::Missed {
+            MessagingService::post_system_message(
+                &mut tx,
+                conversation_id,
+                caller_id,
+                SystemEvent::CallMissed {
+                    caller_id,
+                    video: req.video,
+                },
+            )
+            .await?;
+        }
+
+        tx.commit().await?;
+
+        self.get(req.id).await
+    }
+
+    /// Calls in a conversation since the user joined it, newest first
+    pub async fn list_for_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        before: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<Call>> {
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        self.list(Some(conversation_id), user_id, before, limit)
+            .await
+    }
+
+    /// Calls across all the user's conversations, including ones they have
+    /// since left, while they were a member. Newest first.
+    pub async fn list_for_user(
+        &self,
+        user_id: Uuid,
+        before: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<Call>> {
+        self.list(None, user_id, before, limit).await
+    }
+
+    async fn list(
+        &self,
+        conversation_id: Option<Uuid>,
+        user_id: Uuid,
+        before: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<Call>> {
+        let limit = limit.unwrap_or(DEFAULT_LIST_LIMIT).clamp(1, MAX_LIST_LIMIT);
+
+        let calls: Vec<Call> = sqlx::query_as(
+            r#"
+            SELECT c.*,
+                   COALESCE(EXTRACT(EPOCH FROM c.ended_at - c.answered_at), 0)::int8 AS duration_seconds,
+                   ARRAY(SELECT cp.user_id FROM call_participants cp WHERE cp.call_id = c.id) AS participant_ids
+            FROM calls c
+            JOIN participants p ON p.conversation_id = c.conversation_id AND p.user_id = $2
+            WHERE ($1::uuid IS NULL OR c.conversation_id = $1)
+              AND c.started_at >= p.joined_at
+              AND (p.left_at IS NULL OR c.started_at <= p.left_at)
+              AND ($3::timestamptz IS NULL OR c.started_at < $3)
+            ORDER BY c.started_at DESC
+            LIMIT $4
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(before)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(calls)
+    }
+
+    async fn get(&self, call_id: Uuid) -> AppResult<Call> {
+        let call: Call = sqlx::query_as(
+            r#"
+            SELECT c.*,
+                   COALESCE(EXTRACT(EPOCH FROM c.ended_at - c.answered_at), 0)::int8 AS duration_seconds,
+                   ARRAY(SELECT cp.user_id FROM call_participants cp WHERE cp.call_id = c.id) AS participant_ids
+            FROM calls c
+            WHERE c.id = $1
+            "#,
+        )
+        .bind(call_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(call)
+    }
+}
+
+/// Times must be in order and recent, and only a completed call has an
+/// answer time and people who joined
+fn validate(req: &ReportCallRequest) -> AppResult<()> {
+    let now = Utc::now();
+    if req.ended_at < req.started_at {
+        return Err(AppError::Validation(
+            "ended_at must not be before started_at".to_string(),
+        ));
+    }
+    if req.ended_at > now + Duration::seconds(MAX_CLOCK_SKEW_SECONDS) {
+        return Err(AppError::Validation(
+            "ended_at must not be in the future".to_string(),
+        ));
+    }
+    if req.started_at < now - Duration::days(MAX_REPORT_AGE_DAYS) {
+        return Err(AppError::Validation(format!(
+            "Calls must be reported within {} days",
+            MAX_REPORT_AGE_DAYS
+        )));
+    }
+
+    let completed = req.outcome == CallOutcome::Completed;
+    match (req.answered_at, completed) {
+        (Some(_), false) => {
+            return Err(AppError::Validation(
+                "Only a completed call has answered_at".to_string(),
+            ));
+        }
+        (None, true) => {
+            return Err(AppError::Validation(
+                "A completed call needs answered_at".to_string(),
+            ));
+        }
+        (Some(answered_at), true) if answered_at < req.started_at || answered_at > req.ended_at => {
+            return Err(AppError::Validation(
+                "answered_at must be between started_at and ended_at".to_string(),
+            ));
+        }
+        _ => {}
+    }
+    if completed == req.participant_ids.is_empty() {
+        return Err(AppError::Validation(
+            "Only a completed call has participant_ids, and it needs at least one".to_string(),
+        ));
+    }
+
+    let codecs = &req.capabilities.codecs;
+    if codecs.len() > MAX_CODECS
+        || codecs
+            .iter()
+            .any(|c| c.is_empty() || c.chars().count() > MAX_CODEC_NAME_LENGTH)
+    {
+        return Err(AppError::Validation(format!(
+            "capabilities.codecs takes up to {} names of up to {} characters",
+            MAX_CODECS, MAX_CODEC_NAME_LENGTH
+        )));
+    }
+
+    Ok(())
+}
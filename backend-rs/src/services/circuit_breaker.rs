@@ -0,0 +1,166 @@
+use std::{
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use serde::Serialize;
+
+use crate::{
+    config::BreakerConfig,
+    error::{AppError, AppResult},
+};
+
+#[derive(Debug, Clone, Copy)]
+enum State {
+    Closed {
+        failures: u32,
+    },
+    Open {
+        until: Instant,
+    },
+    /// One trial call is let through; its outcome closes or reopens the breaker
+    HalfOpen {
+        trial_started: Instant,
+    },
+}
+
+/// Stops calling a dependency after repeated failures so requests fail fast
+/// with `503 dependency_unavailable` instead of waiting on timeouts. After
+/// `open_timeout` one trial call is allowed through; success closes the
+/// breaker, failure opens it again.
+pub struct CircuitBreaker {
+    name: &'static str,
+    config: BreakerConfig,
+    state: Mutex<State>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+pub struct BreakerStatus {
+    pub dependency: &'static str,
+    /// `closed`, `open` or `half_open`
+    pub state: &'static str,
+    pub consecutive_failures: u32,
+    /// Seconds until a trial call is allowed, when open
+    pub retry_after: Option<u64>,
+}
+
+impl CircuitBreaker {
+    pub fn new(name: &'static str, config: BreakerConfig) -> Self {
+        Self {
+            name,
+            config,
+            state: Mutex::new(State::Closed { failures: 0 }),
+        }
+    }
+
+    /// Whether a call may go ahead. In the half-open state this claims the
+    /// single trial call, so the caller must report the outcome with `record`.
+    pub fn check(&self) -> AppResult<()> {
+        let mut state = self.state.lock().unwrap();
+        let now = Instant::now();
+
+        match *state {
+            State::Closed { .. } => Ok(()),
+            State::Open { until } if now >= until => {
+                *state = State::HalfOpen { trial_started: now };
+                Ok(())
+            }
+            // A trial whose caller went away never reports back; let
+            // another one through after a full timeout
+            State::HalfOpen { trial_started }
+                if now >= trial_started + self.config.open_timeout =>
+            {
+                *state = State::HalfOpen { trial_started: now };
+                Ok(())
+            }
+            State::Open { until } => Err(self.unavailable(until - now)),
+            State::HalfOpen { .. } => Err(self.unavailable(Duration::from_secs(1))),
+        }
+    }
+
+    /// Report the outcome of a call let through by `check`
+    pub fn record(&self, success: bool) {
+        let mut state = self.state.lock().unwrap();
+
+        *state = match (*state, success) {
+            (State::Closed { .. }, true) => State::Closed { failures: 0 },
+            (_, true) => {
+                tracing::info!("Circuit breaker for {} closed", self.name);
+                State::Closed { failures: 0 }
+            }
+            (State::Closed { failures }, false) if failures + 1 < self.config.failure_threshold => {
+                State::Closed {
+                    failures: failures + 1,
+                }
+            }
+            (_, false) => {
+                tracing::warn!(
+                    "Circuit breaker for {} open for {}s",
+                    self.name,
+                    self.config.open_timeout.as_secs()
+                );
+                State::Open {
+                    until: Instant::now() + self.config.open_timeout,
+                }
+            }
+        };
+    }
+
+    pub fn status(&self) -> BreakerStatus {
+        let state = *self.state.lock().unwrap();
+        let now = Instant::now();
+
+        let (name, consecutive_failures, retry_after) = match state {
+            State::Closed { failures } => ("closed", failures, None),
+            State::Open { until } => (
+                "open",
+                self.config.failure_threshold,
+                Some(until.saturating_duration_since(now).as_secs()),
+            ),
+            State::HalfOpen { .. } => ("half_open", self.config.failure_threshold, None),
+        };
+
+        BreakerStatus {
+            dependency: self.name,
+            state: name,
+            consecutive_failures,
+            retry_after,
+        }
+    }
+
+    fn unavailable(&self, retry_after: Duration) -> AppError {
+        AppError::DependencyUnavailable {
+            dependency: self.name,
+            // Round up so clients don't retry a moment too early
+            retry_after: retry_after.as_secs() + u64::from(retry_after.subsec_nanos() > 0),
+        }
+    }
+}
+
+/// One breaker per external dependency, shared by every request in the
+/// process
+#[derive(Clone)]
+pub struct Breakers {
+    pub sms: Arc<CircuitBreaker>,
+    pub email: Arc<CircuitBreaker>,
+    pub minio: Arc<CircuitBreaker>,
+    pub suggestions: Arc<CircuitBreaker>,
+}
+
+impl Breakers {
+    pub fn new(config: &BreakerConfig) -> Self {
+        Self {
+            sms: Arc::new(CircuitBreaker::new("sms", config.clone())),
+            email: Arc::new(CircuitBreaker::new("email", config.clone())),
+            minio: Arc::new(CircuitBreaker::new("minio", config.clone())),
+            suggestions: Arc::new(CircuitBreaker::new("suggestions", config.clone())),
+        }
+    }
+
+    pub fn statuses(&self) -> Vec<BreakerStatus> {
+        [&self.sms, &self.email, &self.minio, &self.suggestions]
+            .iter()
+            .map(|breaker| breaker.status())
+            .collect()
+    }
+}
@@ -1,18 +1,36 @@
+use std::sync::Arc;
+
 use sqlx::PgPool;
 use uuid::Uuid;
 
 use crate::{
     error::{AppError, AppResult},
-    models::{Contact, ContactWithUser, User},
+    models::{
+        Contact, ContactMatch, ContactSyncResult, ContactWithUser, MergeHint, User,
+        UserSearchCursor, UserSearchPage, Watermark,
+    },
+    services::phone,
+    storage::repos::{ContactFilter, ContactRepo, PgContactRepo, PgUserRepo, UserRepo},
 };
 
+const MAX_SEARCH_LIMIT: i32 = 50;
+const MAX_BULK_ADD: usize = 500;
+
 pub struct ContactsService {
-    db: PgPool,
+    contacts: Arc<dyn ContactRepo>,
+    users: Arc<dyn UserRepo>,
 }
 
 impl ContactsService {
     pub fn new(db: PgPool) -> Self {
-        Self { db }
+        Self::with_repos(
+            Arc::new(PgContactRepo::new(db.clone())),
+            Arc::new(PgUserRepo::new(db)),
+        )
+    }
+
+    pub fn with_repos(contacts: Arc<dyn ContactRepo>, users: Arc<dyn UserRepo>) -> Self {
+        Self { contacts, users }
     }
 
     /// Get all contacts for a user
@@ -21,31 +39,29 @@ impl ContactsService {
         user_id: Uuid,
         include_blocked: bool,
     ) -> AppResult<Vec<ContactWithUser>> {
-        let contacts: Vec<Contact> = if include_blocked {
-            sqlx::query_as("SELECT * FROM contacts WHERE user_id = $1 ORDER BY created_at DESC")
-                .bind(user_id)
-                .fetch_all(&self.db)
-                .await?
+        let filter = if include_blocked {
+            ContactFilter::All
         } else {
-            sqlx::query_as(
-                "SELECT * FROM contacts WHERE user_id = $1 AND is_blocked = false ORDER BY created_at DESC",
-            )
-            .bind(user_id)
-            .fetch_all(&self.db)
-            .await?
+            ContactFilter::Unblocked
         };
+        let contacts = self.contacts.list(user_id, filter).await?;
 
-        let mut result = Vec::with_capacity(contacts.len());
-        for contact in contacts {
-            let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
-                .bind(contact.contact_id)
-                .fetch_optional(&self.db)
-                .await?;
+        self.with_users(contacts).await
+    }
 
-            result.push(ContactWithUser { contact, user });
-        }
+    /// Changes whenever `get_contacts` would return something different
+    pub async fn contacts_watermark(
+        &self,
+        user_id: Uuid,
+        include_blocked: bool,
+    ) -> AppResult<Watermark> {
+        let filter = if include_blocked {
+            ContactFilter::All
+        } else {
+            ContactFilter::Unblocked
+        };
 
-        Ok(result)
+        self.contacts.watermark(user_id, filter).await
     }
 
     /// Add a new contact
@@ -61,42 +77,22 @@ impl ContactsService {
         }
 
         // Check if contact user exists
-        let contact_user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
-            .bind(contact_id)
-            .fetch_optional(&self.db)
-            .await?;
+        let contact_user = self.users.find_by_id(contact_id).await?;
 
         if contact_user.is_none() {
             return Err(AppError::UserNotFound);
         }
 
         // Check if already exists
-        let existing: Option<Contact> = sqlx::query_as(
-            "SELECT * FROM contacts WHERE user_id = $1 AND contact_id = $2",
-        )
-        .bind(user_id)
-        .bind(contact_id)
-        .fetch_optional(&self.db)
-        .await?;
-
-        if existing.is_some() {
+        if self.contacts.find(user_id, contact_id).await?.is_some() {
             return Err(AppError::ContactAlreadyExists);
         }
 
         // Create contact
-        let contact: Contact = sqlx::query_as(
-            r#"
-            INSERT INTO contacts (id, user_id, contact_id, nickname, is_blocked, is_favorite)
-            VALUES ($1, $2, $3, $4, false, false)
-            RETURNING *
-            "#,
-        )
-        .bind(Uuid::new_v4())
-        .bind(user_id)
-        .bind(contact_id)
-        .bind(nickname)
-        .fetch_one(&self.db)
-        .await?;
+        let contact = self
+            .contacts
+            .create(user_id, contact_id, nickname.map(str::to_string))
+            .await?;
 
         Ok(ContactWithUser {
             contact,
@@ -106,68 +102,61 @@ impl ContactsService {
 
     /// Get a specific contact
     pub async fn get_contact(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<ContactWithUser> {
-        let contact: Option<Contact> = sqlx::query_as(
-            "SELECT * FROM contacts WHERE user_id = $1 AND contact_id = $2",
-        )
-        .bind(user_id)
-        .bind(contact_id)
-        .fetch_optional(&self.db)
-        .await?;
-
-        let contact = contact.ok_or(AppError::ContactNotFound)?;
+        let contact = self
+            .contacts
+            .find(user_id, contact_id)
+            .await?
+            .ok_or(AppError::ContactNotFound)?;
 
-        let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
-            .bind(contact.contact_id)
-            .fetch_optional(&self.db)
-            .await?;
+        let user = self.users.find_by_id(contact.contact_id).await?;
 
         Ok(ContactWithUser { contact, user })
     }
 
-    /// Update contact
+    /// Update contact. With `expected_version`, fails with `PreconditionFailed`
+    /// if the contact has changed since.
     pub async fn update_contact(
         &self,
         user_id: Uuid,
         contact_id: Uuid,
         nickname: Option<&str>,
         is_favorite: Option<bool>,
+        expected_version: Option<i32>,
     ) -> AppResult<ContactWithUser> {
-        let contact: Option<Contact> = sqlx::query_as(
-            r#"
-            UPDATE contacts
-            SET nickname = COALESCE($3, nickname),
-                is_favorite = COALESCE($4, is_favorite),
-                updated_at = NOW()
-            WHERE user_id = $1 AND contact_id = $2
-            RETURNING *
-            "#,
-        )
-        .bind(user_id)
-        .bind(contact_id)
-        .bind(nickname)
-        .bind(is_favorite)
-        .fetch_optional(&self.db)
-        .await?;
-
-        let contact = contact.ok_or(AppError::ContactNotFound)?;
-
-        let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
-            .bind(contact.contact_id)
-            .fetch_optional(&self.db)
+        let updated = self
+            .contacts
+            .update(
+                user_id,
+                contact_id,
+                nickname.map(str::to_string),
+                is_favorite,
+                expected_version,
+            )
             .await?;
 
+        let contact = match updated {
+            Some(contact) => contact,
+            None => {
+                let current = self
+                    .contacts
+                    .find(user_id, contact_id)
+                    .await?
+                    .ok_or(AppError::ContactNotFound)?;
+
+                return Err(AppError::PreconditionFailed {
+                    current_version: current.version,
+                });
+            }
+        };
+
+        let user = self.users.find_by_id(contact.contact_id).await?;
+
         Ok(ContactWithUser { contact, user })
     }
 
     /// Delete contact
     pub async fn delete_contact(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()> {
-        let result = sqlx::query("DELETE FROM contacts WHERE user_id = $1 AND contact_id = $2")
-            .bind(user_id)
-            .bind(contact_id)
-            .execute(&self.db)
-            .await?;
-
-        if result.rows_affected() == 0 {
+        if !self.contacts.delete(user_id, contact_id).await? {
             return Err(AppError::ContactNotFound);
         }
 
@@ -176,95 +165,198 @@ impl ContactsService {
 
     /// Block a contact
     pub async fn block_contact(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()> {
-        // First ensure contact exists or create it as blocked
-        sqlx::query(
-            r#"
-            INSERT INTO contacts (id, user_id, contact_id, is_blocked, is_favorite)
-            VALUES ($1, $2, $3, true, false)
-            ON CONFLICT (user_id, contact_id)
-            DO UPDATE SET is_blocked = true, updated_at = NOW()
-            "#,
-        )
-        .bind(Uuid::new_v4())
-        .bind(user_id)
-        .bind(contact_id)
-        .execute(&self.db)
-        .await?;
-
-        Ok(())
+        // Creates the contact as blocked if it doesn't exist
+        self.contacts.block(user_id, contact_id).await
     }
 
     /// Unblock a contact
     pub async fn unblock_contact(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()> {
-        sqlx::query(
-            "UPDATE contacts SET is_blocked = false, updated_at = NOW() WHERE user_id = $1 AND contact_id = $2",
-        )
-        .bind(user_id)
-        .bind(contact_id)
-        .execute(&self.db)
-        .await?;
-
-        Ok(())
+        self.contacts.unblock(user_id, contact_id).await
     }
 
     /// Get blocked contacts
     pub async fn get_blocked_contacts(&self, user_id: Uuid) -> AppResult<Vec<ContactWithUser>> {
-        let contacts: Vec<Contact> = sqlx::query_as(
-            "SELECT * FROM contacts WHERE user_id = $1 AND is_blocked = true ORDER BY updated_at DESC",
-        )
-        .bind(user_id)
-        .fetch_all(&self.db)
-        .await?;
+        let contacts = self.contacts.list(user_id, ContactFilter::Blocked).await?;
 
-        let mut result = Vec::with_capacity(contacts.len());
-        for contact in contacts {
-            let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
-                .bind(contact.contact_id)
-                .fetch_optional(&self.db)
-                .await?;
-
-            result.push(ContactWithUser { contact, user });
-        }
-
-        Ok(result)
+        self.with_users(contacts).await
     }
 
     /// Search users by username or display name
-    pub async fn search_users(&self, query: &str, limit: i32) -> AppResult<Vec<User>> {
-        let search_pattern = format!("%{}%", query.to_lowercase());
-
-        let users: Vec<User> = sqlx::query_as(
-            r#"
-            SELECT * FROM users
-            WHERE LOWER(username) LIKE $1 OR LOWER(display_name) LIKE $1
-            LIMIT $2
-            "#,
-        )
-        .bind(&search_pattern)
-        .bind(limit)
-        .fetch_all(&self.db)
-        .await?;
+    /// Directory search for `viewer_id`, contacts first, a page at a time
+    pub async fn search_users(
+        &self,
+        viewer_id: Uuid,
+        query: &str,
+        limit: i32,
+        cursor: Option<&str>,
+    ) -> AppResult<UserSearchPage> {
+        let after = match cursor {
+            Some(cursor) => Some(
+                UserSearchCursor::decode(cursor)
+                    .ok_or_else(|| AppError::InvalidQuery("Invalid cursor".to_string()))?,
+            ),
+            None => None,
+        };
 
-        Ok(users)
+        let limit = limit.clamp(1, MAX_SEARCH_LIMIT);
+        let rows = self.users.search(viewer_id, query, limit, after).await?;
+
+        let next_cursor = if rows.len() as i32 == limit {
+            rows.last().map(|(user, is_contact)| {
+                UserSearchCursor {
+                    is_contact: *is_contact,
+                    username: user.username.clone(),
+                }
+                .encode()
+            })
+        } else {
+            None
+        };
+
+        Ok(UserSearchPage {
+            users: rows.into_iter().map(|(user, _)| user).collect(),
+            next_cursor,
+        })
     }
 
-    /// Sync contacts from phone identifiers (phone numbers or emails)
+    /// Sync contacts from phone identifiers (phone numbers or emails). Users
+    /// who are blocked, and the caller, are left out. Phone numbers without a
+    /// country code are read in the caller's own region, falling back to
+    /// `default_region`; numbers that don't parse can't match anyone.
     pub async fn sync_contacts(
         &self,
-        _user_id: Uuid,
-        identifiers: Vec<String>,
-    ) -> AppResult<Vec<User>> {
+        user_id: Uuid,
+        mut identifiers: Vec<String>,
+        default_region: Option<&str>,
+    ) -> AppResult<ContactSyncResult> {
+        identifiers.sort();
+        identifiers.dedup();
+
         if identifiers.is_empty() {
-            return Ok(vec![]);
+            return Ok(ContactSyncResult {
+                matches: vec![],
+                merge_hints: vec![],
+            });
         }
 
-        let users: Vec<User> = sqlx::query_as(
-            "SELECT * FROM users WHERE phone = ANY($1) OR email = ANY($1)",
-        )
-        .bind(&identifiers)
-        .fetch_all(&self.db)
-        .await?;
+        let region = self
+            .users
+            .find_by_id(user_id)
+            .await?
+            .and_then(|u| u.phone)
+            .and_then(|p| phone::region_of(&p))
+            .or_else(|| default_region.and_then(phone::parse_region));
+
+        // (as sent, as stored)
+        let lookups: Vec<(String, String)> = identifiers
+            .into_iter()
+            .filter_map(|id| {
+                let stored = if id.contains('@') {
+                    id.trim().to_string()
+                } else {
+                    phone::normalize(&id, region).ok()?
+                };
+                Some((id, stored))
+            })
+            .collect();
+
+        let mut keys: Vec<String> = lookups.iter().map(|(_, stored)| stored.clone()).collect();
+        keys.sort();
+        keys.dedup();
+
+        let users = self.users.find_by_identifiers(&keys).await?;
+        let contacts = self.contacts.list(user_id, ContactFilter::All).await?;
+
+        let mut matches = Vec::with_capacity(users.len());
+        let mut merge_hints = Vec::new();
+        for user in users {
+            if user.id == user_id {
+                continue;
+            }
+
+            let contact = contacts.iter().find(|c| c.contact_id == user.id);
+            if contact.is_some_and(|c| c.is_blocked) {
+                continue;
+            }
+
+            let matched: Vec<String> = lookups
+                .iter()
+                .filter(|(_, stored)| {
+                    user.phone.as_deref() == Some(stored.as_str())
+                        || user.email.as_deref() == Some(stored.as_str())
+                })
+                .map(|(id, _)| id.clone())
+                .collect();
+
+            if matched.len() > 1 {
+                merge_hints.push(MergeHint {
+                    user_id: user.id,
+                    identifiers: matched.clone(),
+                });
+            }
+
+            matches.push(ContactMatch {
+                user,
+                identifiers: matched,
+                is_contact: contact.is_some(),
+            });
+        }
 
-        Ok(users)
+        Ok(ContactSyncResult {
+            matches,
+            merge_hints,
+        })
+    }
+
+    /// Add several users as contacts in one call, typically the new matches
+    /// from a sync. The caller, unknown users and existing contacts are
+    /// skipped; only the contacts created are returned.
+    pub async fn bulk_add_contacts(
+        &self,
+        user_id: Uuid,
+        mut contact_ids: Vec<Uuid>,
+    ) -> AppResult<Vec<ContactWithUser>> {
+        if contact_ids.len() > MAX_BULK_ADD {
+            return Err(AppError::Validation(format!(
+                "At most {} contacts can be added at once",
+                MAX_BULK_ADD
+            )));
+        }
+
+        contact_ids.sort();
+        contact_ids.dedup();
+
+        let mut added = Vec::with_capacity(contact_ids.len());
+        for contact_id in contact_ids {
+            if contact_id == user_id {
+                continue;
+            }
+
+            let Some(user) = self.users.find_by_id(contact_id).await? else {
+                continue;
+            };
+
+            if self.contacts.find(user_id, contact_id).await?.is_some() {
+                continue;
+            }
+
+            let contact = self.contacts.create(user_id, contact_id, None).await?;
+            added.push(ContactWithUser {
+                contact,
+                user: Some(user),
+            });
+        }
+
+        Ok(added)
+    }
+
+    async fn with_users(&self, contacts: Vec<Contact>) -> AppResult<Vec<ContactWithUser>> {
+        let mut result = Vec::with_capacity(contacts.len());
+        for contact in contacts {
+            let user = self.users.find_by_id(contact.contact_id).await?;
+            result.push(ContactWithUser { contact, user });
+        }
+
+        Ok(result)
     }
 }
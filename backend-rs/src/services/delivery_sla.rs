@@ -0,0 +1,118 @@
+use sqlx::PgPool;
+
+use crate::{
+    error::AppResult,
+    models::{DeliverySla, StuckMessage},
+};
+
+/// Window the Prometheus delivery percentiles are measured over
+pub const DEFAULT_SLA_WINDOW_MINUTES: i32 = 60;
+/// Stuck messages older than this are assumed to be known about already
+const STUCK_LOOKBACK_HOURS: i32 = 24;
+
+/// Time from a message being sent to its first delivered receipt, and the
+/// recent messages that never got one. A message stuck at `sent` while its
+/// recipients were online is the trace a silent failure in the Redis or
+/// WebSocket fan-out leaves behind.
+pub struct DeliverySlaService {
+    db: PgPool,
+}
+
+impl DeliverySlaService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Delivery percentiles for messages sent in the last `window_minutes`.
+    /// Shadow-limited and deleted messages are left out.
+    pub async fn sla(&self, window_minutes: i32) -> AppResult<DeliverySla> {
+        let sla: DeliverySla = sqlx::query_as(
+            r#"
+            SELECT $1::int4 AS window_seconds,
+                   COUNT(*) FILTER (WHERE delivered_at IS NOT NULL) AS delivered,
+                   COUNT(*) FILTER (WHERE status = 'sent') AS undelivered,
+                   EXTRACT(EPOCH FROM percentile_cont(0.5)
+                       WITHIN GROUP (ORDER BY delivered_at - created_at))::float8 AS p50_seconds,
+                   EXTRACT(EPOCH FROM percentile_cont(0.95)
+                       WITHIN GROUP (ORDER BY delivered_at - created_at))::float8 AS p95_seconds,
+                   EXTRACT(EPOCH FROM percentile_cont(0.99)
+                       WITHIN GROUP (ORDER BY delivered_at - created_at))::float8 AS p99_seconds,
+                   EXTRACT(EPOCH FROM MAX(delivered_at - created_at))::float8 AS max_seconds
+            FROM messages
+            WHERE created_at > NOW() - make_interval(secs => $1::int4)
+            AND deleted_at IS NULL AND NOT shadow_limited
+            "#,
+        )
+        .bind(window_minutes * 60)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(sla)
+    }
+
+    /// Messages older than `older_than_minutes` (up to a day) that no
+    /// recipient has received, those with active recipients first.
+    /// Recipients who haven't accepted a message request never send
+    /// receipts, so they aren't counted.
+    pub async fn stuck_messages(
+        &self,
+        older_than_minutes: i32,
+        limit: i64,
+    ) -> AppResult<Vec<StuckMessage>> {
+        let messages: Vec<StuckMessage> = sqlx::query_as(
+            r#"
+            SELECT m.id, m.conversation_id, m.sender_id, m.created_at,
+                   EXTRACT(EPOCH FROM NOW() - m.created_at)::float8 AS age_seconds,
+                   COUNT(*) AS recipients,
+                   COUNT(*) FILTER (WHERE EXISTS(
+                       SELECT 1 FROM devices d
+                       WHERE d.user_id = p.user_id AND d.last_active_at > m.created_at
+                   )) AS active_recipients
+            FROM messages m
+            JOIN participants p ON p.conversation_id = m.conversation_id
+                AND p.user_id != m.sender_id AND p.left_at IS NULL
+                AND p.joined_at <= m.created_at
+                AND p.request_status IS DISTINCT FROM 'pending'
+            WHERE m.status = 'sent' AND m.deleted_at IS NULL AND NOT m.shadow_limited
+            AND m.created_at < NOW() - make_interval(mins => $1)
+            AND m.created_at > NOW() - make_interval(hours => $2)
+            GROUP BY m.id, m.conversation_id, m.sender_id, m.created_at
+            ORDER BY active_recipients DESC, m.created_at
+            LIMIT $3
+            "#,
+        )
+        .bind(older_than_minutes)
+        .bind(STUCK_LOOKBACK_HOURS)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(messages)
+    }
+
+    /// Render delivery percentiles in the Prometheus text format
+    pub async fn prometheus_metrics(&self) -> AppResult<String> {
+        let sla = self.sla(DEFAULT_SLA_WINDOW_MINUTES).await?;
+        let mut out = String::new();
+
+        out.push_str("# TYPE ansible_talk_message_delivery_seconds gauge\n");
+        for (quantile, value) in [
+            ("0.5", sla.p50_seconds),
+            ("0.95", sla.p95_seconds),
+            ("0.99", sla.p99_seconds),
+        ] {
+            out.push_str(&format!(
+                "ansible_talk_message_delivery_seconds{{quantile=\"{}\"}} {}\n",
+                quantile,
+                value.unwrap_or(0.0)
+            ));
+        }
+        out.push_str("# TYPE ansible_talk_messages_undelivered gauge\n");
+        out.push_str(&format!(
+            "ansible_talk_messages_undelivered {}\n",
+            sla.undelivered
+        ));
+
+        Ok(out)
+    }
+}
@@ -0,0 +1,187 @@
+use std::net::IpAddr;
+
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::DownloadsConfig,
+    error::{AppError, AppResult},
+    services::audit::AuditService,
+    storage::redis::RedisClient,
+};
+
+const SCOPE_USER: &str = "user";
+const SCOPE_IP: &str = "ip";
+
+/// Who is asking for an attachment URL
+pub struct Downloader {
+    pub user_id: Uuid,
+    pub ip: Option<IpAddr>,
+}
+
+impl Downloader {
+    fn scopes(&self) -> Vec<(&'static str, String)> {
+        let mut scopes = vec![(SCOPE_USER, self.user_id.to_string())];
+        if let Some(ip) = self.ip {
+            scopes.push((SCOPE_IP, ip.to_string()));
+        }
+        scopes
+    }
+}
+
+/// Throttling for attachment downloads. Each URL handed out counts the
+/// attachment's size against a byte quota per user and per client IP;
+/// past the quota, further URLs are refused until the window resets.
+/// Scraping shows up as many distinct attachments, or many lookups of ids
+/// and digests that don't exist, in one window. Either blocks the user or
+/// IP from downloads for `block_duration`, which is written to the audit
+/// log.
+pub struct DownloadsService {
+    redis: RedisClient,
+    audit: AuditService,
+    config: DownloadsConfig,
+}
+
+impl DownloadsService {
+    pub fn new(db: PgPool, redis: RedisClient, config: DownloadsConfig) -> Self {
+        let audit = AuditService::new(db);
+        Self {
+            redis,
+            audit,
+            config,
+        }
+    }
+
+    /// Refuse a download while the user or IP is blocked
+    pub async fn check(&self, downloader: &Downloader) -> AppResult<()> {
+        for (scope, key) in downloader.scopes() {
+            if let Some(retry_after) = self.redis.get_download_block(scope, &key).await? {
+                return Err(AppError::DownloadLimited {
+                    scope,
+                    blocked: true,
+                    retry_after,
+                });
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Count a URL lookup. An attachment that doesn't exist counts as a
+    /// miss; one that does counts toward the distinct-attachment limit, and
+    /// its size toward the byte quotas. `file` gives the attachment's id
+    /// and size.
+    pub async fn settle<T>(
+        &self,
+        downloader: &Downloader,
+        result: AppResult<T>,
+        file: impl FnOnce(&T) -> (Uuid, i64),
+    ) -> AppResult<T> {
+        match &result {
+            Ok(found) => {
+                let (attachment_id, size_bytes) = file(found);
+                self.record_download(downloader, attachment_id, size_bytes)
+                    .await?;
+            }
+            Err(AppError::AttachmentNotFound) => self.record_miss(downloader).await?,
+            Err(_) => {}
+        }
+
+        result
+    }
+
+    async fn record_download(
+        &self,
+        downloader: &Downloader,
+        attachment_id: Uuid,
+        size_bytes: i64,
+    ) -> AppResult<()> {
+        for (scope, key) in downloader.scopes() {
+            let objects = self
+                .redis
+                .add_download_object(scope, &key, &attachment_id.to_string(), self.config.window)
+                .await?;
+            if objects > self.config.max_objects {
+                self.block(downloader, scope, &key, "objects", objects)
+                    .await?;
+            }
+
+            let limit = match scope {
+                SCOPE_USER => self.config.user_bytes,
+                _ => self.config.ip_bytes,
+            };
+            let (bytes, retry_after) = self
+                .redis
+                .incr_download_bytes(scope, &key, size_bytes, self.config.window)
+                .await?;
+            if limit > 0 && bytes > limit {
+                return Err(AppError::DownloadLimited {
+                    scope,
+                    blocked: false,
+                    retry_after,
+                });
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Count a lookup of an attachment that doesn't exist
+    pub async fn record_miss(&self, downloader: &Downloader) -> AppResult<()> {
+        for (scope, key) in downloader.scopes() {
+            let misses = self
+                .redis
+                .incr_download_misses(scope, &key, self.config.window)
+                .await?;
+            if misses > self.config.max_misses {
+                self.block(downloader, scope, &key, "misses", misses)
+                    .await?;
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Block the scope and refuse the download that tripped it
+    async fn block(
+        &self,
+        downloader: &Downloader,
+        scope: &'static str,
+        key: &str,
+        reason: &str,
+        count: i64,
+    ) -> AppResult<()> {
+        self.redis
+            .set_download_block(scope, key, self.config.block_duration)
+            .await?;
+        tracing::warn!(
+            "Blocked downloads for {} {} after {} {} in the window",
+            scope,
+            key,
+            count,
+            reason
+        );
+        self.audit
+            .record(
+                None,
+                "downloads.blocked",
+                scope,
+                Some(key),
+                json!({
+                    "reason": reason,
+                    "count": count,
+                    "duration": self.config.block_duration.as_secs(),
+                    "user_id": downloader.user_id,
+                    "ip": downloader.ip,
+                }),
+            )
+            .await?;
+
+        Err(AppError::DownloadLimited {
+            scope,
+            blocked: true,
+            retry_after: self.config.block_duration.as_secs(),
+        })
+    }
+}
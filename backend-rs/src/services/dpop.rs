@@ -0,0 +1,194 @@
+//! DPoP (RFC 9449) proof of possession. A client generates a device
+//! keypair and signs a short-lived proof JWT for each request; tokens issued
+//! against a proof carry the key's thumbprint (`cnf.jkt`) and are only
+//! accepted alongside a fresh proof from the same key.
+
+use axum::http::{HeaderMap, Method, Uri};
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use chrono::Utc;
+use jsonwebtoken::{decode, decode_header, jwk::Jwk, Algorithm, DecodingKey, Validation};
+use serde::Deserialize;
+use sha2::{Digest, Sha256};
+
+use crate::{
+    config::{DpopConfig, DpopEnforcement},
+    error::{AppError, AppResult},
+    services::auth::Claims,
+    storage::redis::RedisClient,
+};
+
+/// Header carrying the proof JWT
+pub const DPOP_HEADER: &str = "dpop";
+
+const PROOF_TYPE: &str = "dpop+jwt";
+
+#[derive(Debug, Deserialize)]
+struct DpopProof {
+    htm: String,
+    htu: String,
+    iat: i64,
+    jti: String,
+    /// Hash of the access token; required when one is presented
+    ath: Option<String>,
+}
+
+pub struct DpopService {
+    redis: RedisClient,
+    config: DpopConfig,
+}
+
+impl DpopService {
+    pub fn new(redis: RedisClient, config: DpopConfig) -> Self {
+        Self { redis, config }
+    }
+
+    /// Key thumbprint to bind new tokens to, from the proof sent with a
+    /// login, registration or refresh. `None` when DPoP is off or (unless
+    /// required) the client sent no proof.
+    pub async fn binding_for(
+        &self,
+        headers: &HeaderMap,
+        method: &Method,
+        path: &str,
+    ) -> AppResult<Option<String>> {
+        if self.config.enforcement == DpopEnforcement::Off {
+            return Ok(None);
+        }
+
+        match proof_header(headers)? {
+            Some(proof) => Ok(Some(self.verify(proof, method, path, None).await?)),
+            None if self.config.enforcement == DpopEnforcement::Required => {
+                Err(AppError::DpopProofRequired)
+            }
+            None => Ok(None),
+        }
+    }
+
+    /// Check that a request with an access token carries a valid proof from
+    /// the key the token is bound to
+    pub async fn check_request(
+        &self,
+        claims: &Claims,
+        access_token: &str,
+        headers: &HeaderMap,
+        method: &Method,
+        path: &str,
+    ) -> AppResult<()> {
+        if self.config.enforcement == DpopEnforcement::Off {
+            return Ok(());
+        }
+
+        let Some(bound_jkt) = claims.cnf.as_ref().map(|cnf| cnf.jkt.as_str()) else {
+            return match self.config.enforcement {
+                DpopEnforcement::Required => Err(AppError::DpopProofRequired),
+                _ => Ok(()),
+            };
+        };
+
+        let proof = proof_header(headers)?.ok_or(AppError::DpopProofRequired)?;
+        let jkt = self.verify(proof, method, path, Some(access_token)).await?;
+        if jkt != bound_jkt {
+            return Err(invalid("key does not match the token binding"));
+        }
+
+        Ok(())
+    }
+
+    /// Verify a proof for this request and return its key's thumbprint
+    async fn verify(
+        &self,
+        proof: &str,
+        method: &Method,
+        path: &str,
+        access_token: Option<&str>,
+    ) -> AppResult<String> {
+        let header = decode_header(proof).map_err(|_| invalid("malformed proof"))?;
+        if header.typ.as_deref() != Some(PROOF_TYPE) {
+            return Err(invalid("typ must be dpop+jwt"));
+        }
+        if !matches!(header.alg, Algorithm::ES256 | Algorithm::EdDSA) {
+            return Err(invalid("alg must be ES256 or EdDSA"));
+        }
+
+        let jwk = header.jwk.ok_or_else(|| invalid("missing jwk"))?;
+        let key = DecodingKey::from_jwk(&jwk).map_err(|_| invalid("unsupported jwk"))?;
+
+        // Proofs carry no exp; freshness is checked against iat below
+        let mut validation = Validation::new(header.alg);
+        validation.validate_exp = false;
+        validation.required_spec_claims.clear();
+
+        let claims = decode::<DpopProof>(proof, &key, &validation)
+            .map_err(|_| invalid("bad signature"))?
+            .claims;
+
+        if !claims.htm.eq_ignore_ascii_case(method.as_str()) {
+            return Err(invalid("htm does not match the request method"));
+        }
+
+        let htu_path = claims.htu.parse::<Uri>().ok().map(|uri| uri.path().to_string());
+        if htu_path.as_deref() != Some(path) {
+            return Err(invalid("htu does not match the request URL"));
+        }
+
+        let max_age = self.config.max_proof_age.as_secs() as i64;
+        if (Utc::now().timestamp() - claims.iat).abs() > max_age {
+            return Err(invalid("proof is stale"));
+        }
+
+        if let Some(access_token) = access_token {
+            if claims.ath.as_deref() != Some(token_hash(access_token).as_str()) {
+                return Err(invalid("ath does not match the access token"));
+            }
+        }
+
+        let jkt = thumbprint(&jwk)?;
+
+        // A proof is good for one request; keep the jti until it would be
+        // stale anyway
+        let ttl = self.config.max_proof_age * 2;
+        if !self.redis.claim_dpop_jti(&jkt, &claims.jti, ttl).await? {
+            return Err(invalid("proof was already used"));
+        }
+
+        Ok(jkt)
+    }
+}
+
+fn proof_header(headers: &HeaderMap) -> AppResult<Option<&str>> {
+    headers
+        .get(DPOP_HEADER)
+        .map(|value| value.to_str().map_err(|_| invalid("malformed proof")))
+        .transpose()
+}
+
+/// RFC 7638 thumbprint: SHA-256 over the required members in lexical order
+pub fn thumbprint(jwk: &Jwk) -> AppResult<String> {
+    let value = serde_json::to_value(jwk).map_err(|_| invalid("unsupported jwk"))?;
+    let member = |name: &str| value[name].as_str().ok_or_else(|| invalid("incomplete jwk"));
+
+    let canonical = match member("kty")? {
+        "EC" => format!(
+            r#"{{"crv":"{}","kty":"EC","x":"{}","y":"{}"}}"#,
+            member("crv")?,
+            member("x")?,
+            member("y")?
+        ),
+        "OKP" => format!(
+            r#"{{"crv":"{}","kty":"OKP","x":"{}"}}"#,
+            member("crv")?,
+            member("x")?
+        ),
+        _ => return Err(invalid("key type must be EC or OKP")),
+    };
+
+    Ok(URL_SAFE_NO_PAD.encode(Sha256::digest(canonical.as_bytes())))
+}
+
+fn token_hash(access_token: &str) -> String {
+    URL_SAFE_NO_PAD.encode(Sha256::digest(access_token.as_bytes()))
+}
+
+fn invalid(reason: &str) -> AppError {
+    AppError::InvalidDpopProof(reason.to_string())
+}
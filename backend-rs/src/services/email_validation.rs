@@ -0,0 +1,282 @@
+use std::{collections::HashSet, time::Duration};
+
+use hickory_resolver::{error::ResolveErrorKind, TokioAsyncResolver};
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::EmailConfig,
+    error::{AppError, AppResult},
+    models::{BlockedEmailDomain, EmailRejection},
+    services::{
+        analytics::{AnalyticsService, COUNTER_BLOCKED_EMAIL_DOMAIN},
+        audit::AuditService,
+    },
+    storage::redis::RedisClient,
+};
+
+const MAX_EMAIL_LENGTH: usize = 254;
+const MAX_LOCAL_PART_LENGTH: usize = 64;
+const MAX_LABEL_LENGTH: usize = 63;
+const BLOCKLIST_CACHE_TTL: Duration = Duration::from_secs(60);
+/// Redis cache entry for the disposable-domain blocklist
+const BLOCKLIST_CACHE_KEY: &str = "email_domain";
+
+/// Checks email targets before a code is sent or an account registered:
+/// syntax, whether the domain accepts mail, the disposable-domain blocklist
+/// and the registration domain policy.
+pub struct EmailValidationService {
+    db: PgPool,
+    redis: RedisClient,
+    config: EmailConfig,
+    audit: AuditService,
+}
+
+impl EmailValidationService {
+    pub fn new(db: PgPool, redis: RedisClient, config: EmailConfig) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            redis,
+            config,
+            audit,
+        }
+    }
+
+    pub async fn validate(&self, email: &str) -> AppResult<()> {
+        let (_, domain) =
+            split_address(email.trim()).ok_or(AppError::InvalidEmail(EmailRejection::Syntax))?;
+        let domain = domain.to_lowercase();
+
+        if self.is_blocked(&domain).await? {
+            let _ = AnalyticsService::new(self.redis.clone())
+                .incr(COUNTER_BLOCKED_EMAIL_DOMAIN)
+                .await;
+            return Err(AppError::InvalidEmail(EmailRejection::DisposableDomain));
+        }
+
+        if self.config.mx_check && !accepts_mail(&domain).await {
+            return Err(AppError::InvalidEmail(EmailRejection::NoMailServer));
+        }
+
+        Ok(())
+    }
+
+    /// With `REGISTRATION_EMAIL_DOMAINS` set, an account without a phone
+    /// number needs an email in one of those domains
+    pub fn check_registration(&self, phone: Option<&str>, email: Option<&str>) -> AppResult<()> {
+        if phone.is_some() || self.config.registration_domains.is_empty() {
+            return Ok(());
+        }
+
+        let domain = email
+            .and_then(|e| e.rsplit_once('@'))
+            .map(|(_, domain)| domain)
+            .unwrap_or_default();
+        let allowed = self
+            .config
+            .registration_domains
+            .iter()
+            .any(|d| domain_matches(domain, d));
+
+        if !allowed {
+            return Err(AppError::InvalidEmail(EmailRejection::DomainNotAllowed));
+        }
+
+        Ok(())
+    }
+
+    pub async fn list_blocked_domains(&self) -> AppResult<Vec<BlockedEmailDomain>> {
+        let domains: Vec<BlockedEmailDomain> =
+            sqlx::query_as("SELECT * FROM blocked_email_domains ORDER BY domain")
+                .fetch_all(&self.db)
+                .await?;
+
+        Ok(domains)
+    }
+
+    /// Add domains to the blocklist; ones already on it are left unchanged.
+    /// Returns the domains newly added.
+    pub async fn block_domains(
+        &self,
+        admin_id: Uuid,
+        domains: &[String],
+        reason: Option<&str>,
+    ) -> AppResult<Vec<BlockedEmailDomain>> {
+        let mut normalized = Vec::with_capacity(domains.len());
+        for domain in domains {
+            let domain = domain.trim().trim_start_matches('@').to_lowercase();
+            if !is_valid_domain(&domain) {
+                return Err(AppError::Validation(format!("Invalid domain: {}", domain)));
+            }
+            normalized.push(domain);
+        }
+
+        let added: Vec<BlockedEmailDomain> = sqlx::query_as(
+            r#"
+            INSERT INTO blocked_email_domains (domain, reason, created_by)
+            SELECT d, $2, $3 FROM UNNEST($1::text[]) AS d
+            ON CONFLICT (domain) DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(&normalized)
+        .bind(reason)
+        .bind(admin_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        self.redis
+            .invalidate_cached_blocklist(BLOCKLIST_CACHE_KEY)
+            .await?;
+
+        let added_domains: Vec<&str> = added.iter().map(|d| d.domain.as_str()).collect();
+        self.audit
+            .record(
+                Some(admin_id),
+                "email_domain.blocked",
+                "email_domain",
+                None,
+                json!({ "domains": added_domains, "reason": reason }),
+            )
+            .await?;
+
+        Ok(added)
+    }
+
+    pub async fn unblock_domain(&self, admin_id: Uuid, domain: &str) -> AppResult<()> {
+        let domain = domain.trim().to_lowercase();
+        let result = sqlx::query("DELETE FROM blocked_email_domains WHERE domain = $1")
+            .bind(&domain)
+            .execute(&self.db)
+            .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::EmailDomainNotFound);
+        }
+
+        self.redis
+            .invalidate_cached_blocklist(BLOCKLIST_CACHE_KEY)
+            .await?;
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "email_domain.unblocked",
+                "email_domain",
+                Some(&domain),
+                json!({}),
+            )
+            .await?;
+
+        Ok(())
+    }
+
+    /// Whether the domain or any parent domain is blocked, so subdomains of
+    /// a disposable provider are caught too
+    async fn is_blocked(&self, domain: &str) -> AppResult<bool> {
+        let blocked = self.blocked_domains().await?;
+
+        Ok(domain
+            .match_indices('.')
+            .map(|(i, _)| &domain[i + 1..])
+            .chain(std::iter::once(domain))
+            .any(|candidate| blocked.contains(candidate)))
+    }
+
+    /// The blocklist, from Redis when cached
+    async fn blocked_domains(&self) -> AppResult<HashSet<String>> {
+        if let Some(cached) = self.redis.get_cached_blocklist(BLOCKLIST_CACHE_KEY).await? {
+            if let Ok(domains) = serde_json::from_str::<HashSet<String>>(&cached) {
+                return Ok(domains);
+            }
+        }
+
+        let domains: Vec<String> = sqlx::query_scalar("SELECT domain FROM blocked_email_domains")
+            .fetch_all(&self.db)
+            .await?;
+
+        if let Ok(json) = serde_json::to_string(&domains) {
+            self.redis
+                .set_cached_blocklist(BLOCKLIST_CACHE_KEY, &json, BLOCKLIST_CACHE_TTL)
+                .await?;
+        }
+
+        Ok(domains.into_iter().collect())
+    }
+}
+
+/// Split a plain `local@domain` address. Quoted local parts and IP-literal
+/// domains are legal but never used for sign-up, so they are refused.
+fn split_address(email: &str) -> Option<(&str, &str)> {
+    if email.len() > MAX_EMAIL_LENGTH {
+        return None;
+    }
+
+    let (local, domain) = email.rsplit_once('@')?;
+    let local_ok = !local.is_empty()
+        && local.len() <= MAX_LOCAL_PART_LENGTH
+        && !local.starts_with('.')
+        && !local.ends_with('.')
+        && !local.contains("..")
+        && local
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "!#$%&'*+-/=?^_`{|}~.".contains(c));
+
+    if local_ok && is_valid_domain(domain) {
+        Some((local, domain))
+    } else {
+        None
+    }
+}
+
+/// At least two dot-separated labels of letters, digits and inner hyphens,
+/// ending in an alphabetic TLD
+pub fn is_valid_domain(domain: &str) -> bool {
+    let labels: Vec<&str> = domain.split('.').collect();
+    let labels_ok = labels.len() >= 2
+        && labels.iter().all(|label| {
+            !label.is_empty()
+                && label.len() <= MAX_LABEL_LENGTH
+                && !label.starts_with('-')
+                && !label.ends_with('-')
+                && label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+        });
+
+    labels_ok
+        && labels
+            .last()
+            .is_some_and(|tld| tld.len() >= 2 && tld.chars().all(|c| c.is_ascii_alphabetic()))
+}
+
+fn domain_matches(domain: &str, allowed: &str) -> bool {
+    let domain = domain.to_lowercase();
+    domain == allowed || domain.ends_with(&format!(".{}", allowed))
+}
+
+/// Whether the domain has a mail server: an MX record other than the null MX
+/// (RFC 7505), or failing that an address record (implicit MX). Resolver
+/// errors count as yes so an unreachable DNS server doesn't block sign-ups.
+async fn accepts_mail(domain: &str) -> bool {
+    let Ok(resolver) = TokioAsyncResolver::tokio_from_system_conf() else {
+        tracing::warn!("No DNS resolver configuration; skipping MX check");
+        return true;
+    };
+
+    // Trailing dot: don't try the domain against local search suffixes
+    let name = format!("{}.", domain);
+    match resolver.mx_lookup(name.as_str()).await {
+        Ok(mx) => mx.iter().any(|record| !record.exchange().is_root()),
+        Err(e) if matches!(e.kind(), ResolveErrorKind::NoRecordsFound { .. }) => {
+            match resolver.lookup_ip(name.as_str()).await {
+                Ok(ips) => ips.iter().next().is_some(),
+                Err(e) => !matches!(e.kind(), ResolveErrorKind::NoRecordsFound { .. }),
+            }
+        }
+        Err(e) => {
+            tracing::warn!("MX lookup for {} failed: {}", domain, e);
+            true
+        }
+    }
+}
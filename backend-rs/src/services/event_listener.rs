@@ -0,0 +1,120 @@
+//! Wake-ups for long polls and SSE streams. One Redis pub/sub connection per
+//! process listens on every user's channel and wakes whoever is waiting on
+//! that user, instead of each request opening its own connection. Waiters
+//! still read their events from the outbox; a wake-up only says there may be
+//! something new.
+
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use futures_util::StreamExt;
+use tokio::sync::watch;
+use uuid::Uuid;
+
+use crate::storage::redis::RedisClient;
+
+const RECONNECT_DELAY: Duration = Duration::from_secs(1);
+
+pub struct EventListener {
+    redis: RedisClient,
+    /// Waiting users. A std mutex so `Wakeup` can release on drop.
+    waiters: Mutex<HashMap<Uuid, watch::Sender<()>>>,
+}
+
+impl EventListener {
+    pub fn new(redis: RedisClient) -> Self {
+        Self {
+            redis,
+            waiters: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Start listening for `user_id`. Anything published after this returns
+    /// wakes the `Wakeup`, so subscribe before reading the outbox.
+    pub fn subscribe(self: &Arc<Self>, user_id: Uuid) -> Wakeup {
+        let mut waiters = self.waiters.lock().unwrap();
+        let receiver = waiters
+            .entry(user_id)
+            .or_insert_with(|| watch::channel(()).0)
+            .subscribe();
+
+        Wakeup {
+            listener: self.clone(),
+            user_id,
+            receiver,
+        }
+    }
+
+    /// Hold the subscription, reconnecting when Redis drops it
+    pub async fn run(&self) {
+        loop {
+            match self.redis.subscribe_all_messages().await {
+                Ok(mut pubsub) => {
+                    let mut messages = pubsub.on_message();
+                    while let Some(msg) = messages.next().await {
+                        let user_id = self
+                            .redis
+                            .message_channel_user(msg.get_channel_name())
+                            .and_then(|id| Uuid::parse_str(id).ok());
+                        if let Some(user_id) = user_id {
+                            self.wake(Some(user_id));
+                        }
+                    }
+                    tracing::warn!("Realtime event listener lost its Redis subscription");
+                }
+                Err(e) => tracing::warn!("Realtime event listener failed to subscribe: {}", e),
+            }
+
+            // Anything published while disconnected was missed; let every
+            // waiter re-read the outbox
+            self.wake(None);
+            tokio::time::sleep(RECONNECT_DELAY).await;
+        }
+    }
+
+    /// Wake `user_id`'s waiters, or everyone's
+    fn wake(&self, user_id: Option<Uuid>) {
+        let waiters = self.waiters.lock().unwrap();
+        match user_id {
+            Some(user_id) => {
+                if let Some(sender) = waiters.get(&user_id) {
+                    sender.send_replace(());
+                }
+            }
+            None => waiters.values().for_each(|sender| {
+                sender.send_replace(());
+            }),
+        }
+    }
+}
+
+/// A user's registration with the `EventListener`; released when dropped
+pub struct Wakeup {
+    listener: Arc<EventListener>,
+    user_id: Uuid,
+    receiver: watch::Receiver<()>,
+}
+
+impl Wakeup {
+    /// Wait for something to be published to the user since the last wait,
+    /// or since subscribing
+    pub async fn wait(&mut self) {
+        let _ = self.receiver.changed().await;
+    }
+}
+
+impl Drop for Wakeup {
+    fn drop(&mut self) {
+        let mut waiters = self.listener.waiters.lock().unwrap();
+        // Our own receiver is still alive, so 1 means nobody else is waiting
+        let unused = waiters
+            .get(&self.user_id)
+            .is_some_and(|sender| sender.receiver_count() <= 1);
+        if unused {
+            waiters.remove(&self.user_id);
+        }
+    }
+}
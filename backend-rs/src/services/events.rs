@@ -0,0 +1,88 @@
+use sqlx::{PgConnection, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::ConversationEvent,
+};
+
+pub struct EventsService {
+    db: PgPool,
+}
+
+impl EventsService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Append an event to a conversation's log, returning its sequence number.
+    /// Must run inside the transaction making the change; the counter row lock
+    /// serializes writers so sequence numbers are gap-free and ordered.
+    pub async fn append(
+        conn: &mut PgConnection,
+        conversation_id: Uuid,
+        actor_id: Option<Uuid>,
+        event_type: &str,
+        payload: serde_json::Value,
+    ) -> AppResult<i64> {
+        let seq: i64 = sqlx::query_scalar(
+            "UPDATE conversations SET event_seq = event_seq + 1 WHERE id = $1 RETURNING event_seq",
+        )
+        .bind(conversation_id)
+        .fetch_one(&mut *conn)
+        .await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO conversation_events (conversation_id, seq, event_type, actor_id, payload)
+            VALUES ($1, $2, $3, $4, $5)
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(seq)
+        .bind(event_type)
+        .bind(actor_id)
+        .bind(payload)
+        .execute(&mut *conn)
+        .await?;
+
+        Ok(seq)
+    }
+
+    /// List events after `since`, oldest first
+    pub async fn list_events(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        since: i64,
+        limit: i64,
+    ) -> AppResult<Vec<ConversationEvent>> {
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        let events: Vec<ConversationEvent> = sqlx::query_as(
+            r#"
+            SELECT * FROM conversation_events
+            WHERE conversation_id = $1 AND seq > $2
+            ORDER BY seq ASC
+            LIMIT $3
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(since)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(events)
+    }
+}
@@ -0,0 +1,799 @@
+use std::{collections::HashMap, io, path::Path};
+
+use async_trait::async_trait;
+use chrono::{DateTime, FixedOffset, Utc};
+use serde::Serialize;
+use serde_json::{json, Value};
+use sqlx::{types::Json, PgPool};
+use tokio::{
+    fs::File,
+    io::{AsyncWriteExt, BufWriter},
+};
+use uuid::Uuid;
+use zip::{write::SimpleFileOptions, CompressionMethod, ZipWriter};
+
+use crate::{
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        Conversation, ConversationExport, ConversationExportWithUrl, ExportConversationRequest,
+        ExportFormat, ExportStatus, Message, MessageType,
+    },
+    services::{archives::ArchiveService, attachments::AttachmentsService},
+    storage::minio::MinioClient,
+};
+
+const EXPORT_BATCH_SIZE: i64 = 500;
+/// What the requester sees when an export fails; the cause is only logged
+const EXPORT_FAILED_MESSAGE: &str = "The export could not be generated";
+/// Where the transcript goes in a JSON export's zip
+const TRANSCRIPT_ENTRY: &str = "export.json";
+/// Furthest real time zones from UTC
+const MAX_UTC_OFFSET_MINUTES: i32 = 14 * 60;
+
+pub const EXPORT_JOB_KIND: &str = "conversation_export";
+
+/// Export requests carry the client's decrypted history, so they may exceed
+/// the default body limit
+pub const EXPORT_MAX_REQUEST_SIZE: usize = 32 * 1024 * 1024;
+
+pub struct ExportsService {
+    db: PgPool,
+    minio: MinioClient,
+    jobs: JobQueue,
+}
+
+impl ExportsService {
+    pub fn new(db: PgPool, minio: MinioClient, jobs: JobQueue) -> Self {
+        Self { db, minio, jobs }
+    }
+
+    /// Request a transcript export; the archive is generated in the background.
+    /// The server only holds ciphertext, so message text is included only
+    /// where the client supplies it in `req.plaintext`.
+    pub async fn request_export(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        req: &ExportConversationRequest,
+    ) -> AppResult<ConversationExport> {
+        if req.utc_offset_minutes.abs() > MAX_UTC_OFFSET_MINUTES {
+            return Err(AppError::Validation(
+                "utc_offset_minutes must be between -840 and 840".to_string(),
+            ));
+        }
+
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        let export: ConversationExport = sqlx::query_as(
+            r#"
+            INSERT INTO conversation_exports
+                (id, conversation_id, requested_by, status, format, utc_offset_minutes, plaintext, progress)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, 0)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(ExportStatus::Pending)
+        .bind(req.format)
+        .bind(req.utc_offset_minutes)
+        .bind((!req.plaintext.is_empty()).then(|| Json(&req.plaintext)))
+        .fetch_one(&self.db)
+        .await?;
+
+        self.jobs
+            .enqueue(EXPORT_JOB_KIND, json!({ "export_id": export.id }))
+            .await?;
+
+        Ok(export)
+    }
+
+    /// Build the archive for a queued export, including history moved to the
+    /// archive tier. On the final attempt a failure is recorded on the export;
+    /// earlier failures leave it pending for retry.
+    pub async fn process_export(
+        &self,
+        export_id: Uuid,
+        final_attempt: bool,
+        archives: &ArchiveService,
+        attachments: &AttachmentsService,
+    ) -> AppResult<()> {
+        let export: Option<ConversationExport> =
+            sqlx::query_as("SELECT * FROM conversation_exports WHERE id = $1")
+                .bind(export_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        let export = export.ok_or(AppError::ExportNotFound)?;
+
+        if matches!(export.status, ExportStatus::Completed | ExportStatus::Failed) {
+            return Ok(());
+        }
+
+        if let Err(e) = self.run_export(&export, archives, attachments).await {
+            tracing::error!("Export {} failed: {}", export.id, e);
+
+            let (status, error) = if final_attempt {
+                (ExportStatus::Failed, Some(EXPORT_FAILED_MESSAGE))
+            } else {
+                (ExportStatus::Pending, None)
+            };
+
+            sqlx::query(
+                r#"
+                UPDATE conversation_exports
+                SET status = $1, error = $2,
+                    completed_at = CASE WHEN $1 = 'failed'::export_status THEN NOW() END,
+                    plaintext = CASE WHEN $1 = 'failed'::export_status THEN NULL ELSE plaintext END
+                WHERE id = $3
+                "#,
+            )
+            .bind(status)
+            .bind(error)
+            .bind(export.id)
+            .execute(&self.db)
+            .await?;
+
+            return Err(e);
+        }
+
+        Ok(())
+    }
+
+    /// Get export status, with a presigned download URL once completed
+    pub async fn get_export(
+        &self,
+        conversation_id: Uuid,
+        export_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ConversationExportWithUrl> {
+        let export: Option<ConversationExport> = sqlx::query_as(
+            "SELECT * FROM conversation_exports WHERE id = $1 AND conversation_id = $2 AND requested_by = $3",
+        )
+        .bind(export_id)
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let export = export.ok_or(AppError::ExportNotFound)?;
+
+        let download_url = match (&export.status, &export.object_key) {
+            (ExportStatus::Completed, Some(key)) => Some(
+                self.minio
+                    .presigned_url(self.minio.exports_bucket(), key)
+                    .await?,
+            ),
+            _ => None,
+        };
+
+        Ok(ConversationExportWithUrl {
+            export,
+            download_url,
+        })
+    }
+
+    /// Write the export to a temporary directory a batch at a time, then
+    /// upload it
+    async fn run_export(
+        &self,
+        export: &ConversationExport,
+        archives: &ArchiveService,
+        attachments: &AttachmentsService,
+    ) -> AppResult<()> {
+        let dir = std::env::temp_dir().join(format!("ansible-talk-export-{}", export.id));
+        tokio::fs::create_dir_all(&dir)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to create export directory: {}", e))?;
+        let result = self.build_export(export, archives, attachments, &dir).await;
+        let _ = tokio::fs::remove_dir_all(&dir).await;
+
+        result
+    }
+
+    async fn build_export(
+        &self,
+        export: &ConversationExport,
+        archives: &ArchiveService,
+        attachments: &AttachmentsService,
+        dir: &Path,
+    ) -> AppResult<()> {
+        sqlx::query("UPDATE conversation_exports SET status = $1 WHERE id = $2")
+            .bind(ExportStatus::Processing)
+            .bind(export.id)
+            .execute(&self.db)
+            .await?;
+
+        let conversation: Option<Conversation> =
+            sqlx::query_as("SELECT * FROM conversations WHERE id = $1")
+                .bind(export.conversation_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        let conversation = conversation.ok_or(AppError::ConversationNotFound)?;
+
+        // Only messages sent while the requester was a participant are accessible
+        let joined_at: Option<DateTime<Utc>> = sqlx::query_scalar(
+            "SELECT joined_at FROM participants WHERE conversation_id = $1 AND user_id = $2",
+        )
+        .bind(export.conversation_id)
+        .bind(export.requested_by)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let joined_at = joined_at.ok_or(AppError::NotParticipant)?;
+
+        // Older history may have moved to the archive tier. Archive counts
+        // include deleted messages, so they only estimate progress.
+        let archived = archives
+            .objects_since(export.conversation_id, joined_at)
+            .await?;
+        let archived_total: i64 = archived.iter().map(|(_, count)| *count as i64).sum();
+
+        let live_total: i64 = sqlx::query_scalar(
+            r#"
+            SELECT COUNT(*) FROM messages
+            WHERE conversation_id = $1 AND created_at >= $2 AND deleted_at IS NULL
+            AND (shadow_limited = FALSE OR sender_id = $3)
+            "#,
+        )
+        .bind(export.conversation_id)
+        .bind(joined_at)
+        .bind(export.requested_by)
+        .fetch_one(&self.db)
+        .await?;
+        let total = archived_total + live_total;
+
+        let plaintext: Option<Json<HashMap<Uuid, String>>> =
+            sqlx::query_scalar("SELECT plaintext FROM conversation_exports WHERE id = $1")
+                .bind(export.id)
+                .fetch_one(&self.db)
+                .await?;
+        let plaintext = plaintext.map(|p| p.0).unwrap_or_default();
+
+        let transcript = dir.join("transcript");
+        let mut writer =
+            ExportWriter::create(&transcript, export, &conversation, plaintext).await?;
+        let mut names = HashMap::new();
+        let mut done: i64 = 0;
+
+        for (object_key, count) in &archived {
+            let batch = archives
+                .load_since(object_key, export.requested_by, joined_at)
+                .await?;
+            self.add_sender_names(export.format, &batch, &mut names)
+                .await?;
+            writer.write_messages(&batch, &names).await?;
+
+            done += *count as i64;
+            self.set_progress(export.id, done, total).await?;
+        }
+
+        // Keyset paging, so each batch starts where the last one ended
+        let mut after: Option<(DateTime<Utc>, Uuid)> = None;
+        loop {
+            let batch: Vec<Message> = sqlx::query_as(
+                r#"
+                SELECT * FROM messages
+                WHERE conversation_id = $1 AND created_at >= $2 AND deleted_at IS NULL
+                AND (shadow_limited = FALSE OR sender_id = $3)
+                AND ($4::timestamptz IS NULL OR (created_at, id) > ($4, $5))
+                ORDER BY created_at ASC, id ASC
+                LIMIT $6
+                "#,
+            )
+            .bind(export.conversation_id)
+            .bind(joined_at)
+            .bind(export.requested_by)
+            .bind(after.map(|(created_at, _)| created_at))
+            .bind(after.map(|(_, id)| id))
+            .bind(EXPORT_BATCH_SIZE)
+            .fetch_all(&self.db)
+            .await?;
+
+            let Some(last) = batch.last() else {
+                break;
+            };
+            after = Some((last.created_at, last.id));
+
+            self.add_sender_names(export.format, &batch, &mut names)
+                .await?;
+            writer.write_messages(&batch, &names).await?;
+
+            done += batch.len() as i64;
+            self.set_progress(export.id, done, total).await?;
+        }
+
+        let (path, extension, content_type) = match export.format {
+            // The transcript goes into a zip with the attachments the
+            // requester can download
+            ExportFormat::Json => {
+                let path = dir.join("export.zip");
+                let mut archive = ExportArchive::create(&path).await?;
+                let listed = self
+                    .archive_attachments(
+                        export,
+                        joined_at,
+                        attachments,
+                        &mut archive,
+                        &dir.join("attachment"),
+                    )
+                    .await?;
+                writer.finish(&listed).await?;
+                archive
+                    .add_file(TRANSCRIPT_ENTRY, &transcript, CompressionMethod::Deflated)
+                    .await?;
+                archive.finish().await?;
+                (path, "zip", "application/zip")
+            }
+            ExportFormat::Whatsapp => {
+                writer.finish(&[]).await?;
+                (transcript, "txt", "text/plain; charset=utf-8")
+            }
+        };
+
+        let key = format!(
+            "conversations/{}/{}.{}",
+            export.conversation_id, export.id, extension
+        );
+        self.minio
+            .upload_private_path(self.minio.exports_bucket(), &key, &path, content_type)
+            .await?;
+
+        sqlx::query(
+            "UPDATE conversation_exports SET status = $1, progress = 100, object_key = $2, plaintext = NULL, completed_at = NOW() WHERE id = $3",
+        )
+        .bind(ExportStatus::Completed)
+        .bind(&key)
+        .bind(export.id)
+        .execute(&self.db)
+        .await?;
+
+        tracing::info!("Export {} completed ({} messages)", export.id, total);
+
+        Ok(())
+    }
+
+    async fn set_progress(&self, export_id: Uuid, done: i64, total: i64) -> AppResult<()> {
+        let progress = if total > 0 {
+            (done * 100 / total).min(99) as i32
+        } else {
+            99
+        };
+        sqlx::query("UPDATE conversation_exports SET progress = $1 WHERE id = $2")
+            .bind(progress)
+            .bind(export_id)
+            .execute(&self.db)
+            .await?;
+
+        Ok(())
+    }
+
+    /// Add the display names of senders in `messages` not yet in `names`.
+    /// Only transcripts show names.
+    async fn add_sender_names(
+        &self,
+        format: ExportFormat,
+        messages: &[Message],
+        names: &mut HashMap<Uuid, String>,
+    ) -> AppResult<()> {
+        if format != ExportFormat::Whatsapp {
+            return Ok(());
+        }
+
+        let mut sender_ids: Vec<Uuid> = messages
+            .iter()
+            .map(|m| m.sender_id)
+            .filter(|id| !names.contains_key(id))
+            .collect();
+        sender_ids.sort();
+        sender_ids.dedup();
+        if sender_ids.is_empty() {
+            return Ok(());
+        }
+
+        let found: Vec<(Uuid, String)> =
+            sqlx::query_as("SELECT id, display_name FROM users WHERE id = ANY($1)")
+                .bind(&sender_ids)
+                .fetch_all(&self.db)
+                .await?;
+        names.extend(found);
+
+        Ok(())
+    }
+
+    /// Copy the attachments shared in the conversation since `since` into
+    /// `archive`, one at a time through the file at `scratch`. Only those the
+    /// requester can download through the attachments API are included, with
+    /// the same check; those whose objects have since been purged are listed
+    /// as missing.
+    async fn archive_attachments(
+        &self,
+        export: &ConversationExport,
+        since: DateTime<Utc>,
+        attachments: &AttachmentsService,
+        archive: &mut ExportArchive,
+        scratch: &Path,
+    ) -> AppResult<Vec<AttachmentRef>> {
+        let shared = self.attachment_refs(export.conversation_id, since).await?;
+
+        let mut listed = Vec::with_capacity(shared.len());
+        for mut attachment in shared {
+            let object_key = match attachments
+                .accessible_object(export.requested_by, attachment.id)
+                .await
+            {
+                Ok((object_key, _)) => object_key,
+                Err(AppError::AttachmentNotFound) => continue,
+                Err(e) => return Err(e),
+            };
+
+            let found = self
+                .minio
+                .download_to_path(self.minio.attachments_bucket(), &object_key, scratch)
+                .await?;
+            if found {
+                let entry = format!("attachments/{}", attachment.id);
+                // Attachments are encrypted, so compressing them gains nothing
+                archive
+                    .add_file(&entry, scratch, CompressionMethod::Stored)
+                    .await?;
+                attachment.file = Some(entry);
+            } else {
+                attachment.missing = true;
+            }
+            listed.push(attachment);
+        }
+
+        Ok(listed)
+    }
+
+    /// Attachments shared in the conversation since `since`, with the type
+    /// of the variant the attachments API serves
+    async fn attachment_refs(
+        &self,
+        conversation_id: Uuid,
+        since: DateTime<Utc>,
+    ) -> AppResult<Vec<AttachmentRef>> {
+        let attachments: Vec<AttachmentRef> = sqlx::query_as(
+            r#"
+            SELECT a.id,
+                   CASE WHEN a.transcoded_key IS NOT NULL
+                       THEN COALESCE(a.transcoded_content_type, a.content_type)
+                       ELSE a.content_type
+                   END AS content_type,
+                   a.size_bytes, ac.created_at AS shared_at
+            FROM attachment_conversations ac
+            JOIN attachments a ON a.id = ac.attachment_id
+            WHERE ac.conversation_id = $1 AND ac.created_at >= $2
+            ORDER BY ac.created_at ASC
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(since)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(attachments)
+    }
+}
+
+/// An attachment listed in a JSON export
+#[derive(Debug, Serialize, sqlx::FromRow)]
+struct AttachmentRef {
+    id: Uuid,
+    content_type: String,
+    size_bytes: i64,
+    shared_at: DateTime<Utc>,
+    /// Where the content is in the zip
+    #[sqlx(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    file: Option<String>,
+    /// The object was purged from storage, so there is no content to include
+    #[sqlx(default)]
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    missing: bool,
+}
+
+/// The zip of a JSON export. Entries are copied in from files on disk on the
+/// blocking pool, so neither the archive nor an entry is held in memory.
+struct ExportArchive {
+    /// Taken while a blocking task writes to it
+    zip: Option<ZipWriter<std::fs::File>>,
+}
+
+impl ExportArchive {
+    async fn create(path: &Path) -> AppResult<Self> {
+        let file = File::create(path)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to create export archive: {}", e))?;
+
+        Ok(Self {
+            zip: Some(ZipWriter::new(file.into_std().await)),
+        })
+    }
+
+    /// Copy the file at `source` into the archive as `name`
+    async fn add_file(
+        &mut self,
+        name: &str,
+        source: &Path,
+        compression: CompressionMethod,
+    ) -> AppResult<()> {
+        let mut zip = self
+            .zip
+            .take()
+            .ok_or_else(|| anyhow::anyhow!("Export archive is closed"))?;
+        let name = name.to_string();
+        let source = source.to_path_buf();
+
+        let (zip, result) = tokio::task::spawn_blocking(move || {
+            let result = copy_entry(&mut zip, name, &source, compression);
+            (zip, result)
+        })
+        .await
+        .map_err(|e| anyhow::anyhow!("Export archive task failed: {}", e))?;
+        self.zip = Some(zip);
+
+        result.map_err(|e| anyhow::anyhow!("Failed to write export archive: {}", e))?;
+        Ok(())
+    }
+
+    /// Write the central directory and close the file
+    async fn finish(mut self) -> AppResult<()> {
+        let zip = self
+            .zip
+            .take()
+            .ok_or_else(|| anyhow::anyhow!("Export archive is closed"))?;
+
+        tokio::task::spawn_blocking(move || zip.finish())
+            .await
+            .map_err(|e| anyhow::anyhow!("Export archive task failed: {}", e))?
+            .map_err(|e| anyhow::anyhow!("Failed to write export archive: {}", e))?;
+
+        Ok(())
+    }
+}
+
+fn copy_entry(
+    zip: &mut ZipWriter<std::fs::File>,
+    name: String,
+    source: &Path,
+    compression: CompressionMethod,
+) -> anyhow::Result<()> {
+    let mut file = std::fs::File::open(source)?;
+    let options = SimpleFileOptions::default()
+        .compression_method(compression)
+        .large_file(file.metadata()?.len() >= u32::MAX as u64);
+    zip.start_file(name, options)?;
+    io::copy(&mut file, zip)?;
+
+    Ok(())
+}
+
+/// An export being written to disk, so the history is never held in memory
+/// all at once. A JSON export is one object whose `messages` array is
+/// appended to batch by batch.
+struct ExportWriter {
+    file: BufWriter<File>,
+    format: ExportFormat,
+    offset: FixedOffset,
+    plaintext: HashMap<Uuid, String>,
+    /// Messages written so far, for separating JSON entries
+    written: usize,
+}
+
+impl ExportWriter {
+    async fn create(
+        path: &Path,
+        export: &ConversationExport,
+        conversation: &Conversation,
+        plaintext: HashMap<Uuid, String>,
+    ) -> AppResult<Self> {
+        let offset = FixedOffset::east_opt(export.utc_offset_minutes * 60)
+            .ok_or_else(|| anyhow::anyhow!("Invalid UTC offset"))?;
+        let file = File::create(path)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to create export file: {}", e))?;
+        let mut writer = Self {
+            file: BufWriter::new(file),
+            format: export.format,
+            offset,
+            plaintext,
+            written: 0,
+        };
+
+        if writer.format == ExportFormat::Json {
+            let header = json!({
+                "export_id": export.id,
+                "exported_by": export.requested_by,
+                "exported_at": Utc::now(),
+                "conversation": {
+                    "id": conversation.id,
+                    "type": conversation.conversation_type,
+                    "name": conversation.name,
+                    "created_at": conversation.created_at,
+                },
+            });
+            // Reopen the object to append the message list
+            let mut header = header.to_string();
+            header.pop();
+            header.push_str(",\"messages\":[");
+            writer.write(header.as_bytes()).await?;
+        }
+
+        Ok(writer)
+    }
+
+    async fn write_messages(
+        &mut self,
+        messages: &[Message],
+        names: &HashMap<Uuid, String>,
+    ) -> AppResult<()> {
+        for message in messages {
+            match self.format {
+                ExportFormat::Json => {
+                    let entry = message_entry(message, &self.plaintext).to_string();
+                    if self.written > 0 {
+                        self.write(b",").await?;
+                    }
+                    self.write(entry.as_bytes()).await?;
+                }
+                ExportFormat::Whatsapp => {
+                    let line = whatsapp_line(message, &self.plaintext, names, self.offset);
+                    if let Some(line) = line {
+                        self.write(line.as_bytes()).await?;
+                        self.write(b"\n").await?;
+                    }
+                }
+            }
+            self.written += 1;
+        }
+
+        Ok(())
+    }
+
+    /// Close the JSON object with the attachment list and flush to disk
+    async fn finish(mut self, attachments: &[AttachmentRef]) -> AppResult<()> {
+        if self.format == ExportFormat::Json {
+            let attachments = serde_json::to_string(attachments)
+                .map_err(|e| anyhow::anyhow!("Failed to serialize export: {}", e))?;
+            self.write(format!("],\"attachments\":{}}}", attachments).as_bytes())
+                .await?;
+        }
+
+        self.file
+            .flush()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to write export file: {}", e))?;
+
+        Ok(())
+    }
+
+    async fn write(&mut self, data: &[u8]) -> AppResult<()> {
+        self.file
+            .write_all(data)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to write export file: {}", e))?;
+
+        Ok(())
+    }
+}
+
+/// A message's entry in the JSON export. Attachment content is in the zip
+/// next to the transcript; `attachments` lists what was shared.
+fn message_entry(message: &Message, plaintext: &HashMap<Uuid, String>) -> Value {
+    json!({
+        "id": message.id,
+        "sender_id": message.sender_id,
+        "type": message.message_type,
+        "status": message.status,
+        "sticker_id": message.sticker_id,
+        "reply_to_id": message.reply_to_id,
+        "text": plaintext.get(&message.id),
+        "content_size": message.content.len(),
+        "edited_at": message.edited_at,
+        "created_at": message.created_at,
+    })
+}
+
+/// A message's entry in the layout of WhatsApp's "Export chat" (Android,
+/// without media): `dd/mm/yyyy, HH:MM - Sender: text`, with continuation
+/// lines left as they are. System messages have no sender and are only
+/// included when the client supplied their rendered text.
+fn whatsapp_line(
+    message: &Message,
+    plaintext: &HashMap<Uuid, String>,
+    names: &HashMap<Uuid, String>,
+    offset: FixedOffset,
+) -> Option<String> {
+    let timestamp = message
+        .created_at
+        .with_timezone(&offset)
+        .format("%d/%m/%Y, %H:%M");
+    let text = plaintext.get(&message.id).map(|t| t.trim_end());
+
+    match (message.message_type, text) {
+        (MessageType::System, Some(text)) => Some(format!("{} - {}", timestamp, text)),
+        (MessageType::System, None) => None,
+        (message_type, text) => {
+            let sender = names
+                .get(&message.sender_id)
+                .map(String::as_str)
+                .unwrap_or("Unknown");
+            let body = match (message_type, text) {
+                (MessageType::Text, Some(text)) => text.to_string(),
+                (MessageType::Text, None) => "<Message not decrypted>".to_string(),
+                // A caption goes on the line after the placeholder
+                (_, Some(caption)) if !caption.is_empty() => {
+                    format!("<Media omitted>\n{}", caption)
+                }
+                _ => "<Media omitted>".to_string(),
+            };
+            let edited = if message.edited_at.is_some() {
+                " <This message was edited>"
+            } else {
+                ""
+            };
+            Some(format!("{} - {}: {}{}", timestamp, sender, body, edited))
+        }
+    }
+}
+
+/// Job handler that builds queued conversation exports
+pub struct ExportJob {
+    exports: ExportsService,
+    archives: ArchiveService,
+    attachments: AttachmentsService,
+}
+
+impl ExportJob {
+    pub fn new(
+        exports: ExportsService,
+        archives: ArchiveService,
+        attachments: AttachmentsService,
+    ) -> Self {
+        Self {
+            exports,
+            archives,
+            attachments,
+        }
+    }
+}
+
+#[async_trait]
+impl JobHandler for ExportJob {
+    fn kind(&self) -> &'static str {
+        EXPORT_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let export_id = job
+            .payload
+            .get("export_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Export job is missing export_id"))?;
+
+        self.exports
+            .process_export(
+                export_id,
+                job.is_final_attempt(),
+                &self.archives,
+                &self.attachments,
+            )
+            .await
+    }
+}
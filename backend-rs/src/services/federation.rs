@@ -0,0 +1,764 @@
+use std::{
+    net::{IpAddr, SocketAddr},
+    time::Duration,
+};
+
+use async_trait::async_trait;
+use base64::{
+    engine::general_purpose::{STANDARD, URL_SAFE_NO_PAD},
+    Engine,
+};
+use chrono::{DateTime, Utc};
+use hickory_resolver::TokioAsyncResolver;
+use jsonwebtoken::{decode, decode_header, Algorithm, DecodingKey, Validation};
+use serde::{Deserialize, Serialize};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::FederationConfig,
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        FederatedMessage, FederationDirection, FederationDocument, FederationEnvelope,
+        FederationStatus, InboundEnvelope, MessageRequestStatus, MessageType,
+        SendFederatedMessageRequest, WS_FEDERATED_MESSAGE,
+    },
+    services::{
+        email_validation::is_valid_domain,
+        outbox::OutboxService,
+        spam::{SpamAction, SpamService},
+    },
+    storage::redis::RedisClient,
+};
+
+pub const FEDERATION_JOB_KIND: &str = "federation_delivery";
+/// Where every server publishes its `FederationDocument`
+pub const WELL_KNOWN_PATH: &str = "/.well-known/ansible-talk/federation";
+const INBOX_PATH: &str = "/api/v1/federation/inbox";
+/// DNS SRV service name pointing a domain at the host that serves it
+const SRV_SERVICE: &str = "_ansible-talk._tcp";
+const PEER_CACHE_TTL: Duration = Duration::from_secs(10 * 60);
+/// How long a failed discovery is remembered before the domain is tried again
+const DISCOVERY_FAILURE_TTL: Duration = Duration::from_secs(60);
+/// At most one forced rediscovery per domain in this interval
+const REFRESH_INTERVAL: Duration = Duration::from_secs(60);
+const INBOX_RATE_WINDOW: Duration = Duration::from_secs(60);
+const PEER_TIMEOUT: Duration = Duration::from_secs(10);
+const MAX_DOCUMENT_SIZE: usize = 64 * 1024;
+const CLOCK_SKEW_SECONDS: u64 = 60;
+const MAX_CONTENT_SIZE: usize = 64 * 1024;
+const MAX_ADDRESS_LENGTH: usize = 320;
+const DEFAULT_LIST_LIMIT: i64 = 50;
+const MAX_LIST_LIMIT: i64 = 200;
+
+/// A remote server: the host and port it was discovered at and what it
+/// published there
+#[derive(Debug, Serialize, Deserialize)]
+struct Peer {
+    host: String,
+    port: u16,
+    document: FederationDocument,
+}
+
+impl Peer {
+    fn url(&self, path: &str) -> String {
+        format!("https://{}:{}{}", self.host, self.port, path)
+    }
+}
+
+/// Experimental server-to-server relay. Messages to `username@otherdomain`
+/// are wrapped in an envelope signed with this server's federation key and
+/// posted to the other server's inbox, found through DNS SRV or the domain
+/// itself and its `.well-known` document. Only publicly routable addresses
+/// are contacted. Inbound envelopes are checked against the sending
+/// domain's published keys, then go through the recipient's blocks,
+/// message requests and spam policy like messages from local senders.
+/// Content stays end-to-end encrypted and is passed through untouched.
+pub struct FederationService {
+    db: PgPool,
+    redis: RedisClient,
+    config: FederationConfig,
+    jobs: JobQueue,
+}
+
+impl FederationService {
+    pub fn new(db: PgPool, redis: RedisClient, config: FederationConfig, jobs: JobQueue) -> Self {
+        Self {
+            db,
+            redis,
+            config,
+            jobs,
+        }
+    }
+
+    /// This server's `.well-known` document
+    pub fn document(&self) -> FederationDocument {
+        let jwks = self.config.keys.jwks();
+
+        FederationDocument {
+            domain: self.config.domain.clone(),
+            inbox: INBOX_PATH.to_string(),
+            keys: jwks["keys"].as_array().cloned().unwrap_or_default(),
+        }
+    }
+
+    /// Queue a message to a user on another server
+    pub async fn send(
+        &self,
+        user_id: Uuid,
+        req: SendFederatedMessageRequest,
+    ) -> AppResult<FederatedMessage> {
+        let to = req.to.trim().to_lowercase();
+        let (_, domain) = parse_address(&to)
+            .ok_or_else(|| AppError::Validation("Recipient must be username@domain".to_string()))?;
+        if domain == self.config.domain {
+            return Err(AppError::Validation(
+                "Users on this server are reached through conversations".to_string(),
+            ));
+        }
+        if !self.config.allows(domain) {
+            return Err(AppError::FederationDomainBlocked(domain.to_string()));
+        }
+        if req.message_type == MessageType::System {
+            return Err(AppError::Validation(
+                "System messages are generated by the server".to_string(),
+            ));
+        }
+        if req.content.is_empty() || req.content.len() > MAX_CONTENT_SIZE {
+            return Err(AppError::Validation(format!(
+                "Content must be between 1 and {} bytes",
+                MAX_CONTENT_SIZE
+            )));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let message: FederatedMessage = sqlx::query_as(
+            r#"
+            INSERT INTO federated_messages (id, direction, user_id, remote_address, type, content)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(FederationDirection::Outbound)
+        .bind(user_id)
+        .bind(&to)
+        .bind(req.message_type)
+        .bind(&req.content)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        // Replying to a message request accepts it
+        sqlx::query(
+            "UPDATE federated_messages SET request_status = 'accepted' WHERE user_id = $1 AND remote_address = $2 AND request_status = 'pending'",
+        )
+        .bind(user_id)
+        .bind(&to)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.jobs
+            .enqueue(
+                FEDERATION_JOB_KIND,
+                serde_json::json!({ "message_id": message.id }),
+            )
+            .await?;
+
+        Ok(message)
+    }
+
+    /// The user's federated messages, newest first
+    pub async fn list(
+        &self,
+        user_id: Uuid,
+        with: Option<&str>,
+        before: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<FederatedMessage>> {
+        let limit = limit.unwrap_or(DEFAULT_LIST_LIMIT).clamp(1, MAX_LIST_LIMIT);
+        let with = with.map(|w| w.trim().to_lowercase());
+
+        let messages: Vec<FederatedMessage> = sqlx::query_as(
+            r#"
+            SELECT * FROM federated_messages
+            WHERE user_id = $1 AND shadow_limited = FALSE
+              AND ($2::text IS NULL OR remote_address = $2)
+              AND ($3::timestamptz IS NULL OR created_at < $3)
+            ORDER BY created_at DESC
+            LIMIT $4
+            "#,
+        )
+        .bind(user_id)
+        .bind(with)
+        .bind(before)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(messages)
+    }
+
+    /// Deliver a queued outbound message (job)
+    pub async fn deliver(&self, message_id: Uuid, final_attempt: bool) -> AppResult<()> {
+        let message: Option<FederatedMessage> = sqlx::query_as(
+            "SELECT * FROM federated_messages WHERE id = $1 AND direction = 'outbound'",
+        )
+        .bind(message_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let Some(message) = message else {
+            return Ok(());
+        };
+        if message.status != FederationStatus::Pending {
+            return Ok(());
+        }
+
+        if let Err(e) = self.post_envelope(&message).await {
+            tracing::warn!(
+                "Federated delivery of {} to {} failed: {}",
+                message.id,
+                message.remote_address,
+                e
+            );
+
+            if final_attempt {
+                sqlx::query(
+                    "UPDATE federated_messages SET status = 'failed', error = $2 WHERE id = $1",
+                )
+                .bind(message.id)
+                .bind(e.to_string())
+                .execute(&self.db)
+                .await?;
+            }
+
+            return Err(e);
+        }
+
+        sqlx::query(
+            "UPDATE federated_messages SET status = 'delivered', delivered_at = NOW() WHERE id = $1",
+        )
+        .bind(message.id)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Accept a remote sender's message request; later messages from them
+    /// arrive as normal
+    pub async fn accept_sender(&self, user_id: Uuid, address: &str) -> AppResult<()> {
+        let result = sqlx::query(
+            "UPDATE federated_messages SET request_status = 'accepted' WHERE user_id = $1 AND remote_address = $2 AND request_status = 'pending'",
+        )
+        .bind(user_id)
+        .bind(address.trim().to_lowercase())
+        .execute(&self.db)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::MessageRequestNotFound);
+        }
+
+        Ok(())
+    }
+
+    /// Block a remote sender; their envelopes are still accepted but dropped
+    pub async fn block_sender(&self, user_id: Uuid, address: &str) -> AppResult<()> {
+        let address = address.trim().to_lowercase();
+        if parse_address(&address).is_none() {
+            return Err(AppError::Validation(
+                "Sender must be username@domain".to_string(),
+            ));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        sqlx::query(
+            "INSERT INTO federation_blocks (user_id, remote_address) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+        )
+        .bind(user_id)
+        .bind(&address)
+        .execute(&mut *tx)
+        .await?;
+
+        sqlx::query(
+            "UPDATE federated_messages SET request_status = 'blocked' WHERE user_id = $1 AND remote_address = $2 AND request_status = 'pending'",
+        )
+        .bind(user_id)
+        .bind(&address)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    /// Count an inbox request from `ip` against the per-minute limit
+    pub async fn check_inbox_rate(&self, ip: IpAddr) -> AppResult<()> {
+        let retry_after = self
+            .redis
+            .claim_federation_inbox_quota(
+                &ip.to_string(),
+                self.config.inbox_rate_limit,
+                INBOX_RATE_WINDOW,
+            )
+            .await?;
+
+        match retry_after {
+            Some(retry_after) => Err(AppError::RateLimited(retry_after)),
+            None => Ok(()),
+        }
+    }
+
+    /// Verify an envelope from another server and hand it to the recipient.
+    /// Returns the envelope id.
+    pub async fn receive(&self, envelope: &str) -> AppResult<Uuid> {
+        let header = decode_header(envelope).map_err(|_| invalid("Malformed envelope"))?;
+        if header.alg != Algorithm::EdDSA {
+            return Err(invalid("Envelopes must be signed with EdDSA"));
+        }
+        let kid = header.kid.ok_or_else(|| invalid("Envelope has no kid"))?;
+
+        // The issuer picks the keys to check against, so read it before
+        // the signature is verified
+        let origin = unverified_issuer(envelope)
+            .filter(|iss| is_valid_domain(iss))
+            .ok_or_else(|| invalid("Invalid issuer"))?;
+        if !self.config.allows(&origin) {
+            return Err(AppError::FederationDomainBlocked(origin));
+        }
+
+        // An unknown kid may be a key rotated in since the peer was cached.
+        // Refetch at most once per interval, so made-up kids can't make
+        // this server hammer the origin.
+        let key = match self.peer_key(&origin, &kid, false).await? {
+            Some(key) => Some(key),
+            None if self
+                .redis
+                .claim_federation_refresh(&origin, REFRESH_INTERVAL)
+                .await? =>
+            {
+                self.peer_key(&origin, &kid, true).await?
+            }
+            None => None,
+        }
+        .ok_or_else(|| invalid("Unknown signing key"))?;
+
+        let mut validation = Validation::new(Algorithm::EdDSA);
+        validation.set_audience(&[&self.config.domain]);
+        validation.set_issuer(&[&origin]);
+        validation.leeway = CLOCK_SKEW_SECONDS;
+        let envelope = decode::<FederationEnvelope>(envelope, &key, &validation)
+            .map_err(|e| invalid(&e.to_string()))?
+            .claims;
+
+        // Cap how long a captured envelope could be replayed for
+        if envelope.exp - envelope.iat > self.config.envelope_ttl.as_secs() as i64 {
+            return Err(invalid("Envelope lifetime is too long"));
+        }
+        let from = envelope.from.to_lowercase();
+        if parse_address(&from).map(|(_, domain)| domain) != Some(origin.as_str()) {
+            return Err(invalid("Sender is not on the signing server"));
+        }
+        let to = envelope.to.to_lowercase();
+        let username = match parse_address(&to) {
+            Some((username, domain)) if domain == self.config.domain => username,
+            _ => return Err(invalid("Recipient is not on this server")),
+        };
+        if envelope.message_type == MessageType::System {
+            return Err(invalid("System messages cannot be relayed"));
+        }
+        let content = STANDARD
+            .decode(&envelope.content)
+            .map_err(|_| invalid("Content is not valid base64"))?;
+        if content.is_empty() || content.len() > MAX_CONTENT_SIZE {
+            return Err(invalid("Content is empty or too large"));
+        }
+
+        let user_id: Option<Uuid> =
+            sqlx::query_scalar("SELECT id FROM users WHERE LOWER(username) = $1")
+                .bind(username)
+                .fetch_optional(&self.db)
+                .await?;
+        let user_id = user_id.ok_or(AppError::UserNotFound)?;
+
+        // A blocked sender's envelope is accepted and dropped, so the
+        // sender can't tell
+        let (blocked, known): (bool, bool) = sqlx::query_as(
+            r#"
+            SELECT EXISTS(SELECT 1 FROM federation_blocks WHERE user_id = $1 AND remote_address = $2),
+                   EXISTS(SELECT 1 FROM federated_messages
+                          WHERE user_id = $1 AND remote_address = $2
+                            AND COALESCE(request_status, 'accepted') = 'accepted')
+            "#,
+        )
+        .bind(user_id)
+        .bind(&from)
+        .fetch_one(&self.db)
+        .await?;
+        if blocked {
+            return Ok(envelope.jti);
+        }
+
+        let spam_action = SpamService::new(self.db.clone(), self.redis.clone())
+            .evaluate_remote(&from, user_id, &content)
+            .await?;
+        if let Some(SpamAction::Throttle { retry_after }) = spam_action {
+            return Err(AppError::RateLimited(retry_after));
+        }
+        let shadow_limited = spam_action == Some(SpamAction::ShadowLimit);
+
+        // Senders the recipient hasn't written to or accepted arrive as a
+        // message request
+        let request_status = (!known).then_some(MessageRequestStatus::Pending);
+
+        let mut tx = self.db.begin().await?;
+
+        let message: Option<FederatedMessage> = sqlx::query_as(
+            r#"
+            INSERT INTO federated_messages (id, direction, user_id, remote_address, type, content, status, delivered_at, request_status, shadow_limited)
+            VALUES ($1, $2, $3, $4, $5, $6, 'delivered', NOW(), $7, $8)
+            ON CONFLICT (id) DO NOTHING
+            RETURNING *
+            "#,
+        )
+        .bind(envelope.jti)
+        .bind(FederationDirection::Inbound)
+        .bind(user_id)
+        .bind(&from)
+        .bind(envelope.message_type)
+        .bind(&content)
+        .bind(request_status)
+        .bind(shadow_limited)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        // A retried or replayed envelope is accepted without delivering twice
+        let Some(message) = message else {
+            let existing: Option<Uuid> = sqlx::query_scalar(
+                "SELECT id FROM federated_messages WHERE id = $1 AND direction = 'inbound' AND user_id = $2",
+            )
+            .bind(envelope.jti)
+            .bind(user_id)
+            .fetch_optional(&mut *tx)
+            .await?;
+            return existing.ok_or_else(|| invalid("Envelope id already used"));
+        };
+
+        // Shadow-limited messages are stored but never delivered
+        if !shadow_limited {
+            let payload = serde_json::to_value(&message)
+                .map_err(|e| anyhow::anyhow!("Failed to serialize message: {}", e))?;
+            OutboxService::enqueue(&mut tx, user_id, WS_FEDERATED_MESSAGE, &payload).await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(message.id)
+    }
+
+    async fn post_envelope(&self, message: &FederatedMessage) -> AppResult<()> {
+        let (_, domain) = parse_address(&message.remote_address)
+            .ok_or_else(|| anyhow::anyhow!("Invalid address {}", message.remote_address))?;
+        if !self.config.allows(domain) {
+            return Err(AppError::FederationDomainBlocked(domain.to_string()));
+        }
+
+        let username: String = sqlx::query_scalar("SELECT username FROM users WHERE id = $1")
+            .bind(message.user_id)
+            .fetch_one(&self.db)
+            .await?;
+
+        let now = Utc::now();
+        let envelope = FederationEnvelope {
+            iss: self.config.domain.clone(),
+            aud: domain.to_string(),
+            iat: now.timestamp(),
+            exp: now.timestamp() + self.config.envelope_ttl.as_secs() as i64,
+            jti: message.id,
+            from: format!("{}@{}", username.to_lowercase(), self.config.domain),
+            to: message.remote_address.clone(),
+            message_type: message.message_type,
+            content: STANDARD.encode(&message.content),
+        };
+        let envelope = self.config.keys.sign(&envelope)?;
+
+        let peer = self.discover(domain, false).await?;
+        let response = peer_client(&peer.host, peer.port)
+            .await?
+            .post(peer.url(&peer.document.inbox))
+            .json(&InboundEnvelope { envelope })
+            .send()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to reach {}: {}", domain, e))?;
+
+        if !response.status().is_success() {
+            return Err(anyhow::anyhow!(
+                "{} refused the envelope with status {}",
+                domain,
+                response.status()
+            )
+            .into());
+        }
+
+        Ok(())
+    }
+
+    /// The peer's verification key named `kid`, if it publishes one
+    async fn peer_key(
+        &self,
+        domain: &str,
+        kid: &str,
+        refresh: bool,
+    ) -> AppResult<Option<DecodingKey>> {
+        let peer = self.discover(domain, refresh).await.map_err(|e| {
+            tracing::warn!("Federation discovery for {} failed: {}", domain, e);
+            invalid(&format!("Could not fetch keys for {}", domain))
+        })?;
+
+        let x = peer
+            .document
+            .keys
+            .iter()
+            .filter(|jwk| {
+                jwk["kid"].as_str() == Some(kid) && jwk["crv"].as_str() == Some("Ed25519")
+            })
+            .find_map(|jwk| jwk["x"].as_str());
+
+        x.map(|x| DecodingKey::from_ed_components(x).map_err(|_| invalid("Malformed peer key")))
+            .transpose()
+    }
+
+    /// Find the server for `domain`. Results are cached briefly, and so
+    /// are failures, so a domain that doesn't answer isn't looked up again
+    /// for every envelope claiming to be from it.
+    async fn discover(&self, domain: &str, refresh: bool) -> AppResult<Peer> {
+        if !refresh {
+            if let Some(json) = self.redis.get_cached_federation_peer(domain).await? {
+                if let Ok(peer) = serde_json::from_str(&json) {
+                    return Ok(peer);
+                }
+            }
+            if self.redis.get_federation_discovery_failure(domain).await? {
+                return Err(anyhow::anyhow!("Discovery for {} failed recently", domain).into());
+            }
+        }
+
+        let peer = match fetch_peer(domain).await {
+            Ok(peer) => peer,
+            Err(e) => {
+                let _ = self
+                    .redis
+                    .set_federation_discovery_failure(domain, DISCOVERY_FAILURE_TTL)
+                    .await;
+                return Err(e);
+            }
+        };
+
+        if let Ok(json) = serde_json::to_string(&peer) {
+            let _ = self
+                .redis
+                .set_cached_federation_peer(domain, &json, PEER_CACHE_TTL)
+                .await;
+        }
+
+        Ok(peer)
+    }
+}
+
+/// Fetch the document of the server for `domain`: the target of its SRV
+/// record if there is one, the domain itself otherwise
+async fn fetch_peer(domain: &str) -> AppResult<Peer> {
+    let (host, port) = srv_target(domain)
+        .await
+        .unwrap_or_else(|| (domain.to_string(), 443));
+    let url = format!("https://{}:{}{}", host, port, WELL_KNOWN_PATH);
+
+    let response = peer_client(&host, port)
+        .await?
+        .get(url)
+        .send()
+        .await
+        .and_then(|r| r.error_for_status())
+        .map_err(|e| anyhow::anyhow!("Failed to fetch {} document: {}", domain, e))?;
+    if response
+        .content_length()
+        .is_some_and(|len| len > MAX_DOCUMENT_SIZE as u64)
+    {
+        return Err(anyhow::anyhow!("{} document is too large", domain).into());
+    }
+    let body = response
+        .bytes()
+        .await
+        .map_err(|e| anyhow::anyhow!("Failed to read {} document: {}", domain, e))?;
+    if body.len() > MAX_DOCUMENT_SIZE {
+        return Err(anyhow::anyhow!("{} document is too large", domain).into());
+    }
+    let document: FederationDocument = serde_json::from_slice(&body)
+        .map_err(|e| anyhow::anyhow!("Invalid {} document: {}", domain, e))?;
+
+    if document.domain.to_lowercase() != domain {
+        return Err(
+            anyhow::anyhow!("{} serves the document for {}", domain, document.domain).into(),
+        );
+    }
+    if !document.inbox.starts_with('/') {
+        return Err(anyhow::anyhow!("{} publishes an invalid inbox path", domain).into());
+    }
+
+    Ok(Peer {
+        host,
+        port,
+        document,
+    })
+}
+
+/// A client that can only reach `host` at an address resolved here and
+/// checked to be publicly routable, so a peer can't point this server at
+/// its own network. Redirects aren't followed for the same reason.
+async fn peer_client(host: &str, port: u16) -> AppResult<reqwest::Client> {
+    let resolver = TokioAsyncResolver::tokio_from_system_conf()
+        .map_err(|e| anyhow::anyhow!("Failed to create resolver: {}", e))?;
+    let addresses: Vec<IpAddr> = resolver
+        .lookup_ip(format!("{}.", host).as_str())
+        .await
+        .map_err(|e| anyhow::anyhow!("Failed to resolve {}: {}", host, e))?
+        .iter()
+        .collect();
+    let address = match addresses.first() {
+        Some(address) if addresses.iter().all(|ip| is_public(*ip)) => *address,
+        _ => return Err(anyhow::anyhow!("{} does not resolve to a public address", host).into()),
+    };
+
+    let client = reqwest::Client::builder()
+        .resolve(host, SocketAddr::new(address, port))
+        .redirect(reqwest::redirect::Policy::none())
+        .timeout(PEER_TIMEOUT)
+        .build()
+        .map_err(|e| anyhow::anyhow!("Failed to build client: {}", e))?;
+
+    Ok(client)
+}
+
+/// Whether `ip` is globally routable (`IpAddr::is_global` isn't stable)
+fn is_public(ip: IpAddr) -> bool {
+    match ip {
+        IpAddr::V4(ip) => {
+            let [a, b, c, _] = ip.octets();
+            !(ip.is_unspecified()
+                || ip.is_private()
+                || ip.is_loopback()
+                || ip.is_link_local()
+                || ip.is_broadcast()
+                || ip.is_documentation()
+                || ip.is_multicast()
+                || a == 0
+                || a >= 240
+                // Shared address space (carrier-grade NAT)
+                || (a == 100 && (64..128).contains(&b))
+                // IETF protocol assignments
+                || (a == 192 && b == 0 && c == 0)
+                // Benchmarking
+                || (a == 198 && (b == 18 || b == 19)))
+        }
+        IpAddr::V6(ip) => {
+            if let Some(ip) = ip.to_ipv4_mapped() {
+                return is_public(IpAddr::V4(ip));
+            }
+            let [first, second, ..] = ip.segments();
+            !(ip.is_unspecified()
+                || ip.is_loopback()
+                || ip.is_multicast()
+                // Unique local
+                || (first & 0xfe00) == 0xfc00
+                // Link-local
+                || (first & 0xffc0) == 0xfe80
+                // Documentation
+                || (first == 0x2001 && second == 0x0db8))
+        }
+    }
+}
+
+fn invalid(reason: &str) -> AppError {
+    AppError::InvalidFederationEnvelope(reason.to_string())
+}
+
+/// Split `username@domain`, checking both halves
+fn parse_address(address: &str) -> Option<(&str, &str)> {
+    if address.len() > MAX_ADDRESS_LENGTH {
+        return None;
+    }
+
+    let (username, domain) = address.split_once('@')?;
+    let username_ok = !username.is_empty()
+        && username
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '_' || c == '.' || c == '-');
+
+    (username_ok && is_valid_domain(domain)).then_some((username, domain))
+}
+
+/// The `iss` claim of a compact JWS, without verifying it
+fn unverified_issuer(jws: &str) -> Option<String> {
+    let payload = jws.split('.').nth(1)?;
+    let claims: serde_json::Value =
+        serde_json::from_slice(&URL_SAFE_NO_PAD.decode(payload).ok()?).ok()?;
+    claims["iss"].as_str().map(str::to_lowercase)
+}
+
+async fn srv_target(domain: &str) -> Option<(String, u16)> {
+    let resolver = TokioAsyncResolver::tokio_from_system_conf().ok()?;
+    let records = resolver
+        .srv_lookup(format!("{}.{}.", SRV_SERVICE, domain).as_str())
+        .await
+        .ok()?;
+
+    let record = records
+        .iter()
+        .min_by_key(|r| (r.priority(), u16::MAX - r.weight()))?;
+    let host = record.target().to_utf8();
+    let host = host.trim_end_matches('.');
+    // A target of "." means there is no separate host; use the domain
+    if host.is_empty() || !is_valid_domain(host) {
+        return None;
+    }
+
+    Some((host.to_lowercase(), record.port()))
+}
+
+/// Job handler that delivers queued outbound federated messages
+pub struct FederationJob {
+    federation: FederationService,
+}
+
+impl FederationJob {
+    pub fn new(federation: FederationService) -> Self {
+        Self { federation }
+    }
+}
+
+#[async_trait]
+impl JobHandler for FederationJob {
+    fn kind(&self) -> &'static str {
+        FEDERATION_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let message_id = job
+            .payload
+            .get("message_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Federation job is missing message_id"))?;
+
+        self.federation
+            .deliver(message_id, job.is_final_attempt())
+            .await
+    }
+}
@@ -0,0 +1,137 @@
+use std::collections::HashMap;
+use std::time::Duration;
+
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::FeatureFlag,
+    storage::redis::RedisClient,
+};
+
+const FLAGS_CACHE_TTL: Duration = Duration::from_secs(60);
+
+pub struct FlagsService {
+    db: PgPool,
+    redis: RedisClient,
+}
+
+impl FlagsService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        Self { db, redis }
+    }
+
+    /// List all feature flags (cached in Redis)
+    pub async fn list_flags(&self) -> AppResult<Vec<FeatureFlag>> {
+        if let Some(cached) = self.redis.get_cached_flags().await? {
+            if let Ok(flags) = serde_json::from_str::<Vec<FeatureFlag>>(&cached) {
+                return Ok(flags);
+            }
+        }
+
+        let flags: Vec<FeatureFlag> =
+            sqlx::query_as("SELECT * FROM feature_flags ORDER BY key ASC")
+                .fetch_all(&self.db)
+                .await?;
+
+        if let Ok(json) = serde_json::to_string(&flags) {
+            self.redis.set_cached_flags(&json, FLAGS_CACHE_TTL).await?;
+        }
+
+        Ok(flags)
+    }
+
+    /// Create or update a feature flag (admin)
+    pub async fn upsert_flag(
+        &self,
+        key: &str,
+        description: Option<&str>,
+        enabled: bool,
+        rollout_percentage: i32,
+    ) -> AppResult<FeatureFlag> {
+        if key.is_empty() || key.len() > 100 {
+            return Err(AppError::Validation(
+                "Flag key must be between 1 and 100 characters".to_string(),
+            ));
+        }
+
+        if !(0..=100).contains(&rollout_percentage) {
+            return Err(AppError::Validation(
+                "Rollout percentage must be between 0 and 100".to_string(),
+            ));
+        }
+
+        let flag: FeatureFlag = sqlx::query_as(
+            r#"
+            INSERT INTO feature_flags (key, description, enabled, rollout_percentage)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (key)
+            DO UPDATE SET description = COALESCE($2, feature_flags.description),
+                          enabled = $3,
+                          rollout_percentage = $4,
+                          updated_at = NOW()
+            RETURNING *
+            "#,
+        )
+        .bind(key)
+        .bind(description)
+        .bind(enabled)
+        .bind(rollout_percentage)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.redis.invalidate_cached_flags().await?;
+
+        Ok(flag)
+    }
+
+    /// Delete a feature flag (admin)
+    pub async fn delete_flag(&self, key: &str) -> AppResult<()> {
+        let result = sqlx::query("DELETE FROM feature_flags WHERE key = $1")
+            .bind(key)
+            .execute(&self.db)
+            .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::FeatureFlagNotFound);
+        }
+
+        self.redis.invalidate_cached_flags().await?;
+
+        Ok(())
+    }
+
+    /// Evaluate every flag for a user
+    pub async fn evaluate_for_user(&self, user_id: Uuid) -> AppResult<HashMap<String, bool>> {
+        let flags = self.list_flags().await?;
+
+        Ok(flags
+            .iter()
+            .map(|flag| (flag.key.clone(), flag_applies(flag, user_id)))
+            .collect())
+    }
+}
+
+fn flag_applies(flag: &FeatureFlag, user_id: Uuid) -> bool {
+    if !flag.enabled {
+        return false;
+    }
+
+    if flag.rollout_percentage >= 100 {
+        return true;
+    }
+
+    rollout_bucket(&flag.key, user_id) < flag.rollout_percentage as u32
+}
+
+/// Stable bucket in 0..100 for a (flag, user) pair (FNV-1a), so a user keeps
+/// the same result as the rollout percentage grows.
+fn rollout_bucket(key: &str, user_id: Uuid) -> u32 {
+    let mut hash: u32 = 0x811c9dc5;
+    for byte in key.as_bytes().iter().chain(user_id.as_bytes().iter()) {
+        hash ^= *byte as u32;
+        hash = hash.wrapping_mul(0x01000193);
+    }
+    hash % 100
+}
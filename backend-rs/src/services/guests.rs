@@ -0,0 +1,636 @@
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use chrono::{Duration, Utc};
+use rand::RngCore;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::Config,
+    error::{AppError, AppResult},
+    models::{
+        ConversationType, CreatedWidgetToken, GuestSession, ParticipantRole, StartedGuestSession,
+        SystemEvent, User, UserStatus, WidgetToken, EVENT_CONVERSATION_CREATED,
+    },
+    services::{
+        abuse::{AbuseService, ClientOrigin},
+        audit::AuditService,
+        auth::{Claims, Scope},
+        events::EventsService,
+        limits::LimitsService,
+        messaging::MessagingService,
+        workspaces::WorkspacesService,
+    },
+    storage::redis::RedisClient,
+};
+
+/// Prefix of widget tokens, so they are easy to tell apart from other tokens
+const TOKEN_PREFIX: &str = "atw_";
+const DEFAULT_DISPLAY_NAME: &str = "Guest";
+const MAX_DISPLAY_NAME_LENGTH: usize = 50;
+/// Guests have a single device
+const GUEST_DEVICE_ID: i32 = 1;
+/// Window for `GUEST_MAX_SESSIONS_PER_IP`
+const SESSION_RATE_WINDOW: std::time::Duration = std::time::Duration::from_secs(60 * 60);
+
+/// Stands for the guest's own conversation in `ALLOWED_ROUTES`
+const OWN_CONVERSATION: &str = ":conversation";
+
+/// Routes a guest token may call, as path segments after the API version
+/// (`*` matches one segment). Message receipts are checked against the
+/// conversation by the handlers.
+const ALLOWED_ROUTES: &[&[&str]] = &[
+    &["conversations", OWN_CONVERSATION],
+    &["conversations", OWN_CONVERSATION, "messages"],
+    &["conversations", OWN_CONVERSATION, "typing"],
+    &["conversations", OWN_CONVERSATION, "events"],
+    &["messages", "*", "delivered"],
+    &["messages", "*", "read"],
+    &["messages", "*", "receipts"],
+    &["messages", "*", "status"],
+    &["guest", "session"],
+    &["ws"],
+    &["events"],
+    &["realtime", "poll"],
+];
+
+/// Guest sessions for website chat widgets. A workspace admin creates a
+/// widget token naming a support group conversation; each visitor the
+/// widget starts a session for gets a short-lived anonymous account and a
+/// new group conversation with the support group's members. The guest's
+/// token reaches that conversation and realtime delivery only, and can't
+/// be refreshed. Expired sessions are closed: the guest leaves the
+/// conversation and loses its device, and the transcript stays with the
+/// support staff.
+pub struct GuestsService {
+    db: PgPool,
+    redis: RedisClient,
+    config: Config,
+    audit: AuditService,
+}
+
+impl GuestsService {
+    pub fn new(db: PgPool, redis: RedisClient, config: Config) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            redis,
+            config,
+            audit,
+        }
+    }
+
+    /// Create a widget token for the workspace (workspace admins). The
+    /// support conversation must be a group in the same workspace. The
+    /// token is returned once; only its hash is stored.
+    pub async fn create_widget_token(
+        &self,
+        workspace_id: Uuid,
+        actor_id: Uuid,
+        name: &str,
+        support_conversation_id: Uuid,
+    ) -> AppResult<CreatedWidgetToken> {
+        WorkspacesService::new(self.db.clone())
+            .require_admin(workspace_id, actor_id)
+            .await?;
+
+        let name = name.trim();
+        if name.is_empty() || name.chars().count() > 100 {
+            return Err(AppError::Validation(
+                "Name must be between 1 and 100 characters".to_string(),
+            ));
+        }
+
+        let is_support_group: bool = sqlx::query_scalar(
+            r#"
+            SELECT EXISTS(
+                SELECT 1 FROM conversations
+                WHERE id = $1 AND type = $2 AND workspace_id = $3
+            )
+            "#,
+        )
+        .bind(support_conversation_id)
+        .bind(ConversationType::Group)
+        .bind(workspace_id)
+        .fetch_one(&self.db)
+        .await?;
+        if !is_support_group {
+            return Err(AppError::Validation(
+                "The support conversation must be a group in this workspace".to_string(),
+            ));
+        }
+
+        let mut secret = [0u8; 32];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let token = format!("{}{}", TOKEN_PREFIX, URL_SAFE_NO_PAD.encode(secret));
+
+        let widget_token: WidgetToken = sqlx::query_as(
+            r#"
+            INSERT INTO widget_tokens (id, workspace_id, name, support_conversation_id, token_hash, created_by)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(workspace_id)
+        .bind(name)
+        .bind(support_conversation_id)
+        .bind(hash_token(&token))
+        .bind(actor_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.record(actor_id, "widget_token.created", &widget_token)
+            .await?;
+
+        Ok(CreatedWidgetToken {
+            widget_token,
+            token,
+        })
+    }
+
+    /// The workspace's widget tokens, newest first (workspace admins)
+    pub async fn list_widget_tokens(
+        &self,
+        workspace_id: Uuid,
+        actor_id: Uuid,
+    ) -> AppResult<Vec<WidgetToken>> {
+        WorkspacesService::new(self.db.clone())
+            .require_admin(workspace_id, actor_id)
+            .await?;
+
+        let tokens: Vec<WidgetToken> = sqlx::query_as(
+            "SELECT * FROM widget_tokens WHERE workspace_id = $1 ORDER BY created_at DESC",
+        )
+        .bind(workspace_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(tokens)
+    }
+
+    /// Stop accepting the token (workspace admins). Its live sessions end
+    /// at once and are closed by the next cleanup pass.
+    pub async fn revoke_widget_token(
+        &self,
+        workspace_id: Uuid,
+        actor_id: Uuid,
+        token_id: Uuid,
+    ) -> AppResult<WidgetToken> {
+        WorkspacesService::new(self.db.clone())
+            .require_admin(workspace_id, actor_id)
+            .await?;
+
+        let mut tx = self.db.begin().await?;
+
+        let widget_token: Option<WidgetToken> = sqlx::query_as(
+            r#"
+            UPDATE widget_tokens SET revoked_at = COALESCE(revoked_at, NOW())
+            WHERE id = $1 AND workspace_id = $2
+            RETURNING *
+            "#,
+        )
+        .bind(token_id)
+        .bind(workspace_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let widget_token = widget_token.ok_or(AppError::WidgetTokenNotFound)?;
+
+        sqlx::query(
+            r#"
+            UPDATE guest_sessions SET expires_at = LEAST(expires_at, NOW())
+            WHERE widget_token_id = $1 AND ended_at IS NULL
+            "#,
+        )
+        .bind(token_id)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.record(actor_id, "widget_token.revoked", &widget_token)
+            .await?;
+
+        Ok(widget_token)
+    }
+
+    /// Start a guest session from a widget: create the guest account and its
+    /// conversation with the support group, and issue its token. The
+    /// endpoint is public, so clients are checked against the abuse
+    /// blocklists and each IP may only start a few sessions an hour.
+    pub async fn start_session(
+        &self,
+        widget_token: &str,
+        display_name: Option<&str>,
+        origin: &ClientOrigin,
+    ) -> AppResult<StartedGuestSession> {
+        AbuseService::new(self.db.clone(), self.redis.clone())
+            .check_origin(origin)
+            .await?;
+        if let Some(ip) = origin.ip {
+            if let Some(retry_after) = self
+                .redis
+                .claim_guest_session_quota(
+                    &ip.to_string(),
+                    self.config.guest.max_sessions_per_ip,
+                    SESSION_RATE_WINDOW,
+                )
+                .await?
+            {
+                return Err(AppError::RateLimited(retry_after));
+            }
+        }
+
+        let widget = self.authenticate(widget_token).await?;
+
+        let display_name = display_name
+            .map(str::trim)
+            .filter(|name| !name.is_empty())
+            .unwrap_or(DEFAULT_DISPLAY_NAME);
+        if display_name.chars().count() > MAX_DISPLAY_NAME_LENGTH {
+            return Err(AppError::Validation(format!(
+                "Display name must be at most {} characters",
+                MAX_DISPLAY_NAME_LENGTH
+            )));
+        }
+
+        let (active,): (i64,) = sqlx::query_as(
+            r#"
+            SELECT COUNT(*) FROM guest_sessions
+            WHERE widget_token_id = $1 AND ended_at IS NULL AND expires_at > NOW()
+            "#,
+        )
+        .bind(widget.id)
+        .fetch_one(&self.db)
+        .await?;
+        if active >= self.config.guest.max_active_per_widget {
+            return Err(AppError::LimitExceeded(format!(
+                "widgets are limited to {} active guest sessions",
+                self.config.guest.max_active_per_widget
+            )));
+        }
+
+        let agents: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT p.user_id FROM participants p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.conversation_id = $1 AND p.left_at IS NULL AND u.is_guest = false
+            "#,
+        )
+        .bind(widget.support_conversation_id)
+        .fetch_all(&self.db)
+        .await?;
+        if agents.is_empty() {
+            return Err(AppError::Validation(
+                "The widget's support group has no members".to_string(),
+            ));
+        }
+
+        // The guest creates the group, so it gets the default size limit
+        let user_id = Uuid::new_v4();
+        let limits = LimitsService::new(self.db.clone(), self.config.limits.clone());
+        limits.ensure_group_size(user_id, agents.len() + 1).await?;
+        limits.ensure_conversation_capacity(&agents).await?;
+
+        let now = Utc::now();
+        let expires_at = now + Duration::seconds(self.config.guest.session_ttl.as_secs() as i64);
+        let conversation_id = Uuid::new_v4();
+        let conversation_name = format!("Guest: {}", display_name);
+
+        let mut tx = self.db.begin().await?;
+
+        let user: User = sqlx::query_as(
+            r#"
+            INSERT INTO users (id, username, display_name, status, discoverable, is_guest)
+            VALUES ($1, $2, $3, $4, false, true)
+            RETURNING *
+            "#,
+        )
+        .bind(user_id)
+        .bind(format!("guest-{}", user_id.simple()))
+        .bind(display_name)
+        .bind(UserStatus::Online)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO devices (id, user_id, device_id, name, platform, last_active_at)
+            VALUES ($1, $2, $3, 'Chat widget', 'web', NOW())
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(GUEST_DEVICE_ID)
+        .execute(&mut *tx)
+        .await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO conversations (id, type, name, created_by, workspace_id)
+            VALUES ($1, $2, $3, $4, $5)
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(ConversationType::Group)
+        .bind(&conversation_name)
+        .bind(user_id)
+        .bind(widget.workspace_id)
+        .execute(&mut *tx)
+        .await?;
+
+        // Support staff see the chat straight away rather than as a request
+        for member_id in std::iter::once(user_id).chain(agents.iter().copied()) {
+            sqlx::query(
+                r#"
+                INSERT INTO participants (id, conversation_id, user_id, role, joined_at)
+                VALUES ($1, $2, $3, $4, NOW())
+                "#,
+            )
+            .bind(Uuid::new_v4())
+            .bind(conversation_id)
+            .bind(member_id)
+            .bind(ParticipantRole::Member)
+            .execute(&mut *tx)
+            .await?;
+        }
+
+        sqlx::query(
+            r#"
+            INSERT INTO guest_sessions (user_id, widget_token_id, conversation_id, created_at, expires_at)
+            VALUES ($1, $2, $3, $4, $5)
+            "#,
+        )
+        .bind(user_id)
+        .bind(widget.id)
+        .bind(conversation_id)
+        .bind(now)
+        .bind(expires_at)
+        .execute(&mut *tx)
+        .await?;
+
+        EventsService::append(
+            &mut tx,
+            conversation_id,
+            Some(user_id),
+            EVENT_CONVERSATION_CREATED,
+            json!({
+                "type": ConversationType::Group,
+                "name": conversation_name,
+                "member_ids": agents,
+                "guest_id": user_id,
+            }),
+        )
+        .await?;
+
+        MessagingService::post_system_message(
+            &mut tx,
+            conversation_id,
+            user_id,
+            SystemEvent::MemberAdded { user_ids: agents },
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        let claims = Claims {
+            sub: user_id.to_string(),
+            device_id: GUEST_DEVICE_ID.to_string(),
+            iss: self.config.jwt.issuer.clone(),
+            exp: expires_at.timestamp(),
+            iat: now.timestamp(),
+            workspace_id: None,
+            scopes: vec![Scope::Messaging],
+            cnf: None,
+            act: None,
+            guest: true,
+        };
+        let access_token = self.config.jwt.keys.sign(&claims)?;
+
+        let conversation = MessagingService::new(self.db.clone(), self.redis.clone())
+            .get_conversation(conversation_id, user_id)
+            .await?;
+
+        self.audit
+            .record(
+                None,
+                "guest.session_started",
+                "user",
+                Some(&user_id.to_string()),
+                json!({ "widget_token_id": widget.id, "conversation_id": conversation_id }),
+            )
+            .await?;
+
+        Ok(StartedGuestSession {
+            access_token,
+            expires_at,
+            user,
+            conversation,
+        })
+    }
+
+    /// The caller's guest session
+    pub async fn get_session(&self, user_id: Uuid) -> AppResult<GuestSession> {
+        let session: Option<GuestSession> =
+            sqlx::query_as("SELECT * FROM guest_sessions WHERE user_id = $1")
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        session.ok_or(AppError::Forbidden)
+    }
+
+    /// End the caller's guest session now, e.g. when the visitor closes the
+    /// chat
+    pub async fn end_session(&self, user_id: Uuid) -> AppResult<GuestSession> {
+        sqlx::query(
+            "UPDATE guest_sessions SET expires_at = LEAST(expires_at, NOW()) WHERE user_id = $1",
+        )
+        .bind(user_id)
+        .execute(&self.db)
+        .await?;
+
+        self.close(user_id).await?;
+        self.get_session(user_id).await
+    }
+
+    /// Check a guest's request before it runs: the session must still be
+    /// live, and only its own conversation and realtime delivery are
+    /// reachable
+    pub async fn authorize_request(&self, claims: &Claims, path: &str) -> AppResult<()> {
+        let user_id = Uuid::parse_str(&claims.sub).map_err(|_| AppError::InvalidToken)?;
+
+        let conversation_id: Option<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT conversation_id FROM guest_sessions
+            WHERE user_id = $1 AND ended_at IS NULL AND expires_at > NOW()
+            "#,
+        )
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let conversation_id = conversation_id.ok_or(AppError::TokenExpired)?;
+
+        if !is_allowed_route(path, &conversation_id.to_string()) {
+            return Err(AppError::GuestRestricted);
+        }
+
+        Ok(())
+    }
+
+    pub async fn run_cleanup(&self) {
+        tracing::info!("Guest session cleanup started");
+
+        loop {
+            match self.cleanup_pass().await {
+                Ok(0) => {}
+                Ok(count) => tracing::info!("Closed {} expired guest sessions", count),
+                Err(e) => tracing::error!("Guest session cleanup failed: {}", e),
+            }
+
+            tokio::time::sleep(self.config.guest.cleanup_interval).await;
+        }
+    }
+
+    /// Close every expired session. Returns how many were closed.
+    async fn cleanup_pass(&self) -> AppResult<usize> {
+        let expired: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT user_id FROM guest_sessions
+            WHERE ended_at IS NULL AND expires_at <= NOW()
+            ORDER BY expires_at
+            "#,
+        )
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut closed = 0;
+        for user_id in expired {
+            if self.close(user_id).await? {
+                closed += 1;
+            }
+        }
+
+        Ok(closed)
+    }
+
+    /// Take an expired guest out of its conversation and drop its device.
+    /// Returns false if the session is live or was already closed, e.g. by
+    /// another process.
+    async fn close(&self, user_id: Uuid) -> AppResult<bool> {
+        let mut tx = self.db.begin().await?;
+
+        let session: Option<GuestSession> = sqlx::query_as(
+            r#"
+            UPDATE guest_sessions SET ended_at = NOW()
+            WHERE user_id = $1 AND ended_at IS NULL AND expires_at <= NOW()
+            RETURNING *
+            "#,
+        )
+        .bind(user_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let Some(session) = session else {
+            return Ok(false);
+        };
+
+        let left = sqlx::query(
+            r#"
+            UPDATE participants SET left_at = NOW()
+            WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL
+            "#,
+        )
+        .bind(session.conversation_id)
+        .bind(user_id)
+        .execute(&mut *tx)
+        .await?;
+
+        if left.rows_affected() > 0 {
+            MessagingService::post_system_message(
+                &mut tx,
+                session.conversation_id,
+                user_id,
+                SystemEvent::MemberLeft { user_id },
+            )
+            .await?;
+        }
+
+        for query in [
+            "DELETE FROM sessions WHERE user_id = $1",
+            "DELETE FROM devices WHERE user_id = $1",
+            "UPDATE users SET status = 'offline', last_seen_at = NOW() WHERE id = $1",
+        ] {
+            sqlx::query(query).bind(user_id).execute(&mut *tx).await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(true)
+    }
+
+    /// Look up the live widget token
+    async fn authenticate(&self, token: &str) -> AppResult<WidgetToken> {
+        if !token.starts_with(TOKEN_PREFIX) {
+            return Err(AppError::InvalidToken);
+        }
+
+        let widget_token: Option<WidgetToken> = sqlx::query_as(
+            r#"
+            UPDATE widget_tokens SET last_used_at = NOW()
+            WHERE token_hash = $1 AND revoked_at IS NULL
+            RETURNING *
+            "#,
+        )
+        .bind(hash_token(token))
+        .fetch_optional(&self.db)
+        .await?;
+
+        widget_token.ok_or(AppError::InvalidToken)
+    }
+
+    async fn record(
+        &self,
+        actor_id: Uuid,
+        action: &str,
+        widget_token: &WidgetToken,
+    ) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "widget_token",
+                Some(&widget_token.id.to_string()),
+                json!({
+                    "name": widget_token.name,
+                    "workspace_id": widget_token.workspace_id,
+                    "support_conversation_id": widget_token.support_conversation_id,
+                }),
+            )
+            .await
+    }
+}
+
+fn is_allowed_route(path: &str, conversation_id: &str) -> bool {
+    let mut segments = path.trim_matches('/').split('/');
+    if segments.next() != Some("api") || !segments.next().is_some_and(|v| v.starts_with('v')) {
+        return false;
+    }
+    let segments: Vec<&str> = segments.filter(|s| !s.is_empty()).collect();
+
+    ALLOWED_ROUTES.iter().any(|route| {
+        route.len() == segments.len()
+            && route
+                .iter()
+                .zip(&segments)
+                .all(|(expected, actual)| match *expected {
+                    "*" => true,
+                    OWN_CONVERSATION => *actual == conversation_id,
+                    expected => expected == *actual,
+                })
+    })
+}
+
+fn hash_token(token: &str) -> String {
+    format!("{:x}", Sha256::digest(token.as_bytes()))
+}
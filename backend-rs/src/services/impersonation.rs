@@ -0,0 +1,418 @@
+use axum::http::Method;
+use chrono::{Duration, Utc};
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::Config,
+    error::{AppError, AppResult},
+    models::{
+        Impersonation, ImpersonationStatus, ImpersonationToken, WS_IMPERSONATION_REQUESTED,
+        WS_IMPERSONATION_STARTED,
+    },
+    services::{
+        audit::AuditService,
+        auth::{Actor, Claims, Scope},
+        outbox::OutboxService,
+    },
+};
+
+/// How long an approval lasts; tokens expire with it
+const APPROVAL_WINDOW_MINUTES: i64 = 30;
+const LIST_LIMIT: i64 = 100;
+
+/// GET routes an impersonation token may call, as path segments after the
+/// API version (`*` matches one segment). Account and conversation metadata
+/// only: anything that returns message content, attachments, keys or
+/// backups is left out, and `content` fields are stripped from responses.
+const ALLOWED_ROUTES: &[&[&str]] = &[
+    &["users", "me"],
+    &["users", "me", "flags"],
+    &["users", "me", "storage"],
+    &["devices"],
+    &["contacts"],
+    &["contacts", "blocked"],
+    &["contacts", "*"],
+    &["conversations"],
+    &["conversations", "requests"],
+    &["conversations", "*"],
+    &["workspaces"],
+    &["workspaces", "*"],
+    &["workspaces", "*", "members"],
+    &["stickers", "my-packs"],
+];
+
+/// Read-only admin impersonation for support. An admin asks; the user is
+/// notified and approves or denies; the admin then gets a short-lived token
+/// acting as the user. Every step and every impersonated request is
+/// audit-logged.
+pub struct ImpersonationService {
+    db: PgPool,
+    config: Config,
+    audit: AuditService,
+}
+
+impl ImpersonationService {
+    pub fn new(db: PgPool, config: Config) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self { db, config, audit }
+    }
+
+    /// Ask the user for access (admin)
+    pub async fn request(
+        &self,
+        admin_id: Uuid,
+        user_id: Uuid,
+        reason: &str,
+    ) -> AppResult<Impersonation> {
+        if reason.trim().is_empty() {
+            return Err(AppError::Validation("Reason is required".to_string()));
+        }
+        if admin_id == user_id {
+            return Err(AppError::Validation(
+                "Admins cannot impersonate themselves".to_string(),
+            ));
+        }
+
+        let exists: Option<(Uuid,)> = sqlx::query_as("SELECT id FROM users WHERE id = $1")
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?;
+        if exists.is_none() {
+            return Err(AppError::UserNotFound);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let impersonation: Impersonation = sqlx::query_as(
+            r#"
+            INSERT INTO impersonations (id, admin_id, user_id, reason)
+            VALUES ($1, $2, $3, $4)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(admin_id)
+        .bind(user_id)
+        .bind(reason.trim())
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let payload = serde_json::to_value(&impersonation)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize impersonation: {}", e))?;
+        OutboxService::enqueue(&mut tx, user_id, WS_IMPERSONATION_REQUESTED, &payload).await?;
+
+        tx.commit().await?;
+
+        self.record(admin_id, "impersonation.requested", &impersonation)
+            .await?;
+
+        Ok(impersonation)
+    }
+
+    /// Recent impersonations, newest first, optionally for one user (admin)
+    pub async fn list(&self, user_id: Option<Uuid>) -> AppResult<Vec<Impersonation>> {
+        let impersonations: Vec<Impersonation> = sqlx::query_as(
+            r#"
+            SELECT * FROM impersonations
+            WHERE $1::uuid IS NULL OR user_id = $1
+            ORDER BY created_at DESC
+            LIMIT $2
+            "#,
+        )
+        .bind(user_id)
+        .bind(LIST_LIMIT)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(impersonations)
+    }
+
+    /// Requests made for the user's account, newest first
+    pub async fn list_for_user(&self, user_id: Uuid) -> AppResult<Vec<Impersonation>> {
+        self.list(Some(user_id)).await
+    }
+
+    /// Approve or deny a pending request (the impersonated user)
+    pub async fn respond(
+        &self,
+        user_id: Uuid,
+        impersonation_id: Uuid,
+        approve: bool,
+    ) -> AppResult<Impersonation> {
+        let (status, expires_at) = if approve {
+            (
+                ImpersonationStatus::Approved,
+                Some(Utc::now() + Duration::minutes(APPROVAL_WINDOW_MINUTES)),
+            )
+        } else {
+            (ImpersonationStatus::Denied, None)
+        };
+
+        let impersonation: Option<Impersonation> = sqlx::query_as(
+            r#"
+            UPDATE impersonations
+            SET status = $3, expires_at = $4, responded_at = NOW()
+            WHERE id = $1 AND user_id = $2 AND status = 'pending'
+            RETURNING *
+            "#,
+        )
+        .bind(impersonation_id)
+        .bind(user_id)
+        .bind(status)
+        .bind(expires_at)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let impersonation = match impersonation {
+            Some(impersonation) => impersonation,
+            None => {
+                self.get_for_user(user_id, impersonation_id).await?;
+                return Err(AppError::ImpersonationNotInState("pending"));
+            }
+        };
+
+        let action = if approve {
+            "impersonation.approved"
+        } else {
+            "impersonation.denied"
+        };
+        self.record(user_id, action, &impersonation).await?;
+
+        Ok(impersonation)
+    }
+
+    /// End an approved impersonation early; its tokens stop working at once
+    /// (the impersonated user)
+    pub async fn revoke(&self, user_id: Uuid, impersonation_id: Uuid) -> AppResult<Impersonation> {
+        let impersonation: Option<Impersonation> = sqlx::query_as(
+            r#"
+            UPDATE impersonations SET status = 'revoked'
+            WHERE id = $1 AND user_id = $2 AND status = 'approved'
+            RETURNING *
+            "#,
+        )
+        .bind(impersonation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let impersonation = match impersonation {
+            Some(impersonation) => impersonation,
+            None => {
+                self.get_for_user(user_id, impersonation_id).await?;
+                return Err(AppError::ImpersonationNotInState("approved"));
+            }
+        };
+
+        self.record(user_id, "impersonation.revoked", &impersonation)
+            .await?;
+
+        Ok(impersonation)
+    }
+
+    /// Mint a read-only token acting as the user for an approved request.
+    /// The user is told the admin is now looking at their account.
+    pub async fn issue_token(
+        &self,
+        admin_id: Uuid,
+        impersonation_id: Uuid,
+    ) -> AppResult<ImpersonationToken> {
+        let mut tx = self.db.begin().await?;
+
+        let impersonation: Option<Impersonation> = sqlx::query_as(
+            r#"
+            UPDATE impersonations SET token_issued_at = NOW()
+            WHERE id = $1 AND admin_id = $2 AND status = 'approved' AND expires_at > NOW()
+            RETURNING *
+            "#,
+        )
+        .bind(impersonation_id)
+        .bind(admin_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        let Some(impersonation) = impersonation else {
+            let exists: Option<(Uuid,)> =
+                sqlx::query_as("SELECT id FROM impersonations WHERE id = $1 AND admin_id = $2")
+                    .bind(impersonation_id)
+                    .bind(admin_id)
+                    .fetch_optional(&mut *tx)
+                    .await?;
+
+            return Err(match exists {
+                Some(_) => AppError::ImpersonationNotInState("approved"),
+                None => AppError::ImpersonationNotFound,
+            });
+        };
+
+        let expires_at = impersonation
+            .expires_at
+            .ok_or(AppError::ImpersonationNotInState("approved"))?;
+        let claims = Claims {
+            sub: impersonation.user_id.to_string(),
+            // Not one of the user's devices
+            device_id: "0".to_string(),
+            iss: self.config.jwt.issuer.clone(),
+            exp: expires_at.timestamp(),
+            iat: Utc::now().timestamp(),
+            workspace_id: None,
+            scopes: vec![Scope::Read],
+            cnf: None,
+            act: Some(Actor {
+                sub: admin_id.to_string(),
+                sid: impersonation.id.to_string(),
+            }),
+            guest: false,
+        };
+        let access_token = self.config.jwt.keys.sign(&claims)?;
+
+        let payload = serde_json::to_value(&impersonation)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize impersonation: {}", e))?;
+        OutboxService::enqueue(
+            &mut tx,
+            impersonation.user_id,
+            WS_IMPERSONATION_STARTED,
+            &payload,
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        self.record(admin_id, "impersonation.token_issued", &impersonation)
+            .await?;
+
+        Ok(ImpersonationToken {
+            access_token,
+            expires_at,
+        })
+    }
+
+    /// Check an impersonated request before it runs and audit-log it. The
+    /// impersonation must still be approved, and only metadata GET routes
+    /// are reachable. `path` is the full request path.
+    pub async fn authorize_request(
+        &self,
+        claims: &Claims,
+        actor: &Actor,
+        method: &Method,
+        path: &str,
+    ) -> AppResult<()> {
+        let impersonation_id = Uuid::parse_str(&actor.sid).map_err(|_| AppError::InvalidToken)?;
+        let admin_id = Uuid::parse_str(&actor.sub).map_err(|_| AppError::InvalidToken)?;
+        let user_id = Uuid::parse_str(&claims.sub).map_err(|_| AppError::InvalidToken)?;
+
+        let active: bool = sqlx::query_scalar(
+            r#"
+            SELECT EXISTS(
+                SELECT 1 FROM impersonations
+                WHERE id = $1 AND admin_id = $2 AND user_id = $3
+                  AND status = 'approved' AND expires_at > NOW()
+            )
+            "#,
+        )
+        .bind(impersonation_id)
+        .bind(admin_id)
+        .bind(user_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        if !active {
+            return Err(AppError::InvalidToken);
+        }
+
+        // Every impersonated request must be audited, which a read-only
+        // region can't do
+        if self.config.region.read_only {
+            return Err(AppError::RegionReadOnly {
+                leader_url: self.config.region.leader_url.clone(),
+            });
+        }
+
+        let allowed = (*method == Method::GET || *method == Method::HEAD) && is_allowed_route(path);
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "impersonation.request",
+                "user",
+                Some(&user_id.to_string()),
+                json!({
+                    "impersonation_id": impersonation_id,
+                    "method": method.as_str(),
+                    "path": path,
+                    "allowed": allowed,
+                }),
+            )
+            .await?;
+
+        if !allowed {
+            return Err(AppError::ImpersonationRestricted);
+        }
+
+        Ok(())
+    }
+
+    async fn get_for_user(&self, user_id: Uuid, impersonation_id: Uuid) -> AppResult<Impersonation> {
+        let impersonation: Option<Impersonation> =
+            sqlx::query_as("SELECT * FROM impersonations WHERE id = $1 AND user_id = $2")
+                .bind(impersonation_id)
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        impersonation.ok_or(AppError::ImpersonationNotFound)
+    }
+
+    async fn record(
+        &self,
+        actor_id: Uuid,
+        action: &str,
+        impersonation: &Impersonation,
+    ) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "user",
+                Some(&impersonation.user_id.to_string()),
+                json!({
+                    "impersonation_id": impersonation.id,
+                    "admin_id": impersonation.admin_id,
+                    "reason": impersonation.reason,
+                }),
+            )
+            .await
+    }
+}
+
+/// Match `/api/v<n>/...` against `ALLOWED_ROUTES`
+fn is_allowed_route(path: &str) -> bool {
+    let mut segments = path.trim_matches('/').split('/');
+    if segments.next() != Some("api") || !segments.next().is_some_and(|v| v.starts_with('v')) {
+        return false;
+    }
+    let segments: Vec<&str> = segments.filter(|s| !s.is_empty()).collect();
+
+    ALLOWED_ROUTES.iter().any(|route| {
+        route.len() == segments.len()
+            && route
+                .iter()
+                .zip(&segments)
+                .all(|(expected, actual)| *expected == "*" || expected == actual)
+    })
+}
+
+/// Remove every `content` field, at any depth, from a JSON response body
+/// served to an impersonation token
+pub fn redact_content(value: &mut serde_json::Value) {
+    match value {
+        serde_json::Value::Object(map) => {
+            map.remove("content");
+            map.values_mut().for_each(redact_content);
+        }
+        serde_json::Value::Array(items) => items.iter_mut().for_each(redact_content),
+        _ => {}
+    }
+}
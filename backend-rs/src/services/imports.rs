@@ -0,0 +1,867 @@
+use std::{
+    collections::HashSet,
+    io::{Cursor, Read},
+};
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use chrono::{DateTime, Duration, NaiveDate, NaiveDateTime, NaiveTime, Utc};
+use serde::Deserialize;
+use serde_json::json;
+use sqlx::{types::Json, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        ConversationImport, ConversationType, DateOrder, ExportStatus, ImportOptions,
+        ImportParticipant, ImportSource, ImportedHistory, ImportedMessage, ParticipantRole,
+    },
+    services::{limits::LimitsService, phone},
+    storage::minio::MinioClient,
+};
+
+pub const IMPORT_JOB_KIND: &str = "conversation_import";
+
+/// Uploads are text-only exports ("without media"), zipped or not
+pub const IMPORT_MAX_REQUEST_SIZE: usize = 64 * 1024 * 1024;
+
+/// Largest chat file read out of a zip, so a small archive can't expand
+/// without bound
+const MAX_CHAT_SIZE: u64 = 64 * 1024 * 1024;
+const IMPORT_BATCH_SIZE: usize = 1000;
+const MAX_UTC_OFFSET_MINUTES: i32 = 14 * 60;
+const MAX_NAME_LENGTH: usize = 100;
+const DEFAULT_NAME: &str = "Imported chat";
+
+/// A message read from an export, before senders are matched to users
+#[derive(Debug)]
+struct ParsedMessage {
+    sender: Option<String>,
+    text: String,
+    media_name: Option<String>,
+    sent_at: DateTime<Utc>,
+}
+
+#[derive(Debug)]
+struct ParsedChat {
+    source: ImportSource,
+    name: Option<String>,
+    messages: Vec<ParsedMessage>,
+}
+
+/// Imports WhatsApp and Telegram chat exports as read-only conversations.
+/// Only the importing user joins the conversation; senders who match one of
+/// their contacts are linked to that user, everyone else stays a named
+/// placeholder.
+pub struct ImportsService {
+    db: PgPool,
+    minio: MinioClient,
+    jobs: JobQueue,
+}
+
+impl ImportsService {
+    pub fn new(db: PgPool, minio: MinioClient, jobs: JobQueue) -> Self {
+        Self { db, minio, jobs }
+    }
+
+    /// Store the uploaded archive and queue it for processing
+    pub async fn request_import(
+        &self,
+        user_id: Uuid,
+        archive: Bytes,
+        options: ImportOptions,
+    ) -> AppResult<ConversationImport> {
+        if archive.is_empty() {
+            return Err(AppError::Validation("Archive is empty".to_string()));
+        }
+        if options.utc_offset_minutes.abs() > MAX_UTC_OFFSET_MINUTES {
+            return Err(AppError::Validation(
+                "utc_offset_minutes must be between -840 and 840".to_string(),
+            ));
+        }
+        if let Some(name) = &options.name {
+            if name.trim().is_empty() || name.trim().chars().count() > MAX_NAME_LENGTH {
+                return Err(AppError::Validation(
+                    "Name must be between 1 and 100 characters".to_string(),
+                ));
+            }
+        }
+
+        let mapped: Vec<Uuid> = options.participants.values().copied().collect();
+        let known: i64 = sqlx::query_scalar("SELECT COUNT(*) FROM users WHERE id = ANY($1)")
+            .bind(&mapped)
+            .fetch_one(&self.db)
+            .await?;
+        if known != mapped.iter().collect::<HashSet<_>>().len() as i64 {
+            return Err(AppError::Validation(
+                "participants refers to unknown users".to_string(),
+            ));
+        }
+
+        let import_id = Uuid::new_v4();
+        let key = format!("imports/{}/{}", user_id, import_id);
+        self.minio
+            .upload_private_file(
+                self.minio.exports_bucket(),
+                &key,
+                archive,
+                "application/octet-stream",
+            )
+            .await?;
+
+        let import: ConversationImport = sqlx::query_as(
+            r#"
+            INSERT INTO conversation_imports (id, user_id, status, options, object_key)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING *
+            "#,
+        )
+        .bind(import_id)
+        .bind(user_id)
+        .bind(ExportStatus::Pending)
+        .bind(Json(&options))
+        .bind(&key)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.jobs
+            .enqueue(IMPORT_JOB_KIND, json!({ "import_id": import.id }))
+            .await?;
+
+        Ok(import)
+    }
+
+    pub async fn get_import(
+        &self,
+        import_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ConversationImport> {
+        let import: Option<ConversationImport> =
+            sqlx::query_as("SELECT * FROM conversation_imports WHERE id = $1 AND user_id = $2")
+                .bind(import_id)
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        import.ok_or(AppError::ImportNotFound)
+    }
+
+    /// Imported messages after `after_id`, oldest first, with the chat's
+    /// senders
+    pub async fn imported_history(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        after_id: i64,
+        limit: i64,
+    ) -> AppResult<ImportedHistory> {
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if is_participant.is_none() {
+            return Err(AppError::NotParticipant);
+        }
+
+        let participants: Vec<ImportParticipant> = sqlx::query_as(
+            "SELECT name, user_id FROM import_participants WHERE conversation_id = $1 ORDER BY name",
+        )
+        .bind(conversation_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let messages: Vec<ImportedMessage> = sqlx::query_as(
+            r#"
+            SELECT id, sender_name, text, media_name, sent_at FROM imported_messages
+            WHERE conversation_id = $1 AND id > $2
+            ORDER BY id ASC
+            LIMIT $3
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(after_id)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(ImportedHistory {
+            participants,
+            messages,
+        })
+    }
+
+    /// Parse a queued archive and create its conversation. Malformed
+    /// archives and importers at their conversation limit fail at once;
+    /// other failures are retried, and recorded on the final attempt.
+    pub async fn process_import(
+        &self,
+        import_id: Uuid,
+        final_attempt: bool,
+        limits: &LimitsService,
+    ) -> AppResult<()> {
+        let import: Option<ConversationImport> =
+            sqlx::query_as("SELECT * FROM conversation_imports WHERE id = $1")
+                .bind(import_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        let import = import.ok_or(AppError::ImportNotFound)?;
+
+        if matches!(
+            import.status,
+            ExportStatus::Completed | ExportStatus::Failed
+        ) {
+            return Ok(());
+        }
+
+        if let Err(e) = self.run_import(&import, limits).await {
+            tracing::error!("Import {} failed: {}", import.id, e);
+
+            let failed =
+                final_attempt || matches!(e, AppError::Validation(_) | AppError::LimitExceeded(_));
+            let (status, error) = if failed {
+                (ExportStatus::Failed, Some(e.to_string()))
+            } else {
+                (ExportStatus::Pending, None)
+            };
+
+            sqlx::query(
+                r#"
+                UPDATE conversation_imports
+                SET status = $1, error = $2,
+                    completed_at = CASE WHEN $1 = 'failed'::export_status THEN NOW() END
+                WHERE id = $3
+                "#,
+            )
+            .bind(status)
+            .bind(error)
+            .bind(import.id)
+            .execute(&self.db)
+            .await?;
+
+            if failed {
+                self.discard_archive(&import).await;
+            }
+
+            return Err(e);
+        }
+
+        Ok(())
+    }
+
+    async fn run_import(
+        &self,
+        import: &ConversationImport,
+        limits: &LimitsService,
+    ) -> AppResult<()> {
+        sqlx::query("UPDATE conversation_imports SET status = $1 WHERE id = $2")
+            .bind(ExportStatus::Processing)
+            .bind(import.id)
+            .execute(&self.db)
+            .await?;
+
+        let options: Json<ImportOptions> =
+            sqlx::query_scalar("SELECT options FROM conversation_imports WHERE id = $1")
+                .bind(import.id)
+                .fetch_one(&self.db)
+                .await?;
+        let options = options.0;
+
+        let key = import
+            .object_key
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("Import has no archive"))?;
+        let archive = self
+            .minio
+            .download_file(self.minio.exports_bucket(), key)
+            .await?;
+
+        let parse_options = options.clone();
+        let chat = tokio::task::spawn_blocking(move || parse_archive(&archive, &parse_options))
+            .await
+            .map_err(|e| anyhow::anyhow!("Import parser panicked: {}", e))??;
+
+        if chat.messages.is_empty() {
+            return Err(AppError::Validation(
+                "No messages found in the export".to_string(),
+            ));
+        }
+
+        let senders = self.match_senders(import.user_id, &chat, &options).await?;
+
+        let name = options
+            .name
+            .as_deref()
+            .or(chat.name.as_deref())
+            .map(str::trim)
+            .filter(|n| !n.is_empty())
+            .map(|n| n.chars().take(MAX_NAME_LENGTH).collect::<String>())
+            .unwrap_or_else(|| DEFAULT_NAME.to_string());
+        let last_sent_at = chat.messages.iter().map(|m| m.sent_at).max();
+
+        // Matched senders aren't added as participants, only the importer
+        limits
+            .ensure_conversation_capacity(&[import.user_id])
+            .await?;
+
+        let mut tx = self.db.begin().await?;
+
+        let conversation_id = Uuid::new_v4();
+        sqlx::query(
+            r#"
+            INSERT INTO conversations (id, type, name, created_by, imported_from, last_message_at)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(ConversationType::Group)
+        .bind(&name)
+        .bind(import.user_id)
+        .bind(chat.source)
+        .bind(last_sent_at)
+        .execute(&mut *tx)
+        .await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO participants (id, conversation_id, user_id, role, joined_at)
+            VALUES ($1, $2, $3, $4, NOW())
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(conversation_id)
+        .bind(import.user_id)
+        .bind(ParticipantRole::Owner)
+        .execute(&mut *tx)
+        .await?;
+
+        let (names, user_ids): (Vec<&str>, Vec<Option<Uuid>>) = senders
+            .iter()
+            .map(|(name, user_id)| (name.as_str(), *user_id))
+            .unzip();
+        sqlx::query(
+            r#"
+            INSERT INTO import_participants (conversation_id, name, user_id)
+            SELECT $1, * FROM UNNEST($2::text[], $3::uuid[])
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(&names)
+        .bind(&user_ids)
+        .execute(&mut *tx)
+        .await?;
+
+        let total = chat.messages.len();
+        for (i, batch) in chat.messages.chunks(IMPORT_BATCH_SIZE).enumerate() {
+            let senders: Vec<Option<&str>> = batch.iter().map(|m| m.sender.as_deref()).collect();
+            let texts: Vec<&str> = batch.iter().map(|m| m.text.as_str()).collect();
+            let media: Vec<Option<&str>> = batch.iter().map(|m| m.media_name.as_deref()).collect();
+            let sent_at: Vec<DateTime<Utc>> = batch.iter().map(|m| m.sent_at).collect();
+
+            sqlx::query(
+                r#"
+                INSERT INTO imported_messages (conversation_id, sender_name, text, media_name, sent_at)
+                SELECT $1, * FROM UNNEST($2::text[], $3::text[], $4::text[], $5::timestamptz[])
+                "#,
+            )
+            .bind(conversation_id)
+            .bind(&senders)
+            .bind(&texts)
+            .bind(&media)
+            .bind(&sent_at)
+            .execute(&mut *tx)
+            .await?;
+
+            // Outside the transaction so pollers see it
+            let done = ((i + 1) * IMPORT_BATCH_SIZE).min(total);
+            sqlx::query("UPDATE conversation_imports SET progress = $1 WHERE id = $2")
+                .bind((done * 100 / total).min(99) as i32)
+                .bind(import.id)
+                .execute(&self.db)
+                .await?;
+        }
+
+        sqlx::query(
+            r#"
+            UPDATE conversation_imports
+            SET status = $1, progress = 100, source = $2, conversation_id = $3,
+                message_count = $4, completed_at = NOW()
+            WHERE id = $5
+            "#,
+        )
+        .bind(ExportStatus::Completed)
+        .bind(chat.source)
+        .bind(conversation_id)
+        .bind(total as i32)
+        .bind(import.id)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        self.discard_archive(import).await;
+
+        tracing::info!(
+            "Import {} completed ({} messages into conversation {})",
+            import.id,
+            total,
+            conversation_id
+        );
+
+        Ok(())
+    }
+
+    /// Each sender name with the user it stands for: the importer for
+    /// `self_name`, explicit `participants` mappings, then a unique match
+    /// among the importer's contacts by phone number, nickname or display
+    /// name. Lookups never go beyond the importer's contacts, so an import
+    /// can't be used to probe who is registered.
+    async fn match_senders(
+        &self,
+        user_id: Uuid,
+        chat: &ParsedChat,
+        options: &ImportOptions,
+    ) -> AppResult<Vec<(String, Option<Uuid>)>> {
+        let contacts: Vec<(Uuid, Option<String>, String, Option<String>)> = sqlx::query_as(
+            r#"
+            SELECT u.id, c.nickname, u.display_name, u.phone
+            FROM contacts c
+            JOIN users u ON u.id = c.contact_id
+            WHERE c.user_id = $1 AND c.is_blocked = false
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut seen = HashSet::new();
+        let mut senders = Vec::new();
+
+        for name in chat.messages.iter().filter_map(|m| m.sender.as_deref()) {
+            if !seen.insert(name) {
+                continue;
+            }
+
+            let matched = if options.self_name.as_deref() == Some(name) {
+                Some(user_id)
+            } else if let Some(id) = options.participants.get(name) {
+                Some(*id)
+            } else {
+                let phone = name
+                    .starts_with('+')
+                    .then(|| phone::normalize(name, None).ok())
+                    .flatten();
+                let candidates: HashSet<Uuid> = contacts
+                    .iter()
+                    .filter(|(_, nickname, display_name, contact_phone)| match &phone {
+                        Some(phone) => contact_phone.as_ref() == Some(phone),
+                        None => {
+                            nickname
+                                .as_deref()
+                                .is_some_and(|n| n.eq_ignore_ascii_case(name))
+                                || display_name.eq_ignore_ascii_case(name)
+                        }
+                    })
+                    .map(|(id, ..)| *id)
+                    .collect();
+
+                match candidates.len() {
+                    1 => candidates.into_iter().next(),
+                    _ => None,
+                }
+            };
+
+            senders.push((name.to_string(), matched));
+        }
+
+        Ok(senders)
+    }
+
+    async fn discard_archive(&self, import: &ConversationImport) {
+        let Some(key) = &import.object_key else {
+            return;
+        };
+
+        if let Err(e) = self
+            .minio
+            .delete_file(self.minio.exports_bucket(), key)
+            .await
+        {
+            tracing::warn!("Failed to delete import archive {}: {}", key, e);
+            return;
+        }
+
+        let _ = sqlx::query("UPDATE conversation_imports SET object_key = NULL WHERE id = $1")
+            .bind(import.id)
+            .execute(&self.db)
+            .await;
+    }
+}
+
+/// Read a WhatsApp `.txt`, a Telegram `result.json`, or a zip holding
+/// either
+fn parse_archive(data: &[u8], options: &ImportOptions) -> AppResult<ParsedChat> {
+    if data.starts_with(b"PK\x03\x04") {
+        let (file_name, contents) = read_zip_chat(data)?;
+        parse_export(&contents, Some(&file_name), options)
+    } else {
+        parse_export(data, None, options)
+    }
+}
+
+fn read_zip_chat(data: &[u8]) -> AppResult<(String, Vec<u8>)> {
+    let invalid = || AppError::Validation("Archive is not a readable zip file".to_string());
+
+    let mut zip = zip::ZipArchive::new(Cursor::new(data)).map_err(|_| invalid())?;
+    let names: Vec<String> = zip.file_names().map(str::to_string).collect();
+    let file_name = names
+        .iter()
+        .find(|n| n.rsplit('/').next() == Some("result.json"))
+        .or_else(|| names.iter().find(|n| n.ends_with(".txt")))
+        .cloned()
+        .ok_or_else(|| {
+            AppError::Validation(
+                "Archive has no WhatsApp chat (.txt) or Telegram result.json".to_string(),
+            )
+        })?;
+
+    let file = zip.by_name(&file_name).map_err(|_| invalid())?;
+    let mut contents = Vec::new();
+    file.take(MAX_CHAT_SIZE + 1)
+        .read_to_end(&mut contents)
+        .map_err(|_| invalid())?;
+    if contents.len() as u64 > MAX_CHAT_SIZE {
+        return Err(AppError::Validation(
+            "Chat is too large to import".to_string(),
+        ));
+    }
+
+    Ok((file_name, contents))
+}
+
+fn parse_export(
+    contents: &[u8],
+    file_name: Option<&str>,
+    options: &ImportOptions,
+) -> AppResult<ParsedChat> {
+    let text = String::from_utf8_lossy(contents);
+    let text = text.trim_start_matches('\u{feff}');
+
+    if text.trim_start().starts_with('{') {
+        parse_telegram(text, options)
+    } else {
+        let name = file_name.and_then(whatsapp_chat_name);
+        parse_whatsapp(text, name, options)
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct TelegramExport {
+    name: Option<String>,
+    #[serde(default)]
+    messages: Vec<TelegramMessage>,
+}
+
+#[derive(Debug, Deserialize)]
+struct TelegramMessage {
+    #[serde(rename = "type")]
+    kind: String,
+    date: String,
+    date_unixtime: Option<String>,
+    from: Option<String>,
+    #[serde(default)]
+    text: TelegramText,
+    photo: Option<String>,
+    file: Option<String>,
+}
+
+/// Plain text, or a list of plain and formatted pieces
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum TelegramText {
+    Plain(String),
+    Rich(Vec<TelegramTextPart>),
+}
+
+impl Default for TelegramText {
+    fn default() -> Self {
+        Self::Plain(String::new())
+    }
+}
+
+#[derive(Debug, Deserialize)]
+#[serde(untagged)]
+enum TelegramTextPart {
+    Plain(String),
+    Entity { text: String },
+}
+
+/// Telegram Desktop's machine-readable "Export chat history"
+fn parse_telegram(text: &str, options: &ImportOptions) -> AppResult<ParsedChat> {
+    let export: TelegramExport = serde_json::from_str(text)
+        .map_err(|e| AppError::Validation(format!("Invalid Telegram export: {}", e)))?;
+
+    let messages = export
+        .messages
+        .into_iter()
+        // Service entries (joins, pins, calls) have no text of their own
+        .filter(|m| m.kind == "message")
+        .filter_map(|m| {
+            let sent_at = match m.date_unixtime.as_deref().and_then(|t| t.parse().ok()) {
+                Some(timestamp) => DateTime::from_timestamp(timestamp, 0)?,
+                None => {
+                    let local = NaiveDateTime::parse_from_str(&m.date, "%Y-%m-%dT%H:%M:%S").ok()?;
+                    to_utc(local, options.utc_offset_minutes)
+                }
+            };
+            let text = match m.text {
+                TelegramText::Plain(text) => text,
+                TelegramText::Rich(parts) => parts
+                    .into_iter()
+                    .map(|part| match part {
+                        TelegramTextPart::Plain(text) | TelegramTextPart::Entity { text } => text,
+                    })
+                    .collect(),
+            };
+            let media_name = m
+                .photo
+                .or(m.file)
+                .map(|path| path.rsplit('/').next().unwrap_or(&path).to_string());
+
+            Some(ParsedMessage {
+                sender: Some(m.from.unwrap_or_else(|| "Deleted Account".to_string())),
+                text,
+                media_name,
+                sent_at,
+            })
+        })
+        .collect();
+
+    Ok(ParsedChat {
+        source: ImportSource::Telegram,
+        name: export.name,
+        messages,
+    })
+}
+
+/// A WhatsApp message header before the date order is known
+struct WhatsappEntry<'a> {
+    date: [u32; 3],
+    time: NaiveTime,
+    body: String,
+    first_line: &'a str,
+}
+
+/// WhatsApp's "Export chat" text, in both the Android
+/// (`15/10/2026, 14:03 - Name: text`) and iOS
+/// (`[15/10/2026, 14:03:22] Name: text`) layouts. Lines that don't start
+/// with a timestamp continue the previous message.
+fn parse_whatsapp(
+    text: &str,
+    name: Option<String>,
+    options: &ImportOptions,
+) -> AppResult<ParsedChat> {
+    let mut entries: Vec<WhatsappEntry> = Vec::new();
+
+    for line in text.lines() {
+        let line = line.trim_start_matches(['\u{200e}', '\u{200f}']);
+        match whatsapp_header(line) {
+            Some((date, time, rest)) => entries.push(WhatsappEntry {
+                date,
+                time,
+                body: rest.to_string(),
+                first_line: rest,
+            }),
+            None => {
+                if let Some(entry) = entries.last_mut() {
+                    entry.body.push('\n');
+                    entry.body.push_str(line);
+                }
+            }
+        }
+    }
+
+    if entries.is_empty() {
+        return Err(AppError::Validation(
+            "Not a WhatsApp or Telegram chat export".to_string(),
+        ));
+    }
+
+    // Numeric dates are ambiguous; a field over 12 settles it
+    let date_order = options.date_order.unwrap_or_else(|| {
+        if entries.iter().any(|e| e.date[0] > 12) {
+            DateOrder::Dmy
+        } else if entries.iter().any(|e| e.date[1] > 12) {
+            DateOrder::Mdy
+        } else {
+            DateOrder::Dmy
+        }
+    });
+
+    let messages = entries
+        .into_iter()
+        .filter_map(|entry| {
+            let [a, b, year] = entry.date;
+            let (day, month) = match date_order {
+                DateOrder::Dmy => (a, b),
+                DateOrder::Mdy => (b, a),
+            };
+            let year = if year < 100 { 2000 + year } else { year };
+            let date = NaiveDate::from_ymd_opt(year as i32, month, day)?;
+            let sent_at = to_utc(date.and_time(entry.time), options.utc_offset_minutes);
+
+            // Notices ("Messages and calls are end-to-end encrypted") have
+            // no sender
+            let (sender, body) = match entry.first_line.split_once(": ") {
+                Some((sender, _)) => {
+                    let body = entry.body[sender.len() + 2..].to_string();
+                    (Some(sender.to_string()), body)
+                }
+                None => (None, entry.body),
+            };
+            let (text, media_name) = whatsapp_attachment(&body);
+
+            Some(ParsedMessage {
+                sender,
+                text,
+                media_name,
+                sent_at,
+            })
+        })
+        .collect();
+
+    Ok(ParsedChat {
+        source: ImportSource::Whatsapp,
+        name,
+        messages,
+    })
+}
+
+/// Split a line into its date fields, time and the rest, if it starts a
+/// message
+fn whatsapp_header(line: &str) -> Option<([u32; 3], NaiveTime, &str)> {
+    let (stamp, rest) = match line.strip_prefix('[') {
+        Some(inner) => {
+            let (stamp, rest) = inner.split_once(']')?;
+            (stamp, rest.trim_start())
+        }
+        None => line.split_once(" - ")?,
+    };
+    let (date, time) = stamp.split_once(", ").or_else(|| stamp.split_once(' '))?;
+
+    let fields: Vec<u32> = date
+        .split(['/', '.', '-'])
+        .map(|f| f.trim().parse().ok())
+        .collect::<Option<_>>()?;
+    let date = match fields[..] {
+        // Year first, as in 2026-10-15
+        [year, month, day] if year > 999 => [day, month, year],
+        [a, b, year] => [a, b, year],
+        _ => return None,
+    };
+
+    Some((date, parse_time(time)?, rest))
+}
+
+/// `14:03`, `14:03:22`, `2:03 PM` or `2:03:22 p.m.`
+fn parse_time(time: &str) -> Option<NaiveTime> {
+    let time = time
+        .replace(['\u{202f}', '\u{a0}'], " ")
+        .to_lowercase()
+        .replace('.', "");
+    let (clock, pm) = if let Some(clock) = time.strip_suffix("pm") {
+        (clock.trim(), Some(true))
+    } else if let Some(clock) = time.strip_suffix("am") {
+        (clock.trim(), Some(false))
+    } else {
+        (time.trim(), None)
+    };
+
+    let fields: Vec<u32> = clock
+        .split(':')
+        .map(|f| f.parse().ok())
+        .collect::<Option<_>>()?;
+    let (hour, minute, second) = match fields[..] {
+        [hour, minute] => (hour, minute, 0),
+        [hour, minute, second] => (hour, minute, second),
+        _ => return None,
+    };
+    let hour = match pm {
+        Some(pm) if hour <= 12 => hour % 12 + if pm { 12 } else { 0 },
+        Some(_) => return None,
+        None => hour,
+    };
+
+    NaiveTime::from_hms_opt(hour, minute, second)
+}
+
+/// The message text and attachment file name of a WhatsApp message body.
+/// iOS writes `<attached: NAME>`, Android `NAME (file attached)` with any
+/// caption on the following line.
+fn whatsapp_attachment(body: &str) -> (String, Option<String>) {
+    let (first, rest) = match body.split_once('\n') {
+        Some((first, rest)) => (first, Some(rest)),
+        None => (body, None),
+    };
+    let first = first.trim_start_matches('\u{200e}');
+
+    let name = first
+        .strip_prefix("<attached: ")
+        .and_then(|n| n.strip_suffix('>'))
+        .or_else(|| first.strip_suffix(" (file attached)"));
+
+    match name {
+        Some(name) => (rest.unwrap_or_default().to_string(), Some(name.to_string())),
+        None => (body.to_string(), None),
+    }
+}
+
+/// "WhatsApp Chat with Alice.txt" -> "Alice"
+fn whatsapp_chat_name(file_name: &str) -> Option<String> {
+    let base = file_name.rsplit('/').next()?.strip_suffix(".txt")?;
+    base.strip_prefix("WhatsApp Chat with ")
+        .or_else(|| base.strip_prefix("WhatsApp Chat - "))
+        .map(str::to_string)
+}
+
+fn to_utc(local: NaiveDateTime, utc_offset_minutes: i32) -> DateTime<Utc> {
+    (local - Duration::minutes(utc_offset_minutes as i64)).and_utc()
+}
+
+/// Job handler that processes uploaded chat exports
+pub struct ImportJob {
+    imports: ImportsService,
+    limits: LimitsService,
+}
+
+impl ImportJob {
+    pub fn new(imports: ImportsService, limits: LimitsService) -> Self {
+        Self { imports, limits }
+    }
+}
+
+#[async_trait]
+impl JobHandler for ImportJob {
+    fn kind(&self) -> &'static str {
+        IMPORT_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let import_id = job
+            .payload
+            .get("import_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Import job is missing import_id"))?;
+
+        self.imports
+            .process_import(import_id, job.is_final_attempt(), &self.limits)
+            .await
+    }
+}
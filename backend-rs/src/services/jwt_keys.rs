@@ -0,0 +1,259 @@
+use std::{collections::HashMap, fmt, fs, path::Path};
+
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use chrono::{DateTime, Utc};
+use jsonwebtoken::{
+    decode, decode_header, encode, errors::ErrorKind, Algorithm, DecodingKey, EncodingKey, Header,
+    Validation,
+};
+use rsa::{pkcs8::DecodePublicKey, traits::PublicKeyParts, RsaPublicKey};
+use serde::{de::DeserializeOwned, Serialize};
+use sha2::{Digest, Sha256};
+
+use crate::{config::JwtConfig, error::AppResult};
+
+// Ed25519 SubjectPublicKeyInfo is a fixed 12-byte prefix plus the raw key
+const ED25519_SPKI_LEN: usize = 44;
+
+struct JwtKey {
+    kid: String,
+    algorithm: Algorithm,
+    /// Only keys with a private half can sign; retired keys just verify
+    encoding: Option<EncodingKey>,
+    decoding: DecodingKey,
+    /// Public JWK, for asymmetric keys
+    jwk: Option<serde_json::Value>,
+}
+
+/// Signing and verification keys, identified by `kid`. The active key signs
+/// new tokens; every loaded key verifies, so a rotated-out key stays valid
+/// until the tokens it signed expire.
+#[derive(Default)]
+pub struct JwtKeySet {
+    active_kid: String,
+    keys: HashMap<String, JwtKey>,
+    /// Shared HS256 secrets by activation time, oldest first; the newest
+    /// one already active signs instead of `active_kid`
+    schedule: Vec<(DateTime<Utc>, String)>,
+}
+
+impl fmt::Debug for JwtKeySet {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("JwtKeySet")
+            .field("active_kid", &self.active_kid)
+            .field("kids", &self.keys.keys().collect::<Vec<_>>())
+            .finish()
+    }
+}
+
+impl JwtKeySet {
+    /// Build the key set. HS256 uses the secrets shared between replicas,
+    /// plus `JWT_SECRET` in case it isn't shared yet. RS256/EdDSA load `<kid>.pem` private keys and
+    /// `<kid>.pub.pem` public keys from `JWT_KEYS_DIR`.
+    pub fn load(config: &JwtConfig) -> anyhow::Result<Self> {
+        match config.algorithm {
+            Algorithm::HS256 => Ok(Self::from_secrets(config)),
+            Algorithm::RS256 | Algorithm::EdDSA => Self::from_dir(config),
+            other => anyhow::bail!("Unsupported JWT algorithm {:?}", other),
+        }
+    }
+
+    fn from_secrets(config: &JwtConfig) -> Self {
+        let mut keys = HashMap::new();
+        let mut schedule = Vec::new();
+
+        for shared in &config.shared_secrets {
+            let kid = secret_kid(&shared.secret);
+            keys.insert(kid.clone(), secret_key(&kid, &shared.secret));
+            schedule.push((shared.activates_at, kid));
+        }
+
+        let active_kid = secret_kid(&config.secret);
+        keys.entry(active_kid.clone())
+            .or_insert_with(|| secret_key(&active_kid, &config.secret));
+
+        Self {
+            active_kid,
+            keys,
+            schedule,
+        }
+    }
+
+    fn from_dir(config: &JwtConfig) -> anyhow::Result<Self> {
+        let algorithm = config.algorithm;
+        let dir = config
+            .keys_dir
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("JWT_KEYS_DIR is required for {:?}", algorithm))?;
+        let active_kid = config
+            .signing_kid
+            .as_deref()
+            .ok_or_else(|| anyhow::anyhow!("JWT_SIGNING_KID is required for {:?}", algorithm))?;
+
+        Self::load_dir(algorithm, dir, active_kid)
+    }
+
+    /// Load `<kid>.pem` / `<kid>.pub.pem` key files from `dir`, signing
+    /// with `active_kid`. Also used for federation envelope keys.
+    pub fn load_dir(algorithm: Algorithm, dir: &str, active_kid: &str) -> anyhow::Result<Self> {
+        let active_kid = active_kid.to_string();
+        let mut keys = HashMap::new();
+        for entry in fs::read_dir(dir)? {
+            let path = entry?.path();
+            let Some(name) = path.file_name().and_then(|n| n.to_str()) else {
+                continue;
+            };
+            let Some(kid) = name.strip_suffix(".pub.pem") else {
+                continue;
+            };
+
+            let key = load_public_key(algorithm, kid, &path)?;
+            keys.insert(kid.to_string(), key);
+        }
+
+        let active = keys
+            .get_mut(&active_kid)
+            .ok_or_else(|| anyhow::anyhow!("No public key {}.pub.pem in {}", active_kid, dir))?;
+        let private_pem = fs::read(Path::new(dir).join(format!("{}.pem", active_kid)))?;
+        active.encoding = Some(match algorithm {
+            Algorithm::RS256 => EncodingKey::from_rsa_pem(&private_pem)?,
+            _ => EncodingKey::from_ed_pem(&private_pem)?,
+        });
+
+        Ok(Self {
+            active_kid,
+            keys,
+            schedule: Vec::new(),
+        })
+    }
+
+    /// Sign claims with the active key
+    pub fn sign<T: Serialize>(&self, claims: &T) -> AppResult<String> {
+        let now = Utc::now();
+        let kid = self
+            .schedule
+            .iter()
+            .rev()
+            .find(|(activates_at, _)| *activates_at <= now)
+            .map_or(&self.active_kid, |(_, kid)| kid);
+        let key = self
+            .keys
+            .get(kid)
+            .and_then(|k| k.encoding.as_ref().map(|e| (k, e)));
+        let Some((key, encoding)) = key else {
+            return Err(anyhow::anyhow!("No active JWT signing key").into());
+        };
+
+        let mut header = Header::new(key.algorithm);
+        header.kid = Some(key.kid.clone());
+
+        Ok(encode(&header, claims, encoding)?)
+    }
+
+    /// Verify a token against the key named by its `kid`. Tokens issued
+    /// before kids were introduced are checked against the HS256 keys.
+    pub fn verify<T: DeserializeOwned>(&self, token: &str) -> AppResult<T> {
+        let header = decode_header(token)?;
+
+        let candidates: Vec<&JwtKey> = match &header.kid {
+            Some(kid) => self.keys.get(kid).into_iter().collect(),
+            None => self
+                .keys
+                .values()
+                .filter(|k| k.algorithm == Algorithm::HS256)
+                .collect(),
+        };
+
+        let mut last_error = jsonwebtoken::errors::Error::from(ErrorKind::InvalidSignature);
+        for key in candidates {
+            if key.algorithm != header.alg {
+                continue;
+            }
+
+            match decode::<T>(token, &key.decoding, &Validation::new(key.algorithm)) {
+                Ok(data) => return Ok(data.claims),
+                Err(e) => last_error = e,
+            }
+        }
+
+        Err(last_error.into())
+    }
+
+    /// Public keys as a JWKS document; empty for HS256, whose keys are secret
+    pub fn jwks(&self) -> serde_json::Value {
+        let mut keys: Vec<&serde_json::Value> =
+            self.keys.values().filter_map(|k| k.jwk.as_ref()).collect();
+        keys.sort_by_key(|jwk| jwk["kid"].as_str().unwrap_or_default().to_string());
+
+        serde_json::json!({ "keys": keys })
+    }
+}
+
+/// Derive a stable kid from a shared secret without revealing it
+pub fn secret_kid(secret: &str) -> String {
+    let digest = Sha256::digest(secret.as_bytes());
+    let prefix: String = digest[..4].iter().map(|b| format!("{:02x}", b)).collect();
+    format!("hs256-{}", prefix)
+}
+
+fn secret_key(kid: &str, secret: &str) -> JwtKey {
+    JwtKey {
+        kid: kid.to_string(),
+        algorithm: Algorithm::HS256,
+        encoding: Some(EncodingKey::from_secret(secret.as_bytes())),
+        decoding: DecodingKey::from_secret(secret.as_bytes()),
+        jwk: None,
+    }
+}
+
+fn load_public_key(algorithm: Algorithm, kid: &str, path: &Path) -> anyhow::Result<JwtKey> {
+    let pem = fs::read_to_string(path)?;
+
+    let (decoding, jwk) = match algorithm {
+        Algorithm::RS256 => {
+            let public_key = RsaPublicKey::from_public_key_pem(&pem)?;
+            let jwk = serde_json::json!({
+                "kty": "RSA",
+                "kid": kid,
+                "use": "sig",
+                "alg": "RS256",
+                "n": URL_SAFE_NO_PAD.encode(public_key.n().to_bytes_be()),
+                "e": URL_SAFE_NO_PAD.encode(public_key.e().to_bytes_be()),
+            });
+            (DecodingKey::from_rsa_pem(pem.as_bytes())?, jwk)
+        }
+        _ => {
+            let der = pem_body(&pem)?;
+            if der.len() != ED25519_SPKI_LEN {
+                anyhow::bail!("{} is not an Ed25519 public key", path.display());
+            }
+            let jwk = serde_json::json!({
+                "kty": "OKP",
+                "crv": "Ed25519",
+                "kid": kid,
+                "use": "sig",
+                "alg": "EdDSA",
+                "x": URL_SAFE_NO_PAD.encode(&der[ED25519_SPKI_LEN - 32..]),
+            });
+            (DecodingKey::from_ed_pem(pem.as_bytes())?, jwk)
+        }
+    };
+
+    Ok(JwtKey {
+        kid: kid.to_string(),
+        algorithm,
+        encoding: None,
+        decoding,
+        jwk: Some(jwk),
+    })
+}
+
+fn pem_body(pem: &str) -> anyhow::Result<Vec<u8>> {
+    let body: String = pem
+        .lines()
+        .filter(|line| !line.starts_with("-----"))
+        .map(str::trim)
+        .collect();
+
+    Ok(base64::engine::general_purpose::STANDARD.decode(body)?)
+}
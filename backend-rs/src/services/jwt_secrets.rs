@@ -0,0 +1,96 @@
+use std::time::Duration;
+
+use chrono::{DateTime, Utc};
+use sqlx::{FromRow, PgPool};
+
+use crate::{config::JwtConfig, error::AppResult, services::jwt_keys::secret_kid};
+
+/// An HS256 secret in the shared set and when it starts signing
+#[derive(Debug, Clone, PartialEq, Eq, FromRow)]
+pub struct SharedJwtSecret {
+    pub secret: String,
+    pub activates_at: DateTime<Utc>,
+}
+
+/// HS256 secrets shared by every replica through the database. A replica
+/// registers its `JWT_SECRET` with an activation time far enough ahead that
+/// every other replica has loaded it by then, so no replica sees a token
+/// signed with a key it doesn't know. A superseded secret keeps verifying
+/// until the tokens it signed have expired. Retired rows are never deleted,
+/// so a replica still configured with an old secret can't make it current
+/// again.
+pub struct JwtSecretsService {
+    db: PgPool,
+}
+
+impl JwtSecretsService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Register this replica's secret (unless the region is read-only) and
+    /// load the shared set into `jwt`. Replicas sync every `interval`.
+    pub async fn sync(
+        &self,
+        jwt: &mut JwtConfig,
+        read_only: bool,
+        interval: Duration,
+    ) -> anyhow::Result<()> {
+        if !read_only {
+            self.register(&jwt.secret, interval * 2).await?;
+        }
+
+        // Refresh tokens are JWTs too, so a superseded secret has to outlive
+        // whichever TTL is longer
+        let overlap = jwt.access_token_ttl.max(jwt.refresh_token_ttl);
+        jwt.shared_secrets = self.load(overlap).await?;
+        jwt.load_keys()
+    }
+
+    /// Add `secret` to the set, signing after `activation_delay`. The first
+    /// secret signs at once; one already in the set keeps its activation.
+    async fn register(&self, secret: &str, activation_delay: Duration) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            INSERT INTO jwt_secrets (kid, secret, activates_at)
+            SELECT $1, $2,
+                   CASE
+                       WHEN EXISTS (SELECT 1 FROM jwt_secrets)
+                           THEN NOW() + make_interval(secs => $3::int4)
+                       ELSE NOW()
+                   END
+            ON CONFLICT (kid) DO NOTHING
+            "#,
+        )
+        .bind(secret_kid(secret))
+        .bind(secret)
+        .bind(activation_delay.as_secs() as i32)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Secrets that still verify, oldest first: the current one, any waiting
+    /// to activate, and those superseded less than `overlap` ago
+    async fn load(&self, overlap: Duration) -> AppResult<Vec<SharedJwtSecret>> {
+        let secrets = sqlx::query_as(
+            r#"
+            SELECT secret, activates_at
+            FROM (
+                SELECT secret, activates_at,
+                       LEAD(activates_at) OVER (ORDER BY activates_at) AS superseded_at
+                FROM jwt_secrets
+            ) s
+            WHERE superseded_at IS NULL
+               OR superseded_at > NOW() - make_interval(secs => $1::int4)
+            ORDER BY activates_at
+            "#,
+        )
+        .bind(overlap.as_secs() as i32)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(secrets)
+    }
+}
@@ -0,0 +1,166 @@
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{LegalHold, LegalHoldTarget},
+    services::audit::AuditService,
+};
+
+pub struct LegalHoldsService {
+    db: PgPool,
+    audit: AuditService,
+}
+
+impl LegalHoldsService {
+    pub fn new(db: PgPool) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self { db, audit }
+    }
+
+    /// Place a user or conversation under legal hold
+    pub async fn place_hold(
+        &self,
+        admin_id: Uuid,
+        target_type: LegalHoldTarget,
+        target_id: Uuid,
+        reason: &str,
+    ) -> AppResult<LegalHold> {
+        if reason.trim().is_empty() {
+            return Err(AppError::Validation("Reason is required".to_string()));
+        }
+
+        let target_exists: Option<(Uuid,)> = match target_type {
+            LegalHoldTarget::User => sqlx::query_as("SELECT id FROM users WHERE id = $1"),
+            LegalHoldTarget::Conversation => {
+                sqlx::query_as("SELECT id FROM conversations WHERE id = $1")
+            }
+        }
+        .bind(target_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if target_exists.is_none() {
+            return Err(match target_type {
+                LegalHoldTarget::User => AppError::UserNotFound,
+                LegalHoldTarget::Conversation => AppError::ConversationNotFound,
+            });
+        }
+
+        let active: Option<(Uuid,)> = sqlx::query_as(
+            "SELECT id FROM legal_holds WHERE target_type = $1 AND target_id = $2 AND released_at IS NULL",
+        )
+        .bind(target_type)
+        .bind(target_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if active.is_some() {
+            return Err(AppError::LegalHoldAlreadyActive);
+        }
+
+        let hold: LegalHold = sqlx::query_as(
+            r#"
+            INSERT INTO legal_holds (id, target_type, target_id, reason, placed_by)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(target_type)
+        .bind(target_id)
+        .bind(reason)
+        .bind(admin_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "legal_hold.placed",
+                target_type.as_str(),
+                Some(&target_id.to_string()),
+                json!({ "hold_id": hold.id, "reason": reason }),
+            )
+            .await?;
+
+        Ok(hold)
+    }
+
+    /// List legal holds
+    pub async fn list_holds(&self, admin_id: Uuid, active_only: bool) -> AppResult<Vec<LegalHold>> {
+        let holds: Vec<LegalHold> = if active_only {
+            sqlx::query_as(
+                "SELECT * FROM legal_holds WHERE released_at IS NULL ORDER BY placed_at DESC",
+            )
+            .fetch_all(&self.db)
+            .await?
+        } else {
+            sqlx::query_as("SELECT * FROM legal_holds ORDER BY placed_at DESC")
+                .fetch_all(&self.db)
+                .await?
+        };
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "legal_hold.listed",
+                "legal_hold",
+                None,
+                json!({ "active_only": active_only, "count": holds.len() }),
+            )
+            .await?;
+
+        Ok(holds)
+    }
+
+    /// Release an active legal hold
+    pub async fn release_hold(&self, admin_id: Uuid, hold_id: Uuid) -> AppResult<LegalHold> {
+        let hold: Option<LegalHold> = sqlx::query_as(
+            r#"
+            UPDATE legal_holds
+            SET released_by = $1, released_at = NOW()
+            WHERE id = $2 AND released_at IS NULL
+            RETURNING *
+            "#,
+        )
+        .bind(admin_id)
+        .bind(hold_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let hold = hold.ok_or(AppError::LegalHoldNotFound)?;
+
+        self.audit
+            .record(
+                Some(admin_id),
+                "legal_hold.released",
+                hold.target_type.as_str(),
+                Some(&hold.target_id.to_string()),
+                json!({ "hold_id": hold.id }),
+            )
+            .await?;
+
+        Ok(hold)
+    }
+
+    /// Whether a conversation or a message sender is under an active hold
+    pub async fn is_held(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<bool> {
+        let held: Option<(i64,)> = sqlx::query_as(
+            r#"
+            SELECT 1::BIGINT FROM legal_holds
+            WHERE released_at IS NULL
+            AND ((target_type = 'conversation' AND target_id = $1)
+                OR (target_type = 'user' AND target_id = $2))
+            LIMIT 1
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(held.is_some())
+    }
+}
@@ -0,0 +1,210 @@
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::LimitsConfig,
+    error::{AppError, AppResult},
+    models::{EffectiveLimits, UpdateUserLimits, UserLimitOverride, UserLimits},
+};
+
+pub struct LimitsService {
+    db: PgPool,
+    config: LimitsConfig,
+}
+
+impl LimitsService {
+    pub fn new(db: PgPool, config: LimitsConfig) -> Self {
+        Self { db, config }
+    }
+
+    /// Global defaults from configuration
+    pub fn defaults(&self) -> EffectiveLimits {
+        EffectiveLimits {
+            max_group_members: self.config.max_group_members,
+            max_conversations: self.config.max_conversations,
+            max_devices: self.config.max_devices,
+        }
+    }
+
+    /// Limits in force for a user, with any admin override applied
+    pub async fn effective_limits(&self, user_id: Uuid) -> AppResult<EffectiveLimits> {
+        let limit_override = self.get_override(user_id).await?;
+        Ok(self.apply(limit_override.as_ref()))
+    }
+
+    /// Get a user's limits and override (admin)
+    pub async fn get_user_limits(&self, user_id: Uuid) -> AppResult<UserLimits> {
+        let limit_override = self.get_override(user_id).await?;
+
+        Ok(UserLimits {
+            user_id,
+            limits: self.apply(limit_override.as_ref()),
+            limit_override,
+        })
+    }
+
+    /// Create or replace a user's override (admin)
+    pub async fn set_override(
+        &self,
+        user_id: Uuid,
+        update: &UpdateUserLimits,
+    ) -> AppResult<UserLimits> {
+        let values = [
+            update.max_group_members,
+            update.max_conversations,
+            update.max_devices,
+        ];
+        if values.iter().flatten().any(|v| *v < 1) {
+            return Err(AppError::Validation("Limits must be at least 1".to_string()));
+        }
+
+        let user_exists: Option<(Uuid,)> = sqlx::query_as("SELECT id FROM users WHERE id = $1")
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?;
+
+        if user_exists.is_none() {
+            return Err(AppError::UserNotFound);
+        }
+
+        let limit_override: UserLimitOverride = sqlx::query_as(
+            r#"
+            INSERT INTO user_limit_overrides (user_id, max_group_members, max_conversations, max_devices)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (user_id)
+            DO UPDATE SET max_group_members = $2, max_conversations = $3, max_devices = $4
+            RETURNING *
+            "#,
+        )
+        .bind(user_id)
+        .bind(update.max_group_members)
+        .bind(update.max_conversations)
+        .bind(update.max_devices)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(UserLimits {
+            user_id,
+            limits: self.apply(Some(&limit_override)),
+            limit_override: Some(limit_override),
+        })
+    }
+
+    /// Remove a user's override, restoring the global defaults (admin)
+    pub async fn clear_override(&self, user_id: Uuid) -> AppResult<()> {
+        sqlx::query("DELETE FROM user_limit_overrides WHERE user_id = $1")
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+
+        Ok(())
+    }
+
+    /// Check a new group's size against the creator's limit. `member_count`
+    /// includes the creator.
+    pub async fn ensure_group_size(&self, creator_id: Uuid, member_count: usize) -> AppResult<()> {
+        let limits = self.effective_limits(creator_id).await?;
+
+        if member_count as i64 > limits.max_group_members {
+            return Err(AppError::LimitExceeded(format!(
+                "groups are limited to {} members",
+                limits.max_group_members
+            )));
+        }
+
+        Ok(())
+    }
+
+    /// Check that an existing group has room for one more member, under its
+    /// creator's limit
+    pub async fn ensure_group_capacity(&self, conversation_id: Uuid) -> AppResult<()> {
+        let group: Option<(Uuid, i64)> = sqlx::query_as(
+            r#"
+            SELECT c.created_by, COUNT(p.user_id)
+            FROM conversations c
+            LEFT JOIN participants p ON p.conversation_id = c.id AND p.left_at IS NULL
+            WHERE c.id = $1
+            GROUP BY c.id
+            "#,
+        )
+        .bind(conversation_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let (created_by, members) = group.ok_or(AppError::ConversationNotFound)?;
+
+        self.ensure_group_size(created_by, members as usize + 1)
+            .await
+    }
+
+    /// Check that each user can join one more conversation
+    pub async fn ensure_conversation_capacity(&self, user_ids: &[Uuid]) -> AppResult<()> {
+        let counts: Vec<(Uuid, i64)> = sqlx::query_as(
+            r#"
+            SELECT user_id, COUNT(*) FROM participants
+            WHERE user_id = ANY($1) AND left_at IS NULL
+            GROUP BY user_id
+            "#,
+        )
+        .bind(user_ids)
+        .fetch_all(&self.db)
+        .await?;
+
+        for (user_id, count) in counts {
+            let limits = self.effective_limits(user_id).await?;
+            if count >= limits.max_conversations {
+                return Err(AppError::LimitExceeded(format!(
+                    "a member has reached the maximum of {} conversations",
+                    limits.max_conversations
+                )));
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Check that the user can link another device
+    pub async fn ensure_device_capacity(&self, user_id: Uuid) -> AppResult<()> {
+        let limits = self.effective_limits(user_id).await?;
+
+        let count: i64 = sqlx::query_scalar("SELECT COUNT(*) FROM devices WHERE user_id = $1")
+            .bind(user_id)
+            .fetch_one(&self.db)
+            .await?;
+
+        if count >= limits.max_devices {
+            return Err(AppError::LimitExceeded(format!(
+                "accounts are limited to {} devices; remove a device first",
+                limits.max_devices
+            )));
+        }
+
+        Ok(())
+    }
+
+    async fn get_override(&self, user_id: Uuid) -> AppResult<Option<UserLimitOverride>> {
+        let limit_override: Option<UserLimitOverride> =
+            sqlx::query_as("SELECT * FROM user_limit_overrides WHERE user_id = $1")
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        Ok(limit_override)
+    }
+
+    fn apply(&self, limit_override: Option<&UserLimitOverride>) -> EffectiveLimits {
+        let defaults = self.defaults();
+        let Some(o) = limit_override else {
+            return defaults;
+        };
+
+        EffectiveLimits {
+            max_group_members: o
+                .max_group_members
+                .map_or(defaults.max_group_members, i64::from),
+            max_conversations: o
+                .max_conversations
+                .map_or(defaults.max_conversations, i64::from),
+            max_devices: o.max_devices.map_or(defaults.max_devices, i64::from),
+        }
+    }
+}
@@ -0,0 +1,160 @@
+use std::{net::IpAddr, time::Duration};
+
+use serde_json::json;
+use sqlx::PgPool;
+
+use crate::{
+    config::LockoutConfig,
+    error::{AppError, AppResult},
+    services::audit::AuditService,
+    storage::redis::RedisClient,
+};
+
+const SCOPE_TARGET: &str = "target";
+const SCOPE_IP: &str = "ip";
+
+/// One sign-in attempt: the endpoint, what it tries to sign in as (an OTP
+/// target, or the account a refresh token names) and where it comes from
+pub struct SignInAttempt {
+    pub action: &'static str,
+    pub target: Option<String>,
+    pub ip: Option<IpAddr>,
+}
+
+impl SignInAttempt {
+    fn scopes(&self) -> Vec<(&'static str, String)> {
+        let mut scopes = Vec::new();
+        if let Some(target) = &self.target {
+            scopes.push((SCOPE_TARGET, target.clone()));
+        }
+        if let Some(ip) = self.ip {
+            scopes.push((SCOPE_IP, ip.to_string()));
+        }
+        scopes
+    }
+}
+
+/// Brute-force protection for login, OTP verification and token refresh.
+/// Failed attempts are counted in Redis per target and per client IP. Past
+/// `free_attempts`, each further attempt has to wait out a delay that
+/// doubles with every failure; at the threshold the target or IP is locked
+/// out, which is written to the audit log.
+pub struct LockoutService {
+    redis: RedisClient,
+    audit: AuditService,
+    config: LockoutConfig,
+}
+
+impl LockoutService {
+    pub fn new(db: PgPool, redis: RedisClient, config: LockoutConfig) -> Self {
+        let audit = AuditService::new(db);
+        Self {
+            redis,
+            audit,
+            config,
+        }
+    }
+
+    /// Refuse an attempt while its target or IP is delayed or locked out
+    pub async fn check(&self, attempt: &SignInAttempt) -> AppResult<()> {
+        for (scope, key) in attempt.scopes() {
+            if let Some((locked, retry_after)) = self.redis.get_login_lock(scope, &key).await? {
+                return Err(AppError::LoginLocked {
+                    scope,
+                    locked,
+                    retry_after,
+                });
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Count a failed attempt, or clear the target's failures after a
+    /// successful one. Errors that aren't a wrong code or credential, such
+    /// as an expired OTP, aren't counted.
+    pub async fn settle<T>(&self, attempt: &SignInAttempt, result: AppResult<T>) -> AppResult<T> {
+        match &result {
+            Ok(_) => {
+                if let Some(target) = &attempt.target {
+                    self.redis
+                        .clear_login_failures(SCOPE_TARGET, target)
+                        .await?;
+                }
+            }
+            Err(e) if is_credential_failure(e) => self.record_failure(attempt).await?,
+            Err(_) => {}
+        }
+
+        result
+    }
+
+    async fn record_failure(&self, attempt: &SignInAttempt) -> AppResult<()> {
+        for (scope, key) in attempt.scopes() {
+            let threshold = match scope {
+                SCOPE_TARGET => self.config.target_threshold,
+                _ => self.config.ip_threshold,
+            };
+            let failures = self
+                .redis
+                .incr_login_failures(scope, &key, self.config.window)
+                .await? as u32;
+
+            if failures >= threshold {
+                self.redis
+                    .set_login_lock(scope, &key, true, self.config.duration)
+                    .await?;
+                tracing::warn!(
+                    "Locked out {} {} after {} failed {} attempts",
+                    scope,
+                    key,
+                    failures,
+                    attempt.action
+                );
+                self.audit
+                    .record(
+                        None,
+                        "auth.locked_out",
+                        scope,
+                        Some(&key),
+                        json!({
+                            "action": attempt.action,
+                            "failures": failures,
+                            "duration": self.config.duration.as_secs(),
+                            "ip": attempt.ip,
+                        }),
+                    )
+                    .await?;
+            } else if let Some(delay) = self.delay_after(failures) {
+                self.redis.set_login_lock(scope, &key, false, delay).await?;
+            }
+        }
+
+        Ok(())
+    }
+
+    /// Wait imposed after `failures` failed attempts: none for the free
+    /// attempts, then 1s, 2s, 4s, ... up to `max_delay`
+    fn delay_after(&self, failures: u32) -> Option<Duration> {
+        let over = failures.checked_sub(self.config.free_attempts)?;
+        if over == 0 {
+            return None;
+        }
+
+        let secs = 1u64 << (over - 1).min(16);
+        Some(Duration::from_secs(secs).min(self.config.max_delay))
+    }
+}
+
+/// Errors that mean the caller got a code or credential wrong
+fn is_credential_failure(e: &AppError) -> bool {
+    matches!(
+        e,
+        AppError::InvalidOtp
+            | AppError::TooManyAttempts
+            | AppError::OtpNotVerified
+            | AppError::UserNotFound
+            | AppError::InvalidToken
+            | AppError::Jwt(_)
+    )
+}
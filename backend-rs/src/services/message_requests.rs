@@ -0,0 +1,170 @@
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        ConversationWithDetails, MessageRequestAcceptedEvent, MessageRequestStatus,
+        WS_MESSAGE_REQUEST_ACCEPTED,
+    },
+    services::{contacts::ContactsService, messaging::MessagingService, outbox::OutboxService},
+    storage::redis::RedisClient,
+};
+
+pub struct MessageRequestsService {
+    db: PgPool,
+    redis: RedisClient,
+}
+
+impl MessageRequestsService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        Self { db, redis }
+    }
+
+    /// List conversations waiting in the user's message requests
+    pub async fn list_requests(
+        &self,
+        user_id: Uuid,
+        limit: i32,
+        offset: i32,
+    ) -> AppResult<Vec<ConversationWithDetails>> {
+        let conversation_ids: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT c.id FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE p.user_id = $1 AND p.left_at IS NULL AND p.request_status = $2
+            ORDER BY COALESCE(c.last_message_at, c.created_at) DESC
+            LIMIT $3 OFFSET $4
+            "#,
+        )
+        .bind(user_id)
+        .bind(MessageRequestStatus::Pending)
+        .bind(limit)
+        .bind(offset)
+        .fetch_all(&self.db)
+        .await?;
+
+        let messaging = MessagingService::new(self.db.clone(), self.redis.clone());
+        let mut requests = Vec::with_capacity(conversation_ids.len());
+        for conversation_id in conversation_ids {
+            requests.push(messaging.get_conversation(conversation_id, user_id).await?);
+        }
+
+        Ok(requests)
+    }
+
+    /// Accept a request; the conversation moves to the main list and the
+    /// sender starts seeing receipts and presence
+    pub async fn accept(
+        &self,
+        user_id: Uuid,
+        conversation_id: Uuid,
+    ) -> AppResult<ConversationWithDetails> {
+        self.set_status(user_id, conversation_id, MessageRequestStatus::Accepted)
+            .await?;
+
+        // The sender must not miss this, so it goes through the outbox
+        let payload = serde_json::to_value(MessageRequestAcceptedEvent {
+            conversation_id,
+            user_id,
+        })
+        .map_err(|e| anyhow::anyhow!("Failed to serialize message request event: {}", e))?;
+        let mut conn = self.db.acquire().await?;
+        OutboxService::enqueue_for_participants(
+            &mut conn,
+            conversation_id,
+            user_id,
+            WS_MESSAGE_REQUEST_ACCEPTED,
+            &payload,
+        )
+        .await?;
+
+        MessagingService::new(self.db.clone(), self.redis.clone())
+            .get_conversation(conversation_id, user_id)
+            .await
+    }
+
+    /// Block the requester and leave the conversation
+    pub async fn block(&self, user_id: Uuid, conversation_id: Uuid) -> AppResult<()> {
+        let requester_id = self.requester(conversation_id).await?;
+
+        self.set_status(user_id, conversation_id, MessageRequestStatus::Blocked)
+            .await?;
+
+        if requester_id != user_id {
+            ContactsService::new(self.db.clone())
+                .block_contact(user_id, requester_id)
+                .await?;
+        }
+
+        Ok(())
+    }
+
+    /// Report the requester, then block them
+    pub async fn report(
+        &self,
+        user_id: Uuid,
+        conversation_id: Uuid,
+        reason: Option<&str>,
+    ) -> AppResult<()> {
+        let requester_id = self.requester(conversation_id).await?;
+
+        self.block(user_id, conversation_id).await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO user_reports (id, reporter_id, reported_user_id, conversation_id, reason)
+            VALUES ($1, $2, $3, $4, $5)
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(requester_id)
+        .bind(conversation_id)
+        .bind(reason)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Move a pending request to its final state; blocking also leaves the
+    /// conversation
+    async fn set_status(
+        &self,
+        user_id: Uuid,
+        conversation_id: Uuid,
+        status: MessageRequestStatus,
+    ) -> AppResult<()> {
+        let result = sqlx::query(
+            r#"
+            UPDATE participants
+            SET request_status = $1,
+                left_at = CASE WHEN $1 = 'blocked'::message_request_status THEN NOW() ELSE left_at END
+            WHERE conversation_id = $2 AND user_id = $3 AND left_at IS NULL AND request_status = 'pending'
+            "#,
+        )
+        .bind(status)
+        .bind(conversation_id)
+        .bind(user_id)
+        .execute(&self.db)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::MessageRequestNotFound);
+        }
+
+        Ok(())
+    }
+
+    /// The user who started the conversation
+    async fn requester(&self, conversation_id: Uuid) -> AppResult<Uuid> {
+        let created_by: Option<Uuid> =
+            sqlx::query_scalar("SELECT created_by FROM conversations WHERE id = $1")
+                .bind(conversation_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        created_by.ok_or(AppError::MessageRequestNotFound)
+    }
+}
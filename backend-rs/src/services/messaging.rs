@@ -1,15 +1,34 @@
+use std::sync::Arc;
+
 use chrono::Utc;
 use serde::{Deserialize, Serialize};
-use sqlx::PgPool;
+use sqlx::{types::Json, PgConnection, PgPool};
 use uuid::Uuid;
 
 use crate::{
     error::{AppError, AppResult},
     models::{
-        Conversation, ConversationType, ConversationWithDetails, Message, MessageStatus,
-        MessageType, Participant, ParticipantRole, ParticipantWithUser, ReceiptType, User,
+        Conversation, ConversationSearchResult, ConversationState, ConversationType,
+        ConversationWithDetails, DeliveryReport, ImportSource, InvalidMember, Message,
+        MessageRequestStatus, MessageStatus, MessageType, Participant, ParticipantRole,
+        ParticipantWithUser, Receipt, ReceiptType, SearchMatch, SystemEvent, TypingEvent, User,
+        UserStatus, Watermark, EVENT_CONVERSATION_CREATED, EVENT_CONVERSATION_UPDATED,
+        EVENT_MESSAGE_CREATED, EVENT_MESSAGE_DELETED, MAX_FORMAT_VERSION, WS_CONVERSATION_STATE,
+        WS_NEW_MESSAGE, WS_TYPING,
+    },
+    services::{
+        archives::ArchiveService,
+        events::EventsService,
+        legal_holds::LegalHoldsService,
+        limits::LimitsService,
+        outbox::OutboxService,
+        publisher,
+        spam::{SpamAction, SpamService},
+    },
+    storage::{
+        redis::RedisClient,
+        repos::{MessageRepo, PgMessageRepo},
     },
-    storage::redis::RedisClient,
 };
 
 #[derive(Debug, Serialize, Deserialize)]
@@ -19,14 +38,29 @@ pub struct WsMessage {
     pub payload: serde_json::Value,
 }
 
+const MAX_SLOW_MODE_SECONDS: i32 = 24 * 60 * 60;
+
 pub struct MessagingService {
     db: PgPool,
     redis: RedisClient,
+    messages: Arc<dyn MessageRepo>,
 }
 
 impl MessagingService {
     pub fn new(db: PgPool, redis: RedisClient) -> Self {
-        Self { db, redis }
+        let messages = Arc::new(PgMessageRepo::new(db.clone()));
+        Self::with_repos(db, redis, messages)
+    }
+
+    /// Reads and receipts go through `messages`; sends, deletes and
+    /// conversation changes still use the pool, since they commit outbox
+    /// events in the same transaction
+    pub fn with_repos(db: PgPool, redis: RedisClient, messages: Arc<dyn MessageRepo>) -> Self {
+        Self {
+            db,
+            redis,
+            messages,
+        }
     }
 
     /// Create or get existing direct conversation
@@ -34,7 +68,14 @@ impl MessagingService {
         &self,
         user_id: Uuid,
         other_user_id: Uuid,
+        workspace_id: Option<Uuid>,
+        limits: &LimitsService,
     ) -> AppResult<ConversationWithDetails> {
+        if let Some(workspace_id) = workspace_id {
+            self.ensure_workspace_members(workspace_id, &[user_id, other_user_id])
+                .await?;
+        }
+
         // Check if conversation already exists
         let existing: Option<Conversation> = sqlx::query_as(
             r#"
@@ -44,10 +85,12 @@ impl MessagingService {
             WHERE c.type = 'direct'
             AND p1.user_id = $1 AND p2.user_id = $2
             AND p1.left_at IS NULL AND p2.left_at IS NULL
+            AND c.workspace_id IS NOT DISTINCT FROM $3
             "#,
         )
         .bind(user_id)
         .bind(other_user_id)
+        .bind(workspace_id)
         .fetch_optional(&self.db)
         .await?;
 
@@ -55,58 +98,251 @@ impl MessagingService {
             return self.get_conversation(conv.id, user_id).await;
         }
 
+        limits
+            .ensure_conversation_capacity(&[user_id, other_user_id])
+            .await?;
+
+        // Strangers land in the recipient's message requests
+        let other_request_status = if self.is_contact_of(other_user_id, user_id).await? {
+            None
+        } else {
+            Some(MessageRequestStatus::Pending)
+        };
+
         // Create new conversation
         let mut tx = self.db.begin().await?;
 
         let conv_id = Uuid::new_v4();
         let conversation: Conversation = sqlx::query_as(
             r#"
-            INSERT INTO conversations (id, type, created_by)
-            VALUES ($1, $2, $3)
+            INSERT INTO conversations (id, type, created_by, workspace_id)
+            VALUES ($1, $2, $3, $4)
             RETURNING *
             "#,
         )
         .bind(conv_id)
         .bind(ConversationType::Direct)
         .bind(user_id)
+        .bind(workspace_id)
         .fetch_one(&mut *tx)
         .await?;
 
         // Add both participants
-        for uid in [user_id, other_user_id] {
+        for (uid, request_status) in [(user_id, None), (other_user_id, other_request_status)] {
             sqlx::query(
                 r#"
-                INSERT INTO participants (id, conversation_id, user_id, role, joined_at)
-                VALUES ($1, $2, $3, $4, NOW())
+                INSERT INTO participants (id, conversation_id, user_id, role, joined_at, request_status)
+                VALUES ($1, $2, $3, $4, NOW(), $5)
                 "#,
             )
             .bind(Uuid::new_v4())
             .bind(conv_id)
             .bind(uid)
             .bind(ParticipantRole::Member)
+            .bind(request_status)
             .execute(&mut *tx)
             .await?;
         }
 
+        EventsService::append(
+            &mut tx,
+            conv_id,
+            Some(user_id),
+            EVENT_CONVERSATION_CREATED,
+            serde_json::json!({
+                "type": ConversationType::Direct,
+                "member_ids": [user_id, other_user_id],
+            }),
+        )
+        .await?;
+
         tx.commit().await?;
 
         self.get_conversation(conversation.id, user_id).await
     }
 
+    /// Parse, dedupe and verify a group member list, dropping the creator.
+    /// Every bad entry is reported at once.
+    pub async fn resolve_group_members(
+        &self,
+        user_id: Uuid,
+        member_ids: &[String],
+    ) -> AppResult<Vec<Uuid>> {
+        let mut invalid = Vec::new();
+        let mut members: Vec<Uuid> = Vec::with_capacity(member_ids.len());
+
+        for raw in member_ids {
+            match Uuid::parse_str(raw.trim()) {
+                Ok(id) if id == user_id || members.contains(&id) => {}
+                Ok(id) => members.push(id),
+                Err(_) => invalid.push(InvalidMember {
+                    id: raw.clone(),
+                    reason: "invalid_uuid".to_string(),
+                }),
+            }
+        }
+
+        let existing: Vec<Uuid> = sqlx::query_scalar("SELECT id FROM users WHERE id = ANY($1)")
+            .bind(&members)
+            .fetch_all(&self.db)
+            .await?;
+
+        for id in members.iter().filter(|id| !existing.contains(id)) {
+            invalid.push(InvalidMember {
+                id: id.to_string(),
+                reason: "user_not_found".to_string(),
+            });
+        }
+
+        if !invalid.is_empty() {
+            return Err(AppError::InvalidMembers(invalid));
+        }
+
+        Ok(members)
+    }
+
     /// Create a group conversation
     pub async fn create_group_conversation(
         &self,
         user_id: Uuid,
         name: &str,
         member_ids: Vec<Uuid>,
+        workspace_id: Option<Uuid>,
+        limits: &LimitsService,
+    ) -> AppResult<ConversationWithDetails> {
+        let members = member_ids
+            .into_iter()
+            .map(|id| (id, ParticipantRole::Member))
+            .collect();
+
+        self.insert_group(user_id, name, members, workspace_id, None, limits)
+            .await
+    }
+
+    /// Start a new group with the structure of one the caller owns: its
+    /// name (unless `name` is given), avatar and settings, and those of its
+    /// current members the caller confirmed in `member_ids`, in the same
+    /// roles. Messages are not copied.
+    pub async fn clone_group_conversation(
+        &self,
+        user_id: Uuid,
+        source_id: Uuid,
+        name: Option<&str>,
+        member_ids: Vec<Uuid>,
+        limits: &LimitsService,
+    ) -> AppResult<ConversationWithDetails> {
+        let source: Option<Conversation> = sqlx::query_as(
+            r#"
+            SELECT c.* FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(source_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let source = source.ok_or(AppError::NotParticipant)?;
+        if source.conversation_type != ConversationType::Group {
+            return Err(AppError::Validation(
+                "Only groups can be cloned".to_string(),
+            ));
+        }
+
+        // Guests are tied to a single widget session and aren't carried over
+        let current: Vec<(Uuid, ParticipantRole)> = sqlx::query_as(
+            r#"
+            SELECT p.user_id, p.role FROM participants p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.conversation_id = $1 AND p.left_at IS NULL AND u.is_guest = false
+            "#,
+        )
+        .bind(source_id)
+        .fetch_all(&self.db)
+        .await?;
+        if !current
+            .iter()
+            .any(|(id, role)| *id == user_id && *role == ParticipantRole::Owner)
+        {
+            return Err(AppError::Forbidden);
+        }
+
+        let mut invalid = Vec::new();
+        let mut members = Vec::with_capacity(member_ids.len());
+        for member_id in member_ids {
+            match current.iter().find(|(id, _)| *id == member_id) {
+                // The caller owns the clone, so other owners become admins
+                Some((_, ParticipantRole::Owner)) => {
+                    members.push((member_id, ParticipantRole::Admin))
+                }
+                Some((_, role)) => members.push((member_id, *role)),
+                None => invalid.push(InvalidMember {
+                    id: member_id.to_string(),
+                    reason: "not_a_member".to_string(),
+                }),
+            }
+        }
+        if !invalid.is_empty() {
+            return Err(AppError::InvalidMembers(invalid));
+        }
+
+        let name = name.or(source.name.as_deref()).unwrap_or_default();
+        self.insert_group(
+            user_id,
+            name,
+            members,
+            source.workspace_id,
+            Some(&source),
+            limits,
+        )
+        .await
+    }
+
+    /// Create a group owned by `user_id` with the other `members` in the
+    /// given roles, copying the avatar and settings of `template` if set
+    async fn insert_group(
+        &self,
+        user_id: Uuid,
+        name: &str,
+        members: Vec<(Uuid, ParticipantRole)>,
+        workspace_id: Option<Uuid>,
+        template: Option<&Conversation>,
+        limits: &LimitsService,
     ) -> AppResult<ConversationWithDetails> {
+        let name = name.trim();
+        if name.is_empty() || name.chars().count() > 100 {
+            return Err(AppError::Validation(
+                "Group name must be between 1 and 100 characters".to_string(),
+            ));
+        }
+
+        let member_ids: Vec<Uuid> = members.iter().map(|(id, _)| *id).collect();
+        let mut all_members = vec![user_id];
+        all_members.extend(member_ids.iter().copied().filter(|id| *id != user_id));
+
+        limits.ensure_group_size(user_id, all_members.len()).await?;
+        limits.ensure_conversation_capacity(&all_members).await?;
+
+        if let Some(workspace_id) = workspace_id {
+            self.ensure_workspace_members(workspace_id, &all_members).await?;
+        }
+
+        // Members who haven't added the creator get the group as a request
+        let known_by: Vec<Uuid> = sqlx::query_scalar(
+            "SELECT user_id FROM contacts WHERE contact_id = $1 AND user_id = ANY($2) AND is_blocked = false",
+        )
+        .bind(user_id)
+        .bind(&member_ids)
+        .fetch_all(&self.db)
+        .await?;
+
         let mut tx = self.db.begin().await?;
 
         let conv_id = Uuid::new_v4();
         let conversation: Conversation = sqlx::query_as(
             r#"
-            INSERT INTO conversations (id, type, name, created_by)
-            VALUES ($1, $2, $3, $4)
+            INSERT INTO conversations (id, type, name, created_by, workspace_id, avatar_url, slow_mode_seconds, share_links_enabled)
+            VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, 0), COALESCE($8, true))
             RETURNING *
             "#,
         )
@@ -114,6 +350,10 @@ impl MessagingService {
         .bind(ConversationType::Group)
         .bind(name)
         .bind(user_id)
+        .bind(workspace_id)
+        .bind(template.and_then(|t| t.avatar_url.as_deref()))
+        .bind(template.map(|t| t.slow_mode_seconds))
+        .bind(template.map(|t| t.share_links_enabled))
         .fetch_one(&mut *tx)
         .await?;
 
@@ -132,23 +372,53 @@ impl MessagingService {
         .await?;
 
         // Add members
-        for member_id in member_ids {
+        for &(member_id, role) in &members {
             if member_id != user_id {
+                let request_status =
+                    (!known_by.contains(&member_id)).then_some(MessageRequestStatus::Pending);
                 sqlx::query(
                     r#"
-                    INSERT INTO participants (id, conversation_id, user_id, role, joined_at)
-                    VALUES ($1, $2, $3, $4, NOW())
+                    INSERT INTO participants (id, conversation_id, user_id, role, joined_at, request_status)
+                    VALUES ($1, $2, $3, $4, NOW(), $5)
                     "#,
                 )
                 .bind(Uuid::new_v4())
                 .bind(conv_id)
                 .bind(member_id)
-                .bind(ParticipantRole::Member)
+                .bind(role)
+                .bind(request_status)
                 .execute(&mut *tx)
                 .await?;
             }
         }
 
+        let mut payload = serde_json::json!({
+            "type": ConversationType::Group,
+            "name": name,
+            "member_ids": all_members,
+        });
+        if let Some(template) = template {
+            payload["cloned_from"] = serde_json::json!(template.id);
+        }
+        EventsService::append(
+            &mut tx,
+            conv_id,
+            Some(user_id),
+            EVENT_CONVERSATION_CREATED,
+            payload,
+        )
+        .await?;
+
+        Self::post_system_message(
+            &mut tx,
+            conv_id,
+            user_id,
+            SystemEvent::MemberAdded {
+                user_ids: all_members[1..].to_vec(),
+            },
+        )
+        .await?;
+
         tx.commit().await?;
 
         self.get_conversation(conversation.id, user_id).await
@@ -161,17 +431,14 @@ impl MessagingService {
         user_id: Uuid,
     ) -> AppResult<ConversationWithDetails> {
         // Check if user is participant
-        let is_participant: Option<(i64,)> = sqlx::query_as(
-            "SELECT 1 FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        let state: ConversationState = sqlx::query_as(
+            "SELECT conversation_id, marked_unread, flagged_at FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
         )
         .bind(conversation_id)
         .bind(user_id)
         .fetch_optional(&self.db)
-        .await?;
-
-        if is_participant.is_none() {
-            return Err(AppError::NotParticipant);
-        }
+        .await?
+        .ok_or(AppError::NotParticipant)?;
 
         let conversation: Option<Conversation> =
             sqlx::query_as("SELECT * FROM conversations WHERE id = $1")
@@ -190,11 +457,28 @@ impl MessagingService {
         .await?;
 
         let mut participants_with_users = Vec::with_capacity(participants.len());
-        for participant in participants {
-            let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
+        for mut participant in participants {
+            let mut user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
                 .bind(participant.user_id)
                 .fetch_optional(&self.db)
                 .await?;
+
+            // No presence leaks to the sender before a request is accepted
+            let pending = participant.request_status == Some(MessageRequestStatus::Pending);
+            if pending && participant.user_id != user_id {
+                if let Some(user) = user.as_mut() {
+                    user.status = UserStatus::Offline;
+                    user.last_seen_at = None;
+                }
+            }
+
+            let account_read_receipts = user.as_ref().map_or(true, |u| u.read_receipts);
+            if participant.user_id != user_id
+                && !participant.shares_read_receipts(account_read_receipts)
+            {
+                participant.read_up_to = None;
+            }
+
             participants_with_users.push(ParticipantWithUser { participant, user });
         }
 
@@ -202,8 +486,12 @@ impl MessagingService {
         let unread_count: (i64,) = sqlx::query_as(
             r#"
             SELECT COUNT(*) FROM messages m
-            LEFT JOIN receipts r ON m.id = r.message_id AND r.user_id = $2 AND r.type = 'read'
-            WHERE m.conversation_id = $1 AND m.sender_id != $2 AND r.id IS NULL AND m.deleted_at IS NULL
+            WHERE m.conversation_id = $1 AND m.sender_id != $2 AND m.deleted_at IS NULL
+            AND m.shadow_limited = FALSE
+            AND m.created_at > COALESCE(
+                (SELECT read_up_to FROM participants WHERE conversation_id = $1 AND user_id = $2),
+                '-infinity'
+            )
             "#,
         )
         .bind(conversation_id)
@@ -211,11 +499,17 @@ impl MessagingService {
         .fetch_one(&self.db)
         .await?;
 
-        // Get last message
+        // Get last message; shadow-limited ones only show to their sender
         let last_message: Option<Message> = sqlx::query_as(
-            "SELECT * FROM messages WHERE conversation_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC LIMIT 1",
+            r#"
+            SELECT * FROM messages
+            WHERE conversation_id = $1 AND deleted_at IS NULL
+            AND (shadow_limited = FALSE OR sender_id = $2)
+            ORDER BY created_at DESC LIMIT 1
+            "#,
         )
         .bind(conversation_id)
+        .bind(user_id)
         .fetch_optional(&self.db)
         .await?;
 
@@ -224,6 +518,8 @@ impl MessagingService {
             participants: participants_with_users,
             unread_count: unread_count.0,
             last_message,
+            marked_unread: state.marked_unread,
+            flagged_at: state.flagged_at,
         })
     }
 
@@ -231,14 +527,39 @@ impl MessagingService {
     pub async fn get_user_conversations(
         &self,
         user_id: Uuid,
+        workspace_id: Option<Uuid>,
         limit: i32,
         offset: i32,
     ) -> AppResult<Vec<ConversationWithDetails>> {
+        let conversations = self
+            .list_conversations(user_id, workspace_id, limit, offset)
+            .await?;
+
+        let mut result = Vec::with_capacity(conversations.len());
+        for conv in conversations {
+            let details = self.get_conversation(conv.id, user_id).await?;
+            result.push(details);
+        }
+
+        Ok(result)
+    }
+
+    /// One page of the user's conversation list without the per-conversation
+    /// details, for callers that load those in batches
+    pub async fn list_conversations(
+        &self,
+        user_id: Uuid,
+        workspace_id: Option<Uuid>,
+        limit: i32,
+        offset: i32,
+    ) -> AppResult<Vec<Conversation>> {
         let conversations: Vec<Conversation> = sqlx::query_as(
             r#"
             SELECT c.* FROM conversations c
             JOIN participants p ON c.id = p.conversation_id
             WHERE p.user_id = $1 AND p.left_at IS NULL
+            AND p.request_status IS DISTINCT FROM 'pending'
+            AND c.workspace_id IS NOT DISTINCT FROM $4
             ORDER BY COALESCE(c.last_message_at, c.created_at) DESC
             LIMIT $2 OFFSET $3
             "#,
@@ -246,16 +567,137 @@ impl MessagingService {
         .bind(user_id)
         .bind(limit)
         .bind(offset)
+        .bind(workspace_id)
         .fetch_all(&self.db)
         .await?;
 
-        let mut result = Vec::with_capacity(conversations.len());
-        for conv in conversations {
-            let details = self.get_conversation(conv.id, user_id).await?;
-            result.push(details);
+        Ok(conversations)
+    }
+
+    /// Changes whenever any page of `get_user_conversations` would: when a
+    /// conversation in the list, one of its participants (read markers
+    /// included) or their users change, or one joins or leaves the list
+    pub async fn conversation_list_watermark(
+        &self,
+        user_id: Uuid,
+        workspace_id: Option<Uuid>,
+    ) -> AppResult<Watermark> {
+        let watermark: Watermark = sqlx::query_as(
+            r#"
+            SELECT COUNT(DISTINCT c.id) AS count,
+                   MAX(GREATEST(c.updated_at, p.updated_at, op.updated_at, u.updated_at)) AS latest
+            FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            LEFT JOIN participants op ON op.conversation_id = c.id
+            LEFT JOIN users u ON u.id = op.user_id
+            WHERE p.user_id = $1 AND p.left_at IS NULL
+            AND p.request_status IS DISTINCT FROM 'pending'
+            AND c.workspace_id IS NOT DISTINCT FROM $2
+            "#,
+        )
+        .bind(user_id)
+        .bind(workspace_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(watermark)
+    }
+
+    /// A conversation the user currently takes part in, without details
+    pub async fn find_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<Conversation> {
+        let conversation: Option<Conversation> = sqlx::query_as(
+            r#"
+            SELECT c.* FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        conversation.ok_or(AppError::NotParticipant)
+    }
+
+    /// Find the user's conversations whose group name, or another
+    /// participant's display name or username, contains `query`. Most recently
+    /// active first, like the conversation list.
+    pub async fn search_conversations(
+        &self,
+        user_id: Uuid,
+        workspace_id: Option<Uuid>,
+        query: &str,
+        limit: i32,
+    ) -> AppResult<Vec<ConversationSearchResult>> {
+        let query = query.trim();
+        if query.is_empty() {
+            return Err(AppError::BadRequest("Search query required".to_string()));
         }
 
-        Ok(result)
+        let pattern = format!(
+            "%{}%",
+            query.replace('\\', "\\\\").replace('%', "\\%").replace('_', "\\_")
+        );
+        let conversation_ids: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT c.id FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE p.user_id = $1 AND p.left_at IS NULL
+            AND p.request_status IS DISTINCT FROM 'pending'
+            AND c.workspace_id IS NOT DISTINCT FROM $2
+            AND (
+                c.name ILIKE $3
+                OR EXISTS (
+                    SELECT 1 FROM participants op
+                    JOIN users u ON u.id = op.user_id
+                    WHERE op.conversation_id = c.id AND op.user_id != $1 AND op.left_at IS NULL
+                    AND (u.display_name ILIKE $3 OR u.username ILIKE $3)
+                )
+            )
+            ORDER BY COALESCE(c.last_message_at, c.created_at) DESC
+            LIMIT $4
+            "#,
+        )
+        .bind(user_id)
+        .bind(workspace_id)
+        .bind(&pattern)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut results = Vec::with_capacity(conversation_ids.len());
+        for conversation_id in conversation_ids {
+            let conversation = self.get_conversation(conversation_id, user_id).await?;
+
+            let mut matches = Vec::new();
+            if let Some(name) = &conversation.conversation.name {
+                matches.extend(SearchMatch::find("name", None, name, query));
+            }
+            for participant in &conversation.participants {
+                let Some(user) = participant.user.as_ref().filter(|u| u.id != user_id) else {
+                    continue;
+                };
+                matches.extend(SearchMatch::find(
+                    "display_name",
+                    Some(user.id),
+                    &user.display_name,
+                    query,
+                ));
+                matches.extend(SearchMatch::find("username", Some(user.id), &user.username, query));
+            }
+
+            results.push(ConversationSearchResult {
+                conversation,
+                matches,
+            });
+        }
+
+        Ok(results)
     }
 
     /// Send a message
@@ -267,7 +709,28 @@ impl MessagingService {
         content: Vec<u8>,
         sticker_id: Option<Uuid>,
         reply_to_id: Option<Uuid>,
+        format_version: Option<i16>,
     ) -> AppResult<Message> {
+        if message_type == MessageType::System {
+            return Err(AppError::Validation(
+                "System messages are generated by the server".to_string(),
+            ));
+        }
+
+        if let Some(version) = format_version {
+            if !(1..=MAX_FORMAT_VERSION).contains(&version) {
+                return Err(AppError::Validation(format!(
+                    "Unsupported format version {}; the newest supported is {}",
+                    version, MAX_FORMAT_VERSION
+                )));
+            }
+            if message_type == MessageType::Sticker {
+                return Err(AppError::Validation(
+                    "Sticker messages cannot be formatted".to_string(),
+                ));
+            }
+        }
+
         // Check if sender is participant
         let is_participant: Option<(i64,)> = sqlx::query_as(
             "SELECT 1 FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
@@ -281,39 +744,190 @@ impl MessagingService {
             return Err(AppError::NotParticipant);
         }
 
+        let imported: Option<ImportSource> =
+            sqlx::query_scalar("SELECT imported_from FROM conversations WHERE id = $1")
+                .bind(conversation_id)
+                .fetch_one(&self.db)
+                .await?;
+        if imported.is_some() {
+            return Err(AppError::ConversationReadOnly);
+        }
+
+        // There is no foreign key on reply_to_id since messages is partitioned.
+        // The quoted message must be one the sender can see in this
+        // conversation, or its metadata would leak across conversations.
+        let reply_to = match reply_to_id {
+            Some(reply_to_id) => Some(
+                self.messages
+                    .quoted(conversation_id, sender_id, &[reply_to_id])
+                    .await?
+                    .pop()
+                    .ok_or(AppError::MessageNotFound)?,
+            ),
+            None => None,
+        };
+
+        self.enforce_slow_mode(conversation_id, sender_id).await?;
+
+        let spam_action = SpamService::new(self.db.clone(), self.redis.clone())
+            .evaluate(sender_id, conversation_id, &content)
+            .await?;
+
+        if let Some(SpamAction::Throttle { retry_after }) = spam_action {
+            return Err(AppError::RateLimited(retry_after));
+        }
+
+        let mut tx = self.db.begin().await?;
+
         // Create message
-        let message: Message = sqlx::query_as(
+        let (message_id, created_at) = Message::new_id();
+        let seq = Self::next_seq(&mut tx, conversation_id).await?;
+        let mut message: Message = sqlx::query_as(
             r#"
-            INSERT INTO messages (id, conversation_id, sender_id, type, content, sticker_id, reply_to_id, status)
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            INSERT INTO messages (id, conversation_id, sender_id, type, content, sticker_id, reply_to_id, format_version, status, shadow_limited, created_at, seq)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
             RETURNING *
             "#,
         )
-        .bind(Uuid::new_v4())
+        .bind(message_id)
         .bind(conversation_id)
         .bind(sender_id)
         .bind(message_type)
         .bind(&content)
         .bind(sticker_id)
         .bind(reply_to_id)
+        .bind(format_version)
         .bind(MessageStatus::Sent)
-        .fetch_one(&self.db)
+        .bind(spam_action == Some(SpamAction::ShadowLimit))
+        .bind(created_at)
+        .bind(seq)
+        .fetch_one(&mut *tx)
         .await?;
+        message.reply_to = reply_to;
+
+        // Shadow-limited messages are stored but never delivered; the sender
+        // sees a normal response
+        if spam_action == Some(SpamAction::ShadowLimit) {
+            tx.commit().await?;
+            return Ok(message);
+        }
 
         // Update conversation last_message_at
         sqlx::query("UPDATE conversations SET last_message_at = NOW(), updated_at = NOW() WHERE id = $1")
             .bind(conversation_id)
-            .execute(&self.db)
+            .execute(&mut *tx)
             .await?;
 
-        // Notify participants
-        self.notify_participants(conversation_id, sender_id, &message)
+        // Replying to a message request accepts it
+        sqlx::query(
+            "UPDATE participants SET request_status = 'accepted' WHERE conversation_id = $1 AND user_id = $2 AND request_status = 'pending'",
+        )
+        .bind(conversation_id)
+        .bind(sender_id)
+        .execute(&mut *tx)
+        .await?;
+
+        // Notify participants via the outbox, atomically with the message
+        let payload = serde_json::to_value(&message)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize message: {}", e))?;
+        OutboxService::enqueue_for_participants(
+            &mut tx,
+            conversation_id,
+            sender_id,
+            WS_NEW_MESSAGE,
+            &payload,
+        )
+        .await?;
+
+        EventsService::append(
+            &mut tx,
+            conversation_id,
+            Some(sender_id),
+            EVENT_MESSAGE_CREATED,
+            payload,
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        Ok(message)
+    }
+
+    /// Take the conversation's next message sequence number. The row lock
+    /// is held until the transaction commits, so numbers become visible in
+    /// order.
+    async fn next_seq(conn: &mut PgConnection, conversation_id: Uuid) -> AppResult<i64> {
+        let seq: i64 = sqlx::query_scalar(
+            "UPDATE conversations SET message_seq = message_seq + 1 WHERE id = $1 RETURNING message_seq",
+        )
+        .bind(conversation_id)
+        .fetch_one(&mut *conn)
+        .await?;
+
+        Ok(seq)
+    }
+
+    /// Post a server-generated system message on behalf of `actor_id` and
+    /// notify the other participants. Must be called inside the transaction
+    /// that makes the change it describes.
+    pub async fn post_system_message(
+        conn: &mut PgConnection,
+        conversation_id: Uuid,
+        actor_id: Uuid,
+        event: SystemEvent,
+    ) -> AppResult<Message> {
+        let (message_id, created_at) = Message::new_id();
+        let seq = Self::next_seq(&mut *conn, conversation_id).await?;
+        let message: Message = sqlx::query_as(
+            r#"
+            INSERT INTO messages (id, conversation_id, sender_id, type, content, system_event, status, created_at, seq)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+            RETURNING *
+            "#,
+        )
+        .bind(message_id)
+        .bind(conversation_id)
+        .bind(actor_id)
+        .bind(MessageType::System)
+        .bind(Vec::<u8>::new())
+        .bind(Json(&event))
+        .bind(MessageStatus::Sent)
+        .bind(created_at)
+        .bind(seq)
+        .fetch_one(&mut *conn)
+        .await?;
+
+        sqlx::query("UPDATE conversations SET last_message_at = NOW(), updated_at = NOW() WHERE id = $1")
+            .bind(conversation_id)
+            .execute(&mut *conn)
             .await?;
 
+        let payload = serde_json::to_value(&message)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize message: {}", e))?;
+        OutboxService::enqueue_for_participants(
+            &mut *conn,
+            conversation_id,
+            actor_id,
+            WS_NEW_MESSAGE,
+            &payload,
+        )
+        .await?;
+
+        EventsService::append(
+            &mut *conn,
+            conversation_id,
+            Some(actor_id),
+            EVENT_MESSAGE_CREATED,
+            payload,
+        )
+        .await?;
+
         Ok(message)
     }
 
-    /// Get messages for a conversation
+    /// Get messages for a conversation. When the page runs past what is
+    /// still in Postgres, it is filled from the archive tier; archived history
+    /// is paged with `before` only, as `offset` counts rows in Postgres.
     pub async fn get_messages(
         &self,
         conversation_id: Uuid,
@@ -321,138 +935,402 @@ impl MessagingService {
         limit: i32,
         offset: i32,
         before: Option<Uuid>,
+        archives: &ArchiveService,
     ) -> AppResult<Vec<Message>> {
-        // Check if user is participant
-        let is_participant: Option<(i64,)> = sqlx::query_as(
-            "SELECT 1 FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
-        )
-        .bind(conversation_id)
-        .bind(user_id)
-        .fetch_optional(&self.db)
-        .await?;
+        let mut messages = self
+            .page_messages(conversation_id, user_id, limit, offset, before, archives)
+            .await?;
+        self.attach_quotes(conversation_id, user_id, &mut messages)
+            .await?;
 
-        if is_participant.is_none() {
+        Ok(messages)
+    }
+
+    /// Messages after sequence number `since_seq`, oldest first. Nothing
+    /// visible is skipped, so a short page means the client has caught up.
+    /// Tokens older than the archive tier can't be resumed.
+    pub async fn sync_messages(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        since_seq: i64,
+        limit: i32,
+    ) -> AppResult<Vec<Message>> {
+        if !self.messages.is_participant(conversation_id, user_id).await? {
             return Err(AppError::NotParticipant);
         }
 
-        let messages: Vec<Message> = if let Some(before_id) = before {
-            sqlx::query_as(
-                r#"
-                SELECT * FROM messages
-                WHERE conversation_id = $1 AND deleted_at IS NULL
-                AND created_at < (SELECT created_at FROM messages WHERE id = $4)
-                ORDER BY created_at DESC
-                LIMIT $2 OFFSET $3
-                "#,
-            )
-            .bind(conversation_id)
-            .bind(limit)
-            .bind(offset)
-            .bind(before_id)
-            .fetch_all(&self.db)
-            .await?
-        } else {
-            sqlx::query_as(
-                r#"
-                SELECT * FROM messages
-                WHERE conversation_id = $1 AND deleted_at IS NULL
-                ORDER BY created_at DESC
-                LIMIT $2 OFFSET $3
-                "#,
-            )
-            .bind(conversation_id)
-            .bind(limit)
-            .bind(offset)
-            .fetch_all(&self.db)
-            .await?
+        let (archived_seq,): (i64,) =
+            sqlx::query_as("SELECT archived_message_seq FROM conversations WHERE id = $1")
+                .bind(conversation_id)
+                .fetch_one(&self.db)
+                .await?;
+        if since_seq < archived_seq {
+            return Err(AppError::SyncTokenExpired);
+        }
+
+        let mut messages = self
+            .messages
+            .list_since_seq(conversation_id, user_id, since_seq, limit)
+            .await?;
+        self.attach_quotes(conversation_id, user_id, &mut messages)
+            .await?;
+
+        Ok(messages)
+    }
+
+    /// Replies to messages that were deleted or archived since get no quote
+    async fn attach_quotes(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        messages: &mut [Message],
+    ) -> AppResult<()> {
+        let reply_ids: Vec<Uuid> = messages.iter().filter_map(|m| m.reply_to_id).collect();
+        let quoted = self
+            .messages
+            .quoted(conversation_id, user_id, &reply_ids)
+            .await?;
+        for message in messages {
+            message.reply_to = message
+                .reply_to_id
+                .and_then(|id| quoted.iter().find(|q| q.id == id).cloned());
+        }
+
+        Ok(())
+    }
+
+    async fn page_messages(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        limit: i32,
+        offset: i32,
+        before: Option<Uuid>,
+        archives: &ArchiveService,
+    ) -> AppResult<Vec<Message>> {
+        if !self.messages.is_participant(conversation_id, user_id).await? {
+            return Err(AppError::NotParticipant);
+        }
+
+        let mut messages = self
+            .messages
+            .list(conversation_id, user_id, limit, offset, before)
+            .await?;
+
+        let wanted = limit.max(0) as usize;
+        if messages.len() >= wanted || (messages.is_empty() && offset > 0) {
+            return Ok(messages);
+        }
+
+        let cursor = match (messages.last(), before) {
+            (Some(oldest), _) => Some(oldest.created_at),
+            (None, Some(before_id)) => match self.messages.find(before_id).await? {
+                Some(message) => Some(message.created_at),
+                None => match archives.created_at(conversation_id, before_id).await? {
+                    Some(created_at) => Some(created_at),
+                    // Unknown cursor
+                    None => return Ok(messages),
+                },
+            },
+            (None, None) => None,
         };
 
+        let archived = archives
+            .list(conversation_id, user_id, wanted - messages.len(), cursor)
+            .await?;
+        messages.extend(archived);
+
         Ok(messages)
     }
 
-    /// Mark message as delivered
+    /// Mark message as delivered, along with every earlier message in its
+    /// conversation
     pub async fn mark_as_delivered(&self, message_id: Uuid, user_id: Uuid) -> AppResult<()> {
-        sqlx::query(
+        // The sender sees no receipts until the request is accepted
+        if self.is_pending_request_message(message_id, user_id).await? {
+            return Ok(());
+        }
+
+        self.messages
+            .advance_pointer(message_id, user_id, ReceiptType::Delivered)
+            .await
+    }
+
+    /// Mark message as read, along with every earlier message in its
+    /// conversation
+    pub async fn mark_as_read(&self, message_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        if self.is_pending_request_message(message_id, user_id).await? {
+            return Ok(());
+        }
+
+        self.messages
+            .advance_pointer(message_id, user_id, ReceiptType::Read)
+            .await?;
+
+        // Reading clears a manual unread mark
+        let (from, to) = Message::created_at_range(message_id);
+        let cleared: Option<ConversationState> = sqlx::query_as(
             r#"
-            INSERT INTO receipts (id, message_id, user_id, type)
-            VALUES ($1, $2, $3, $4)
-            ON CONFLICT (message_id, user_id, type) DO NOTHING
+            UPDATE participants p SET marked_unread = FALSE
+            FROM messages m
+            WHERE m.id = $1 AND m.created_at >= $3 AND m.created_at < $4
+            AND p.conversation_id = m.conversation_id AND p.user_id = $2 AND p.marked_unread
+            RETURNING p.conversation_id, p.marked_unread, p.flagged_at
             "#,
         )
-        .bind(Uuid::new_v4())
         .bind(message_id)
         .bind(user_id)
-        .bind(ReceiptType::Delivered)
-        .execute(&self.db)
+        .bind(from)
+        .bind(to)
+        .fetch_optional(&self.db)
         .await?;
 
-        // Update message status if this was the last recipient
-        sqlx::query(
-            "UPDATE messages SET status = 'delivered' WHERE id = $1 AND status = 'sent'",
-        )
-        .bind(message_id)
-        .execute(&self.db)
-        .await?;
+        if let Some(state) = cleared {
+            self.sync_conversation_state(user_id, &state).await?;
+        }
 
         Ok(())
     }
 
-    /// Mark message as read
-    pub async fn mark_as_read(&self, message_id: Uuid, user_id: Uuid) -> AppResult<()> {
-        // Also mark as delivered if not already
-        sqlx::query(
-            r#"
-            INSERT INTO receipts (id, message_id, user_id, type)
-            VALUES ($1, $2, $3, $4)
-            ON CONFLICT (message_id, user_id, type) DO NOTHING
-            "#,
+    /// Stop or resume sharing read receipts in one conversation, or with
+    /// `None` go back to the account setting. The user's own read pointer
+    /// keeps moving either way; others just stop seeing it.
+    pub async fn set_read_receipts(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        enabled: Option<bool>,
+    ) -> AppResult<ConversationWithDetails> {
+        let result = sqlx::query(
+            "UPDATE participants SET read_receipts = $3 WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
         )
-        .bind(Uuid::new_v4())
-        .bind(message_id)
+        .bind(conversation_id)
         .bind(user_id)
-        .bind(ReceiptType::Delivered)
+        .bind(enabled)
         .execute(&self.db)
         .await?;
+        if result.rows_affected() == 0 {
+            return Err(AppError::NotParticipant);
+        }
 
-        sqlx::query(
-            r#"
-            INSERT INTO receipts (id, message_id, user_id, type)
-            VALUES ($1, $2, $3, $4)
-            ON CONFLICT (message_id, user_id, type) DO NOTHING
-            "#,
+        self.get_conversation(conversation_id, user_id).await
+    }
+
+    /// Mark a conversation unread for the user without moving their read
+    /// pointer, so other participants' receipts are unaffected
+    pub async fn mark_unread(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ConversationWithDetails> {
+        self.update_conversation_state(
+            conversation_id,
+            user_id,
+            "UPDATE participants SET marked_unread = TRUE WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL RETURNING conversation_id, marked_unread, flagged_at",
         )
-        .bind(Uuid::new_v4())
-        .bind(message_id)
-        .bind(user_id)
-        .bind(ReceiptType::Read)
-        .execute(&self.db)
-        .await?;
+        .await
+    }
 
-        // Update message status
-        sqlx::query(
-            "UPDATE messages SET status = 'read' WHERE id = $1 AND status IN ('sent', 'delivered')",
+    /// Flag a conversation; flagging again keeps the original time
+    pub async fn flag_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ConversationWithDetails> {
+        self.update_conversation_state(
+            conversation_id,
+            user_id,
+            "UPDATE participants SET flagged_at = COALESCE(flagged_at, NOW()) WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL RETURNING conversation_id, marked_unread, flagged_at",
         )
-        .bind(message_id)
-        .execute(&self.db)
-        .await?;
+        .await
+    }
 
-        Ok(())
+    pub async fn unflag_conversation(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ConversationWithDetails> {
+        self.update_conversation_state(
+            conversation_id,
+            user_id,
+            "UPDATE participants SET flagged_at = NULL WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL RETURNING conversation_id, marked_unread, flagged_at",
+        )
+        .await
     }
 
-    /// Delete a message (soft delete)
-    pub async fn delete_message(&self, message_id: Uuid, user_id: Uuid) -> AppResult<()> {
-        let result = sqlx::query(
-            "UPDATE messages SET deleted_at = NOW() WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL",
+    /// Who has received or read a message, derived from the other
+    /// participants' pointers
+    pub async fn get_receipts(&self, message_id: Uuid, user_id: Uuid) -> AppResult<Vec<Receipt>> {
+        let message = self
+            .messages
+            .find(message_id)
+            .await?
+            .ok_or(AppError::MessageNotFound)?;
+
+        if !self
+            .messages
+            .is_participant(message.conversation_id, user_id)
+            .await?
+        {
+            return Err(AppError::NotParticipant);
+        }
+
+        self.messages
+            .receipts(message.conversation_id, message.sender_id, message.created_at)
+            .await
+    }
+
+    /// Delivery state of a message for the double-check UI, counted from the
+    /// recipients' pointers in one query. Any participant gets the counts;
+    /// only the sender gets the per-user breakdown.
+    pub async fn get_delivery_report(
+        &self,
+        message_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<DeliveryReport> {
+        let message = self
+            .messages
+            .find(message_id)
+            .await?
+            .ok_or(AppError::MessageNotFound)?;
+
+        if !self
+            .messages
+            .is_participant(message.conversation_id, user_id)
+            .await?
+        {
+            return Err(AppError::NotParticipant);
+        }
+
+        let (recipients, delivered, read) = self
+            .messages
+            .receipt_counts(message.conversation_id, message.sender_id, message.created_at)
+            .await?;
+
+        let status = if recipients > 0 && read == recipients {
+            MessageStatus::Read
+        } else if recipients > 0 && delivered == recipients {
+            MessageStatus::Delivered
+        } else {
+            MessageStatus::Sent
+        };
+
+        let receipts = if message.sender_id == user_id {
+            Some(
+                self.messages
+                    .receipts(message.conversation_id, message.sender_id, message.created_at)
+                    .await?,
+            )
+        } else {
+            None
+        };
+
+        Ok(DeliveryReport {
+            message_id,
+            status,
+            recipients,
+            delivered,
+            read,
+            receipts,
+        })
+    }
+
+    /// Delete a message for everyone (soft delete). The encrypted content is
+    /// wiped unless the conversation or sender is under legal hold. Without
+    /// `archives`, only messages still in Postgres can be deleted.
+    pub async fn delete_message(
+        &self,
+        message_id: Uuid,
+        user_id: Uuid,
+        archives: Option<&ArchiveService>,
+    ) -> AppResult<()> {
+        let (from, to) = Message::created_at_range(message_id);
+        let conversation_id: Option<Uuid> = sqlx::query_scalar(
+            "SELECT conversation_id FROM messages WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL AND created_at >= $3 AND created_at < $4",
         )
         .bind(message_id)
         .bind(user_id)
-        .execute(&self.db)
+        .bind(from)
+        .bind(to)
+        .fetch_optional(&self.db)
         .await?;
 
+        let conversation_id = match (conversation_id, archives) {
+            (Some(conversation_id), _) => conversation_id,
+            // Older messages may have moved to the archive tier
+            (None, Some(archives)) => {
+                let conversation_id = archives
+                    .delete_message(message_id, user_id)
+                    .await?
+                    .ok_or(AppError::MessageNotFound)?;
+                let mut tx = self.db.begin().await?;
+                Self::record_deletion(&mut tx, conversation_id, message_id, user_id).await?;
+                tx.commit().await?;
+                return Ok(());
+            }
+            (None, None) => return Err(AppError::MessageNotFound),
+        };
+
+        let held = LegalHoldsService::new(self.db.clone())
+            .is_held(conversation_id, user_id)
+            .await?;
+
+        let mut tx = self.db.begin().await?;
+
+        let result = if held {
+            sqlx::query(
+                "UPDATE messages SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL AND created_at >= $2 AND created_at < $3",
+            )
+            .bind(message_id)
+            .bind(from)
+            .bind(to)
+            .execute(&mut *tx)
+            .await?
+        } else {
+            sqlx::query(
+                "UPDATE messages SET deleted_at = NOW(), content = ''::BYTEA WHERE id = $1 AND deleted_at IS NULL AND created_at >= $2 AND created_at < $3",
+            )
+            .bind(message_id)
+            .bind(from)
+            .bind(to)
+            .execute(&mut *tx)
+            .await?
+        };
+
         if result.rows_affected() == 0 {
             return Err(AppError::MessageNotFound);
         }
 
+        Self::record_deletion(&mut tx, conversation_id, message_id, user_id).await?;
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    /// Touch the conversation and log the deletion in its event stream
+    async fn record_deletion(
+        conn: &mut PgConnection,
+        conversation_id: Uuid,
+        message_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<()> {
+        // The last message may have changed, so conversation lists have too
+        sqlx::query("UPDATE conversations SET updated_at = NOW() WHERE id = $1")
+            .bind(conversation_id)
+            .execute(&mut *conn)
+            .await?;
+
+        EventsService::append(
+            conn,
+            conversation_id,
+            Some(user_id),
+            EVENT_MESSAGE_DELETED,
+            serde_json::json!({ "message_id": message_id }),
+        )
+        .await?;
+
         Ok(())
     }
 
@@ -463,6 +1341,18 @@ impl MessagingService {
         user_id: Uuid,
         is_typing: bool,
     ) -> AppResult<()> {
+        let pending: Option<Option<MessageRequestStatus>> = sqlx::query_scalar(
+            "SELECT request_status FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        if pending.flatten() == Some(MessageRequestStatus::Pending) {
+            return Ok(());
+        }
+
         let participants: Vec<(Uuid,)> = sqlx::query_as(
             "SELECT user_id FROM participants WHERE conversation_id = $1 AND user_id != $2 AND left_at IS NULL",
         )
@@ -471,22 +1361,22 @@ impl MessagingService {
         .fetch_all(&self.db)
         .await?;
 
+        let event = TypingEvent {
+            conversation_id,
+            user_id,
+            is_typing,
+            timestamp: Utc::now(),
+        };
         let message = WsMessage {
-            msg_type: "typing".to_string(),
-            payload: serde_json::json!({
-                "conversation_id": conversation_id,
-                "user_id": user_id,
-                "is_typing": is_typing,
-                "timestamp": Utc::now().to_rfc3339()
-            }),
+            msg_type: WS_TYPING.to_string(),
+            payload: serde_json::to_value(&event)?,
         };
 
         let msg_str = serde_json::to_string(&message)?;
 
+        // Typing is ephemeral: a dropped publish isn't worth failing the request
         for (participant_id,) in participants {
-            self.redis
-                .publish_message(&participant_id.to_string(), &msg_str)
-                .await?;
+            publisher::publish(&self.redis, &participant_id.to_string(), &msg_str).await;
         }
 
         Ok(())
@@ -509,34 +1399,494 @@ impl MessagingService {
         Ok(())
     }
 
-    /// Notify participants of new message
-    async fn notify_participants(
+    /// Set a group's slow mode interval; 0 turns it off. Group owners and
+    /// admins only. With `expected_version`, fails with `PreconditionFailed`
+    /// if the settings changed since the caller read them.
+    pub async fn set_slow_mode(
         &self,
         conversation_id: Uuid,
-        sender_id: Uuid,
-        message: &Message,
+        user_id: Uuid,
+        seconds: i32,
+        expected_version: Option<i32>,
+    ) -> AppResult<ConversationWithDetails> {
+        if !(0..=MAX_SLOW_MODE_SECONDS).contains(&seconds) {
+            return Err(AppError::Validation(format!(
+                "Slow mode must be between 0 and {} seconds",
+                MAX_SLOW_MODE_SECONDS
+            )));
+        }
+
+        let member: Option<(ConversationType, ParticipantRole, i32)> = sqlx::query_as(
+            r#"
+            SELECT c.type, p.role, c.version FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let (conversation_type, role, current_version) =
+            member.ok_or(AppError::NotParticipant)?;
+
+        if conversation_type != ConversationType::Group {
+            return Err(AppError::BadRequest(
+                "Slow mode is only available for groups".to_string(),
+            ));
+        }
+
+        if role == ParticipantRole::Member {
+            return Err(AppError::Forbidden);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let result = sqlx::query(
+            r#"
+            UPDATE conversations
+            SET slow_mode_seconds = $1, version = version + 1, updated_at = NOW()
+            WHERE id = $2 AND ($3::INTEGER IS NULL OR version = $3)
+            "#,
+        )
+        .bind(seconds)
+        .bind(conversation_id)
+        .bind(expected_version)
+        .execute(&mut *tx)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::PreconditionFailed { current_version });
+        }
+
+        EventsService::append(
+            &mut tx,
+            conversation_id,
+            Some(user_id),
+            EVENT_CONVERSATION_UPDATED,
+            serde_json::json!({ "slow_mode_seconds": seconds }),
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        self.get_conversation(conversation_id, user_id).await
+    }
+
+    /// Allow or stop share links for a group. Group owners and admins only.
+    /// Turning sharing off revokes every link to the group. With
+    /// `expected_version`, fails with `PreconditionFailed` if the settings
+    /// changed since the caller read them.
+    pub async fn set_share_links_enabled(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        enabled: bool,
+        expected_version: Option<i32>,
+    ) -> AppResult<ConversationWithDetails> {
+        let member: Option<(ConversationType, ParticipantRole, i32)> = sqlx::query_as(
+            r#"
+            SELECT c.type, p.role, c.version FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let (conversation_type, role, current_version) =
+            member.ok_or(AppError::NotParticipant)?;
+
+        if conversation_type != ConversationType::Group {
+            return Err(AppError::BadRequest(
+                "Sharing can only be turned off in groups".to_string(),
+            ));
+        }
+
+        if role == ParticipantRole::Member {
+            return Err(AppError::Forbidden);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let result = sqlx::query(
+            r#"
+            UPDATE conversations
+            SET share_links_enabled = $1, version = version + 1, updated_at = NOW()
+            WHERE id = $2 AND ($3::INTEGER IS NULL OR version = $3)
+            "#,
+        )
+        .bind(enabled)
+        .bind(conversation_id)
+        .bind(expected_version)
+        .execute(&mut *tx)
+        .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::PreconditionFailed { current_version });
+        }
+
+        if !enabled {
+            sqlx::query(
+                "UPDATE share_links SET revoked_at = NOW() WHERE conversation_id = $1 AND revoked_at IS NULL",
+            )
+            .bind(conversation_id)
+            .execute(&mut *tx)
+            .await?;
+        }
+
+        EventsService::append(
+            &mut tx,
+            conversation_id,
+            Some(user_id),
+            EVENT_CONVERSATION_UPDATED,
+            serde_json::json!({ "share_links_enabled": enabled }),
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        self.get_conversation(conversation_id, user_id).await
+    }
+
+    async fn update_conversation_state(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        query: &str,
+    ) -> AppResult<ConversationWithDetails> {
+        let state: ConversationState = sqlx::query_as(query)
+            .bind(conversation_id)
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?
+            .ok_or(AppError::NotParticipant)?;
+
+        self.sync_conversation_state(user_id, &state).await?;
+
+        self.get_conversation(conversation_id, user_id).await
+    }
+
+    /// Queue the user's list state for all of their devices
+    async fn sync_conversation_state(
+        &self,
+        user_id: Uuid,
+        state: &ConversationState,
     ) -> AppResult<()> {
-        let participants: Vec<(Uuid,)> = sqlx::query_as(
-            "SELECT user_id FROM participants WHERE conversation_id = $1 AND user_id != $2 AND left_at IS NULL",
+        let payload = serde_json::to_value(state)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize conversation state: {}", e))?;
+
+        let mut conn = self.db.acquire().await?;
+        OutboxService::enqueue(&mut conn, user_id, WS_CONVERSATION_STATE, &payload).await
+    }
+
+    /// Reject the send if the sender already posted within the group's slow
+    /// mode interval. Owners and admins are exempt.
+    async fn enforce_slow_mode(&self, conversation_id: Uuid, sender_id: Uuid) -> AppResult<()> {
+        let slow_mode: Option<(i32, ParticipantRole)> = sqlx::query_as(
+            r#"
+            SELECT c.slow_mode_seconds, p.role FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            AND c.type = 'group' AND c.slow_mode_seconds > 0
+            "#,
         )
         .bind(conversation_id)
         .bind(sender_id)
-        .fetch_all(&self.db)
+        .fetch_optional(&self.db)
         .await?;
 
-        let ws_message = WsMessage {
-            msg_type: "new_message".to_string(),
-            payload: serde_json::to_value(message)?,
+        let Some((seconds, role)) = slow_mode else {
+            return Ok(());
         };
 
-        let msg_str = serde_json::to_string(&ws_message)?;
+        if role != ParticipantRole::Member {
+            return Ok(());
+        }
 
-        for (participant_id,) in participants {
-            self.redis
-                .publish_message(&participant_id.to_string(), &msg_str)
-                .await?;
+        let window = std::time::Duration::from_secs(seconds as u64);
+        if let Some(retry_after) = self
+            .redis
+            .claim_slow_mode_slot(&conversation_id.to_string(), &sender_id.to_string(), window)
+            .await?
+        {
+            return Err(AppError::RateLimited(retry_after));
+        }
+
+        Ok(())
+    }
+
+    /// Whether `owner_id` has `contact_id` in their (unblocked) contacts
+    async fn is_contact_of(&self, owner_id: Uuid, contact_id: Uuid) -> AppResult<bool> {
+        let exists: bool = sqlx::query_scalar(
+            "SELECT EXISTS(SELECT 1 FROM contacts WHERE user_id = $1 AND contact_id = $2 AND is_blocked = false)",
+        )
+        .bind(owner_id)
+        .bind(contact_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(exists)
+    }
+
+    /// Whether the message sits in a conversation the user hasn't accepted yet
+    async fn is_pending_request_message(&self, message_id: Uuid, user_id: Uuid) -> AppResult<bool> {
+        let (from, to) = Message::created_at_range(message_id);
+        let pending: bool = sqlx::query_scalar(
+            r#"
+            SELECT EXISTS(
+                SELECT 1 FROM participants p
+                JOIN messages m ON m.conversation_id = p.conversation_id
+                WHERE m.id = $1 AND p.user_id = $2 AND p.request_status = 'pending'
+                AND m.created_at >= $3 AND m.created_at < $4
+            )
+            "#,
+        )
+        .bind(message_id)
+        .bind(user_id)
+        .bind(from)
+        .bind(to)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(pending)
+    }
+
+    /// Ensure every user belongs to the workspace
+    async fn ensure_workspace_members(
+        &self,
+        workspace_id: Uuid,
+        user_ids: &[Uuid],
+    ) -> AppResult<()> {
+        let mut unique_ids = user_ids.to_vec();
+        unique_ids.sort();
+        unique_ids.dedup();
+
+        let member_count: i64 = sqlx::query_scalar(
+            "SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND user_id = ANY($2)",
+        )
+        .bind(workspace_id)
+        .bind(&unique_ids)
+        .fetch_one(&self.db)
+        .await?;
+
+        if member_count != unique_ids.len() as i64 {
+            return Err(AppError::NotWorkspaceMember);
         }
 
         Ok(())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use chrono::Utc;
+    use mockall::predicate::eq;
+    use sqlx::postgres::PgPoolOptions;
+    use uuid::Uuid;
+
+    use super::MessagingService;
+    use crate::{
+        error::AppError,
+        models::{Message, MessageStatus, MessageType, Receipt, ReceiptType},
+        storage::{redis::RedisClient, repos::MockMessageRepo},
+    };
+
+    /// The service over `messages`, with a pool and Redis it never reaches
+    async fn service(messages: MockMessageRepo) -> MessagingService {
+        let db = PgPoolOptions::new()
+            .connect_lazy("postgres://localhost/unreachable")
+            .unwrap();
+        let redis = RedisClient::stub().await.unwrap();
+        MessagingService::with_repos(db, redis, Arc::new(messages))
+    }
+
+    fn message(sender_id: Uuid) -> Message {
+        Message {
+            id: Uuid::new_v4(),
+            conversation_id: Uuid::new_v4(),
+            sender_id,
+            message_type: MessageType::Text,
+            content: b"ciphertext".to_vec(),
+            sticker_id: None,
+            reply_to_id: None,
+            format_version: None,
+            system_event: None,
+            status: MessageStatus::Sent,
+            edited_at: None,
+            deleted_at: None,
+            created_at: Utc::now(),
+            seq: Some(1),
+            reply_to: None,
+        }
+    }
+
+    /// A repo that finds `message` and answers whether `user_id` is one of
+    /// its conversation's participants
+    fn repo_with(message: &Message, user_id: Uuid, participant: bool) -> MockMessageRepo {
+        let mut messages = MockMessageRepo::new();
+        let found = message.clone();
+        messages
+            .expect_find()
+            .with(eq(message.id))
+            .returning(move |_| Ok(Some(found.clone())));
+        messages
+            .expect_is_participant()
+            .with(eq(message.conversation_id), eq(user_id))
+            .returning(move |_, _| Ok(participant));
+        messages
+    }
+
+    #[tokio::test]
+    async fn receipts_of_a_missing_message_are_not_found() {
+        let mut messages = MockMessageRepo::new();
+        messages.expect_find().returning(|_| Ok(None));
+
+        let result = service(messages)
+            .await
+            .get_receipts(Uuid::new_v4(), Uuid::new_v4())
+            .await;
+
+        assert!(matches!(result, Err(AppError::MessageNotFound)));
+    }
+
+    #[tokio::test]
+    async fn receipts_are_refused_to_non_participants() {
+        let outsider = Uuid::new_v4();
+        let message = message(Uuid::new_v4());
+        let mut messages = repo_with(&message, outsider, false);
+        messages.expect_receipts().never();
+
+        let result = service(messages)
+            .await
+            .get_receipts(message.id, outsider)
+            .await;
+
+        assert!(matches!(result, Err(AppError::NotParticipant)));
+    }
+
+    #[tokio::test]
+    async fn receipts_come_from_the_conversation_pointers() {
+        let sender = Uuid::new_v4();
+        let reader = Uuid::new_v4();
+        let message = message(sender);
+        let mut messages = repo_with(&message, sender, true);
+        messages
+            .expect_receipts()
+            .with(
+                eq(message.conversation_id),
+                eq(sender),
+                eq(message.created_at),
+            )
+            .times(1)
+            .returning(move |_, _, _| {
+                Ok(vec![Receipt {
+                    user_id: reader,
+                    receipt_type: ReceiptType::Read,
+                }])
+            });
+
+        let receipts = service(messages)
+            .await
+            .get_receipts(message.id, sender)
+            .await
+            .unwrap();
+
+        assert_eq!(receipts.len(), 1);
+        assert_eq!(receipts[0].user_id, reader);
+        assert_eq!(receipts[0].receipt_type, ReceiptType::Read);
+    }
+
+    #[tokio::test]
+    async fn delivery_report_status_follows_the_counts() {
+        let sender = Uuid::new_v4();
+        for (delivered, read, status) in [
+            (0, 0, MessageStatus::Sent),
+            (1, 0, MessageStatus::Sent),
+            (2, 1, MessageStatus::Delivered),
+            (2, 2, MessageStatus::Read),
+        ] {
+            let message = message(sender);
+            let mut messages = repo_with(&message, sender, true);
+            messages
+                .expect_receipt_counts()
+                .returning(move |_, _, _| Ok((2, delivered, read)));
+            messages.expect_receipts().returning(|_, _, _| Ok(vec![]));
+
+            let report = service(messages)
+                .await
+                .get_delivery_report(message.id, sender)
+                .await
+                .unwrap();
+
+            assert_eq!(report.status, status, "{delivered} delivered, {read} read");
+            assert_eq!(
+                (report.recipients, report.delivered, report.read),
+                (2, delivered, read)
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn delivery_report_breakdown_is_only_for_the_sender() {
+        let sender = Uuid::new_v4();
+        let recipient = Uuid::new_v4();
+        let message = message(sender);
+
+        let mut messages = repo_with(&message, recipient, true);
+        messages
+            .expect_receipt_counts()
+            .returning(|_, _, _| Ok((1, 1, 0)));
+        messages.expect_receipts().never();
+        let report = service(messages)
+            .await
+            .get_delivery_report(message.id, recipient)
+            .await
+            .unwrap();
+        assert!(report.receipts.is_none());
+
+        let mut messages = repo_with(&message, sender, true);
+        messages
+            .expect_receipt_counts()
+            .returning(|_, _, _| Ok((1, 1, 0)));
+        messages
+            .expect_receipts()
+            .times(1)
+            .returning(move |_, _, _| {
+                Ok(vec![Receipt {
+                    user_id: recipient,
+                    receipt_type: ReceiptType::Delivered,
+                }])
+            });
+        let report = service(messages)
+            .await
+            .get_delivery_report(message.id, sender)
+            .await
+            .unwrap();
+        assert_eq!(report.receipts.map(|r| r.len()), Some(1));
+    }
+
+    #[tokio::test]
+    async fn sync_is_refused_to_non_participants() {
+        let conversation_id = Uuid::new_v4();
+        let outsider = Uuid::new_v4();
+        let mut messages = MockMessageRepo::new();
+        messages
+            .expect_is_participant()
+            .with(eq(conversation_id), eq(outsider))
+            .returning(|_, _| Ok(false));
+        messages.expect_list_since_seq().never();
+
+        let result = service(messages)
+            .await
+            .sync_messages(conversation_id, outsider, 0, 50)
+            .await;
+
+        assert!(matches!(result, Err(AppError::NotParticipant)));
+    }
+}
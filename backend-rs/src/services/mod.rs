@@ -1,5 +1,58 @@
+pub mod access_tokens;
+pub mod account_purge;
+pub mod abuse;
+pub mod analytics;
+pub mod archives;
+pub mod attachments;
+pub mod audit;
 pub mod auth;
+pub mod backups;
+pub mod bots;
+pub mod bridges;
+pub mod calendar;
+pub mod calls;
+pub mod circuit_breaker;
 pub mod contacts;
 pub mod crypto;
+pub mod delivery_sla;
+pub mod downloads;
+pub mod dpop;
+pub mod email_validation;
+pub mod event_listener;
+pub mod events;
+pub mod exports;
+pub mod federation;
+pub mod flags;
+pub mod guests;
+pub mod impersonation;
+pub mod imports;
+pub mod jwt_keys;
+pub mod jwt_secrets;
+pub mod legal_holds;
+pub mod limits;
+pub mod lockout;
+pub mod message_requests;
 pub mod messaging;
+pub mod notes;
+pub mod notifications;
+pub mod otp_delivery;
+pub mod otp_templates;
+pub mod outbox;
+pub mod partitions;
+pub mod payments;
+pub mod phone;
+pub mod profiles;
+pub mod publisher;
+pub mod region;
+pub mod runtime_config;
+pub mod session_anomaly;
+pub mod share_links;
+pub mod spam;
 pub mod stickers;
+pub mod storage;
+pub mod suggestions;
+pub mod tasks;
+pub mod transcoding;
+pub mod translation;
+pub mod usage;
+pub mod workspaces;
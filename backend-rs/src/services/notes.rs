@@ -0,0 +1,151 @@
+use sqlx::{types::Json, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{ConversationNote, UpdateNoteRequest, VersionVector, WS_NOTE_UPDATED},
+    services::outbox::OutboxService,
+};
+
+/// Ciphertext, so a little over the plaintext limit clients enforce
+const MAX_CONTENT_BYTES: usize = 64 * 1024;
+const MAX_VECTOR_ENTRIES: usize = 1024;
+
+/// One shared note per conversation, such as group rules or a shared list.
+/// The content is end-to-end encrypted; the server only sees who edited it
+/// and when. Each note carries a version vector counting every member's
+/// edits. An update must name a vector at least as new as the stored one
+/// in every entry, so an edit made without seeing the latest one is
+/// refused and the client merges before trying again. Members are sent
+/// `note_updated` with the new note.
+pub struct NotesService {
+    db: PgPool,
+}
+
+impl NotesService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    pub async fn get(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<ConversationNote> {
+        self.membership(conversation_id, user_id).await?;
+
+        let note: Option<ConversationNote> =
+            sqlx::query_as("SELECT * FROM conversation_notes WHERE conversation_id = $1")
+                .bind(conversation_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        Ok(note.unwrap_or_else(|| ConversationNote {
+            conversation_id,
+            content: Vec::new(),
+            version_vector: Json(VersionVector::new()),
+            updated_by: None,
+            updated_at: None,
+        }))
+    }
+
+    /// Replace the note. Fails with `NoteConflict`, carrying the stored
+    /// vector, if someone else's edit isn't reflected in
+    /// `req.version_vector`.
+    pub async fn update(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        req: &UpdateNoteRequest,
+    ) -> AppResult<ConversationNote> {
+        if self.membership(conversation_id, user_id).await? {
+            return Err(AppError::ConversationReadOnly);
+        }
+
+        if req.content.len() > MAX_CONTENT_BYTES {
+            return Err(AppError::Validation(format!(
+                "Note must be at most {} bytes",
+                MAX_CONTENT_BYTES
+            )));
+        }
+        if req.version_vector.len() > MAX_VECTOR_ENTRIES
+            || req.version_vector.values().any(|count| *count < 0)
+        {
+            return Err(AppError::Validation(format!(
+                "version_vector takes up to {} non-negative counts",
+                MAX_VECTOR_ENTRIES
+            )));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        // Make sure there is a row to lock, so concurrent first edits are
+        // ordered too
+        sqlx::query(
+            "INSERT INTO conversation_notes (conversation_id, content) VALUES ($1, '') ON CONFLICT (conversation_id) DO NOTHING",
+        )
+        .bind(conversation_id)
+        .execute(&mut *tx)
+        .await?;
+
+        let (Json(stored),): (Json<VersionVector>,) = sqlx::query_as(
+            "SELECT version_vector FROM conversation_notes WHERE conversation_id = $1 FOR UPDATE",
+        )
+        .bind(conversation_id)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let seen_everything = stored
+            .iter()
+            .all(|(user, count)| req.version_vector.get(user).is_some_and(|c| c >= count));
+        if !seen_everything {
+            return Err(AppError::NoteConflict(stored));
+        }
+
+        let mut version_vector = req.version_vector.clone();
+        *version_vector.entry(user_id).or_insert(0) += 1;
+
+        let note: ConversationNote = sqlx::query_as(
+            r#"
+            UPDATE conversation_notes
+            SET content = $2, version_vector = $3, updated_by = $4, updated_at = NOW()
+            WHERE conversation_id = $1
+            RETURNING *
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(&req.content)
+        .bind(Json(&version_vector))
+        .bind(user_id)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let payload = serde_json::to_value(&note)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize note: {}", e))?;
+        OutboxService::enqueue_for_participants(
+            &mut tx,
+            conversation_id,
+            user_id,
+            WS_NOTE_UPDATED,
+            &payload,
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        Ok(note)
+    }
+
+    /// Whether the conversation is read-only, for active participants
+    async fn membership(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<bool> {
+        let read_only: Option<bool> = sqlx::query_scalar(
+            r#"
+            SELECT c.imported_from IS NOT NULL FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        read_only.ok_or(AppError::NotParticipant)
+    }
+}
@@ -0,0 +1,148 @@
+use std::time::Duration;
+
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{Device, DeviceWithRouting, NotificationRouting},
+    storage::redis::RedisClient,
+};
+
+/// Matches the presence TTL; the socket refreshes it while frames arrive
+const WS_ACTIVITY_TTL: Duration = Duration::from_secs(300);
+const DESKTOP_PLATFORMS: &[&str] = &["macos", "windows", "linux", "web"];
+
+pub struct NotificationsService {
+    db: PgPool,
+    redis: RedisClient,
+}
+
+impl NotificationsService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        Self { db, redis }
+    }
+
+    pub async fn get_routing(&self, user_id: Uuid) -> AppResult<NotificationRouting> {
+        let routing: Option<NotificationRouting> =
+            sqlx::query_scalar("SELECT notification_routing FROM users WHERE id = $1")
+                .bind(user_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        routing.ok_or(AppError::UserNotFound)
+    }
+
+    pub async fn set_routing(
+        &self,
+        user_id: Uuid,
+        routing: NotificationRouting,
+    ) -> AppResult<NotificationRouting> {
+        let result = sqlx::query("UPDATE users SET notification_routing = $1 WHERE id = $2")
+            .bind(routing)
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+
+        if result.rows_affected() == 0 {
+            return Err(AppError::UserNotFound);
+        }
+
+        Ok(routing)
+    }
+
+    /// Mark the device as active and connected. Called when its WebSocket
+    /// opens and periodically while frames arrive. A read-only region only
+    /// marks it connected.
+    pub async fn record_ws_activity(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        read_only: bool,
+    ) -> AppResult<()> {
+        let query = if read_only {
+            "SELECT platform FROM devices WHERE user_id = $1 AND device_id = $2"
+        } else {
+            "UPDATE devices SET last_active_at = NOW() WHERE user_id = $1 AND device_id = $2 RETURNING platform"
+        };
+        let platform: Option<String> = sqlx::query_scalar(query)
+            .bind(user_id)
+            .bind(device_id)
+            .fetch_optional(&self.db)
+            .await?;
+
+        if let Some(platform) = platform {
+            self.redis
+                .set_ws_device(&user_id.to_string(), device_id, &platform, WS_ACTIVITY_TTL)
+                .await?;
+        }
+
+        Ok(())
+    }
+
+    pub async fn clear_ws_activity(&self, user_id: Uuid, device_id: i32) -> AppResult<()> {
+        self.redis
+            .delete_ws_device(&user_id.to_string(), device_id)
+            .await
+    }
+
+    /// Devices the push dispatcher should notify for this user, after
+    /// applying their routing preference
+    pub async fn push_targets(&self, user_id: Uuid) -> AppResult<Vec<Device>> {
+        let devices: Vec<Device> = sqlx::query_as(
+            r#"
+            SELECT * FROM devices
+            WHERE user_id = $1 AND push_token IS NOT NULL
+            ORDER BY last_active_at DESC
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let targets = match self.get_routing(user_id).await? {
+            NotificationRouting::All => devices,
+            NotificationRouting::MostRecent => devices.into_iter().take(1).collect(),
+            NotificationRouting::NoneWhileDesktop => {
+                let platforms = self.redis.get_ws_platforms(&user_id.to_string()).await?;
+                if platforms.iter().any(|p| DESKTOP_PLATFORMS.contains(&p.as_str())) {
+                    Vec::new()
+                } else {
+                    devices
+                }
+            }
+        };
+
+        Ok(targets)
+    }
+
+    /// All of the user's devices, most recently active first, flagged with
+    /// whether they currently receive pushes
+    pub async fn list_devices(&self, user_id: Uuid) -> AppResult<Vec<DeviceWithRouting>> {
+        let devices: Vec<Device> = sqlx::query_as(
+            r#"
+            SELECT id, user_id, device_id, name, platform, push_token, last_active_at, created_at
+            FROM devices WHERE user_id = $1
+            ORDER BY last_active_at DESC
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let targets: Vec<Uuid> = self
+            .push_targets(user_id)
+            .await?
+            .into_iter()
+            .map(|d| d.id)
+            .collect();
+
+        Ok(devices
+            .into_iter()
+            .map(|device| DeviceWithRouting {
+                receives_push: targets.contains(&device.id),
+                device,
+            })
+            .collect())
+    }
+}
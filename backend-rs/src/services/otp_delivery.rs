@@ -0,0 +1,634 @@
+use std::time::Duration;
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use lettre::{
+    message::{header::ContentType, Mailbox},
+    AsyncSmtpTransport, AsyncTransport, Message, Tokio1Executor,
+};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::OtpDeliveryConfig,
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{OtpDelivery, OtpDeliveryStatus, OtpType},
+    services::{
+        circuit_breaker::{Breakers, CircuitBreaker},
+        otp_templates::{self, OtpMessage, TemplateVars},
+    },
+};
+
+pub const OTP_DELIVERY_JOB_KIND: &str = "otp.deliver";
+
+const TWILIO_API_URL: &str = "https://api.twilio.com/2010-04-01";
+const SENDGRID_URL: &str = "https://api.sendgrid.com/v3/mail/send";
+
+const PROVIDER_TWILIO: &str = "twilio";
+const PROVIDER_SENDGRID: &str = "sendgrid";
+const PROVIDER_SMTP: &str = "smtp";
+
+/// Sender for SMTP mail when SENDGRID_FROM_EMAIL isn't set
+const SMTP_DEFAULT_FROM: &str = "otp@ansible-talk.local";
+const SMTP_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Deliveries shown to support for one target
+const HISTORY_LIMIT: i64 = 50;
+
+/// One entry of a SendGrid event webhook batch; other fields are ignored
+#[derive(Debug, Deserialize)]
+pub struct SendgridEvent {
+    pub event: String,
+    pub sg_message_id: Option<String>,
+    /// SMTP status of a bounce, e.g. `5.1.1`
+    pub status: Option<String>,
+}
+
+/// Sends OTP codes through Twilio (SMS) and SendGrid (email), records each
+/// attempt with the provider's message id, and tracks delivery from the
+/// providers' status callbacks. A code that fails on one channel is resent
+/// once on the user's other channel, if they have one. In development,
+/// email can go to a plain SMTP mail catcher instead of SendGrid. Each
+/// channel sits behind a circuit breaker: while a provider is down, sends
+/// fail fast with `DependencyUnavailable` and can be queued with `queue`.
+/// Account notices go out through the same email providers.
+pub struct OtpDeliveryService {
+    db: PgPool,
+    http: reqwest::Client,
+    breakers: Breakers,
+    config: OtpDeliveryConfig,
+    environment: String,
+}
+
+impl OtpDeliveryService {
+    pub fn new(
+        db: PgPool,
+        http: reqwest::Client,
+        breakers: Breakers,
+        config: OtpDeliveryConfig,
+        environment: String,
+    ) -> Self {
+        Self {
+            db,
+            http,
+            breakers,
+            config,
+            environment,
+        }
+    }
+
+    /// Send the target's outstanding code later, from a job worker, once
+    /// the provider is back
+    pub async fn queue(
+        &self,
+        jobs: &JobQueue,
+        target: &str,
+        otp_type: OtpType,
+        locale: &str,
+    ) -> AppResult<()> {
+        jobs.enqueue(
+            OTP_DELIVERY_JOB_KIND,
+            json!({ "target": target, "type": otp_type, "locale": locale }),
+        )
+        .await?;
+
+        Ok(())
+    }
+
+    /// Send the target's outstanding code, worded for `locale` (see
+    /// `otp_templates::negotiate`)
+    pub async fn deliver(&self, target: &str, otp_type: OtpType, locale: &str) -> AppResult<()> {
+        let (code, expires_at) = self
+            .outstanding_code(target, otp_type)
+            .await?
+            .ok_or(AppError::OtpExpired)?;
+
+        if !self.channel_enabled(otp_type) {
+            // In development, just log the code
+            if self.environment == "development" {
+                tracing::info!("{} OTP to {}: {}", channel_name(otp_type), target, code);
+                return Ok(());
+            }
+
+            tracing::warn!("No provider configured for {} OTPs", channel_name(otp_type));
+            return Err(AppError::OtpDeliveryFailed);
+        }
+
+        let message = self.render(locale, &code, expires_at);
+        let delivery = self
+            .attempt(target, otp_type, otp_type, target, &message, locale, None)
+            .await?;
+        if delivery.status != OtpDeliveryStatus::Failed {
+            return Ok(());
+        }
+
+        match self.fall_back(&delivery, &message).await? {
+            Some(fallback) if fallback.status != OtpDeliveryStatus::Failed => Ok(()),
+            _ => Err(AppError::OtpDeliveryFailed),
+        }
+    }
+
+    /// Send a plain-text account notice (not a code) by email, through the
+    /// same provider and breaker as email OTPs. Nothing is recorded; a
+    /// failure is returned so a job can retry it.
+    pub async fn send_notice(&self, email: &str, subject: &str, text: &str) -> AppResult<()> {
+        if !self.channel_enabled(OtpType::Email) {
+            if self.environment == "development" {
+                tracing::info!("Notice to {}: {}", email, subject);
+                return Ok(());
+            }
+
+            tracing::warn!("No provider configured for email notices");
+            return Err(AppError::OtpDeliveryFailed);
+        }
+
+        let breaker = self.breaker(OtpType::Email);
+        breaker.check()?;
+
+        let result = if self.config.email_enabled() {
+            self.send_email(email, subject, text).await
+        } else {
+            self.send_smtp(email, subject, text).await
+        };
+        breaker.record(!matches!(&result, Err(error_code) if is_outage(error_code)));
+
+        result.map(|_| ()).map_err(|error_code| {
+            AppError::Internal(anyhow::anyhow!("Email notice failed: {}", error_code))
+        })
+    }
+
+    /// Reject provider callbacks without the shared webhook token
+    pub fn verify_webhook_token(&self, token: Option<&str>) -> AppResult<()> {
+        match (self.config.webhook_token.as_deref(), token) {
+            (Some(expected), Some(token)) if constant_time_eq(expected, token) => Ok(()),
+            _ => Err(AppError::Unauthorized),
+        }
+    }
+
+    /// Apply a Twilio message status callback
+    pub async fn handle_twilio_status(
+        &self,
+        message_sid: &str,
+        message_status: &str,
+        error_code: Option<&str>,
+    ) -> AppResult<()> {
+        let status = match message_status {
+            "sent" => OtpDeliveryStatus::Sent,
+            "delivered" => OtpDeliveryStatus::Delivered,
+            "failed" | "undelivered" => OtpDeliveryStatus::Failed,
+            // queued, accepted, sending: nothing new
+            _ => return Ok(()),
+        };
+
+        self.update_status(PROVIDER_TWILIO, message_sid, status, error_code)
+            .await
+    }
+
+    /// Apply a batch of SendGrid delivery events
+    pub async fn handle_sendgrid_events(&self, events: &[SendgridEvent]) -> AppResult<()> {
+        for event in events {
+            let status = match event.event.as_str() {
+                "processed" => OtpDeliveryStatus::Sent,
+                "delivered" => OtpDeliveryStatus::Delivered,
+                "bounce" | "dropped" => OtpDeliveryStatus::Failed,
+                // deferred, open, click, ...: nothing new
+                _ => continue,
+            };
+
+            // Event ids extend the X-Message-Id returned at send time, e.g.
+            // `<x-message-id>.filter0001.16648.5515E0B88.0`
+            let Some(message_id) = event
+                .sg_message_id
+                .as_deref()
+                .and_then(|id| id.split('.').next())
+            else {
+                continue;
+            };
+
+            let error_code = if status == OtpDeliveryStatus::Failed {
+                Some(event.status.as_deref().unwrap_or(event.event.as_str()))
+            } else {
+                None
+            };
+
+            self.update_status(PROVIDER_SENDGRID, message_id, status, error_code)
+                .await?;
+        }
+
+        Ok(())
+    }
+
+    /// Recent deliveries for a phone number or email, newest first
+    pub async fn list_for_target(&self, target: &str) -> AppResult<Vec<OtpDelivery>> {
+        let deliveries: Vec<OtpDelivery> = sqlx::query_as(
+            r#"
+            SELECT * FROM otp_deliveries
+            WHERE target = $1 OR recipient = $1
+            ORDER BY created_at DESC
+            LIMIT $2
+            "#,
+        )
+        .bind(target)
+        .bind(HISTORY_LIMIT)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(deliveries)
+    }
+
+    fn channel_enabled(&self, channel: OtpType) -> bool {
+        match channel {
+            OtpType::Phone => self.config.sms_enabled(),
+            OtpType::Email => self.config.email_enabled() || self.smtp_enabled(),
+        }
+    }
+
+    fn smtp_enabled(&self) -> bool {
+        self.config.smtp_host.is_some() && self.environment == "development"
+    }
+
+    fn breaker(&self, channel: OtpType) -> &CircuitBreaker {
+        match channel {
+            OtpType::Phone => &self.breakers.sms,
+            OtpType::Email => &self.breakers.email,
+        }
+    }
+
+    async fn outstanding_code(
+        &self,
+        target: &str,
+        otp_type: OtpType,
+    ) -> AppResult<Option<(String, DateTime<Utc>)>> {
+        let otp: Option<(String, DateTime<Utc>)> = sqlx::query_as(
+            r#"
+            SELECT code, expires_at FROM otps
+            WHERE target = $1 AND type = $2 AND verified = false AND expires_at > NOW()
+            "#,
+        )
+        .bind(target)
+        .bind(otp_type)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(otp)
+    }
+
+    fn render(&self, locale: &str, code: &str, expires_at: DateTime<Utc>) -> OtpMessage {
+        // Round up so a code never outlives what the message promises
+        let seconds = (expires_at - Utc::now()).num_seconds().max(0);
+        otp_templates::render(
+            locale,
+            &TemplateVars {
+                code,
+                app_name: &self.config.app_name,
+                expiry_minutes: (seconds + 59) / 60,
+            },
+        )
+    }
+
+    /// Send the message on `channel` and record the attempt. Provider errors
+    /// are recorded as a failed delivery rather than returned; an open
+    /// circuit breaker is returned without recording anything.
+    async fn attempt(
+        &self,
+        target: &str,
+        otp_type: OtpType,
+        channel: OtpType,
+        recipient: &str,
+        message: &OtpMessage,
+        locale: &str,
+        fallback_for: Option<Uuid>,
+    ) -> AppResult<OtpDelivery> {
+        let breaker = self.breaker(channel);
+        breaker.check()?;
+
+        let (provider, result) = match channel {
+            OtpType::Phone => (PROVIDER_TWILIO, self.send_sms(recipient, &message.sms).await),
+            OtpType::Email if self.config.email_enabled() => (
+                PROVIDER_SENDGRID,
+                self.send_email(recipient, &message.email_subject, &message.email_body)
+                    .await,
+            ),
+            OtpType::Email => (
+                PROVIDER_SMTP,
+                self.send_smtp(recipient, &message.email_subject, &message.email_body)
+                    .await,
+            ),
+        };
+        breaker.record(!matches!(&result, Err(error_code) if is_outage(error_code)));
+
+        let (message_id, status, error_code) = match result {
+            // SMTP has no status callbacks; a message the server accepted is sent
+            Ok(message_id) if provider == PROVIDER_SMTP => {
+                (Some(message_id), OtpDeliveryStatus::Sent, None)
+            }
+            Ok(message_id) => (Some(message_id), OtpDeliveryStatus::Queued, None),
+            Err(error_code) => {
+                tracing::warn!(
+                    "OTP {} via {} failed: {}",
+                    channel_name(channel),
+                    provider,
+                    error_code
+                );
+                (None, OtpDeliveryStatus::Failed, Some(error_code))
+            }
+        };
+
+        let delivery: OtpDelivery = sqlx::query_as(
+            r#"
+            INSERT INTO otp_deliveries
+                (id, target, type, channel, recipient, provider, provider_message_id, status, error_code, fallback_for, locale)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(target)
+        .bind(otp_type)
+        .bind(channel)
+        .bind(recipient)
+        .bind(provider)
+        .bind(message_id)
+        .bind(status)
+        .bind(error_code)
+        .bind(fallback_for)
+        .bind(locale)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(delivery)
+    }
+
+    /// Move a delivery forward. A delivery reaching `failed` here triggers the
+    /// fallback with the code that is still outstanding for the target.
+    async fn update_status(
+        &self,
+        provider: &str,
+        message_id: &str,
+        status: OtpDeliveryStatus,
+        error_code: Option<&str>,
+    ) -> AppResult<()> {
+        // Final states stay put, so a late or repeated callback is a no-op
+        let delivery: Option<OtpDelivery> = sqlx::query_as(
+            r#"
+            UPDATE otp_deliveries
+            SET status = $3, error_code = COALESCE($4, error_code), updated_at = NOW()
+            WHERE provider = $1 AND provider_message_id = $2
+              AND status NOT IN ('delivered', 'failed')
+            RETURNING *
+            "#,
+        )
+        .bind(provider)
+        .bind(message_id)
+        .bind(status)
+        .bind(error_code)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let Some(delivery) = delivery.filter(|d| d.status == OtpDeliveryStatus::Failed) else {
+            return Ok(());
+        };
+
+        let otp = self
+            .outstanding_code(&delivery.target, delivery.otp_type)
+            .await?;
+        if let Some((code, expires_at)) = otp {
+            let message = self.render(&delivery.locale, &code, expires_at);
+            self.fall_back(&delivery, &message).await?;
+        }
+
+        Ok(())
+    }
+
+    /// Resend a failed code on the user's other channel. Only the original
+    /// attempt falls back, and only for registered users with both a phone
+    /// number and an email.
+    async fn fall_back(
+        &self,
+        failed: &OtpDelivery,
+        message: &OtpMessage,
+    ) -> AppResult<Option<OtpDelivery>> {
+        let channel = failed.channel.other();
+        if failed.fallback_for.is_some() || !self.channel_enabled(channel) {
+            return Ok(None);
+        }
+
+        let query = match failed.otp_type {
+            OtpType::Phone => "SELECT email FROM users WHERE phone = $1 AND email IS NOT NULL",
+            OtpType::Email => "SELECT phone FROM users WHERE email = $1 AND phone IS NOT NULL",
+        };
+        let recipient: Option<String> = sqlx::query_scalar(query)
+            .bind(&failed.target)
+            .fetch_optional(&self.db)
+            .await?;
+
+        let Some(recipient) = recipient else {
+            return Ok(None);
+        };
+
+        let result = self
+            .attempt(
+                &failed.target,
+                failed.otp_type,
+                channel,
+                &recipient,
+                message,
+                &failed.locale,
+                Some(failed.id),
+            )
+            .await;
+
+        match result {
+            Ok(delivery) => Ok(Some(delivery)),
+            Err(AppError::DependencyUnavailable { .. }) => Ok(None),
+            Err(e) => Err(e),
+        }
+    }
+
+    /// Send through Twilio; returns the message SID or an error code
+    async fn send_sms(&self, phone: &str, text: &str) -> Result<String, String> {
+        let account_sid = self.config.twilio_account_sid.as_deref().unwrap_or_default();
+        let url = format!("{}/Accounts/{}/Messages.json", TWILIO_API_URL, account_sid);
+
+        let mut form = vec![
+            ("To", phone.to_string()),
+            (
+                "From",
+                self.config.twilio_from_number.clone().unwrap_or_default(),
+            ),
+            ("Body", text.to_string()),
+        ];
+        if let Some(callback) = self.callback_url("twilio") {
+            form.push(("StatusCallback", callback));
+        }
+
+        let response = self
+            .http
+            .post(&url)
+            .basic_auth(account_sid, self.config.twilio_auth_token.as_deref())
+            .form(&form)
+            .send()
+            .await
+            .map_err(|_| "unreachable".to_string())?;
+
+        let status = response.status();
+        let body: Value = response.json().await.unwrap_or(Value::Null);
+        if !status.is_success() {
+            // Twilio error codes (21211 invalid number, ...) say more than
+            // the HTTP status
+            return Err(body
+                .get("code")
+                .map(|c| c.to_string())
+                .unwrap_or_else(|| format!("http_{}", status.as_u16())));
+        }
+
+        body.get("sid")
+            .and_then(Value::as_str)
+            .map(str::to_string)
+            .ok_or_else(|| "missing_sid".to_string())
+    }
+
+    /// Send through SendGrid; returns the X-Message-Id or an error code
+    async fn send_email(&self, email: &str, subject: &str, text: &str) -> Result<String, String> {
+        let body = json!({
+            "personalizations": [{ "to": [{ "email": email }] }],
+            "from": { "email": self.config.sendgrid_from_email, "name": self.config.app_name },
+            "subject": subject,
+            "content": [{ "type": "text/plain", "value": text }],
+        });
+
+        let response = self
+            .http
+            .post(SENDGRID_URL)
+            .bearer_auth(self.config.sendgrid_api_key.as_deref().unwrap_or_default())
+            .json(&body)
+            .send()
+            .await
+            .map_err(|_| "unreachable".to_string())?;
+
+        let status = response.status();
+        if !status.is_success() {
+            return Err(format!("http_{}", status.as_u16()));
+        }
+
+        response
+            .headers()
+            .get("X-Message-Id")
+            .and_then(|v| v.to_str().ok())
+            .map(str::to_string)
+            .ok_or_else(|| "missing_message_id".to_string())
+    }
+
+    /// Send through the plain SMTP server; returns the Message-ID or an
+    /// error code
+    async fn send_smtp(&self, email: &str, subject: &str, text: &str) -> Result<String, String> {
+        let host = self.config.smtp_host.as_deref().unwrap_or_default();
+        let from = self
+            .config
+            .sendgrid_from_email
+            .as_deref()
+            .unwrap_or(SMTP_DEFAULT_FROM)
+            .parse()
+            .map_err(|_| "invalid_from".to_string())?;
+        let to = email.parse().map_err(|_| "invalid_recipient".to_string())?;
+        let message_id = format!("<{}@{}>", Uuid::new_v4(), host);
+
+        let message = Message::builder()
+            .from(Mailbox::new(Some(self.config.app_name.clone()), from))
+            .to(Mailbox::new(None, to))
+            .subject(subject)
+            .message_id(Some(message_id.clone()))
+            .header(ContentType::TEXT_PLAIN)
+            .body(text.to_string())
+            .map_err(|_| "invalid_message".to_string())?;
+
+        let transport = AsyncSmtpTransport::<Tokio1Executor>::builder_dangerous(host)
+            .port(self.config.smtp_port)
+            .timeout(Some(SMTP_TIMEOUT))
+            .build();
+        transport
+            .send(message)
+            .await
+            .map_err(|e| if e.is_permanent() { "rejected" } else { "unreachable" }.to_string())?;
+
+        Ok(message_id)
+    }
+
+    fn callback_url(&self, provider: &str) -> Option<String> {
+        let base = self.config.webhook_base_url.as_deref()?;
+        let token = self.config.webhook_token.as_deref()?;
+        Some(format!(
+            "{}/api/v1/webhooks/{}?token={}",
+            base.trim_end_matches('/'),
+            provider,
+            token
+        ))
+    }
+}
+
+/// Queued delivery of an outstanding code, retried with the job runner's
+/// backoff while the provider's breaker is open
+pub struct OtpDeliveryJob {
+    delivery: OtpDeliveryService,
+}
+
+impl OtpDeliveryJob {
+    pub fn new(delivery: OtpDeliveryService) -> Self {
+        Self { delivery }
+    }
+}
+
+#[derive(Debug, Deserialize)]
+struct OtpDeliveryPayload {
+    target: String,
+    #[serde(rename = "type")]
+    otp_type: OtpType,
+    locale: String,
+}
+
+#[async_trait]
+impl JobHandler for OtpDeliveryJob {
+    fn kind(&self) -> &'static str {
+        OTP_DELIVERY_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let payload: OtpDeliveryPayload = serde_json::from_value(job.payload.clone())
+            .map_err(|e| anyhow::anyhow!("Invalid OTP delivery job: {}", e))?;
+
+        match self
+            .delivery
+            .deliver(&payload.target, payload.otp_type, &payload.locale)
+            .await
+        {
+            // Expired or already used while queued: nothing left to send
+            Err(AppError::OtpExpired) => Ok(()),
+            result => result,
+        }
+    }
+}
+
+/// Provider errors that point at the provider being down rather than at
+/// the message (an invalid number, a rejected address)
+fn is_outage(error_code: &str) -> bool {
+    error_code == "unreachable" || error_code.starts_with("http_5")
+}
+
+fn channel_name(channel: OtpType) -> &'static str {
+    match channel {
+        OtpType::Phone => "sms",
+        OtpType::Email => "email",
+    }
+}
+
+pub fn constant_time_eq(a: &str, b: &str) -> bool {
+    a.len() == b.len()
+        && a
+            .bytes()
+            .zip(b.bytes())
+            .fold(0u8, |acc, (x, y)| acc | (x ^ y))
+            == 0
+}
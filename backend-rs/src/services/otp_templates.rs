@@ -0,0 +1,130 @@
+//! Localized OTP message content. Templates live in `templates/otp/<locale>.json`
+//! and are compiled into the binary; `{code}`, `{app_name}` and
+//! `{expiry_minutes}` are filled in when a message is rendered.
+
+use std::{collections::HashMap, sync::OnceLock};
+
+use serde::Deserialize;
+
+pub const DEFAULT_LOCALE: &str = "en";
+
+/// Embedded template files, in the order primary-language matches prefer
+const TEMPLATE_FILES: &[(&str, &str)] = &[
+    ("en", include_str!("../../templates/otp/en.json")),
+    ("zh-TW", include_str!("../../templates/otp/zh-TW.json")),
+    ("zh-CN", include_str!("../../templates/otp/zh-CN.json")),
+    ("ja", include_str!("../../templates/otp/ja.json")),
+    ("ko", include_str!("../../templates/otp/ko.json")),
+    ("es", include_str!("../../templates/otp/es.json")),
+    ("fr", include_str!("../../templates/otp/fr.json")),
+    ("de", include_str!("../../templates/otp/de.json")),
+];
+
+#[derive(Debug, Deserialize)]
+struct OtpTemplate {
+    sms: String,
+    email_subject: String,
+    email_body: String,
+}
+
+/// A rendered OTP message for one channel's provider to send
+#[derive(Debug, Clone)]
+pub struct OtpMessage {
+    pub sms: String,
+    pub email_subject: String,
+    pub email_body: String,
+}
+
+pub struct TemplateVars<'a> {
+    pub code: &'a str,
+    pub app_name: &'a str,
+    pub expiry_minutes: i64,
+}
+
+fn templates() -> &'static HashMap<&'static str, OtpTemplate> {
+    static TEMPLATES: OnceLock<HashMap<&'static str, OtpTemplate>> = OnceLock::new();
+    TEMPLATES.get_or_init(|| {
+        TEMPLATE_FILES
+            .iter()
+            .map(|(locale, source)| {
+                let template = serde_json::from_str(source)
+                    .unwrap_or_else(|e| panic!("Invalid OTP template {}: {}", locale, e));
+                (*locale, template)
+            })
+            .collect()
+    })
+}
+
+/// Render the message for a locale returned by `negotiate`
+pub fn render(locale: &str, vars: &TemplateVars) -> OtpMessage {
+    let templates = templates();
+    let template = templates
+        .get(locale)
+        .unwrap_or_else(|| &templates[DEFAULT_LOCALE]);
+
+    let fill = |text: &str| {
+        text.replace("{code}", vars.code)
+            .replace("{app_name}", vars.app_name)
+            .replace("{expiry_minutes}", &vars.expiry_minutes.to_string())
+    };
+
+    OtpMessage {
+        sms: fill(&template.sms),
+        email_subject: fill(&template.email_subject),
+        email_body: fill(&template.email_body),
+    }
+}
+
+/// Pick a template locale: the request's explicit `locale` first, then the
+/// Accept-Language ranges by quality, then English
+pub fn negotiate(locale: Option<&str>, accept_language: Option<&str>) -> &'static str {
+    let mut ranges: Vec<(&str, f32)> = accept_language
+        .unwrap_or_default()
+        .split(',')
+        .filter_map(|part| {
+            let mut params = part.split(';');
+            let tag = params.next()?.trim();
+            let quality = params
+                .find_map(|p| p.trim().strip_prefix("q="))
+                .and_then(|q| q.parse().ok())
+                .unwrap_or(1.0);
+            (!tag.is_empty() && quality > 0.0).then_some((tag, quality))
+        })
+        .collect();
+    // Stable, so equal qualities keep the header's order
+    ranges.sort_by(|a, b| b.1.total_cmp(&a.1));
+
+    locale
+        .into_iter()
+        .chain(ranges.into_iter().map(|(tag, _)| tag))
+        .find_map(match_locale)
+        .unwrap_or(DEFAULT_LOCALE)
+}
+
+/// The template locale for a language tag (`zh-Hant-HK`, `pt_BR`, `fr`, ...)
+fn match_locale(tag: &str) -> Option<&'static str> {
+    let tag = tag.trim().replace('_', "-").to_lowercase();
+
+    if let Some((locale, _)) = TEMPLATE_FILES
+        .iter()
+        .find(|(locale, _)| locale.to_lowercase() == tag)
+    {
+        return Some(locale);
+    }
+
+    // Chinese is told apart by script, or by region when no script is given
+    let subtags: Vec<&str> = tag.split('-').collect();
+    let language = subtags[0];
+    if language == "zh" {
+        let traditional = !subtags.contains(&"hans")
+            && subtags
+                .iter()
+                .any(|s| matches!(*s, "hant" | "tw" | "hk" | "mo"));
+        return Some(if traditional { "zh-TW" } else { "zh-CN" });
+    }
+
+    TEMPLATE_FILES
+        .iter()
+        .map(|(locale, _)| *locale)
+        .find(|locale| locale.split('-').next() == Some(language))
+}
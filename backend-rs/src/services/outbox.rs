@@ -0,0 +1,431 @@
+use std::time::Duration;
+
+use sqlx::{PgConnection, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{DeliveryLag, PendingEvent, QueuedEvent, RealtimeQueueStats, RecipientBacklog},
+    services::{event_listener::Wakeup, messaging::WsMessage, publisher},
+    storage::redis::RedisClient,
+};
+
+const DISPATCH_BATCH_SIZE: i64 = 100;
+const DISPATCH_POLL_INTERVAL: Duration = Duration::from_millis(200);
+const DELIVERED_RETENTION_HOURS: i32 = 24;
+/// Failed publishes before an event is dead-lettered
+const MAX_DISPATCH_ATTEMPTS: i32 = 10;
+/// Delay after the first failed publish, doubling with each further one
+const RETRY_BASE_SECONDS: i32 = 1;
+const RETRY_MAX_SECONDS: i32 = 5 * 60;
+const POLL_BATCH_SIZE: i64 = 100;
+/// Recently delivered events that delivery lag is measured over
+const LAG_WINDOW_SECONDS: i32 = 5 * 60;
+
+#[derive(Debug, sqlx::FromRow)]
+struct OutboxEvent {
+    id: i64,
+    recipient_id: Uuid,
+    event_type: String,
+    payload: serde_json::Value,
+}
+
+pub struct OutboxService {
+    db: PgPool,
+    redis: RedisClient,
+}
+
+impl OutboxService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        Self { db, redis }
+    }
+
+    /// Record an event for every active participant of a conversation except
+    /// `exclude_user_id`. Must be called inside the transaction that makes the
+    /// change, so the event is persisted if and only if the change commits.
+    pub async fn enqueue_for_participants(
+        conn: &mut PgConnection,
+        conversation_id: Uuid,
+        exclude_user_id: Uuid,
+        event_type: &str,
+        payload: &serde_json::Value,
+    ) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            INSERT INTO outbox_events (recipient_id, event_type, payload)
+            SELECT user_id, $3, $4
+            FROM participants
+            WHERE conversation_id = $1 AND user_id != $2 AND left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(exclude_user_id)
+        .bind(event_type)
+        .bind(payload)
+        .execute(conn)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Record an event for a single user, e.g. to sync state across their
+    /// own devices
+    pub async fn enqueue(
+        conn: &mut PgConnection,
+        recipient_id: Uuid,
+        event_type: &str,
+        payload: &serde_json::Value,
+    ) -> AppResult<()> {
+        sqlx::query(
+            "INSERT INTO outbox_events (recipient_id, event_type, payload) VALUES ($1, $2, $3)",
+        )
+        .bind(recipient_id)
+        .bind(event_type)
+        .bind(payload)
+        .execute(conn)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Events queued for a user after `after_id`, oldest first. Polling
+    /// clients read the queue directly; delivered events stay readable for
+    /// the retention window.
+    pub async fn events_after(
+        &self,
+        recipient_id: Uuid,
+        after_id: i64,
+        limit: i64,
+    ) -> AppResult<Vec<QueuedEvent>> {
+        let events: Vec<QueuedEvent> = sqlx::query_as(
+            r#"
+            SELECT id, event_type, payload, created_at FROM outbox_events
+            WHERE recipient_id = $1 AND id > $2
+            ORDER BY id ASC
+            LIMIT $3
+            "#,
+        )
+        .bind(recipient_id)
+        .bind(after_id)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(events)
+    }
+
+    /// Id of the newest event queued for a user, or 0 if there is none
+    pub async fn latest_event_id(&self, recipient_id: Uuid) -> AppResult<i64> {
+        let id: Option<i64> =
+            sqlx::query_scalar("SELECT MAX(id) FROM outbox_events WHERE recipient_id = $1")
+                .bind(recipient_id)
+                .fetch_one(&self.db)
+                .await?;
+
+        Ok(id.unwrap_or(0))
+    }
+
+    /// Long-poll the queue: return events after `after_id` as soon as there
+    /// are any, or an empty list once `timeout` passes. `wakeup` must be
+    /// subscribed for `recipient_id` before the call, so an event dispatched
+    /// between reads still wakes us up.
+    pub async fn wait_for_events(
+        &self,
+        wakeup: &mut Wakeup,
+        recipient_id: Uuid,
+        after_id: i64,
+        timeout: Duration,
+    ) -> AppResult<Vec<QueuedEvent>> {
+        let events = self.events_after(recipient_id, after_id, POLL_BATCH_SIZE).await?;
+        if !events.is_empty() {
+            return Ok(events);
+        }
+
+        let _ = tokio::time::timeout(timeout, wakeup.wait()).await;
+
+        self.events_after(recipient_id, after_id, POLL_BATCH_SIZE).await
+    }
+
+    /// Pending depth, delivery lag and the biggest per-user backlogs, or
+    /// only `user_id`'s backlog when given
+    pub async fn queue_stats(
+        &self,
+        user_id: Option<Uuid>,
+        limit: i64,
+    ) -> AppResult<RealtimeQueueStats> {
+        let recipients: Vec<RecipientBacklog> = sqlx::query_as(
+            r#"
+            SELECT recipient_id AS user_id,
+                   COUNT(*) AS pending,
+                   MIN(created_at) AS oldest_pending_at,
+                   MAX(attempts) AS max_attempts
+            FROM outbox_events
+            WHERE delivered_at IS NULL AND failed_at IS NULL
+              AND ($1::uuid IS NULL OR recipient_id = $1)
+            GROUP BY recipient_id
+            ORDER BY pending DESC, oldest_pending_at ASC
+            LIMIT $2
+            "#,
+        )
+        .bind(user_id)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(RealtimeQueueStats {
+            pending: self.pending_count().await?,
+            failed: self.failed_count().await?,
+            oldest_pending: self.oldest_pending().await?,
+            delivery_lag: self.delivery_lag().await?,
+            dropped_publishes: publisher::dropped_publishes(),
+            recipients,
+        })
+    }
+
+    /// Render queue depth and delivery lag in the Prometheus text format
+    pub async fn prometheus_metrics(&self) -> AppResult<String> {
+        let pending = self.pending_count().await?;
+        let failed = self.failed_count().await?;
+        let oldest_pending = self.oldest_pending().await?;
+        let lag = self.delivery_lag().await?;
+        let mut out = String::new();
+
+        out.push_str("# TYPE ansible_talk_outbox_pending gauge\n");
+        out.push_str(&format!("ansible_talk_outbox_pending {}\n", pending));
+        out.push_str("# TYPE ansible_talk_outbox_failed gauge\n");
+        out.push_str(&format!("ansible_talk_outbox_failed {}\n", failed));
+        out.push_str("# TYPE ansible_talk_outbox_oldest_pending_seconds gauge\n");
+        out.push_str(&format!(
+            "ansible_talk_outbox_oldest_pending_seconds {}\n",
+            oldest_pending.map_or(0.0, |e| e.age_seconds)
+        ));
+
+        out.push_str("# TYPE ansible_talk_outbox_delivery_lag_seconds gauge\n");
+        for (stat, value) in [
+            ("avg", lag.avg_seconds),
+            ("p95", lag.p95_seconds),
+            ("max", lag.max_seconds),
+        ] {
+            out.push_str(&format!(
+                "ansible_talk_outbox_delivery_lag_seconds{{stat=\"{}\"}} {}\n",
+                stat,
+                value.unwrap_or(0.0)
+            ));
+        }
+
+        Ok(out)
+    }
+
+    async fn pending_count(&self) -> AppResult<i64> {
+        let pending: i64 = sqlx::query_scalar(
+            "SELECT COUNT(*) FROM outbox_events WHERE delivered_at IS NULL AND failed_at IS NULL",
+        )
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(pending)
+    }
+
+    async fn failed_count(&self) -> AppResult<i64> {
+        let failed: i64 =
+            sqlx::query_scalar("SELECT COUNT(*) FROM outbox_events WHERE failed_at IS NOT NULL")
+                .fetch_one(&self.db)
+                .await?;
+
+        Ok(failed)
+    }
+
+    async fn oldest_pending(&self) -> AppResult<Option<PendingEvent>> {
+        let event: Option<PendingEvent> = sqlx::query_as(
+            r#"
+            SELECT id, recipient_id, event_type, attempts, created_at,
+                   EXTRACT(EPOCH FROM NOW() - created_at)::float8 AS age_seconds
+            FROM outbox_events
+            WHERE delivered_at IS NULL AND failed_at IS NULL
+            ORDER BY id ASC
+            LIMIT 1
+            "#,
+        )
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(event)
+    }
+
+    /// Time from being queued to being published, for events delivered in
+    /// the last `LAG_WINDOW_SECONDS`
+    async fn delivery_lag(&self) -> AppResult<DeliveryLag> {
+        let lag: DeliveryLag = sqlx::query_as(
+            r#"
+            SELECT $1::int4 AS window_seconds,
+                   COUNT(*) AS sample_size,
+                   EXTRACT(EPOCH FROM AVG(delivered_at - created_at))::float8 AS avg_seconds,
+                   EXTRACT(EPOCH FROM percentile_cont(0.95)
+                       WITHIN GROUP (ORDER BY delivered_at - created_at))::float8 AS p95_seconds,
+                   EXTRACT(EPOCH FROM MAX(delivered_at - created_at))::float8 AS max_seconds
+            FROM outbox_events
+            WHERE delivered_at > NOW() - make_interval(secs => $1::int4)
+            "#,
+        )
+        .bind(LAG_WINDOW_SECONDS)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(lag)
+    }
+
+    /// Dispatcher loop: publish undelivered events to Redis and mark them delivered
+    pub async fn run_dispatcher(&self) {
+        tracing::info!("Outbox dispatcher started");
+
+        let mut last_purge = std::time::Instant::now();
+
+        loop {
+            match self.dispatch_batch().await {
+                // A full batch likely means more is waiting
+                Ok(count) if count as i64 == DISPATCH_BATCH_SIZE => continue,
+                Ok(_) => {}
+                Err(e) => tracing::error!("Outbox dispatch failed: {}", e),
+            }
+
+            if last_purge.elapsed() > Duration::from_secs(60 * 60) {
+                if let Err(e) = self.purge_delivered().await {
+                    tracing::error!("Outbox purge failed: {}", e);
+                }
+                last_purge = std::time::Instant::now();
+            }
+
+            tokio::time::sleep(DISPATCH_POLL_INTERVAL).await;
+        }
+    }
+
+    /// Publish one batch of pending events. Rows are locked with SKIP LOCKED so
+    /// several dispatchers can run side by side; delivery is at-least-once.
+    /// A failed publish is retried with exponential backoff, and an event
+    /// that fails `MAX_DISPATCH_ATTEMPTS` times is dead-lettered: it stays
+    /// readable by polling clients but is no longer published.
+    pub async fn dispatch_batch(&self) -> AppResult<usize> {
+        let mut tx = self.db.begin().await?;
+
+        let events: Vec<OutboxEvent> = sqlx::query_as(
+            r#"
+            SELECT id, recipient_id, event_type, payload FROM outbox_events
+            WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+            ORDER BY id ASC
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+            "#,
+        )
+        .bind(DISPATCH_BATCH_SIZE)
+        .fetch_all(&mut *tx)
+        .await?;
+
+        let mut delivered = Vec::with_capacity(events.len());
+        let mut failed = Vec::new();
+
+        for event in events {
+            let ws_message = WsMessage {
+                msg_type: event.event_type,
+                payload: event.payload,
+            };
+
+            let msg_str = serde_json::to_string(&ws_message)
+                .map_err(|e| anyhow::anyhow!("Failed to serialize outbox event: {}", e))?;
+
+            match self
+                .redis
+                .publish_message(&event.recipient_id.to_string(), &msg_str)
+                .await
+            {
+                Ok(()) => delivered.push(event.id),
+                Err(e) => {
+                    tracing::warn!("Failed to publish outbox event {}: {}", event.id, e);
+                    failed.push(event.id);
+                }
+            }
+        }
+
+        if !delivered.is_empty() {
+            sqlx::query("UPDATE outbox_events SET delivered_at = NOW() WHERE id = ANY($1)")
+                .bind(&delivered)
+                .execute(&mut *tx)
+                .await?;
+        }
+
+        if !failed.is_empty() {
+            let dead_lettered: Vec<Option<i64>> = sqlx::query_scalar(
+                r#"
+                UPDATE outbox_events
+                SET attempts = attempts + 1,
+                    next_attempt_at = NOW() + make_interval(
+                        secs => LEAST($2 * power(2, attempts), $3)
+                    ),
+                    failed_at = CASE WHEN attempts + 1 >= $4 THEN NOW() END
+                WHERE id = ANY($1)
+                RETURNING CASE WHEN failed_at IS NOT NULL THEN id END
+                "#,
+            )
+            .bind(&failed)
+            .bind(RETRY_BASE_SECONDS as f64)
+            .bind(RETRY_MAX_SECONDS as f64)
+            .bind(MAX_DISPATCH_ATTEMPTS)
+            .fetch_all(&mut *tx)
+            .await?;
+
+            for id in dead_lettered.iter().flatten() {
+                tracing::error!(
+                    "Outbox event {} dead-lettered after {} failed publishes",
+                    id,
+                    MAX_DISPATCH_ATTEMPTS
+                );
+            }
+        }
+
+        tx.commit().await?;
+
+        Ok(delivered.len())
+    }
+
+    /// Retry events still pending or dead-lettered straight away, with
+    /// their attempts reset, for every recipient or only `recipient_id`.
+    /// With `redeliver_minutes`, events delivered in that window are marked
+    /// pending again too, so publishes lost while Redis was down or
+    /// restarting go out again; their recipients get anything that did
+    /// arrive twice, as delivery is at-least-once anyway.
+    pub async fn requeue(
+        &self,
+        redeliver_minutes: Option<i32>,
+        recipient_id: Option<Uuid>,
+    ) -> AppResult<u64> {
+        let result = sqlx::query(
+            r#"
+            UPDATE outbox_events
+            SET delivered_at = NULL, attempts = 0, next_attempt_at = NOW(), failed_at = NULL
+            WHERE (delivered_at IS NULL
+                   OR ($1::int4 IS NOT NULL AND delivered_at > NOW() - make_interval(mins => $1)))
+              AND ($2::uuid IS NULL OR recipient_id = $2)
+            "#,
+        )
+        .bind(redeliver_minutes)
+        .bind(recipient_id)
+        .execute(&self.db)
+        .await?;
+
+        Ok(result.rows_affected())
+    }
+
+    async fn purge_delivered(&self) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            DELETE FROM outbox_events
+            WHERE delivered_at < NOW() - make_interval(hours => $1)
+               OR failed_at < NOW() - make_interval(hours => $1)
+            "#,
+        )
+        .bind(DELIVERED_RETENTION_HOURS)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+}
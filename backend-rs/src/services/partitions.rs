@@ -0,0 +1,88 @@
+use std::time::Duration;
+
+use chrono::{Datelike, Months, Utc};
+use sqlx::PgPool;
+
+use crate::error::AppResult;
+
+const MAINTENANCE_INTERVAL: Duration = Duration::from_secs(6 * 60 * 60);
+
+/// Arbitrary key for the advisory lock that keeps several servers from
+/// creating the same partition at once
+const PARTITION_LOCK_KEY: i64 = 0x6d65_7373_6167_6573;
+
+/// Keeps monthly partitions of the messages table created ahead of time, so
+/// new messages never fall into the default partition
+pub struct PartitionService {
+    db: PgPool,
+    months_ahead: u32,
+}
+
+impl PartitionService {
+    pub fn new(db: PgPool, months_ahead: u32) -> Self {
+        Self { db, months_ahead }
+    }
+
+    /// Maintenance loop: top up partitions now and every few hours after
+    pub async fn run_maintenance(&self) {
+        tracing::info!("Partition maintenance started");
+
+        loop {
+            match self.ensure_partitions().await {
+                Ok(created) if !created.is_empty() => {
+                    tracing::info!("Created message partitions: {}", created.join(", "));
+                }
+                Ok(_) => {}
+                Err(e) => tracing::error!("Partition maintenance failed: {}", e),
+            }
+
+            tokio::time::sleep(MAINTENANCE_INTERVAL).await;
+        }
+    }
+
+    /// Create any missing partitions from the current month through
+    /// `months_ahead` months from now. Returns the ones created.
+    pub async fn ensure_partitions(&self) -> AppResult<Vec<String>> {
+        let mut tx = self.db.begin().await?;
+
+        sqlx::query("SELECT pg_advisory_xact_lock($1)")
+            .bind(PARTITION_LOCK_KEY)
+            .execute(&mut *tx)
+            .await?;
+
+        let existing: Vec<String> = sqlx::query_scalar(
+            r#"
+            SELECT c.relname::TEXT FROM pg_inherits i
+            JOIN pg_class c ON c.oid = i.inhrelid
+            WHERE i.inhparent = 'messages'::regclass
+            "#,
+        )
+        .fetch_all(&mut *tx)
+        .await?;
+
+        let today = Utc::now().date_naive();
+        let this_month = today.with_day(1).unwrap_or(today);
+
+        let mut created = Vec::new();
+        for offset in 0..=self.months_ahead {
+            let Some(month) = this_month.checked_add_months(Months::new(offset)) else {
+                break;
+            };
+
+            let name = format!("messages_{}", month.format("%Y_%m"));
+            if existing.contains(&name) {
+                continue;
+            }
+
+            sqlx::query("SELECT create_messages_partition($1)")
+                .bind(month)
+                .execute(&mut *tx)
+                .await?;
+            created.push(name);
+        }
+
+        tx.commit().await?;
+
+        Ok(created)
+    }
+}
@@ -0,0 +1,418 @@
+use std::time::Duration;
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use hmac::{Hmac, Mac};
+use serde_json::json;
+use sha2::Sha256;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::PaymentsConfig,
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        CreatePaymentRequestRequest, PaymentRequest, PaymentStatus, PaymentWebhookEvent,
+        SystemEvent, UpdatePaymentRequestRequest,
+    },
+    services::messaging::MessagingService,
+};
+
+pub const PAYMENT_WEBHOOK_JOB_KIND: &str = "payment_webhook";
+const WEBHOOK_TIMEOUT: Duration = Duration::from_secs(10);
+const DEFAULT_LIST_LIMIT: i64 = 50;
+const MAX_LIST_LIMIT: i64 = 200;
+/// Keeps amounts well inside what clients can hold as a double
+const MAX_AMOUNT_MINOR: i64 = 1_000_000_000_000;
+const MAX_NOTE_LENGTH: usize = 200;
+const MAX_PROVIDER_REFERENCE_LENGTH: usize = 200;
+
+/// Payment requests between members of a conversation. Asking posts a
+/// `payment_requested` system message; the payer then marks the request
+/// paid or declines it, or the requester marks it paid or cancels it, and
+/// each change posts `payment_status_changed`. The server never moves money.
+/// With `PAYMENT_WEBHOOK_URL` set, every new request and status change is
+/// also sent to the payment provider through the job queue.
+pub struct PaymentsService {
+    db: PgPool,
+    http: reqwest::Client,
+    jobs: JobQueue,
+    config: PaymentsConfig,
+}
+
+impl PaymentsService {
+    pub fn new(db: PgPool, http: reqwest::Client, jobs: JobQueue, config: PaymentsConfig) -> Self {
+        Self {
+            db,
+            http,
+            jobs,
+            config,
+        }
+    }
+
+    /// Ask another member of the conversation for money
+    pub async fn create(
+        &self,
+        conversation_id: Uuid,
+        requester_id: Uuid,
+        req: &CreatePaymentRequestRequest,
+    ) -> AppResult<PaymentRequest> {
+        self.require_writable_member(conversation_id, requester_id)
+            .await?;
+
+        if req.payer_id == requester_id {
+            return Err(AppError::Validation(
+                "You can't request money from yourself".to_string(),
+            ));
+        }
+        if !(1..=MAX_AMOUNT_MINOR).contains(&req.amount_minor) {
+            return Err(AppError::Validation(format!(
+                "amount_minor must be between 1 and {}",
+                MAX_AMOUNT_MINOR
+            )));
+        }
+        let currency = req.currency.trim();
+        if currency.len() != 3 || !currency.chars().all(|c| c.is_ascii_uppercase()) {
+            return Err(AppError::Validation(
+                "currency must be an ISO 4217 code such as USD".to_string(),
+            ));
+        }
+        let note = req.note.as_deref().map(str::trim).filter(|n| !n.is_empty());
+        if note.is_some_and(|n| n.chars().count() > MAX_NOTE_LENGTH) {
+            return Err(AppError::Validation(format!(
+                "Note must be at most {} characters",
+                MAX_NOTE_LENGTH
+            )));
+        }
+
+        let payer_is_member: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1::BIGINT FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(req.payer_id)
+        .fetch_optional(&self.db)
+        .await?;
+        if payer_is_member.is_none() {
+            return Err(AppError::Validation(
+                "payer_id must be a member of the conversation".to_string(),
+            ));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let payment_request: PaymentRequest = sqlx::query_as(
+            r#"
+            INSERT INTO payment_requests (conversation_id, requester_id, payer_id, amount_minor, currency, note)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING *
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(requester_id)
+        .bind(req.payer_id)
+        .bind(req.amount_minor)
+        .bind(currency)
+        .bind(note)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let message = MessagingService::post_system_message(
+            &mut tx,
+            conversation_id,
+            requester_id,
+            SystemEvent::PaymentRequested {
+                payment_request_id: payment_request.id,
+                payer_id: payment_request.payer_id,
+                amount_minor: payment_request.amount_minor,
+                currency: payment_request.currency.clone(),
+            },
+        )
+        .await?;
+
+        let payment_request: PaymentRequest =
+            sqlx::query_as("UPDATE payment_requests SET message_id = $1 WHERE id = $2 RETURNING *")
+                .bind(message.id)
+                .bind(payment_request.id)
+                .fetch_one(&mut *tx)
+                .await?;
+
+        tx.commit().await?;
+
+        self.notify_provider(&payment_request).await?;
+
+        Ok(payment_request)
+    }
+
+    /// Payment requests in the conversation, newest first
+    pub async fn list(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        status: Option<PaymentStatus>,
+        before: Option<DateTime<Utc>>,
+        limit: Option<i64>,
+    ) -> AppResult<Vec<PaymentRequest>> {
+        self.require_member(conversation_id, user_id).await?;
+        let limit = limit.unwrap_or(DEFAULT_LIST_LIMIT).clamp(1, MAX_LIST_LIMIT);
+
+        let payment_requests: Vec<PaymentRequest> = sqlx::query_as(
+            r#"
+            SELECT * FROM payment_requests
+            WHERE conversation_id = $1
+            AND ($2::payment_status IS NULL OR status = $2)
+            AND ($3::timestamptz IS NULL OR created_at < $3)
+            ORDER BY created_at DESC
+            LIMIT $4
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(status)
+        .bind(before)
+        .bind(limit)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(payment_requests)
+    }
+
+    pub async fn get(
+        &self,
+        conversation_id: Uuid,
+        payment_request_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<PaymentRequest> {
+        self.require_member(conversation_id, user_id).await?;
+        self.find(conversation_id, payment_request_id).await
+    }
+
+    /// Settle an open request. The payer can mark it `paid` or `declined`;
+    /// the requester can mark it `paid` (received) or `cancelled`.
+    pub async fn update_status(
+        &self,
+        conversation_id: Uuid,
+        payment_request_id: Uuid,
+        user_id: Uuid,
+        req: &UpdatePaymentRequestRequest,
+    ) -> AppResult<PaymentRequest> {
+        self.require_writable_member(conversation_id, user_id)
+            .await?;
+        let current = self.find(conversation_id, payment_request_id).await?;
+
+        let allowed = match req.status {
+            PaymentStatus::Paid => user_id == current.payer_id || user_id == current.requester_id,
+            PaymentStatus::Declined => user_id == current.payer_id,
+            PaymentStatus::Cancelled => user_id == current.requester_id,
+            PaymentStatus::Requested => {
+                return Err(AppError::Validation(
+                    "status must be paid, declined or cancelled".to_string(),
+                ));
+            }
+        };
+        if !allowed {
+            return Err(AppError::Forbidden);
+        }
+
+        let provider_reference = req
+            .provider_reference
+            .as_deref()
+            .map(str::trim)
+            .filter(|r| !r.is_empty());
+        if provider_reference.is_some() && req.status != PaymentStatus::Paid {
+            return Err(AppError::Validation(
+                "provider_reference only goes with paid".to_string(),
+            ));
+        }
+        if provider_reference.is_some_and(|r| r.chars().count() > MAX_PROVIDER_REFERENCE_LENGTH) {
+            return Err(AppError::Validation(format!(
+                "provider_reference must be at most {} characters",
+                MAX_PROVIDER_REFERENCE_LENGTH
+            )));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        // Only an open request moves, so two members settling it at once
+        // can't both win
+        let updated: Option<PaymentRequest> = sqlx::query_as(
+            r#"
+            UPDATE payment_requests
+            SET status = $2, provider_reference = $3, settled_at = NOW(), updated_at = NOW()
+            WHERE id = $1 AND status = 'requested'
+            RETURNING *
+            "#,
+        )
+        .bind(payment_request_id)
+        .bind(req.status)
+        .bind(provider_reference)
+        .fetch_optional(&mut *tx)
+        .await?;
+        let Some(payment_request) = updated else {
+            let latest = self.find(conversation_id, payment_request_id).await?;
+            return Err(AppError::PaymentRequestSettled(latest.status.as_str()));
+        };
+
+        MessagingService::post_system_message(
+            &mut tx,
+            conversation_id,
+            user_id,
+            SystemEvent::PaymentStatusChanged {
+                payment_request_id,
+                status: payment_request.status,
+            },
+        )
+        .await?;
+
+        tx.commit().await?;
+
+        self.notify_provider(&payment_request).await?;
+
+        Ok(payment_request)
+    }
+
+    /// Send a request's current state to the payment webhook. Failures are
+    /// retried by the job queue.
+    pub async fn deliver_webhook(&self, payment_request_id: Uuid) -> AppResult<()> {
+        let Some(url) = &self.config.webhook_url else {
+            return Ok(());
+        };
+
+        let payment_request: Option<PaymentRequest> =
+            sqlx::query_as("SELECT * FROM payment_requests WHERE id = $1")
+                .bind(payment_request_id)
+                .fetch_optional(&self.db)
+                .await?;
+        // Gone with its conversation
+        let Some(payment_request) = payment_request else {
+            return Ok(());
+        };
+
+        let event = PaymentWebhookEvent {
+            status: payment_request.status,
+            payment_request,
+            sent_at: Utc::now(),
+        };
+        let body = serde_json::to_vec(&event)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize payment webhook: {}", e))?;
+        let timestamp = Utc::now().timestamp().to_string();
+
+        let mut request = self
+            .http
+            .post(url)
+            .timeout(WEBHOOK_TIMEOUT)
+            .header("Content-Type", "application/json")
+            .header("X-Payment-Timestamp", &timestamp);
+        if let Some(secret) = &self.config.webhook_secret {
+            let mut mac = Hmac::<Sha256>::new_from_slice(secret.as_bytes())
+                .map_err(|e| anyhow::anyhow!("Invalid payment webhook secret: {}", e))?;
+            mac.update(timestamp.as_bytes());
+            mac.update(b".");
+            mac.update(&body);
+            let signature = format!("{:x}", mac.finalize().into_bytes());
+            request = request.header("X-Payment-Signature", format!("sha256={}", signature));
+        }
+
+        let response = request
+            .body(body)
+            .send()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to reach the payment webhook: {}", e))?;
+        if !response.status().is_success() {
+            return Err(AppError::Internal(anyhow::anyhow!(
+                "Payment webhook answered with status {}",
+                response.status()
+            )));
+        }
+
+        Ok(())
+    }
+
+    async fn notify_provider(&self, payment_request: &PaymentRequest) -> AppResult<()> {
+        if !self.config.webhook_enabled() {
+            return Ok(());
+        }
+
+        self.jobs
+            .enqueue(
+                PAYMENT_WEBHOOK_JOB_KIND,
+                json!({ "payment_request_id": payment_request.id }),
+            )
+            .await?;
+
+        Ok(())
+    }
+
+    async fn find(
+        &self,
+        conversation_id: Uuid,
+        payment_request_id: Uuid,
+    ) -> AppResult<PaymentRequest> {
+        let payment_request: Option<PaymentRequest> =
+            sqlx::query_as("SELECT * FROM payment_requests WHERE id = $1 AND conversation_id = $2")
+                .bind(payment_request_id)
+                .bind(conversation_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        payment_request.ok_or(AppError::PaymentRequestNotFound)
+    }
+
+    async fn require_member(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        self.membership(conversation_id, user_id).await.map(|_| ())
+    }
+
+    /// Imported conversations are read-only
+    async fn require_writable_member(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        if self.membership(conversation_id, user_id).await? {
+            return Err(AppError::ConversationReadOnly);
+        }
+
+        Ok(())
+    }
+
+    /// Whether the conversation is read-only, for active participants
+    async fn membership(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<bool> {
+        let read_only: Option<bool> = sqlx::query_scalar(
+            r#"
+            SELECT c.imported_from IS NOT NULL FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        read_only.ok_or(AppError::NotParticipant)
+    }
+}
+
+/// Job handler that sends payment request changes to the provider
+pub struct PaymentWebhookJob {
+    payments: PaymentsService,
+}
+
+impl PaymentWebhookJob {
+    pub fn new(payments: PaymentsService) -> Self {
+        Self { payments }
+    }
+}
+
+#[async_trait]
+impl JobHandler for PaymentWebhookJob {
+    fn kind(&self) -> &'static str {
+        PAYMENT_WEBHOOK_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let payment_request_id = job
+            .payload
+            .get("payment_request_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Payment webhook job is missing payment_request_id"))?;
+
+        self.payments.deliver_webhook(payment_request_id).await
+    }
+}
@@ -0,0 +1,29 @@
+//! Phone numbers are stored and looked up in E.164 (`+15550001234`) so the
+//! same number written differently always maps to the same user.
+
+use phonenumber::{country, Mode};
+
+use crate::error::{AppError, AppResult};
+
+/// Validate a phone number and format it as E.164. Numbers without a `+`
+/// country code are read as local to `region`.
+pub fn normalize(raw: &str, region: Option<country::Id>) -> AppResult<String> {
+    let invalid = || AppError::Validation(format!("Invalid phone number: {}", raw));
+
+    let number = phonenumber::parse(region, raw.trim()).map_err(|_| invalid())?;
+    if !phonenumber::is_valid(&number) {
+        return Err(invalid());
+    }
+
+    Ok(number.format().mode(Mode::E164).to_string())
+}
+
+/// An ISO 3166 region code such as `US` or `tw`
+pub fn parse_region(code: &str) -> Option<country::Id> {
+    code.trim().to_uppercase().parse().ok()
+}
+
+/// The region a stored E.164 number belongs to
+pub fn region_of(e164: &str) -> Option<country::Id> {
+    phonenumber::parse(None, e164).ok()?.country().id()
+}
@@ -0,0 +1,236 @@
+use chrono::{DateTime, Utc};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{CreateProfilePostRequest, ProfilePost, UpdateProfilePostRequest, UserProfile},
+};
+
+const MAX_BODY_LENGTH: usize = 2000;
+const MAX_POSTS_PER_USER: i64 = 100;
+const MAX_PINNED_POSTS: i64 = 3;
+const MAX_PROFILE_POSTS: i64 = 50;
+
+/// Public profiles and the plaintext posts users publish on them. Posts are
+/// a separate, unencrypted channel: a client pinning a message sends its
+/// plaintext, and the server only checks the caller sent that message.
+pub struct ProfilesService {
+    db: PgPool,
+}
+
+impl ProfilesService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// A user's profile with the posts `viewer_id` may see. Users who have
+    /// blocked the viewer, and guests, look like they don't exist.
+    pub async fn get_profile(&self, user_id: Uuid, viewer_id: Uuid) -> AppResult<UserProfile> {
+        let profile: Option<(
+            Uuid,
+            String,
+            String,
+            Option<String>,
+            Option<String>,
+            DateTime<Utc>,
+            bool,
+        )> = sqlx::query_as(
+            r#"
+            SELECT u.id, u.username, u.display_name, u.avatar_url, u.bio, u.created_at,
+                   EXISTS(
+                       SELECT 1 FROM contacts c
+                       WHERE c.user_id = u.id AND c.contact_id = $2 AND c.is_blocked IS NOT TRUE
+                   )
+            FROM users u
+            WHERE u.id = $1 AND u.is_guest = false
+            AND NOT EXISTS(
+                SELECT 1 FROM contacts c
+                WHERE c.user_id = u.id AND c.contact_id = $2 AND c.is_blocked = true
+            )
+            "#,
+        )
+        .bind(user_id)
+        .bind(viewer_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let (id, username, display_name, avatar_url, bio, created_at, is_contact) =
+            profile.ok_or(AppError::UserNotFound)?;
+
+        let sees_all = user_id == viewer_id || is_contact;
+        let posts: Vec<ProfilePost> = sqlx::query_as(
+            r#"
+            SELECT * FROM profile_posts
+            WHERE user_id = $1 AND ($2 OR visibility = 'public')
+            ORDER BY pinned DESC, created_at DESC
+            LIMIT $3
+            "#,
+        )
+        .bind(user_id)
+        .bind(sees_all)
+        .bind(MAX_PROFILE_POSTS)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(UserProfile {
+            id,
+            username,
+            display_name,
+            avatar_url,
+            bio,
+            created_at,
+            posts,
+        })
+    }
+
+    /// All of the caller's posts, pinned first, then newest first
+    pub async fn list_posts(&self, user_id: Uuid) -> AppResult<Vec<ProfilePost>> {
+        let posts: Vec<ProfilePost> = sqlx::query_as(
+            r#"
+            SELECT * FROM profile_posts
+            WHERE user_id = $1
+            ORDER BY pinned DESC, created_at DESC
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(posts)
+    }
+
+    pub async fn create_post(
+        &self,
+        user_id: Uuid,
+        req: &CreateProfilePostRequest,
+    ) -> AppResult<ProfilePost> {
+        let body = validate_body(&req.body)?;
+
+        if let Some(message_id) = req.message_id {
+            let own_message: Option<(Uuid,)> = sqlx::query_as(
+                r#"
+                SELECT id FROM messages
+                WHERE id = $1 AND sender_id = $2 AND deleted_at IS NULL AND type <> 'system'
+                "#,
+            )
+            .bind(message_id)
+            .bind(user_id)
+            .fetch_optional(&self.db)
+            .await?;
+            if own_message.is_none() {
+                return Err(AppError::MessageNotFound);
+            }
+        }
+
+        let (posts, pinned): (i64, i64) = sqlx::query_as(
+            "SELECT COUNT(*), COUNT(*) FILTER (WHERE pinned) FROM profile_posts WHERE user_id = $1",
+        )
+        .bind(user_id)
+        .fetch_one(&self.db)
+        .await?;
+        if posts >= MAX_POSTS_PER_USER {
+            return Err(AppError::LimitExceeded(format!(
+                "profiles are limited to {} posts",
+                MAX_POSTS_PER_USER
+            )));
+        }
+        if req.pinned && pinned >= MAX_PINNED_POSTS {
+            return Err(AppError::Validation(format!(
+                "At most {} posts can be pinned",
+                MAX_PINNED_POSTS
+            )));
+        }
+
+        let post: ProfilePost = sqlx::query_as(
+            r#"
+            INSERT INTO profile_posts (id, user_id, body, visibility, source_message_id, pinned)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(body)
+        .bind(req.visibility)
+        .bind(req.message_id)
+        .bind(req.pinned)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(post)
+    }
+
+    pub async fn update_post(
+        &self,
+        user_id: Uuid,
+        post_id: Uuid,
+        req: &UpdateProfilePostRequest,
+    ) -> AppResult<ProfilePost> {
+        if req.body.is_none() && req.visibility.is_none() && req.pinned.is_none() {
+            return Err(AppError::Validation("Nothing to update".to_string()));
+        }
+        let body = req.body.as_deref().map(validate_body).transpose()?;
+
+        if req.pinned == Some(true) {
+            let (pinned,): (i64,) = sqlx::query_as(
+                "SELECT COUNT(*) FROM profile_posts WHERE user_id = $1 AND pinned AND id <> $2",
+            )
+            .bind(user_id)
+            .bind(post_id)
+            .fetch_one(&self.db)
+            .await?;
+            if pinned >= MAX_PINNED_POSTS {
+                return Err(AppError::Validation(format!(
+                    "At most {} posts can be pinned",
+                    MAX_PINNED_POSTS
+                )));
+            }
+        }
+
+        let post: Option<ProfilePost> = sqlx::query_as(
+            r#"
+            UPDATE profile_posts
+            SET body = COALESCE($3, body),
+                visibility = COALESCE($4, visibility),
+                pinned = COALESCE($5, pinned),
+                updated_at = NOW()
+            WHERE id = $1 AND user_id = $2
+            RETURNING *
+            "#,
+        )
+        .bind(post_id)
+        .bind(user_id)
+        .bind(body)
+        .bind(req.visibility)
+        .bind(req.pinned)
+        .fetch_optional(&self.db)
+        .await?;
+
+        post.ok_or(AppError::ProfilePostNotFound)
+    }
+
+    pub async fn delete_post(&self, user_id: Uuid, post_id: Uuid) -> AppResult<()> {
+        let result = sqlx::query("DELETE FROM profile_posts WHERE id = $1 AND user_id = $2")
+            .bind(post_id)
+            .bind(user_id)
+            .execute(&self.db)
+            .await?;
+        if result.rows_affected() == 0 {
+            return Err(AppError::ProfilePostNotFound);
+        }
+
+        Ok(())
+    }
+}
+
+fn validate_body(body: &str) -> AppResult<&str> {
+    let body = body.trim();
+    if body.is_empty() || body.chars().count() > MAX_BODY_LENGTH {
+        return Err(AppError::Validation(format!(
+            "Post must be between 1 and {} characters",
+            MAX_BODY_LENGTH
+        )));
+    }
+
+    Ok(body)
+}
@@ -0,0 +1,56 @@
+//! Best-effort realtime publishes to Redis pub/sub. Ephemeral events
+//! (typing, presence, hub fan-out) go through `publish`, which retries with
+//! backoff and counts what it finally drops. Events a client must not miss
+//! belong in the outbox instead, which keeps retrying until delivered.
+
+use std::{
+    sync::atomic::{AtomicU64, Ordering},
+    time::Duration,
+};
+
+use rand::Rng;
+
+use crate::storage::redis::RedisClient;
+
+const MAX_ATTEMPTS: u32 = 3;
+const BASE_DELAY: Duration = Duration::from_millis(25);
+
+/// Publishes given up on since the process started
+static DROPPED_PUBLISHES: AtomicU64 = AtomicU64::new(0);
+
+/// Publish to a user's channel, retrying transient Redis errors. Returns
+/// whether the message went out; a dropped message is logged and counted.
+pub async fn publish(redis: &RedisClient, user_id: &str, message: &str) -> bool {
+    let mut attempt = 0;
+    loop {
+        match redis.publish_message(user_id, message).await {
+            Ok(()) => return true,
+            Err(e) if attempt + 1 < MAX_ATTEMPTS => {
+                tracing::debug!("Publish to {} failed, retrying: {}", user_id, e);
+                tokio::time::sleep(backoff(attempt)).await;
+                attempt += 1;
+            }
+            Err(e) => {
+                tracing::warn!(
+                    "Dropped publish to {} after {} attempts: {}",
+                    user_id,
+                    MAX_ATTEMPTS,
+                    e
+                );
+                DROPPED_PUBLISHES.fetch_add(1, Ordering::Relaxed);
+                return false;
+            }
+        }
+    }
+}
+
+pub fn dropped_publishes() -> u64 {
+    DROPPED_PUBLISHES.load(Ordering::Relaxed)
+}
+
+/// Exponential backoff with full jitter: a random delay up to
+/// `BASE_DELAY * 2^attempt`
+fn backoff(attempt: u32) -> Duration {
+    let ceiling = BASE_DELAY.as_millis() as u64 * (1 << attempt);
+    Duration::from_millis(rand::thread_rng().gen_range(0..=ceiling))
+}
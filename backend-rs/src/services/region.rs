@@ -0,0 +1,91 @@
+use sqlx::PgPool;
+
+use crate::{
+    config::RegionConfig,
+    error::AppResult,
+    models::{RegionHealth, RegionRole, ReplicaStatus},
+};
+
+/// Replication state for active-passive regions. The primary takes writes;
+/// a standby serves reads from a PostgreSQL replica and refuses writes
+/// until a failover promotes its database and clears `REGION_READ_ONLY`.
+/// A region is unhealthy when its flag and its database disagree, or when a
+/// standby falls too far behind to be promoted safely.
+pub struct RegionService {
+    db: PgPool,
+    config: RegionConfig,
+}
+
+impl RegionService {
+    pub fn new(db: PgPool, config: RegionConfig) -> Self {
+        Self { db, config }
+    }
+
+    pub async fn health(&self) -> AppResult<RegionHealth> {
+        // An idle primary sends nothing to replay, so a replica that has
+        // replayed everything it received isn't behind
+        let (in_recovery, replication_lag_seconds): (bool, Option<f64>) = sqlx::query_as(
+            r#"
+            SELECT pg_is_in_recovery(),
+                   CASE
+                       WHEN NOT pg_is_in_recovery() THEN NULL
+                       WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+                       ELSE EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp())
+                   END::float8
+            "#,
+        )
+        .fetch_one(&self.db)
+        .await?;
+
+        // Needs the pg_monitor role to see replicas; without it the list is empty
+        let replicas: Vec<ReplicaStatus> = if in_recovery {
+            Vec::new()
+        } else {
+            sqlx::query_as(
+                r#"
+                SELECT application_name, state,
+                       EXTRACT(EPOCH FROM replay_lag)::float8 AS replay_lag_seconds
+                FROM pg_stat_replication
+                ORDER BY application_name
+                "#,
+            )
+            .fetch_all(&self.db)
+            .await?
+        };
+
+        let mut problems = Vec::new();
+        if in_recovery && !self.config.read_only {
+            problems.push("Database is a replica but the region accepts writes".to_string());
+        }
+        if !in_recovery && self.config.read_only {
+            problems.push("Database accepts writes but the region is read-only".to_string());
+        }
+        let max_lag = self.config.max_replication_lag.as_secs_f64();
+        match replication_lag_seconds {
+            Some(lag) if lag > max_lag => problems.push(format!(
+                "Replication lag of {:.0}s exceeds {:.0}s",
+                lag, max_lag
+            )),
+            None if in_recovery => {
+                problems.push("Replica hasn't replayed anything from the primary".to_string())
+            }
+            _ => {}
+        }
+
+        Ok(RegionHealth {
+            region: self.config.name.clone(),
+            role: if self.config.read_only {
+                RegionRole::Standby
+            } else {
+                RegionRole::Primary
+            },
+            read_only: self.config.read_only,
+            leader_url: self.config.leader_url.clone(),
+            in_recovery,
+            replication_lag_seconds,
+            replicas,
+            healthy: problems.is_empty(),
+            problems,
+        })
+    }
+}
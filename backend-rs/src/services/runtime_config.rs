@@ -0,0 +1,115 @@
+use std::{collections::BTreeMap, sync::Arc};
+
+use serde_json::json;
+use sqlx::PgPool;
+use tracing_subscriber::{reload, EnvFilter, Registry};
+use uuid::Uuid;
+
+use crate::{
+    config::{Config, SharedConfig},
+    error::{AppError, AppResult},
+    models::{ConfigChange, ConfigReloadResult, RuntimeConfig},
+    services::audit::AuditService,
+    storage::redis::RedisClient,
+};
+
+/// Handle for swapping the log filter at runtime
+pub type LogFilterHandle = reload::Handle<EnvFilter, Registry>;
+
+pub struct RuntimeConfigService {
+    config: Arc<SharedConfig>,
+    log_filter: LogFilterHandle,
+    redis: RedisClient,
+    audit: AuditService,
+}
+
+impl RuntimeConfigService {
+    pub fn new(
+        db: PgPool,
+        redis: RedisClient,
+        config: Arc<SharedConfig>,
+        log_filter: LogFilterHandle,
+    ) -> Self {
+        Self {
+            config,
+            log_filter,
+            redis,
+            audit: AuditService::new(db),
+        }
+    }
+
+    /// Current values of the hot-reloadable settings
+    pub fn get(&self) -> RuntimeConfig {
+        RuntimeConfig {
+            settings: settings_map(&self.config.current()),
+        }
+    }
+
+    /// Re-read configuration and apply the hot-reloadable settings (log
+    /// level, OTP, limits, minimum client version, JWT signing key).
+    /// Invalid values are rejected as a whole and the running config is left
+    /// untouched.
+    /// Feature flags are re-read from the database on next use.
+    pub async fn reload(
+        &self,
+        actor_id: Option<Uuid>,
+        source: &str,
+    ) -> AppResult<ConfigReloadResult> {
+        let current = self.config.current();
+        let mut next = current.with_reloadable(&Config::reload());
+
+        next.validate_reloadable().map_err(AppError::Validation)?;
+        // Picks up a new JWT_SIGNING_KID and key files added to or removed
+        // from JWT_KEYS_DIR
+        next.jwt
+            .load_keys()
+            .map_err(|e| AppError::Validation(format!("Invalid JWT keys: {}", e)))?;
+        let log_filter = EnvFilter::try_new(&next.server.log_level)
+            .map_err(|e| AppError::Validation(format!("Invalid RUST_LOG: {}", e)))?;
+
+        let changes: Vec<ConfigChange> = current
+            .reloadable_values()
+            .into_iter()
+            .zip(next.reloadable_values())
+            .filter(|((_, old), (_, new))| old != new)
+            .map(|((key, old_value), (_, new_value))| ConfigChange {
+                key: key.to_string(),
+                old_value,
+                new_value,
+            })
+            .collect();
+
+        if next.server.log_level != current.server.log_level {
+            self.log_filter
+                .reload(log_filter)
+                .map_err(|e| anyhow::anyhow!("Failed to reload log filter: {}", e))?;
+        }
+
+        self.redis.invalidate_cached_flags().await?;
+
+        let settings = settings_map(&next);
+        self.config.replace(next);
+
+        tracing::info!("Configuration reloaded via {}: {} change(s)", source, changes.len());
+
+        self.audit
+            .record(
+                actor_id,
+                "config.reloaded",
+                "config",
+                None,
+                json!({ "source": source, "changes": changes }),
+            )
+            .await?;
+
+        Ok(ConfigReloadResult { changes, settings })
+    }
+}
+
+fn settings_map(config: &Config) -> BTreeMap<String, String> {
+    config
+        .reloadable_values()
+        .into_iter()
+        .map(|(key, value)| (key.to_string(), value))
+        .collect()
+}
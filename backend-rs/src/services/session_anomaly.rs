@@ -0,0 +1,260 @@
+use std::net::IpAddr;
+
+use chrono::Utc;
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::{Config, SessionAnomalyAction},
+    error::{AppError, AppResult},
+    models::{AnomalySignal, SessionAnomalyEvent, WS_SESSION_ANOMALY},
+    services::{
+        abuse::ClientOrigin, audit::AuditService, auth::AuthService, outbox::OutboxService,
+    },
+    storage::redis::RedisClient,
+};
+
+const ALL_SIGNALS: [AnomalySignal; 3] = [
+    AnomalySignal::Network,
+    AnomalySignal::Country,
+    AnomalySignal::UserAgent,
+];
+const MAX_USER_AGENT_LENGTH: usize = 256;
+
+/// Checks each use of a session token against where the session has been
+/// used before: the client's network, country and User-Agent. The first
+/// value seen for a signal becomes the session's baseline. A value outside
+/// the history is an anomaly; depending on `SESSION_ANOMALY_ACTION` the user
+/// is notified, or notified and the session ended so the device has to log
+/// in again. Anomalies are written to the audit log. A fresh login starts a
+/// new history.
+pub struct SessionAnomalyService {
+    db: PgPool,
+    redis: RedisClient,
+    audit: AuditService,
+    config: Config,
+}
+
+impl SessionAnomalyService {
+    pub fn new(db: PgPool, redis: RedisClient, config: Config) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self {
+            db,
+            redis,
+            audit,
+            config,
+        }
+    }
+
+    /// Check a request made with a full session token
+    pub async fn check_request(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        issued_at: i64,
+        origin: &ClientOrigin,
+        user_agent: Option<&str>,
+    ) -> AppResult<()> {
+        let settings = &self.config.session_anomaly;
+        if settings.action == SessionAnomalyAction::Off {
+            return Ok(());
+        }
+
+        // Step-up and every signal's history come back in one Redis round
+        // trip; only a new session's baseline or an anomaly writes
+        let values: Vec<(AnomalySignal, String)> = settings
+            .signals
+            .iter()
+            .filter_map(|signal| Some((*signal, observed(*signal, origin, user_agent)?)))
+            .collect();
+        let signals: Vec<&str> = values.iter().map(|(signal, _)| signal.as_str()).collect();
+        let (user, device) = (user_id.to_string(), device_id.to_string());
+        let (step_up, histories) = self
+            .redis
+            .get_session_state(&user, &device, &signals)
+            .await?;
+        if step_up.is_some_and(|since| issued_at <= since) {
+            return Err(AppError::ReauthRequired);
+        }
+
+        let mut baseline = Vec::new();
+        let mut anomalies = Vec::new();
+        for ((signal, value), history) in values.into_iter().zip(histories) {
+            if history.is_empty() {
+                baseline.push((signal, value));
+            } else if !history.contains(&value) {
+                anomalies.push((signal, value));
+            }
+        }
+        if !baseline.is_empty() {
+            self.add_history(&user, &device, &baseline).await?;
+        }
+        if anomalies.is_empty() {
+            return Ok(());
+        }
+
+        // A read-only region can't end the session or write the report;
+        // the step-up still holds, and refreshing needs the primary anyway
+        let read_only = self.config.region.read_only;
+        let reauth_required = settings.action == SessionAnomalyAction::StepUp;
+        if reauth_required {
+            // Ending the session stops the refresh token; the step-up
+            // catches access tokens still in their lifetime
+            self.redis
+                .set_session_step_up(
+                    &user,
+                    &device,
+                    Utc::now().timestamp(),
+                    self.config.jwt.access_token_ttl,
+                )
+                .await?;
+            if !read_only {
+                AuthService::new(self.db.clone(), self.redis.clone(), self.config.clone())
+                    .logout(user_id, device_id)
+                    .await?;
+            }
+        } else {
+            // Told once; the same place again isn't news
+            self.add_history(&user, &device, &anomalies).await?;
+        }
+
+        if read_only {
+            let signals: Vec<AnomalySignal> = anomalies.iter().map(|(signal, _)| *signal).collect();
+            tracing::warn!(
+                "Session anomaly for user {} device {} in a read-only region: {:?}",
+                user_id,
+                device_id,
+                signals
+            );
+        } else {
+            self.report(
+                user_id,
+                device_id,
+                &anomalies,
+                origin,
+                user_agent,
+                reauth_required,
+            )
+            .await?;
+        }
+
+        if reauth_required {
+            return Err(AppError::ReauthRequired);
+        }
+
+        Ok(())
+    }
+
+    /// Start a new history for a device that just logged in
+    pub async fn reset(&self, user_id: Uuid, device_id: i32) -> AppResult<()> {
+        let signals = ALL_SIGNALS.map(|s| s.as_str());
+        self.redis
+            .clear_session_history(&user_id.to_string(), &device_id.to_string(), &signals)
+            .await
+    }
+
+    async fn add_history(
+        &self,
+        user: &str,
+        device: &str,
+        values: &[(AnomalySignal, String)],
+    ) -> AppResult<()> {
+        let entries: Vec<(&str, &str)> = values
+            .iter()
+            .map(|(signal, value)| (signal.as_str(), value.as_str()))
+            .collect();
+        self.redis
+            .add_session_history(user, device, &entries, self.config.jwt.refresh_token_ttl)
+            .await
+    }
+
+    async fn report(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        anomalies: &[(AnomalySignal, String)],
+        origin: &ClientOrigin,
+        user_agent: Option<&str>,
+        reauth_required: bool,
+    ) -> AppResult<()> {
+        let signals: Vec<AnomalySignal> = anomalies.iter().map(|(signal, _)| *signal).collect();
+        tracing::warn!(
+            "Session anomaly for user {} device {}: {:?}",
+            user_id,
+            device_id,
+            signals
+        );
+
+        let event = SessionAnomalyEvent {
+            device_id,
+            signals: signals.clone(),
+            ip: origin.ip.map(|ip| ip.to_string()),
+            country: origin.country.clone(),
+            user_agent: user_agent.map(|ua| truncate(ua, MAX_USER_AGENT_LENGTH)),
+            reauth_required,
+            detected_at: Utc::now(),
+        };
+        let payload = serde_json::to_value(&event)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize session anomaly: {}", e))?;
+
+        let mut conn = self.db.acquire().await?;
+        OutboxService::enqueue(&mut conn, user_id, WS_SESSION_ANOMALY, &payload).await?;
+
+        self.audit
+            .record(
+                Some(user_id),
+                "session.anomaly",
+                "user",
+                Some(&user_id.to_string()),
+                json!({
+                    "device_id": device_id,
+                    "signals": signals,
+                    "ip": event.ip,
+                    "country": event.country,
+                    "user_agent": event.user_agent,
+                    "action": self.config.session_anomaly.action.as_str(),
+                }),
+            )
+            .await
+    }
+}
+
+/// The request's value for a signal, if it has one
+fn observed(
+    signal: AnomalySignal,
+    origin: &ClientOrigin,
+    user_agent: Option<&str>,
+) -> Option<String> {
+    match signal {
+        AnomalySignal::Network => origin.ip.map(network),
+        AnomalySignal::Country => origin.country.clone(),
+        AnomalySignal::UserAgent => user_agent.map(user_agent_family),
+    }
+}
+
+/// The /16 (IPv4) or /32 (IPv6) network an address is in, so moving
+/// around a provider's pool doesn't count as a change
+fn network(ip: IpAddr) -> String {
+    match ip {
+        IpAddr::V4(v4) => {
+            let [a, b, _, _] = v4.octets();
+            format!("{}.{}.0.0/16", a, b)
+        }
+        IpAddr::V6(v6) => {
+            let segments = v6.segments();
+            format!("{:x}:{:x}::/32", segments[0], segments[1])
+        }
+    }
+}
+
+/// A User-Agent without its version numbers, so app and browser updates
+/// don't count as a change but a different browser or OS does
+fn user_agent_family(user_agent: &str) -> String {
+    let family: String = user_agent.chars().filter(|c| !c.is_ascii_digit()).collect();
+    truncate(&family, MAX_USER_AGENT_LENGTH)
+}
+
+fn truncate(value: &str, max_chars: usize) -> String {
+    value.chars().take(max_chars).collect()
+}
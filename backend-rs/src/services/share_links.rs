@@ -0,0 +1,301 @@
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use chrono::{DateTime, Duration, Utc};
+use rand::RngCore;
+use serde_json::json;
+use sha2::{Digest, Sha256};
+use sqlx::{types::Json, PgPool};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        ConversationType, CreatedShareLink, MessageType, ParticipantRole, ShareLink,
+        ShareMessageInput, SharedMessage, SharedSnapshot,
+    },
+    services::audit::AuditService,
+};
+
+const MAX_SHARED_MESSAGES: usize = 200;
+const MAX_TEXT_LENGTH: usize = 10_000;
+const MAX_TITLE_LENGTH: usize = 200;
+const DEFAULT_TTL_SECONDS: u64 = 7 * 24 * 60 * 60;
+const MIN_TTL_SECONDS: u64 = 60;
+const MAX_TTL_SECONDS: u64 = 30 * 24 * 60 * 60;
+
+/// Read-only snapshots of a thread for sharing outside the app. Messages
+/// are end-to-end encrypted, so the sharer sends the plaintext of the
+/// messages they pick; the server checks they are in the conversation and
+/// stores the text with sender names and timestamps. Anyone with the link
+/// can read the snapshot until it expires or is revoked. Group owners and
+/// admins can turn sharing off, which revokes every link to the group.
+pub struct ShareLinksService {
+    db: PgPool,
+    audit: AuditService,
+}
+
+impl ShareLinksService {
+    pub fn new(db: PgPool) -> Self {
+        let audit = AuditService::new(db.clone());
+        Self { db, audit }
+    }
+
+    /// Snapshot `messages` behind a new link. The token is returned once;
+    /// only its hash is stored.
+    pub async fn create(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        messages: &[ShareMessageInput],
+        title: Option<&str>,
+        expires_in: Option<u64>,
+    ) -> AppResult<CreatedShareLink> {
+        let (_, _, share_links_enabled) = self.membership(conversation_id, user_id).await?;
+        if !share_links_enabled {
+            return Err(AppError::ShareLinksDisabled);
+        }
+
+        if messages.is_empty() || messages.len() > MAX_SHARED_MESSAGES {
+            return Err(AppError::Validation(format!(
+                "Share between 1 and {} messages",
+                MAX_SHARED_MESSAGES
+            )));
+        }
+        if messages
+            .iter()
+            .any(|m| m.text.trim().is_empty() || m.text.chars().count() > MAX_TEXT_LENGTH)
+        {
+            return Err(AppError::Validation(format!(
+                "Message text must be between 1 and {} characters",
+                MAX_TEXT_LENGTH
+            )));
+        }
+
+        let title = title.map(str::trim).filter(|t| !t.is_empty());
+        if title.is_some_and(|t| t.chars().count() > MAX_TITLE_LENGTH) {
+            return Err(AppError::Validation(format!(
+                "Title must be at most {} characters",
+                MAX_TITLE_LENGTH
+            )));
+        }
+
+        let ttl = expires_in.unwrap_or(DEFAULT_TTL_SECONDS);
+        if !(MIN_TTL_SECONDS..=MAX_TTL_SECONDS).contains(&ttl) {
+            return Err(AppError::Validation(format!(
+                "expires_in must be between {} and {} seconds",
+                MIN_TTL_SECONDS, MAX_TTL_SECONDS
+            )));
+        }
+
+        let mut message_ids: Vec<Uuid> = messages.iter().map(|m| m.message_id).collect();
+        message_ids.sort_unstable();
+        message_ids.dedup();
+        if message_ids.len() != messages.len() {
+            return Err(AppError::Validation(
+                "Each message can only be shared once per link".to_string(),
+            ));
+        }
+
+        // System messages have no text of their own, deleted ones are gone
+        // for everyone and shadow-limited ones only show to their sender
+        let found: Vec<(Uuid, MessageType, DateTime<Utc>, String)> = sqlx::query_as(
+            r#"
+            SELECT m.id, m.type, m.created_at, u.display_name FROM messages m
+            JOIN users u ON u.id = m.sender_id
+            WHERE m.conversation_id = $1 AND m.id = ANY($2)
+            AND m.deleted_at IS NULL AND m.type <> 'system'
+            AND (m.shadow_limited = FALSE OR m.sender_id = $3)
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(&message_ids)
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+        if found.len() != message_ids.len() {
+            return Err(AppError::MessageNotFound);
+        }
+
+        let snapshot: Vec<SharedMessage> = messages
+            .iter()
+            .filter_map(|input| {
+                let (_, message_type, sent_at, sender_name) =
+                    found.iter().find(|(id, ..)| *id == input.message_id)?;
+                Some(SharedMessage {
+                    sender_name: sender_name.clone(),
+                    message_type: *message_type,
+                    text: input.text.clone(),
+                    sent_at: *sent_at,
+                })
+            })
+            .collect();
+
+        let mut secret = [0u8; 24];
+        rand::thread_rng().fill_bytes(&mut secret);
+        let token = URL_SAFE_NO_PAD.encode(secret);
+
+        let share_link: ShareLink = sqlx::query_as(
+            r#"
+            INSERT INTO share_links (id, conversation_id, created_by, token_hash, title, snapshot, message_count, expires_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(hash_token(&token))
+        .bind(title)
+        .bind(Json(&snapshot))
+        .bind(snapshot.len() as i32)
+        .bind(Utc::now() + Duration::seconds(ttl as i64))
+        .fetch_one(&self.db)
+        .await?;
+
+        self.record(user_id, "share_link.created", &share_link)
+            .await?;
+
+        Ok(CreatedShareLink { share_link, token })
+    }
+
+    /// Links to the conversation: all of them for group owners and admins,
+    /// otherwise the caller's own. Newest first.
+    pub async fn list(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<Vec<ShareLink>> {
+        let (conversation_type, role, _) = self.membership(conversation_id, user_id).await?;
+        let sees_all =
+            conversation_type == ConversationType::Group && role != ParticipantRole::Member;
+
+        let links: Vec<ShareLink> = sqlx::query_as(
+            r#"
+            SELECT * FROM share_links
+            WHERE conversation_id = $1 AND ($2 OR created_by = $3)
+            ORDER BY created_at DESC
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(sees_all)
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(links)
+    }
+
+    /// Revoke a link (its creator, or a group owner or admin)
+    pub async fn revoke(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        link_id: Uuid,
+    ) -> AppResult<ShareLink> {
+        let (conversation_type, role, _) = self.membership(conversation_id, user_id).await?;
+        let moderates =
+            conversation_type == ConversationType::Group && role != ParticipantRole::Member;
+
+        let share_link: Option<ShareLink> = sqlx::query_as(
+            r#"
+            UPDATE share_links SET revoked_at = COALESCE(revoked_at, NOW())
+            WHERE id = $1 AND conversation_id = $2 AND ($3 OR created_by = $4)
+            RETURNING *
+            "#,
+        )
+        .bind(link_id)
+        .bind(conversation_id)
+        .bind(moderates)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+        let share_link = share_link.ok_or(AppError::ShareLinkNotFound)?;
+
+        self.record(user_id, "share_link.revoked", &share_link)
+            .await?;
+
+        Ok(share_link)
+    }
+
+    /// The snapshot behind a live link, counting the view
+    pub async fn view(&self, token: &str) -> AppResult<SharedSnapshot> {
+        let link: Option<(
+            Uuid,
+            Uuid,
+            Option<String>,
+            Json<Vec<SharedMessage>>,
+            DateTime<Utc>,
+            DateTime<Utc>,
+        )> = sqlx::query_as(
+            r#"
+            UPDATE share_links
+            SET view_count = view_count + 1, last_viewed_at = NOW()
+            WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+            RETURNING conversation_id, created_by, title, snapshot, created_at, expires_at
+            "#,
+        )
+        .bind(hash_token(token))
+        .fetch_optional(&self.db)
+        .await?;
+        let (conversation_id, created_by, title, Json(messages), created_at, expires_at) =
+            link.ok_or(AppError::ShareLinkNotFound)?;
+
+        let (conversation_name, shared_by): (Option<String>, String) = sqlx::query_as(
+            r#"
+            SELECT CASE WHEN c.type = 'group' THEN c.name END, u.display_name
+            FROM conversations c, users u
+            WHERE c.id = $1 AND u.id = $2
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(created_by)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(SharedSnapshot {
+            title,
+            conversation_name,
+            shared_by,
+            created_at,
+            expires_at,
+            messages,
+        })
+    }
+
+    /// The conversation's type, the caller's role in it and whether it
+    /// allows sharing
+    async fn membership(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<(ConversationType, ParticipantRole, bool)> {
+        let member: Option<(ConversationType, ParticipantRole, bool)> = sqlx::query_as(
+            r#"
+            SELECT c.type, p.role, c.share_links_enabled FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        member.ok_or(AppError::NotParticipant)
+    }
+
+    async fn record(&self, actor_id: Uuid, action: &str, share_link: &ShareLink) -> AppResult<()> {
+        self.audit
+            .record(
+                Some(actor_id),
+                action,
+                "share_link",
+                Some(&share_link.id.to_string()),
+                json!({
+                    "conversation_id": share_link.conversation_id,
+                    "message_count": share_link.message_count,
+                    "expires_at": share_link.expires_at,
+                }),
+            )
+            .await
+    }
+}
+
+fn hash_token(token: &str) -> String {
+    format!("{:x}", Sha256::digest(token.as_bytes()))
+}
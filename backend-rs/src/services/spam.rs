@@ -0,0 +1,349 @@
+use std::time::Duration;
+
+use chrono::{DateTime, Utc};
+use serde::Serialize;
+use sha2::{Digest, Sha256};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{SpamSettings, UpdateSpamSettings},
+    storage::redis::RedisClient,
+};
+
+pub const SEND_RATE_WINDOW: Duration = Duration::from_secs(60);
+const FANOUT_WINDOW: Duration = Duration::from_secs(10 * 60);
+
+/// What to do with a send the policy flagged, ordered by severity
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum SpamAction {
+    /// Store the message but do not deliver it to the other participants
+    ShadowLimit,
+    /// Reject the send; the client may retry after the given seconds
+    Throttle { retry_after: u64 },
+}
+
+/// Metadata about a send; message content is never inspected beyond its digest
+#[derive(Debug, Clone)]
+pub struct SpamSignals {
+    pub sends_last_minute: i64,
+    pub account_created_at: DateTime<Utc>,
+    pub recipients: i64,
+    pub stranger_recipients: i64,
+    pub identical_fanout: i64,
+}
+
+impl SpamSignals {
+    pub fn account_age_hours(&self) -> i64 {
+        (Utc::now() - self.account_created_at).num_hours()
+    }
+
+    pub fn stranger_ratio(&self) -> f64 {
+        if self.recipients == 0 {
+            return 0.0;
+        }
+        self.stranger_recipients as f64 / self.recipients as f64
+    }
+}
+
+/// A single check in the spam policy
+pub trait SpamRule: Send + Sync {
+    fn name(&self) -> &'static str;
+    fn evaluate(&self, signals: &SpamSignals, settings: &SpamSettings) -> Option<SpamAction>;
+}
+
+/// Throttle senders above the per-minute limit (stricter for new accounts)
+pub struct SendRateRule;
+
+impl SpamRule for SendRateRule {
+    fn name(&self) -> &'static str {
+        "send_rate"
+    }
+
+    fn evaluate(&self, signals: &SpamSignals, settings: &SpamSettings) -> Option<SpamAction> {
+        let limit = if signals.account_age_hours() < settings.new_account_age_hours as i64 {
+            settings.new_account_max_sends_per_minute
+        } else {
+            settings.max_sends_per_minute
+        };
+
+        (signals.sends_last_minute > limit as i64).then_some(SpamAction::Throttle {
+            retry_after: SEND_RATE_WINDOW.as_secs(),
+        })
+    }
+}
+
+/// Shadow-limit a new account that mostly messages people who haven't
+/// added it as a contact. There is no captcha to prove a human is behind
+/// it, so the sender isn't told.
+pub struct StrangerRatioRule;
+
+impl SpamRule for StrangerRatioRule {
+    fn name(&self) -> &'static str {
+        "stranger_ratio"
+    }
+
+    fn evaluate(&self, signals: &SpamSignals, settings: &SpamSettings) -> Option<SpamAction> {
+        let is_new = signals.account_age_hours() < settings.new_account_age_hours as i64;
+        let flagged = signals.recipients >= settings.stranger_min_recipients as i64
+            && signals.stranger_ratio() >= settings.stranger_ratio_threshold;
+
+        (is_new && flagged).then_some(SpamAction::ShadowLimit)
+    }
+}
+
+/// Shadow-limit the same envelope being sprayed across many conversations
+pub struct IdenticalFanoutRule;
+
+impl SpamRule for IdenticalFanoutRule {
+    fn name(&self) -> &'static str {
+        "identical_fanout"
+    }
+
+    fn evaluate(&self, signals: &SpamSignals, settings: &SpamSettings) -> Option<SpamAction> {
+        (signals.identical_fanout > settings.max_identical_fanout as i64)
+            .then_some(SpamAction::ShadowLimit)
+    }
+}
+
+/// Ordered set of rules; the most severe triggered action wins
+pub struct SpamPolicy {
+    rules: Vec<Box<dyn SpamRule>>,
+}
+
+impl SpamPolicy {
+    pub fn new(rules: Vec<Box<dyn SpamRule>>) -> Self {
+        Self { rules }
+    }
+
+    pub fn evaluate(
+        &self,
+        signals: &SpamSignals,
+        settings: &SpamSettings,
+    ) -> Option<(&'static str, SpamAction)> {
+        self.rules
+            .iter()
+            .filter_map(|rule| rule.evaluate(signals, settings).map(|a| (rule.name(), a)))
+            .max_by_key(|(_, action)| *action)
+    }
+}
+
+impl Default for SpamPolicy {
+    fn default() -> Self {
+        Self::new(vec![
+            Box::new(SendRateRule),
+            Box::new(StrangerRatioRule),
+            Box::new(IdenticalFanoutRule),
+        ])
+    }
+}
+
+pub struct SpamService {
+    db: PgPool,
+    redis: RedisClient,
+    policy: SpamPolicy,
+}
+
+impl SpamService {
+    pub fn new(db: PgPool, redis: RedisClient) -> Self {
+        Self {
+            db,
+            redis,
+            policy: SpamPolicy::default(),
+        }
+    }
+
+    /// Get the current spam thresholds
+    pub async fn get_settings(&self) -> AppResult<SpamSettings> {
+        let settings: SpamSettings = sqlx::query_as("SELECT * FROM spam_settings")
+            .fetch_one(&self.db)
+            .await?;
+
+        Ok(settings)
+    }
+
+    /// Update spam thresholds (admin)
+    pub async fn update_settings(&self, update: &UpdateSpamSettings) -> AppResult<SpamSettings> {
+        let thresholds = [
+            update.max_sends_per_minute,
+            update.new_account_age_hours,
+            update.new_account_max_sends_per_minute,
+            update.stranger_min_recipients,
+            update.max_identical_fanout,
+        ];
+        if thresholds.iter().flatten().any(|v| *v < 0) {
+            return Err(AppError::Validation(
+                "Spam thresholds must not be negative".to_string(),
+            ));
+        }
+
+        if let Some(ratio) = update.stranger_ratio_threshold {
+            if !(0.0..=1.0).contains(&ratio) {
+                return Err(AppError::Validation(
+                    "Stranger ratio threshold must be between 0 and 1".to_string(),
+                ));
+            }
+        }
+
+        let settings: SpamSettings = sqlx::query_as(
+            r#"
+            UPDATE spam_settings
+            SET enabled = COALESCE($1, enabled),
+                max_sends_per_minute = COALESCE($2, max_sends_per_minute),
+                new_account_age_hours = COALESCE($3, new_account_age_hours),
+                new_account_max_sends_per_minute = COALESCE($4, new_account_max_sends_per_minute),
+                stranger_ratio_threshold = COALESCE($5, stranger_ratio_threshold),
+                stranger_min_recipients = COALESCE($6, stranger_min_recipients),
+                max_identical_fanout = COALESCE($7, max_identical_fanout)
+            RETURNING *
+            "#,
+        )
+        .bind(update.enabled)
+        .bind(update.max_sends_per_minute)
+        .bind(update.new_account_age_hours)
+        .bind(update.new_account_max_sends_per_minute)
+        .bind(update.stranger_ratio_threshold)
+        .bind(update.stranger_min_recipients)
+        .bind(update.max_identical_fanout)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(settings)
+    }
+
+    /// Evaluate a send against the policy. Returns the action to take, if any.
+    pub async fn evaluate(
+        &self,
+        sender_id: Uuid,
+        conversation_id: Uuid,
+        content: &[u8],
+    ) -> AppResult<Option<SpamAction>> {
+        let settings = self.get_settings().await?;
+        if !settings.enabled {
+            return Ok(None);
+        }
+
+        let signals = self.collect_signals(sender_id, conversation_id, content).await?;
+
+        let Some((rule, action)) = self.policy.evaluate(&signals, &settings) else {
+            return Ok(None);
+        };
+
+        tracing::warn!(
+            "Spam rule {} flagged sender {} in conversation {}: {:?}",
+            rule,
+            sender_id,
+            conversation_id,
+            action
+        );
+
+        Ok(Some(action))
+    }
+
+    /// Evaluate a message relayed from another server for `recipient_id`.
+    /// The remote sender's age is how long this server has been hearing
+    /// from it, and it is a stranger unless the recipient has written to
+    /// it.
+    pub async fn evaluate_remote(
+        &self,
+        from: &str,
+        recipient_id: Uuid,
+        content: &[u8],
+    ) -> AppResult<Option<SpamAction>> {
+        let settings = self.get_settings().await?;
+        if !settings.enabled {
+            return Ok(None);
+        }
+
+        let sends_last_minute = self.redis.incr_send_rate(from, SEND_RATE_WINDOW).await?;
+        let digest = format!("{:x}", Sha256::digest(content));
+        let identical_fanout = self
+            .redis
+            .incr_envelope_fanout(from, &digest, FANOUT_WINDOW)
+            .await?;
+
+        let (first_seen, known): (Option<DateTime<Utc>>, bool) = sqlx::query_as(
+            r#"
+            SELECT (SELECT MIN(created_at) FROM federated_messages
+                    WHERE remote_address = $1 AND direction = 'inbound'),
+                   EXISTS(SELECT 1 FROM federated_messages
+                          WHERE remote_address = $1 AND user_id = $2 AND direction = 'outbound')
+            "#,
+        )
+        .bind(from)
+        .bind(recipient_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        let signals = SpamSignals {
+            sends_last_minute,
+            account_created_at: first_seen.unwrap_or_else(Utc::now),
+            recipients: 1,
+            stranger_recipients: if known { 0 } else { 1 },
+            identical_fanout,
+        };
+
+        let Some((rule, action)) = self.policy.evaluate(&signals, &settings) else {
+            return Ok(None);
+        };
+
+        tracing::warn!(
+            "Spam rule {} flagged remote sender {} to {}: {:?}",
+            rule,
+            from,
+            recipient_id,
+            action
+        );
+
+        Ok(Some(action))
+    }
+
+    async fn collect_signals(
+        &self,
+        sender_id: Uuid,
+        conversation_id: Uuid,
+        content: &[u8],
+    ) -> AppResult<SpamSignals> {
+        let sender = sender_id.to_string();
+
+        let sends_last_minute = self.redis.incr_send_rate(&sender, SEND_RATE_WINDOW).await?;
+
+        let digest = format!("{:x}", Sha256::digest(content));
+        let identical_fanout = self
+            .redis
+            .incr_envelope_fanout(&sender, &digest, FANOUT_WINDOW)
+            .await?;
+
+        let account_created_at: DateTime<Utc> =
+            sqlx::query_scalar("SELECT created_at FROM users WHERE id = $1")
+                .bind(sender_id)
+                .fetch_optional(&self.db)
+                .await?
+                .ok_or(AppError::UserNotFound)?;
+
+        // Recipients who have not added the sender as a contact
+        let (recipients, stranger_recipients): (i64, i64) = sqlx::query_as(
+            r#"
+            SELECT COUNT(*),
+                   COUNT(*) FILTER (WHERE c.id IS NULL)
+            FROM participants p
+            LEFT JOIN contacts c ON c.user_id = p.user_id AND c.contact_id = $2
+            WHERE p.conversation_id = $1 AND p.user_id != $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(sender_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(SpamSignals {
+            sends_last_minute,
+            account_created_at,
+            recipients,
+            stranger_recipients,
+            identical_fanout,
+        })
+    }
+}
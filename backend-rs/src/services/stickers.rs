@@ -4,10 +4,13 @@ use uuid::Uuid;
 
 use crate::{
     error::{AppError, AppResult},
-    models::{Sticker, StickerPack, StickerPackWithStickers, UserStickerPack},
+    models::{Sticker, StickerPack, StickerPackWithStickers, UserStickerPack, Watermark},
     storage::minio::MinioClient,
 };
 
+/// Most-downloaded public packs searched for trending suggestions
+const TRENDING_PACKS: i64 = 20;
+
 pub struct StickersService {
     db: PgPool,
     minio: MinioClient,
@@ -29,7 +32,7 @@ impl StickersService {
             sqlx::query_as(
                 r#"
                 SELECT * FROM sticker_packs
-                WHERE is_official = $1
+                WHERE is_official = $1 AND workspace_id IS NULL
                 ORDER BY downloads DESC, created_at DESC
                 LIMIT $2 OFFSET $3
                 "#,
@@ -43,6 +46,7 @@ impl StickersService {
             sqlx::query_as(
                 r#"
                 SELECT * FROM sticker_packs
+                WHERE workspace_id IS NULL
                 ORDER BY downloads DESC, created_at DESC
                 LIMIT $1 OFFSET $2
                 "#,
@@ -63,7 +67,8 @@ impl StickersService {
         let packs: Vec<StickerPack> = sqlx::query_as(
             r#"
             SELECT * FROM sticker_packs
-            WHERE LOWER(name) LIKE $1 OR LOWER(description) LIKE $1 OR LOWER(author) LIKE $1
+            WHERE (LOWER(name) LIKE $1 OR LOWER(description) LIKE $1 OR LOWER(author) LIKE $1)
+            AND workspace_id IS NULL
             ORDER BY downloads DESC
             LIMIT $2
             "#,
@@ -96,63 +101,140 @@ impl StickersService {
         Ok(StickerPackWithStickers { pack, stickers })
     }
 
-    /// Download (add) a sticker pack to user's collection
-    pub async fn download_pack(&self, user_id: Uuid, pack_id: Uuid) -> AppResult<()> {
+    /// Download (add) a sticker pack to user's collection. Idempotent: the
+    /// pack is added and counted once however many times this is called.
+    pub async fn download_pack(
+        &self,
+        user_id: Uuid,
+        pack_id: Uuid,
+    ) -> AppResult<StickerPackWithStickers> {
+        let mut tx = self.db.begin().await?;
+
         // Check if pack exists
-        let pack_exists: Option<(i64,)> =
-            sqlx::query_as("SELECT 1 FROM sticker_packs WHERE id = $1")
+        let pack_workspace: Option<Option<Uuid>> =
+            sqlx::query_scalar("SELECT workspace_id FROM sticker_packs WHERE id = $1")
                 .bind(pack_id)
-                .fetch_optional(&self.db)
+                .fetch_optional(&mut *tx)
                 .await?;
 
-        if pack_exists.is_none() {
-            return Err(AppError::StickerPackNotFound);
+        let pack_workspace = pack_workspace.ok_or(AppError::StickerPackNotFound)?;
+
+        // Workspace packs are only available to workspace members
+        if let Some(workspace_id) = pack_workspace {
+            let is_member: Option<(i64,)> = sqlx::query_as(
+                "SELECT 1::BIGINT FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+            )
+            .bind(workspace_id)
+            .bind(user_id)
+            .fetch_optional(&mut *tx)
+            .await?;
+
+            if is_member.is_none() {
+                return Err(AppError::StickerPackNotFound);
+            }
         }
 
-        // Check if already owned
-        let already_owned: Option<(i64,)> = sqlx::query_as(
-            "SELECT 1 FROM user_sticker_packs WHERE user_id = $1 AND pack_id = $2",
+        // Add to the end of the user's collection. A concurrent or repeated
+        // download hits the unique (user_id, pack_id) constraint and inserts
+        // nothing.
+        let inserted: Option<Uuid> = sqlx::query_scalar(
+            r#"
+            INSERT INTO user_sticker_packs (id, user_id, pack_id, position)
+            SELECT $1, $2, $3, COALESCE(MAX(position) + 1, 0)
+            FROM user_sticker_packs WHERE user_id = $2
+            ON CONFLICT (user_id, pack_id) DO NOTHING
+            RETURNING id
+            "#,
         )
+        .bind(Uuid::new_v4())
         .bind(user_id)
         .bind(pack_id)
-        .fetch_optional(&self.db)
+        .fetch_optional(&mut *tx)
         .await?;
 
-        if already_owned.is_some() {
-            return Err(AppError::StickerPackAlreadyOwned);
-        }
+        // Only the download that added the pack counts
+        let pack: Option<StickerPack> = if inserted.is_some() {
+            sqlx::query_as(
+                "UPDATE sticker_packs SET downloads = downloads + 1 WHERE id = $1 RETURNING *",
+            )
+            .bind(pack_id)
+            .fetch_optional(&mut *tx)
+            .await?
+        } else {
+            sqlx::query_as("SELECT * FROM sticker_packs WHERE id = $1")
+                .bind(pack_id)
+                .fetch_optional(&mut *tx)
+                .await?
+        };
+
+        let pack = pack.ok_or(AppError::StickerPackNotFound)?;
 
-        // Get next position
-        let max_pos: Option<i32> = sqlx::query_scalar(
-            "SELECT MAX(position) FROM user_sticker_packs WHERE user_id = $1",
+        let stickers: Vec<Sticker> = sqlx::query_as(
+            "SELECT * FROM stickers WHERE pack_id = $1 ORDER BY position ASC",
         )
-        .bind(user_id)
-        .fetch_one(&self.db)
+        .bind(pack_id)
+        .fetch_all(&mut *tx)
         .await?;
 
-        let position = max_pos.unwrap_or(-1) + 1;
+        tx.commit().await?;
 
-        // Add to user's collection
-        sqlx::query(
+        Ok(StickerPackWithStickers { pack, stickers })
+    }
+
+    /// Stickers for an emoji, from the user's packs in their order and then,
+    /// if `include_trending`, from popular public packs they haven't added
+    pub async fn suggest(
+        &self,
+        user_id: Uuid,
+        emoji: &str,
+        include_trending: bool,
+        limit: i32,
+    ) -> AppResult<Vec<Sticker>> {
+        let mut stickers: Vec<Sticker> = sqlx::query_as(
             r#"
-            INSERT INTO user_sticker_packs (id, user_id, pack_id, position)
-            VALUES ($1, $2, $3, $4)
+            SELECT s.* FROM stickers s
+            JOIN user_sticker_packs usp ON usp.pack_id = s.pack_id
+            WHERE usp.user_id = $1 AND s.emoji = $2
+            ORDER BY usp.position ASC, s.position ASC
+            LIMIT $3
             "#,
         )
-        .bind(Uuid::new_v4())
         .bind(user_id)
-        .bind(pack_id)
-        .bind(position)
-        .execute(&self.db)
+        .bind(emoji)
+        .bind(limit)
+        .fetch_all(&self.db)
         .await?;
 
-        // Increment download count
-        sqlx::query("UPDATE sticker_packs SET downloads = downloads + 1 WHERE id = $1")
-            .bind(pack_id)
-            .execute(&self.db)
+        let remaining = limit - stickers.len() as i32;
+        if include_trending && remaining > 0 {
+            let trending: Vec<Sticker> = sqlx::query_as(
+                r#"
+                SELECT s.* FROM (
+                    SELECT id, downloads FROM sticker_packs
+                    WHERE workspace_id IS NULL
+                    ORDER BY downloads DESC
+                    LIMIT $3
+                ) p
+                JOIN stickers s ON s.pack_id = p.id
+                WHERE s.emoji = $2
+                AND NOT EXISTS (
+                    SELECT 1 FROM user_sticker_packs WHERE user_id = $1 AND pack_id = p.id
+                )
+                ORDER BY p.downloads DESC, s.position ASC
+                LIMIT $4
+                "#,
+            )
+            .bind(user_id)
+            .bind(emoji)
+            .bind(TRENDING_PACKS)
+            .bind(remaining)
+            .fetch_all(&self.db)
             .await?;
 
-        Ok(())
+            stickers.extend(trending);
+        }
+
+        Ok(stickers)
     }
 
     /// Remove a sticker pack from user's collection
@@ -172,6 +254,28 @@ impl StickersService {
         Ok(())
     }
 
+    /// Set each pack's download count to the number of users who have it.
+    /// Removing a pack doesn't lower the count, so after a recount users
+    /// who removed it are no longer counted. Returns how many packs changed.
+    pub async fn recount_downloads(&self) -> AppResult<u64> {
+        let result = sqlx::query(
+            r#"
+            UPDATE sticker_packs p SET downloads = counts.downloads
+            FROM (
+                SELECT sp.id, COUNT(usp.id) AS downloads
+                FROM sticker_packs sp
+                LEFT JOIN user_sticker_packs usp ON usp.pack_id = sp.id
+                GROUP BY sp.id
+            ) counts
+            WHERE p.id = counts.id AND p.downloads IS DISTINCT FROM counts.downloads
+            "#,
+        )
+        .execute(&self.db)
+        .await?;
+
+        Ok(result.rows_affected())
+    }
+
     /// Get user's sticker packs
     pub async fn get_user_packs(&self, user_id: Uuid) -> AppResult<Vec<StickerPackWithStickers>> {
         let user_packs: Vec<UserStickerPack> = sqlx::query_as(
@@ -190,6 +294,24 @@ impl StickersService {
         Ok(result)
     }
 
+    /// Changes whenever `get_user_packs` would: when packs are added,
+    /// removed or reordered, or one of them gains stickers
+    pub async fn user_packs_watermark(&self, user_id: Uuid) -> AppResult<Watermark> {
+        let watermark: Watermark = sqlx::query_as(
+            r#"
+            SELECT COUNT(*) AS count, MAX(GREATEST(usp.updated_at, sp.updated_at)) AS latest
+            FROM user_sticker_packs usp
+            JOIN sticker_packs sp ON sp.id = usp.pack_id
+            WHERE usp.user_id = $1
+            "#,
+        )
+        .bind(user_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(watermark)
+    }
+
     /// Reorder user's sticker packs
     pub async fn reorder_packs(&self, user_id: Uuid, pack_ids: Vec<Uuid>) -> AppResult<()> {
         let mut tx = self.db.begin().await?;
@@ -209,7 +331,19 @@ impl StickersService {
         Ok(())
     }
 
-    /// Create a new sticker pack (admin)
+    /// Get sticker packs scoped to a workspace
+    pub async fn get_workspace_packs(&self, workspace_id: Uuid) -> AppResult<Vec<StickerPack>> {
+        let packs: Vec<StickerPack> = sqlx::query_as(
+            "SELECT * FROM sticker_packs WHERE workspace_id = $1 ORDER BY created_at DESC",
+        )
+        .bind(workspace_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(packs)
+    }
+
+    /// Create a new sticker pack (admin), optionally scoped to a workspace
     pub async fn create_pack(
         &self,
         name: &str,
@@ -217,11 +351,12 @@ impl StickersService {
         description: Option<&str>,
         is_official: bool,
         is_animated: bool,
+        workspace_id: Option<Uuid>,
     ) -> AppResult<StickerPack> {
         let pack: StickerPack = sqlx::query_as(
             r#"
-            INSERT INTO sticker_packs (id, name, author, description, is_official, is_animated, price, downloads)
-            VALUES ($1, $2, $3, $4, $5, $6, 0, 0)
+            INSERT INTO sticker_packs (id, name, author, description, is_official, is_animated, price, downloads, workspace_id)
+            VALUES ($1, $2, $3, $4, $5, $6, 0, 0, $7)
             RETURNING *
             "#,
         )
@@ -231,6 +366,7 @@ impl StickersService {
         .bind(description)
         .bind(is_official)
         .bind(is_animated)
+        .bind(workspace_id)
         .fetch_one(&self.db)
         .await?;
 
@@ -295,6 +431,12 @@ impl StickersService {
         .fetch_one(&self.db)
         .await?;
 
+        // Bumps the watermark of every user who has the pack
+        sqlx::query("UPDATE sticker_packs SET updated_at = NOW() WHERE id = $1")
+            .bind(pack_id)
+            .execute(&self.db)
+            .await?;
+
         Ok(sticker)
     }
 
@@ -0,0 +1,112 @@
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::StorageConfig,
+    error::{AppError, AppResult},
+    models::{CategoryUsage, StorageCategory, StorageUsage},
+};
+
+pub struct StorageService {
+    db: PgPool,
+    config: StorageConfig,
+}
+
+impl StorageService {
+    pub fn new(db: PgPool, config: StorageConfig) -> Self {
+        Self { db, config }
+    }
+
+    /// Summarize a user's object storage usage by category
+    pub async fn get_usage(&self, user_id: Uuid) -> AppResult<StorageUsage> {
+        let categories: Vec<CategoryUsage> = sqlx::query_as(
+            r#"
+            SELECT category, COUNT(*) AS objects, COALESCE(SUM(size_bytes), 0)::BIGINT AS bytes
+            FROM storage_objects
+            WHERE user_id = $1
+            GROUP BY category
+            ORDER BY category
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let used_bytes = categories.iter().map(|c| c.bytes).sum();
+
+        Ok(StorageUsage {
+            used_bytes,
+            quota_bytes: self.config.user_quota,
+            categories,
+        })
+    }
+
+    /// Ensure storing `size` bytes at `bucket/key` keeps the user within quota.
+    /// An existing object at the same key is replaced, so its size is not counted.
+    pub async fn ensure_quota(
+        &self,
+        user_id: Uuid,
+        bucket: &str,
+        key: &str,
+        size: i64,
+    ) -> AppResult<()> {
+        let used: i64 = sqlx::query_scalar(
+            r#"
+            SELECT COALESCE(SUM(size_bytes), 0)::BIGINT
+            FROM storage_objects
+            WHERE user_id = $1 AND NOT (bucket = $2 AND object_key = $3)
+            "#,
+        )
+        .bind(user_id)
+        .bind(bucket)
+        .bind(key)
+        .fetch_one(&self.db)
+        .await?;
+
+        if used + size > self.config.user_quota {
+            return Err(AppError::StorageQuotaExceeded);
+        }
+
+        Ok(())
+    }
+
+    /// Record an uploaded object against the user's usage
+    pub async fn record(
+        &self,
+        user_id: Uuid,
+        category: StorageCategory,
+        bucket: &str,
+        key: &str,
+        size: i64,
+    ) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            INSERT INTO storage_objects (id, user_id, category, bucket, object_key, size_bytes)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (bucket, object_key)
+            DO UPDATE SET user_id = $2, category = $3, size_bytes = $6, created_at = NOW()
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(category)
+        .bind(bucket)
+        .bind(key)
+        .bind(size)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Stop counting a deleted object
+    pub async fn release(&self, bucket: &str, key: &str) -> AppResult<()> {
+        sqlx::query("DELETE FROM storage_objects WHERE bucket = $1 AND object_key = $2")
+            .bind(bucket)
+            .bind(key)
+            .execute(&self.db)
+            .await?;
+
+        Ok(())
+    }
+}
@@ -0,0 +1,227 @@
+use std::sync::Arc;
+
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::SuggestionsConfig,
+    error::AppResult,
+    jobs::{Job, JobHandler, JobQueue},
+    models::{ConversationType, MessageType, Suggestion, SuggestionsEvent, WS_SUGGESTIONS},
+    services::{circuit_breaker::CircuitBreaker, outbox::OutboxService},
+};
+
+pub const SUGGESTIONS_JOB_KIND: &str = "message_suggestions";
+const MAX_SUGGESTIONS: usize = 3;
+const MAX_ACTION_LENGTH: usize = 64;
+const MAX_LABEL_LENGTH: usize = 100;
+
+/// What the sidecar is told about a message. Content, sender and
+/// recipients are never sent, encrypted or not.
+#[derive(Debug, Serialize)]
+struct MessageMetadata {
+    message_id: Uuid,
+    message_type: MessageType,
+    conversation_type: ConversationType,
+    participant_count: i64,
+    is_reply: bool,
+    sent_at: DateTime<Utc>,
+}
+
+#[derive(Debug, Deserialize)]
+struct SidecarResponse {
+    #[serde(default)]
+    suggestions: Vec<Suggestion>,
+}
+
+/// Quick-action suggestions from an optional ML sidecar (`SUGGESTIONS_URL`).
+/// After a message is sent, a job posts its metadata to the sidecar and
+/// forwards any suggestions to the other participants as a `suggestions`
+/// event. Suggestions only matter right away, so a slow or failing sidecar
+/// drops them rather than retrying.
+pub struct SuggestionsService {
+    db: PgPool,
+    http: reqwest::Client,
+    breaker: Arc<CircuitBreaker>,
+    config: SuggestionsConfig,
+}
+
+impl SuggestionsService {
+    pub fn new(
+        db: PgPool,
+        http: reqwest::Client,
+        breaker: Arc<CircuitBreaker>,
+        config: SuggestionsConfig,
+    ) -> Self {
+        Self {
+            db,
+            http,
+            breaker,
+            config,
+        }
+    }
+
+    /// Queue a suggestions lookup for a sent message. Best effort: a failure
+    /// is logged and the send still succeeds.
+    pub async fn request(jobs: &JobQueue, message_id: Uuid) {
+        let payload = serde_json::json!({ "message_id": message_id });
+        if let Err(e) = jobs.enqueue(SUGGESTIONS_JOB_KIND, payload).await {
+            tracing::warn!(
+                "Failed to queue suggestions for message {}: {}",
+                message_id,
+                e
+            );
+        }
+    }
+
+    /// Ask the sidecar about a message and pass its suggestions on
+    pub async fn suggest(&self, message_id: Uuid) -> AppResult<()> {
+        let Some(url) = &self.config.url else {
+            return Ok(());
+        };
+
+        let row: Option<(
+            Uuid,
+            Uuid,
+            MessageType,
+            ConversationType,
+            i64,
+            bool,
+            DateTime<Utc>,
+        )> = sqlx::query_as(
+            r#"
+            SELECT m.conversation_id, m.sender_id, m.type, c.type,
+                   (SELECT COUNT(*) FROM participants p
+                    WHERE p.conversation_id = c.id AND p.left_at IS NULL),
+                   m.reply_to_id IS NOT NULL, m.created_at
+            FROM messages m
+            JOIN conversations c ON c.id = m.conversation_id
+            WHERE m.id = $1 AND m.deleted_at IS NULL
+            "#,
+        )
+        .bind(message_id)
+        .fetch_optional(&self.db)
+        .await?;
+        // Deleted before the job ran
+        let Some((
+            conversation_id,
+            sender_id,
+            message_type,
+            conversation_type,
+            participant_count,
+            is_reply,
+            sent_at,
+        )) = row
+        else {
+            return Ok(());
+        };
+        let metadata = MessageMetadata {
+            message_id,
+            message_type,
+            conversation_type,
+            participant_count,
+            is_reply,
+            sent_at,
+        };
+
+        if self.breaker.check().is_err() {
+            return Ok(());
+        }
+        let result = self.call_sidecar(url, &metadata).await;
+        self.breaker.record(result.is_ok());
+
+        let suggestions: Vec<Suggestion> = match result {
+            Ok(response) => response
+                .suggestions
+                .into_iter()
+                .filter(|s| {
+                    is_valid(&s.action, MAX_ACTION_LENGTH) && is_valid(&s.label, MAX_LABEL_LENGTH)
+                })
+                .take(MAX_SUGGESTIONS)
+                .collect(),
+            Err(e) => {
+                tracing::warn!(
+                    "Suggestions sidecar failed for message {}: {}",
+                    message_id,
+                    e
+                );
+                return Ok(());
+            }
+        };
+        if suggestions.is_empty() {
+            return Ok(());
+        }
+
+        let payload = serde_json::to_value(SuggestionsEvent {
+            conversation_id,
+            message_id,
+            suggestions,
+        })
+        .map_err(|e| anyhow::anyhow!("Failed to serialize suggestions event: {}", e))?;
+
+        let mut conn = self.db.acquire().await?;
+        OutboxService::enqueue_for_participants(
+            &mut conn,
+            conversation_id,
+            sender_id,
+            WS_SUGGESTIONS,
+            &payload,
+        )
+        .await
+    }
+
+    async fn call_sidecar(
+        &self,
+        url: &str,
+        metadata: &MessageMetadata,
+    ) -> anyhow::Result<SidecarResponse> {
+        let response = self
+            .http
+            .post(url)
+            .timeout(self.config.timeout)
+            .json(metadata)
+            .send()
+            .await?;
+        if !response.status().is_success() {
+            anyhow::bail!("status {}", response.status());
+        }
+
+        Ok(response.json().await?)
+    }
+}
+
+fn is_valid(value: &str, max_length: usize) -> bool {
+    !value.trim().is_empty() && value.chars().count() <= max_length
+}
+
+/// Job handler that fetches suggestions for a sent message
+pub struct SuggestionsJob {
+    suggestions: SuggestionsService,
+}
+
+impl SuggestionsJob {
+    pub fn new(suggestions: SuggestionsService) -> Self {
+        Self { suggestions }
+    }
+}
+
+#[async_trait]
+impl JobHandler for SuggestionsJob {
+    fn kind(&self) -> &'static str {
+        SUGGESTIONS_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let message_id = job
+            .payload
+            .get("message_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Suggestions job is missing message_id"))?;
+
+        self.suggestions.suggest(message_id).await
+    }
+}
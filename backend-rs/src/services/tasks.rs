@@ -0,0 +1,357 @@
+use sqlx::{PgPool, Postgres, Transaction};
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{CreateTaskRequest, ParticipantRole, SystemEvent, Task, WS_TASK_UPDATED},
+    services::{messaging::MessagingService, outbox::OutboxService},
+};
+
+const MAX_TITLE_LENGTH: usize = 200;
+/// Open and completed tasks a conversation can hold, which keeps the list
+/// small enough to return whole
+const MAX_TASKS: i64 = 500;
+
+/// Shared task lists inside conversations. Creating, assigning, completing
+/// and reopening a task each post a system message so the change shows up
+/// in the chat, and members are sent `task_updated` with the task so open
+/// lists stay current. Like calendar events, titles are stored in plaintext
+/// since they're part of those system messages.
+pub struct TasksService {
+    db: PgPool,
+}
+
+impl TasksService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    pub async fn create(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        req: &CreateTaskRequest,
+    ) -> AppResult<Task> {
+        self.writable_membership(conversation_id, user_id).await?;
+
+        let title = req.title.trim();
+        if title.is_empty() || title.chars().count() > MAX_TITLE_LENGTH {
+            return Err(AppError::Validation(format!(
+                "Title must be between 1 and {} characters",
+                MAX_TITLE_LENGTH
+            )));
+        }
+        if let Some(assignee_id) = req.assignee_id {
+            self.check_assignee(conversation_id, assignee_id).await?;
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        // Serializes creates per conversation so the cap holds
+        sqlx::query("SELECT id FROM conversations WHERE id = $1 FOR UPDATE")
+            .bind(conversation_id)
+            .execute(&mut *tx)
+            .await?;
+
+        let count: i64 = sqlx::query_scalar(
+            "SELECT COUNT(*) FROM conversation_tasks WHERE conversation_id = $1 AND deleted_at IS NULL",
+        )
+        .bind(conversation_id)
+        .fetch_one(&mut *tx)
+        .await?;
+        if count >= MAX_TASKS {
+            return Err(AppError::Validation(format!(
+                "A conversation can have at most {} tasks",
+                MAX_TASKS
+            )));
+        }
+
+        let task: Task = sqlx::query_as(
+            r#"
+            INSERT INTO conversation_tasks (conversation_id, created_by, title, assignee_id, due_at)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING *
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(title)
+        .bind(req.assignee_id)
+        .bind(req.due_at)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        let event = SystemEvent::TaskCreated {
+            task_id: task.id,
+            title: task.title.clone(),
+            assignee_id: task.assignee_id,
+        };
+        Self::announce(&mut tx, &task, user_id, Some(event)).await?;
+
+        tx.commit().await?;
+
+        Ok(task)
+    }
+
+    /// The conversation's tasks, open ones first, each group oldest first.
+    /// `completed` narrows the list to open or completed tasks.
+    pub async fn list(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+        completed: Option<bool>,
+    ) -> AppResult<Vec<Task>> {
+        self.membership(conversation_id, user_id).await?;
+
+        let tasks: Vec<Task> = sqlx::query_as(
+            r#"
+            SELECT * FROM conversation_tasks
+            WHERE conversation_id = $1 AND deleted_at IS NULL
+            AND ($2::bool IS NULL OR (completed_at IS NOT NULL) = $2)
+            ORDER BY completed_at IS NOT NULL, created_at
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(completed)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(tasks)
+    }
+
+    /// Hand the task to `assignee_id`, or unassign it with `None`. Any
+    /// member can. Assigning to the current assignee is a no-op.
+    pub async fn assign(
+        &self,
+        conversation_id: Uuid,
+        task_id: Uuid,
+        user_id: Uuid,
+        assignee_id: Option<Uuid>,
+    ) -> AppResult<Task> {
+        self.writable_membership(conversation_id, user_id).await?;
+        if let Some(assignee_id) = assignee_id {
+            self.check_assignee(conversation_id, assignee_id).await?;
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let task: Option<Task> = sqlx::query_as(
+            r#"
+            UPDATE conversation_tasks SET assignee_id = $3, updated_at = NOW()
+            WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+            AND assignee_id IS DISTINCT FROM $3
+            RETURNING *
+            "#,
+        )
+        .bind(task_id)
+        .bind(conversation_id)
+        .bind(assignee_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        let Some(task) = task else {
+            drop(tx);
+            return self.find(conversation_id, task_id).await;
+        };
+
+        let event = SystemEvent::TaskAssigned {
+            task_id: task.id,
+            title: task.title.clone(),
+            assignee_id,
+        };
+        Self::announce(&mut tx, &task, user_id, Some(event)).await?;
+
+        tx.commit().await?;
+
+        Ok(task)
+    }
+
+    /// Mark the task done, or open it again. Any member can. Completing a
+    /// completed task, or reopening an open one, is a no-op.
+    pub async fn set_completed(
+        &self,
+        conversation_id: Uuid,
+        task_id: Uuid,
+        user_id: Uuid,
+        completed: bool,
+    ) -> AppResult<Task> {
+        self.writable_membership(conversation_id, user_id).await?;
+
+        let mut tx = self.db.begin().await?;
+
+        let task: Option<Task> = sqlx::query_as(
+            r#"
+            UPDATE conversation_tasks
+            SET completed_at = CASE WHEN $3 THEN NOW() END,
+                completed_by = CASE WHEN $3 THEN $4 END,
+                updated_at = NOW()
+            WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL
+            AND (completed_at IS NOT NULL) != $3
+            RETURNING *
+            "#,
+        )
+        .bind(task_id)
+        .bind(conversation_id)
+        .bind(completed)
+        .bind(user_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        let Some(task) = task else {
+            drop(tx);
+            return self.find(conversation_id, task_id).await;
+        };
+
+        let event = if completed {
+            SystemEvent::TaskCompleted {
+                task_id: task.id,
+                title: task.title.clone(),
+            }
+        } else {
+            SystemEvent::TaskReopened {
+                task_id: task.id,
+                title: task.title.clone(),
+            }
+        };
+        Self::announce(&mut tx, &task, user_id, Some(event)).await?;
+
+        tx.commit().await?;
+
+        Ok(task)
+    }
+
+    /// Remove the task from the list. Only its creator and group
+    /// owners/admins can. No system message is posted.
+    pub async fn delete(
+        &self,
+        conversation_id: Uuid,
+        task_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<()> {
+        let role = self.writable_membership(conversation_id, user_id).await?;
+
+        let task = self.find(conversation_id, task_id).await?;
+        if task.created_by != user_id && role == ParticipantRole::Member {
+            return Err(AppError::Forbidden);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let task: Option<Task> = sqlx::query_as(
+            r#"
+            UPDATE conversation_tasks SET deleted_at = NOW(), updated_at = NOW()
+            WHERE id = $1 AND deleted_at IS NULL
+            RETURNING *
+            "#,
+        )
+        .bind(task_id)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        if let Some(task) = task {
+            Self::announce(&mut tx, &task, user_id, None).await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    /// Post `event` as a system message, if any, and send `task_updated`
+    /// to the other members
+    async fn announce(
+        tx: &mut Transaction<'_, Postgres>,
+        task: &Task,
+        user_id: Uuid,
+        event: Option<SystemEvent>,
+    ) -> AppResult<()> {
+        if let Some(event) = event {
+            MessagingService::post_system_message(tx, task.conversation_id, user_id, event).await?;
+        }
+
+        let payload = serde_json::to_value(task)
+            .map_err(|e| anyhow::anyhow!("Failed to serialize task: {}", e))?;
+        OutboxService::enqueue_for_participants(
+            tx,
+            task.conversation_id,
+            user_id,
+            WS_TASK_UPDATED,
+            &payload,
+        )
+        .await?;
+
+        Ok(())
+    }
+
+    async fn find(&self, conversation_id: Uuid, task_id: Uuid) -> AppResult<Task> {
+        let task: Option<Task> = sqlx::query_as(
+            "SELECT * FROM conversation_tasks WHERE id = $1 AND conversation_id = $2 AND deleted_at IS NULL",
+        )
+        .bind(task_id)
+        .bind(conversation_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        task.ok_or(AppError::TaskNotFound)
+    }
+
+    /// Tasks can only go to people currently in the conversation
+    async fn check_assignee(&self, conversation_id: Uuid, assignee_id: Uuid) -> AppResult<()> {
+        let is_member: bool = sqlx::query_scalar(
+            r#"
+            SELECT EXISTS(
+                SELECT 1 FROM participants
+                WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL
+                AND request_status IS DISTINCT FROM 'pending'
+            )
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(assignee_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        if !is_member {
+            return Err(AppError::Validation(
+                "assignee_id must be a member of the conversation".to_string(),
+            ));
+        }
+
+        Ok(())
+    }
+
+    /// The caller's role, for active participants of writable
+    /// conversations
+    async fn writable_membership(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<ParticipantRole> {
+        match self.membership(conversation_id, user_id).await? {
+            (_, true) => Err(AppError::ConversationReadOnly),
+            (role, false) => Ok(role),
+        }
+    }
+
+    /// The caller's role and whether the conversation is read-only, for
+    /// active participants
+    async fn membership(
+        &self,
+        conversation_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<(ParticipantRole, bool)> {
+        let member: Option<(ParticipantRole, bool)> = sqlx::query_as(
+            r#"
+            SELECT p.role, c.imported_from IS NOT NULL FROM conversations c
+            JOIN participants p ON c.id = p.conversation_id
+            WHERE c.id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        member.ok_or(AppError::NotParticipant)
+    }
+}
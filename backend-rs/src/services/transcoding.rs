@@ -0,0 +1,358 @@
+use std::{path::PathBuf, sync::Arc, time::Duration};
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use sqlx::PgPool;
+use tokio::{process::Command, sync::Semaphore};
+use uuid::Uuid;
+
+use crate::{
+    config::TranscodeConfig,
+    error::{AppError, AppResult},
+    jobs::{Job, JobHandler, JobQueue},
+    models::{
+        Attachment, AttachmentProcessedEvent, StorageCategory, TranscodeStatus,
+        WS_ATTACHMENT_PROCESSED,
+    },
+    services::{outbox::OutboxService, storage::StorageService},
+    storage::minio::MinioClient,
+};
+
+pub const TRANSCODE_JOB_KIND: &str = "attachment.transcode";
+
+/// How long a claimed attachment stays claimed without a renewal
+const LEASE_DURATION: Duration = Duration::from_secs(2 * 60);
+const LEASE_RENEW_INTERVAL: Duration = Duration::from_secs(30);
+
+pub struct TranscodingService {
+    db: PgPool,
+    minio: MinioClient,
+    storage: StorageService,
+    config: TranscodeConfig,
+}
+
+impl TranscodingService {
+    pub fn new(
+        db: PgPool,
+        minio: MinioClient,
+        storage: StorageService,
+        config: TranscodeConfig,
+    ) -> Self {
+        Self {
+            db,
+            minio,
+            storage,
+            config,
+        }
+    }
+
+    /// Queue transcoding of a freshly uploaded attachment. Best effort: a
+    /// failure is logged and the attachment is picked up by `queue_stalled`
+    /// at the next start.
+    pub async fn request(jobs: &JobQueue, attachment_id: Uuid) {
+        let payload = serde_json::json!({ "attachment_id": attachment_id });
+        if let Err(e) = jobs.enqueue(TRANSCODE_JOB_KIND, payload).await {
+            tracing::warn!(
+                "Failed to queue transcoding of attachment {}: {}",
+                attachment_id,
+                e
+            );
+        }
+    }
+
+    /// Queue a job for every attachment still waiting to be transcoded, and
+    /// every one whose lease ran out because its transcoder went away.
+    /// Attachments another process is working on keep their lease; a
+    /// duplicate job finds them taken or done.
+    pub async fn queue_stalled(&self, jobs: &JobQueue) -> AppResult<()> {
+        let attachment_ids: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            SELECT id FROM attachments
+            WHERE transcode_status = $1
+               OR (transcode_status = $2
+                   AND (transcode_lease_until IS NULL OR transcode_lease_until < NOW()))
+            ORDER BY created_at ASC
+            "#,
+        )
+        .bind(TranscodeStatus::Pending)
+        .bind(TranscodeStatus::Processing)
+        .fetch_all(&self.db)
+        .await?;
+
+        for attachment_id in &attachment_ids {
+            Self::request(jobs, *attachment_id).await;
+        }
+
+        if !attachment_ids.is_empty() {
+            tracing::info!("Queued {} stalled transcoding jobs", attachment_ids.len());
+        }
+
+        Ok(())
+    }
+
+    /// Transcode one attachment, holding a lease on it that is renewed
+    /// while ffmpeg runs. A lease that is still live means another process
+    /// is on it, so the job fails and is retried once that lease has either
+    /// finished or run out.
+    pub async fn process(&self, attachment_id: Uuid) -> AppResult<()> {
+        let Some(attachment) = self.claim(attachment_id).await? else {
+            let status: Option<TranscodeStatus> =
+                sqlx::query_scalar("SELECT transcode_status FROM attachments WHERE id = $1")
+                    .bind(attachment_id)
+                    .fetch_optional(&self.db)
+                    .await?;
+            if status == Some(TranscodeStatus::Processing) {
+                return Err(AppError::Internal(anyhow::anyhow!(
+                    "Attachment {} is being transcoded elsewhere",
+                    attachment_id
+                )));
+            }
+            // Deleted, already done, or never needed transcoding
+            return Ok(());
+        };
+
+        let transcode = self.transcode(&attachment);
+        tokio::pin!(transcode);
+        let mut renew = tokio::time::interval(LEASE_RENEW_INTERVAL);
+        renew.tick().await;
+        let result = loop {
+            tokio::select! {
+                result = &mut transcode => break result,
+                _ = renew.tick() => {
+                    if let Err(e) = self.renew_lease(attachment.id).await {
+                        tracing::warn!(
+                            "Failed to renew transcode lease on {}: {}",
+                            attachment.id,
+                            e
+                        );
+                    }
+                }
+            }
+        };
+
+        self.finish(&attachment, result).await
+    }
+
+    /// Take a pending attachment, or one whose lease has run out
+    async fn claim(&self, attachment_id: Uuid) -> AppResult<Option<Attachment>> {
+        let attachment: Option<Attachment> = sqlx::query_as(
+            r#"
+            UPDATE attachments
+            SET transcode_status = $1,
+                transcode_lease_until = NOW() + make_interval(secs => $2::int4)
+            WHERE id = $3
+              AND (transcode_status = $4
+                   OR (transcode_status = $1
+                       AND (transcode_lease_until IS NULL OR transcode_lease_until < NOW())))
+            RETURNING *
+            "#,
+        )
+        .bind(TranscodeStatus::Processing)
+        .bind(LEASE_DURATION.as_secs() as i32)
+        .bind(attachment_id)
+        .bind(TranscodeStatus::Pending)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(attachment)
+    }
+
+    async fn renew_lease(&self, attachment_id: Uuid) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            UPDATE attachments
+            SET transcode_lease_until = NOW() + make_interval(secs => $1::int4)
+            WHERE id = $2 AND transcode_status = $3
+            "#,
+        )
+        .bind(LEASE_DURATION.as_secs() as i32)
+        .bind(attachment_id)
+        .bind(TranscodeStatus::Processing)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    /// Normalize to H.264/AAC MP4 (video) or AAC M4A (audio) with faststart,
+    /// returning the stored key and content type
+    async fn transcode(&self, attachment: &Attachment) -> AppResult<(String, String)> {
+        let is_video = attachment.content_type.starts_with("video/");
+        let (extension, content_type) = if is_video {
+            ("mp4", "video/mp4")
+        } else {
+            ("m4a", "audio/mp4")
+        };
+
+        let bucket = self.minio.attachments_bucket();
+        let data = self.minio.download_file(bucket, &attachment.object_key).await?;
+
+        let input = temp_path(&format!("{}-in", attachment.id));
+        let output = temp_path(&format!("{}-out.{}", attachment.id, extension));
+
+        let result: AppResult<Vec<u8>> = async {
+            tokio::fs::write(&input, &data)
+                .await
+                .map_err(|e| anyhow::anyhow!("Failed to write transcode input: {}", e))?;
+
+            let mut command = Command::new(&self.config.ffmpeg_path);
+            command.arg("-y").arg("-i").arg(&input);
+            if is_video {
+                command.args(["-c:v", "libx264", "-preset", "veryfast", "-crf", "23"]);
+            } else {
+                command.arg("-vn");
+            }
+            command
+                .args(["-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart"])
+                .arg(&output);
+
+            let status = command
+                .output()
+                .await
+                .map_err(|e| anyhow::anyhow!("Failed to run ffmpeg: {}", e))?;
+
+            if !status.status.success() {
+                let stderr = String::from_utf8_lossy(&status.stderr);
+                let tail: String = stderr.lines().rev().take(5).collect::<Vec<_>>().join(" | ");
+                return Err(AppError::Internal(anyhow::anyhow!("ffmpeg failed: {}", tail)));
+            }
+
+            let transcoded = tokio::fs::read(&output)
+                .await
+                .map_err(|e| anyhow::anyhow!("Failed to read transcode output: {}", e))?;
+
+            Ok(transcoded)
+        }
+        .await;
+
+        let _ = tokio::fs::remove_file(&input).await;
+        let _ = tokio::fs::remove_file(&output).await;
+
+        let transcoded = result?;
+        let size = transcoded.len() as i64;
+        let key = format!("transcoded/{}.{}", attachment.digest, extension);
+
+        self.minio
+            .upload_file(bucket, &key, Bytes::from(transcoded), content_type)
+            .await?;
+
+        if let Some(owner_id) = attachment.created_by {
+            self.storage
+                .record(owner_id, StorageCategory::Attachment, bucket, &key, size)
+                .await?;
+        }
+
+        Ok((key, content_type.to_string()))
+    }
+
+    async fn finish(
+        &self,
+        attachment: &Attachment,
+        result: AppResult<(String, String)>,
+    ) -> AppResult<()> {
+        let (status, error) = match &result {
+            Ok((key, content_type)) => {
+                sqlx::query(
+                    r#"
+                    UPDATE attachments
+                    SET transcode_status = $1, transcoded_key = $2, transcoded_content_type = $3,
+                        transcode_error = NULL, transcoded_at = NOW(), transcode_lease_until = NULL
+                    WHERE id = $4
+                    "#,
+                )
+                .bind(TranscodeStatus::Completed)
+                .bind(key)
+                .bind(content_type)
+                .bind(attachment.id)
+                .execute(&self.db)
+                .await?;
+
+                tracing::info!("Transcoded attachment {}", attachment.id);
+                (TranscodeStatus::Completed, None)
+            }
+            Err(e) => {
+                sqlx::query(
+                    r#"
+                    UPDATE attachments
+                    SET transcode_status = $1, transcode_error = $2, transcode_lease_until = NULL
+                    WHERE id = $3
+                    "#,
+                )
+                .bind(TranscodeStatus::Failed)
+                .bind(e.to_string())
+                .bind(attachment.id)
+                .execute(&self.db)
+                .await?;
+
+                tracing::warn!("Transcoding attachment {} failed: {}", attachment.id, e);
+                (TranscodeStatus::Failed, Some(e.to_string()))
+            }
+        };
+
+        // Let the uploader know processing is done, via the outbox so a
+        // Redis hiccup doesn't lose it
+        if let Some(owner_id) = attachment.created_by {
+            let payload = serde_json::to_value(AttachmentProcessedEvent {
+                attachment_id: attachment.id,
+                status,
+                error,
+            })
+            .map_err(|e| anyhow::anyhow!("Failed to serialize attachment event: {}", e))?;
+
+            let mut conn = self.db.acquire().await?;
+            OutboxService::enqueue(&mut conn, owner_id, WS_ATTACHMENT_PROCESSED, &payload).await?;
+        }
+
+        Ok(())
+    }
+}
+
+fn temp_path(name: &str) -> PathBuf {
+    std::env::temp_dir().join(format!("ansible-talk-transcode-{}", name))
+}
+
+/// Job handler that transcodes an uploaded attachment. At most
+/// `TRANSCODE_WORKERS` run at once in a process; with none, attachments are
+/// left pending for a process that transcodes.
+pub struct TranscodeJob {
+    transcoding: TranscodingService,
+    permits: Arc<Semaphore>,
+    enabled: bool,
+}
+
+impl TranscodeJob {
+    pub fn new(transcoding: TranscodingService, workers: usize) -> Self {
+        Self {
+            transcoding,
+            permits: Arc::new(Semaphore::new(workers)),
+            enabled: workers > 0,
+        }
+    }
+}
+
+#[async_trait]
+impl JobHandler for TranscodeJob {
+    fn kind(&self) -> &'static str {
+        TRANSCODE_JOB_KIND
+    }
+
+    async fn handle(&self, job: &Job) -> AppResult<()> {
+        let attachment_id = job
+            .payload
+            .get("attachment_id")
+            .and_then(|v| v.as_str())
+            .and_then(|v| Uuid::parse_str(v).ok())
+            .ok_or_else(|| anyhow::anyhow!("Transcode job is missing attachment_id"))?;
+
+        if !self.enabled {
+            return Ok(());
+        }
+
+        let _permit = self
+            .permits
+            .acquire()
+            .await
+            .map_err(|e| anyhow::anyhow!("Transcode permits closed: {}", e))?;
+        self.transcoding.process(attachment_id).await
+    }
+}
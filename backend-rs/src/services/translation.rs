@@ -0,0 +1,198 @@
+use std::time::Duration;
+
+use serde_json::{json, Value};
+use uuid::Uuid;
+
+use crate::{
+    config::TranslationConfig,
+    error::{AppError, AppResult},
+    models::{TranslateRequest, TranslateResponse, TranslationProvider},
+    storage::redis::RedisClient,
+};
+
+pub const RATE_WINDOW: Duration = Duration::from_secs(60);
+
+const DEEPL_URL: &str = "https://api.deepl.com/v2/translate";
+const DEEPL_FREE_URL: &str = "https://api-free.deepl.com/v2/translate";
+const GOOGLE_URL: &str = "https://translation.googleapis.com/language/translate/v2";
+
+/// Relays already-decrypted text to a translation provider on the client's
+/// behalf, with the client's own key. Neither the text nor the key is stored
+/// or logged; provider failures are reported by status code only.
+pub struct TranslationService {
+    http: reqwest::Client,
+    redis: RedisClient,
+    config: TranslationConfig,
+}
+
+impl TranslationService {
+    pub fn new(http: reqwest::Client, redis: RedisClient, config: TranslationConfig) -> Self {
+        Self {
+            http,
+            redis,
+            config,
+        }
+    }
+
+    pub async fn translate(
+        &self,
+        user_id: Uuid,
+        req: &TranslateRequest,
+    ) -> AppResult<TranslateResponse> {
+        if !self.config.enabled {
+            return Err(AppError::FeatureDisabled("translation".to_string()));
+        }
+
+        self.validate(req)?;
+
+        if let Some(retry_after) = self
+            .redis
+            .claim_translation_quota(&user_id.to_string(), self.config.rate_limit, RATE_WINDOW)
+            .await?
+        {
+            return Err(AppError::RateLimited(retry_after));
+        }
+
+        match req.provider {
+            TranslationProvider::Deepl => self.deepl(req).await,
+            TranslationProvider::Google => self.google(req).await,
+        }
+    }
+
+    fn validate(&self, req: &TranslateRequest) -> AppResult<()> {
+        if req.text.trim().is_empty() {
+            return Err(AppError::Validation("Text is required".to_string()));
+        }
+        if req.text.chars().count() > self.config.max_length {
+            return Err(AppError::Validation(format!(
+                "Text is longer than {} characters",
+                self.config.max_length
+            )));
+        }
+        if req.provider_token.is_empty() {
+            return Err(AppError::Validation("Provider token is required".to_string()));
+        }
+
+        let langs = std::iter::once(&req.target_lang).chain(req.source_lang.as_ref());
+        for lang in langs {
+            let valid = !lang.is_empty()
+                && lang.len() <= 10
+                && lang.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+            if !valid {
+                return Err(AppError::Validation(format!(
+                    "Invalid language code: {}",
+                    lang
+                )));
+            }
+        }
+
+        Ok(())
+    }
+
+    async fn deepl(&self, req: &TranslateRequest) -> AppResult<TranslateResponse> {
+        // Free-tier keys only work against the free endpoint
+        let url = if req.provider_token.ends_with(":fx") {
+            DEEPL_FREE_URL
+        } else {
+            DEEPL_URL
+        };
+
+        let mut body = json!({
+            "text": [req.text],
+            "target_lang": req.target_lang.to_uppercase(),
+        });
+        if let Some(source_lang) = &req.source_lang {
+            body["source_lang"] = json!(source_lang.to_uppercase());
+        }
+
+        let request = self
+            .http
+            .post(url)
+            .header("Authorization", format!("DeepL-Auth-Key {}", req.provider_token))
+            .json(&body);
+        let response = self.send(req.provider, request).await?;
+
+        let translation = response
+            .pointer("/translations/0")
+            .ok_or(AppError::TranslationFailed(None))?;
+
+        Ok(TranslateResponse {
+            text: string_field(translation, "text")?,
+            detected_source_lang: translation
+                .get("detected_source_language")
+                .and_then(Value::as_str)
+                .map(str::to_lowercase),
+        })
+    }
+
+    async fn google(&self, req: &TranslateRequest) -> AppResult<TranslateResponse> {
+        let mut body = json!({
+            "q": req.text,
+            "target": req.target_lang,
+            "format": "text",
+        });
+        if let Some(source_lang) = &req.source_lang {
+            body["source"] = json!(source_lang);
+        }
+
+        // The key goes in a header rather than the query string, where it
+        // would show up in URLs
+        let request = self
+            .http
+            .post(GOOGLE_URL)
+            .header("X-Goog-Api-Key", &req.provider_token)
+            .json(&body);
+        let response = self.send(req.provider, request).await?;
+
+        let translation = response
+            .pointer("/data/translations/0")
+            .ok_or(AppError::TranslationFailed(None))?;
+
+        Ok(TranslateResponse {
+            text: string_field(translation, "translatedText")?,
+            detected_source_lang: translation
+                .get("detectedSourceLanguage")
+                .and_then(Value::as_str)
+                .map(str::to_string),
+        })
+    }
+
+    /// Send a provider request. Only the provider and status are logged.
+    async fn send(
+        &self,
+        provider: TranslationProvider,
+        request: reqwest::RequestBuilder,
+    ) -> AppResult<Value> {
+        let response = request.send().await.map_err(|e| {
+            tracing::warn!(
+                "Translation provider {} unreachable: {}",
+                provider.as_str(),
+                e.without_url()
+            );
+            AppError::TranslationFailed(None)
+        })?;
+
+        let status = response.status();
+        if !status.is_success() {
+            tracing::warn!(
+                "Translation provider {} returned {}",
+                provider.as_str(),
+                status
+            );
+            return Err(AppError::TranslationFailed(Some(status.as_u16())));
+        }
+
+        response
+            .json()
+            .await
+            .map_err(|_| AppError::TranslationFailed(None))
+    }
+}
+
+fn string_field(value: &Value, key: &str) -> AppResult<String> {
+    value
+        .get(key)
+        .and_then(Value::as_str)
+        .map(str::to_string)
+        .ok_or(AppError::TranslationFailed(None))
+}
@@ -0,0 +1,140 @@
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    config::{LimitsConfig, StorageConfig, TranslationConfig},
+    error::AppResult,
+    models::{AccountUsage, DeviceUsage, RateLimitUsage},
+    services::{
+        access_tokens, limits::LimitsService, spam::SEND_RATE_WINDOW, storage::StorageService,
+        translation,
+    },
+    storage::redis::RedisClient,
+};
+
+/// Gathers a user's consumption of rate limits, storage, devices and
+/// sessions for the account health screen. Rate-limit windows are read
+/// without counting against them.
+pub struct UsageService {
+    db: PgPool,
+    redis: RedisClient,
+    storage_config: StorageConfig,
+    limits_config: LimitsConfig,
+    translation_config: TranslationConfig,
+}
+
+impl UsageService {
+    pub fn new(
+        db: PgPool,
+        redis: RedisClient,
+        storage_config: StorageConfig,
+        limits_config: LimitsConfig,
+        translation_config: TranslationConfig,
+    ) -> Self {
+        Self {
+            db,
+            redis,
+            storage_config,
+            limits_config,
+            translation_config,
+        }
+    }
+
+    pub async fn get_usage(&self, user_id: Uuid) -> AppResult<AccountUsage> {
+        let storage = StorageService::new(self.db.clone(), self.storage_config.clone())
+            .get_usage(user_id)
+            .await?;
+
+        let limits = LimitsService::new(self.db.clone(), self.limits_config.clone())
+            .effective_limits(user_id)
+            .await?;
+
+        let (device_count, active_sessions, active_access_tokens): (i64, i64, i64) =
+            sqlx::query_as(
+                r#"
+                SELECT
+                    (SELECT COUNT(*) FROM devices WHERE user_id = $1),
+                    (SELECT COUNT(*) FROM sessions WHERE user_id = $1 AND expires_at > NOW()),
+                    (SELECT COUNT(*) FROM access_tokens
+                     WHERE user_id = $1 AND revoked_at IS NULL
+                       AND (expires_at IS NULL OR expires_at > NOW()))
+                "#,
+            )
+            .bind(user_id)
+            .fetch_one(&self.db)
+            .await?;
+
+        Ok(AccountUsage {
+            rate_limits: self.rate_limits(user_id).await?,
+            storage,
+            devices: DeviceUsage {
+                count: device_count,
+                limit: limits.max_devices,
+            },
+            active_sessions,
+            active_access_tokens,
+        })
+    }
+
+    async fn rate_limits(&self, user_id: Uuid) -> AppResult<Vec<RateLimitUsage>> {
+        let mut usage = Vec::new();
+
+        // Sending is throttled by the spam rules, which adapt to the sender
+        let (used, resets_in) = self.redis.peek_send_rate(&user_id.to_string()).await?;
+        usage.push(RateLimitUsage {
+            resource: "messages",
+            token_id: None,
+            token_name: None,
+            used,
+            limit: None,
+            window_seconds: SEND_RATE_WINDOW.as_secs(),
+            resets_in,
+        });
+
+        if self.translation_config.enabled {
+            let (used, resets_in) = self
+                .redis
+                .peek_translation_quota(&user_id.to_string())
+                .await?;
+            usage.push(RateLimitUsage {
+                resource: "translation",
+                token_id: None,
+                token_name: None,
+                used,
+                limit: Some(self.translation_config.rate_limit),
+                window_seconds: translation::RATE_WINDOW.as_secs(),
+                resets_in,
+            });
+        }
+
+        let tokens: Vec<(Uuid, String, i32)> = sqlx::query_as(
+            r#"
+            SELECT id, name, rate_limit FROM access_tokens
+            WHERE user_id = $1 AND revoked_at IS NULL
+              AND (expires_at IS NULL OR expires_at > NOW())
+            ORDER BY created_at
+            "#,
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        for (token_id, name, rate_limit) in tokens {
+            let (used, resets_in) = self
+                .redis
+                .peek_access_token_quota(&token_id.to_string())
+                .await?;
+            usage.push(RateLimitUsage {
+                resource: "access_token",
+                token_id: Some(token_id),
+                token_name: Some(name),
+                used,
+                limit: Some(rate_limit as i64),
+                window_seconds: access_tokens::RATE_WINDOW.as_secs(),
+                resets_in,
+            });
+        }
+
+        Ok(usage)
+    }
+}
@@ -0,0 +1,313 @@
+use serde_json::json;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::{AppError, AppResult},
+    models::{
+        SystemEvent, User, Workspace, WorkspaceMember, WorkspaceMemberWithUser, WorkspaceRole,
+        WorkspaceWithRole, EVENT_MEMBER_LEFT,
+    },
+    services::{events::EventsService, messaging::MessagingService},
+};
+
+pub struct WorkspacesService {
+    db: PgPool,
+}
+
+impl WorkspacesService {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+
+    /// Create a workspace, making the creator its owner
+    pub async fn create_workspace(
+        &self,
+        user_id: Uuid,
+        name: &str,
+        slug: &str,
+    ) -> AppResult<Workspace> {
+        let slug = slug.to_lowercase();
+        if slug.is_empty()
+            || slug.len() > 50
+            || !slug
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '-')
+        {
+            return Err(AppError::Validation(
+                "Slug must be 1-50 characters of letters, digits or '-'".to_string(),
+            ));
+        }
+
+        let existing: Option<(Uuid,)> = sqlx::query_as("SELECT id FROM workspaces WHERE slug = $1")
+            .bind(&slug)
+            .fetch_optional(&self.db)
+            .await?;
+
+        if existing.is_some() {
+            return Err(AppError::WorkspaceSlugTaken);
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        let workspace: Workspace = sqlx::query_as(
+            r#"
+            INSERT INTO workspaces (id, name, slug, created_by)
+            VALUES ($1, $2, $3, $4)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(name)
+        .bind(&slug)
+        .bind(user_id)
+        .fetch_one(&mut *tx)
+        .await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO workspace_members (id, workspace_id, user_id, role)
+            VALUES ($1, $2, $3, $4)
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(workspace.id)
+        .bind(user_id)
+        .bind(WorkspaceRole::Owner)
+        .execute(&mut *tx)
+        .await?;
+
+        tx.commit().await?;
+
+        Ok(workspace)
+    }
+
+    /// Get workspaces the user belongs to
+    pub async fn get_user_workspaces(&self, user_id: Uuid) -> AppResult<Vec<WorkspaceWithRole>> {
+        let memberships: Vec<WorkspaceMember> = sqlx::query_as(
+            "SELECT * FROM workspace_members WHERE user_id = $1 ORDER BY joined_at ASC",
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut result = Vec::with_capacity(memberships.len());
+        for membership in memberships {
+            let workspace: Option<Workspace> =
+                sqlx::query_as("SELECT * FROM workspaces WHERE id = $1")
+                    .bind(membership.workspace_id)
+                    .fetch_optional(&self.db)
+                    .await?;
+
+            if let Some(workspace) = workspace {
+                result.push(WorkspaceWithRole {
+                    workspace,
+                    role: membership.role,
+                });
+            }
+        }
+
+        Ok(result)
+    }
+
+    /// Get a workspace the user belongs to
+    pub async fn get_workspace(
+        &self,
+        workspace_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<WorkspaceWithRole> {
+        let role = self.require_member(workspace_id, user_id).await?;
+
+        let workspace: Option<Workspace> = sqlx::query_as("SELECT * FROM workspaces WHERE id = $1")
+            .bind(workspace_id)
+            .fetch_optional(&self.db)
+            .await?;
+
+        let workspace = workspace.ok_or(AppError::WorkspaceNotFound)?;
+
+        Ok(WorkspaceWithRole { workspace, role })
+    }
+
+    /// List members of a workspace
+    pub async fn get_members(
+        &self,
+        workspace_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<Vec<WorkspaceMemberWithUser>> {
+        self.require_member(workspace_id, user_id).await?;
+
+        let members: Vec<WorkspaceMember> = sqlx::query_as(
+            "SELECT * FROM workspace_members WHERE workspace_id = $1 ORDER BY joined_at ASC",
+        )
+        .bind(workspace_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        let mut result = Vec::with_capacity(members.len());
+        for member in members {
+            let user: Option<User> = sqlx::query_as("SELECT * FROM users WHERE id = $1")
+                .bind(member.user_id)
+                .fetch_optional(&self.db)
+                .await?;
+            result.push(WorkspaceMemberWithUser { member, user });
+        }
+
+        Ok(result)
+    }
+
+    /// Add a member or change their role (workspace admins only)
+    pub async fn set_member(
+        &self,
+        workspace_id: Uuid,
+        actor_id: Uuid,
+        member_id: Uuid,
+        role: WorkspaceRole,
+    ) -> AppResult<WorkspaceMember> {
+        self.require_admin(workspace_id, actor_id).await?;
+
+        if role == WorkspaceRole::Owner {
+            return Err(AppError::Validation(
+                "Workspace ownership cannot be assigned".to_string(),
+            ));
+        }
+
+        if self.get_role(workspace_id, member_id).await? == Some(WorkspaceRole::Owner) {
+            return Err(AppError::Forbidden);
+        }
+
+        let user_exists: Option<(Uuid,)> = sqlx::query_as("SELECT id FROM users WHERE id = $1")
+            .bind(member_id)
+            .fetch_optional(&self.db)
+            .await?;
+
+        if user_exists.is_none() {
+            return Err(AppError::UserNotFound);
+        }
+
+        let member: WorkspaceMember = sqlx::query_as(
+            r#"
+            INSERT INTO workspace_members (id, workspace_id, user_id, role)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (workspace_id, user_id)
+            DO UPDATE SET role = $4
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(workspace_id)
+        .bind(member_id)
+        .bind(role)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(member)
+    }
+
+    /// Remove a member (workspace admins, or the member themselves). They
+    /// leave the workspace's conversations too.
+    pub async fn remove_member(
+        &self,
+        workspace_id: Uuid,
+        actor_id: Uuid,
+        member_id: Uuid,
+    ) -> AppResult<()> {
+        if actor_id != member_id {
+            self.require_admin(workspace_id, actor_id).await?;
+        }
+
+        let role = self
+            .get_role(workspace_id, member_id)
+            .await?
+            .ok_or(AppError::NotWorkspaceMember)?;
+
+        if role == WorkspaceRole::Owner {
+            return Err(AppError::Validation(
+                "The workspace owner cannot be removed".to_string(),
+            ));
+        }
+
+        let mut tx = self.db.begin().await?;
+
+        sqlx::query("DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2")
+            .bind(workspace_id)
+            .bind(member_id)
+            .execute(&mut *tx)
+            .await?;
+
+        // They also leave every conversation in the workspace
+        let conversation_ids: Vec<Uuid> = sqlx::query_scalar(
+            r#"
+            UPDATE participants p SET left_at = NOW()
+            FROM conversations c
+            WHERE c.id = p.conversation_id AND c.workspace_id = $1
+            AND p.user_id = $2 AND p.left_at IS NULL
+            RETURNING p.conversation_id
+            "#,
+        )
+        .bind(workspace_id)
+        .bind(member_id)
+        .fetch_all(&mut *tx)
+        .await?;
+
+        for conversation_id in conversation_ids {
+            EventsService::append(
+                &mut tx,
+                conversation_id,
+                Some(actor_id),
+                EVENT_MEMBER_LEFT,
+                json!({ "user_id": member_id }),
+            )
+            .await?;
+            MessagingService::post_system_message(
+                &mut tx,
+                conversation_id,
+                actor_id,
+                SystemEvent::MemberLeft { user_id: member_id },
+            )
+            .await?;
+        }
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    /// Get a user's role in a workspace, if any
+    pub async fn get_role(
+        &self,
+        workspace_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<Option<WorkspaceRole>> {
+        let role: Option<WorkspaceRole> = sqlx::query_scalar(
+            "SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+        )
+        .bind(workspace_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(role)
+    }
+
+    /// Ensure the user belongs to the workspace, returning their role
+    pub async fn require_member(
+        &self,
+        workspace_id: Uuid,
+        user_id: Uuid,
+    ) -> AppResult<WorkspaceRole> {
+        self.get_role(workspace_id, user_id)
+            .await?
+            .ok_or(AppError::NotWorkspaceMember)
+    }
+
+    /// Ensure the user is an owner or admin of the workspace
+    pub async fn require_admin(&self, workspace_id: Uuid, user_id: Uuid) -> AppResult<()> {
+        let role = self.require_member(workspace_id, user_id).await?;
+
+        if !role.is_admin() {
+            return Err(AppError::Forbidden);
+        }
+
+        Ok(())
+    }
+}
@@ -1,22 +1,54 @@
+use std::{
+    future::Future,
+    path::Path,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
 use aws_config::Region;
 use aws_sdk_s3::{
     config::Credentials,
+    error::{ProvideErrorMetadata, SdkError},
+    presigning::PresigningConfig,
     primitives::ByteStream,
-    types::{BucketCannedAcl, ObjectCannedAcl},
+    types::{
+        AbortIncompleteMultipartUpload, BucketCannedAcl, BucketLifecycleConfiguration,
+        ExpirationStatus, LifecycleExpiration, LifecycleRule, LifecycleRuleFilter, ObjectCannedAcl,
+        Transition, TransitionStorageClass,
+    },
     Client, Config,
 };
 use bytes::Bytes;
+use hmac::{Hmac, Mac};
+use sha2::Sha256;
+use tokio::{fs::File, io::AsyncWriteExt};
+
+use crate::{
+    config::{FileUrlMode, MinioConfig},
+    error::{AppError, AppResult},
+    models::{BucketLifecycle, LifecycleRuleStatus},
+    services::circuit_breaker::CircuitBreaker,
+};
 
-use crate::{config::MinioConfig, error::AppResult};
+const RULE_ABORT_MULTIPART: &str = "abort-incomplete-uploads";
+const RULE_EXPIRE_IMPORTS: &str = "expire-import-uploads";
+const RULE_TRANSITION_ATTACHMENTS: &str = "transition-old-attachments";
 
 #[derive(Clone)]
 pub struct MinioClient {
     client: Client,
     config: MinioConfig,
+    breaker: Arc<CircuitBreaker>,
+    /// While MinIO hasn't been reachable since boot, the seconds clients are
+    /// told to wait; 0 once it is
+    degraded: Arc<AtomicU64>,
 }
 
 impl MinioClient {
-    pub async fn new(config: &MinioConfig) -> AppResult<Self> {
+    pub async fn new(config: &MinioConfig, breaker: Arc<CircuitBreaker>) -> AppResult<Self> {
         let creds = Credentials::new(
             &config.access_key,
             &config.secret_key,
@@ -37,31 +69,268 @@ impl MinioClient {
         Ok(Self {
             client,
             config: config.clone(),
+            breaker,
+            degraded: Arc::new(AtomicU64::new(0)),
         })
     }
 
+    /// Fail media calls fast, telling clients to retry after `retry_after`,
+    /// until `run_recovery` reaches MinIO
+    pub fn set_degraded(&self, retry_after: Duration) {
+        self.degraded
+            .store(retry_after.as_secs().max(1), Ordering::Relaxed);
+    }
+
+    /// Retry `ensure_buckets` every `interval` until it succeeds, then
+    /// bring media features back
+    pub async fn run_recovery(&self, interval: Duration) {
+        loop {
+            tokio::time::sleep(interval).await;
+
+            match self.ensure_buckets().await {
+                Ok(()) => {
+                    self.degraded.store(0, Ordering::Relaxed);
+                    tracing::info!("MinIO reachable again, media features restored");
+                    return;
+                }
+                Err(e) => tracing::warn!("MinIO still unavailable: {}", e),
+            }
+        }
+    }
+
+    fn check_available(&self) -> AppResult<()> {
+        match self.degraded.load(Ordering::Relaxed) {
+            0 => Ok(()),
+            retry_after => Err(AppError::DependencyUnavailable {
+                dependency: "minio",
+                retry_after,
+            }),
+        }
+    }
+
+    /// Send an S3 request through the circuit breaker. Only failures to
+    /// reach MinIO count against it; error responses such as a missing key
+    /// don't.
+    async fn guarded<T, E, R>(
+        &self,
+        request: impl Future<Output = Result<T, SdkError<E, R>>>,
+    ) -> AppResult<Result<T, SdkError<E, R>>> {
+        self.check_available()?;
+        self.breaker.check()?;
+        let result = request.await;
+        self.breaker
+            .record(!matches!(&result, Err(e) if !matches!(e, SdkError::ServiceError(_))));
+        Ok(result)
+    }
+
     pub async fn ensure_buckets(&self) -> AppResult<()> {
-        let buckets = [
-            &self.config.stickers_bucket,
-            &self.config.avatars_bucket,
+        let buckets = [&self.config.stickers_bucket, &self.config.avatars_bucket];
+
+        for bucket in buckets {
+            self.create_bucket_if_not_exists(bucket, BucketCannedAcl::PublicRead).await?;
+        }
+
+        // Attachments, exports and backups are only reachable through
+        // presigned URLs
+        let private_buckets = [
             &self.config.attachments_bucket,
+            &self.config.exports_bucket,
+            &self.config.backups_bucket,
+            &self.config.archives_bucket,
         ];
 
-        for bucket in buckets {
-            self.create_bucket_if_not_exists(bucket).await?;
+        for bucket in private_buckets {
+            self.create_bucket_if_not_exists(bucket, BucketCannedAcl::Private).await?;
+        }
+
+        // Attachments used to be public; close deployments created before
+        if let Err(e) = self
+            .client
+            .put_bucket_acl()
+            .bucket(&self.config.attachments_bucket)
+            .acl(BucketCannedAcl::Private)
+            .send()
+            .await
+        {
+            tracing::warn!(
+                "Failed to make {} private: {}",
+                self.config.attachments_bucket,
+                e
+            );
+        }
+
+        // Lifecycle rules are housekeeping, so a backend that refuses them
+        // doesn't stop the server from starting
+        for bucket in self.buckets() {
+            if let Err(e) = self.configure_lifecycle(bucket).await {
+                tracing::warn!("Failed to set lifecycle rules on {}: {}", bucket, e);
+            }
         }
 
         Ok(())
     }
 
-    async fn create_bucket_if_not_exists(&self, bucket: &str) -> AppResult<()> {
+    /// Replace the bucket's lifecycle rules with the configured ones. A
+    /// backend without the attachment storage class (MinIO without a remote
+    /// tier) gets the rest of the rules.
+    async fn configure_lifecycle(&self, bucket: &str) -> AppResult<()> {
+        let rules = self.lifecycle_rules(bucket)?;
+        let result = self.put_lifecycle(bucket, rules.clone()).await;
+
+        let has_transition = rules
+            .iter()
+            .any(|r| r.id() == Some(RULE_TRANSITION_ATTACHMENTS));
+        match result {
+            Err(e) if has_transition => {
+                tracing::warn!(
+                    "{} doesn't support moving attachments to {}, leaving them in place: {}",
+                    bucket,
+                    self.config.attachment_storage_class,
+                    e
+                );
+                let rules = rules
+                    .into_iter()
+                    .filter(|r| r.id() != Some(RULE_TRANSITION_ATTACHMENTS))
+                    .collect();
+                self.put_lifecycle(bucket, rules).await
+            }
+            result => result,
+        }
+    }
+
+    async fn put_lifecycle(&self, bucket: &str, rules: Vec<LifecycleRule>) -> AppResult<()> {
+        if rules.is_empty() {
+            self.client
+                .delete_bucket_lifecycle()
+                .bucket(bucket)
+                .send()
+                .await
+                .map_err(|e| anyhow::anyhow!("Failed to remove lifecycle rules: {}", e))?;
+            return Ok(());
+        }
+
+        let configuration = BucketLifecycleConfiguration::builder()
+            .set_rules(Some(rules))
+            .build()
+            .map_err(|e| anyhow::anyhow!("Invalid lifecycle configuration: {}", e))?;
+        self.client
+            .put_bucket_lifecycle_configuration()
+            .bucket(bucket)
+            .lifecycle_configuration(configuration)
+            .send()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to set lifecycle rules: {}", e))?;
+
+        Ok(())
+    }
+
+    /// The rules the server keeps on a bucket: incomplete multipart uploads
+    /// are aborted everywhere, leftover import uploads expire, and old
+    /// attachments move to a cheaper storage class. A setting of 0 days
+    /// leaves its rule out.
+    fn lifecycle_rules(&self, bucket: &str) -> AppResult<Vec<LifecycleRule>> {
+        let rule = |id: &str, prefix: &str| {
+            LifecycleRule::builder()
+                .id(id)
+                .status(ExpirationStatus::Enabled)
+                .filter(LifecycleRuleFilter::builder().prefix(prefix).build())
+        };
+        let mut rules = Vec::new();
+
+        if self.config.abort_multipart_days > 0 {
+            rules.push(
+                rule(RULE_ABORT_MULTIPART, "").abort_incomplete_multipart_upload(
+                    AbortIncompleteMultipartUpload::builder()
+                        .days_after_initiation(self.config.abort_multipart_days)
+                        .build(),
+                ),
+            );
+        }
+        // Import archives are deleted once processed; this catches the
+        // ones a failed delete left behind
+        if bucket == self.config.exports_bucket && self.config.imports_expire_days > 0 {
+            rules.push(
+                rule(RULE_EXPIRE_IMPORTS, "imports/").expiration(
+                    LifecycleExpiration::builder()
+                        .days(self.config.imports_expire_days)
+                        .build(),
+                ),
+            );
+        }
+        if bucket == self.config.attachments_bucket && self.config.attachment_transition_days > 0 {
+            rules.push(
+                rule(RULE_TRANSITION_ATTACHMENTS, "").transitions(
+                    Transition::builder()
+                        .days(self.config.attachment_transition_days)
+                        .storage_class(TransitionStorageClass::from(
+                            self.config.attachment_storage_class.as_str(),
+                        ))
+                        .build(),
+                ),
+            );
+        }
+
+        rules
+            .into_iter()
+            .map(|r| {
+                r.build().map_err(|e| {
+                    AppError::Internal(anyhow::anyhow!("Invalid lifecycle rule: {}", e))
+                })
+            })
+            .collect()
+    }
+
+    /// Lifecycle rules currently in place on each bucket, as the backend
+    /// reports them
+    pub async fn lifecycle_policies(&self) -> AppResult<Vec<BucketLifecycle>> {
+        let mut policies = Vec::new();
+
+        for bucket in self.buckets() {
+            let request = self
+                .client
+                .get_bucket_lifecycle_configuration()
+                .bucket(bucket)
+                .send();
+            let rules = match self.guarded(request).await? {
+                Ok(output) => output.rules().iter().map(rule_status).collect(),
+                Err(e) if e.code() == Some("NoSuchLifecycleConfiguration") => Vec::new(),
+                Err(e) => {
+                    return Err(anyhow::anyhow!("Failed to get lifecycle rules: {}", e).into());
+                }
+            };
+
+            policies.push(BucketLifecycle {
+                bucket: bucket.to_string(),
+                rules,
+            });
+        }
+
+        Ok(policies)
+    }
+
+    fn buckets(&self) -> [&str; 6] {
+        [
+            &self.config.stickers_bucket,
+            &self.config.avatars_bucket,
+            &self.config.attachments_bucket,
+            &self.config.exports_bucket,
+            &self.config.backups_bucket,
+            &self.config.archives_bucket,
+        ]
+    }
+
+    async fn create_bucket_if_not_exists(
+        &self,
+        bucket: &str,
+        acl: BucketCannedAcl,
+    ) -> AppResult<()> {
         let result = self.client.head_bucket().bucket(bucket).send().await;
 
         if result.is_err() {
             self.client
                 .create_bucket()
                 .bucket(bucket)
-                .acl(BucketCannedAcl::PublicRead)
+                .acl(acl)
                 .send()
                 .await
                 .map_err(|e| anyhow::anyhow!("Failed to create bucket: {}", e))?;
@@ -78,28 +347,78 @@ impl MinioClient {
         data: Bytes,
         content_type: &str,
     ) -> AppResult<String> {
-        self.client
+        let request = self
+            .client
             .put_object()
             .bucket(bucket)
             .key(key)
             .body(ByteStream::from(data))
             .content_type(content_type)
-            .acl(ObjectCannedAcl::PublicRead)
-            .send()
-            .await
+            .cache_control(&self.config.cache_control)
+            .acl(self.object_acl(bucket))
+            .send();
+        self.guarded(request)
+            .await?
             .map_err(|e| anyhow::anyhow!("Failed to upload file: {}", e))?;
 
         Ok(self.get_file_url(bucket, key))
     }
 
-    pub async fn download_file(&self, bucket: &str, key: &str) -> AppResult<Bytes> {
-        let result = self
+    pub async fn upload_private_file(
+        &self,
+        bucket: &str,
+        key: &str,
+        data: Bytes,
+        content_type: &str,
+    ) -> AppResult<()> {
+        let request = self
             .client
-            .get_object()
+            .put_object()
             .bucket(bucket)
             .key(key)
-            .send()
+            .body(ByteStream::from(data))
+            .content_type(content_type)
+            .acl(ObjectCannedAcl::Private)
+            .send();
+        self.guarded(request)
+            .await?
+            .map_err(|e| anyhow::anyhow!("Failed to upload file: {}", e))?;
+
+        Ok(())
+    }
+
+    /// Upload a file from disk without reading it into memory first
+    pub async fn upload_private_path(
+        &self,
+        bucket: &str,
+        key: &str,
+        path: &Path,
+        content_type: &str,
+    ) -> AppResult<()> {
+        let body = ByteStream::from_path(path)
             .await
+            .map_err(|e| anyhow::anyhow!("Failed to read {}: {}", path.display(), e))?;
+        let request = self
+            .client
+            .put_object()
+            .bucket(bucket)
+            .key(key)
+            .body(body)
+            .content_type(content_type)
+            .acl(ObjectCannedAcl::Private)
+            .send();
+        self.guarded(request)
+            .await?
+            .map_err(|e| anyhow::anyhow!("Failed to upload file: {}", e))?;
+
+        Ok(())
+    }
+
+    pub async fn download_file(&self, bucket: &str, key: &str) -> AppResult<Bytes> {
+        let request = self.client.get_object().bucket(bucket).key(key).send();
+        let result = self
+            .guarded(request)
+            .await?
             .map_err(|e| anyhow::anyhow!("Failed to download file: {}", e))?;
 
         let data = result
@@ -111,20 +430,47 @@ impl MinioClient {
         Ok(data.into_bytes())
     }
 
-    pub async fn delete_file(&self, bucket: &str, key: &str) -> AppResult<()> {
-        self.client
-            .delete_object()
-            .bucket(bucket)
-            .key(key)
-            .send()
+    /// Stream an object to a file on disk without holding it in memory.
+    /// Returns false if there is no such object.
+    pub async fn download_to_path(&self, bucket: &str, key: &str, path: &Path) -> AppResult<bool> {
+        let request = self.client.get_object().bucket(bucket).key(key).send();
+        let mut body = match self.guarded(request).await? {
+            Ok(output) => output.body,
+            Err(e) if e.code() == Some("NoSuchKey") => return Ok(false),
+            Err(e) => return Err(anyhow::anyhow!("Failed to download file: {}", e).into()),
+        };
+
+        let mut file = File::create(path)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to create {}: {}", path.display(), e))?;
+        while let Some(chunk) = body
+            .try_next()
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to read file body: {}", e))?
+        {
+            file.write_all(&chunk)
+                .await
+                .map_err(|e| anyhow::anyhow!("Failed to write {}: {}", path.display(), e))?;
+        }
+        file.flush()
             .await
+            .map_err(|e| anyhow::anyhow!("Failed to write {}: {}", path.display(), e))?;
+
+        Ok(true)
+    }
+
+    pub async fn delete_file(&self, bucket: &str, key: &str) -> AppResult<()> {
+        let request = self.client.delete_object().bucket(bucket).key(key).send();
+        self.guarded(request)
+            .await?
             .map_err(|e| anyhow::anyhow!("Failed to delete file: {}", e))?;
 
         Ok(())
     }
 
     pub async fn file_exists(&self, bucket: &str, key: &str) -> AppResult<bool> {
-        let result = self.client.head_object().bucket(bucket).key(key).send().await;
+        let request = self.client.head_object().bucket(bucket).key(key).send();
+        let result = self.guarded(request).await?;
 
         Ok(result.is_ok())
     }
@@ -136,14 +482,96 @@ impl MinioClient {
         }
     }
 
+    /// Attachments are private whatever the URL mode
+    fn object_acl(&self, bucket: &str) -> ObjectCannedAcl {
+        if bucket == self.config.attachments_bucket {
+            ObjectCannedAcl::Private
+        } else {
+            ObjectCannedAcl::PublicRead
+        }
+    }
+
+    /// URL handed to clients for an object, according to the configured URL
+    /// mode. Attachments get a presigned URL in `public` mode too.
+    pub async fn file_url(&self, bucket: &str, key: &str) -> AppResult<String> {
+        match self.config.url_mode {
+            FileUrlMode::Public if bucket != self.config.attachments_bucket => {
+                Ok(self.get_file_url(bucket, key))
+            }
+            // Public and CDN URLs may still be served from a cache
+            FileUrlMode::Public | FileUrlMode::Presigned => {
+                self.check_available()?;
+                self.presigned_url(bucket, key).await
+            }
+            FileUrlMode::SignedCdn => self.signed_cdn_url(bucket, key),
+        }
+    }
+
+    /// Build a CDN URL signed with HMAC-SHA256 over `path + expires`, suitable
+    /// for verification by a Cloudflare Worker or CloudFront Function
+    fn signed_cdn_url(&self, bucket: &str, key: &str) -> AppResult<String> {
+        let (cdn_url, signing_key) = match (&self.config.cdn_url, &self.config.cdn_signing_key) {
+            (Some(cdn_url), Some(signing_key)) => (cdn_url, signing_key),
+            _ => {
+                return Err(AppError::Internal(anyhow::anyhow!(
+                    "CDN_URL and CDN_SIGNING_KEY are required for signed CDN URLs"
+                )))
+            }
+        };
+
+        let path = format!("/{}/{}", bucket, key);
+        let expires =
+            chrono::Utc::now().timestamp() + self.config.presigned_url_ttl.as_secs() as i64;
+
+        let mut mac = Hmac::<Sha256>::new_from_slice(signing_key.as_bytes())
+            .map_err(|e| anyhow::anyhow!("Invalid CDN signing key: {}", e))?;
+        mac.update(format!("{}{}", path, expires).as_bytes());
+        let signature = format!("{:x}", mac.finalize().into_bytes());
+
+        Ok(format!(
+            "{}{}?expires={}&signature={}",
+            cdn_url.trim_end_matches('/'),
+            path,
+            expires,
+            signature
+        ))
+    }
+
+    pub async fn presigned_url(&self, bucket: &str, key: &str) -> AppResult<String> {
+        self.presigned_url_with_ttl(bucket, key, self.config.presigned_url_ttl).await
+    }
+
+    pub async fn presigned_url_with_ttl(
+        &self,
+        bucket: &str,
+        key: &str,
+        ttl: Duration,
+    ) -> AppResult<String> {
+        let presigning_config = PresigningConfig::expires_in(ttl)
+            .map_err(|e| anyhow::anyhow!("Invalid presigning config: {}", e))?;
+
+        let request = self
+            .client
+            .get_object()
+            .bucket(bucket)
+            .key(key)
+            .presigned(presigning_config)
+            .await
+            .map_err(|e| anyhow::anyhow!("Failed to presign URL: {}", e))?;
+
+        Ok(request.uri().to_string())
+    }
+
     pub async fn list_files(&self, bucket: &str, prefix: &str) -> AppResult<Vec<String>> {
-        let result = self
+        let request = self
             .client
             .list_objects_v2()
             .bucket(bucket)
             .prefix(prefix)
-            .send()
-            .await
+            .send();
+        let result = self
+            .guarded(request)
+            .await?
             .map_err(|e| anyhow::anyhow!("Failed to list files: {}", e))?;
 
         let keys: Vec<String> = result
@@ -167,4 +595,34 @@ impl MinioClient {
     pub fn attachments_bucket(&self) -> &str {
         &self.config.attachments_bucket
     }
+
+    pub fn exports_bucket(&self) -> &str {
+        &self.config.exports_bucket
+    }
+
+    pub fn backups_bucket(&self) -> &str {
+        &self.config.backups_bucket
+    }
+
+    pub fn archives_bucket(&self) -> &str {
+        &self.config.archives_bucket
+    }
+}
+
+fn rule_status(rule: &LifecycleRule) -> LifecycleRuleStatus {
+    let transition = rule.transitions().first();
+
+    LifecycleRuleStatus {
+        id: rule.id().map(str::to_string),
+        enabled: *rule.status() == ExpirationStatus::Enabled,
+        prefix: rule.filter().and_then(|f| f.prefix()).map(str::to_string),
+        expiration_days: rule.expiration().and_then(|e| e.days()),
+        abort_multipart_days: rule
+            .abort_incomplete_multipart_upload()
+            .and_then(|a| a.days_after_initiation()),
+        transition_days: transition.and_then(|t| t.days()),
+        storage_class: transition
+            .and_then(|t| t.storage_class())
+            .map(|c| c.as_str().to_string()),
+    }
 }
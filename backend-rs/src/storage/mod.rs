@@ -1,2 +1,3 @@
 pub mod minio;
 pub mod redis;
+pub mod repos;
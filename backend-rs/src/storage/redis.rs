@@ -1,5 +1,7 @@
-use redis::{aio::MultiplexedConnection, AsyncCommands, Client};
+use redis::{aio::MultiplexedConnection, AsyncCommands, Client, RedisConnectionInfo};
+use std::collections::HashMap;
 use std::time::Duration;
+use tokio::io::{AsyncReadExt, AsyncWriteExt, DuplexStream};
 
 use crate::error::AppResult;
 
@@ -7,13 +9,36 @@ use crate::error::AppResult;
 pub struct RedisClient {
     client: Client,
     conn: MultiplexedConnection,
+    /// `<region>:` in front of pub/sub channel names, or empty
+    channel_prefix: String,
 }
 
 impl RedisClient {
-    pub async fn new(url: &str) -> AppResult<Self> {
+    pub async fn new(url: &str, region: Option<&str>) -> AppResult<Self> {
         let client = Client::open(url)?;
         let conn = client.get_multiplexed_async_connection().await?;
-        Ok(Self { client, conn })
+        let channel_prefix = region.map(|r| format!("{}:", r)).unwrap_or_default();
+        Ok(Self {
+            client,
+            conn,
+            channel_prefix,
+        })
+    }
+
+    /// A client with no server behind it: every command fails. For unit
+    /// tests and benchmarks of code that holds a `RedisClient` but
+    /// shouldn't reach Redis.
+    pub async fn stub() -> AppResult<Self> {
+        let (conn_end, server_end) = tokio::io::duplex(4096);
+        tokio::spawn(refuse_commands(server_end));
+        let (conn, driver) =
+            MultiplexedConnection::new(&RedisConnectionInfo::default(), conn_end).await?;
+        tokio::spawn(driver);
+        Ok(Self {
+            client: Client::open("redis://127.0.0.1/")?,
+            conn,
+            channel_prefix: String::new(),
+        })
     }
 
     pub fn client(&self) -> &Client {
@@ -57,6 +82,28 @@ impl RedisClient {
         Ok(())
     }
 
+    /// Refuse the user's tokens issued before `since` (a Unix timestamp)
+    /// until they have expired
+    pub async fn set_tokens_revoked(
+        &self,
+        user_id: &str,
+        since: i64,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("session:revoked:{}", user_id);
+        conn.set_ex(&key, since, ttl.as_secs().max(1)).await?;
+        Ok(())
+    }
+
+    /// When the user's tokens were last revoked, while that still matters
+    pub async fn get_tokens_revoked(&self, user_id: &str) -> AppResult<Option<i64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("session:revoked:{}", user_id);
+        let since: Option<i64> = conn.get(&key).await?;
+        Ok(since)
+    }
+
     // OTP management
     pub async fn set_otp(&self, target: &str, code: &str, ttl: Duration) -> AppResult<()> {
         let mut conn = self.conn.clone();
@@ -99,18 +146,810 @@ impl RedisClient {
         Ok(value.unwrap_or_else(|| "offline".to_string()))
     }
 
+    // WebSocket connections, per device, for notification routing
+    pub async fn set_ws_device(
+        &self,
+        user_id: &str,
+        device_id: i32,
+        platform: &str,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("ws:device:{}:{}", user_id, device_id);
+        conn.set_ex(&key, platform, ttl.as_secs()).await?;
+        Ok(())
+    }
+
+    pub async fn delete_ws_device(&self, user_id: &str, device_id: i32) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("ws:device:{}:{}", user_id, device_id);
+        conn.del(&key).await?;
+        Ok(())
+    }
+
+    /// Platforms of the user's devices that currently hold a WebSocket open
+    pub async fn get_ws_platforms(&self, user_id: &str) -> AppResult<Vec<String>> {
+        let mut conn = self.conn.clone();
+        let pattern = format!("ws:device:{}:*", user_id);
+        let keys: Vec<String> = conn.keys(&pattern).await?;
+        if keys.is_empty() {
+            return Ok(Vec::new());
+        }
+        let platforms: Vec<Option<String>> = conn.mget(&keys).await?;
+        Ok(platforms.into_iter().flatten().collect())
+    }
+
+    // Feature flags cache
+    pub async fn set_cached_flags(&self, flags_json: &str, ttl: Duration) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.set_ex("flags:all", flags_json, ttl.as_secs()).await?;
+        Ok(())
+    }
+
+    pub async fn get_cached_flags(&self) -> AppResult<Option<String>> {
+        let mut conn = self.conn.clone();
+        let value: Option<String> = conn.get("flags:all").await?;
+        Ok(value)
+    }
+
+    pub async fn invalidate_cached_flags(&self) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.del("flags:all").await?;
+        Ok(())
+    }
+
+    // Abuse blocklist cache, one entry per list (`phone_prefix`, `email_domain`, ...)
+    pub async fn set_cached_blocklist(
+        &self,
+        list: &str,
+        values_json: &str,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("blocklist:{}", list);
+        conn.set_ex(&key, values_json, ttl.as_secs()).await?;
+        Ok(())
+    }
+
+    pub async fn get_cached_blocklist(&self, list: &str) -> AppResult<Option<String>> {
+        let mut conn = self.conn.clone();
+        let key = format!("blocklist:{}", list);
+        let value: Option<String> = conn.get(&key).await?;
+        Ok(value)
+    }
+
+    pub async fn invalidate_cached_blocklist(&self, list: &str) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("blocklist:{}", list);
+        conn.del(&key).await?;
+        Ok(())
+    }
+
+    // Federation peer discovery cache, one entry per remote domain
+    pub async fn set_cached_federation_peer(
+        &self,
+        domain: &str,
+        peer_json: &str,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:peer:{}", domain);
+        conn.set_ex(&key, peer_json, ttl.as_secs()).await?;
+        Ok(())
+    }
+
+    pub async fn get_cached_federation_peer(&self, domain: &str) -> AppResult<Option<String>> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:peer:{}", domain);
+        let value: Option<String> = conn.get(&key).await?;
+        Ok(value)
+    }
+
+    /// Remember that discovering `domain` failed, so envelopes claiming to
+    /// be from it don't each trigger another lookup
+    pub async fn set_federation_discovery_failure(
+        &self,
+        domain: &str,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:failed:{}", domain);
+        conn.set_ex(&key, 1, ttl.as_secs()).await?;
+        Ok(())
+    }
+
+    pub async fn get_federation_discovery_failure(&self, domain: &str) -> AppResult<bool> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:failed:{}", domain);
+        let failed: bool = conn.exists(&key).await?;
+        Ok(failed)
+    }
+
+    /// Allow one forced rediscovery of `domain` per `ttl`. Returns false if
+    /// one already ran in this window.
+    pub async fn claim_federation_refresh(&self, domain: &str, ttl: Duration) -> AppResult<bool> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:refresh:{}", domain);
+        let claimed: Option<String> = redis::cmd("SET")
+            .arg(&key)
+            .arg(1)
+            .arg("NX")
+            .arg("EX")
+            .arg(ttl.as_secs().max(1))
+            .query_async(&mut conn)
+            .await?;
+
+        Ok(claimed.is_some())
+    }
+
+    /// Count an inbox request against the sending address's per-window
+    /// limit; returns seconds until the window resets once it is used up
+    pub async fn claim_federation_inbox_quota(
+        &self,
+        ip: &str,
+        limit: i64,
+        window: Duration,
+    ) -> AppResult<Option<u64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("federation:inbox:{}", ip);
+        let count: i64 = conn.incr(&key, 1).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+
+        if count <= limit {
+            return Ok(None);
+        }
+
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some(ttl.max(1) as u64))
+    }
+
+    pub async fn claim_guest_session_quota(
+        &self,
+        ip: &str,
+        limit: i64,
+        window: Duration,
+    ) -> AppResult<Option<u64>> {
+        let key = format!("guest:sessions:{}", ip);
+        let count = self.incr_window(&key, window).await?;
+        if count <= limit {
+            return Ok(None);
+        }
+
+        let mut conn = self.conn.clone();
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some(ttl.max(1) as u64))
+    }
+
+    // Background job queue
+    pub async fn push_job(&self, job_json: &str) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.lpush("jobs:queue", job_json).await?;
+        Ok(())
+    }
+
+    /// Atomically move the oldest queued job onto the runner's processing list
+    pub async fn claim_job(&self, runner_id: &str) -> AppResult<Option<String>> {
+        let mut conn = self.conn.clone();
+        let processing = format!("jobs:processing:{}", runner_id);
+        let value: Option<String> = conn.rpoplpush("jobs:queue", &processing).await?;
+        Ok(value)
+    }
+
+    pub async fn ack_job(&self, runner_id: &str, job_json: &str) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let processing = format!("jobs:processing:{}", runner_id);
+        conn.lrem(&processing, 1, job_json).await?;
+        Ok(())
+    }
+
+    /// Register a job runner, or keep it registered, for another `ttl`
+    pub async fn heartbeat_job_runner(&self, runner_id: &str, ttl: Duration) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.sadd("jobs:runners", runner_id).await?;
+        conn.set_ex(format!("jobs:runner:{}", runner_id), 1, ttl.as_secs())
+            .await?;
+        Ok(())
+    }
+
+    pub async fn schedule_job(&self, job_json: &str, run_at: i64) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.zadd("jobs:scheduled", job_json, run_at).await?;
+        Ok(())
+    }
+
+    /// Move scheduled jobs that are due back onto the queue
+    pub async fn promote_due_jobs(&self, now: i64) -> AppResult<usize> {
+        let mut conn = self.conn.clone();
+        let due: Vec<String> = conn.zrangebyscore("jobs:scheduled", 0, now).await?;
+
+        let mut promoted = 0;
+        for job_json in due {
+            // Only the instance that removes the entry re-queues it
+            let removed: i64 = conn.zrem("jobs:scheduled", &job_json).await?;
+            if removed > 0 {
+                conn.lpush("jobs:queue", &job_json).await?;
+                promoted += 1;
+            }
+        }
+        Ok(promoted)
+    }
+
+    /// Return jobs held by runners whose heartbeat has expired (e.g. after a
+    /// crash) to the queue. Each job is moved atomically, so runners
+    /// recovering side by side don't requeue one twice.
+    pub async fn requeue_orphaned_jobs(&self) -> AppResult<usize> {
+        let mut conn = self.conn.clone();
+        let runners: Vec<String> = conn.smembers("jobs:runners").await?;
+
+        let mut requeued = 0;
+        for runner_id in runners {
+            let alive: bool = conn.exists(format!("jobs:runner:{}", runner_id)).await?;
+            if alive {
+                continue;
+            }
+
+            let processing = format!("jobs:processing:{}", runner_id);
+            requeued += self.drain_list(&processing, "jobs:queue").await?;
+            conn.srem("jobs:runners", &runner_id).await?;
+        }
+
+        // The shared list servers used before processing lists were per runner
+        requeued += self.drain_list("jobs:processing", "jobs:queue").await?;
+
+        Ok(requeued)
+    }
+
+    async fn drain_list(&self, from: &str, to: &str) -> AppResult<usize> {
+        let mut conn = self.conn.clone();
+        let mut moved = 0;
+        loop {
+            let value: Option<String> = conn.rpoplpush(from, to).await?;
+            if value.is_none() {
+                break;
+            }
+            moved += 1;
+        }
+        Ok(moved)
+    }
+
+    pub async fn push_dead_job(&self, job_json: &str, max_len: isize) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.lpush("jobs:dead", job_json).await?;
+        conn.ltrim("jobs:dead", 0, max_len - 1).await?;
+        Ok(())
+    }
+
+    pub async fn get_dead_jobs(&self, limit: isize) -> AppResult<Vec<String>> {
+        let mut conn = self.conn.clone();
+        let values: Vec<String> = conn.lrange("jobs:dead", 0, limit - 1).await?;
+        Ok(values)
+    }
+
+    pub async fn remove_dead_job(&self, job_json: &str) -> AppResult<bool> {
+        let mut conn = self.conn.clone();
+        let removed: i64 = conn.lrem("jobs:dead", 1, job_json).await?;
+        Ok(removed > 0)
+    }
+
+    pub async fn incr_job_metric(&self, field: &str) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.hincr("jobs:metrics", field, 1).await?;
+        Ok(())
+    }
+
+    pub async fn get_job_metrics(&self) -> AppResult<HashMap<String, i64>> {
+        let mut conn = self.conn.clone();
+        let values: HashMap<String, i64> = conn.hgetall("jobs:metrics").await?;
+        Ok(values)
+    }
+
+    /// Lengths of the (queued, scheduled, processing, dead) job collections
+    pub async fn get_job_queue_lengths(&self) -> AppResult<(i64, i64, i64, i64)> {
+        let mut conn = self.conn.clone();
+        let queued: i64 = conn.llen("jobs:queue").await?;
+        let scheduled: i64 = conn.zcard("jobs:scheduled").await?;
+        let runners: Vec<String> = conn.smembers("jobs:runners").await?;
+        let mut processing: i64 = 0;
+        for runner_id in runners {
+            let held: i64 = conn.llen(format!("jobs:processing:{}", runner_id)).await?;
+            processing += held;
+        }
+        let dead: i64 = conn.llen("jobs:dead").await?;
+        Ok((queued, scheduled, processing, dead))
+    }
+
+    // Slow mode
+    /// Claim the user's send slot in a conversation. Returns the seconds left
+    /// on the current slot if it is already taken.
+    pub async fn claim_slow_mode_slot(
+        &self,
+        conversation_id: &str,
+        user_id: &str,
+        window: Duration,
+    ) -> AppResult<Option<u64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("slowmode:{}:{}", conversation_id, user_id);
+        let claimed: Option<String> = redis::cmd("SET")
+            .arg(&key)
+            .arg(1)
+            .arg("NX")
+            .arg("EX")
+            .arg(window.as_secs())
+            .query_async(&mut conn)
+            .await?;
+
+        if claimed.is_some() {
+            return Ok(None);
+        }
+
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some(ttl.max(1) as u64))
+    }
+
+    // DPoP replay protection
+    /// Record a proof's `jti`. Returns false if it was already used.
+    pub async fn claim_dpop_jti(&self, jkt: &str, jti: &str, ttl: Duration) -> AppResult<bool> {
+        let mut conn = self.conn.clone();
+        let key = format!("dpop:jti:{}:{}", jkt, jti);
+        let claimed: Option<String> = redis::cmd("SET")
+            .arg(&key)
+            .arg(1)
+            .arg("NX")
+            .arg("EX")
+            .arg(ttl.as_secs().max(1))
+            .query_async(&mut conn)
+            .await?;
+
+        Ok(claimed.is_some())
+    }
+
+    // Sign-in lockout, per scope (`target` or `ip`)
+    /// Count a failed sign-in attempt; returns the failures in the window
+    pub async fn incr_login_failures(
+        &self,
+        scope: &str,
+        key: &str,
+        window: Duration,
+    ) -> AppResult<i64> {
+        let mut conn = self.conn.clone();
+        let key = format!("login:fail:{}:{}", scope, key);
+        let count: i64 = conn.incr(&key, 1).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+        Ok(count)
+    }
+
+    /// Hold off further attempts for `duration`. `locked` marks a lockout
+    /// rather than a progressive delay.
+    pub async fn set_login_lock(
+        &self,
+        scope: &str,
+        key: &str,
+        locked: bool,
+        duration: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("login:lock:{}:{}", scope, key);
+        conn.set_ex(&key, locked as u8, duration.as_secs().max(1))
+            .await?;
+        Ok(())
+    }
+
+    /// Whether a lockout (rather than a delay) is in place and the seconds
+    /// left on it
+    pub async fn get_login_lock(&self, scope: &str, key: &str) -> AppResult<Option<(bool, u64)>> {
+        let mut conn = self.conn.clone();
+        let key = format!("login:lock:{}:{}", scope, key);
+        let locked: Option<u8> = conn.get(&key).await?;
+        let Some(locked) = locked else {
+            return Ok(None);
+        };
+
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some((locked == 1, ttl.max(1) as u64)))
+    }
+
+    pub async fn clear_login_failures(&self, scope: &str, key: &str) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        conn.del(&[
+            format!("login:fail:{}:{}", scope, key),
+            format!("login:lock:{}:{}", scope, key),
+        ])
+        .await?;
+        Ok(())
+    }
+
+    // Download throttling, per scope (`user` or `ip`)
+    /// Count attachment bytes handed out; returns the total in the window
+    /// and the seconds until it resets
+    pub async fn incr_download_bytes(
+        &self,
+        scope: &str,
+        key: &str,
+        bytes: i64,
+        window: Duration,
+    ) -> AppResult<(i64, u64)> {
+        let mut conn = self.conn.clone();
+        let key = format!("download:bytes:{}:{}", scope, key);
+        let total: i64 = conn.incr(&key, bytes).await?;
+        let mut ttl: i64 = conn.ttl(&key).await?;
+        if ttl < 0 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+            ttl = window.as_secs() as i64;
+        }
+        Ok((total, ttl.max(1) as u64))
+    }
+
+    /// Note an attachment handed out; returns how many distinct ones have
+    /// been in the window
+    pub async fn add_download_object(
+        &self,
+        scope: &str,
+        key: &str,
+        object: &str,
+        window: Duration,
+    ) -> AppResult<i64> {
+        let mut conn = self.conn.clone();
+        let key = format!("download:objects:{}:{}", scope, key);
+        conn.sadd(&key, object).await?;
+        let count: i64 = conn.scard(&key).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+        Ok(count)
+    }
+
+    /// Count a lookup of an attachment that doesn't exist; returns the misses
+    /// in the window
+    pub async fn incr_download_misses(
+        &self,
+        scope: &str,
+        key: &str,
+        window: Duration,
+    ) -> AppResult<i64> {
+        let mut conn = self.conn.clone();
+        let key = format!("download:miss:{}:{}", scope, key);
+        let count: i64 = conn.incr(&key, 1).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+        Ok(count)
+    }
+
+    pub async fn set_download_block(
+        &self,
+        scope: &str,
+        key: &str,
+        duration: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("download:block:{}:{}", scope, key);
+        conn.set_ex(&key, 1, duration.as_secs().max(1)).await?;
+        Ok(())
+    }
+
+    /// Seconds left on a block, if one is in place
+    pub async fn get_download_block(&self, scope: &str, key: &str) -> AppResult<Option<u64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("download:block:{}:{}", scope, key);
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok((ttl > 0).then_some(ttl as u64))
+    }
+
+    // Session anomaly detection, per session (user and device)
+    /// The session's step-up time, if any, and the values of each signal
+    /// (`network`, `country`, ...) it has been used from, in one round trip
+    pub async fn get_session_state(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        signals: &[&str],
+    ) -> AppResult<(Option<i64>, Vec<Vec<String>>)> {
+        let mut conn = self.conn.clone();
+        let mut pipe = redis::pipe();
+        pipe.get(format!("session:stepup:{}:{}", user_id, device_id));
+        for signal in signals {
+            pipe.smembers(format!("session:seen:{}:{}:{}", user_id, device_id, signal));
+        }
+
+        let replies: Vec<redis::Value> = pipe.query_async(&mut conn).await?;
+        let since: Option<i64> = redis::from_redis_value(&replies[0])?;
+        let histories = replies[1..]
+            .iter()
+            .map(redis::from_redis_value)
+            .collect::<Result<Vec<Vec<String>>, _>>()?;
+
+        Ok((since, histories))
+    }
+
+    /// Add `(signal, value)` pairs to the session's history
+    pub async fn add_session_history(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        entries: &[(&str, &str)],
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let mut pipe = redis::pipe();
+        for (signal, value) in entries {
+            let key = format!("session:seen:{}:{}:{}", user_id, device_id, signal);
+            pipe.sadd(&key, *value)
+                .ignore()
+                .expire(&key, ttl.as_secs() as i64)
+                .ignore();
+        }
+        pipe.query_async::<_, ()>(&mut conn).await?;
+        Ok(())
+    }
+
+    /// Forget a session's history and any step-up, e.g. on a fresh login
+    pub async fn clear_session_history(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        signals: &[&str],
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let mut keys: Vec<String> = signals
+            .iter()
+            .map(|signal| format!("session:seen:{}:{}:{}", user_id, device_id, signal))
+            .collect();
+        keys.push(format!("session:stepup:{}:{}", user_id, device_id));
+        conn.del(keys).await?;
+        Ok(())
+    }
+
+    /// Refuse the session's tokens issued at or before `since` (a Unix
+    /// timestamp) until they have expired
+    pub async fn set_session_step_up(
+        &self,
+        user_id: &str,
+        device_id: &str,
+        since: i64,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("session:stepup:{}:{}", user_id, device_id);
+        conn.set_ex(&key, since, ttl.as_secs().max(1)).await?;
+        Ok(())
+    }
+
+    // Translation relay
+    /// Count a translation request against the user's per-window quota.
+    /// Returns the seconds until the window resets once the quota is used up.
+    pub async fn claim_translation_quota(
+        &self,
+        user_id: &str,
+        limit: i64,
+        window: Duration,
+    ) -> AppResult<Option<u64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("translate:rate:{}", user_id);
+        let count: i64 = conn.incr(&key, 1).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+
+        if count <= limit {
+            return Ok(None);
+        }
+
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some(ttl.max(1) as u64))
+    }
+
+    /// Translation requests in the user's current window, without counting one
+    pub async fn peek_translation_quota(&self, user_id: &str) -> AppResult<(i64, Option<u64>)> {
+        self.peek_window(&format!("translate:rate:{}", user_id))
+            .await
+    }
+
+    // Personal access tokens
+    /// Count a request against a personal access token's per-window limit;
+    /// returns seconds until the window resets once the limit is used up
+    pub async fn claim_access_token_quota(
+        &self,
+        token_id: &str,
+        limit: i64,
+        window: Duration,
+    ) -> AppResult<Option<u64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("access_token:rate:{}", token_id);
+        let count: i64 = conn.incr(&key, 1).await?;
+        if count == 1 {
+            conn.expire(&key, window.as_secs() as i64).await?;
+        }
+
+        if count <= limit {
+            return Ok(None);
+        }
+
+        let ttl: i64 = conn.ttl(&key).await?;
+        Ok(Some(ttl.max(1) as u64))
+    }
+
+    pub async fn peek_access_token_quota(&self, token_id: &str) -> AppResult<(i64, Option<u64>)> {
+        self.peek_window(&format!("access_token:rate:{}", token_id))
+            .await
+    }
+
+    // Spam signals
+    pub async fn incr_send_rate(&self, user_id: &str, window: Duration) -> AppResult<i64> {
+        self.incr_window(&format!("spam:rate:{}", user_id), window)
+            .await
+    }
+
+    pub async fn peek_send_rate(&self, user_id: &str) -> AppResult<(i64, Option<u64>)> {
+        self.peek_window(&format!("spam:rate:{}", user_id)).await
+    }
+
+    /// A fixed-window counter as it stands: the count so far and the seconds
+    /// until it resets. An expired window reads as `(0, None)`.
+    async fn peek_window(&self, key: &str) -> AppResult<(i64, Option<u64>)> {
+        let mut conn = self.conn.clone();
+        let used: Option<i64> = conn.get(key).await?;
+        let ttl: i64 = conn.ttl(key).await?;
+
+        Ok((used.unwrap_or(0), (ttl > 0).then_some(ttl as u64)))
+    }
+
+    pub async fn incr_envelope_fanout(
+        &self,
+        user_id: &str,
+        digest: &str,
+        window: Duration,
+    ) -> AppResult<i64> {
+        self.incr_window(&format!("spam:envelope:{}:{}", user_id, digest), window)
+            .await
+    }
+
+    /// Count one in a fixed-window counter and return the new count. The
+    /// window is created and counted in one transaction, so a crash between
+    /// the two can't leave a counter that never expires.
+    async fn incr_window(&self, key: &str, window: Duration) -> AppResult<i64> {
+        let mut conn = self.conn.clone();
+        let (count,): (i64,) = redis::pipe()
+            .atomic()
+            .cmd("SET")
+            .arg(key)
+            .arg(0)
+            .arg("NX")
+            .arg("EX")
+            .arg(window.as_secs().max(1))
+            .ignore()
+            .incr(key, 1)
+            .query_async(&mut conn)
+            .await?;
+
+        Ok(count)
+    }
+
+    // Analytics
+    /// Active users are HyperLogLogs: a few KB per day however many users,
+    /// at the cost of counts that are off by around 1%
+    pub async fn track_active_user(
+        &self,
+        date: &str,
+        user_id: &str,
+        ttl: Duration,
+    ) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("analytics:active_hll:{}", date);
+        redis::pipe()
+            .pfadd(&key, user_id)
+            .ignore()
+            .expire(&key, ttl.as_secs() as i64)
+            .ignore()
+            .query_async::<_, ()>(&mut conn)
+            .await?;
+        Ok(())
+    }
+
+    /// Approximate number of distinct users active on any of the given dates
+    pub async fn count_active_users(&self, dates: &[String]) -> AppResult<i64> {
+        let mut conn = self.conn.clone();
+        let keys: Vec<String> = dates
+            .iter()
+            .map(|d| format!("analytics:active_hll:{}", d))
+            .collect();
+
+        let count: i64 = conn.pfcount(keys).await?;
+        Ok(count)
+    }
+
+    pub async fn incr_daily_counter(&self, date: &str, name: &str, ttl: Duration) -> AppResult<()> {
+        let mut conn = self.conn.clone();
+        let key = format!("analytics:counters:{}", date);
+        conn.hincr(&key, name, 1).await?;
+        conn.expire(&key, ttl.as_secs() as i64).await?;
+        Ok(())
+    }
+
+    pub async fn get_daily_counters(&self, date: &str) -> AppResult<HashMap<String, i64>> {
+        let mut conn = self.conn.clone();
+        let key = format!("analytics:counters:{}", date);
+        let values: HashMap<String, i64> = conn.hgetall(&key).await?;
+        Ok(values)
+    }
+
     // Pub/Sub for messaging
     pub async fn publish_message(&self, user_id: &str, message: &str) -> AppResult<()> {
         let mut conn = self.conn.clone();
-        let channel = format!("messages:{}", user_id);
+        let channel = format!("{}messages:{}", self.channel_prefix, user_id);
         conn.publish(&channel, message).await?;
         Ok(())
     }
 
     pub async fn subscribe_messages(&self, user_id: &str) -> AppResult<redis::aio::PubSub> {
         let mut pubsub = self.client.get_async_pubsub().await?;
-        let channel = format!("messages:{}", user_id);
+        let channel = format!("{}messages:{}", self.channel_prefix, user_id);
         pubsub.subscribe(&channel).await?;
         Ok(pubsub)
     }
+
+    /// One subscription to every user's channel, for a process-wide listener
+    pub async fn subscribe_all_messages(&self) -> AppResult<redis::aio::PubSub> {
+        let mut pubsub = self.client.get_async_pubsub().await?;
+        let pattern = format!("{}messages:*", self.channel_prefix);
+        pubsub.psubscribe(&pattern).await?;
+        Ok(pubsub)
+    }
+
+    /// The user id a `subscribe_all_messages` channel belongs to
+    pub fn message_channel_user<'a>(&self, channel: &'a str) -> Option<&'a str> {
+        channel
+            .strip_prefix(self.channel_prefix.as_str())?
+            .strip_prefix("messages:")
+    }
+}
+
+/// Answer every command that arrives on `stream` with an error, the server
+/// side of [`RedisClient::stub`]
+async fn refuse_commands(mut stream: DuplexStream) {
+    let mut buffer = Vec::new();
+    let mut chunk = [0u8; 4096];
+    loop {
+        let read = match stream.read(&mut chunk).await {
+            Ok(0) | Err(_) => return,
+            Ok(read) => read,
+        };
+        buffer.extend_from_slice(&chunk[..read]);
+
+        while let Some(len) = command_len(&buffer) {
+            buffer.drain(..len);
+            if stream.write_all(b"-ERR no Redis server\r\n").await.is_err() {
+                return;
+            }
+        }
+    }
+}
+
+/// Length of the first complete RESP command (`*<n>` then `n` bulk
+/// strings) in `buffer`, if it has arrived
+fn command_len(buffer: &[u8]) -> Option<usize> {
+    let (args, mut pos) = resp_header(buffer, 0, b'*')?;
+    for _ in 0..args {
+        let (len, start) = resp_header(buffer, pos, b'$')?;
+        pos = start + len + 2;
+        if buffer.len() < pos {
+            return None;
+        }
+    }
+    Some(pos)
+}
+
+/// The number in a `<prefix><number>\r\n` line at `pos`, and where the
+/// line ends
+fn resp_header(buffer: &[u8], pos: usize, prefix: u8) -> Option<(usize, usize)> {
+    let line = buffer.get(pos..)?;
+    if line.first() != Some(&prefix) {
+        return None;
+    }
+    let end = line.windows(2).position(|w| w == b"\r\n")?;
+    let number = std::str::from_utf8(&line[1..end]).ok()?.parse().ok()?;
+    Some((number, pos + end + 2))
 }
@@ -0,0 +1,216 @@
+use async_trait::async_trait;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{Contact, Watermark},
+};
+
+/// Which of a user's contacts to list
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ContactFilter {
+    All,
+    Unblocked,
+    Blocked,
+}
+
+#[cfg_attr(test, mockall::automock)]
+#[async_trait]
+pub trait ContactRepo: Send + Sync {
+    async fn list(&self, user_id: Uuid, filter: ContactFilter) -> AppResult<Vec<Contact>>;
+
+    async fn find(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<Option<Contact>>;
+
+    async fn create(
+        &self,
+        user_id: Uuid,
+        contact_id: Uuid,
+        nickname: Option<String>,
+    ) -> AppResult<Contact>;
+
+    /// Apply the given changes; `None` fields are left as they are. Returns
+    /// `None` if there is no such contact, or it is no longer at
+    /// `expected_version`.
+    async fn update(
+        &self,
+        user_id: Uuid,
+        contact_id: Uuid,
+        nickname: Option<String>,
+        is_favorite: Option<bool>,
+        expected_version: Option<i32>,
+    ) -> AppResult<Option<Contact>>;
+
+    /// Returns false if there was no such contact
+    async fn delete(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<bool>;
+
+    /// Block, creating the contact if needed
+    async fn block(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()>;
+
+    async fn unblock(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()>;
+
+    /// How many contacts `list` would return, and when the newest of them or
+    /// their users last changed
+    async fn watermark(&self, user_id: Uuid, filter: ContactFilter) -> AppResult<Watermark>;
+}
+
+pub struct PgContactRepo {
+    db: PgPool,
+}
+
+impl PgContactRepo {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+#[async_trait]
+impl ContactRepo for PgContactRepo {
+    async fn list(&self, user_id: Uuid, filter: ContactFilter) -> AppResult<Vec<Contact>> {
+        let query = match filter {
+            ContactFilter::All => {
+                "SELECT * FROM contacts WHERE user_id = $1 ORDER BY created_at DESC"
+            }
+            ContactFilter::Unblocked => {
+                "SELECT * FROM contacts WHERE user_id = $1 AND is_blocked = false ORDER BY created_at DESC"
+            }
+            ContactFilter::Blocked => {
+                "SELECT * FROM contacts WHERE user_id = $1 AND is_blocked = true ORDER BY updated_at DESC"
+            }
+        };
+
+        let contacts = sqlx::query_as(query)
+            .bind(user_id)
+            .fetch_all(&self.db)
+            .await?;
+
+        Ok(contacts)
+    }
+
+    async fn find(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<Option<Contact>> {
+        let contact =
+            sqlx::query_as("SELECT * FROM contacts WHERE user_id = $1 AND contact_id = $2")
+                .bind(user_id)
+                .bind(contact_id)
+                .fetch_optional(&self.db)
+                .await?;
+
+        Ok(contact)
+    }
+
+    async fn create(
+        &self,
+        user_id: Uuid,
+        contact_id: Uuid,
+        nickname: Option<String>,
+    ) -> AppResult<Contact> {
+        let contact = sqlx::query_as(
+            r#"
+            INSERT INTO contacts (id, user_id, contact_id, nickname, is_blocked, is_favorite)
+            VALUES ($1, $2, $3, $4, false, false)
+            RETURNING *
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(contact_id)
+        .bind(nickname)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(contact)
+    }
+
+    async fn update(
+        &self,
+        user_id: Uuid,
+        contact_id: Uuid,
+        nickname: Option<String>,
+        is_favorite: Option<bool>,
+        expected_version: Option<i32>,
+    ) -> AppResult<Option<Contact>> {
+        let contact = sqlx::query_as(
+            r#"
+            UPDATE contacts
+            SET nickname = COALESCE($3, nickname),
+                is_favorite = COALESCE($4, is_favorite),
+                version = version + 1,
+                updated_at = NOW()
+            WHERE user_id = $1 AND contact_id = $2 AND ($5::INTEGER IS NULL OR version = $5)
+            RETURNING *
+            "#,
+        )
+        .bind(user_id)
+        .bind(contact_id)
+        .bind(nickname)
+        .bind(is_favorite)
+        .bind(expected_version)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(contact)
+    }
+
+    async fn delete(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<bool> {
+        let result = sqlx::query("DELETE FROM contacts WHERE user_id = $1 AND contact_id = $2")
+            .bind(user_id)
+            .bind(contact_id)
+            .execute(&self.db)
+            .await?;
+
+        Ok(result.rows_affected() > 0)
+    }
+
+    async fn block(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()> {
+        sqlx::query(
+            r#"
+            INSERT INTO contacts (id, user_id, contact_id, is_blocked, is_favorite)
+            VALUES ($1, $2, $3, true, false)
+            ON CONFLICT (user_id, contact_id)
+            DO UPDATE SET is_blocked = true, version = contacts.version + 1, updated_at = NOW()
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(contact_id)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    async fn unblock(&self, user_id: Uuid, contact_id: Uuid) -> AppResult<()> {
+        sqlx::query(
+            "UPDATE contacts SET is_blocked = false, version = version + 1, updated_at = NOW() WHERE user_id = $1 AND contact_id = $2",
+        )
+        .bind(user_id)
+        .bind(contact_id)
+        .execute(&self.db)
+        .await?;
+
+        Ok(())
+    }
+
+    async fn watermark(&self, user_id: Uuid, filter: ContactFilter) -> AppResult<Watermark> {
+        let blocked = match filter {
+            ContactFilter::All => None,
+            ContactFilter::Unblocked => Some(false),
+            ContactFilter::Blocked => Some(true),
+        };
+
+        let watermark = sqlx::query_as(
+            r#"
+            SELECT COUNT(*) AS count, MAX(GREATEST(c.updated_at, u.updated_at)) AS latest
+            FROM contacts c
+            LEFT JOIN users u ON u.id = c.contact_id
+            WHERE c.user_id = $1 AND ($2::BOOLEAN IS NULL OR c.is_blocked = $2)
+            "#,
+        )
+        .bind(user_id)
+        .bind(blocked)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(watermark)
+    }
+}
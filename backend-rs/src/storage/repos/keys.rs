@@ -0,0 +1,269 @@
+use async_trait::async_trait;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::error::AppResult;
+
+/// A device's public identity key
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct IdentityKey {
+    pub public_key: Vec<u8>,
+    pub registration_id: i32,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SignedPreKey {
+    pub key_id: i32,
+    pub public_key: Vec<u8>,
+    pub signature: Vec<u8>,
+}
+
+/// A one-time pre-key
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PreKey {
+    pub key_id: i32,
+    pub public_key: Vec<u8>,
+}
+
+#[cfg_attr(test, mockall::automock)]
+#[async_trait]
+pub trait KeyRepo: Send + Sync {
+    /// Store a device's full key set in one transaction, replacing its
+    /// identity key
+    async fn register_device_keys(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        identity_key: IdentityKey,
+        signed_pre_key: SignedPreKey,
+        pre_keys: Vec<PreKey>,
+    ) -> AppResult<()>;
+
+    async fn identity_key(&self, user_id: Uuid, device_id: i32) -> AppResult<Option<IdentityKey>>;
+
+    /// The signed pre-key with the highest key id
+    async fn latest_signed_pre_key(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+    ) -> AppResult<Option<SignedPreKey>>;
+
+    /// Remove and return the oldest one-time pre-key
+    async fn take_pre_key(&self, user_id: Uuid, device_id: i32) -> AppResult<Option<PreKey>>;
+
+    async fn count_pre_keys(&self, user_id: Uuid, device_id: i32) -> AppResult<i64>;
+
+    /// Add one-time pre-keys, skipping key ids already present
+    async fn add_pre_keys(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        pre_keys: Vec<PreKey>,
+    ) -> AppResult<()>;
+
+    async fn upsert_signed_pre_key(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        signed_pre_key: SignedPreKey,
+    ) -> AppResult<()>;
+
+    /// Devices of the user that have registered keys
+    async fn device_ids(&self, user_id: Uuid) -> AppResult<Vec<i32>>;
+}
+
+pub struct PgKeyRepo {
+    db: PgPool,
+}
+
+impl PgKeyRepo {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+const UPSERT_SIGNED_PRE_KEY: &str = r#"
+    INSERT INTO signal_signed_prekeys (id, user_id, device_id, key_id, public_key, signature)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (user_id, device_id, key_id)
+    DO UPDATE SET public_key = $5, signature = $6, updated_at = NOW()
+"#;
+
+const INSERT_PRE_KEY: &str = r#"
+    INSERT INTO signal_prekeys (id, user_id, device_id, key_id, public_key)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (user_id, device_id, key_id) DO NOTHING
+"#;
+
+#[async_trait]
+impl KeyRepo for PgKeyRepo {
+    async fn register_device_keys(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        identity_key: IdentityKey,
+        signed_pre_key: SignedPreKey,
+        pre_keys: Vec<PreKey>,
+    ) -> AppResult<()> {
+        let mut tx = self.db.begin().await?;
+
+        sqlx::query(
+            r#"
+            INSERT INTO signal_identity_keys (id, user_id, device_id, public_key, registration_id)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (user_id, device_id)
+            DO UPDATE SET public_key = $4, registration_id = $5, updated_at = NOW()
+            "#,
+        )
+        .bind(Uuid::new_v4())
+        .bind(user_id)
+        .bind(device_id)
+        .bind(&identity_key.public_key)
+        .bind(identity_key.registration_id)
+        .execute(&mut *tx)
+        .await?;
+
+        sqlx::query(UPSERT_SIGNED_PRE_KEY)
+            .bind(Uuid::new_v4())
+            .bind(user_id)
+            .bind(device_id)
+            .bind(signed_pre_key.key_id)
+            .bind(&signed_pre_key.public_key)
+            .bind(&signed_pre_key.signature)
+            .execute(&mut *tx)
+            .await?;
+
+        for pre_key in &pre_keys {
+            sqlx::query(INSERT_PRE_KEY)
+                .bind(Uuid::new_v4())
+                .bind(user_id)
+                .bind(device_id)
+                .bind(pre_key.key_id)
+                .bind(&pre_key.public_key)
+                .execute(&mut *tx)
+                .await?;
+        }
+
+        tx.commit().await?;
+        Ok(())
+    }
+
+    async fn identity_key(&self, user_id: Uuid, device_id: i32) -> AppResult<Option<IdentityKey>> {
+        let identity: Option<(Vec<u8>, i32)> = sqlx::query_as(
+            "SELECT public_key, registration_id FROM signal_identity_keys WHERE user_id = $1 AND device_id = $2",
+        )
+        .bind(user_id)
+        .bind(device_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(identity.map(|(public_key, registration_id)| IdentityKey {
+            public_key,
+            registration_id,
+        }))
+    }
+
+    async fn latest_signed_pre_key(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+    ) -> AppResult<Option<SignedPreKey>> {
+        let signed_pre_key: Option<(i32, Vec<u8>, Vec<u8>)> = sqlx::query_as(
+            "SELECT key_id, public_key, signature FROM signal_signed_prekeys WHERE user_id = $1 AND device_id = $2 ORDER BY key_id DESC LIMIT 1",
+        )
+        .bind(user_id)
+        .bind(device_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(signed_pre_key.map(|(key_id, public_key, signature)| SignedPreKey {
+            key_id,
+            public_key,
+            signature,
+        }))
+    }
+
+    async fn take_pre_key(&self, user_id: Uuid, device_id: i32) -> AppResult<Option<PreKey>> {
+        let pre_key: Option<(Uuid, i32, Vec<u8>)> = sqlx::query_as(
+            "SELECT id, key_id, public_key FROM signal_prekeys WHERE user_id = $1 AND device_id = $2 ORDER BY key_id ASC LIMIT 1",
+        )
+        .bind(user_id)
+        .bind(device_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        let Some((id, key_id, public_key)) = pre_key else {
+            return Ok(None);
+        };
+
+        // One-time use
+        sqlx::query("DELETE FROM signal_prekeys WHERE id = $1")
+            .bind(id)
+            .execute(&self.db)
+            .await?;
+
+        Ok(Some(PreKey { key_id, public_key }))
+    }
+
+    async fn count_pre_keys(&self, user_id: Uuid, device_id: i32) -> AppResult<i64> {
+        let count: (i64,) = sqlx::query_as(
+            "SELECT COUNT(*) FROM signal_prekeys WHERE user_id = $1 AND device_id = $2",
+        )
+        .bind(user_id)
+        .bind(device_id)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(count.0)
+    }
+
+    async fn add_pre_keys(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        pre_keys: Vec<PreKey>,
+    ) -> AppResult<()> {
+        for pre_key in &pre_keys {
+            sqlx::query(INSERT_PRE_KEY)
+                .bind(Uuid::new_v4())
+                .bind(user_id)
+                .bind(device_id)
+                .bind(pre_key.key_id)
+                .bind(&pre_key.public_key)
+                .execute(&self.db)
+                .await?;
+        }
+
+        Ok(())
+    }
+
+    async fn upsert_signed_pre_key(
+        &self,
+        user_id: Uuid,
+        device_id: i32,
+        signed_pre_key: SignedPreKey,
+    ) -> AppResult<()> {
+        sqlx::query(UPSERT_SIGNED_PRE_KEY)
+            .bind(Uuid::new_v4())
+            .bind(user_id)
+            .bind(device_id)
+            .bind(signed_pre_key.key_id)
+            .bind(&signed_pre_key.public_key)
+            .bind(&signed_pre_key.signature)
+            .execute(&self.db)
+            .await?;
+
+        Ok(())
+    }
+
+    async fn device_ids(&self, user_id: Uuid) -> AppResult<Vec<i32>> {
+        let devices: Vec<(i32,)> = sqlx::query_as(
+            "SELECT DISTINCT device_id FROM signal_identity_keys WHERE user_id = $1",
+        )
+        .bind(user_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(devices.into_iter().map(|(d,)| d).collect())
+    }
+}
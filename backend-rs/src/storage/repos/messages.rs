@@ -0,0 +1,385 @@
+use async_trait::async_trait;
+use chrono::{DateTime, Utc};
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{Message, QuotedMessage, Receipt, ReceiptType},
+};
+
+#[cfg_attr(test, mockall::automock)]
+#[async_trait]
+pub trait MessageRepo: Send + Sync {
+    /// Whether the user is a current (not departed) participant
+    async fn is_participant(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<bool>;
+
+    /// A page of undeleted messages, newest first, as `viewer_id` sees them:
+    /// shadow-limited messages are only visible to their sender
+    async fn list(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        limit: i32,
+        offset: i32,
+        before: Option<Uuid>,
+    ) -> AppResult<Vec<Message>>;
+
+    /// Undeleted messages after sequence number `since_seq`, oldest first,
+    /// with the same visibility as `list`
+    async fn list_since_seq(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        since_seq: i64,
+        limit: i32,
+    ) -> AppResult<Vec<Message>>;
+
+    /// A message still in Postgres, deleted or not
+    async fn find(&self, message_id: Uuid) -> AppResult<Option<Message>>;
+
+    /// Quote metadata for those of `message_ids` that are in the
+    /// conversation, undeleted and visible to `viewer_id`
+    async fn quoted(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        message_ids: &[Uuid],
+    ) -> AppResult<Vec<QuotedMessage>>;
+
+    /// Move the user's delivered pointer (and for reads, their read pointer)
+    /// up to the message, and advance the status of the other participants'
+    /// messages it newly covers. Pointers never move back; unknown messages
+    /// and non-participants are ignored.
+    async fn advance_pointer(
+        &self,
+        message_id: Uuid,
+        user_id: Uuid,
+        receipt_type: ReceiptType,
+    ) -> AppResult<()>;
+
+    /// Current participants other than the sender whose pointers cover a
+    /// message created at `created_at`. Reads by participants who don't
+    /// share read receipts show as deliveries.
+    async fn receipts(
+        &self,
+        conversation_id: Uuid,
+        sender_id: Uuid,
+        created_at: DateTime<Utc>,
+    ) -> AppResult<Vec<Receipt>>;
+
+    /// Counts of current participants other than the sender: all of them,
+    /// those who received a message created at `created_at`, and those who
+    /// read it and share read receipts
+    async fn receipt_counts(
+        &self,
+        conversation_id: Uuid,
+        sender_id: Uuid,
+        created_at: DateTime<Utc>,
+    ) -> AppResult<(i64, i64, i64)>;
+}
+
+pub struct PgMessageRepo {
+    db: PgPool,
+}
+
+impl PgMessageRepo {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+#[async_trait]
+impl MessageRepo for PgMessageRepo {
+    async fn is_participant(&self, conversation_id: Uuid, user_id: Uuid) -> AppResult<bool> {
+        let is_participant: Option<(i64,)> = sqlx::query_as(
+            "SELECT 1 FROM participants WHERE conversation_id = $1 AND user_id = $2 AND left_at IS NULL",
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(is_participant.is_some())
+    }
+
+    async fn list(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        limit: i32,
+        offset: i32,
+        before: Option<Uuid>,
+    ) -> AppResult<Vec<Message>> {
+        let messages = if let Some(before_id) = before {
+            let (from, to) = Message::created_at_range(before_id);
+            sqlx::query_as(
+                r#"
+                SELECT * FROM messages
+                WHERE conversation_id = $1 AND deleted_at IS NULL
+                AND (shadow_limited = FALSE OR sender_id = $5)
+                AND created_at < (
+                    SELECT created_at FROM messages
+                    WHERE id = $4 AND created_at >= $6 AND created_at < $7
+                )
+                ORDER BY created_at DESC
+                LIMIT $2 OFFSET $3
+                "#,
+            )
+            .bind(conversation_id)
+            .bind(limit)
+            .bind(offset)
+            .bind(before_id)
+            .bind(viewer_id)
+            .bind(from)
+            .bind(to)
+            .fetch_all(&self.db)
+            .await?
+        } else {
+            sqlx::query_as(
+                r#"
+                SELECT * FROM messages
+                WHERE conversation_id = $1 AND deleted_at IS NULL
+                AND (shadow_limited = FALSE OR sender_id = $4)
+                ORDER BY created_at DESC
+                LIMIT $2 OFFSET $3
+                "#,
+            )
+            .bind(conversation_id)
+            .bind(limit)
+            .bind(offset)
+            .bind(viewer_id)
+            .fetch_all(&self.db)
+            .await?
+        };
+
+        Ok(messages)
+    }
+
+    async fn list_since_seq(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        since_seq: i64,
+        limit: i32,
+    ) -> AppResult<Vec<Message>> {
+        let messages = sqlx::query_as(
+            r#"
+            SELECT * FROM messages
+            WHERE conversation_id = $1 AND seq > $2 AND deleted_at IS NULL
+            AND (shadow_limited = FALSE OR sender_id = $4)
+            ORDER BY seq ASC
+            LIMIT $3
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(since_seq)
+        .bind(limit)
+        .bind(viewer_id)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(messages)
+    }
+
+    async fn find(&self, message_id: Uuid) -> AppResult<Option<Message>> {
+        let (from, to) = Message::created_at_range(message_id);
+        let message = sqlx::query_as(
+            "SELECT * FROM messages WHERE id = $1 AND created_at >= $2 AND created_at < $3",
+        )
+        .bind(message_id)
+        .bind(from)
+        .bind(to)
+        .fetch_optional(&self.db)
+        .await?;
+
+        Ok(message)
+    }
+
+    async fn quoted(
+        &self,
+        conversation_id: Uuid,
+        viewer_id: Uuid,
+        message_ids: &[Uuid],
+    ) -> AppResult<Vec<QuotedMessage>> {
+        if message_ids.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        // Bound the scan by the ids' timestamps so only their partitions are read
+        let (from, to) = message_ids
+            .iter()
+            .map(|id| Message::created_at_range(*id))
+            .reduce(|(from, to), (f, t)| (from.min(f), to.max(t)))
+            .unwrap_or((DateTime::UNIX_EPOCH, Utc::now()));
+
+        let quoted = sqlx::query_as(
+            r#"
+            SELECT id, sender_id, type AS message_type, created_at FROM messages
+            WHERE id = ANY($1) AND conversation_id = $2 AND deleted_at IS NULL
+            AND (shadow_limited = FALSE OR sender_id = $3)
+            AND created_at >= $4 AND created_at < $5
+            "#,
+        )
+        .bind(message_ids)
+        .bind(conversation_id)
+        .bind(viewer_id)
+        .bind(from)
+        .bind(to)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(quoted)
+    }
+
+    async fn advance_pointer(
+        &self,
+        message_id: Uuid,
+        user_id: Uuid,
+        receipt_type: ReceiptType,
+    ) -> AppResult<()> {
+        let (from, to) = Message::created_at_range(message_id);
+        let mut tx = self.db.begin().await?;
+
+        let target: Option<(Uuid, DateTime<Utc>)> = sqlx::query_as(
+            "SELECT conversation_id, created_at FROM messages WHERE id = $1 AND created_at >= $2 AND created_at < $3",
+        )
+        .bind(message_id)
+        .bind(from)
+        .bind(to)
+        .fetch_optional(&mut *tx)
+        .await?;
+
+        let Some((conversation_id, created_at)) = target else {
+            return Ok(());
+        };
+
+        let pointers: Option<(Option<DateTime<Utc>>, Option<DateTime<Utc>>, bool)> =
+            sqlx::query_as(
+                r#"
+                SELECT p.delivered_up_to, p.read_up_to, COALESCE(p.read_receipts, u.read_receipts)
+                FROM participants p
+                JOIN users u ON u.id = p.user_id
+                WHERE p.conversation_id = $1 AND p.user_id = $2 AND p.left_at IS NULL
+                FOR UPDATE OF p
+                "#,
+            )
+            .bind(conversation_id)
+            .bind(user_id)
+            .fetch_optional(&mut *tx)
+            .await?;
+
+        let Some((delivered_up_to, read_up_to, shares_read_receipts)) = pointers else {
+            return Ok(());
+        };
+
+        let previous = match receipt_type {
+            ReceiptType::Delivered => delivered_up_to,
+            ReceiptType::Read => read_up_to,
+        };
+        if previous.is_some_and(|previous| previous >= created_at) {
+            return Ok(());
+        }
+
+        // GREATEST ignores NULL, so an unset delivered pointer just takes the
+        // new value
+        sqlx::query(
+            r#"
+            UPDATE participants
+            SET delivered_up_to = GREATEST(delivered_up_to, $3),
+                read_up_to = CASE WHEN $4 THEN $3 ELSE read_up_to END
+            WHERE conversation_id = $1 AND user_id = $2
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(user_id)
+        .bind(created_at)
+        .bind(receipt_type == ReceiptType::Read)
+        .execute(&mut *tx)
+        .await?;
+
+        // A read the user doesn't share still counts as a delivery
+        let query = match receipt_type {
+            ReceiptType::Read if !shares_read_receipts => {
+                "UPDATE messages SET status = 'delivered', delivered_at = NOW() WHERE conversation_id = $1 AND sender_id != $2 AND created_at > $3 AND created_at <= $4 AND status = 'sent'"
+            }
+            ReceiptType::Delivered => {
+                "UPDATE messages SET status = 'delivered', delivered_at = NOW() WHERE conversation_id = $1 AND sender_id != $2 AND created_at > $3 AND created_at <= $4 AND status = 'sent'"
+            }
+            ReceiptType::Read => {
+                "UPDATE messages SET status = 'read', delivered_at = COALESCE(delivered_at, NOW()) WHERE conversation_id = $1 AND sender_id != $2 AND created_at > $3 AND created_at <= $4 AND status IN ('sent', 'delivered')"
+            }
+        };
+
+        sqlx::query(query)
+            .bind(conversation_id)
+            .bind(user_id)
+            .bind(previous.unwrap_or(DateTime::UNIX_EPOCH))
+            .bind(created_at)
+            .execute(&mut *tx)
+            .await?;
+
+        tx.commit().await?;
+
+        Ok(())
+    }
+
+    async fn receipts(
+        &self,
+        conversation_id: Uuid,
+        sender_id: Uuid,
+        created_at: DateTime<Utc>,
+    ) -> AppResult<Vec<Receipt>> {
+        let rows: Vec<(Uuid, ReceiptType)> = sqlx::query_as(
+            r#"
+            SELECT p.user_id,
+                CASE WHEN p.read_up_to >= $3 AND COALESCE(p.read_receipts, u.read_receipts)
+                    THEN 'read' ELSE 'delivered' END::receipt_type
+            FROM participants p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.conversation_id = $1 AND p.user_id != $2 AND p.left_at IS NULL
+            AND p.delivered_up_to >= $3
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(sender_id)
+        .bind(created_at)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(rows
+            .into_iter()
+            .map(|(user_id, receipt_type)| Receipt {
+                user_id,
+                receipt_type,
+            })
+            .collect())
+    }
+
+    async fn receipt_counts(
+        &self,
+        conversation_id: Uuid,
+        sender_id: Uuid,
+        created_at: DateTime<Utc>,
+    ) -> AppResult<(i64, i64, i64)> {
+        let counts = sqlx::query_as(
+            r#"
+            SELECT COUNT(*),
+                COUNT(*) FILTER (WHERE p.delivered_up_to >= $3),
+                COUNT(*) FILTER (
+                    WHERE p.read_up_to >= $3 AND COALESCE(p.read_receipts, u.read_receipts)
+                )
+            FROM participants p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.conversation_id = $1 AND p.user_id != $2 AND p.left_at IS NULL
+            "#,
+        )
+        .bind(conversation_id)
+        .bind(sender_id)
+        .bind(created_at)
+        .fetch_one(&self.db)
+        .await?;
+
+        Ok(counts)
+    }
+}
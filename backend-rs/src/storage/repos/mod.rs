@@ -0,0 +1,23 @@
+//! Database access behind traits. Services hold an `Arc<dyn ...Repo>` built
+//! from the pool by their `new` constructor; unit tests pass the generated
+//! `Mock...Repo` types to `with_repos` instead, so no database is needed.
+//! Writes that share a transaction with outbox events stay on the pool.
+
+pub mod contacts;
+pub mod keys;
+pub mod messages;
+pub mod users;
+
+pub use contacts::{ContactFilter, ContactRepo, PgContactRepo};
+pub use keys::{IdentityKey, KeyRepo, PgKeyRepo, PreKey, SignedPreKey};
+pub use messages::{MessageRepo, PgMessageRepo};
+pub use users::{PgUserRepo, UserRepo};
+
+#[cfg(test)]
+pub use contacts::MockContactRepo;
+#[cfg(test)]
+pub use keys::MockKeyRepo;
+#[cfg(test)]
+pub use messages::MockMessageRepo;
+#[cfg(test)]
+pub use users::MockUserRepo;
@@ -0,0 +1,120 @@
+use async_trait::async_trait;
+use sqlx::PgPool;
+use uuid::Uuid;
+
+use crate::{
+    error::AppResult,
+    models::{User, UserSearchCursor},
+};
+
+#[cfg_attr(test, mockall::automock)]
+#[async_trait]
+pub trait UserRepo: Send + Sync {
+    async fn find_by_id(&self, id: Uuid) -> AppResult<Option<User>>;
+
+    /// Users whose username or display name contains `query`, ignoring case,
+    /// as `viewer_id` may see them: contacts first, then by username, after
+    /// `after`. Users who opted out of discovery only match their contacts,
+    /// and users who blocked the viewer never match.
+    async fn search(
+        &self,
+        viewer_id: Uuid,
+        query: &str,
+        limit: i32,
+        after: Option<UserSearchCursor>,
+    ) -> AppResult<Vec<(User, bool)>>;
+
+    /// Users matching any of the phone numbers or emails
+    async fn find_by_identifiers(&self, identifiers: &[String]) -> AppResult<Vec<User>>;
+}
+
+#[derive(sqlx::FromRow)]
+struct SearchRow {
+    #[sqlx(flatten)]
+    user: User,
+    is_contact: bool,
+}
+
+pub struct PgUserRepo {
+    db: PgPool,
+}
+
+impl PgUserRepo {
+    pub fn new(db: PgPool) -> Self {
+        Self { db }
+    }
+}
+
+#[async_trait]
+impl UserRepo for PgUserRepo {
+    async fn find_by_id(&self, id: Uuid) -> AppResult<Option<User>> {
+        let user = sqlx::query_as("SELECT * FROM users WHERE id = $1")
+            .bind(id)
+            .fetch_optional(&self.db)
+            .await?;
+
+        Ok(user)
+    }
+
+    async fn search(
+        &self,
+        viewer_id: Uuid,
+        query: &str,
+        limit: i32,
+        after: Option<UserSearchCursor>,
+    ) -> AppResult<Vec<(User, bool)>> {
+        let search_pattern = format!(
+            "%{}%",
+            query
+                .to_lowercase()
+                .replace('\\', "\\\\")
+                .replace('%', "\\%")
+                .replace('_', "\\_")
+        );
+        let (after_contact, after_username) = match after {
+            Some(cursor) => (Some(cursor.is_contact), Some(cursor.username)),
+            None => (None, None),
+        };
+
+        let rows: Vec<SearchRow> = sqlx::query_as(
+            r#"
+            SELECT u.*, (c.id IS NOT NULL) AS is_contact
+            FROM users u
+            LEFT JOIN contacts c
+                ON c.user_id = $1 AND c.contact_id = u.id AND c.is_blocked = false
+            WHERE u.id != $1
+            AND (LOWER(u.username) LIKE $2 OR LOWER(u.display_name) LIKE $2)
+            AND (u.discoverable OR c.id IS NOT NULL)
+            AND NOT EXISTS (
+                SELECT 1 FROM contacts b
+                WHERE b.user_id = u.id AND b.contact_id = $1 AND b.is_blocked = true
+            )
+            AND (
+                $4::BOOLEAN IS NULL
+                OR ($4 AND c.id IS NULL)
+                OR ((c.id IS NOT NULL) = $4 AND u.username > $5)
+            )
+            ORDER BY is_contact DESC, u.username ASC
+            LIMIT $3
+            "#,
+        )
+        .bind(viewer_id)
+        .bind(&search_pattern)
+        .bind(limit)
+        .bind(after_contact)
+        .bind(after_username)
+        .fetch_all(&self.db)
+        .await?;
+
+        Ok(rows.into_iter().map(|r| (r.user, r.is_contact)).collect())
+    }
+
+    async fn find_by_identifiers(&self, identifiers: &[String]) -> AppResult<Vec<User>> {
+        let users = sqlx::query_as("SELECT * FROM users WHERE phone = ANY($1) OR email = ANY($1)")
+            .bind(identifiers)
+            .fetch_all(&self.db)
+            .await?;
+
+        Ok(users)
+    }
+}
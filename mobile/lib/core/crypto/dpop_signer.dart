@@ -0,0 +1,74 @@
+import 'dart:convert';
+import 'dart:math';
+
+import 'package:cryptography/cryptography.dart';
+
+import '../storage/secure_storage.dart';
+
+/// Signs DPoP proofs (RFC 9449) with an Ed25519 key generated on this
+/// device, so tokens the server binds to it are useless anywhere else
+class DpopSigner {
+  final SecureStorage _storage;
+  final _algorithm = Ed25519();
+  final _random = Random.secure();
+
+  Future<_DeviceKey>? _key;
+
+  DpopSigner(this._storage);
+
+  /// Proof for a request to [url]; pass [accessToken] when the request
+  /// carries one so the proof is tied to it
+  Future<String> proof(String method, Uri url, {String? accessToken}) async {
+    final key = await (_key ??= _loadOrCreateKey());
+
+    final header = {
+      'typ': 'dpop+jwt',
+      'alg': 'EdDSA',
+      'jwk': key.jwk,
+    };
+    final claims = {
+      'htm': method.toUpperCase(),
+      'htu': '${url.scheme}://${url.authority}${url.path}',
+      'iat': DateTime.now().millisecondsSinceEpoch ~/ 1000,
+      'jti': _encode(List<int>.generate(16, (_) => _random.nextInt(256))),
+      if (accessToken != null)
+        'ath': _encode((await Sha256().hash(utf8.encode(accessToken))).bytes),
+    };
+
+    final signingInput =
+        '${_encode(utf8.encode(jsonEncode(header)))}.${_encode(utf8.encode(jsonEncode(claims)))}';
+    final signature = await _algorithm.sign(
+      utf8.encode(signingInput),
+      keyPair: key.keyPair,
+    );
+
+    return '$signingInput.${_encode(signature.bytes)}';
+  }
+
+  Future<_DeviceKey> _loadOrCreateKey() async {
+    var seed = await _storage.getDpopKeySeed();
+    if (seed == null) {
+      final keyPair = await _algorithm.newKeyPair();
+      seed = await keyPair.extractPrivateKeyBytes();
+      await _storage.saveDpopKeySeed(seed);
+    }
+
+    final keyPair = await _algorithm.newKeyPairFromSeed(seed);
+    final publicKey = await keyPair.extractPublicKey();
+
+    return _DeviceKey(keyPair, {
+      'kty': 'OKP',
+      'crv': 'Ed25519',
+      'x': _encode(publicKey.bytes),
+    });
+  }
+
+  static String _encode(List<int> bytes) => base64Url.encode(bytes).replaceAll('=', '');
+}
+
+class _DeviceKey {
+  final SimpleKeyPair keyPair;
+  final Map<String, String> jwk;
+
+  _DeviceKey(this.keyPair, this.jwk);
+}
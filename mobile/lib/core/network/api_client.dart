@@ -1,21 +1,25 @@
 import 'package:dio/dio.dart';
 import 'package:flutter_riverpod/flutter_riverpod.dart';
 
+import '../crypto/dpop_signer.dart';
 import '../storage/secure_storage.dart';
 
 class ApiClient {
   late final Dio _dio;
   final SecureStorage _storage;
+  final DpopSigner _dpop;
 
   static const String baseUrl = 'http://localhost:8080/api/v1';
+  static const String clientVersion = '1.0.0';
 
-  ApiClient(this._storage) {
+  ApiClient(this._storage) : _dpop = DpopSigner(_storage) {
     _dio = Dio(BaseOptions(
       baseUrl: baseUrl,
       connectTimeout: const Duration(seconds: 30),
       receiveTimeout: const Duration(seconds: 30),
       headers: {
         'Content-Type': 'application/json',
+        'X-Client-Version': clientVersion,
       },
     ));
 
@@ -25,6 +29,11 @@ class ApiClient {
         if (token != null) {
           options.headers['Authorization'] = 'Bearer $token';
         }
+        options.headers['DPoP'] = await _dpop.proof(
+          options.method,
+          options.uri,
+          accessToken: token,
+        );
         return handler.next(options);
       },
       onError: (error, handler) async {
@@ -66,6 +75,11 @@ class ApiClient {
     }
   }
 
+  /// DPoP proof for a request made outside Dio, e.g. the WebSocket upgrade
+  Future<String> dpopProof(String method, Uri url, {String? accessToken}) {
+    return _dpop.proof(method, url, accessToken: accessToken);
+  }
+
   // Auth endpoints
   Future<Response> sendOTP(String target, String type) async {
     return _dio.post('/auth/otp/send', data: {
@@ -248,6 +262,18 @@ class ApiClient {
     return _dio.delete('/messages/$messageId');
   }
 
+  // Realtime fallback (long polling)
+  Future<Response> pollEvents({int? cursor, int timeout = 25}) async {
+    return _dio.get(
+      '/realtime/poll',
+      queryParameters: {
+        if (cursor != null) 'cursor': cursor,
+        'timeout': timeout,
+      },
+      options: Options(receiveTimeout: Duration(seconds: timeout + 10)),
+    );
+  }
+
   // Signal keys endpoints
   Future<Response> registerKeys(Map<String, dynamic> keys) async {
     return _dio.post('/keys/register', data: keys);
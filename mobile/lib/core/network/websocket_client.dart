@@ -2,9 +2,11 @@ import 'dart:async';
 import 'dart:convert';
 
 import 'package:flutter_riverpod/flutter_riverpod.dart';
+import 'package:web_socket_channel/io.dart';
 import 'package:web_socket_channel/web_socket_channel.dart';
 
 import '../storage/secure_storage.dart';
+import 'api_client.dart';
 
 enum ConnectionState { disconnected, connecting, connected, reconnecting }
 
@@ -30,11 +32,20 @@ class WebSocketMessage {
 class WebSocketClient {
   static const String wsUrl = 'ws://localhost:8080/api/v1/ws';
 
+  // After this many failed WebSocket attempts, fall back to long polling
+  static const int maxWsFailures = 2;
+  static const Duration wsRetryInterval = Duration(minutes: 5);
+
   final SecureStorage _storage;
+  final ApiClient _api;
   WebSocketChannel? _channel;
   ConnectionState _state = ConnectionState.disconnected;
   Timer? _reconnectTimer;
   Timer? _pingTimer;
+  Timer? _wsRetryTimer;
+  int _wsFailures = 0;
+  bool _polling = false;
+  int? _pollCursor;
 
   final _messageController = StreamController<WebSocketMessage>.broadcast();
   final _stateController = StreamController<ConnectionState>.broadcast();
@@ -43,7 +54,9 @@ class WebSocketClient {
   Stream<ConnectionState> get connectionState => _stateController.stream;
   ConnectionState get state => _state;
 
-  WebSocketClient(this._storage);
+  bool get isPolling => _polling;
+
+  WebSocketClient(this._storage, this._api);
 
   Future<void> connect() async {
     if (_state == ConnectionState.connecting || _state == ConnectionState.connected) {
@@ -59,10 +72,15 @@ class WebSocketClient {
         return;
       }
 
-      final uri = Uri.parse('$wsUrl?token=$token');
-      _channel = WebSocketChannel.connect(uri);
+      final uri = Uri.parse(wsUrl);
+      _channel = IOWebSocketChannel.connect(uri, headers: {
+        'Authorization': 'Bearer $token',
+        'DPoP': await _api.dpopProof('GET', uri, accessToken: token),
+      });
 
       await _channel!.ready;
+      _wsFailures = 0;
+      _stopPolling();
       _updateState(ConnectionState.connected);
 
       // Start ping timer
@@ -75,6 +93,12 @@ class WebSocketClient {
         onDone: _onDone,
       );
     } catch (e) {
+      _channel = null;
+      _wsFailures++;
+      if (_wsFailures >= maxWsFailures) {
+        _startPolling();
+        return;
+      }
       _updateState(ConnectionState.disconnected);
       _scheduleReconnect();
     }
@@ -83,8 +107,10 @@ class WebSocketClient {
   void disconnect() {
     _reconnectTimer?.cancel();
     _pingTimer?.cancel();
+    _stopPolling();
     _channel?.sink.close();
     _channel = null;
+    _wsFailures = 0;
     _updateState(ConnectionState.disconnected);
   }
 
@@ -123,6 +149,48 @@ class WebSocketClient {
     ));
   }
 
+  // Long-polling fallback for networks that block WebSockets. Receives the
+  // same events; typing and presence go through the REST endpoints.
+  void _startPolling() {
+    _updateState(ConnectionState.connected);
+    if (_polling) return;
+    _polling = true;
+    _pollLoop();
+
+    // Periodically check whether WebSockets work again
+    _wsRetryTimer?.cancel();
+    _wsRetryTimer = Timer.periodic(wsRetryInterval, (_) {
+      _wsFailures = maxWsFailures - 1;
+      _state = ConnectionState.reconnecting;
+      connect();
+    });
+  }
+
+  void _stopPolling() {
+    _polling = false;
+    _wsRetryTimer?.cancel();
+    _wsRetryTimer = null;
+  }
+
+  Future<void> _pollLoop() async {
+    while (_polling) {
+      try {
+        final response = await _api.pollEvents(cursor: _pollCursor);
+        if (!_polling) break;
+
+        final data = response.data as Map<String, dynamic>;
+        for (final event in data['events'] as List<dynamic>) {
+          _messageController.add(
+            WebSocketMessage.fromJson(event as Map<String, dynamic>),
+          );
+        }
+        _pollCursor = data['cursor'] as int;
+      } catch (e) {
+        await Future.delayed(const Duration(seconds: 5));
+      }
+    }
+  }
+
   void _onMessage(dynamic data) {
     try {
       final json = jsonDecode(data as String) as Map<String, dynamic>;
@@ -179,7 +247,8 @@ class WebSocketClient {
 // Provider
 final webSocketClientProvider = Provider<WebSocketClient>((ref) {
   final storage = ref.watch(secureStorageProvider);
-  final client = WebSocketClient(storage);
+  final api = ref.watch(apiClientProvider);
+  final client = WebSocketClient(storage, api);
   ref.onDispose(() => client.dispose());
   return client;
 });
@@ -11,6 +11,7 @@ class SecureStorage {
   static const _signalIdentityKeyKey = 'signal_identity_key';
   static const _signalRegistrationIdKey = 'signal_registration_id';
   static const _signalKeysInitializedKey = 'signal_keys_initialized';
+  static const _dpopKeySeedKey = 'dpop_key_seed';
 
   final FlutterSecureStorage _storage;
 
@@ -60,6 +61,17 @@ class SecureStorage {
     return _storage.read(key: _deviceIdKey);
   }
 
+  // Device key for DPoP proofs; kept across logouts
+  Future<void> saveDpopKeySeed(List<int> seed) async {
+    await _storage.write(key: _dpopKeySeedKey, value: jsonEncode(seed));
+  }
+
+  Future<List<int>?> getDpopKeySeed() async {
+    final data = await _storage.read(key: _dpopKeySeedKey);
+    if (data == null) return null;
+    return List<int>.from(jsonDecode(data));
+  }
+
   // Signal protocol keys
   Future<void> saveSignalIdentityKey(List<int> privateKey, List<int> publicKey) async {
     final data = jsonEncode({
@@ -0,0 +1,212 @@
+import type {
+  AddContactRequest,
+  AuthResponse,
+  ContactWithUser,
+  ConversationWithDetails,
+  CreateDirectRequest,
+  CreateGroupRequest,
+  DeviceWithRouting,
+  ErrorCode,
+  LoginRequest,
+  Message,
+  MessageResponse,
+  RefreshRequest,
+  RegisterRequest,
+  SendMessageRequest,
+  SendOtpRequest,
+  TokenResponse,
+  TypingRequest,
+  UpdateContactRequest,
+  User,
+  VerifyOtpRequest,
+  VerifyResponse,
+} from "./generated/index.js";
+
+export interface ClientOptions {
+  /** Server origin, e.g. `https://chat.example.com` */
+  baseUrl: string;
+  accessToken?: string;
+  /** API version in the path; defaults to 1 */
+  apiVersion?: 1 | 2;
+  fetch?: typeof fetch;
+}
+
+/** An error response, with the server's `code`, `message` and `details` */
+export class ApiError extends Error {
+  constructor(
+    readonly status: number,
+    /** `unknown` when the response wasn't an error envelope */
+    readonly code: ErrorCode | "unknown",
+    message: string,
+    readonly details: unknown,
+    /** Seconds to wait, for `rate_limited` and `dependency_unavailable` */
+    readonly retryAfter?: number,
+  ) {
+    super(message);
+    this.name = "ApiError";
+  }
+}
+
+type Query = Record<string, string | number | boolean | undefined>;
+
+export class ApiClient {
+  private accessToken?: string;
+  private readonly fetch: typeof fetch;
+
+  constructor(private readonly options: ClientOptions) {
+    this.accessToken = options.accessToken;
+    this.fetch = options.fetch ?? globalThis.fetch.bind(globalThis);
+  }
+
+  setAccessToken(token: string | undefined): void {
+    this.accessToken = token;
+  }
+
+  // Auth
+
+  sendOtp(req: SendOtpRequest): Promise<MessageResponse> {
+    return this.request("POST", "/auth/otp/send", { body: req });
+  }
+
+  verifyOtp(req: VerifyOtpRequest): Promise<VerifyResponse> {
+    return this.request("POST", "/auth/otp/verify", { body: req });
+  }
+
+  /** Register, and use the new access token from then on */
+  async register(req: RegisterRequest): Promise<AuthResponse> {
+    const res = await this.request<AuthResponse>("POST", "/auth/register", { body: req });
+    this.accessToken = res.tokens.access_token;
+    return res;
+  }
+
+  /** Log in, and use the new access token from then on */
+  async login(req: LoginRequest): Promise<AuthResponse> {
+    const res = await this.request<AuthResponse>("POST", "/auth/login", { body: req });
+    this.accessToken = res.tokens.access_token;
+    return res;
+  }
+
+  async refresh(req: RefreshRequest): Promise<TokenResponse> {
+    const res = await this.request<TokenResponse>("POST", "/auth/refresh", { body: req });
+    this.accessToken = res.tokens.access_token;
+    return res;
+  }
+
+  // Users, contacts and devices
+
+  me(): Promise<User> {
+    return this.request("GET", "/users/me");
+  }
+
+  contacts(opts: { includeBlocked?: boolean } = {}): Promise<ContactWithUser[]> {
+    return this.request("GET", "/contacts", {
+      query: { include_blocked: opts.includeBlocked },
+    });
+  }
+
+  addContact(req: AddContactRequest): Promise<ContactWithUser> {
+    return this.request("POST", "/contacts", { body: req });
+  }
+
+  /** Pass `version` (the ETag) to fail with `precondition_failed` if it changed since */
+  updateContact(
+    contactId: string,
+    req: UpdateContactRequest,
+    version?: number,
+  ): Promise<ContactWithUser> {
+    return this.request("PUT", `/contacts/${contactId}`, { body: req, version });
+  }
+
+  devices(): Promise<DeviceWithRouting[]> {
+    return this.request("GET", "/devices");
+  }
+
+  // Conversations and messages
+
+  conversations(opts: { limit?: number; offset?: number } = {}): Promise<
+    ConversationWithDetails[]
+  > {
+    return this.request("GET", "/conversations", { query: opts });
+  }
+
+  conversation(id: string): Promise<ConversationWithDetails> {
+    return this.request("GET", `/conversations/${id}`);
+  }
+
+  createDirectConversation(req: CreateDirectRequest): Promise<ConversationWithDetails> {
+    return this.request("POST", "/conversations/direct", { body: req });
+  }
+
+  createGroupConversation(req: CreateGroupRequest): Promise<ConversationWithDetails> {
+    return this.request("POST", "/conversations/group", { body: req });
+  }
+
+  /** Newest first; pass the oldest id seen as `before` for older history */
+  messages(
+    conversationId: string,
+    opts: { limit?: number; before?: string } = {},
+  ): Promise<Message[]> {
+    return this.request("GET", `/conversations/${conversationId}/messages`, {
+      query: opts,
+    });
+  }
+
+  sendMessage(conversationId: string, req: SendMessageRequest): Promise<Message> {
+    return this.request("POST", `/conversations/${conversationId}/messages`, {
+      body: req,
+    });
+  }
+
+  sendTyping(conversationId: string, req: TypingRequest): Promise<MessageResponse> {
+    return this.request("POST", `/conversations/${conversationId}/typing`, {
+      body: req,
+    });
+  }
+
+  private async request<T>(
+    method: string,
+    path: string,
+    opts: { body?: unknown; query?: Query; version?: number } = {},
+  ): Promise<T> {
+    const url = new URL(
+      `/api/v${this.options.apiVersion ?? 1}${path}`,
+      this.options.baseUrl,
+    );
+    for (const [key, value] of Object.entries(opts.query ?? {})) {
+      if (value !== undefined) {
+        url.searchParams.set(key, String(value));
+      }
+    }
+
+    const headers: Record<string, string> = { Accept: "application/json" };
+    if (this.accessToken) {
+      headers.Authorization = `Bearer ${this.accessToken}`;
+    }
+    if (opts.body !== undefined) {
+      headers["Content-Type"] = "application/json";
+    }
+    if (opts.version !== undefined) {
+      headers["If-Match"] = `"${opts.version}"`;
+    }
+
+    const res = await this.fetch(url, {
+      method,
+      headers,
+      body: opts.body === undefined ? undefined : JSON.stringify(opts.body),
+    });
+
+    if (!res.ok) {
+      const error = await res.json().catch(() => ({}));
+      const retryAfter = res.headers.get("Retry-After");
+      throw new ApiError(
+        res.status,
+        error.code ?? "unknown",
+        error.message ?? res.statusText,
+        error.details,
+        retryAfter ? Number(retryAfter) : undefined,
+      );
+    }
+
+    return (await res.json()) as T;
+  }
+}
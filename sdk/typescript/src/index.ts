@@ -0,0 +1,3 @@
+export type * from "./generated/index.js";
+export * from "./client.js";
+export * from "./realtime.js";
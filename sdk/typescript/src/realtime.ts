@@ -0,0 +1,83 @@
+import type { ClientEvent, ServerEvent } from "./generated/index.js";
+
+/** The part of a WebSocket the connection uses */
+export interface WebSocketLike {
+  send(data: string): void;
+  close(code?: number, reason?: string): void;
+  onopen: ((event: unknown) => void) | null;
+  onmessage: ((event: { data: unknown }) => void) | null;
+  onclose: ((event: unknown) => void) | null;
+  onerror: ((event: unknown) => void) | null;
+}
+
+/**
+ * Opens the socket. The server only accepts the access token in the
+ * `Authorization` header, so this must be a WebSocket that can send headers,
+ * e.g. `(url, headers) => new WebSocket(url, { headers })` with the `ws`
+ * package.
+ */
+export type SocketFactory = (url: string, headers: Record<string, string>) => WebSocketLike;
+
+export interface RealtimeOptions {
+  /** Server origin, e.g. `https://chat.example.com` */
+  baseUrl: string;
+  accessToken: string;
+  apiVersion?: 1 | 2;
+  socket: SocketFactory;
+}
+
+type EventOf<T extends ServerEvent["type"]> = Extract<ServerEvent, { type: T }>;
+type Handler<T extends ServerEvent["type"]> = (payload: EventOf<T>["payload"]) => void;
+
+/** A typed connection to `/ws`, delivering `{type, payload}` events */
+export class RealtimeConnection {
+  private readonly socket: WebSocketLike;
+  private readonly handlers = new Map<string, Set<(payload: unknown) => void>>();
+
+  constructor(options: RealtimeOptions) {
+    const url = new URL(`/api/v${options.apiVersion ?? 1}/ws`, options.baseUrl);
+    url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+
+    this.socket = options.socket(url.toString(), {
+      Authorization: `Bearer ${options.accessToken}`,
+    });
+    this.socket.onmessage = (event) => this.dispatch(event.data);
+  }
+
+  /** Calls `handler` with the payload of every `type` event; returns an unsubscribe function */
+  on<T extends ServerEvent["type"]>(type: T, handler: Handler<T>): () => void {
+    let handlers = this.handlers.get(type);
+    if (!handlers) {
+      handlers = new Set();
+      this.handlers.set(type, handlers);
+    }
+    const entry = handler as (payload: unknown) => void;
+    handlers.add(entry);
+    return () => handlers.delete(entry);
+  }
+
+  send(event: ClientEvent): void {
+    this.socket.send(JSON.stringify(event));
+  }
+
+  close(): void {
+    this.socket.close();
+  }
+
+  private dispatch(data: unknown): void {
+    if (typeof data !== "string") {
+      return;
+    }
+
+    let event: ServerEvent;
+    try {
+      event = JSON.parse(data);
+    } catch {
+      return;
+    }
+
+    for (const handler of this.handlers.get(event.type) ?? []) {
+      handler(event.payload);
+    }
+  }
+}